@@ -32,37 +32,90 @@ package archive
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
-	"github.com/uwedeportivo/torrentzip/cgzip"
+	"github.com/uwedeportivo/romba/types"
 )
 
 const (
 	zipSuffix  = ".zip"
+	rarSuffix  = ".rar"
 	gzipSuffix = ".gz"
+	chdSuffix  = ".chd"
 	datSuffix  = ".dat"
 	fixPrefix  = "fix-"
 )
 
+const blake3Size = 32
+
+// tmpDirName is the directory inside each depot root where files are written
+// before being renamed into place. Anything left in it is from an interrupted
+// write and gets removed when the depot is opened.
+const tmpDirName = ".romba_tmp"
+
+// streamTmpPrefix starts the names of the temp files members are compressed
+// into while being hashed.
+const streamTmpPrefix = "streamed-"
+
+// Hashes holds the digests of a file. Sha256 and Blake3 are optional and only
+// computed for Hashes created with extended hashing.
 type Hashes struct {
-	Crc  []byte
-	Md5  []byte
-	Sha1 []byte
+	Crc    types.Crc32
+	Md5    types.Md5Sum
+	Sha1   types.Sha1Sum
+	Sha256 []byte
+	Blake3 []byte
 }
 
-func newHashes() *Hashes {
+func newHashes(extended bool) *Hashes {
 	rs := new(Hashes)
 	rs.Crc = make([]byte, 0, crc32.Size)
 	rs.Md5 = make([]byte, 0, md5.Size)
 	rs.Sha1 = make([]byte, 0, sha1.Size)
+	if extended {
+		rs.Sha256 = make([]byte, 0, sha256.Size)
+		rs.Blake3 = make([]byte, 0, blake3Size)
+	}
 	return rs
 }
 
+func (hh *Hashes) extended() bool {
+	return hh.Sha256 != nil
+}
+
+// rom returns a rom with a copy of these hashes.
+func (hh *Hashes) rom(name, path string, size int64) *types.Rom {
+	rom := new(types.Rom)
+	rom.Crc = make([]byte, crc32.Size)
+	rom.Md5 = make([]byte, md5.Size)
+	rom.Sha1 = make([]byte, sha1.Size)
+	copy(rom.Crc, hh.Crc)
+	copy(rom.Md5, hh.Md5)
+	copy(rom.Sha1, hh.Sha1)
+	if hh.extended() {
+		rom.Sha256 = make([]byte, sha256.Size)
+		rom.Blake3 = make([]byte, blake3Size)
+		copy(rom.Sha256, hh.Sha256)
+		copy(rom.Blake3, hh.Blake3)
+	}
+	rom.Name = name
+	rom.Size = size
+	rom.Path = path
+	return rom
+}
+
 func (hh *Hashes) forFile(inpath string) error {
 	file, err := os.Open(inpath)
 	if err != nil {
@@ -74,15 +127,22 @@ func (hh *Hashes) forFile(inpath string) error {
 }
 
 func (hh *Hashes) forReader(in io.Reader) error {
-	br := bufio.NewReader(in)
+	he := currentHashEngine()
 
-	hSha1 := sha1.New()
-	hMd5 := md5.New()
-	hCrc := cgzip.NewCrc32()
+	hSha1 := he.NewSha1()
+	hMd5 := he.NewMd5()
+	hCrc := he.NewCrc32()
 
-	w := io.MultiWriter(hSha1, hMd5, hCrc)
+	var hSha256, hBlake3 hash.Hash
+	var err error
 
-	_, err := io.Copy(w, br)
+	if hh.extended() {
+		hSha256 = he.NewSha256()
+		hBlake3 = he.NewBlake3()
+		err = he.hash(in, hSha1, hMd5, hCrc, hSha256, hBlake3)
+	} else {
+		err = he.hash(in, hSha1, hMd5, hCrc)
+	}
 	if err != nil {
 		return err
 	}
@@ -91,23 +151,24 @@ func (hh *Hashes) forReader(in io.Reader) error {
 	hh.Md5 = hMd5.Sum(hh.Md5[0:0])
 	hh.Sha1 = hSha1.Sum(hh.Sha1[0:0])
 
+	if hh.extended() {
+		hh.Sha256 = hSha256.Sum(hh.Sha256[0:0])
+		hh.Blake3 = hBlake3.Sum(hh.Blake3[0:0])
+	}
+
 	return nil
 }
 
-func HashesForGZFile(inpath string) (*Hashes, error) {
-	file, err := os.Open(inpath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	gzipReader, err := cgzip.NewReader(file)
+// HashesForDepotFile returns the hashes of the decompressed contents of the
+// depot file inpath.
+func HashesForDepotFile(inpath string) (*Hashes, error) {
+	r, err := openDepotFile(inpath)
 	if err != nil {
 		return nil, err
 	}
-	defer gzipReader.Close()
+	defer r.Close()
 
-	return hashesForReader(gzipReader)
+	return hashesForReader(r)
 }
 
 func HashesForFile(inpath string) (*Hashes, error) {
@@ -121,13 +182,13 @@ func HashesForFile(inpath string) (*Hashes, error) {
 }
 
 func hashesForReader(in io.Reader) (*Hashes, error) {
-	hSha1 := sha1.New()
-	hMd5 := md5.New()
-	hCrc := crc32.NewIEEE()
+	he := currentHashEngine()
 
-	w := io.MultiWriter(hSha1, hMd5, hCrc)
+	hSha1 := he.NewSha1()
+	hMd5 := he.NewMd5()
+	hCrc := he.NewCrc32()
 
-	_, err := io.Copy(w, in)
+	err := he.hash(in, hSha1, hMd5, hCrc)
 	if err != nil {
 		return nil, err
 	}
@@ -151,9 +212,10 @@ func sha1ForFile(inpath string) ([]byte, error) {
 }
 
 func sha1ForReader(in io.Reader) ([]byte, error) {
-	h := sha1.New()
+	he := currentHashEngine()
+	h := he.NewSha1()
 
-	_, err := io.Copy(h, in)
+	err := he.hash(in, h)
 	if err != nil {
 		return nil, err
 	}
@@ -161,17 +223,10 @@ func sha1ForReader(in io.Reader) ([]byte, error) {
 	return h.Sum(nil), nil
 }
 
+// pathFromSha1HexEncoding returns the path of the depot file for the given hex
+// encoded SHA1 below root in the default layout.
 func pathFromSha1HexEncoding(root, hexStr, suffix string) string {
-	prefix := hexStr[0:8]
-	pieces := make([]string, 6)
-
-	pieces[0] = root
-	for i := 0; i < 4; i++ {
-		pieces[i+1] = prefix[2*i : 2*i+2]
-	}
-	pieces[5] = hexStr + suffix
-
-	return filepath.Join(pieces...)
+	return DefaultLayout.path(root, hexStr, suffix)
 }
 
 func PathExists(path string) (bool, error) {
@@ -185,6 +240,52 @@ func PathExists(path string) (bool, error) {
 	return false, err
 }
 
+// spool copies r into a temporary file and returns its path and size. It is
+// used for members of archive formats that can only be read sequentially, since
+// archiving needs to read a member twice (once for hashing, once for compressing).
+func spool(r io.Reader) (string, int64, error) {
+	tmpfile, err := ioutil.TempFile("", "romba-spool")
+	if err != nil {
+		return "", 0, err
+	}
+
+	bw := bufio.NewWriter(tmpfile)
+
+	n, err := io.Copy(bw, r)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return "", 0, err
+	}
+
+	err = tmpfile.Close()
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return "", 0, err
+	}
+	return tmpfile.Name(), n, nil
+}
+
+// spoolFile is a temp file made by spool, removed once the last compress job
+// reading it is done.
+type spoolFile struct {
+	path string
+	refs int32
+}
+
+func (sf *spoolFile) acquire() {
+	atomic.AddInt32(&sf.refs, 1)
+}
+
+func (sf *spoolFile) release() {
+	if atomic.AddInt32(&sf.refs, -1) == 0 {
+		os.Remove(sf.path)
+	}
+}
+
 type countWriter struct {
 	w     io.Writer
 	count int64
@@ -196,32 +297,66 @@ func (w *countWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func archive(outpath string, r io.Reader, extra []byte) (int64, error) {
-	br := bufio.NewReader(r)
+// archive compresses r with codec c into outpath with the given extra header.
+// The data is written to a temp file in tmpDir first and only renamed to
+// outpath once it is complete and, if wantSha1 is non nil, its uncompressed
+// contents match wantSha1. tmpDir must be on the same filesystem as outpath.
+func archive(c *codec, outpath, tmpDir string, r io.Reader, extra []byte, wantSha1 []byte) (int64, error) {
+	err := os.MkdirAll(tmpDir, 0777)
+	if err != nil {
+		return 0, err
+	}
 
-	err := os.MkdirAll(filepath.Dir(outpath), 0777)
+	outfile, err := ioutil.TempFile(tmpDir, filepath.Base(outpath))
 	if err != nil {
 		return 0, err
 	}
 
-	outfile, err := os.Create(outpath)
+	tmppath := outfile.Name()
+
+	n, err := compress(c, outfile, r, extra, wantSha1)
+	if err == nil {
+		err = outfile.Sync()
+	}
+	if cerr := outfile.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
+		os.Remove(tmppath)
+		return 0, fmt.Errorf("archiving %s failed: %v", outpath, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(outpath), 0777)
+	if err == nil {
+		err = os.Rename(tmppath, outpath)
+	}
+	if err != nil {
+		os.Remove(tmppath)
 		return 0, err
 	}
 
+	return n, nil
+}
+
+func compress(c *codec, outfile io.Writer, r io.Reader, extra []byte, wantSha1 []byte) (int64, error) {
+	var h hash.Hash
+
+	if wantSha1 != nil {
+		h = sha1.New()
+		r = io.TeeReader(r, h)
+	}
+
+	br := bufio.NewReader(r)
+
 	cw := &countWriter{
 		w: outfile,
 	}
 
 	bufout := bufio.NewWriter(cw)
 
-	zipWriter := cgzip.NewWriter(bufout)
-
-	if len(extra) > 0 {
-		err = zipWriter.SetExtraHeader(extra)
-		if err != nil {
-			return 0, err
-		}
+	zipWriter, err := c.newWriter(bufout, extra)
+	if err != nil {
+		return 0, err
 	}
 
 	_, err = io.Copy(zipWriter, br)
@@ -234,12 +369,15 @@ func archive(outpath string, r io.Reader, extra []byte) (int64, error) {
 		return 0, err
 	}
 
-	bufout.Flush()
-
-	err = outfile.Close()
+	err = bufout.Flush()
 	if err != nil {
 		return 0, err
 	}
 
+	if h != nil && !bytes.Equal(h.Sum(nil), wantSha1) {
+		return 0, fmt.Errorf("sha1 mismatch: expected %s, got %s",
+			hex.EncodeToString(wantSha1), hex.EncodeToString(h.Sum(nil)))
+	}
+
 	return cw.count, nil
 }
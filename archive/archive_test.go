@@ -0,0 +1,180 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDepotHeaderRoundTrip(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-archive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := []byte("some rom contents")
+
+	for _, c := range codecs {
+		for _, extended := range []bool{false, true} {
+			hh := newHashes(extended)
+			err := hh.forReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			outpath := filepath.Join(root, "rom"+c.suffix)
+			_, err = archive(c, outpath, filepath.Join(root, tmpDirName), bytes.NewReader(data),
+				hh.depotExtra(nil, int64(len(data))), hh.Sha1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dh, err := ReadDepotHeader(outpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dh == nil {
+				t.Fatalf("%s extended=%v: no depot header", c.name, extended)
+			}
+
+			if dh.Size != int64(len(data)) {
+				t.Errorf("%s extended=%v: size %d, expected %d", c.name, extended, dh.Size, len(data))
+			}
+			if !bytes.Equal(dh.Md5, hh.Md5) || !bytes.Equal(dh.Crc, hh.Crc) || !bytes.Equal(dh.Sha1, hh.Sha1) ||
+				!bytes.Equal(dh.Sha256, hh.Sha256) || !bytes.Equal(dh.Blake3, hh.Blake3) {
+				t.Errorf("%s extended=%v: header hashes %+v, expected %+v", c.name, extended, dh.Hashes, *hh)
+			}
+
+			r, err := openDepotFile(outpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(contents, data) {
+				t.Errorf("%s extended=%v: decompressed %q, expected %q", c.name, extended, contents, data)
+			}
+
+			os.Remove(outpath)
+		}
+	}
+}
+
+func TestParseLegacyDepotExtra(t *testing.T) {
+	hh := newHashes(true)
+	err := hh.forReader(bytes.NewReader([]byte("legacy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extra := append(append(append(append([]byte{}, hh.Md5...), hh.Crc...), hh.Sha256...), hh.Blake3...)
+
+	dh, err := parseDepotExtra(extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dh.Size != -1 || dh.Sha1 != nil {
+		t.Errorf("legacy header should have no size or sha1, got %d and %x", dh.Size, dh.Sha1)
+	}
+	if !bytes.Equal(dh.Sha256, hh.Sha256) || !bytes.Equal(dh.Blake3, hh.Blake3) {
+		t.Errorf("legacy header extended hashes mismatch")
+	}
+
+	dh, err = parseDepotExtra(extra[:legacyDepotExtraSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dh.Md5, hh.Md5) || !bytes.Equal(dh.Crc, hh.Crc) || dh.Sha256 != nil {
+		t.Errorf("legacy header mismatch: %+v", dh)
+	}
+
+	_, err = parseDepotExtra(extra[:7])
+	if err == nil {
+		t.Errorf("expected error for bogus header length")
+	}
+}
+
+func TestArchiveVerifiesSha1(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-archive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := []byte("some rom contents")
+	sum := sha1.Sum(data)
+	tmpDir := filepath.Join(root, tmpDirName)
+
+	good := filepath.Join(root, "good.gz")
+	n, err := archive(gzipCodec, good, tmpDir, bytes.NewReader(data), nil, sum[:])
+	if err != nil {
+		t.Fatalf("archive failed: %v", err)
+	}
+
+	fi, err := os.Stat(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != n {
+		t.Fatalf("reported compressed size %d, file has %d", n, fi.Size())
+	}
+
+	bad := filepath.Join(root, "bad.gz")
+	_, err = archive(gzipCodec, bad, tmpDir, bytes.NewReader(data[1:]), nil, sum[:])
+	if err == nil {
+		t.Fatalf("expected sha1 mismatch error")
+	}
+
+	exists, err := PathExists(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatalf("depot file %s committed despite sha1 mismatch", bad)
+	}
+
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected empty tmp dir, found %d entries", len(entries))
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// setFile is a file found in a set folder, loose or a member of a zip.
+type setFile struct {
+	// key is where the file is in the set, slash separated: the path
+	// relative to the set folder, with zips standing in for directories
+	// named like them without the .zip suffix.
+	key string
+	// path of the file, for zip members the path of the zip joined with the
+	// member name.
+	path string
+	// zipPath is the zip holding the file, empty for loose files.
+	zipPath string
+	member  string
+	rom     *types.Rom
+}
+
+// scanSet hashes all files of the set folder setpath, looking into zips.
+func scanSet(setpath string) ([]*setFile, error) {
+	var sfs []*setFile
+
+	err := filepath.Walk(setpath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// leftovers of builds and rebuilds
+		if strings.HasPrefix(fi.Name(), ".romba-") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() || fi.Name() == ".DS_Store" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(setpath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if strings.ToLower(filepath.Ext(path)) != zipSuffix {
+			hh, err := HashesForFile(path)
+			if err != nil {
+				return err
+			}
+			sfs = append(sfs, &setFile{
+				key:  rel,
+				path: path,
+				rom:  hh.rom(fi.Name(), path, fi.Size()),
+			})
+			return nil
+		}
+
+		zr, err := czip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		gameKey := strings.TrimSuffix(rel, filepath.Ext(rel))
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+
+			r, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			hh, err := hashesForReader(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+
+			memberPath := filepath.Join(path, filepath.FromSlash(zf.Name))
+			sfs = append(sfs, &setFile{
+				key:     gameKey + "/" + zf.Name,
+				path:    memberPath,
+				zipPath: path,
+				member:  zf.Name,
+				rom:     hh.rom(filepath.Base(memberPath), memberPath, zf.FileInfo().Size()),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sfs, nil
+}
+
+// setRom is a rom of a dat along with where it belongs in a set folder.
+type setRom struct {
+	game *types.Game
+	rom  *types.Rom
+	// key is where the rom belongs, see setFile.
+	key string
+}
+
+// setIndex finds the roms of a dat by content.
+type setIndex struct {
+	roms  []*setRom
+	byKey map[string]*setRom
+	// bySha1 and byCrc hold the roms by hex encoded SHA1 and by hex encoded
+	// CRC and size, for roms without SHA1
+	bySha1 map[string][]*setRom
+	byCrc  map[string][]*setRom
+}
+
+func crcKey(crc []byte, size int64) string {
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(crc), size)
+}
+
+func newSetIndex(dat *types.Dat) *setIndex {
+	si := &setIndex{
+		byKey:  make(map[string]*setRom),
+		bySha1: make(map[string][]*setRom),
+		byCrc:  make(map[string][]*setRom),
+	}
+
+	for _, game := range dat.Games {
+		for _, rom := range game.AllRoms() {
+			if rom.NoDump() || (rom.Sha1 == nil && rom.Crc == nil) {
+				// nodump, nothing to look for
+				continue
+			}
+
+			sr := &setRom{
+				game: game,
+				rom:  rom,
+				key:  game.Name + "/" + romEntryName(rom),
+			}
+			if _, ok := si.byKey[sr.key]; ok {
+				continue
+			}
+
+			si.roms = append(si.roms, sr)
+			si.byKey[sr.key] = sr
+			if rom.Sha1 != nil {
+				sha1Hex := hex.EncodeToString(rom.Sha1)
+				si.bySha1[sha1Hex] = append(si.bySha1[sha1Hex], sr)
+			} else {
+				ck := crcKey(rom.Crc, rom.Size)
+				si.byCrc[ck] = append(si.byCrc[ck], sr)
+			}
+		}
+	}
+	return si
+}
+
+// matches reports whether the contents of the found rom are those of the dat
+// rom want, by SHA1 if want has one and by CRC and size otherwise.
+func (sr *setRom) matches(found *types.Rom) bool {
+	if sr.rom.Sha1 != nil {
+		return bytes.Equal(sr.rom.Sha1, found.Sha1)
+	}
+	return bytes.Equal(sr.rom.Crc, found.Crc) && sr.rom.Size == found.Size
+}
+
+// withContent returns the roms of the dat the found rom has the contents of.
+func (si *setIndex) withContent(found *types.Rom) []*setRom {
+	var srs []*setRom
+	srs = append(srs, si.bySha1[hex.EncodeToString(found.Sha1)]...)
+	srs = append(srs, si.byCrc[crcKey(found.Crc, found.Size)]...)
+	return srs
+}
+
+// AuditEntry is a rom of a dat or a file of a set folder in an audit report.
+type AuditEntry struct {
+	Game string
+	Rom  string
+	// Path of the file in the set folder, empty for missing roms.
+	Path string
+}
+
+// AuditReport is the result of comparing a set folder against a dat.
+type AuditReport struct {
+	// Have are the roms of the dat found where they belong.
+	Have []*AuditEntry
+	// Miss are the roms of the dat not found anywhere in the set folder.
+	Miss []*AuditEntry
+	// Unneeded are the files of the set folder that aren't roms of the dat,
+	// or duplicates of roms found where they belong. Only Path is set.
+	Unneeded []*AuditEntry
+	// WronglyNamed are files of the set folder holding a rom of the dat that
+	// isn't found where it belongs, with Game and Rom telling where it does.
+	WronglyNamed []*AuditEntry
+	// Completeness counts the roms of Have as present.
+	Completeness *types.Completeness
+}
+
+// Audit compares the set folder setpath against dat, without changing
+// anything. Games are expected as zips or directories named after the game
+// holding files named after the roms, as BuildDat builds them.
+func Audit(dat *types.Dat, setpath string) (*AuditReport, error) {
+	sfs, err := scanSet(setpath)
+	if err != nil {
+		return nil, err
+	}
+
+	si := newSetIndex(dat)
+	ar := new(AuditReport)
+
+	have := make(map[*setRom]bool)
+	placed := make(map[*setFile]bool)
+	for _, sf := range sfs {
+		if sr, ok := si.byKey[sf.key]; ok && !have[sr] && sr.matches(sf.rom) {
+			have[sr] = true
+			placed[sf] = true
+			ar.Have = append(ar.Have, &AuditEntry{Game: sr.game.Name, Rom: sr.rom.Name, Path: sf.path})
+		}
+	}
+
+	misnamed := make(map[*setRom]bool)
+	for _, sf := range sfs {
+		if placed[sf] {
+			continue
+		}
+
+		var elsewhere *setRom
+		for _, sr := range si.withContent(sf.rom) {
+			if !have[sr] && sr.matches(sf.rom) {
+				elsewhere = sr
+				break
+			}
+		}
+
+		if elsewhere == nil {
+			ar.Unneeded = append(ar.Unneeded, &AuditEntry{Path: sf.path})
+			continue
+		}
+
+		misnamed[elsewhere] = true
+		ar.WronglyNamed = append(ar.WronglyNamed,
+			&AuditEntry{Game: elsewhere.game.Name, Rom: elsewhere.rom.Name, Path: sf.path})
+	}
+
+	haveRoms := make(map[*types.Rom]bool)
+	for _, sr := range si.roms {
+		if have[sr] {
+			haveRoms[sr.rom] = true
+		}
+		if !have[sr] && !misnamed[sr] {
+			ar.Miss = append(ar.Miss, &AuditEntry{Game: sr.game.Name, Rom: sr.rom.Name})
+		}
+	}
+
+	ar.Completeness = types.CompletenessOf(dat, func(rom *types.Rom) bool {
+		return haveRoms[rom]
+	})
+	return ar, nil
+}
+
+// WriteReports writes the have, miss, unneeded and wrongly named reports into
+// dir, as tab separated files named after name.
+func (ar *AuditReport) WriteReports(dir, name string) error {
+	for _, report := range []struct {
+		suffix  string
+		entries []*AuditEntry
+	}{
+		{"-have.txt", ar.Have},
+		{"-miss.txt", ar.Miss},
+		{"-unneeded.txt", ar.Unneeded},
+		{"-wrongly-named.txt", ar.WronglyNamed},
+	} {
+		err := writeAuditReport(filepath.Join(dir, name+report.suffix), report.entries)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAuditReport(outpath string, entries []*AuditEntry) error {
+	lines := make([]string, len(entries))
+	for i, ae := range entries {
+		switch {
+		case ae.Game == "":
+			lines[i] = ae.Path
+		case ae.Path == "":
+			lines[i] = ae.Game + "\t" + ae.Rom
+		default:
+			lines[i] = ae.Game + "\t" + ae.Rom + "\t" + ae.Path
+		}
+	}
+	sort.Strings(lines)
+
+	file, err := os.Create(outpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bw := bufio.NewWriter(file)
+	for _, line := range lines {
+		fmt.Fprintln(bw, line)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func romFor(t *testing.T, name string, data []byte) *types.Rom {
+	hh := newHashes(false)
+	err := hh.forReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hh.rom(name, "", int64(len(data)))
+}
+
+func writeZip(t *testing.T, outpath string, members map[string][]byte) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range members {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(outpath, buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	setDir, err := ioutil.TempDir("", "romba-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(setDir)
+
+	dataA := []byte("rom a of game one")
+	dataB := []byte("rom b of game one")
+	dataC := []byte("rom c of game two")
+
+	dat := &types.Dat{
+		Name: "audit",
+		Games: types.GameSlice{
+			{Name: "one", Roms: types.RomSlice{romFor(t, "a.bin", dataA), romFor(t, "b.bin", dataB)}},
+			{Name: "two", Roms: types.RomSlice{romFor(t, "c.bin", dataC)}},
+		},
+	}
+
+	writeZip(t, filepath.Join(setDir, "one.zip"), map[string][]byte{
+		"a.bin":         dataA,
+		"b-renamed.bin": dataB,
+	})
+
+	err = os.MkdirAll(filepath.Join(setDir, "two"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(setDir, "two", "junk.txt"), []byte("not a rom"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ar, err := Audit(dat, setDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(what string, got []*AuditEntry, want *AuditEntry) {
+		if len(got) != 1 || *got[0] != *want {
+			t.Errorf("got %s %v, want %v", what, got, want)
+		}
+	}
+
+	check("have", ar.Have, &AuditEntry{Game: "one", Rom: "a.bin", Path: filepath.Join(setDir, "one.zip", "a.bin")})
+	check("miss", ar.Miss, &AuditEntry{Game: "two", Rom: "c.bin"})
+	check("unneeded", ar.Unneeded, &AuditEntry{Path: filepath.Join(setDir, "two", "junk.txt")})
+	check("wrongly named", ar.WronglyNamed,
+		&AuditEntry{Game: "one", Rom: "b.bin", Path: filepath.Join(setDir, "one.zip", "b-renamed.bin")})
+
+	// the wrongly named rom isn't where it belongs
+	c := ar.Completeness
+	if c.Have.Roms != 1 || c.Missing.Roms != 2 || c.CompleteGames != 0 || c.Have.Bytes != int64(len(dataA)) {
+		t.Errorf("got completeness %s", c)
+	}
+
+	reportDir := filepath.Join(setDir, "reports")
+	err = os.MkdirAll(reportDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ar.WriteReports(reportDir, dat.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	miss, err := ioutil.ReadFile(filepath.Join(reportDir, "audit-miss.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(miss) != "two\tc.bin\n" {
+		t.Errorf("got miss report %q", miss)
+	}
+}
@@ -0,0 +1,582 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/uwedeportivo/torrentzip"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// gameSink receives the roms of one game being built.
+type gameSink interface {
+	// Create returns the writer for the rom named name, a slash separated
+	// path relative to the game.
+	Create(name string) (io.Writer, error)
+	// Close commits the game.
+	Close() error
+	// Abort discards whatever has been written for the game.
+	Abort()
+}
+
+// buildTmpPrefix starts the names of the files and directories games are
+// written to before being renamed into place.
+const buildTmpPrefix = ".romba-build-"
+
+// BuildLeftovers returns the partial games an interrupted build left behind
+// below outpath.
+func BuildLeftovers(outpath string) ([]string, error) {
+	var leftovers []string
+	err := filepath.Walk(outpath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == outpath {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if strings.HasPrefix(info.Name(), buildTmpPrefix) {
+			leftovers = append(leftovers, path)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return leftovers, err
+}
+
+// sinkFactory creates the sink for game inside the dat's output directory
+// datPath.
+type sinkFactory func(datPath string, game *types.Game) (gameSink, error)
+
+// torrentzipSink writes a game into a torrentzip file. The file is written
+// under a temporary name and renamed into place when complete, so that an
+// interrupted build never leaves truncated zips behind.
+type torrentzipSink struct {
+	file    *os.File
+	tw      *torrentzip.Writer
+	outpath string
+}
+
+func newTorrentzipSink(datPath string, game *types.Game) (gameSink, error) {
+	outpath, err := joinEntryName(datPath, game.Name+zipSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(outpath), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(outpath), buildTmpPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	tw, err := torrentzip.NewWriter(file)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &torrentzipSink{
+		file:    file,
+		tw:      tw,
+		outpath: outpath,
+	}, nil
+}
+
+func (ts *torrentzipSink) Create(name string) (io.Writer, error) {
+	return ts.tw.Create(name)
+}
+
+func (ts *torrentzipSink) Close() error {
+	err := ts.tw.Close()
+	if err != nil {
+		ts.Abort()
+		return err
+	}
+
+	err = ts.file.Close()
+	if err != nil {
+		os.Remove(ts.file.Name())
+		return err
+	}
+
+	return os.Rename(ts.file.Name(), ts.outpath)
+}
+
+func (ts *torrentzipSink) Abort() {
+	ts.file.Close()
+	os.Remove(ts.file.Name())
+}
+
+// dirSink writes a game as a plain directory of files. The directory is
+// assembled under a temporary name and renamed into place when complete,
+// replacing an earlier build of the game.
+type dirSink struct {
+	tmpDir  string
+	outpath string
+	file    *os.File
+}
+
+func newDirSink(datPath string, game *types.Game) (gameSink, error) {
+	outpath, err := joinEntryName(datPath, game.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(outpath), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(outpath), buildTmpPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dirSink{
+		tmpDir:  tmpDir,
+		outpath: outpath,
+	}, nil
+}
+
+func (ds *dirSink) Create(name string) (io.Writer, error) {
+	err := ds.closeFile()
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := joinEntryName(ds.tmpDir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(fpath), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	ds.file, err = os.Create(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return ds.file, nil
+}
+
+func (ds *dirSink) closeFile() error {
+	if ds.file == nil {
+		return nil
+	}
+	err := ds.file.Close()
+	ds.file = nil
+	return err
+}
+
+func (ds *dirSink) Close() error {
+	err := ds.closeFile()
+	if err != nil {
+		ds.Abort()
+		return err
+	}
+
+	err = os.RemoveAll(ds.outpath)
+	if err != nil {
+		ds.Abort()
+		return err
+	}
+
+	return os.Rename(ds.tmpDir, ds.outpath)
+}
+
+func (ds *dirSink) Abort() {
+	ds.closeFile()
+	os.RemoveAll(ds.tmpDir)
+}
+
+// BuildOptions controls the output of a build.
+type BuildOptions struct {
+	// Unzipped writes each game as a directory of plain files instead of a
+	// torrentzip file.
+	Unzipped bool
+	// CHD, if set, builds the games of CD images, the ones with a cue or gdi
+	// file, into CHDs with it.
+	CHD CHDTool
+	// Sets spreads the roms of parents and clones over the games like the
+	// set type it names, see types.SetMode. Games are built as the dat has
+	// them by default.
+	Sets types.SetMode
+	// NumWorkers is the number of games built in parallel, at least one.
+	NumWorkers int
+	// Progress, if set, is called after each game of a dat with the number of
+	// games done so far. Calls can come from several goroutines.
+	Progress func(datName string, done, total int)
+}
+
+// BuildReport sums up the build of one or more dats.
+type BuildReport struct {
+	Dats int
+	// Games is the number of games in the dats, Built the number of games
+	// with at least one rom written out.
+	Games int
+	Built int
+	// Have and Miss count the roms found in the depot and the ones missing.
+	Have int
+	Miss int
+}
+
+// Complete reports whether no rom was missing.
+func (br *BuildReport) Complete() bool {
+	return br.Miss == 0
+}
+
+// Add adds the counts of other to br.
+func (br *BuildReport) Add(other *BuildReport) {
+	br.Dats += other.Dats
+	br.Games += other.Games
+	br.Built += other.Built
+	br.Have += other.Have
+	br.Miss += other.Miss
+}
+
+func (br *BuildReport) String() string {
+	return fmt.Sprintf("built %d of %d games from %d dats, have %d roms, miss %d roms",
+		br.Built, br.Games, br.Dats, br.Have, br.Miss)
+}
+
+// BuildDat builds each game of dat inside the directory outpath/dat.Name.
+// Roms are looked up in the depot, completing their hashes from the rom DB if
+// needed. Roms missing from the depot are listed in a fix dat written to
+// outpath, games without any rom in the depot are skipped. CD images are built
+// into CHDs if opts.CHD is set. Parent and clone games are built as split,
+// merged or non-merged sets if opts.Sets says so.
+func (depot *Depot) BuildDat(dat *types.Dat, outpath string, opts *BuildOptions) (*BuildReport, error) {
+	dat = dat.Sets(opts.Sets)
+
+	newSink := newTorrentzipSink
+	if opts.Unzipped {
+		newSink = newDirSink
+	}
+	if opts.CHD != nil {
+		plainSink := newSink
+		newSink = func(datPath string, game *types.Game) (gameSink, error) {
+			if cdToc(game) == "" {
+				return plainSink(datPath, game)
+			}
+			return newCHDSink(datPath, game, opts.CHD)
+		}
+	}
+	return depot.buildDat(dat, outpath, newSink, opts)
+}
+
+// gameResult is the outcome of building one game of a dat.
+type gameResult struct {
+	fixGame *types.Game
+	have    int
+	err     error
+}
+
+func (depot *Depot) buildDat(dat *types.Dat, outpath string, newSink sinkFactory, opts *BuildOptions) (*BuildReport, error) {
+	datPath := filepath.Join(outpath, dat.Name)
+
+	err := os.MkdirAll(datPath, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	numWorkers := opts.NumWorkers
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	results := make([]gameResult, len(dat.Games))
+	indices := make(chan int)
+	done := make(chan int)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range indices {
+				res := &results[k]
+				res.fixGame, res.have, res.err = buildGame(dat.Games[k], datPath, newSink, depot.openBuildRom)
+				done <- k
+			}
+		}()
+	}
+
+	go func() {
+		defer close(indices)
+		for k := range dat.Games {
+			select {
+			case indices <- k:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// stop handing out games at the first error, the games already being
+	// built still finish
+	var firstErr error
+	finished := 0
+	for k := range done {
+		finished++
+		if results[k].err != nil && firstErr == nil {
+			firstErr = results[k].err
+			close(stop)
+		}
+		if opts.Progress != nil {
+			opts.Progress(dat.Name, finished, len(dat.Games))
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	report := &BuildReport{
+		Dats:  1,
+		Games: len(dat.Games),
+	}
+
+	var fixDat *types.Dat
+
+	for _, res := range results {
+		report.Have += res.have
+		if res.have > 0 {
+			report.Built++
+		}
+		if res.fixGame != nil {
+			fixDat = addFixGame(fixDat, dat, res.fixGame)
+			report.Miss += len(res.fixGame.Roms)
+		}
+	}
+
+	if fixDat != nil {
+		err = writeFixDat(fixDat, outpath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// addFixGame adds fixGame to the fix dat for dat, which is created if nil.
+func addFixGame(fixDat *types.Dat, dat *types.Dat, fixGame *types.Game) *types.Dat {
+	if fixDat == nil {
+		fixDat = dat.Header()
+	}
+	fixDat.Games = append(fixDat.Games, fixGame)
+	return fixDat
+}
+
+// writeFixDat writes fixDat into the directory outpath.
+func writeFixDat(fixDat *types.Dat, outpath string) error {
+	fixFile, err := os.Create(filepath.Join(outpath, fixPrefix+fixDat.Name+datSuffix))
+	if err != nil {
+		return err
+	}
+	defer fixFile.Close()
+
+	fixWriter := bufio.NewWriter(fixFile)
+
+	err = types.ComposeDat(fixDat, fixWriter)
+	if err != nil {
+		return err
+	}
+	return fixWriter.Flush()
+}
+
+// romEntryName returns the name of rom inside its game, dats use both slashes
+// and backslashes as separators.
+func romEntryName(rom *types.Rom) string {
+	return strings.Replace(rom.Name, "\\", "/", -1)
+}
+
+// joinEntryName returns the path of the entry name, slash separated, inside
+// dir. Names that would end up outside of dir are rejected, as are names of
+// dir itself.
+func joinEntryName(dir, name string) (string, error) {
+	dir = filepath.Clean(dir)
+	fpath := filepath.Join(dir, filepath.FromSlash(name))
+	if !strings.HasPrefix(fpath, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("name %s escapes %s", name, dir)
+	}
+	return fpath, nil
+}
+
+// romOpener returns the contents of rom, or nil if it isn't available.
+type romOpener func(rom *types.Rom) (io.ReadCloser, error)
+
+// openBuildRom opens roms of dats from the depot, or returns nil if the depot
+// doesn't have them.
+func (depot *Depot) openBuildRom(rom *types.Rom) (io.ReadCloser, error) {
+	rompath, err := depot.buildRomPath(rom)
+	if err != nil || rompath == "" {
+		return nil, err
+	}
+	return openDepotFile(rompath)
+}
+
+// HasDatRom reports whether the depot has rom of a dat, looking up roms
+// without SHA1 in the rom DB like builds do.
+func (depot *Depot) HasDatRom(rom *types.Rom) (bool, error) {
+	rompath, err := depot.buildRomPath(rom)
+	return rompath != "", err
+}
+
+// OpenDatRom returns the decompressed contents of rom of a dat, or nil if the
+// depot doesn't have it, looking up roms without SHA1 in the rom DB like
+// builds do.
+func (depot *Depot) OpenDatRom(rom *types.Rom) (io.ReadCloser, error) {
+	return depot.openBuildRom(rom)
+}
+
+// buildRomPath returns the path of the depot file holding a rom of a dat, or
+// the empty string if the depot doesn't have it. Roms without SHA1 are looked
+// up in the rom DB by their other hashes, they aren't available if that fails.
+func (depot *Depot) buildRomPath(rom *types.Rom) (string, error) {
+	if rom.Sha1 == nil {
+		// roms can be shared between games built in parallel, so complete
+		// a copy
+		crom := *rom
+		err := depot.romDB.CompleteRom(&crom)
+		if err != nil {
+			return "", err
+		}
+		if crom.Sha1 == nil {
+			return "", nil
+		}
+		rom = &crom
+	}
+	return depot.romPathFor(rom)
+}
+
+// buildGame writes the roms of game opened with open into a sink created by
+// newSink. It returns a game with the roms that aren't available, if any, and
+// the number of roms written.
+func buildGame(game *types.Game, datPath string, newSink sinkFactory, open romOpener) (*types.Game, int, error) {
+	var fixGame *types.Game
+
+	addFix := func(rom *types.Rom) {
+		if fixGame == nil {
+			fixGame = new(types.Game)
+			fixGame.Name = game.Name
+			fixGame.Description = game.Description
+		}
+		fixGame.Roms = append(fixGame.Roms, rom)
+	}
+
+	var sink gameSink
+	seen := make(map[string]bool)
+	have := 0
+
+	for _, rom := range game.AllRoms() {
+		if rom.NoDump() {
+			continue
+		}
+		if rom.Sha1 == nil && rom.Crc == nil {
+			logger.Warningf("game %s has rom with missing hashes %s", game.Name, rom.Name)
+			addFix(rom)
+			continue
+		}
+
+		name := romEntryName(rom)
+		if seen[name] {
+			continue
+		}
+
+		src, err := open(rom)
+		if err != nil {
+			if sink != nil {
+				sink.Abort()
+			}
+			return nil, 0, err
+		}
+
+		if src == nil {
+			logger.Warningf("game %s has missing rom %s (sha1 %s, crc %s)", game.Name, rom.Name,
+				hex.EncodeToString(rom.Sha1), hex.EncodeToString(rom.Crc))
+			addFix(rom)
+			continue
+		}
+
+		seen[name] = true
+
+		if sink == nil {
+			sink, err = newSink(datPath, game)
+			if err != nil {
+				src.Close()
+				return nil, 0, err
+			}
+		}
+
+		dst, err := sink.Create(name)
+		if err == nil {
+			_, err = io.Copy(dst, src)
+		}
+		src.Close()
+		if err != nil {
+			sink.Abort()
+			return nil, 0, err
+		}
+		have++
+	}
+
+	if sink != nil {
+		err := sink.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return fixGame, have, nil
+}
@@ -0,0 +1,465 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// putRom stores data into the depot rooted at root and returns a rom for it.
+func putRom(t *testing.T, root, name string, data []byte) *types.Rom {
+	hh := newHashes(false)
+	err := hh.forReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outpath := pathFromSha1HexEncoding(root, hex.EncodeToString(hh.Sha1), gzipSuffix)
+	_, err = archive(gzipCodec, outpath, filepath.Join(root, tmpDirName), bytes.NewReader(data),
+		hh.depotExtra(nil, int64(len(data))), hh.Sha1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hh.rom(name, "", int64(len(data)))
+}
+
+func TestBuildDat(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	outDir := filepath.Join(root, "out")
+
+	for _, dir := range []string{depotRoot, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	present := putRom(t, depotRoot, `sub\a.bin`, []byte("rom a"))
+	missing := (&Hashes{Sha1: bytes.Repeat([]byte{0xab}, 20)}).rom("b.bin", "", 5)
+
+	dat := &types.Dat{
+		Name: "test",
+		Games: types.GameSlice{
+			{Name: "complete", Roms: types.RomSlice{present, present}},
+			{Name: "partial", Roms: types.RomSlice{present, missing}},
+			{Name: "absent", Roms: types.RomSlice{missing}},
+		},
+	}
+
+	report, err := depot.BuildDat(dat, outDir, &BuildOptions{NumWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Complete() {
+		t.Errorf("dat with missing roms reported as complete")
+	}
+	if report.Games != 3 || report.Built != 2 || report.Have != 2 || report.Miss != 2 {
+		t.Errorf("got report %v, want 2 of 3 games built, 2 roms had and 2 missing", report)
+	}
+
+	for _, game := range []string{"complete", "partial"} {
+		zr, err := zip.OpenReader(filepath.Join(outDir, "test", game+zipSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) != 1 || zr.File[0].Name != "sub/a.bin" {
+			t.Errorf("game %s has unexpected entries", game)
+		}
+		zr.Close()
+	}
+
+	if exists, _ := PathExists(filepath.Join(outDir, "test", "absent"+zipSuffix)); exists {
+		t.Errorf("zip built for game without roms in the depot")
+	}
+
+	if exists, _ := PathExists(filepath.Join(outDir, fixPrefix+"test"+datSuffix)); !exists {
+		t.Errorf("fix dat missing")
+	}
+
+	dat.Games = types.GameSlice{{Name: "../../escaped", Roms: types.RomSlice{present}}}
+	_, err = depot.BuildDat(dat, outDir, &BuildOptions{})
+	if err == nil {
+		t.Errorf("game name escaping the output directory accepted")
+	}
+	if exists, _ := PathExists(filepath.Join(root, "escaped"+zipSuffix)); exists {
+		t.Errorf("zip built outside of the output directory")
+	}
+}
+
+func TestBuildDatUnzipped(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	outDir := filepath.Join(root, "out")
+
+	for _, dir := range []string{depotRoot, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat := &types.Dat{
+		Name: "test",
+		Games: types.GameSlice{
+			{Name: "game", Roms: types.RomSlice{
+				putRom(t, depotRoot, `sub\a.bin`, []byte("rom a")),
+				putRom(t, depotRoot, "b.bin", []byte("rom b")),
+			}},
+			{Name: "evil", Roms: types.RomSlice{
+				putRom(t, depotRoot, "../../evil.bin", []byte("evil")),
+			}},
+		},
+	}
+
+	_, err = depot.BuildDat(dat, outDir, &BuildOptions{Unzipped: true})
+	if err == nil {
+		t.Errorf("rom name escaping its game accepted")
+	}
+
+	// the game directory would replace the one holding the depot
+	escaped := &types.Dat{
+		Name:  "test",
+		Games: types.GameSlice{{Name: "../..", Roms: dat.Games[0].Roms}},
+	}
+	_, err = depot.BuildDat(escaped, outDir, &BuildOptions{Unzipped: true})
+	if err == nil {
+		t.Errorf("game name escaping the output directory accepted")
+	}
+	if exists, _ := PathExists(depotRoot); !exists {
+		t.Fatalf("build removed a directory outside of the output directory")
+	}
+
+	dat.Games = dat.Games[:1]
+
+	report, err := depot.BuildDat(dat, outDir, &BuildOptions{Unzipped: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Complete() {
+		t.Errorf("complete dat reported as incomplete")
+	}
+
+	for name, want := range map[string]string{"sub/a.bin": "rom a", "b.bin": "rom b"} {
+		got, err := ioutil.ReadFile(filepath.Join(outDir, "test", "game", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s has %q, want %q", name, got, want)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(outDir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("build left %d entries, want just the game directory", len(entries))
+	}
+}
+
+func TestBuildDatMerged(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	outDir := filepath.Join(root, "out")
+
+	for _, dir := range []string{depotRoot, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	common := putRom(t, depotRoot, "common.bin", []byte("common"))
+
+	dat := &types.Dat{
+		Name: "arcade",
+		Games: types.GameSlice{
+			{Name: "clone", CloneOf: "parent", RomOf: "parent", Roms: types.RomSlice{
+				common,
+				putRom(t, depotRoot, "main.bin", []byte("clone main")),
+			}},
+			{Name: "parent", Roms: types.RomSlice{
+				common,
+				putRom(t, depotRoot, "main.bin", []byte("parent main")),
+			}},
+		},
+	}
+
+	report, err := depot.BuildDat(dat, outDir, &BuildOptions{Unzipped: true, Sets: types.MergedSets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Games != 1 || !report.Complete() {
+		t.Errorf("got report %v, want one complete game", report)
+	}
+
+	for name, want := range map[string]string{
+		"common.bin":     "common",
+		"main.bin":       "parent main",
+		"clone/main.bin": "clone main",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(outDir, "arcade", "parent", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s has %q, want %q", name, got, want)
+		}
+	}
+
+	if exists, _ := PathExists(filepath.Join(outDir, "arcade", "clone")); exists {
+		t.Errorf("clone built on its own in a merged set")
+	}
+}
+
+func TestBuildDatSkipsNoDumps(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	outDir := filepath.Join(root, "out")
+
+	for _, dir := range []string{depotRoot, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	present := putRom(t, depotRoot, "a.bin", []byte("rom a"))
+	nodump := &types.Rom{Name: "b.bin", Size: 5, Status: types.StatusNoDump}
+
+	dat := &types.Dat{
+		Name: "test",
+		Games: types.GameSlice{
+			{Name: "game", Roms: types.RomSlice{present, nodump}},
+		},
+	}
+
+	report, err := depot.BuildDat(dat, outDir, &BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Complete() {
+		t.Errorf("dat reported incomplete because of a rom without dump")
+	}
+	if exists, _ := PathExists(filepath.Join(outDir, fixPrefix+"test"+datSuffix)); exists {
+		t.Errorf("fix dat written for a rom without dump")
+	}
+}
+
+// crcTestDB completes roms by their CRC
+type crcTestDB struct {
+	archiveTestDB
+	sha1s map[string][]byte
+}
+
+func (cdb *crcTestDB) CompleteRom(rom *types.Rom) error {
+	rom.Sha1 = cdb.sha1s[hex.EncodeToString(rom.Crc)]
+	return nil
+}
+
+func TestBuildDatCompletesRoms(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	outDir := filepath.Join(root, "out")
+
+	for _, dir := range []string{depotRoot, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	romDB := &crcTestDB{sha1s: make(map[string][]byte)}
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, romDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	present := putRom(t, depotRoot, "a.bin", []byte("rom a"))
+	romDB.sha1s[hex.EncodeToString(present.Crc)] = present.Sha1
+	crcOnly := &types.Rom{Name: "a.bin", Size: present.Size, Crc: present.Crc}
+
+	dat := &types.Dat{Name: "test"}
+	for i := 0; i < 10; i++ {
+		dat.Games = append(dat.Games, &types.Game{
+			Name: fmt.Sprintf("game%d", i),
+			Roms: types.RomSlice{crcOnly},
+		})
+	}
+
+	var progress int32
+	opts := &BuildOptions{
+		NumWorkers: 4,
+		Progress: func(datName string, done, total int) {
+			atomic.AddInt32(&progress, 1)
+		},
+	}
+
+	report, err := depot.BuildDat(dat, outDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Complete() || report.Built != 10 || report.Have != 10 {
+		t.Errorf("got report %v, want all 10 games built", report)
+	}
+	if progress != 10 {
+		t.Errorf("got %d progress calls, want 10", progress)
+	}
+	if crcOnly.Sha1 != nil {
+		t.Errorf("rom of the dat modified by the build")
+	}
+}
+
+func TestCheckBuiltDat(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	outDir := filepath.Join(root, "out")
+
+	for _, dir := range []string{depotRoot, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := putRom(t, depotRoot, "a.bin", []byte("rom a"))
+	b := putRom(t, depotRoot, "b.bin", []byte("rom b"))
+
+	dat := &types.Dat{
+		Name: "test",
+		Games: types.GameSlice{
+			{Name: "first", Roms: types.RomSlice{a}},
+			{Name: "second", Roms: types.RomSlice{a, b}},
+			{Name: "third", Roms: types.RomSlice{b}},
+		},
+	}
+
+	_, err = depot.BuildDat(dat, outDir, &BuildOptions{NumWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	differ, err := depot.CheckBuiltDat(dat, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(differ) != 0 {
+		t.Errorf("fresh build differs from the depot: %v", differ)
+	}
+
+	datDir := filepath.Join(outDir, "test")
+	writeZip(t, filepath.Join(datDir, "first"+zipSuffix), map[string][]byte{"a.bin": []byte("rom A")})
+	err = os.Remove(filepath.Join(datDir, "third"+zipSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(datDir, "extra"+zipSuffix), []byte("not a game"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	differ, err = depot.CheckBuiltDat(dat, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"extra.zip", "first.zip", "third.zip"}
+	if fmt.Sprint(differ) != fmt.Sprint(want) {
+		t.Errorf("got differing files %v, want %v", differ, want)
+	}
+}
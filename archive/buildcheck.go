@@ -0,0 +1,161 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// hashSink computes the SHA1 of the torrentzip file of a game instead of
+// writing it.
+type hashSink struct {
+	h   hash.Hash
+	tw  *torrentzip.Writer
+	sum *[]byte
+}
+
+func (hs *hashSink) Create(name string) (io.Writer, error) {
+	return hs.tw.Create(name)
+}
+
+func (hs *hashSink) Close() error {
+	err := hs.tw.Close()
+	if err != nil {
+		return err
+	}
+	*hs.sum = hs.h.Sum(nil)
+	return nil
+}
+
+func (hs *hashSink) Abort() {}
+
+func sha1OfFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha1.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// CheckBuiltDat rebuilds the games of dat built into outpath by BuildDat in
+// memory and returns the paths, relative to the directory of the dat, of the
+// torrentzip files that differ from what the depot builds now, are missing or
+// belong to no game. Torrentzip files of the same roms are byte-identical, so
+// those files weren't built from the depot or were changed since.
+func (depot *Depot) CheckBuiltDat(dat *types.Dat, outpath string) ([]string, error) {
+	datPath := filepath.Join(outpath, dat.Name)
+
+	var differ []string
+	expected := make(map[string]bool)
+
+	for _, game := range dat.Games {
+		name := filepath.FromSlash(game.Name) + zipSuffix
+		expected[name] = true
+
+		var sum []byte
+		newSink := func(datPath string, game *types.Game) (gameSink, error) {
+			h := sha1.New()
+			tw, err := torrentzip.NewWriter(h)
+			if err != nil {
+				return nil, err
+			}
+			return &hashSink{h: h, tw: tw, sum: &sum}, nil
+		}
+
+		_, _, err := buildGame(game, datPath, newSink, depot.openBuildRom)
+		if err != nil {
+			return nil, err
+		}
+
+		have, err := sha1OfFile(filepath.Join(datPath, name))
+		if os.IsNotExist(err) {
+			if sum != nil {
+				differ = append(differ, name)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(have, sum) {
+			differ = append(differ, name)
+		}
+	}
+
+	err := filepath.Walk(datPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") && path != datPath {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(datPath, path)
+		if err != nil {
+			return err
+		}
+		if !expected[rel] {
+			differ = append(differ, rel)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sort.Strings(differ)
+	return differ, nil
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+const chdTag = "MComprHD"
+
+// maxCHDHeaderLen is the length of the largest CHD header layout
+const maxCHDHeaderLen = 124
+
+// CHDInfo holds the identifying information found in the header of a MAME
+// CHD (compressed hunks of data) file. Sha1 is the internal SHA1 that dat
+// disk entries refer to; it is nil for version 1 and 2 files which only carry
+// an MD5.
+type CHDInfo struct {
+	Version uint32
+	Md5     types.Md5Sum
+	Sha1    types.Sha1Sum
+}
+
+// chd header layouts, offsets are from the start of the file
+type chdLayout struct {
+	headerLen int
+	md5Off    int
+	sha1Off   int
+}
+
+var chdLayouts = map[uint32]chdLayout{
+	1: {headerLen: 76, md5Off: 44, sha1Off: -1},
+	2: {headerLen: 80, md5Off: 44, sha1Off: -1},
+	3: {headerLen: 120, md5Off: 44, sha1Off: 80},
+	4: {headerLen: 108, md5Off: -1, sha1Off: 48},
+	5: {headerLen: 124, md5Off: -1, sha1Off: 84},
+}
+
+// ReadCHDInfo reads a CHD header from r. It returns nil and no error if r
+// doesn't start with a CHD header.
+func ReadCHDInfo(r io.Reader) (*CHDInfo, error) {
+	buf := make([]byte, maxCHDHeaderLen)
+
+	n, err := io.ReadFull(r, buf[:16])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(buf[:len(chdTag)], []byte(chdTag)) {
+		return nil, nil
+	}
+
+	headerLen := binary.BigEndian.Uint32(buf[8:12])
+	version := binary.BigEndian.Uint32(buf[12:16])
+
+	layout, ok := chdLayouts[version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported CHD version %d", version)
+	}
+
+	if int(headerLen) != layout.headerLen {
+		return nil, fmt.Errorf("CHD version %d with unexpected header length %d", version, headerLen)
+	}
+
+	_, err = io.ReadFull(r, buf[n:layout.headerLen])
+	if err != nil {
+		return nil, fmt.Errorf("truncated CHD header: %v", err)
+	}
+
+	info := &CHDInfo{
+		Version: version,
+	}
+
+	if layout.md5Off >= 0 {
+		info.Md5 = make([]byte, md5.Size)
+		copy(info.Md5, buf[layout.md5Off:layout.md5Off+md5.Size])
+	}
+
+	if layout.sha1Off >= 0 {
+		info.Sha1 = make([]byte, sha1.Size)
+		copy(info.Sha1, buf[layout.sha1Off:layout.sha1Off+sha1.Size])
+	}
+
+	return info, nil
+}
+
+// CHDInfoForFile returns the CHD header information of the file at inpath
+// or nil if the file isn't a CHD.
+func CHDInfoForFile(inpath string) (*CHDInfo, error) {
+	file, err := os.Open(inpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadCHDInfo(file)
+}
+
+// archiveCHD stores a CHD file in the depot under its internal SHA1 instead of
+// the SHA1 of the file contents, since that is what dat disk entries refer to.
+func (w *archiveWorker) archiveCHD(inpath string, root int, chd *CHDInfo, size int64) error {
+	rom := new(types.Rom)
+	rom.Name = filepath.Base(inpath)
+	rom.Size = size
+	rom.Path = inpath
+	rom.Sha1 = chd.Sha1
+	rom.Md5 = chd.Md5
+
+	// the internal SHA1 covers the decompressed hunks, not the file itself,
+	// so there is nothing to verify the written contents against
+	err := w.store(w.pm.sources.opener(inpath), root, rom, nil, nil)
+	if err != nil || w.pm.opts.VerifyCHD == nil {
+		return err
+	}
+	return w.verifyCHDTracks(inpath)
+}
+
+// verifyCHDTracks extracts the tracks of the CD image in the CHD inpath and
+// looks up their hashes in the dats. Hard disk images have no tracks and are
+// left alone.
+func (w *archiveWorker) verifyCHDTracks(inpath string) error {
+	tool := w.pm.opts.VerifyCHD
+
+	info, err := tool.Info(inpath)
+	if err != nil {
+		return err
+	}
+	if len(info.Tracks) == 0 {
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "romba-chd-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	paths, err := tool.ExtractCD(inpath, dir)
+	if err != nil {
+		return err
+	}
+	if len(paths) != len(info.Tracks) {
+		return fmt.Errorf("extracted %d tracks from CHD %s with %d tracks", len(paths), inpath, len(info.Tracks))
+	}
+
+	for i, path := range paths {
+		hh, err := HashesForFile(path)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		tr := &TrackReport{
+			Number: info.Tracks[i].Number,
+			Sha1:   hex.EncodeToString(hh.Sha1),
+			Size:   fi.Size(),
+		}
+
+		dats, err := w.depot.romDB.DatsForRom(&types.Rom{Sha1: hh.Sha1, Size: fi.Size()})
+		if err != nil {
+			return err
+		}
+		for _, dat := range dats {
+			if !dat.Artificial {
+				tr.Dats = append(tr.Dats, dat.Name)
+			}
+		}
+		if len(tr.Dats) == 0 {
+			logger.Warningf("track %d of CHD %s (sha1 %s) is in no dat", tr.Number, inpath, tr.Sha1)
+		}
+
+		w.task.tracks = append(w.task.tracks, tr)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func chdHeader(version uint32, headerLen int, md5Off, sha1Off int, md5Hex, sha1Hex string) []byte {
+	buf := make([]byte, headerLen)
+	copy(buf, chdTag)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(headerLen))
+	binary.BigEndian.PutUint32(buf[12:16], version)
+
+	if md5Off >= 0 {
+		md5Bytes, _ := hex.DecodeString(md5Hex)
+		copy(buf[md5Off:], md5Bytes)
+	}
+	if sha1Off >= 0 {
+		sha1Bytes, _ := hex.DecodeString(sha1Hex)
+		copy(buf[sha1Off:], sha1Bytes)
+	}
+	return buf
+}
+
+func TestReadCHDInfo(t *testing.T) {
+	md5Hex := "43ee6acc0c173048f47826307c0a262e"
+	sha1Hex := "80353cb168dc5d7cc1dce57971f4ea2640a50ac4"
+
+	for version, layout := range chdLayouts {
+		header := chdHeader(version, layout.headerLen, layout.md5Off, layout.sha1Off, md5Hex, sha1Hex)
+
+		info, err := ReadCHDInfo(bytes.NewReader(header))
+		if err != nil {
+			t.Fatalf("version %d: failed to read header: %v", version, err)
+		}
+		if info == nil {
+			t.Fatalf("version %d: header not detected", version)
+		}
+		if info.Version != version {
+			t.Fatalf("version %d: got version %d", version, info.Version)
+		}
+		if layout.sha1Off >= 0 && hex.EncodeToString(info.Sha1) != sha1Hex {
+			t.Fatalf("version %d: expected sha1 %s, got %s", version, sha1Hex, hex.EncodeToString(info.Sha1))
+		}
+		if layout.sha1Off < 0 && info.Sha1 != nil {
+			t.Fatalf("version %d: expected no sha1", version)
+		}
+		if layout.md5Off >= 0 && hex.EncodeToString(info.Md5) != md5Hex {
+			t.Fatalf("version %d: expected md5 %s, got %s", version, md5Hex, hex.EncodeToString(info.Md5))
+		}
+	}
+}
+
+func TestReadCHDInfoNotCHD(t *testing.T) {
+	info, err := ReadCHDInfo(bytes.NewReader([]byte("just some rom")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info != nil {
+		t.Fatalf("detected CHD in non CHD data")
+	}
+
+	header := chdHeader(5, 124, -1, 84, "", "80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	_, err = ReadCHDInfo(bytes.NewReader(header[:100]))
+	if err == nil {
+		t.Fatalf("expected error for truncated header")
+	}
+}
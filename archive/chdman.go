@@ -0,0 +1,326 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// CHDTool creates and extracts the CD images of CHDs, see Chdman.
+type CHDTool interface {
+	// CreateCD compresses the CD image described by the cue or gdi file toc
+	// into the CHD outpath.
+	CreateCD(toc, outpath string) error
+	// ExtractCD writes the tracks of the CD image in the CHD inpath into
+	// dir, one file per track in track order, and returns their paths.
+	ExtractCD(inpath, dir string) ([]string, error)
+	// Info describes the CHD inpath.
+	Info(inpath string) (*CHDToolInfo, error)
+}
+
+// CHDToolInfo describes a CHD as told by a CHDTool.
+type CHDToolInfo struct {
+	Version     int
+	LogicalSize int64
+	// Sha1 is the internal SHA1 dat disk entries refer to, DataSha1 the
+	// SHA1 of the raw data only.
+	Sha1     []byte
+	DataSha1 []byte
+	// Tracks are the tracks of CD images, none for hard disk images.
+	Tracks []*CHDTrack
+}
+
+// CHDTrack is a track of the CD image in a CHD.
+type CHDTrack struct {
+	Number int
+	Type   string
+	Frames int64
+}
+
+// Chdman is the CHDTool running MAME's chdman. Extracting CDs needs a chdman
+// with the --splitbin option, from MAME 0.246 on.
+type Chdman struct {
+	// Path is the chdman executable, looked up in the PATH if it has no
+	// directory.
+	Path string
+}
+
+// NewChdman returns the CHDTool running the chdman at path, "chdman" if
+// empty.
+func NewChdman(path string) *Chdman {
+	if path == "" {
+		path = "chdman"
+	}
+	return &Chdman{Path: path}
+}
+
+// run runs chdman with args and returns its output.
+func (c *Chdman) run(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(c.Path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	logger.V(2).Infof("running %s %s", c.Path, strings.Join(args, " "))
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = strings.TrimSpace(stdout.String())
+		}
+		if i := strings.LastIndexByte(msg, '\n'); i >= 0 {
+			msg = msg[i+1:]
+		}
+		return nil, fmt.Errorf("chdman %s failed: %v: %s", args[0], err, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+func (c *Chdman) CreateCD(toc, outpath string) error {
+	_, err := c.run("createcd", "-i", toc, "-o", outpath, "-f")
+	return err
+}
+
+func (c *Chdman) ExtractCD(inpath, dir string) ([]string, error) {
+	base := strings.TrimSuffix(filepath.Base(inpath), filepath.Ext(inpath))
+	_, err := c.run("extractcd", "-i", inpath, "-o", filepath.Join(dir, base+".cue"),
+		"-ob", filepath.Join(dir, base+".bin"), "--splitbin", "-f")
+	if err != nil {
+		return nil, err
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the track files are numbered, so they sort in track order
+	var tracks []string
+	for _, fi := range fis {
+		if strings.EqualFold(filepath.Ext(fi.Name()), ".bin") {
+			tracks = append(tracks, filepath.Join(dir, fi.Name()))
+		}
+	}
+	sort.Strings(tracks)
+	return tracks, nil
+}
+
+func (c *Chdman) Info(inpath string) (*CHDToolInfo, error) {
+	out, err := c.run("info", "-i", inpath, "-v")
+	if err != nil {
+		return nil, err
+	}
+	return parseChdmanInfo(bytes.NewReader(out))
+}
+
+// parseChdmanInfo reads the output of chdman info, lines of "Key: value",
+// the metadata of CD tracks continuing over unkeyed lines:
+//
+//	File Version: 5
+//	Logical size: 1,234,567 bytes
+//	SHA1:         0123...
+//	Data SHA1:    4567...
+//	Metadata:     Tag='CHT2'  Index=0  Length=91 bytes
+//	              TRACK:1 TYPE:MODE2_RAW SUBTYPE:NONE FRAMES:1234 ...
+func parseChdmanInfo(r io.Reader) (*CHDToolInfo, error) {
+	info := new(CHDToolInfo)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		value := strings.TrimSpace(line)
+		if i := strings.Index(line, ":"); i >= 0 && !strings.HasPrefix(line, " ") {
+			key := strings.TrimSpace(line[:i])
+			value = strings.TrimSpace(line[i+1:])
+
+			var err error
+			switch key {
+			case "File Version":
+				info.Version, err = strconv.Atoi(value)
+			case "Logical size":
+				info.LogicalSize, err = parseChdmanNumber(value)
+			case "SHA1":
+				info.Sha1, err = hex.DecodeString(value)
+			case "Data SHA1":
+				info.DataSha1, err = hex.DecodeString(value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("bad chdman info %s %q: %v", key, value, err)
+			}
+		}
+
+		if strings.HasPrefix(value, "TRACK:") {
+			track, err := parseCHDTrack(value)
+			if err != nil {
+				return nil, err
+			}
+			info.Tracks = append(info.Tracks, track)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if info.Sha1 == nil {
+		return nil, fmt.Errorf("chdman info has no SHA1")
+	}
+	return info, nil
+}
+
+// parseChdmanNumber parses numbers like "1,234 bytes".
+func parseChdmanNumber(s string) (int64, error) {
+	s = strings.TrimSuffix(s, " bytes")
+	return strconv.ParseInt(strings.Replace(s, ",", "", -1), 10, 64)
+}
+
+// parseCHDTrack parses the metadata of a CD track, fields of KEY:value.
+func parseCHDTrack(s string) (*CHDTrack, error) {
+	track := new(CHDTrack)
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		var err error
+		switch kv[0] {
+		case "TRACK":
+			track.Number, err = strconv.Atoi(kv[1])
+		case "TYPE":
+			track.Type = kv[1]
+		case "FRAMES":
+			track.Frames, err = strconv.ParseInt(kv[1], 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad CHD track %q: %v", s, err)
+		}
+	}
+	return track, nil
+}
+
+// isCDToc reports whether name is the cue or gdi file describing a CD
+// image.
+func isCDToc(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".cue" || ext == ".gdi"
+}
+
+// cdToc returns the name of the cue or gdi rom of game, "" if it has none.
+func cdToc(game *types.Game) string {
+	for _, rom := range game.Roms {
+		if isCDToc(rom.Name) {
+			return romEntryName(rom)
+		}
+	}
+	return ""
+}
+
+// chdSink writes a CD image game as a CHD. The tracks are assembled in a
+// temporary directory which the tool compresses into the CHD once they are
+// all there. Games with missing tracks are left as a directory of the
+// tracks found, like dirSink does.
+type chdSink struct {
+	*dirSink
+	tool CHDTool
+	toc  string
+	want map[string]bool
+	game *types.Game
+}
+
+func newCHDSink(datPath string, game *types.Game, tool CHDTool) (gameSink, error) {
+	ds, err := newDirSink(datPath, game)
+	if err != nil {
+		return nil, err
+	}
+
+	want := make(map[string]bool)
+	for _, rom := range game.Roms {
+		if !rom.NoDump() {
+			want[romEntryName(rom)] = true
+		}
+	}
+
+	return &chdSink{
+		dirSink: ds.(*dirSink),
+		tool:    tool,
+		toc:     cdToc(game),
+		want:    want,
+		game:    game,
+	}, nil
+}
+
+func (cs *chdSink) Create(name string) (io.Writer, error) {
+	delete(cs.want, name)
+	return cs.dirSink.Create(name)
+}
+
+func (cs *chdSink) Close() error {
+	if len(cs.want) > 0 {
+		logger.Warningf("game %s misses %d tracks, built as a folder instead of a CHD", cs.game.Name, len(cs.want))
+		return cs.dirSink.Close()
+	}
+
+	err := cs.closeFile()
+	if err != nil {
+		cs.Abort()
+		return err
+	}
+	defer cs.Abort()
+
+	// the game directory's path was checked by newDirSink
+	outpath := cs.outpath + chdSuffix
+	tmpPath := filepath.Join(filepath.Dir(outpath), filepath.Base(cs.tmpDir)+chdSuffix)
+
+	toc, err := joinEntryName(cs.tmpDir, cs.toc)
+	if err != nil {
+		return err
+	}
+
+	err = cs.tool.CreateCD(toc, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("creating CHD of game %s failed: %v", cs.game.Name, err)
+	}
+	return os.Rename(tmpPath, outpath)
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+const chdmanInfoOutput = `chdman - MAME Compressed Hunks of Data (CHD) manager 0.251 (mame0251)
+Input file:   game.chd
+File Version: 5
+Logical size: 1,234,567 bytes
+Hunk Size:    19,584 bytes
+Total Hunks:  64
+Unit Size:    2,448 bytes
+Compression:  cdlz (CD LZMA), cdzl (CD Deflate), cdfl (CD FLAC)
+Ratio:        51.2%
+SHA1:         c2f67e2b1ba4d1e5c2c9a0a49c4e5a4bd0c14a2b
+Data SHA1:    9b5b5bd06e34b6a8e4ffcb3a9e1b2f4b3d2b1a09
+Metadata:     Tag='CHT2'  Index=0  Length=91 bytes
+              TRACK:1 TYPE:MODE2_RAW SUBTYPE:NONE FRAMES:300 PREGAP:0 PGTYPE:MODE2_RAW PGSUB:RW POSTGAP:0
+Metadata:     Tag='CHT2'  Index=1  Length=89 bytes
+              TRACK:2 TYPE:AUDIO SUBTYPE:NONE FRAMES:200 PREGAP:150 PGTYPE:AUDIO PGSUB:RW POSTGAP:0
+`
+
+func TestParseChdmanInfo(t *testing.T) {
+	info, err := parseChdmanInfo(strings.NewReader(chdmanInfoOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Version != 5 || info.LogicalSize != 1234567 ||
+		hex.EncodeToString(info.Sha1) != "c2f67e2b1ba4d1e5c2c9a0a49c4e5a4bd0c14a2b" ||
+		hex.EncodeToString(info.DataSha1) != "9b5b5bd06e34b6a8e4ffcb3a9e1b2f4b3d2b1a09" {
+		t.Errorf("got info %+v", info)
+	}
+	if len(info.Tracks) != 2 || info.Tracks[0].Number != 1 || info.Tracks[0].Type != "MODE2_RAW" ||
+		info.Tracks[0].Frames != 300 || info.Tracks[1].Type != "AUDIO" {
+		t.Errorf("got tracks %+v", info.Tracks)
+	}
+
+	_, err = parseChdmanInfo(strings.NewReader("chdman - MAME Compressed Hunks of Data (CHD) manager\n"))
+	if err == nil {
+		t.Errorf("info without SHA1 accepted")
+	}
+}
+
+// fakeCHDTool makes CHDs of the files listed in cue sheets, one file name a
+// line, by concatenating them.
+type fakeCHDTool struct {
+	tracks map[string][]byte
+}
+
+func (ft *fakeCHDTool) CreateCD(toc, outpath string) error {
+	cue, err := ioutil.ReadFile(toc)
+	if err != nil {
+		return err
+	}
+
+	var chd []byte
+	for _, name := range strings.Fields(string(cue)) {
+		bs, err := ioutil.ReadFile(filepath.Join(filepath.Dir(toc), name))
+		if err != nil {
+			return err
+		}
+		chd = append(chd, bs...)
+	}
+	return ioutil.WriteFile(outpath, chd, 0666)
+}
+
+func (ft *fakeCHDTool) ExtractCD(inpath, dir string) ([]string, error) {
+	var paths []string
+	for _, name := range []string{"track01.bin", "track02.bin"} {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, ft.tracks[name], 0666)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func (ft *fakeCHDTool) Info(inpath string) (*CHDToolInfo, error) {
+	return &CHDToolInfo{
+		Version: 5,
+		Tracks:  []*CHDTrack{{Number: 1}, {Number: 2}},
+	}, nil
+}
+
+func TestBuildDatCHD(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	outDir := filepath.Join(root, "out")
+
+	for _, dir := range []string{depotRoot, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cue := putRom(t, depotRoot, "disc.cue", []byte("track01.bin track02.bin"))
+	track1 := putRom(t, depotRoot, "track01.bin", []byte("data track"))
+	track2 := putRom(t, depotRoot, "track02.bin", []byte("audio track"))
+	missing := (&Hashes{Sha1: make([]byte, 20)}).rom("track02.bin", "", 5)
+
+	dat := &types.Dat{
+		Name: "redump",
+		Games: types.GameSlice{
+			{Name: "disc", Roms: types.RomSlice{cue, track1, track2}},
+			{Name: "broken", Roms: types.RomSlice{cue, track1, missing}},
+			{Name: "cart", Roms: types.RomSlice{track1}},
+		},
+	}
+
+	_, err = depot.BuildDat(dat, outDir, &BuildOptions{CHD: &fakeCHDTool{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(outDir, "redump", "disc"+chdSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "data trackaudio track" {
+		t.Errorf("got CHD %q", got)
+	}
+
+	// a disc missing tracks is left as a folder, other games are zipped
+	for _, path := range []string{
+		filepath.Join("broken", "track01.bin"),
+		"cart" + zipSuffix,
+	} {
+		if exists, _ := PathExists(filepath.Join(outDir, "redump", path)); !exists {
+			t.Errorf("%s not built", path)
+		}
+	}
+
+	leftovers, err := BuildLeftovers(outDir)
+	if err != nil || len(leftovers) != 0 {
+		t.Errorf("build left %v, %v behind", leftovers, err)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+)
+
+const zstdSuffix = ".zst"
+
+// codec is a compression format for depot files. Depot files are named with
+// the suffix of the codec they were written with, so a depot can hold files
+// of different codecs and all of them can be read regardless of which codec
+// new files are written with.
+type codec struct {
+	name   string
+	suffix string
+	// newWriter returns a writer compressing into w, with extra stored as
+	// the depot header
+	newWriter func(w io.Writer, extra []byte) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	// readExtra returns the depot header stored at the start of r, or nil
+	readExtra func(r io.Reader) ([]byte, error)
+	// extraOffset is where newWriter puts the depot header, so that it can
+	// be written over once known
+	extraOffset int64
+}
+
+var gzipCodec = &codec{
+	name:   "gzip",
+	suffix: gzipSuffix,
+	newWriter: func(w io.Writer, extra []byte) (io.WriteCloser, error) {
+		zw := cgzip.NewWriter(w)
+		if len(extra) > 0 {
+			err := zw.SetExtraHeader(extra)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return zw, nil
+	},
+	newReader: func(r io.Reader) (io.ReadCloser, error) {
+		return cgzip.NewReader(r)
+	},
+	readExtra: func(r io.Reader) ([]byte, error) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return zr.Header.Extra, nil
+	},
+	// after the fixed header fields and the length of the extra field
+	extraOffset: 12,
+}
+
+// zstd has no header field for arbitrary data, so the depot header goes into
+// a skippable frame in front of the compressed data. Decoders ignore it.
+const zstdSkippableFrameMagic = 0x184D2A50
+
+var zstdCodec = &codec{
+	name:   "zstd",
+	suffix: zstdSuffix,
+	newWriter: func(w io.Writer, extra []byte) (io.WriteCloser, error) {
+		if len(extra) > 0 {
+			var hdr [8]byte
+			binary.LittleEndian.PutUint32(hdr[0:4], zstdSkippableFrameMagic)
+			binary.LittleEndian.PutUint32(hdr[4:8], uint32(len(extra)))
+			_, err := w.Write(hdr[:])
+			if err == nil {
+				_, err = w.Write(extra)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	},
+	newReader: func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	},
+	readExtra: func(r io.Reader) ([]byte, error) {
+		var hdr [8]byte
+		_, err := io.ReadFull(r, hdr[:])
+		if err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(hdr[0:4]) != zstdSkippableFrameMagic {
+			return nil, nil
+		}
+		extra := make([]byte, binary.LittleEndian.Uint32(hdr[4:8]))
+		_, err = io.ReadFull(r, extra)
+		if err != nil {
+			return nil, err
+		}
+		return extra, nil
+	},
+	extraOffset: 8,
+}
+
+var codecs = []*codec{gzipCodec, zstdCodec}
+
+func codecByName(name string) (*codec, error) {
+	for _, c := range codecs {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown depot compression %q", name)
+}
+
+// codecForPath returns the codec of the depot file path, or nil if path
+// doesn't have the suffix of any codec.
+func codecForPath(path string) *codec {
+	ext := filepath.Ext(path)
+	for _, c := range codecs {
+		if c.suffix == ext {
+			return c
+		}
+	}
+	return nil
+}
+
+// sha1HexForPath returns the hex encoded SHA1 a depot file is named after.
+func sha1HexForPath(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+type depotFileReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r *depotFileReader) Close() error {
+	err := r.ReadCloser.Close()
+	if ferr := r.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// openDepotFile returns the decompressed contents of the depot file path.
+func openDepotFile(path string) (io.ReadCloser, error) {
+	c := codecForPath(path)
+	if c == nil {
+		return nil, fmt.Errorf("%s is not a depot file", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.newReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &depotFileReader{
+		ReadCloser: r,
+		file:       file,
+	}, nil
+}
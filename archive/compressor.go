@@ -0,0 +1,196 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// compressJob is a rom that has been hashed and indexed and now waits to be
+// compressed into the depot.
+type compressJob struct {
+	ro       readerOpener
+	root     int
+	outpath  string
+	extra    []byte
+	wantSha1 []byte
+	done     func(err error)
+}
+
+// compressorPool compresses roms into the depot. Archive workers only read
+// and hash, so they can move on to the next file while the CPU bound
+// compression happens here with its own degree of parallelism.
+type compressorPool struct {
+	depot    *Depot
+	jobs     chan *compressJob
+	wg       *sync.WaitGroup
+	lock     *sync.Mutex
+	inflight map[string]bool
+	err      error
+}
+
+func newCompressorPool(depot *Depot, numCompressors int) *compressorPool {
+	cp := &compressorPool{
+		depot:    depot,
+		jobs:     make(chan *compressJob, numCompressors),
+		wg:       new(sync.WaitGroup),
+		lock:     new(sync.Mutex),
+		inflight: make(map[string]bool),
+	}
+
+	for i := 0; i < numCompressors; i++ {
+		cp.wg.Add(1)
+		go cp.run()
+	}
+	return cp
+}
+
+// submit queues job, blocking while all compressors are busy so that hashing
+// can't run arbitrarily far ahead. It returns false without queueing job if
+// the same depot file is already queued or being compressed.
+func (cp *compressorPool) submit(job *compressJob) bool {
+	if !cp.claim(job.outpath) {
+		return false
+	}
+
+	cp.jobs <- job
+	return true
+}
+
+// claim marks the depot file outpath as being written, returning false if it
+// already is. Claims are given up with release.
+func (cp *compressorPool) claim(outpath string) bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if cp.inflight[outpath] {
+		return false
+	}
+	cp.inflight[outpath] = true
+	return true
+}
+
+func (cp *compressorPool) release(outpath string) {
+	cp.lock.Lock()
+	delete(cp.inflight, outpath)
+	cp.lock.Unlock()
+}
+
+// close waits for the queued jobs to finish and returns the first error any
+// of them had.
+func (cp *compressorPool) close() error {
+	close(cp.jobs)
+	cp.wg.Wait()
+	return cp.err
+}
+
+func (cp *compressorPool) run() {
+	defer cp.wg.Done()
+
+	for job := range cp.jobs {
+		n, err := cp.compress(job)
+		if err != nil {
+			logger.Errorf("failed to compress %s: %v", job.outpath, err)
+		} else {
+			cp.depot.archived(job.root, n)
+		}
+
+		cp.lock.Lock()
+		delete(cp.inflight, job.outpath)
+		if err != nil && cp.err == nil {
+			cp.err = err
+		}
+		cp.lock.Unlock()
+
+		job.done(err)
+	}
+}
+
+func (cp *compressorPool) compress(job *compressJob) (int64, error) {
+	r, err := job.ro()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return archive(cp.depot.codec, job.outpath, filepath.Join(cp.depot.roots[job.root], tmpDirName),
+		r, job.extra, job.wantSha1)
+}
+
+// archiveTask tracks the compress jobs queued while processing one path, so
+// that what they read from is released only after the last of them is done.
+type archiveTask struct {
+	wg       *sync.WaitGroup
+	cleanups []func()
+	lock     *sync.Mutex
+	err      error
+	// roms found while processing the path
+	roms []*RomReport
+	// tracks of the CHD at the path, if verified
+	tracks []*TrackReport
+	// incomplete is set if some rom found was not put into the depot
+	incomplete bool
+}
+
+func newArchiveTask() *archiveTask {
+	return &archiveTask{
+		wg:   new(sync.WaitGroup),
+		lock: new(sync.Mutex),
+	}
+}
+
+func (t *archiveTask) add() {
+	t.wg.Add(1)
+}
+
+// done marks a job of the task as done, with the error it failed with if any.
+func (t *archiveTask) done(err error) {
+	t.lock.Lock()
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	t.lock.Unlock()
+	t.wg.Done()
+}
+
+// onDone registers f to run after all jobs of the task are done, in order of
+// registration.
+func (t *archiveTask) onDone(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+func (t *archiveTask) wait() {
+	t.wg.Wait()
+	for _, f := range t.cleanups {
+		f()
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// deleteSource removes, or moves to the trash, the source file path
+// once task, which processed it, has put all its contents into the depot.
+// Directories left empty are removed up to the path given to archive it
+// came from.
+func (pm *archiveMaster) deleteSource(path string, task *archiveTask) error {
+	if task.err != nil {
+		return fmt.Errorf("keeping source because its contents failed to be stored: %v", task.err)
+	}
+	if task.incomplete {
+		logger.V(2).Infof("keeping source %s because not all its contents were stored", path)
+		return nil
+	}
+
+	for _, rr := range task.roms {
+		rompath, err := pm.depot.RomPath(rr.Sha1)
+		if err != nil {
+			return err
+		}
+		if rompath == "" {
+			return fmt.Errorf("keeping source because depot has no file for SHA1 %s", rr.Sha1)
+		}
+	}
+
+	if pm.opts.TrashDir != "" {
+		dst, err := pm.relocateSource(path, pm.opts.TrashDir, false)
+		if err != nil {
+			return err
+		}
+		logger.V(2).Infof("moved archived source %s to %s", path, dst)
+	} else if pm.opts.Trash != nil {
+		err := pm.opts.Trash.Remove(path)
+		if err != nil {
+			return err
+		}
+		logger.V(2).Infof("trashed archived source %s", path)
+	} else {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		logger.V(2).Infof("removed archived source %s", path)
+	}
+
+	pruneEmptyDirs(filepath.Dir(path), pm.rootOf(path))
+	return nil
+}
+
+// rootOf returns the innermost path given to archive that path is in or is,
+// "" if there is none.
+func (pm *archiveMaster) rootOf(path string) string {
+	var root string
+	for _, r := range pm.roots {
+		if len(r) <= len(root) {
+			continue
+		}
+		if path == r || strings.HasPrefix(path, r+string(filepath.Separator)) {
+			root = r
+		}
+	}
+	return root
+}
+
+// pruneEmptyDirs removes dir and its parents for as long as they are empty,
+// stopping below stop.
+func pruneEmptyDirs(dir, stop string) {
+	if stop == "" {
+		return
+	}
+	for dir != stop && len(dir) > len(stop) {
+		// fails for directories that aren't empty
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// neededTestDB only considers roms with the given content needed
+type neededTestDB struct {
+	archiveTestDB
+	needed map[string]bool
+}
+
+func (ndb *neededTestDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	if ndb.needed[rom.Name] {
+		return []*types.Dat{{Name: "needed"}}, nil
+	}
+	return nil, nil
+}
+
+func TestArchiveDeletesSources(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-consume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{filepath.Join(srcDir, "a", "b"), depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loosePath := filepath.Join(srcDir, "a", "b", "rom.bin")
+	err = ioutil.WriteFile(loosePath, []byte("loose rom"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zipPath := filepath.Join(srcDir, "set.zip")
+	zf, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	for _, name := range []string{"needed.bin", "unneeded.bin"} {
+		w, err := zw.Create(name)
+		if err == nil {
+			_, err = w.Write([]byte(name))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = zw.Close()
+	if err == nil {
+		err = zf.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	romDB := &neededTestDB{needed: map[string]bool{"rom.bin": true, "needed.bin": true}}
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, romDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ArchiveOptions{OnlyNeeded: true, DeleteSources: true}
+	_, err = depot.Archive([]string{srcDir}, opts, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := PathExists(loosePath); exists {
+		t.Errorf("archived source not removed")
+	}
+	if exists, _ := PathExists(filepath.Join(srcDir, "a")); exists {
+		t.Errorf("emptied directories not removed")
+	}
+	if exists, _ := PathExists(srcDir); !exists {
+		t.Errorf("archived directory itself removed")
+	}
+	if exists, _ := PathExists(zipPath); !exists {
+		t.Errorf("zip removed although not all its members were stored")
+	}
+}
+
+func TestArchiveKeepsGivenDirectories(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-consume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+	// the files scanned have src as common root, above the directories given
+	srcDirs := []string{filepath.Join(root, "src", "a", "b"), filepath.Join(root, "src", "c", "d")}
+
+	for _, dir := range append([]string{depotRoot, logDir}, srcDirs...) {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, dir := range srcDirs {
+		err = os.MkdirAll(filepath.Join(dir, "sub"), 0777)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, "sub", "rom.bin"), []byte{byte(i)}, 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ArchiveOptions{DeleteSources: true}
+	_, err = depot.Archive(srcDirs, opts, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range srcDirs {
+		if exists, _ := PathExists(filepath.Join(dir, "sub")); exists {
+			t.Errorf("emptied directory in %s not removed", dir)
+		}
+		if exists, _ := PathExists(dir); !exists {
+			t.Errorf("given directory %s removed", dir)
+		}
+	}
+}
@@ -33,309 +33,396 @@ package archive
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
-
 	"github.com/dustin/go-humanize"
 
-	"github.com/uwedeportivo/torrentzip"
-	"github.com/uwedeportivo/torrentzip/cgzip"
 	"github.com/uwedeportivo/torrentzip/czip"
 
 	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/logging"
+	"github.com/uwedeportivo/romba/trash"
 	"github.com/uwedeportivo/romba/types"
 	"github.com/uwedeportivo/romba/worker"
 )
 
+var logger = logging.For("archive")
+
+// Depot stores roms gzipped under their SHA1 across a number of root
+// directories, each with its own maximum size. New roms go into the root with
+// the most free space.
 type Depot struct {
 	roots    []string
 	sizes    []int64
 	maxSizes []int64
 	romDB    db.RomDB
 	lock     *sync.Mutex
-	start    int
+	codec    *codec
+	// layouts per root, the one to write with first
+	layouts [][]Layout
+	// files and bytes written into the depot since it was opened
+	archivedFiles int64
+	archivedBytes int64
 }
 
 type completed struct {
 	path        string
 	workerIndex int
+	// failed is set if some rom of path failed to be put into the depot
+	failed bool
 }
 
 type archiveWorker struct {
-	depot        *Depot
-	hh           *Hashes
-	md5crcBuffer []byte
-	index        int
-	pm           *archiveMaster
+	depot       *Depot
+	hh          *Hashes
+	extraBuffer []byte
+	index       int
+	pm          *archiveMaster
+	task        *archiveTask
+	// modTime of the file being processed
+	modTime time.Time
+	// partialHash of the loose file partialHashPath of partialHashSize
+	// bytes being processed, computed once needed, see loosePartialHash
+	partialHash     string
+	partialHashPath string
+	partialHashSize int64
+	// spooled is the temp file of the member being archived, if spooled
+	spooled *spoolFile
 }
 
 type archiveMaster struct {
 	depot           *Depot
-	resumePath      string
 	numWorkers      int
 	pt              worker.ProgressTracker
 	soFar           chan *completed
 	resumeLogFile   *os.File
 	resumeLogWriter *bufio.Writer
-	includezips     bool
-	onlyneeded      bool
+	opts            *ArchiveOptions
+	compressors     *compressorPool
+	pendingTasks    *sync.WaitGroup
+	run             string
+	provenance      *provenanceLog
+	report          *runReport
+	sources         *sources
+	commonRootPath  string
+	// roots are the paths given to archive, absolute
+	roots []string
+	// known loose files by size, if the depot is trusted
+	known map[int64][]knownFile
 }
 
 func NewDepot(roots []string, maxSize []int64, romDB db.RomDB) (*Depot, error) {
+	if len(roots) != len(maxSize) {
+		return nil, fmt.Errorf("depot has %d roots but %d max sizes", len(roots), len(maxSize))
+	}
+
 	depot := new(Depot)
 	depot.roots = make([]string, len(roots))
 	depot.sizes = make([]int64, len(roots))
 	depot.maxSizes = make([]int64, len(roots))
+	depot.layouts = make([][]Layout, len(roots))
 
 	copy(depot.roots, roots)
 	copy(depot.maxSizes, maxSize)
 
 	for k, root := range depot.roots {
+		err := cleanTmpDir(root)
+		if err != nil {
+			return nil, err
+		}
+
 		size, err := establishSize(root)
 		if err != nil {
 			return nil, err
 		}
 		depot.sizes[k] = size
+
+		layouts, err := readLayouts(root)
+		if err != nil {
+			return nil, err
+		}
+		depot.layouts[k] = layouts
 	}
 
-	glog.Info("Initializing Depot with the following roots")
+	logger.Info("Initializing Depot with the following roots")
 
 	for k, root := range depot.roots {
-		glog.Infof("root = %s, maxSize = %s, size = %s", root,
+		logger.Infof("root = %s, maxSize = %s, size = %s", root,
 			humanize.Bytes(uint64(depot.maxSizes[k])), humanize.Bytes(uint64(depot.sizes[k])))
 	}
 
 	depot.romDB = romDB
 	depot.lock = new(sync.Mutex)
+	depot.codec = gzipCodec
 	return depot, nil
 }
 
-func (depot *Depot) Archive(paths []string, resumePath string, includezips bool, onlyneeded bool, numWorkers int,
+// cleanTmpDir removes partial depot files left behind in root by an
+// interrupted archive run.
+func cleanTmpDir(root string) error {
+	tmpDir := filepath.Join(root, tmpDirName)
+
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if len(entries) > 0 {
+		logger.Warningf("removing %d partial depot files from %s", len(entries), tmpDir)
+	}
+
+	return os.RemoveAll(tmpDir)
+}
+
+// ArchiveOptions controls what an archive run puts into the depot.
+type ArchiveOptions struct {
+	// ResumePath resumes an interrupted run, skipping all paths up to and including it.
+	ResumePath string
+	// IncludeZips stores container files (zip, rar, tar) themselves in addition to their contents.
+	IncludeZips bool
+	// OnlyNeeded only stores files referenced by a non artificial dat.
+	OnlyNeeded bool
+	// ExtraHashes computes sha256 and blake3 digests in addition to crc, md5 and sha1.
+	ExtraHashes bool
+	// Detectors recognize headered roms, whose contents without the header
+	// are indexed and stored as well.
+	Detectors []*types.Detector
+	// VerifyImports decompresses files taken over from another depot to check
+	// them against their name, instead of trusting their header.
+	VerifyImports bool
+	// MoveImports moves files taken over from another depot instead of
+	// cloning or hardlinking them.
+	MoveImports bool
+	// MemberBufferSize is the size up to which members of zip, rar and tar
+	// files are held in memory for the Detectors, which read them a second
+	// time. Larger zip members are read from the zip again, larger rar and tar
+	// members are spooled into a temp file. Without Detectors, members are
+	// hashed while being compressed, in a single pass.
+	MemberBufferSize int64
+	// QuarantineDir, if set, is where source files that fail to be archived
+	// are moved to, along with a report of the error, instead of failing the
+	// run.
+	QuarantineDir string
+	// QuarantineCopy copies failed source files into QuarantineDir instead of
+	// moving them.
+	QuarantineCopy bool
+	// DeleteSources removes source files once all their contents are in the
+	// depot, along with directories left empty. Containers are only removed
+	// if all their members were stored.
+	DeleteSources bool
+	// Trash, if set and TrashDir isn't, receives the source files
+	// DeleteSources removes, so they can be restored by an undo.
+	Trash *trash.Op
+	// TrashDir, if set, is where DeleteSources moves source files to instead
+	// of removing them.
+	TrashDir string
+	// TrustDepot skips hashing loose files archived before from the same
+	// path, recognized by their modification time, size and a hash of their
+	// start and end, as long as the depot has a file of the same size for
+	// them. It can't be combined with DeleteSources.
+	TrustDepot bool
+	// LowWaterMark is the free disk space in bytes below which writing to a
+	// depot root pauses until space is freed, 0 disables the check.
+	LowWaterMark int64
+	// RequireSpace refuses to start if the files to archive are larger than
+	// the space left in the depot, instead of just warning.
+	RequireSpace bool
+	// VerifyCHD, if set, extracts the tracks of CD image CHDs with it to
+	// check their hashes against the dats, which for redump dats list the
+	// tracks. The checks go into the run report.
+	VerifyCHD CHDTool
+	// Limits bound what is extracted from zip, rar and tar files.
+	Limits ContainerLimits
+	// Source tunes how the files to archive are read.
+	Source SourceOptions
+}
+
+func (depot *Depot) Archive(paths []string, opts *ArchiveOptions, numWorkers int,
 	logDir string, pt worker.ProgressTracker) (string, error) {
 
-	resumeLogPath := filepath.Join(logDir, fmt.Sprintf("archive-resume-%s.log", time.Now().Format("2006-01-02-15_04_05")))
+	if opts.TrustDepot && opts.DeleteSources {
+		return "", fmt.Errorf("sources can't be deleted when trusting the depot, their contents aren't verified")
+	}
+
+	var roots []string
+	for _, path := range paths {
+		if isRemote(path) {
+			if opts.QuarantineDir != "" || opts.DeleteSources {
+				return "", fmt.Errorf("files on SFTP and HTTP servers like %s can't be quarantined or deleted", path)
+			}
+			continue
+		}
+		root, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		roots = append(roots, root)
+	}
+
+	run := time.Now().Format("2006-01-02-15_04_05")
+
+	resumeLogPath := filepath.Join(logDir, fmt.Sprintf("archive-resume-%s.log", run))
 	resumeLogFile, err := os.Create(resumeLogPath)
 	if err != nil {
 		return "", err
 	}
 	resumeLogWriter := bufio.NewWriter(resumeLogFile)
 
+	report, err := openRunReport(logDir, run)
+	if err != nil {
+		resumeLogFile.Close()
+		return "", err
+	}
+
 	pm := new(archiveMaster)
 	pm.depot = depot
-	pm.resumePath = resumePath
 	pm.pt = pt
 	pm.numWorkers = numWorkers
 	pm.soFar = make(chan *completed)
 	pm.resumeLogWriter = resumeLogWriter
 	pm.resumeLogFile = resumeLogFile
-	pm.includezips = includezips
-	pm.onlyneeded = onlyneeded
+	pm.opts = opts
+	pm.pendingTasks = new(sync.WaitGroup)
+	pm.run = run
+	pm.report = report
+	pm.sources = newSources(&opts.Source, pt)
+	pm.roots = roots
 
 	go pm.loopObserver(resumeLogWriter)
 
-	return worker.Work("archive roms", paths, pm)
+	res, err := worker.Work("archive roms", paths, pm)
+	return res.Message, err
 }
 
-func (depot *Depot) OpenRomGZ(rom *types.Rom) (io.ReadCloser, error) {
+// OpenRom returns the decompressed contents of rom from the depot, or nil if
+// the depot doesn't have it.
+func (depot *Depot) OpenRom(rom *types.Rom) (io.ReadCloser, error) {
+	rompath, err := depot.romPathFor(rom)
+	if err != nil || rompath == "" {
+		return nil, err
+	}
+	return openDepotFile(rompath)
+}
+
+// romPathFor returns the path of the depot file holding rom, or the empty
+// string if the depot doesn't have it. rom.Sha1 may hold several SHA1s in case
+// of hash collisions, which are told apart by md5 or crc.
+func (depot *Depot) romPathFor(rom *types.Rom) (string, error) {
 	if rom.Sha1 == nil {
-		return nil, fmt.Errorf("cannot open rom %s because SHA1 is missing", rom.Name)
+		return "", fmt.Errorf("cannot open rom %s because SHA1 is missing", rom.Name)
 	}
 
 	if len(rom.Sha1) == sha1.Size {
-		sha1Hex := hex.EncodeToString(rom.Sha1)
+		return depot.RomPath(hex.EncodeToString(rom.Sha1))
+	}
 
-		for _, root := range depot.roots {
-			rompath := pathFromSha1HexEncoding(root, sha1Hex, gzipSuffix)
-			exists, err := PathExists(rompath)
-			if err != nil {
-				return nil, err
-			}
+	logger.Infof("searching for the right file for rom %s because of hash collisions", rom.Name)
+	for i := 0; i < len(rom.Sha1); i += sha1.Size {
+		sha1Hex := hex.EncodeToString(rom.Sha1[i : i+sha1.Size])
 
-			if exists {
-				return os.Open(rompath)
-			}
-		}
-	} else {
-		glog.Infof("searching for the right file for rom %s because of hash collisions", rom.Name)
-		for i := 0; i < len(rom.Sha1); i += sha1.Size {
-			sha1Hex := hex.EncodeToString(rom.Sha1[i : i+sha1.Size])
+		logger.Infof("trying SHA1 %s", sha1Hex)
 
-			glog.Infof("trying SHA1 %s", sha1Hex)
+		rompath, err := depot.RomPath(sha1Hex)
+		if err != nil {
+			return "", err
+		}
 
-			for _, root := range depot.roots {
-				rompath := pathFromSha1HexEncoding(root, sha1Hex, gzipSuffix)
-				exists, err := PathExists(rompath)
+		if rompath != "" {
+			// double check that it matches crc or md5
+			if rom.Crc != nil || rom.Md5 != nil {
+				hh, err := headerHashesForDepotFile(rompath)
 				if err != nil {
-					return nil, err
+					return "", err
 				}
 
-				if exists {
-					// double check that it matches crc or md5
-					if rom.Crc != nil || rom.Md5 != nil {
-						hh, err := HashesForGZFile(rompath)
-						if err != nil {
-							return nil, err
-						}
-
-						if rom.Md5 != nil && bytes.Equal(rom.Md5, hh.Md5) {
-							return os.Open(rompath)
-						}
-
-						if rom.Crc != nil && bytes.Equal(rom.Crc, hh.Crc) {
-							return os.Open(rompath)
-						}
-
-					} else {
-						glog.Warningf("rom %s with collision SHA1 and no other hash to disambigue", rom.Name)
-						return os.Open(rompath)
-					}
+				if rom.Md5 != nil && bytes.Equal(rom.Md5, hh.Md5) {
+					return rompath, nil
 				}
-			}
-		}
-	}
-
-	return nil, nil
-}
 
-func (depot *Depot) BuildDat(dat *types.Dat, outpath string) (bool, error) {
-	datPath := filepath.Join(outpath, dat.Name)
-
-	err := os.Mkdir(datPath, 0777)
-	if err != nil {
-		return false, err
-	}
-
-	var fixDat *types.Dat
+				if rom.Crc != nil && bytes.Equal(rom.Crc, hh.Crc) {
+					return rompath, nil
+				}
 
-	for _, game := range dat.Games {
-		fixGame, err := depot.buildGame(game, datPath)
-		if err != nil {
-			return false, err
-		}
-		if fixGame != nil {
-			if fixDat == nil {
-				fixDat = new(types.Dat)
-				fixDat.Name = dat.Name
-				fixDat.Description = dat.Description
-				fixDat.Path = dat.Path
+			} else {
+				logger.Warningf("rom %s with collision SHA1 and no other hash to disambigue", rom.Name)
+				return rompath, nil
 			}
-			fixDat.Games = append(fixDat.Games, fixGame)
 		}
 	}
 
-	if fixDat != nil {
-		fixDatPath := filepath.Join(outpath, fixPrefix+dat.Name+datSuffix)
-
-		fixFile, err := os.Create(fixDatPath)
-		if err != nil {
-			return false, err
-		}
-		defer fixFile.Close()
+	return "", nil
+}
 
-		fixWriter := bufio.NewWriter(fixFile)
-		defer fixWriter.Flush()
+// RomPath returns the path of the depot file for the given hex encoded SHA1
+// in whichever root holds it with whichever codec, or the empty string if no
+// root has it.
+func (depot *Depot) RomPath(sha1Hex string) (string, error) {
+	for k, root := range depot.roots {
+		for _, l := range depot.layoutsOf(k) {
+			for _, c := range codecs {
+				rompath := l.path(root, sha1Hex, c.suffix)
+				exists, err := PathExists(rompath)
+				if err != nil {
+					return "", err
+				}
 
-		err = types.ComposeDat(fixDat, fixWriter)
-		if err != nil {
-			return false, err
+				if exists {
+					return rompath, nil
+				}
+			}
 		}
 	}
-
-	return fixDat == nil, nil
+	return "", nil
 }
 
-func (depot *Depot) buildGame(game *types.Game, datPath string) (*types.Game, error) {
-	gamePath := filepath.Join(datPath, game.Name+zipSuffix)
-	gameFile, err := os.Create(gamePath)
+// SetCompression selects the codec new depot files are written with, "gzip"
+// or "zstd". Existing depot files can be read regardless of their codec.
+func (depot *Depot) SetCompression(name string) error {
+	c, err := codecByName(name)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer gameFile.Close()
+	depot.codec = c
+	return nil
+}
 
-	gameTorrent, err := torrentzip.NewWriter(gameFile)
-	if err != nil {
-		return nil, err
+func (pm *archiveMaster) Accept(path string) bool {
+	if isDepotBookkeeping(path) {
+		return false
 	}
-	defer gameTorrent.Close()
-
-	var fixGame *types.Game
-
-	for _, rom := range game.Roms {
-		if rom.Sha1 == nil {
-			glog.Warningf("game %s has rom with missing SHA1 %s", game.Name, rom.Name)
-			if fixGame == nil {
-				fixGame = new(types.Game)
-				fixGame.Name = game.Name
-				fixGame.Description = game.Description
-			}
-
-			fixGame.Roms = append(fixGame.Roms, rom)
-			continue
-		}
-
-		romGZ, err := depot.OpenRomGZ(rom)
-		if err != nil {
-			return nil, err
-		}
-
-		if romGZ == nil {
-			glog.Warningf("game %s has missing rom %s (sha1 %s)", game.Name, rom.Name, hex.EncodeToString(rom.Sha1))
-			if fixGame == nil {
-				fixGame = new(types.Game)
-				fixGame.Name = game.Name
-				fixGame.Description = game.Description
-			}
-
-			fixGame.Roms = append(fixGame.Roms, rom)
-			continue
-		}
-
-		src, err := cgzip.NewReader(romGZ)
-		if err != nil {
-			return nil, err
-		}
-
-		dst, err := gameTorrent.Create(rom.Name)
-		if err != nil {
-			return nil, err
-		}
-
-		_, err = io.Copy(dst, src)
-		if err != nil {
-			return nil, err
+	for _, dir := range []string{pm.opts.QuarantineDir, pm.opts.TrashDir} {
+		if dir != "" && strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return false
 		}
-
-		src.Close()
-		romGZ.Close()
 	}
-	return fixGame, nil
-}
-
-func (pm *archiveMaster) Accept(path string) bool {
-	if pm.resumePath != "" {
-		return path > pm.resumePath
+	if pm.opts.ResumePath != "" {
+		return path > pm.opts.ResumePath
 	}
 	return true
 }
 
 func (pm *archiveMaster) NewWorker(workerIndex int) worker.Worker {
 	return &archiveWorker{
-		depot:        pm.depot,
-		hh:           newHashes(),
-		md5crcBuffer: make([]byte, md5.Size+crc32.Size),
-		index:        workerIndex,
-		pm:           pm,
+		depot:       pm.depot,
+		hh:          newHashes(pm.opts.ExtraHashes),
+		extraBuffer: make([]byte, 0, maxDepotExtraSize),
+		index:       workerIndex,
+		pm:          pm,
 	}
 }
 
@@ -348,44 +435,179 @@ func (pm *archiveMaster) ProgressTracker() worker.ProgressTracker {
 }
 
 func (pm *archiveMaster) FinishUp() error {
+	pm.pendingTasks.Wait()
+	cerr := pm.compressors.close()
+
 	pm.soFar <- &completed{
 		workerIndex: -1,
 	}
 
 	pm.depot.writeSizes()
 	pm.resumeLogWriter.Flush()
+	pm.sources.close()
+
+	perr := pm.provenance.close()
+	rerr := pm.report.close()
 
-	return pm.resumeLogFile.Close()
+	err := pm.resumeLogFile.Close()
+	if cerr != nil {
+		return cerr
+	}
+	if perr != nil {
+		return perr
+	}
+	if rerr != nil {
+		return rerr
+	}
+	return err
 }
 
 func (pm *archiveMaster) Start() error {
+	provenance, err := openProvenanceLog(pm.depot, pm.run)
+	if err != nil {
+		return err
+	}
+	pm.provenance = provenance
+
+	if pm.opts.TrustDepot {
+		pm.known, err = pm.depot.loadKnownFiles()
+		if err != nil {
+			return err
+		}
+	}
+	pm.compressors = newCompressorPool(pm.depot, runtime.NumCPU())
+	return nil
+}
+
+func (pm *archiveMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	pm.commonRootPath = commonRootPath
+	fi, err := os.Stat(commonRootPath)
+	if err == nil && !fi.IsDir() {
+		pm.commonRootPath = filepath.Dir(commonRootPath)
+	}
+
+	// compression makes this a pessimistic estimate
+	available := pm.depot.availableSpace(pm.opts.LowWaterMark)
+	if numBytes > available {
+		msg := fmt.Sprintf("archiving %s of files into a depot with %s of space left",
+			humanize.Bytes(uint64(numBytes)), humanize.Bytes(uint64(available)))
+		if pm.opts.RequireSpace {
+			return errors.New(msg)
+		}
+		logger.Warn(msg)
+	}
 	return nil
 }
 
-func (pm *archiveMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+// skipOutsideRoots is the reason depot jobs skip files in none of the depot
+// roots for, see worker.Skip.
+const skipOutsideRoots = "outside the depot roots"
+
+// rootIndex returns the index of the depot root that path is in, or -1.
+func (depot *Depot) rootIndex(path string) int {
+	for k, root := range depot.roots {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return k
+		}
+	}
+	return -1
+}
+
+// freeSpacePollInterval is how often a paused archive run checks whether
+// disk space has been freed.
+var freeSpacePollInterval = 30 * time.Second
+
+// rootSpace returns how many more bytes root i can take, bounded by its max
+// size and, if lowWater is positive, by the free disk space above lowWater. It
+// also reports whether the free disk space is the bound. Callers hold
+// depot.lock.
+func (depot *Depot) rootSpace(i int, lowWater int64) (int64, bool) {
+	free := depot.maxSizes[i] - depot.sizes[i]
+	if lowWater <= 0 {
+		return free, false
+	}
+
+	disk, err := diskFree(depot.roots[i])
+	if err != nil {
+		logger.Warningf("failed to determine free disk space of %s: %v", depot.roots[i], err)
+		return free, false
+	}
+	if disk >= 0 && disk-lowWater < free {
+		return disk - lowWater, true
+	}
+	return free, false
+}
 
-func (depot *Depot) reserveRoot(size int64) (int, error) {
+// availableSpace returns how many more bytes the depot can take.
+func (depot *Depot) availableSpace(lowWater int64) int64 {
 	depot.lock.Lock()
 	defer depot.lock.Unlock()
 
-	for i := depot.start; i < len(depot.roots); i++ {
-		if depot.sizes[i]+size < depot.maxSizes[i] {
-			depot.sizes[i] += size
-			return i, nil
-		} else if depot.sizes[i] >= depot.maxSizes[i] {
-			depot.start = i
+	var total int64
+	for i := range depot.roots {
+		if free, _ := depot.rootSpace(i, lowWater); free > 0 {
+			total += free
+		}
+	}
+	return total
+}
+
+// reserveRoot picks the root with the most space for size bytes and reserves
+// them. If only the free disk space keeps a root from taking them, it waits
+// for space to be freed instead of failing.
+func (depot *Depot) reserveRoot(size int64, lowWater int64) (int, error) {
+	for {
+		root, diskBound := depot.tryReserveRoot(size, lowWater)
+		if root != -1 {
+			return root, nil
+		}
+		if !diskBound {
+			break
 		}
+
+		logger.Warningf("depot disk space below %s, pausing until space is freed",
+			humanize.Bytes(uint64(lowWater)))
+		time.Sleep(freeSpacePollInterval)
 	}
 
-	glog.Error("Depot with the following roots ran out of disk space")
+	logger.Error("Depot with the following roots ran out of disk space")
 	for k, root := range depot.roots {
-		glog.Errorf("root = %s, maxSize = %s, size = %s", root,
+		logger.Errorf("root = %s, maxSize = %s, size = %s", root,
 			humanize.Bytes(uint64(depot.maxSizes[k])), humanize.Bytes(uint64(depot.sizes[k])))
 	}
 
 	return -1, fmt.Errorf("depot ran out of disk space")
 }
 
+// tryReserveRoot reserves size bytes in the root with the most space. If no
+// root has enough it returns -1 and whether some root only lacks free disk
+// space.
+func (depot *Depot) tryReserveRoot(size int64, lowWater int64) (int, bool) {
+	depot.lock.Lock()
+	defer depot.lock.Unlock()
+
+	best := -1
+	var bestFree int64
+	diskBound := false
+
+	for i := range depot.roots {
+		free, bound := depot.rootSpace(i, lowWater)
+		if free > size && (best == -1 || free > bestFree) {
+			best = i
+			bestFree = free
+		}
+		if bound && depot.maxSizes[i]-depot.sizes[i] > size {
+			diskBound = true
+		}
+	}
+
+	if best != -1 {
+		depot.sizes[best] += size
+	}
+	return best, diskBound
+}
+
 func (depot *Depot) writeSizes() {
 	depot.lock.Lock()
 	defer depot.lock.Unlock()
@@ -393,7 +615,7 @@ func (depot *Depot) writeSizes() {
 	for k, root := range depot.roots {
 		err := writeSizeFile(root, depot.sizes[k])
 		if err != nil {
-			glog.Errorf("failed to write size file into %s: %v\n", root, err)
+			logger.Errorf("failed to write size file into %s: %v\n", root, err)
 		}
 	}
 }
@@ -405,24 +627,189 @@ func (depot *Depot) adjustSize(index int, delta int64) {
 	depot.sizes[index] += delta
 }
 
-func (w *archiveWorker) Process(path string, size int64) error {
-	var err error
+// archived records that a file of size bytes was written into the depot.
+func (depot *Depot) archived(index int, size int64) {
+	depot.lock.Lock()
+	defer depot.lock.Unlock()
+
+	depot.sizes[index] += size
+	depot.archivedFiles++
+	depot.archivedBytes += size
+}
+
+// Archived returns the number of files and bytes written into the depot
+// since it was opened.
+func (depot *Depot) Archived() (int64, int64) {
+	depot.lock.Lock()
+	defer depot.lock.Unlock()
+
+	return depot.archivedFiles, depot.archivedBytes
+}
+
+// RootUsage is how much of a depot root is used.
+type RootUsage struct {
+	Root    string `json:"root"`
+	Size    int64  `json:"size"`
+	MaxSize int64  `json:"maxSize"`
+	// DiskFree is the free space of the disk holding the root, -1 if
+	// unknown.
+	DiskFree int64 `json:"diskFree"`
+}
+
+// trashDirName is the directory inside each depot root the depot files
+// trashed by purges go to, on the same filesystem as them.
+const trashDirName = ".romba_trash"
+
+// TrashAreas returns the trash areas of the depot roots.
+func (depot *Depot) TrashAreas() []trash.Area {
+	areas := make([]trash.Area, len(depot.roots))
+	for k, root := range depot.roots {
+		areas[k] = trash.Area{Root: root, Dir: filepath.Join(root, trashDirName)}
+	}
+	return areas
+}
+
+// Restored records that the depot file at path, of size bytes, was put back
+// into the depot from outside, like by an undo of a purge. Paths outside of
+// the depot are ignored.
+func (depot *Depot) Restored(path string, size int64) {
+	k := depot.rootIndex(path)
+	if k == -1 || !isDepotFile(path) {
+		return
+	}
+	depot.adjustSize(k, size)
+	depot.writeSizes()
+}
 
-	if filepath.Ext(path) == zipSuffix {
-		_, err = w.archiveZip(path, size, w.pm.includezips)
-	} else {
-		_, err = w.archiveRom(path, size)
+// Usage returns how much of each root of the depot is used.
+func (depot *Depot) Usage() []*RootUsage {
+	depot.lock.Lock()
+	defer depot.lock.Unlock()
+
+	usage := make([]*RootUsage, len(depot.roots))
+	for k, root := range depot.roots {
+		disk, err := diskFree(root)
+		if err != nil {
+			logger.Warningf("failed to determine free disk space of %s: %v", root, err)
+			disk = -1
+		}
+
+		usage[k] = &RootUsage{
+			Root:     root,
+			Size:     depot.sizes[k],
+			MaxSize:  depot.maxSizes[k],
+			DiskFree: disk,
+		}
 	}
+	return usage
+}
 
+// Process hashes and indexes the roms in path and queues the ones missing
+// from the depot for compression. The reservation for path in the depot and
+// any resources the queued roms are read from are released once all of them
+// are compressed, without holding up the worker.
+func (w *archiveWorker) Process(path string, size int64) error {
+	fi, err := w.pm.sources.stat(path)
 	if err != nil {
 		return err
 	}
+	w.modTime = fi.ModTime()
+	w.partialHashPath = ""
 
-	w.pm.soFar <- &completed{
-		path:        path,
-		workerIndex: w.index,
+	root, err := w.depot.reserveRoot(size, w.pm.opts.LowWaterMark)
+	if err != nil {
+		return err
 	}
-	return nil
+	// the reservation is handed to the task once archiving returns, if it
+	// doesn't it is released here
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			w.depot.adjustSize(root, -size)
+		}
+	}()
+
+	w.task = newArchiveTask()
+
+	switch {
+	case isRemote(path):
+		err = w.archiveRemote(path, root, size)
+	case isTar(path):
+		err = w.archiveTar(path, root, size, w.pm.opts.IncludeZips)
+	case filepath.Ext(path) == zipSuffix:
+		err = w.archiveZip(path, root, size, w.pm.opts.IncludeZips)
+	case filepath.Ext(path) == rarSuffix:
+		err = w.archiveRar(path, root, size, w.pm.opts.IncludeZips)
+	default:
+		if sha1Hex, ok := depotLayoutSha1(path); ok {
+			err = w.importDepotFile(path, sha1Hex, root)
+		} else if isPlainGzip(path) {
+			err = w.archiveGzip(path, root, size)
+		} else {
+			err = w.archiveRom(path, root, size)
+		}
+	}
+
+	task := w.task
+	w.task = nil
+
+	task.onDone(func() { w.depot.adjustSize(root, -size) })
+	handedOver = true
+
+	procErr := err
+	task.onDone(func() {
+		sr := &SourceReport{Path: path, Roms: task.roms, Tracks: task.tracks}
+		if procErr == nil {
+			procErr = task.err
+		}
+		if procErr != nil {
+			sr.Error = procErr.Error()
+		}
+		w.pm.report.add(sr)
+	})
+
+	// files skipped on purpose are neither quarantined nor deleted
+	_, skipped := err.(*worker.SkipError)
+	quarantined := false
+	if err != nil && !skipped && w.pm.opts.QuarantineDir != "" {
+		logger.Errorf("failed to archive %s: %v", path, procErr)
+
+		// the compressors may still be reading from path
+		task.onDone(func() {
+			if qerr := w.pm.quarantineSource(path, procErr); qerr != nil {
+				logger.Errorf("failed to quarantine %s: %v", path, qerr)
+			}
+		})
+		quarantined = true
+		err = nil
+	} else if err == nil && w.pm.opts.DeleteSources {
+		task.onDone(func() {
+			if derr := w.pm.deleteSource(path, task); derr != nil {
+				logger.Errorf("failed to delete source %s: %v", path, derr)
+			}
+		})
+	}
+	if err == nil || skipped {
+		workerIndex := w.index
+		task.onDone(func() {
+			w.pm.soFar <- &completed{
+				path:        path,
+				workerIndex: workerIndex,
+				failed:      task.err != nil,
+			}
+		})
+	}
+
+	w.pm.pendingTasks.Add(1)
+	go func() {
+		task.wait()
+		w.pm.pendingTasks.Done()
+	}()
+
+	if quarantined {
+		return worker.Skip("quarantined")
+	}
+	return err
 }
 
 func (w *archiveWorker) Close() error {
@@ -431,10 +818,10 @@ func (w *archiveWorker) Close() error {
 
 type readerOpener func() (io.ReadCloser, error)
 
-func (w *archiveWorker) archive(ro readerOpener, root int, name, path string, size int64) (int64, error) {
+func (w *archiveWorker) archive(ro readerOpener, root int, name, path string, size int64) error {
 	r, err := ro()
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	br := bufio.NewReader(r)
@@ -442,31 +829,73 @@ func (w *archiveWorker) archive(ro readerOpener, root int, name, path string, si
 	err = w.hh.forReader(br)
 	if err != nil {
 		r.Close()
-		return 0, err
+		return err
 	}
 	err = r.Close()
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	rom := w.hh.rom(name, path, size)
+
+	w.extraBuffer = w.hh.depotExtra(w.extraBuffer[:0], size)
+
+	err = w.store(ro, root, rom, w.extraBuffer, rom.Sha1)
+	if err != nil {
+		return err
+	}
+
+	if len(w.pm.opts.Detectors) > 0 {
+		return w.archiveHeaderless(ro, root, name, path, size)
+	}
+	return nil
+}
+
+// store indexes rom and, unless the depot already has it, queues the contents
+// provided by ro for compression into the depot under the rom's SHA1. If
+// wantSha1 is non nil the contents are verified against it before the depot
+// file is committed. ro must stay valid until the current task is done.
+func (w *archiveWorker) store(ro readerOpener, root int, rom *types.Rom, extra []byte, wantSha1 []byte) error {
+	sha1Hex, missing, err := w.indexRom(rom, root)
+	if err != nil || !missing {
+		return err
 	}
 
-	copy(w.md5crcBuffer[0:md5.Size], w.hh.Md5)
-	copy(w.md5crcBuffer[md5.Size:], w.hh.Crc)
+	task := w.task
+	done := task.done
+	if sf := w.spooled; sf != nil {
+		sf.acquire()
+		done = func(err error) {
+			sf.release()
+			task.done(err)
+		}
+	}
 
-	rom := new(types.Rom)
-	rom.Crc = make([]byte, crc32.Size)
-	rom.Md5 = make([]byte, md5.Size)
-	rom.Sha1 = make([]byte, sha1.Size)
-	copy(rom.Crc, w.hh.Crc)
-	copy(rom.Md5, w.hh.Md5)
-	copy(rom.Sha1, w.hh.Sha1)
-	rom.Name = name
-	rom.Size = size
-	rom.Path = path
+	task.add()
+	queued := w.pm.compressors.submit(&compressJob{
+		ro:       ro,
+		root:     root,
+		outpath:  w.depot.romPathIn(root, sha1Hex, w.depot.codec.suffix),
+		extra:    append([]byte(nil), extra...),
+		wantSha1: wantSha1,
+		done:     done,
+	})
+	if !queued {
+		// another source of this run is putting it into the depot
+		task.roms[len(task.roms)-1].New = false
+		done(nil)
+	}
+	return nil
+}
 
-	if w.pm.onlyneeded {
+// indexRom indexes rom unless only needed roms are archived and rom isn't one
+// of them, and records its provenance in root. It returns the hex encoded SHA1
+// of rom and whether it still needs to be put into the depot.
+func (w *archiveWorker) indexRom(rom *types.Rom, root int) (string, bool, error) {
+	if w.pm.opts.OnlyNeeded {
 		dats, err := w.depot.romDB.DatsForRom(rom)
 		if err != nil {
-			return 0, err
+			return "", false, err
 		}
 
 		needed := false
@@ -478,103 +907,301 @@ func (w *archiveWorker) archive(ro readerOpener, root int, name, path string, si
 			}
 		}
 		if !needed {
-			return 0, nil
+			w.task.incomplete = true
+			return "", false, nil
 		}
 	}
 
-	err = w.depot.romDB.IndexRom(rom)
+	err := w.depot.romDB.IndexRom(rom)
+	if err != nil {
+		return "", false, err
+	}
+
+	sha1Hex := hex.EncodeToString(rom.Sha1)
+
+	pr := &ProvenanceRecord{
+		Sha1:    sha1Hex,
+		ModTime: w.modTime,
+		Size:    rom.Size,
+		Path:    rom.Path,
+	}
+	if rom.Path == w.partialHashPath {
+		pr.PartialHash, err = w.loosePartialHash()
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	err = w.pm.provenance.record(root, pr)
+	if err != nil {
+		return "", false, err
+	}
+
+	existing, err := w.depot.RomPath(sha1Hex)
+	if err != nil {
+		return "", false, err
+	}
+
+	w.task.roms = append(w.task.roms, &RomReport{Sha1: sha1Hex, New: existing == ""})
+	return sha1Hex, existing == "", nil
+}
+
+// bufferedOpener returns a readerOpener for data held in memory.
+func bufferedOpener(data []byte) readerOpener {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// streams reports whether a member of size bytes, -1 if unknown, is archived
+// in a single pass by archiveStreamed. With header skippers, that holds it in
+// memory for them.
+func (w *archiveWorker) streams(size int64) bool {
+	if len(w.pm.opts.Detectors) == 0 {
+		return true
+	}
+	return size >= 0 && size <= w.pm.opts.MemberBufferSize
+}
+
+// archiveStreamed archives r in a single pass: it is hashed while being
+// compressed into a temp file of the depot, which is put into place once its
+// SHA1 is known, unless the depot already has it.
+func (w *archiveWorker) archiveStreamed(r io.Reader, root int, name, path string) error {
+	c := w.depot.codec
+	tmpDir := filepath.Join(w.depot.roots[root], tmpDirName)
+	err := os.MkdirAll(tmpDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	outfile, err := ioutil.TempFile(tmpDir, streamTmpPrefix)
+	if err != nil {
+		return err
+	}
+	tmppath := outfile.Name()
+
+	// the depot header is written over once the hashes are known
+	extraSize := depotExtraSize
+	if w.hh.extended() {
+		extraSize = maxDepotExtraSize
+	}
+
+	cw := &countWriter{w: outfile}
+	bufout := bufio.NewWriter(cw)
+	zw, err := c.newWriter(bufout, make([]byte, extraSize))
 	if err != nil {
-		return 0, err
+		outfile.Close()
+		os.Remove(tmppath)
+		return err
 	}
 
-	sha1Hex := hex.EncodeToString(w.hh.Sha1)
+	uw := &countWriter{w: zw}
+	var held *bytes.Buffer
+	if len(w.pm.opts.Detectors) > 0 {
+		held = new(bytes.Buffer)
+		uw.w = io.MultiWriter(zw, held)
+	}
 
-	outpath := pathFromSha1HexEncoding(w.depot.roots[root], sha1Hex, gzipSuffix)
+	err = w.hh.forReader(io.TeeReader(r, uw))
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = bufout.Flush()
+	}
+	if err == nil {
+		w.extraBuffer = w.hh.depotExtra(w.extraBuffer[:0], uw.count)
+		_, err = outfile.WriteAt(w.extraBuffer, c.extraOffset)
+	}
+	if err == nil {
+		err = outfile.Sync()
+	}
+	if cerr := outfile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
 
-	exists, err := PathExists(outpath)
+	rom := w.hh.rom(name, path, uw.count)
+	err = w.putStreamed(tmppath, root, rom, cw.count)
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	if held != nil {
+		return w.archiveHeaderless(bufferedOpener(held.Bytes()), root, name, path, uw.count)
+	}
+	return nil
+}
+
+// putStreamed indexes rom and moves the depot file for it at tmppath, n bytes
+// big, into place if the depot needs it, or removes it.
+func (w *archiveWorker) putStreamed(tmppath string, root int, rom *types.Rom, n int64) error {
+	sha1Hex, missing, err := w.indexRom(rom, root)
+	if err != nil || !missing {
+		os.Remove(tmppath)
+		return err
 	}
 
-	if exists {
-		return 0, nil
+	outpath := w.depot.romPathIn(root, sha1Hex, w.depot.codec.suffix)
+	if !w.pm.compressors.claim(outpath) {
+		// another source of this run is putting it into the depot
+		w.task.roms[len(w.task.roms)-1].New = false
+		os.Remove(tmppath)
+		return nil
 	}
+	defer w.pm.compressors.release(outpath)
 
-	r, err = ro()
+	err = os.MkdirAll(filepath.Dir(outpath), 0777)
+	if err == nil {
+		err = os.Rename(tmppath, outpath)
+	}
 	if err != nil {
-		return 0, err
+		os.Remove(tmppath)
+		return err
+	}
+
+	w.depot.archived(root, n)
+	return nil
+}
+
+// archiveSpooled archives a member of a container format that can only be read
+// once and in order (rar, tar), by spooling it into a temp file first unless
+// it can be streamed. size is -1 if unknown.
+func (w *archiveWorker) archiveSpooled(r io.Reader, root int, name, path string, size int64) error {
+	if w.streams(size) {
+		return w.archiveStreamed(r, root, name, path)
 	}
-	defer r.Close()
 
-	compressedSize, err := archive(outpath, r, w.md5crcBuffer)
+	tmppath, n, err := spool(r)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	w.depot.adjustSize(root, compressedSize)
-	return compressedSize, nil
+	// the temp file goes as soon as the compressors are done with it, not
+	// with the whole container
+	sf := &spoolFile{path: tmppath, refs: 1}
+	w.spooled = sf
+	err = w.archive(func() (io.ReadCloser, error) { return os.Open(tmppath) }, root, name, path, n)
+	w.spooled = nil
+	sf.release()
+	return err
 }
 
-func (w *archiveWorker) archiveZip(inpath string, size int64, addZipItself bool) (int64, error) {
-	root, err := w.depot.reserveRoot(size)
+func (w *archiveWorker) archiveZip(inpath string, root int, size int64, addZipItself bool) error {
+	sf, err := w.pm.sources.openFile(inpath)
 	if err != nil {
-		return 0, err
+		return err
 	}
+	// members are read again by the compressors
+	w.task.onDone(func() { sf.Close() })
 
-	zr, err := czip.OpenReader(inpath)
+	zr, err := czip.NewReader(sf, size)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer zr.Close()
 
-	var compressedSize int64
+	limits := &w.pm.opts.Limits
+	err = limits.checkMembers(inpath, len(zr.File))
+	if err != nil {
+		return err
+	}
 
 	for _, zf := range zr.File {
-		cs, err := w.archive(func() (io.ReadCloser, error) { return zf.Open() }, root,
-			zf.FileInfo().Name(), filepath.Join(inpath, zf.FileInfo().Name()), zf.FileInfo().Size())
+		zf := zf
+		name := zf.FileInfo().Name()
+		size := zf.FileInfo().Size()
+		path := filepath.Join(inpath, name)
+
+		err = limits.checkMember(path, size, int64(zf.CompressedSize64))
 		if err != nil {
-			return 0, err
+			return err
 		}
-		compressedSize += cs
-	}
 
-	if addZipItself {
-		cs, err := w.archive(func() (io.ReadCloser, error) { return os.Open(inpath) }, root, filepath.Base(inpath), inpath, size)
+		if w.streams(size) {
+			r, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = w.archiveStreamed(limits.reader(path, r), root, name, path)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := w.archive(limits.opener(path, func() (io.ReadCloser, error) { return zf.Open() }), root,
+			name, path, size)
 		if err != nil {
-			return 0, err
+			return err
 		}
-		compressedSize += cs
 	}
-	return compressedSize, nil
+
+	if addZipItself {
+		return w.archive(w.pm.sources.opener(inpath), root, filepath.Base(inpath), inpath, size)
+	}
+	return nil
 }
 
-func (w *archiveWorker) archiveRom(inpath string, size int64) (int64, error) {
-	root, err := w.depot.reserveRoot(size)
+func (w *archiveWorker) archiveRom(inpath string, root int, size int64) error {
+	chd, err := CHDInfoForFile(inpath)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if chd != nil && chd.Sha1 != nil {
+		return w.archiveCHD(inpath, root, chd, size)
 	}
-	return w.archive(func() (io.ReadCloser, error) { return os.Open(inpath) }, root, filepath.Base(inpath), inpath, size)
+
+	w.partialHash = ""
+	w.partialHashPath = inpath
+	w.partialHashSize = size
+
+	if w.pm.known != nil {
+		done, err := w.archiveKnown(inpath, root, size)
+		if err != nil || done {
+			return err
+		}
+	}
+
+	return w.archive(w.pm.sources.opener(inpath), root, filepath.Base(inpath), inpath, size)
 }
 
-func (pm *archiveMaster) loopObserver(writer io.Writer) {
+// loopObserver writes the smallest path the workers are busy with to the
+// resume log every minute, the paths before it all being done. It returns
+// when FinishUp tells it to, with workerIndex -1.
+func (pm *archiveMaster) loopObserver(writer *bufio.Writer) {
 	ticker := time.NewTicker(time.Minute * 1)
+	defer ticker.Stop()
+
 	comps := make([]string, pm.numWorkers)
+	sorted := make([]string, pm.numWorkers)
+	// failed workers don't move on, so that a resumed run starts over
+	// before the path that failed
+	failed := make([]bool, pm.numWorkers)
 
 	for {
 		select {
 		case comp := <-pm.soFar:
 			if comp.workerIndex == -1 {
-				break
+				return
+			}
+			if comp.failed {
+				failed[comp.workerIndex] = true
+			}
+			if !failed[comp.workerIndex] {
+				comps[comp.workerIndex] = comp.path
 			}
-			comps[comp.workerIndex] = comp.path
 		case <-ticker.C:
-			if comps[0] != "" {
-				sort.Strings(comps)
-				fmt.Fprint(writer, "%s\n", comps[0])
+			copy(sorted, comps)
+			sort.Strings(sorted)
+			if sorted[0] != "" {
+				fmt.Fprintf(writer, "%s\n", sorted[0])
+				writer.Flush()
 				pm.depot.writeSizes()
 			}
 		}
 	}
-
-	ticker.Stop()
 }
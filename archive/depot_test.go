@@ -0,0 +1,533 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// archiveTestDB accepts every rom and knows no dats
+type archiveTestDB struct {
+	db.RomDB
+}
+
+func (adb *archiveTestDB) IndexRom(rom *types.Rom) error {
+	return nil
+}
+
+func (adb *archiveTestDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	return nil, nil
+}
+
+func (adb *archiveTestDB) CompleteRom(rom *types.Rom) error {
+	return nil
+}
+
+func TestArchive(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-depot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var contents [][]byte
+
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("loose rom %d", i))
+		contents = append(contents, data)
+		err = ioutil.WriteFile(filepath.Join(srcDir, fmt.Sprintf("rom%d.bin", i)), data, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zf, err := os.Create(filepath.Join(srcDir, "set.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("zipped rom %d", i))
+		contents = append(contents, data)
+		w, err := zw.Create(fmt.Sprintf("rom%d.bin", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf.Close()
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, &ArchiveOptions{}, 4, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range contents {
+		sum := sha1.Sum(data)
+		rompath, err := depot.RomPath(hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rompath == "" {
+			t.Errorf("rom %q missing from depot", data)
+			continue
+		}
+
+		r, err := openDepotFile(rompath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(stored) != string(data) {
+			t.Errorf("depot has %q for rom %q", stored, data)
+		}
+	}
+}
+
+func TestArchiveImportsDepotFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-depot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDepot := filepath.Join(root, "old-depot")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := []byte("rom from another depot")
+	hh := newHashes(false)
+	err = hh.forReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha1Hex := hex.EncodeToString(hh.Sha1)
+	srcPath := pathFromSha1HexEncoding(srcDepot, sha1Hex, zstdSuffix)
+
+	if got, ok := depotLayoutSha1(srcPath); !ok || got != sha1Hex {
+		t.Fatalf("%s not recognized as depot file", srcPath)
+	}
+	if _, ok := depotLayoutSha1(filepath.Join(srcDepot, sha1Hex+gzipSuffix)); ok {
+		t.Fatalf("depot file outside of depot layout recognized")
+	}
+
+	_, err = archive(zstdCodec, srcPath, filepath.Join(srcDepot, tmpDirName), bytes.NewReader(data),
+		hh.depotExtra(nil, int64(len(data))), hh.Sha1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Archive([]string{srcDepot}, &ArchiveOptions{}, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the depot uses gzip, but the imported file is taken over as is
+	rompath, err := depot.RomPath(sha1Hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rompath != pathFromSha1HexEncoding(depotRoot, sha1Hex, zstdSuffix) {
+		t.Fatalf("imported depot file at %q", rompath)
+	}
+
+	srcBytes, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstBytes, err := ioutil.ReadFile(rompath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(srcBytes, dstBytes) {
+		t.Errorf("imported depot file differs from its source")
+	}
+}
+
+func TestArchiveMovesVerifiedDepotFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-depot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDepot := filepath.Join(root, "old-depot")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDepot, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = writeSizeFile(srcDepot, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := putRom(t, srcDepot, "good", []byte("good rom"))
+	goodPath := pathFromSha1HexEncoding(srcDepot, hex.EncodeToString(good.Sha1), gzipSuffix)
+
+	// a depot file whose header matches its name but not its contents
+	hh := newHashes(false)
+	err = hh.forReader(bytes.NewReader([]byte("claimed rom")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badPath := pathFromSha1HexEncoding(srcDepot, hex.EncodeToString(hh.Sha1), gzipSuffix)
+	_, err = archive(gzipCodec, badPath, filepath.Join(srcDepot, tmpDirName), bytes.NewReader([]byte("actual rom")),
+		hh.depotExtra(nil, 11), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ArchiveOptions{VerifyImports: true, MoveImports: true}
+	_, err = depot.Archive([]string{goodPath, badPath}, opts, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rompath, _ := depot.RomPath(hex.EncodeToString(good.Sha1)); rompath == "" {
+		t.Errorf("verified depot file not imported")
+	}
+	if exists, _ := PathExists(goodPath); exists {
+		t.Errorf("moved depot file still in its source depot")
+	}
+	if rompath, _ := depot.RomPath(hex.EncodeToString(hh.Sha1)); rompath != "" {
+		t.Errorf("depot file with wrong contents imported")
+	}
+	if exists, _ := PathExists(badPath); !exists {
+		t.Errorf("rejected depot file removed from its source depot")
+	}
+
+	_, err = depot.Archive([]string{srcDepot}, &ArchiveOptions{}, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeSum := sha1.Sum([]byte("1234"))
+	if rompath, _ := depot.RomPath(hex.EncodeToString(sizeSum[:])); rompath != "" {
+		t.Errorf("size file of the source depot archived")
+	}
+}
+
+func TestArchiveStreamsMembers(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-depot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// with a 100 byte buffer the short members are buffered, the long ones streamed or spooled
+	members := [][]byte{
+		[]byte("short member"),
+		bytes.Repeat([]byte("long member"), 100),
+	}
+
+	zf, err := os.Create(filepath.Join(srcDir, "set.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	tf, err := os.Create(filepath.Join(srcDir, "set.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(tf)
+
+	var contents [][]byte
+
+	for i, m := range members {
+		for _, kind := range []string{"zip", "tar"} {
+			data := append([]byte(kind), m...)
+			contents = append(contents, data)
+			name := fmt.Sprintf("rom%d.bin", i)
+
+			if kind == "zip" {
+				w, err := zw.Create(name)
+				if err == nil {
+					_, err = w.Write(data)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+
+			err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0666, Size: int64(len(data))})
+			if err == nil {
+				_, err = tw.Write(data)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, c := range []interface {
+		Close() error
+	}{zw, zf, tw, tf} {
+		err = c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// without header skippers all members are hashed while being
+	// compressed, which writes the depot header last
+	for _, opts := range []*ArchiveOptions{
+		{MemberBufferSize: 100, Detectors: BuiltinDetectors},
+		{MemberBufferSize: 100},
+		{MemberBufferSize: 100, ExtraHashes: true},
+	} {
+		for _, c := range codecs {
+			err = os.RemoveAll(depotRoot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.MkdirAll(depotRoot, 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			depot.codec = c
+
+			_, err = depot.Archive([]string{srcDir}, opts, 2, logDir, worker.NewProgressTracker())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, data := range contents {
+				checkDepotFile(t, depot, data, opts.ExtraHashes)
+			}
+		}
+	}
+}
+
+// checkDepotFile checks that depot has data, with a header matching it.
+func checkDepotFile(t *testing.T, depot *Depot, data []byte, extended bool) {
+	sum := sha1.Sum(data)
+	rompath, err := depot.RomPath(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rompath == "" {
+		t.Errorf("rom of size %d missing from depot", len(data))
+		return
+	}
+
+	dh, err := ReadDepotHeader(rompath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dh.Size != int64(len(data)) {
+		t.Errorf("depot header of %s has size %d, want %d", rompath, dh.Size, len(data))
+	}
+
+	hh := newHashes(extended)
+	err = hh.forReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dh.Sha1, hh.Sha1) || !bytes.Equal(dh.Md5, hh.Md5) || !bytes.Equal(dh.Crc, hh.Crc) ||
+		!bytes.Equal(dh.Sha256, hh.Sha256) || !bytes.Equal(dh.Blake3, hh.Blake3) {
+		t.Errorf("depot header of %s has wrong hashes", rompath)
+	}
+
+	stored, err := HashesForDepotFile(rompath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.Sha1, hh.Sha1) {
+		t.Errorf("%s has wrong contents", rompath)
+	}
+}
+
+func TestArchiveChecksSpace(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-depot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(srcDir, "rom.bin"), bytes.Repeat([]byte("rom"), 1000), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{100}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, &ArchiveOptions{RequireSpace: true}, 1, logDir,
+		worker.NewProgressTracker())
+	if err == nil {
+		t.Errorf("archive into a full depot started")
+	}
+
+	free, bound := depot.rootSpace(0, 1)
+	if free != 100-depot.sizes[0] || bound {
+		t.Errorf("got %d bytes of space, bound by disk %v, want max size to be the bound", free, bound)
+	}
+
+	disk, err := diskFree(depotRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk >= 0 {
+		free, bound = depot.rootSpace(0, disk+int64(GB))
+		if free >= 0 || !bound {
+			t.Errorf("got %d bytes of space, bound by disk %v, want disk to be the bound", free, bound)
+		}
+	}
+}
+
+func TestArchiveReleasesReservation(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-depot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(srcDir, "broken.zip"), bytes.Repeat([]byte("not a zip"), 100), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// archiving fails, which is all this is about
+	depot.Archive([]string{srcDir}, &ArchiveOptions{}, 1, logDir, worker.NewProgressTracker())
+
+	if depot.sizes[0] != 0 {
+		t.Errorf("got %d bytes still reserved after a failed archive, want none", depot.sizes[0])
+	}
+}
@@ -31,99 +31,402 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package archive
 
 import (
+	"archive/zip"
 	"bufio"
-	"io/ioutil"
+	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 
-	"github.com/golang/glog"
+	"github.com/uwedeportivo/torrentzip/czip"
 
 	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
 )
 
-type gameWalker struct {
-	game     *types.Game
-	gamepath string
+// GameGrouping decides which games Dir2Dat puts files in. Zip files count as
+// directories of their members, named like them without the .zip extension.
+// Files directly in the source directory are games of their own, named like
+// them without their extension.
+type GameGrouping int
+
+const (
+	// GroupTopLevel makes a game of each directory directly in the source
+	// directory, with all the files below it.
+	GroupTopLevel GameGrouping = iota
+	// GroupFolders makes a game of each directory holding files, named by
+	// its path relative to the source directory.
+	GroupFolders
+	// GroupFiles makes a game of each file.
+	GroupFiles
+)
+
+var gameGroupingNames = []string{"top", "folders", "files"}
+
+func (gg GameGrouping) String() string {
+	if int(gg) < len(gameGroupingNames) {
+		return gameGroupingNames[gg]
+	}
+	return fmt.Sprintf("GameGrouping(%d)", int(gg))
 }
 
-func (gw *gameWalker) visit(path string, f os.FileInfo, err error) error {
-	if f == nil || f.Name() == ".DS_Store" {
-		return nil
+// ParseGameGrouping returns the grouping of the given name: top, folders or
+// files.
+func ParseGameGrouping(name string) (GameGrouping, error) {
+	for i, n := range gameGroupingNames {
+		if n == name {
+			return GameGrouping(i), nil
+		}
 	}
-	if f.IsDir() {
-		return nil
+	return 0, fmt.Errorf("unknown game grouping %s, want one of %s", name, strings.Join(gameGroupingNames, ", "))
+}
+
+// Dir2DatOptions are the choices of Dir2Dat.
+type Dir2DatOptions struct {
+	Grouping GameGrouping
+	// XML writes a Logiqx XML dat instead of a clrmamepro one.
+	XML bool
+}
+
+// dir2datMaster writes each game as soon as all of its files are hashed and
+// all games before it are written, in the order the source directory is
+// walked, so only the games being hashed are held.
+type dir2datMaster struct {
+	srcpath    string
+	opts       *Dir2DatOptions
+	numWorkers int
+	pt         worker.ProgressTracker
+
+	mu sync.Mutex
+	dw *types.DatWriter
+	// order lists the games in the order they are written, next is the
+	// index of the next one, pending the number of files of each game not
+	// yet hashed and games the games with roms hashed so far.
+	order   []string
+	next    int
+	pending map[string]int
+	games   map[string]*types.Game
+	werr    error
+}
+
+type dir2datWorker struct {
+	pm *dir2datMaster
+}
+
+// Dir2Dat hashes every file below srcpath, including the members of zip
+// files, and writes a dat with games of them grouped as opts says to outpath.
+// The dat is named after dat, whose header it gets. Games are written as they
+// are hashed, dat gets none of them.
+func Dir2Dat(dat *types.Dat, srcpath, outpath string, opts *Dir2DatOptions, numWorkers int,
+	pt worker.ProgressTracker) (string, error) {
+	logger.Infof("composing DAT from source %s into output dir %s", srcpath, outpath)
+
+	srcpath, err := filepath.Abs(srcpath)
+	if err != nil {
+		return "", err
+	}
+
+	pm := &dir2datMaster{
+		srcpath:    srcpath,
+		opts:       opts,
+		numWorkers: numWorkers,
+		pt:         pt,
+		pending:    make(map[string]int),
+		games:      make(map[string]*types.Game),
 	}
 
-	hh, err := HashesForFile(path)
+	err = pm.countFiles()
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	name, suffix := types.TemplateDat, datSuffix
+	if opts.XML {
+		name, suffix = types.TemplateXML, ".xml"
 	}
 
-	romName, err := filepath.Rel(gw.gamepath, path)
+	outf, err := os.Create(filepath.Join(outpath, dat.Name+suffix))
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer outf.Close()
 
-	rom := new(types.Rom)
-	rom.Name = romName
-	rom.Size = f.Size()
-	rom.Crc = hh.Crc
-	rom.Md5 = hh.Md5
-	rom.Sha1 = hh.Sha1
+	outbuf := bufio.NewWriter(outf)
 
-	gw.game.Roms = append(gw.game.Roms, rom)
+	pm.dw, err = types.NewDatWriter(outbuf, name)
+	if err != nil {
+		return "", err
+	}
 
-	return nil
+	err = pm.dw.BeginDat(dat)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := worker.Work("dir2dat "+srcpath, []string{srcpath}, pm)
+	endMsg := res.Message
+	if err != nil {
+		return "", err
+	}
+
+	// games with files that couldn't be read are written as far as they got
+	pm.mu.Lock()
+	err = pm.writeGames(true)
+	pm.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	err = pm.dw.EndDat()
+	if err != nil {
+		return "", err
+	}
+
+	err = outbuf.Flush()
+	if err != nil {
+		return "", err
+	}
+	return endMsg, outf.Close()
+}
+
+// countFiles walks the source directory like worker.Work does and counts the
+// files of each game.
+func (pm *dir2datMaster) countFiles() error {
+	return filepath.Walk(pm.srcpath, func(path string, fi os.FileInfo, err error) error {
+		// unreadable files are reported by the workers
+		if err != nil || fi.IsDir() || !pm.Accept(path) {
+			return nil
+		}
+
+		games, err := pm.fileGames(path)
+		if err != nil {
+			return nil
+		}
+		for _, g := range games {
+			if _, ok := pm.pending[g]; !ok {
+				pm.order = append(pm.order, g)
+			}
+			pm.pending[g]++
+		}
+		return nil
+	})
 }
 
-func populateGame(srcpath string, gameDirInfo os.FileInfo) (*types.Game, error) {
-	game := new(types.Game)
-	baseName := gameDirInfo.Name()
+// relPath returns the slash separated path of inpath relative to the source
+// directory.
+func (pm *dir2datMaster) relPath(inpath string) (string, error) {
+	rel, err := filepath.Rel(pm.srcpath, inpath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
 
-	game.Name = baseName
-	game.Description = baseName
+// fileGames returns the games the file at inpath has roms of.
+func (pm *dir2datMaster) fileGames(inpath string) ([]string, error) {
+	rel, err := pm.relPath(inpath)
+	if err != nil {
+		return nil, err
+	}
 
-	gw := &gameWalker{
-		game:     game,
-		gamepath: filepath.Join(srcpath, baseName),
+	if strings.ToLower(filepath.Ext(inpath)) != zipSuffix {
+		game, _ := pm.place(rel)
+		return []string{game}, nil
 	}
 
-	err := filepath.Walk(gw.gamepath, gw.visit)
+	zr, err := czip.OpenReader(inpath)
 	if err != nil {
 		return nil, err
 	}
+	defer zr.Close()
+
+	var games []string
+	seen := make(map[string]bool)
+	dir := strings.TrimSuffix(rel, filepath.Ext(rel))
+	for _, zf := range zr.File {
+		if skipMember(zf) {
+			continue
+		}
+		game, _ := pm.place(dir + "/" + zf.Name)
+		if !seen[game] {
+			seen[game] = true
+			games = append(games, game)
+		}
+	}
+	return games, nil
+}
+
+// skipMember reports whether the zip member zf is left out of dats.
+func skipMember(zf *zip.File) bool {
+	return zf.FileInfo().IsDir() || path.Base(zf.Name) == ".DS_Store"
+}
+
+// filesDone marks a file of each of games as hashed and writes the games
+// that are complete.
+func (pm *dir2datMaster) filesDone(games []string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, g := range games {
+		pm.pending[g]--
+	}
+	return pm.writeGames(false)
+}
 
-	return game, nil
+// writeGames writes the complete games that are next in order, or all
+// remaining games if all is set. Callers hold pm.mu.
+func (pm *dir2datMaster) writeGames(all bool) error {
+	for pm.werr == nil && pm.next < len(pm.order) {
+		name := pm.order[pm.next]
+		if !all && pm.pending[name] > 0 {
+			break
+		}
+		pm.next++
+
+		// games whose files all failed have no roms
+		g := pm.games[name]
+		delete(pm.games, name)
+		delete(pm.pending, name)
+		if g == nil {
+			continue
+		}
+
+		g.Normalize()
+		pm.werr = pm.dw.WriteGame(g)
+	}
+	return pm.werr
 }
 
-func Dir2Dat(dat *types.Dat, srcpath, outpath string) error {
-	glog.Infof("composing DAT from source %s into output dir %s", srcpath, outpath)
+// place returns the game and rom name of the file at rel, a slash separated
+// path relative to the source directory.
+func (pm *dir2datMaster) place(rel string) (string, string) {
+	dir, file := path.Split(rel)
+	dir = strings.TrimSuffix(dir, "/")
+
+	if dir == "" || pm.opts.Grouping == GroupFiles {
+		return strings.TrimSuffix(rel, path.Ext(rel)), file
+	}
+	if pm.opts.Grouping == GroupFolders {
+		return dir, file
+	}
+
+	i := strings.IndexByte(rel, '/')
+	return rel[:i], rel[i+1:]
+}
+
+func (pm *dir2datMaster) addRom(rel string, hh *Hashes, size int64) {
+	gameName, romName := pm.place(rel)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	g := pm.games[gameName]
+	if g == nil {
+		g = &types.Game{
+			Name:        gameName,
+			Description: gameName,
+		}
+		pm.games[gameName] = g
+	}
+	g.Roms = append(g.Roms, hh.rom(romName, "", size))
+}
+
+func (pm *dir2datMaster) Accept(path string) bool {
+	return filepath.Base(path) != ".DS_Store"
+}
+
+func (pm *dir2datMaster) NewWorker(workerIndex int) worker.Worker {
+	return &dir2datWorker{
+		pm: pm,
+	}
+}
+
+func (pm *dir2datMaster) NumWorkers() int {
+	return pm.numWorkers
+}
 
-	fis, err := ioutil.ReadDir(srcpath)
+func (pm *dir2datMaster) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *dir2datMaster) FinishUp() error {
+	return nil
+}
+
+func (pm *dir2datMaster) Start() error {
+	return nil
+}
+
+func (pm *dir2datMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	return nil
+}
+
+func (w *dir2datWorker) Process(inpath string, size int64) (err error) {
+	rel, err := w.pm.relPath(inpath)
 	if err != nil {
 		return err
 	}
 
-	for _, fi := range fis {
-		if fi.IsDir() {
-			game, err := populateGame(srcpath, fi)
-			if err != nil {
-				return err
-			}
+	games, err := w.pm.fileGames(inpath)
+	if err != nil {
+		return err
+	}
+	// the games are complete once all of their files are done with, read
+	// or not
+	defer func() {
+		if derr := w.pm.filesDone(games); err == nil {
+			err = derr
+		}
+	}()
 
-			dat.Games = append(dat.Games, game)
+	if strings.ToLower(filepath.Ext(inpath)) != zipSuffix {
+		file, err := os.Open(inpath)
+		if err != nil {
+			return err
+		}
+		hh, err := hashesForReader(worker.ThrottleReader(w.pm.pt, file))
+		file.Close()
+		if err != nil {
+			return err
 		}
+		w.pm.addRom(rel, hh, size)
+		return nil
 	}
 
-	outfilename := filepath.Join(outpath, dat.Name+datSuffix)
-	outf, err := os.Create(outfilename)
+	zr, err := czip.OpenReader(inpath)
 	if err != nil {
 		return err
 	}
-	defer outf.Close()
+	defer zr.Close()
 
-	outbuf := bufio.NewWriter(outf)
-	defer outbuf.Flush()
+	dir := strings.TrimSuffix(rel, filepath.Ext(rel))
+	hashed := 0
+	for _, zf := range zr.File {
+		if skipMember(zf) {
+			continue
+		}
 
-	return types.ComposeDat(dat, outbuf)
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		hh, err := hashesForReader(worker.ThrottleReader(w.pm.pt, r))
+		r.Close()
+		if err != nil {
+			return err
+		}
+
+		w.pm.addRom(dir+"/"+zf.Name, hh, zf.FileInfo().Size())
+		hashed++
+	}
+	if hashed == 0 {
+		return worker.Skip("zip without files")
+	}
+	return nil
+}
+
+func (w *dir2datWorker) Close() error {
+	return nil
 }
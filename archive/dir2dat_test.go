@@ -0,0 +1,144 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestDir2Dat(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-dir2dat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	outDir := filepath.Join(root, "out")
+
+	for name, data := range map[string]string{
+		"alpha/a.bin":     "aaaa",
+		"alpha/sub/b.bin": "bbbb",
+		"alpha/.DS_Store": "finder",
+		"loose.bin":       "llll",
+	} {
+		path := filepath.Join(srcDir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zf, err := os.Create(filepath.Join(srcDir, "beta.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	w, err := zw.Create("c.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("cccc"))
+	w, err = zw.Create(".DS_Store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("finder"))
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf.Close()
+
+	err = os.MkdirAll(outDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		grouping GameGrouping
+		xml      bool
+		want     string
+	}{
+		{GroupTopLevel, false, "alpha[a.bin sub/b.bin] beta[c.bin] loose[loose.bin]"},
+		{GroupFolders, true, "alpha[a.bin] alpha/sub[b.bin] beta[c.bin] loose[loose.bin]"},
+		{GroupFiles, false, "alpha/a[a.bin] alpha/sub/b[b.bin] beta/c[c.bin] loose[loose.bin]"},
+	} {
+		dat := &types.Dat{Name: "dir2dat-" + test.grouping.String()}
+		opts := &Dir2DatOptions{Grouping: test.grouping, XML: test.xml}
+
+		_, err = Dir2Dat(dat, srcDir, outDir, opts, 2, worker.NewProgressTracker())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		outpath := filepath.Join(outDir, dat.Name+".dat")
+		if test.xml {
+			outpath = filepath.Join(outDir, dat.Name+".xml")
+		}
+		got, _, err := parser.Parse(outpath)
+		if err != nil {
+			t.Fatalf("error parsing dat of grouping %v: %v", test.grouping, err)
+		}
+
+		var games []string
+		for _, g := range got.Games {
+			var roms []string
+			for _, r := range g.Roms {
+				roms = append(roms, r.Name)
+				if r.Size != 4 || len(r.Sha1) == 0 {
+					t.Errorf("got rom %s with size %d and sha1 %x", r.Name, r.Size, r.Sha1)
+				}
+			}
+			games = append(games, fmt.Sprintf("%s%v", g.Name, roms))
+		}
+		if s := strings.Join(games, " "); s != test.want {
+			t.Errorf("got games %s for grouping %v, want %s", s, test.grouping, test.want)
+		}
+	}
+
+	if _, err := ParseGameGrouping("nested"); err == nil {
+		t.Errorf("parsed unknown grouping")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// ExportOptions controls how depot files are exported.
+type ExportOptions struct {
+	// ByGame lays exported files out as <dat name>/<game name>/<rom name>.gz
+	// instead of in the sha1 layout of a depot.
+	ByGame bool
+	// Copy copies files even where they could be cloned or hardlinked.
+	Copy bool
+}
+
+// ExportDat puts the depot files of all roms of dat into outpath, so a single
+// set can be shared without handing over the whole depot. Files are exported
+// compressed as they are in the depot. It returns the number of files
+// exported and the number of roms missing from the depot.
+func (depot *Depot) ExportDat(dat *types.Dat, outpath string, opts *ExportOptions) (int, int, error) {
+	err := os.MkdirAll(outpath, 0777)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// dats exported concurrently into the same tree each need their own
+	tmpDir, err := ioutil.TempDir(outpath, tmpDirName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var datPath string
+	if opts.ByGame {
+		datPath, err = joinEntryName(outpath, dat.Name)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	exported, missing := 0, 0
+
+	for _, game := range dat.Games {
+		for _, rom := range game.AllRoms() {
+			if rom.NoDump() {
+				continue
+			}
+			if rom.Sha1 == nil {
+				logger.Warningf("game %s has rom with missing SHA1 %s", game.Name, rom.Name)
+				missing++
+				continue
+			}
+
+			rompath, err := depot.romPathFor(rom)
+			if err != nil {
+				return exported, missing, err
+			}
+
+			if rompath == "" {
+				logger.Warningf("game %s has missing rom %s (sha1 %s)", game.Name, rom.Name, hex.EncodeToString(rom.Sha1))
+				missing++
+				continue
+			}
+
+			var dst string
+			if opts.ByGame {
+				var gamePath string
+				gamePath, err = joinEntryName(datPath, game.Name)
+				if err == nil {
+					dst, err = joinEntryName(gamePath, romEntryName(rom)+filepath.Ext(rompath))
+				}
+				if err != nil {
+					return exported, missing, err
+				}
+			} else {
+				dst = pathFromSha1HexEncoding(outpath, sha1HexForPath(rompath), filepath.Ext(rompath))
+			}
+
+			exists, err := PathExists(dst)
+			if err != nil {
+				return exported, missing, err
+			}
+			if exists {
+				continue
+			}
+
+			_, how, err := linkDepotFile(rompath, dst, tmpDir, opts.Copy)
+			if err != nil {
+				return exported, missing, err
+			}
+
+			logger.V(2).Infof("exported %s to %s by %s", rompath, dst, how)
+			exported++
+		}
+	}
+	return exported, missing, nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestExportDat(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-export-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	outDir := filepath.Join(root, "out")
+
+	err = os.MkdirAll(depotRoot, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := putRom(t, depotRoot, "a.bin", []byte("rom a"))
+	missing := (&Hashes{Sha1: bytes.Repeat([]byte{0xab}, 20)}).rom("b.bin", "", 5)
+
+	dat := &types.Dat{
+		Name: "test",
+		Games: types.GameSlice{
+			{Name: "game", Roms: types.RomSlice{rom, missing}},
+		},
+	}
+
+	for _, opts := range []*ExportOptions{{}, {ByGame: true, Copy: true}} {
+		exported, nmissing, err := depot.ExportDat(dat, outDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exported != 1 || nmissing != 1 {
+			t.Errorf("exported %d and missed %d roms, want 1 and 1", exported, nmissing)
+		}
+	}
+
+	for _, path := range []string{
+		pathFromSha1HexEncoding(outDir, hex.EncodeToString(rom.Sha1), gzipSuffix),
+		filepath.Join(outDir, "test", "game", "a.bin"+gzipSuffix),
+	} {
+		hh, err := HashesForDepotFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hh.Sha1, rom.Sha1) {
+			t.Errorf("%s has wrong contents", path)
+		}
+	}
+
+	matches, err := filepath.Glob(filepath.Join(outDir, tmpDirName+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("export left its temp dir behind")
+	}
+
+	dat.Games[0].Name = "../../escaped"
+	_, _, err = depot.ExportDat(dat, outDir, &ExportOptions{ByGame: true})
+	if err == nil {
+		t.Errorf("game name escaping the output directory accepted")
+	}
+	if exists, _ := PathExists(filepath.Join(root, "escaped")); exists {
+		t.Errorf("exported outside of the output directory")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"fmt"
+
+	"github.com/uwedeportivo/romba/trash"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// FixOptions controls the fix of a set folder.
+type FixOptions struct {
+	// Unzipped expects and writes games as directories of plain files
+	// instead of torrentzip files.
+	Unzipped bool
+	// BackupDir, if set, is where unneeded and replaced files of the set
+	// folder are moved to, instead of being removed. Without it they go to
+	// Trash if set.
+	BackupDir string
+	Trash     *trash.Op
+	// ReportDir, if set, is where the audit reports of the set folder as it
+	// was found and a fix dat of the roms still missing are written to.
+	ReportDir string
+}
+
+// FixReport tells what a fix did to a set folder.
+type FixReport struct {
+	// Before is the audit of the set folder as it was found.
+	Before *AuditReport
+	// Renamed is the number of wrongly named roms moved to where they
+	// belong, Removed the number of unneeded files taken out.
+	Renamed int
+	Removed int
+	// Filled is the number of missing roms taken from the depot, Missing
+	// the number of roms neither the set folder nor the depot has.
+	Filled  int
+	Missing int
+}
+
+func (fr *FixReport) String() string {
+	return fmt.Sprintf("renamed %d roms, removed %d files, filled %d roms from the depot, %d roms missing",
+		fr.Renamed, fr.Removed, fr.Filled, fr.Missing)
+}
+
+// Fix repairs the set folder setpath in place against dat: it audits the set
+// folder, then renames wrongly named roms, removes unneeded files and fills
+// in missing roms from the depot. Games already matching the dat are left
+// alone. Set folders of protected dats are refused.
+func (depot *Depot) Fix(dat *types.Dat, setpath string, opts *FixOptions) (*FixReport, error) {
+	if dat.Protected {
+		return nil, protectedError(dat, setpath)
+	}
+
+	ar, err := Audit(dat, setpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ReportDir != "" {
+		err = ar.WriteReports(opts.ReportDir, dat.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fr := &FixReport{
+		Before:  ar,
+		Renamed: len(ar.WronglyNamed),
+		Removed: len(ar.Unneeded),
+	}
+
+	if len(ar.Miss) == 0 && len(ar.Unneeded) == 0 && len(ar.WronglyNamed) == 0 {
+		logger.Infof("set %s already matches dat %s", setpath, dat.Name)
+		return fr, nil
+	}
+
+	fr.Missing, err = depot.RebuildSet(dat, setpath, &RebuildOptions{
+		Unzipped:  opts.Unzipped,
+		BackupDir: opts.BackupDir,
+		Trash:     opts.Trash,
+		FixDir:    opts.ReportDir,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the fix dat also lists roms without hashes, which the audit skips
+	if fr.Missing < len(ar.Miss) {
+		fr.Filled = len(ar.Miss) - fr.Missing
+	}
+
+	logger.Infof("fixed set %s for dat %s: %v", setpath, dat.Name, fr)
+	return fr, nil
+}
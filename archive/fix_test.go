@@ -0,0 +1,126 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestFix(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-fix-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	setDir := filepath.Join(root, "set")
+	depotRoot := filepath.Join(root, "depot")
+	backupDir := filepath.Join(root, "backup")
+	reportDir := filepath.Join(root, "reports")
+
+	for _, dir := range []string{setDir, depotRoot, reportDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataA := []byte("rom a of game one")
+	dataB := []byte("rom b of game one, only in the depot")
+	dataC := []byte("rom c of game two")
+
+	dat := &types.Dat{
+		Name: "fix",
+		Games: types.GameSlice{
+			{Name: "one", Roms: types.RomSlice{romFor(t, "a.bin", dataA), putRom(t, depotRoot, "b.bin", dataB)}},
+			{Name: "two", Roms: types.RomSlice{romFor(t, "c.bin", dataC),
+				romFor(t, "lost.bin", []byte("nowhere to be found"))}},
+		},
+	}
+
+	writeZip(t, filepath.Join(setDir, "one.zip"), map[string][]byte{
+		"a-renamed.bin": dataA,
+		"junk.txt":      []byte("not a rom"),
+	})
+	writeZip(t, filepath.Join(setDir, "two.zip"), map[string][]byte{
+		"c.bin": dataC,
+	})
+
+	protected := *dat
+	protected.Protected = true
+	_, err = depot.Fix(&protected, setDir, &FixOptions{ReportDir: reportDir})
+	if err == nil {
+		t.Errorf("fixed the set of a protected dat")
+	}
+	if exists, _ := PathExists(filepath.Join(setDir, "one.zip")); !exists {
+		t.Errorf("set of a protected dat changed")
+	}
+
+	fr, err := depot.Fix(dat, setDir, &FixOptions{BackupDir: backupDir, ReportDir: reportDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Renamed != 1 || fr.Removed != 1 || fr.Filled != 1 || fr.Missing != 1 {
+		t.Errorf("got fix report %v, want one rom renamed, removed, filled and missing each", fr)
+	}
+
+	ar, err := Audit(dat, setDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ar.Have) != 3 || len(ar.Miss) != 1 || len(ar.Unneeded) != 0 || len(ar.WronglyNamed) != 0 {
+		t.Errorf("set not fixed: have %d, miss %v, unneeded %v, wrongly named %v", len(ar.Have), ar.Miss,
+			ar.Unneeded, ar.WronglyNamed)
+	}
+
+	for _, name := range []string{"fix-unneeded.txt", fixPrefix + "fix" + datSuffix} {
+		if exists, _ := PathExists(filepath.Join(reportDir, name)); !exists {
+			t.Errorf("report %s not written", name)
+		}
+	}
+
+	fr, err = depot.Fix(dat, setDir, &FixOptions{ReportDir: reportDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Renamed != 0 || fr.Removed != 0 || fr.Filled != 0 {
+		t.Errorf("fixing a fixed set changed it: %v", fr)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isPlainGzip reports whether path is a gzip file from some other tool, as
+// opposed to a depot file carrying romba metadata in its header.
+func isPlainGzip(path string) bool {
+	if strings.ToLower(filepath.Ext(path)) != gzipSuffix {
+		return false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	extra, err := gzipCodec.readExtra(file)
+	if err != nil {
+		// not a gzip file after all, it gets archived as is
+		return false
+	}
+
+	if len(extra) == 0 {
+		return true
+	}
+	_, err = parseDepotExtra(extra)
+	return err != nil
+}
+
+// archiveGzip archives the decompressed contents of the plain gzip file inpath
+// as well as the file itself, so dumps gzipped by other tools are found by
+// either.
+func (w *archiveWorker) archiveGzip(inpath string, root int, size int64) error {
+	file, err := w.pm.sources.opener(inpath)()
+	if err != nil {
+		return err
+	}
+
+	r, err := gzipCodec.newReader(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(inpath), filepath.Ext(inpath))
+	path := filepath.Join(inpath, name)
+
+	err = w.archiveSpooled(w.pm.opts.Limits.reader(path, r), root, name, path, -1)
+	r.Close()
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	return w.archiveRom(inpath, root, size)
+}
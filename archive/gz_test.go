@@ -0,0 +1,112 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestArchivePlainGzip(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-gz-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := []byte("rom gzipped by some other tool")
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzPath := filepath.Join(srcDir, "game.bin.gz")
+	err = ioutil.WriteFile(gzPath, buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a depot file outside of a depot layout isn't a plain gzip
+	depotFile := putRom(t, depotRoot, "other.bin", []byte("rom in the depot"))
+	depotPath := pathFromSha1HexEncoding(depotRoot, hex.EncodeToString(depotFile.Sha1), gzipSuffix)
+	if isPlainGzip(depotPath) {
+		t.Errorf("depot file %s taken for a plain gzip", depotPath)
+	}
+	if !isPlainGzip(gzPath) {
+		t.Errorf("%s not recognized as plain gzip", gzPath)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, &ArchiveOptions{}, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for what, contents := range map[string][]byte{"decompressed": data, "compressed": buf.Bytes()} {
+		sum := sha1.Sum(contents)
+		rompath, err := depot.RomPath(hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rompath == "" {
+			t.Errorf("%s contents of %s missing from depot", what, gzPath)
+		}
+	}
+}
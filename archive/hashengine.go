@@ -0,0 +1,326 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lukechampine.com/blake3"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+)
+
+// HashEngine supplies the implementations roms are hashed with, so faster
+// ones (SIMD assembly, hardware offload) can be dropped in with
+// RegisterHashEngine. All engines must produce the same digests.
+type HashEngine struct {
+	Name      string
+	NewCrc32  func() hash.Hash
+	NewMd5    func() hash.Hash
+	NewSha1   func() hash.Hash
+	NewSha256 func() hash.Hash
+	NewBlake3 func() hash.Hash
+	// Parallel feeds each hash from a goroutine of its own instead of one
+	// after the other, which pays off for large files on multi-core machines.
+	Parallel bool
+}
+
+// parallelHashChunk is the size of the chunks handed to the hashes of a
+// parallel engine.
+const parallelHashChunk = 1 << 20
+
+var stdHashEngine = &HashEngine{
+	Name:      "std",
+	NewCrc32:  func() hash.Hash { return cgzip.NewCrc32() },
+	NewMd5:    md5.New,
+	NewSha1:   sha1.New,
+	NewSha256: sha256.New,
+	NewBlake3: func() hash.Hash { return blake3.New(blake3Size, nil) },
+}
+
+var parallelHashEngine = &HashEngine{
+	Name:      "parallel",
+	NewCrc32:  stdHashEngine.NewCrc32,
+	NewMd5:    stdHashEngine.NewMd5,
+	NewSha1:   stdHashEngine.NewSha1,
+	NewSha256: stdHashEngine.NewSha256,
+	NewBlake3: stdHashEngine.NewBlake3,
+	Parallel:  true,
+}
+
+var (
+	hashEnginesLock = new(sync.Mutex)
+	hashEngines     = []*HashEngine{stdHashEngine, parallelHashEngine}
+	hashEngine      = stdHashEngine
+)
+
+// RegisterHashEngine makes he available to SetHashEngine, replacing any
+// engine of the same name.
+func RegisterHashEngine(he *HashEngine) {
+	hashEnginesLock.Lock()
+	defer hashEnginesLock.Unlock()
+
+	for i, e := range hashEngines {
+		if e.Name == he.Name {
+			hashEngines[i] = he
+			return
+		}
+	}
+	hashEngines = append(hashEngines, he)
+}
+
+// HashEngines returns the names of the registered hash engines.
+func HashEngines() []string {
+	hashEnginesLock.Lock()
+	defer hashEnginesLock.Unlock()
+
+	names := make([]string, len(hashEngines))
+	for i, he := range hashEngines {
+		names[i] = he.Name
+	}
+	return names
+}
+
+func hashEngineByName(name string) (*HashEngine, error) {
+	hashEnginesLock.Lock()
+	defer hashEnginesLock.Unlock()
+
+	for _, he := range hashEngines {
+		if he.Name == name {
+			return he, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown hash engine %q", name)
+}
+
+// SetHashEngine selects the registered hash engine roms are hashed with,
+// "std" by default.
+func SetHashEngine(name string) error {
+	he, err := hashEngineByName(name)
+	if err != nil {
+		return err
+	}
+
+	hashEnginesLock.Lock()
+	defer hashEnginesLock.Unlock()
+
+	hashEngine = he
+	return nil
+}
+
+func currentHashEngine() *HashEngine {
+	hashEnginesLock.Lock()
+	defer hashEnginesLock.Unlock()
+
+	return hashEngine
+}
+
+// hash feeds all of r to hs.
+func (he *HashEngine) hash(r io.Reader, hs ...hash.Hash) error {
+	if !he.Parallel || len(hs) < 2 {
+		ws := make([]io.Writer, len(hs))
+		for i, h := range hs {
+			ws[i] = h
+		}
+		_, err := io.Copy(io.MultiWriter(ws...), bufio.NewReader(r))
+		return err
+	}
+	return hashParallel(r, hs)
+}
+
+// hashChunk is a chunk of input shared by the hashes of a parallel engine,
+// its buffer goes back to free once all of them are done with it.
+type hashChunk struct {
+	data    []byte
+	pending int32
+	free    chan []byte
+}
+
+func (c *hashChunk) release() {
+	if atomic.AddInt32(&c.pending, -1) == 0 {
+		c.free <- c.data[:cap(c.data)]
+	}
+}
+
+func hashParallel(r io.Reader, hs []hash.Hash) error {
+	const numBuffers = 4
+
+	free := make(chan []byte, numBuffers)
+	for i := 0; i < numBuffers; i++ {
+		free <- make([]byte, parallelHashChunk)
+	}
+
+	wg := new(sync.WaitGroup)
+	chans := make([]chan *hashChunk, len(hs))
+	for i, h := range hs {
+		chans[i] = make(chan *hashChunk, numBuffers)
+		wg.Add(1)
+		go func(h hash.Hash, in chan *hashChunk) {
+			defer wg.Done()
+			for c := range in {
+				h.Write(c.data)
+				c.release()
+			}
+		}(h, chans[i])
+	}
+
+	var err error
+	for {
+		buf := <-free
+
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if n > 0 {
+			c := &hashChunk{data: buf[:n], pending: int32(len(hs)), free: free}
+			for _, in := range chans {
+				in <- c
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for _, in := range chans {
+		close(in)
+	}
+	wg.Wait()
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+// HashBenchmark is the throughput of one algorithm of a hash engine.
+type HashBenchmark struct {
+	Engine    string
+	Algorithm string
+	// BytesPerSecond hashed.
+	BytesPerSecond float64
+}
+
+func (hb *HashBenchmark) String() string {
+	return fmt.Sprintf("%s\t%s\t%s/s", hb.Engine, hb.Algorithm, ByteSize(hb.BytesPerSecond))
+}
+
+// MaxHashBenchmarkSize is the largest buffer BenchmarkHashEngines hashes,
+// which it holds in memory.
+const MaxHashBenchmarkSize = int64(GB)
+
+// BenchmarkHashEngines hashes size bytes with each algorithm of each
+// registered hash engine, and with all algorithms together as roms are
+// hashed. It fails if an engine's digests differ from those of the std engine.
+func BenchmarkHashEngines(size int64) ([]*HashBenchmark, error) {
+	if size <= 0 || size > MaxHashBenchmarkSize {
+		return nil, fmt.Errorf("benchmark size %d out of range, at most %s", size, ByteSize(MaxHashBenchmarkSize))
+	}
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i>>8)
+	}
+
+	algorithms := []struct {
+		name string
+		new  func(he *HashEngine) hash.Hash
+	}{
+		{"crc32", func(he *HashEngine) hash.Hash { return he.NewCrc32() }},
+		{"md5", func(he *HashEngine) hash.Hash { return he.NewMd5() }},
+		{"sha1", func(he *HashEngine) hash.Hash { return he.NewSha1() }},
+		{"sha256", func(he *HashEngine) hash.Hash { return he.NewSha256() }},
+		{"blake3", func(he *HashEngine) hash.Hash { return he.NewBlake3() }},
+	}
+
+	want := make([][]byte, len(algorithms))
+	for i, a := range algorithms {
+		h := a.new(stdHashEngine)
+		h.Write(data)
+		want[i] = h.Sum(nil)
+	}
+
+	hashEnginesLock.Lock()
+	engines := make([]*HashEngine, len(hashEngines))
+	copy(engines, hashEngines)
+	hashEnginesLock.Unlock()
+
+	throughput := func(start time.Time) float64 {
+		elapsed := time.Since(start).Seconds()
+		if elapsed <= 0 {
+			return 0
+		}
+		return float64(size) / elapsed
+	}
+
+	var hbs []*HashBenchmark
+	for _, he := range engines {
+		for i, a := range algorithms {
+			h := a.new(he)
+			start := time.Now()
+			err := he.hash(bytes.NewReader(data), h)
+			if err != nil {
+				return nil, err
+			}
+			hbs = append(hbs, &HashBenchmark{Engine: he.Name, Algorithm: a.name, BytesPerSecond: throughput(start)})
+
+			if !bytes.Equal(h.Sum(nil), want[i]) {
+				return hbs, fmt.Errorf("hash engine %s computes wrong %s digests", he.Name, a.name)
+			}
+		}
+
+		hs := make([]hash.Hash, len(algorithms))
+		for i, a := range algorithms {
+			hs[i] = a.new(he)
+		}
+		start := time.Now()
+		err := he.hash(bytes.NewReader(data), hs...)
+		if err != nil {
+			return nil, err
+		}
+		hbs = append(hbs, &HashBenchmark{Engine: he.Name, Algorithm: "all", BytesPerSecond: throughput(start)})
+
+		for i, a := range algorithms {
+			if !bytes.Equal(hs[i].Sum(nil), want[i]) {
+				return hbs, fmt.Errorf("hash engine %s computes wrong %s digests hashing all together", he.Name, a.name)
+			}
+		}
+	}
+	return hbs, nil
+}
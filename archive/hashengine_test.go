@@ -0,0 +1,114 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+	"testing"
+)
+
+func TestParallelHashEngine(t *testing.T) {
+	for _, size := range []int{0, 1, parallelHashChunk, 3*parallelHashChunk + 17} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+
+		want := newHashes(true)
+		err := want.forReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		he := parallelHashEngine
+		hs := []hash.Hash{he.NewCrc32(), he.NewMd5(), he.NewSha1(), he.NewSha256(), he.NewBlake3()}
+		err = he.hash(bytes.NewReader(data), hs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, w := range [][]byte{want.Crc, want.Md5, want.Sha1, want.Sha256, want.Blake3} {
+			if !bytes.Equal(hs[i].Sum(nil), w) {
+				t.Errorf("size %d: digest %d differs from the std engine", size, i)
+			}
+		}
+	}
+
+	readErr := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader(make([]byte, parallelHashChunk+1)), &failingReader{err: readErr})
+	err := parallelHashEngine.hash(r, parallelHashEngine.NewSha1(), parallelHashEngine.NewMd5())
+	if err != readErr {
+		t.Errorf("got %v, want %v", err, readErr)
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	return 0, fr.err
+}
+
+func TestSetHashEngine(t *testing.T) {
+	defer SetHashEngine(stdHashEngine.Name)
+
+	if err := SetHashEngine("no such engine"); err == nil {
+		t.Errorf("expected an error selecting an unknown hash engine")
+	}
+
+	err := SetHashEngine(parallelHashEngine.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if currentHashEngine() != parallelHashEngine {
+		t.Errorf("hash engine %s not selected", parallelHashEngine.Name)
+	}
+}
+
+func TestBenchmarkHashEngines(t *testing.T) {
+	hbs, err := BenchmarkHashEngines(2*parallelHashChunk + 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// five algorithms and all of them together for each engine
+	if want := 6 * len(HashEngines()); len(hbs) != want {
+		t.Errorf("got %d benchmarks, want %d", len(hbs), want)
+	}
+
+	_, err = BenchmarkHashEngines(MaxHashBenchmarkSize + 1)
+	if err == nil {
+		t.Errorf("benchmark larger than the limit accepted")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// Depot files carry the metadata of their uncompressed contents in a header
+// (the gzip extra field, a skippable frame for zstd), so it can be recovered
+// without decompressing them.
+// Layouts are told apart by their length:
+//
+//	md5 | crc                                      (old depot files)
+//	md5 | crc | sha256 | blake3                    (old depot files, extended)
+//	md5 | crc | size (8 bytes, big endian) | sha1
+//	md5 | crc | size (8 bytes, big endian) | sha1 | sha256 | blake3
+const (
+	legacyDepotExtraSize         = md5.Size + crc32.Size
+	legacyExtendedDepotExtraSize = legacyDepotExtraSize + sha256.Size + blake3Size
+	depotExtraSize               = md5.Size + crc32.Size + 8 + sha1.Size
+	maxDepotExtraSize            = depotExtraSize + sha256.Size + blake3Size
+)
+
+// DepotHeader is the metadata read back from the gzip extra header of a depot
+// file. Fields missing from older layouts are nil, Size is -1 if unknown.
+type DepotHeader struct {
+	Hashes
+	Size int64
+}
+
+// depotExtra appends the gzip extra header for a depot file holding size
+// bytes with these hashes to buf.
+func (hh *Hashes) depotExtra(buf []byte, size int64) []byte {
+	var sz [8]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(size))
+
+	buf = append(buf, hh.Md5...)
+	buf = append(buf, hh.Crc...)
+	buf = append(buf, sz[:]...)
+	buf = append(buf, hh.Sha1...)
+	if hh.extended() {
+		buf = append(buf, hh.Sha256...)
+		buf = append(buf, hh.Blake3...)
+	}
+	return buf
+}
+
+func parseDepotExtra(extra []byte) (*DepotHeader, error) {
+	dh := &DepotHeader{Size: -1}
+
+	switch len(extra) {
+	case legacyDepotExtraSize, legacyExtendedDepotExtraSize, depotExtraSize, maxDepotExtraSize:
+	default:
+		return nil, fmt.Errorf("unknown depot header length %d", len(extra))
+	}
+
+	next := func(n int) []byte {
+		b := make([]byte, n)
+		copy(b, extra[:n])
+		extra = extra[n:]
+		return b
+	}
+
+	dh.Md5 = next(md5.Size)
+	dh.Crc = next(crc32.Size)
+
+	if len(extra) == sha256.Size+blake3Size {
+		dh.Sha256 = next(sha256.Size)
+		dh.Blake3 = next(blake3Size)
+		return dh, nil
+	}
+
+	if len(extra) > 0 {
+		dh.Size = int64(binary.BigEndian.Uint64(next(8)))
+		dh.Sha1 = next(sha1.Size)
+	}
+
+	if len(extra) > 0 {
+		dh.Sha256 = next(sha256.Size)
+		dh.Blake3 = next(blake3Size)
+	}
+	return dh, nil
+}
+
+// ReadDepotHeader reads the metadata stored in the header of the depot file
+// inpath. It returns nil if the file has no such header.
+func ReadDepotHeader(inpath string) (*DepotHeader, error) {
+	c := codecForPath(inpath)
+	if c == nil {
+		return nil, fmt.Errorf("%s is not a depot file", inpath)
+	}
+
+	file, err := os.Open(inpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	extra, err := c.readExtra(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(extra) == 0 {
+		return nil, nil
+	}
+
+	return parseDepotExtra(extra)
+}
+
+// headerHashesForDepotFile returns the hashes of the contents of the depot
+// file inpath, from its header if it has one and by decompressing it otherwise.
+func headerHashesForDepotFile(inpath string) (*Hashes, error) {
+	dh, err := ReadDepotHeader(inpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if dh != nil {
+		return &dh.Hashes, nil
+	}
+
+	return HashesForDepotFile(inpath)
+}
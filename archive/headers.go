@@ -0,0 +1,182 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// maxHeaderedRomSize bounds the size of roms checked for headers. Headered
+// formats are all from cartridge era systems, and the headerless contents are
+// held in memory.
+const maxHeaderedRomSize = int64(64 * MB)
+
+// BuiltinDetectors are the header skippers of clrmamepro for the common
+// headered formats.
+var BuiltinDetectors = []*types.Detector{
+	{
+		Name: "NES",
+		Rules: []*types.DetectorRule{{
+			StartOffset: 0x10,
+			EndOffset:   -1,
+			Operation:   types.OpNone,
+			Tests: []*types.DetectorTest{
+				{Kind: types.TestData, Offset: 0, Value: []byte("NES\x1a"), Result: true},
+			},
+		}},
+	},
+	{
+		Name: "FDS",
+		Rules: []*types.DetectorRule{{
+			StartOffset: 0x10,
+			EndOffset:   -1,
+			Operation:   types.OpNone,
+			Tests: []*types.DetectorTest{
+				{Kind: types.TestData, Offset: 0, Value: []byte("FDS\x1a"), Result: true},
+			},
+		}},
+	},
+	{
+		Name: "Lynx",
+		Rules: []*types.DetectorRule{{
+			StartOffset: 0x40,
+			EndOffset:   -1,
+			Operation:   types.OpNone,
+			Tests: []*types.DetectorTest{
+				{Kind: types.TestData, Offset: 0, Value: []byte("LYNX"), Result: true},
+			},
+		}, {
+			StartOffset: 0x40,
+			EndOffset:   -1,
+			Operation:   types.OpNone,
+			Tests: []*types.DetectorTest{
+				{Kind: types.TestData, Offset: 6, Value: []byte("BS93"), Result: true},
+			},
+		}},
+	},
+	{
+		Name: "Atari 7800",
+		Rules: []*types.DetectorRule{{
+			StartOffset: 0x80,
+			EndOffset:   -1,
+			Operation:   types.OpNone,
+			Tests: []*types.DetectorTest{
+				{Kind: types.TestData, Offset: 1, Value: []byte("ATARI7800"), Result: true},
+			},
+		}, {
+			StartOffset: 0x80,
+			EndOffset:   -1,
+			Operation:   types.OpNone,
+			Tests: []*types.DetectorTest{
+				{Kind: types.TestData, Offset: 0x64, Value: []byte("ACTUAL CART DATA STARTS HERE"), Result: true},
+			},
+		}},
+	},
+}
+
+// matchHeader returns the rule of the first detector matching a file of the
+// given size starting with header, or nil if none does.
+func matchHeader(detectors []*types.Detector, header []byte, size int64) *types.DetectorRule {
+	for _, d := range detectors {
+		if rule := d.Match(header, size); rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// headerLen returns how many bytes of a file detectors need to look at.
+func headerLen(detectors []*types.Detector) int {
+	n := 0
+	for _, d := range detectors {
+		if l := d.HeaderLen(); l > n {
+			n = l
+		}
+	}
+	return n
+}
+
+// archiveHeaderless checks the contents provided by ro for a header known to
+// the archive options' detectors and, if it has one, archives the contents
+// with the header skipped as well, so that dats listing headerless hashes
+// match.
+func (w *archiveWorker) archiveHeaderless(ro readerOpener, root int, name, path string, size int64) error {
+	if size > maxHeaderedRomSize {
+		return nil
+	}
+
+	detectors := w.pm.opts.Detectors
+
+	r, err := ro()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, headerLen(detectors))
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.Close()
+		return err
+	}
+	header = header[:n]
+
+	rule := matchHeader(detectors, header, size)
+	if rule == nil {
+		return r.Close()
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	err = r.Close()
+	if err != nil {
+		return err
+	}
+
+	data := rule.Apply(append(header, rest...))
+
+	err = w.hh.forReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	rom := w.hh.rom(name, path, int64(len(data)))
+
+	w.extraBuffer = w.hh.depotExtra(w.extraBuffer[:0], rom.Size)
+
+	return w.store(bufferedOpener(data), root, rom, w.extraBuffer, rom.Sha1)
+}
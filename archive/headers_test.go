@@ -0,0 +1,150 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestDetectorRuleApply(t *testing.T) {
+	data := []byte{0x01, 0x02, 0x03, 0x04, 0x80, 0x00, 0x00, 0x00}
+
+	cases := []struct {
+		op   string
+		want []byte
+	}{
+		{types.OpNone, []byte{0x01, 0x02, 0x03, 0x04, 0x80, 0x00}},
+		{types.OpByteSwap, []byte{0x02, 0x01, 0x04, 0x03, 0x00, 0x80}},
+		{types.OpWordSwap, []byte{0x04, 0x03, 0x02, 0x01, 0x80, 0x00}},
+		{types.OpWordByteSwap, []byte{0x03, 0x04, 0x01, 0x02, 0x80, 0x00}},
+		{types.OpBitSwap, []byte{0x80, 0x40, 0xc0, 0x20, 0x01, 0x00}},
+	}
+
+	for _, c := range cases {
+		rule := &types.DetectorRule{StartOffset: 0, EndOffset: 6, Operation: c.op}
+		got := rule.Apply(data)
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%s: got %x, want %x", c.op, got, c.want)
+		}
+	}
+}
+
+func TestMatchHeader(t *testing.T) {
+	nes := append([]byte("NES\x1a"), make([]byte, 12)...)
+	lynx := append(append([]byte("xxxxxxBS93"), make([]byte, 54)...), 0xff)
+
+	if rule := matchHeader(BuiltinDetectors, nes, 32); rule == nil || rule.StartOffset != 0x10 {
+		t.Errorf("NES header not detected")
+	}
+	if rule := matchHeader(BuiltinDetectors, lynx, 65); rule == nil || rule.StartOffset != 0x40 {
+		t.Errorf("Lynx header not detected")
+	}
+	if rule := matchHeader(BuiltinDetectors, []byte("NES"), 3); rule != nil {
+		t.Errorf("short file detected as headered")
+	}
+
+	pow2 := &types.DetectorTest{Kind: types.TestFile, Size: -1}
+	if !pow2.Match(nil, 1024) || pow2.Match(nil, 1040) {
+		t.Errorf("power of two file test broken")
+	}
+	masked := &types.DetectorTest{Kind: types.TestAnd, Value: []byte{0x10}, Mask: []byte{0xf0}}
+	if !masked.Match([]byte{0x1f}, 1) || masked.Match([]byte{0x2f}, 1) {
+		t.Errorf("and test broken")
+	}
+}
+
+func TestArchiveSkipsHeaders(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-headers-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	header := append([]byte("NES\x1a"), make([]byte, 12)...)
+	prg := bytes.Repeat([]byte("prg rom"), 100)
+	full := append(header, prg...)
+
+	err = ioutil.WriteFile(filepath.Join(srcDir, "game.nes"), full, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ArchiveOptions{Detectors: BuiltinDetectors}
+	_, err = depot.Archive([]string{srcDir}, opts, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{full, prg} {
+		sum := sha1.Sum(data)
+		rompath, err := depot.RomPath(hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rompath == "" {
+			t.Errorf("rom of size %d missing from depot", len(data))
+			continue
+		}
+
+		dh, err := ReadDepotHeader(rompath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dh.Size != int64(len(data)) {
+			t.Errorf("depot header has size %d, want %d", dh.Size, len(data))
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Timeouts of downloads from HTTP and HTTPS servers. httpIdleTimeout is how
+// long a download may go without receiving any data.
+var (
+	httpDialTimeout     = 30 * time.Second
+	httpTLSTimeout      = 30 * time.Second
+	httpResponseTimeout = time.Minute
+	httpIdleTimeout     = time.Minute
+)
+
+// newHTTPClient returns the client downloading the files at HTTP and HTTPS
+// URLs. It refuses to connect to loopback, private and link-local addresses
+// unless they are in one of allowed, so URLs can't be used to reach the
+// machine romba runs on or its local network. It connects to servers
+// directly, as through a proxy only the address of the proxy could be
+// checked.
+func newHTTPClient(allowed []*net.IPNet) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   httpDialTimeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return checkHTTPAddr(address, allowed)
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   httpTLSTimeout,
+			ResponseHeaderTimeout: httpResponseTimeout,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// checkHTTPAddr fails if the resolved address is loopback, private,
+// link-local or unspecified and not in one of allowed.
+func checkHTTPAddr(address string, allowed []*net.IPNet) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("connecting to %s: not an IP address", address)
+	}
+	if !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()) {
+		return nil
+	}
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("connecting to %s: address not allowed, see SourceOptions.HTTPAllowedNets", address)
+}
+
+// isHTTP reports whether path is the URL of a file on an HTTP or HTTPS
+// server, as in https://archive.org/download/item/set.zip.
+func isHTTP(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// httpError is a failed download worth retrying: a dropped connection, a
+// body cut short or a server error.
+type httpError struct {
+	err error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+// httpFileInfo describes the file at a URL, from the headers of a HEAD
+// request.
+type httpFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *httpFileInfo) Name() string       { return fi.name }
+func (fi *httpFileInfo) Size() int64        { return fi.size }
+func (fi *httpFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi *httpFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *httpFileInfo) IsDir() bool        { return false }
+func (fi *httpFileInfo) Sys() interface{}   { return nil }
+
+// statHTTP describes the file at rawurl. Its size is 0 if the server
+// doesn't tell it.
+func statHTTP(client *http.Client, rawurl string) (os.FileInfo, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Head(rawurl)
+	if err != nil {
+		return nil, &httpError{err}
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(rawurl, resp)
+	}
+
+	fi := &httpFileInfo{
+		name: path.Base(u.Path),
+	}
+	if resp.ContentLength > 0 {
+		fi.size = resp.ContentLength
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		fi.modTime, _ = http.ParseTime(lm)
+	}
+	return fi, nil
+}
+
+func statusError(rawurl string, resp *http.Response) error {
+	err := fmt.Errorf("%s %s: %s", resp.Request.Method, rawurl, resp.Status)
+	if resp.StatusCode >= 500 {
+		return &httpError{err}
+	}
+	return err
+}
+
+// httpFile reads the file at a URL. Reads continue the download in progress
+// if they carry on where the last one stopped, others start a new one with
+// a range request. Downloads cut short are resumed the same way when reads
+// are retried, see SourceOptions.Retries.
+type httpFile struct {
+	client *http.Client
+	url    string
+
+	lock sync.Mutex
+	body io.ReadCloser
+	// off is where body is at, size the size of the file or -1 if the
+	// server doesn't tell it
+	off  int64
+	size int64
+}
+
+func openHTTP(client *http.Client, rawurl string) (*httpFile, error) {
+	return &httpFile{client: client, url: rawurl}, nil
+}
+
+// download starts downloading the file from off.
+func (hf *httpFile) download(off int64) error {
+	req, err := http.NewRequest("GET", hf.url, nil)
+	if err != nil {
+		return err
+	}
+	if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+
+	resp, err := hf.client.Do(req)
+	if err != nil {
+		return &httpError{err}
+	}
+
+	switch {
+	case off > 0 && resp.StatusCode == http.StatusPartialContent:
+	case off == 0 && resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return io.EOF
+	case off > 0 && resp.StatusCode == http.StatusOK:
+		resp.Body.Close()
+		return fmt.Errorf("GET %s: server doesn't support resuming downloads", hf.url)
+	default:
+		resp.Body.Close()
+		return statusError(hf.url, resp)
+	}
+
+	hf.body = newIdleBody(resp.Body)
+	hf.off = off
+	hf.size = -1
+	if resp.ContentLength >= 0 {
+		hf.size = off + resp.ContentLength
+	}
+	return nil
+}
+
+func (hf *httpFile) ReadAt(p []byte, off int64) (int, error) {
+	hf.lock.Lock()
+	defer hf.lock.Unlock()
+
+	if hf.body == nil || hf.off != off {
+		hf.closeBody()
+		err := hf.download(off)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(hf.body, p)
+	hf.off += int64(n)
+
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		hf.closeBody()
+		err = io.EOF
+		if hf.size >= 0 && hf.off < hf.size {
+			err = &httpError{fmt.Errorf("download of %s cut short at %d of %d bytes", hf.url, hf.off, hf.size)}
+		}
+	case errIdle:
+		hf.closeBody()
+		err = &httpError{fmt.Errorf("download of %s received no data for %v", hf.url, httpIdleTimeout)}
+	default:
+		hf.closeBody()
+		if _, ok := err.(net.Error); ok {
+			err = &httpError{err}
+		}
+	}
+	return n, err
+}
+
+func (hf *httpFile) closeBody() {
+	if hf.body != nil {
+		hf.body.Close()
+		hf.body = nil
+	}
+}
+
+func (hf *httpFile) Close() error {
+	hf.lock.Lock()
+	defer hf.lock.Unlock()
+
+	hf.closeBody()
+	return nil
+}
+
+// walkHTTP calls walkFn for the file at rawurl. URLs are files, not
+// directory listings.
+func walkHTTP(client *http.Client, rawurl string, walkFn filepath.WalkFunc) error {
+	fi, err := statHTTP(client, rawurl)
+	return walkFn(rawurl, fi, err)
+}
+
+// errIdle is returned by reads of an idleBody that timed out.
+var errIdle = errors.New("download idle")
+
+// idleBody closes the body of a download when a read waits httpIdleTimeout
+// without receiving any data, failing it and any later one with errIdle. The
+// time between reads doesn't count, a busy reader isn't an idle server.
+type idleBody struct {
+	body  io.ReadCloser
+	timer *time.Timer
+
+	lock sync.Mutex
+	idle bool
+}
+
+func newIdleBody(body io.ReadCloser) *idleBody {
+	ib := &idleBody{body: body}
+	ib.timer = time.AfterFunc(httpIdleTimeout, func() {
+		ib.lock.Lock()
+		ib.idle = true
+		ib.lock.Unlock()
+		body.Close()
+	})
+	ib.timer.Stop()
+	return ib
+}
+
+func (ib *idleBody) Read(p []byte) (int, error) {
+	ib.timer.Reset(httpIdleTimeout)
+	n, err := ib.body.Read(p)
+	ib.timer.Stop()
+
+	ib.lock.Lock()
+	idle := ib.idle
+	ib.lock.Unlock()
+	if idle {
+		return n, errIdle
+	}
+	return n, err
+}
+
+func (ib *idleBody) Close() error {
+	ib.timer.Stop()
+	return ib.body.Close()
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestArchiveFromHTTP(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-http-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "mirror")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var contents [][]byte
+
+	big := bytes.Repeat([]byte("a rom larger than a single read "), 10000)
+	contents = append(contents, big)
+	err = ioutil.WriteFile(filepath.Join(srcDir, "big.bin"), big, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := make(map[string][]byte)
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("zipped rom %d", i))
+		contents = append(contents, data)
+		members[fmt.Sprintf("rom%d.bin", i)] = data
+	}
+	writeZip(t, filepath.Join(srcDir, "set.zip"), members)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("tarred rom %d", i))
+		contents = append(contents, data)
+		err = tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("rom%d.bin", i), Mode: 0666, Size: int64(len(data))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(srcDir, "set.tar"), buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first download of big.bin is cut short halfway
+	var cut, resumed int32
+	files := http.FileServer(http.Dir(srcDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/big.bin" {
+			if r.Header.Get("Range") == fmt.Sprintf("bytes=%d-", len(big)/2) {
+				atomic.AddInt32(&resumed, 1)
+			} else if r.Header.Get("Range") == "" && atomic.AddInt32(&cut, 1) == 1 {
+				w.Header().Set("Content-Length", strconv.Itoa(len(big)))
+				w.Write(big[:len(big)/2])
+				return
+			}
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var urls []string
+	for _, name := range []string{"big.bin", "set.zip", "set.tar"} {
+		urls = append(urls, server.URL+"/"+name)
+	}
+
+	_, err = depot.Archive(urls, &ArchiveOptions{DeleteSources: true}, 2, logDir, worker.NewProgressTracker())
+	if err == nil {
+		t.Errorf("deleting files on an HTTP server didn't fail")
+	}
+
+	// the test server is on a loopback address, refused unless allowed
+	depot.Archive(urls, &ArchiveOptions{}, 2, logDir, worker.NewProgressTracker())
+	sum := sha1.Sum(contents[0])
+	rompath, err := depot.RomPath(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rompath != "" {
+		t.Errorf("downloaded from a loopback address without allowing it")
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	sopts := SourceOptions{Retries: 1, HTTPAllowedNets: []*net.IPNet{loopback}}
+	_, err = depot.Archive(urls, &ArchiveOptions{Source: sopts}, 2, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range contents {
+		sum := sha1.Sum(data)
+		rompath, err := depot.RomPath(hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rompath == "" {
+			t.Errorf("rom of %d bytes starting with %q missing from depot", len(data), data[:10])
+		}
+	}
+
+	if resumed != 1 {
+		t.Errorf("resumed the cut download %d times", resumed)
+	}
+
+	sum = sha1.Sum(big)
+	prs, err := depot.Provenance(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 1 || prs[0].Path != urls[0] || prs[0].ModTime.IsZero() {
+		t.Errorf("got provenance records %v, want one for %s", prs, urls[0])
+	}
+}
+
+func TestHTTPIdleTimeout(t *testing.T) {
+	defer func(d time.Duration) { httpIdleTimeout = d }(httpIdleTimeout)
+	httpIdleTimeout = 50 * time.Millisecond
+
+	stall := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("abcd"))
+		w.(http.Flusher).Flush()
+		<-stall
+	}))
+	defer server.Close()
+	defer close(stall)
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	hf, err := openHTTP(newHTTPClient([]*net.IPNet{loopback}), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hf.Close()
+
+	_, err = hf.ReadAt(make([]byte, 8), 0)
+	if _, ok := err.(*httpError); !ok {
+		t.Errorf("got error %v reading a stalled download, want a retryable one", err)
+	}
+}
+
+func TestHTTPSlowReader(t *testing.T) {
+	defer func(d time.Duration) { httpIdleTimeout = d }(httpIdleTimeout)
+	httpIdleTimeout = 50 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("abcdefgh"))
+	}))
+	defer server.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	hf, err := openHTTP(newHTTPClient([]*net.IPNet{loopback}), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hf.Close()
+
+	// a reader busy for longer than the idle timeout between reads
+	p := make([]byte, 4)
+	for off := int64(0); off < 8; off += 4 {
+		_, err = hf.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("read at %d failed: %v", off, err)
+		}
+		time.Sleep(3 * httpIdleTimeout)
+	}
+	if string(p) != "efgh" {
+		t.Errorf("read %q, want efgh", p)
+	}
+}
+
+func TestHTTPIgnoresProxy(t *testing.T) {
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	os.Setenv("HTTP_PROXY", proxy.URL)
+	defer os.Unsetenv("HTTP_PROXY")
+
+	// the proxy is allowed, the private address behind it isn't
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, err := statHTTP(newHTTPClient([]*net.IPNet{loopback}), "http://10.0.0.1/set.zip")
+	if err == nil || !strings.Contains(err.Error(), "address not allowed") {
+		t.Errorf("got error %v for a private address, want it refused", err)
+	}
+	if proxied != 0 {
+		t.Errorf("request for a private address went through the proxy")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// partialHashChunk is how much of the start and of the end of a file go into
+// its partial hash.
+const partialHashChunk = 64 * 1024
+
+// partialHashForFile returns a cheap fingerprint of the file r of the given
+// size: the hex encoded SHA1 of its size, its first and its last 64KB.
+func partialHashForFile(r io.ReaderAt, size int64) (string, error) {
+	h := sha1.New()
+
+	var sz [8]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(size))
+	h.Write(sz[:])
+
+	var err error
+	if size <= 2*partialHashChunk {
+		_, err = io.Copy(h, io.NewSectionReader(r, 0, size))
+	} else {
+		_, err = io.Copy(h, io.NewSectionReader(r, 0, partialHashChunk))
+		if err == nil {
+			_, err = io.Copy(h, io.NewSectionReader(r, size-partialHashChunk, partialHashChunk))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loosePartialHash returns the partial hash of the loose file being
+// processed, read through the sources of the run the first time it is
+// needed.
+func (w *archiveWorker) loosePartialHash() (string, error) {
+	if w.partialHash != "" {
+		return w.partialHash, nil
+	}
+
+	sf, err := w.pm.sources.openFile(w.partialHashPath)
+	if err != nil {
+		return "", err
+	}
+	defer sf.Close()
+
+	w.partialHash, err = partialHashForFile(sf, w.partialHashSize)
+	return w.partialHash, err
+}
+
+// knownFile is a loose file archived before.
+type knownFile struct {
+	partialHash string
+	sha1Hex     string
+	path        string
+	modTime     time.Time
+}
+
+// loadKnownFiles indexes the loose files recorded in the provenance sidecars
+// of the depot by their size.
+func (depot *Depot) loadKnownFiles() (map[int64][]knownFile, error) {
+	known := make(map[int64][]knownFile)
+
+	err := depot.scanProvenance("", func(pr *ProvenanceRecord) {
+		if pr.PartialHash == "" {
+			return
+		}
+		for _, kf := range known[pr.Size] {
+			if kf.partialHash == pr.PartialHash && kf.sha1Hex == pr.Sha1 &&
+				kf.path == pr.Path && kf.modTime.Equal(pr.ModTime) {
+				return
+			}
+		}
+		known[pr.Size] = append(known[pr.Size], knownFile{
+			partialHash: pr.PartialHash,
+			sha1Hex:     pr.Sha1,
+			path:        pr.Path,
+			modTime:     pr.ModTime,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return known, nil
+}
+
+// archiveKnown checks whether the loose file inpath was archived before from
+// the same path, unchanged since by its modification time, size and partial
+// hash, and whether the depot still has a file of that size for it. If so it
+// indexes the rom from the depot file instead of hashing inpath and returns
+// true.
+func (w *archiveWorker) archiveKnown(inpath string, root int, size int64) (bool, error) {
+	// provenance records keep modification times to the second
+	modTime := w.modTime.Truncate(time.Second)
+
+	for _, kf := range w.pm.known[size] {
+		if kf.path != inpath || !kf.modTime.Equal(modTime) {
+			continue
+		}
+		partialHash, err := w.loosePartialHash()
+		if err != nil {
+			return false, err
+		}
+		if kf.partialHash != partialHash {
+			continue
+		}
+
+		rompath, err := w.depot.RomPath(kf.sha1Hex)
+		if err != nil {
+			return false, err
+		}
+		if rompath == "" {
+			continue
+		}
+
+		rom, err := romForDepotFile(rompath, kf.sha1Hex, false)
+		if err != nil {
+			return false, err
+		}
+		if rom == nil || rom.Size != size {
+			continue
+		}
+
+		rom.Name = filepath.Base(inpath)
+		rom.Path = inpath
+
+		_, _, err = w.indexRom(rom, root)
+		if err != nil {
+			return false, err
+		}
+
+		logger.V(2).Infof("trusting depot file %s for %s", rompath, inpath)
+		return true, nil
+	}
+	return false, nil
+}
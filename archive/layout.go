@@ -0,0 +1,335 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// layoutFilename is the descriptor in a depot root telling how its files are
+// sharded into directories. Roots without one use DefaultLayout.
+//
+// It holds one layout per line, formatted like "depth=4 width=2". The first
+// is the layout new files are written with, any further ones are layouts an
+// interrupted Relayout was migrating away from, which are still searched.
+const layoutFilename = ".romba_layout"
+
+// Layout describes how depot files are sharded into directories named after
+// the leading hex digits of their SHA1: Depth levels of Width digits each.
+type Layout struct {
+	Depth int
+	Width int
+}
+
+// DefaultLayout is 4 levels of 2 hex digits, like ab/cd/ef/01/abcdef01....
+var DefaultLayout = Layout{Depth: 4, Width: 2}
+
+func (l Layout) String() string {
+	return fmt.Sprintf("depth=%d width=%d", l.Depth, l.Width)
+}
+
+// Validate checks that the layout has at least one level and shards by at
+// most all of the SHA1.
+func (l Layout) Validate() error {
+	if l.Depth < 1 || l.Width < 1 || l.Depth*l.Width > 2*sha1.Size {
+		return fmt.Errorf("invalid depot layout %s", l)
+	}
+	return nil
+}
+
+// path returns the path of the depot file for the given hex encoded SHA1 below root.
+func (l Layout) path(root, sha1Hex, suffix string) string {
+	pieces := make([]string, l.Depth+2)
+
+	pieces[0] = root
+	for i := 0; i < l.Depth; i++ {
+		pieces[i+1] = sha1Hex[l.Width*i : l.Width*(i+1)]
+	}
+	pieces[l.Depth+1] = sha1Hex + suffix
+
+	return filepath.Join(pieces...)
+}
+
+func parseLayout(line string) (Layout, error) {
+	var l Layout
+
+	_, err := fmt.Sscanf(line, "depth=%d width=%d", &l.Depth, &l.Width)
+	if err != nil {
+		return l, fmt.Errorf("malformed depot layout %q: %v", line, err)
+	}
+	return l, l.Validate()
+}
+
+// readLayouts returns the layouts of root, the one to write with first.
+func readLayouts(root string) ([]Layout, error) {
+	file, err := os.Open(filepath.Join(root, layoutFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Layout{DefaultLayout}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var layouts []Layout
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		l, err := parseLayout(line)
+		if err != nil {
+			return nil, err
+		}
+		layouts = append(layouts, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(layouts) == 0 {
+		return nil, fmt.Errorf("%s in %s has no layout", layoutFilename, root)
+	}
+	return layouts, nil
+}
+
+func writeLayouts(root string, layouts []Layout) error {
+	tmpPath := filepath.Join(root, layoutFilename+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(file)
+	for _, l := range layouts {
+		fmt.Fprintln(bw, l)
+	}
+	err = bw.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(root, layoutFilename))
+}
+
+// layoutsOf returns the layouts of the root with index k, the one to write
+// with first.
+func (depot *Depot) layoutsOf(k int) []Layout {
+	depot.lock.Lock()
+	defer depot.lock.Unlock()
+
+	return depot.layouts[k]
+}
+
+func (depot *Depot) setLayouts(k int, layouts []Layout) error {
+	err := writeLayouts(depot.roots[k], layouts)
+	if err != nil {
+		return err
+	}
+
+	depot.lock.Lock()
+	defer depot.lock.Unlock()
+
+	depot.layouts[k] = layouts
+	return nil
+}
+
+// romPathIn returns the path new depot files for the given hex encoded SHA1
+// are written to in the root with index k.
+func (depot *Depot) romPathIn(k int, sha1Hex, suffix string) string {
+	return depot.layoutsOf(k)[0].path(depot.roots[k], sha1Hex, suffix)
+}
+
+type relayoutMaster struct {
+	depot      *Depot
+	numWorkers int
+	pt         worker.ProgressTracker
+	layout     Layout
+	lock       *sync.Mutex
+	failed     int
+}
+
+type relayoutWorker struct {
+	pm *relayoutMaster
+}
+
+// Relayout moves all depot files to where the given layout puts them and
+// records it in the depot roots. Until it has completed the previous layouts
+// are searched as well, and it can be rerun to finish an interrupted migration.
+func (depot *Depot) Relayout(layout Layout, numWorkers int, pt worker.ProgressTracker) (string, error) {
+	err := layout.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	pm := &relayoutMaster{
+		depot:      depot,
+		numWorkers: numWorkers,
+		pt:         pt,
+		layout:     layout,
+		lock:       new(sync.Mutex),
+	}
+
+	// worker.Work makes paths absolute in place
+	roots := make([]string, len(depot.roots))
+	copy(roots, depot.roots)
+
+	res, err := worker.Work("relayout depot to "+layout.String(), roots, pm)
+	return res.Message, err
+}
+
+func (pm *relayoutMaster) Accept(path string) bool {
+	return isDepotFile(path)
+}
+
+func (pm *relayoutMaster) NewWorker(workerIndex int) worker.Worker {
+	return &relayoutWorker{
+		pm: pm,
+	}
+}
+
+func (pm *relayoutMaster) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *relayoutMaster) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+// Start makes the new layout the one to write with, keeping the previous ones
+// searchable while files are moved.
+func (pm *relayoutMaster) Start() error {
+	for k := range pm.depot.roots {
+		layouts := []Layout{pm.layout}
+		for _, l := range pm.depot.layoutsOf(k) {
+			if l != pm.layout {
+				layouts = append(layouts, l)
+			}
+		}
+
+		err := pm.depot.setLayouts(k, layouts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FinishUp drops the previous layouts if all files were moved.
+func (pm *relayoutMaster) FinishUp() error {
+	pm.lock.Lock()
+	failed := pm.failed
+	pm.lock.Unlock()
+
+	if failed > 0 {
+		logger.Warningf("%d depot files failed to move, keeping the previous layouts", failed)
+		return nil
+	}
+
+	for k := range pm.depot.roots {
+		err := pm.depot.setLayouts(k, []Layout{pm.layout})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pm *relayoutMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	return nil
+}
+
+func (w *relayoutWorker) Process(path string, size int64) error {
+	err := w.move(path, size)
+	if _, skipped := err.(*worker.SkipError); err != nil && !skipped {
+		w.pm.lock.Lock()
+		w.pm.failed++
+		w.pm.lock.Unlock()
+	}
+	return err
+}
+
+func (w *relayoutWorker) move(path string, size int64) error {
+	depot := w.pm.depot
+
+	k := depot.rootIndex(path)
+	if k == -1 {
+		return worker.Skip(skipOutsideRoots)
+	}
+
+	root := depot.roots[k]
+	outpath := w.pm.layout.path(root, sha1HexForPath(path), filepath.Ext(path))
+	if outpath == path {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(outpath), 0777)
+	if err != nil {
+		return err
+	}
+
+	exists, err := PathExists(outpath)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		err = os.Remove(path)
+		if err == nil {
+			depot.adjustSize(k, -size)
+		}
+	} else {
+		err = os.Rename(path, outpath)
+	}
+	if err != nil {
+		return err
+	}
+
+	pruneEmptyDirs(filepath.Dir(path), root)
+	return nil
+}
+
+func (w *relayoutWorker) Close() error {
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestLayoutPath(t *testing.T) {
+	sha1Hex := "0123456789abcdef0123456789abcdef01234567"
+
+	for _, tc := range []struct {
+		layout Layout
+		want   string
+	}{
+		{DefaultLayout, "root/01/23/45/67/" + sha1Hex + ".gz"},
+		{Layout{Depth: 2, Width: 3}, "root/012/345/" + sha1Hex + ".gz"},
+		{Layout{Depth: 1, Width: 1}, "root/0/" + sha1Hex + ".gz"},
+	} {
+		got := tc.layout.path("root", sha1Hex, gzipSuffix)
+		if got != filepath.FromSlash(tc.want) {
+			t.Errorf("%s: got %s, want %s", tc.layout, got, tc.want)
+		}
+
+		if got, ok := depotLayoutSha1(filepath.FromSlash(tc.want)); !ok || got != sha1Hex {
+			t.Errorf("%s: %s not recognized as depot file", tc.layout, tc.want)
+		}
+	}
+
+	for _, l := range []Layout{{Depth: -1, Width: 2}, {Depth: 0, Width: 2}, {Depth: 2, Width: 0}, {Depth: 21, Width: 2}} {
+		if l.Validate() == nil {
+			t.Errorf("expected %s to be invalid", l)
+		}
+	}
+}
+
+func TestRelayout(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-layout-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	err = os.MkdirAll(depotRoot, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sha1Hexes []string
+	for _, data := range []string{"first rom to move", "second rom to move"} {
+		rom := putRom(t, depotRoot, data, []byte(data))
+		sha1Hexes = append(sha1Hexes, hex.EncodeToString(rom.Sha1))
+	}
+
+	layout := Layout{Depth: 2, Width: 3}
+
+	_, err = depot.Relayout(layout, 2, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen to read the layout back from the descriptor
+	depot, err = NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := depot.layoutsOf(0); len(got) != 1 || got[0] != layout {
+		t.Errorf("got layouts %v, want %s", got, layout)
+	}
+
+	for _, sha1Hex := range sha1Hexes {
+		want := layout.path(depotRoot, sha1Hex, gzipSuffix)
+
+		got, err := depot.RomPath(sha1Hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got depot file %s, want %s", got, want)
+		}
+
+		exists, err := PathExists(filepath.Join(depotRoot, sha1Hex[0:2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Errorf("directory of the previous layout left behind for %s", sha1Hex)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"fmt"
+	"io"
+)
+
+// ContainerLimits bound what is extracted from zip, rar and tar files, so a
+// malicious or corrupt container fails with a *LimitError instead of
+// exhausting memory or disk. Zero values mean no limit.
+type ContainerLimits struct {
+	// MaxMemberSize is the largest decompressed size of a member.
+	MaxMemberSize int64
+	// MaxRatio is the largest ratio of decompressed to compressed size of a
+	// member. For compressed tar files, whose members aren't compressed
+	// individually, it applies to the members so far and the whole file.
+	MaxRatio int64
+	// MaxMembers is the largest number of members in a container.
+	MaxMembers int
+}
+
+// LimitError is returned for containers exceeding one of the ContainerLimits.
+type LimitError struct {
+	// Path of the container, or of the member for member limits.
+	Path string
+	// Limit is "member size", "compression ratio" or "members".
+	Limit string
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeds the %s limit: %d > %d", e.Path, e.Limit, e.Value, e.Max)
+}
+
+// checkMembers fails once a container holds more than MaxMembers members.
+func (cl *ContainerLimits) checkMembers(path string, n int) error {
+	if cl.MaxMembers > 0 && n > cl.MaxMembers {
+		return &LimitError{Path: path, Limit: "members", Value: int64(n), Max: int64(cl.MaxMembers)}
+	}
+	return nil
+}
+
+// checkMember checks the sizes a member declares, size and packed are -1 if
+// unknown.
+func (cl *ContainerLimits) checkMember(path string, size, packed int64) error {
+	if cl.MaxMemberSize > 0 && size > cl.MaxMemberSize {
+		return &LimitError{Path: path, Limit: "member size", Value: size, Max: cl.MaxMemberSize}
+	}
+	return cl.checkRatio(path, size, packed)
+}
+
+func (cl *ContainerLimits) checkRatio(path string, size, packed int64) error {
+	if cl.MaxRatio <= 0 || size < 0 || packed < 0 {
+		return nil
+	}
+
+	// empty and tiny members compress badly, not well
+	if packed == 0 {
+		packed = 1
+	}
+	if size/packed > cl.MaxRatio {
+		return &LimitError{Path: path, Limit: "compression ratio", Value: size / packed, Max: cl.MaxRatio}
+	}
+	return nil
+}
+
+// reader enforces MaxMemberSize on the bytes actually read from r, in case
+// the size declared by the container is wrong.
+func (cl *ContainerLimits) reader(path string, r io.Reader) io.Reader {
+	if cl.MaxMemberSize <= 0 {
+		return r
+	}
+	return &limitReader{r: r, path: path, max: cl.MaxMemberSize}
+}
+
+// opener applies reader to what ro opens.
+func (cl *ContainerLimits) opener(path string, ro readerOpener) readerOpener {
+	if cl.MaxMemberSize <= 0 {
+		return ro
+	}
+	return func() (io.ReadCloser, error) {
+		rc, err := ro()
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{cl.reader(path, rc), rc}, nil
+	}
+}
+
+type limitReader struct {
+	r    io.Reader
+	path string
+	n    int64
+	max  int64
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lr.n > lr.max {
+		return n, &LimitError{Path: lr.path, Limit: "member size", Value: lr.n, Max: lr.max}
+	}
+	return n, err
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestContainerLimits(t *testing.T) {
+	cl := &ContainerLimits{MaxMemberSize: 100, MaxRatio: 10, MaxMembers: 2}
+
+	for _, tc := range []struct {
+		err   error
+		limit string
+	}{
+		{cl.checkMembers("c.zip", 2), ""},
+		{cl.checkMembers("c.zip", 3), "members"},
+		{cl.checkMember("c.zip/m", 100, 10), ""},
+		{cl.checkMember("c.zip/m", 101, 100), "member size"},
+		{cl.checkMember("c.zip/m", 100, 9), "compression ratio"},
+		{cl.checkMember("c.zip/m", 0, 0), ""},
+		{cl.checkMember("c.zip/m", -1, -1), ""},
+	} {
+		if tc.limit == "" {
+			if tc.err != nil {
+				t.Errorf("unexpected error %v", tc.err)
+			}
+			continue
+		}
+
+		le, ok := tc.err.(*LimitError)
+		if !ok || le.Limit != tc.limit {
+			t.Errorf("got %v, want the %s limit", tc.err, tc.limit)
+		}
+	}
+
+	_, err := ioutil.ReadAll(cl.reader("c.zip/m", bytes.NewReader(make([]byte, 101))))
+	if le, ok := err.(*LimitError); !ok || le.Limit != "member size" {
+		t.Errorf("got %v reading too much, want the member size limit", err)
+	}
+
+	_, err = ioutil.ReadAll(cl.reader("c.zip/m", bytes.NewReader(make([]byte, 100))))
+	if err != nil {
+		t.Errorf("unexpected error %v reading up to the limit", err)
+	}
+}
+
+func TestArchiveLimitsZipBombs(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-limits-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+	qDir := filepath.Join(root, "quarantine")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Create("zeros.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.Write(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bombPath := filepath.Join(srcDir, "bomb.zip")
+	err = ioutil.WriteFile(bombPath, buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ArchiveOptions{
+		QuarantineDir: qDir,
+		Limits:        ContainerLimits{MaxRatio: 100},
+	}
+	_, err = depot.Archive([]string{srcDir}, opts, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("archive failed despite quarantine: %v", err)
+	}
+
+	report, err := ioutil.ReadFile(filepath.Join(qDir, "bomb.zip") + quarantineReportSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "compression ratio") {
+		t.Errorf("quarantine report doesn't name the exceeded limit: %s", report)
+	}
+}
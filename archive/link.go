@@ -0,0 +1,313 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// depotLayoutSha1 reports whether path looks like a file in a depot, i.e.
+// <sha1>.gz or <sha1>.zst in directories named after the leading hex digits
+// of the sha1, in any layout at least one level deep. It returns the hex
+// encoded sha1.
+func depotLayoutSha1(path string) (string, bool) {
+	if codecForPath(path) == nil {
+		return "", false
+	}
+
+	sha1Hex := sha1HexForPath(path)
+	sha1Bytes, err := hex.DecodeString(sha1Hex)
+	if err != nil || len(sha1Bytes) != sha1.Size || hex.EncodeToString(sha1Bytes) != sha1Hex {
+		return "", false
+	}
+
+	// the innermost directory gives the width, try each depth it allows
+	width := len(filepath.Base(filepath.Dir(path)))
+	root := filepath.Dir(path)
+	for depth := 1; width > 0 && depth*width <= len(sha1Hex); depth++ {
+		root = filepath.Dir(root)
+		l := Layout{Depth: depth, Width: width}
+		if l.path(root, sha1Hex, filepath.Ext(path)) == path {
+			return sha1Hex, true
+		}
+	}
+	return "", false
+}
+
+// isDepotBookkeeping reports whether path is one of the files a depot keeps
+// besides its rom files: the size, provenance, manifest and layout files and
+// anything in the temp, quarantine, upload and trash directories.
+func isDepotBookkeeping(path string) bool {
+	switch filepath.Base(path) {
+	case sizeFilename, provenanceFilename, manifestFilename, layoutFilename:
+		return true
+	}
+
+	for _, skip := range []string{tmpDirName, quarantineDirName, uploadDirName, trashDirName} {
+		if strings.Contains(path, string(filepath.Separator)+skip+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// importDepotFile adds a file from another depot to this one. The compressed
+// file is reflinked, hardlinked or, failing both, copied as is, so merging
+// depots doesn't recompress anything.
+func (w *archiveWorker) importDepotFile(inpath, sha1Hex string, root int) error {
+	rom, err := romForDepotFile(inpath, sha1Hex, w.pm.opts.VerifyImports)
+	if err != nil {
+		return err
+	}
+	if rom == nil {
+		return worker.Skip("not matching its name")
+	}
+
+	_, missing, err := w.indexRom(rom, root)
+	if err != nil || !missing {
+		return err
+	}
+
+	outpath := w.depot.romPathIn(root, sha1Hex, filepath.Ext(inpath))
+	tmpDir := filepath.Join(w.depot.roots[root], tmpDirName)
+
+	var n int64
+	var how string
+
+	if w.pm.opts.MoveImports {
+		n, how, err = moveDepotFile(inpath, outpath, tmpDir)
+	} else {
+		n, how, err = linkDepotFile(inpath, outpath, tmpDir, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.V(2).Infof("imported %s into depot by %s", inpath, how)
+	w.depot.archived(root, n)
+	return nil
+}
+
+// romForDepotFile describes the contents of the depot file inpath, from its
+// header if it is complete and by decompressing it otherwise. If verify is set
+// the contents are always decompressed and checked against sha1Hex. Files
+// that don't match their name are logged and nil is returned for them.
+func romForDepotFile(inpath, sha1Hex string, verify bool) (*types.Rom, error) {
+	sha1Bytes, err := hex.DecodeString(sha1Hex)
+	if err != nil {
+		return nil, err
+	}
+
+	rom := new(types.Rom)
+	rom.Name = filepath.Base(inpath)
+	rom.Path = inpath
+	rom.Sha1 = sha1Bytes
+
+	dh, err := ReadDepotHeader(inpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if dh != nil && dh.Sha1 != nil && !bytes.Equal(dh.Sha1, sha1Bytes) {
+		logger.Errorf("skipping depot file %s with SHA1 %s in its header", inpath, hex.EncodeToString(dh.Sha1))
+		return nil, nil
+	}
+
+	if dh != nil && dh.Sha1 != nil && !verify {
+		rom.Size = dh.Size
+		rom.Md5 = dh.Md5
+		rom.Crc = dh.Crc
+		rom.Sha256 = dh.Sha256
+		rom.Blake3 = dh.Blake3
+		return rom, nil
+	}
+
+	r, err := openDepotFile(inpath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	hh := newHashes(dh != nil && dh.Sha256 != nil)
+	cr := &countReader{r: r}
+	err = hh.forReader(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	rom.Size = cr.count
+
+	if bytes.Equal(hh.Sha1, sha1Bytes) {
+		rom.Md5 = hh.Md5
+		rom.Crc = hh.Crc
+		rom.Sha256 = hh.Sha256
+		rom.Blake3 = hh.Blake3
+		return rom, nil
+	}
+
+	// CHDs are stored under their internal SHA1
+	r2, err := openDepotFile(inpath)
+	if err != nil {
+		return nil, err
+	}
+	defer r2.Close()
+
+	chd, err := ReadCHDInfo(r2)
+	if err != nil {
+		return nil, err
+	}
+	if chd == nil || !bytes.Equal(chd.Sha1, sha1Bytes) {
+		logger.Errorf("skipping depot file %s whose contents have SHA1 %s", inpath, hex.EncodeToString(hh.Sha1))
+		return nil, nil
+	}
+	rom.Md5 = chd.Md5
+	return rom, nil
+}
+
+type countReader struct {
+	r     io.Reader
+	count int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// linkDepotFile puts a copy of src at dst, by cloning it on filesystems that
+// support it, hardlinking it if that fails and copying it as a last resort.
+// If copyOnly is set it is always copied. The copy is made in tmpDir and
+// renamed into place. It returns the size of the file and how it was copied.
+func linkDepotFile(src, dst, tmpDir string, copyOnly bool) (int64, string, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = os.MkdirAll(tmpDir, 0777)
+	if err != nil {
+		return 0, "", err
+	}
+
+	tmpfile, err := ioutil.TempFile(tmpDir, filepath.Base(dst))
+	if err != nil {
+		return 0, "", err
+	}
+	tmppath := tmpfile.Name()
+
+	var how string
+	if !copyOnly {
+		how = "clone"
+		err = cloneFile(tmpfile, src)
+	}
+	tmpfile.Close()
+
+	if !copyOnly && err != nil {
+		how = "hardlink"
+		os.Remove(tmppath)
+		err = os.Link(src, tmppath)
+	}
+
+	if copyOnly || err != nil {
+		how = "copy"
+		err = copyFile(src, tmppath)
+	}
+
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(dst), 0777)
+	}
+	if err == nil {
+		err = os.Rename(tmppath, dst)
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return 0, "", err
+	}
+	return fi.Size(), how, nil
+}
+
+// moveDepotFile moves src to dst, by renaming it if both are on the same
+// filesystem and by linking or copying it and removing src otherwise. It
+// returns the size of the file and how it was moved.
+func moveDepotFile(src, dst, tmpDir string) (int64, string, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if os.Rename(src, dst) == nil {
+		return fi.Size(), "rename", nil
+	}
+
+	n, how, err := linkDepotFile(src, dst, tmpDir, false)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, how, os.Remove(src)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestFilename is the file in each depot root listing the depot files
+// below it, so replication tools and integrity checkers can work off it
+// instead of walking the depot.
+const manifestFilename = ".romba_manifest"
+
+// StateFiles returns the names of the files in each depot root describing
+// the depot, the ones state bundles keep.
+func StateFiles() []string {
+	return []string{layoutFilename, manifestFilename, provenanceFilename}
+}
+
+// ManifestEntry describes one depot file.
+type ManifestEntry struct {
+	Sha1 string
+	// Size of the uncompressed rom.
+	Size int64
+	// Path is relative to the depot root, with forward slashes.
+	Path  string
+	Codec string
+}
+
+func (me *ManifestEntry) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s", me.Sha1, me.Size, me.Path, me.Codec)
+}
+
+func parseManifestEntry(line string) (*ManifestEntry, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("malformed manifest entry %q", line)
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ManifestEntry{
+		Sha1:  fields[0],
+		Size:  size,
+		Path:  fields[2],
+		Codec: fields[3],
+	}, nil
+}
+
+// readManifest returns the entries of the manifest in root by path and the
+// time it was written, the zero time if there is none.
+func readManifest(root string) (map[string]*ManifestEntry, time.Time, error) {
+	entries := make(map[string]*ManifestEntry)
+
+	file, err := os.Open(filepath.Join(root, manifestFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, time.Time{}, nil
+		}
+		return nil, time.Time{}, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		me, err := parseManifestEntry(scanner.Text())
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		entries[me.Path] = me
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	return entries, fi.ModTime(), nil
+}
+
+func writeManifest(root string, entries map[string]*ManifestEntry) error {
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	tmpPath := filepath.Join(root, manifestFilename+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(file)
+	for _, path := range paths {
+		if _, err = fmt.Fprintln(bw, entries[path]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(root, manifestFilename))
+}
+
+// manifestSubtree checks subtree, a slash separated path relative to the depot
+// roots, and returns it cleaned. The empty string stands for the whole depot.
+func manifestSubtree(subtree string) (string, error) {
+	if subtree == "" {
+		return "", nil
+	}
+
+	clean := filepath.ToSlash(filepath.Clean(filepath.FromSlash(subtree)))
+	if clean == "." {
+		return "", nil
+	}
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("subtree %s is outside of the depot", subtree)
+	}
+	return clean, nil
+}
+
+func inManifestSubtree(path, subtree string) bool {
+	return subtree == "" || path == subtree || strings.HasPrefix(path, subtree+"/")
+}
+
+// UpdateManifest brings the manifests in the depot roots up to date for the
+// depot files below subtree, or for all of them if subtree is empty. Entries
+// of files older than the previous manifest are carried over, so only new
+// depot files have their headers read.
+func (depot *Depot) UpdateManifest(subtree string) (string, error) {
+	subtree, err := manifestSubtree(subtree)
+	if err != nil {
+		return "", err
+	}
+
+	var total, added, removed int
+
+	for _, root := range depot.roots {
+		old, written, err := readManifest(root)
+		if err != nil {
+			return "", err
+		}
+
+		entries := make(map[string]*ManifestEntry, len(old))
+		for path, me := range old {
+			if !inManifestSubtree(path, subtree) {
+				entries[path] = me
+			}
+		}
+
+		err = filepath.Walk(filepath.Join(root, filepath.FromSlash(subtree)),
+			func(path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					if os.IsNotExist(err) {
+						return nil
+					}
+					return err
+				}
+				if fi.IsDir() || !isDepotFile(path) {
+					return nil
+				}
+
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					return err
+				}
+				rel = filepath.ToSlash(rel)
+
+				if me, ok := old[rel]; ok && fi.ModTime().Before(written) {
+					entries[rel] = me
+					return nil
+				}
+
+				rom, err := romForDepotFile(path, sha1HexForPath(path), false)
+				if err != nil {
+					logger.Errorf("skipping depot file %s in manifest: %v", path, err)
+					return nil
+				}
+				if rom == nil {
+					return nil
+				}
+
+				entries[rel] = &ManifestEntry{
+					Sha1:  sha1HexForPath(path),
+					Size:  rom.Size,
+					Path:  rel,
+					Codec: codecForPath(path).name,
+				}
+				if _, ok := old[rel]; !ok {
+					added++
+				}
+				return nil
+			})
+		if err != nil {
+			return "", err
+		}
+
+		for path := range old {
+			if _, ok := entries[path]; !ok {
+				removed++
+			}
+		}
+		total += len(entries)
+
+		err = writeManifest(root, entries)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("updated manifest: %d depot files, %d added, %d removed", total, added, removed), nil
+}
+
+// Manifest calls f for the entries of the manifests below subtree, or for all
+// of them if subtree is empty, along with the depot root they belong to.
+func (depot *Depot) Manifest(subtree string, f func(root string, me *ManifestEntry)) error {
+	subtree, err := manifestSubtree(subtree)
+	if err != nil {
+		return err
+	}
+
+	for _, root := range depot.roots {
+		entries, _, err := readManifest(root)
+		if err != nil {
+			return err
+		}
+
+		paths := make([]string, 0, len(entries))
+		for path := range entries {
+			if inManifestSubtree(path, subtree) {
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			f(root, entries[path])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdateManifest(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-manifest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	err = os.MkdirAll(depotRoot, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := func(subtree string) map[string]*ManifestEntry {
+		entries := make(map[string]*ManifestEntry)
+		err := depot.Manifest(subtree, func(r string, me *ManifestEntry) {
+			if r != depotRoot {
+				t.Errorf("got root %s, want %s", r, depotRoot)
+			}
+			entries[me.Sha1] = me
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	first := putRom(t, depotRoot, "first.bin", []byte("first rom in the manifest"))
+
+	_, err = depot.UpdateManifest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstHex := hex.EncodeToString(first.Sha1)
+	entries := manifest("")
+	me := entries[firstHex]
+	if len(entries) != 1 || me == nil {
+		t.Fatalf("got manifest %v, want only %s", entries, firstHex)
+	}
+	wantPath := strings.Join([]string{firstHex[0:2], firstHex[2:4], firstHex[4:6], firstHex[6:8], firstHex + gzipSuffix}, "/")
+	if me.Size != first.Size || me.Path != wantPath || me.Codec != gzipCodec.name {
+		t.Errorf("got entry %v, want size %d, path %s and codec %s", me, first.Size, wantPath, gzipCodec.name)
+	}
+
+	second := putRom(t, depotRoot, "second.bin", []byte("second rom in the manifest"))
+	secondHex := hex.EncodeToString(second.Sha1)
+
+	_, err = depot.UpdateManifest(secondHex[0:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries = manifest("")
+	if len(entries) != 2 || entries[firstHex] == nil || entries[secondHex] == nil {
+		t.Fatalf("got manifest %v, want %s and %s", entries, firstHex, secondHex)
+	}
+
+	entries = manifest(secondHex[0:2] + "/" + secondHex[2:4])
+	if len(entries) != 1 || entries[secondHex] == nil {
+		t.Errorf("got subtree manifest %v, want only %s", entries, secondHex)
+	}
+
+	err = os.Remove(pathFromSha1HexEncoding(depotRoot, firstHex, gzipSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.UpdateManifest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries = manifest("")
+	if len(entries) != 1 || entries[secondHex] == nil {
+		t.Errorf("got manifest %v after removal, want only %s", entries, secondHex)
+	}
+
+	_, err = depot.UpdateManifest("../outside")
+	if err == nil {
+		t.Errorf("expected an error for a subtree outside of the depot")
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// MissEntry is a rom of a dat the depot doesn't have. Hashes are hex encoded,
+// empty if the dat doesn't give them.
+type MissEntry struct {
+	Game string `json:"game"`
+	Rom  string `json:"rom"`
+	Size int64  `json:"size"`
+	Crc  string `json:"crc,omitempty"`
+	Md5  string `json:"md5,omitempty"`
+	Sha1 string `json:"sha1,omitempty"`
+}
+
+// hash returns the strongest hash known for the missing rom.
+func (me *MissEntry) hash() string {
+	switch {
+	case me.Sha1 != "":
+		return me.Sha1
+	case me.Md5 != "":
+		return me.Md5
+	}
+	return me.Crc
+}
+
+// DatMissReport tells which roms of a dat the depot has and misses.
+type DatMissReport struct {
+	Name string `json:"name"`
+	// Path is the DAT file the dat was read from, if known.
+	Path         string       `json:"path,omitempty"`
+	Have         int          `json:"have"`
+	Miss         int          `json:"miss"`
+	MissingBytes int64        `json:"missingBytes"`
+	Missing      []*MissEntry `json:"missing,omitempty"`
+}
+
+// MissReport consolidates the miss reports of a number of dats.
+type MissReport struct {
+	Have         int              `json:"have"`
+	Miss         int              `json:"miss"`
+	MissingBytes int64            `json:"missingBytes"`
+	Dats         []*DatMissReport `json:"dats"`
+}
+
+// Add adds the report of a dat to mr.
+func (mr *MissReport) Add(dr *DatMissReport) {
+	mr.Have += dr.Have
+	mr.Miss += dr.Miss
+	mr.MissingBytes += dr.MissingBytes
+	mr.Dats = append(mr.Dats, dr)
+}
+
+func (mr *MissReport) String() string {
+	return fmt.Sprintf("%d dats, have %d roms, miss %d roms (%s)", len(mr.Dats), mr.Have, mr.Miss,
+		ByteSize(mr.MissingBytes))
+}
+
+// MissDat checks which roms of dat are in the depot. Roms without SHA1 are
+// looked up in the rom DB by their other hashes, roms without dump are
+// skipped.
+func (depot *Depot) MissDat(dat *types.Dat) (*DatMissReport, error) {
+	dr := &DatMissReport{
+		Name: dat.Name,
+		Path: dat.Path,
+	}
+
+	for _, game := range dat.Games {
+		for _, rom := range game.AllRoms() {
+			if rom.NoDump() {
+				continue
+			}
+
+			rompath, err := depot.buildRomPath(rom)
+			if err != nil {
+				return nil, err
+			}
+
+			if rompath != "" {
+				dr.Have++
+				continue
+			}
+
+			dr.Miss++
+			dr.MissingBytes += rom.Size
+			dr.Missing = append(dr.Missing, &MissEntry{
+				Game: game.Name,
+				Rom:  rom.Name,
+				Size: rom.Size,
+				Crc:  hex.EncodeToString(rom.Crc),
+				Md5:  hex.EncodeToString(rom.Md5),
+				Sha1: hex.EncodeToString(rom.Sha1),
+			})
+		}
+	}
+	return dr, nil
+}
+
+// WriteReports writes mr into dir as text, CSV and JSON files named after
+// name. Dats are sorted by name.
+func (mr *MissReport) WriteReports(dir, name string) error {
+	sort.Slice(mr.Dats, func(i, j int) bool {
+		return mr.Dats[i].Name < mr.Dats[j].Name
+	})
+
+	for _, report := range []struct {
+		suffix string
+		write  func(bw *bufio.Writer) error
+	}{
+		{".txt", mr.writeText},
+		{".csv", mr.writeCSV},
+		{".json", mr.writeJSON},
+	} {
+		err := writeReportFile(filepath.Join(dir, name+report.suffix), report.write)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeReportFile(outpath string, write func(bw *bufio.Writer) error) error {
+	file, err := os.Create(outpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bw := bufio.NewWriter(file)
+	err = write(bw)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (mr *MissReport) writeText(bw *bufio.Writer) error {
+	fmt.Fprintf(bw, "%s\n", mr)
+	for _, dr := range mr.Dats {
+		fmt.Fprintf(bw, "\n%s: have %d, miss %d (%s)\n", dr.Name, dr.Have, dr.Miss, ByteSize(dr.MissingBytes))
+		for _, me := range dr.Missing {
+			fmt.Fprintf(bw, "\t%s\t%s\t%s\n", me.Game, me.Rom, me.hash())
+		}
+	}
+	return nil
+}
+
+func (mr *MissReport) writeCSV(bw *bufio.Writer) error {
+	cw := csv.NewWriter(bw)
+
+	err := cw.Write([]string{"dat", "have", "miss", "missing bytes", "missing"})
+	if err != nil {
+		return err
+	}
+
+	for _, dr := range mr.Dats {
+		hashes := make([]string, len(dr.Missing))
+		for i, me := range dr.Missing {
+			hashes[i] = me.hash()
+		}
+
+		err = cw.Write([]string{
+			dr.Name,
+			strconv.Itoa(dr.Have),
+			strconv.Itoa(dr.Miss),
+			strconv.FormatInt(dr.MissingBytes, 10),
+			strings.Join(hashes, " "),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func (mr *MissReport) writeJSON(bw *bufio.Writer) error {
+	enc := json.NewEncoder(bw)
+	enc.SetIndent("", "  ")
+	return enc.Encode(mr)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestMissReport(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-miss-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	err = os.MkdirAll(depotRoot, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	present := putRom(t, depotRoot, "a.bin", []byte("rom a"))
+	missing := (&Hashes{Sha1: bytes.Repeat([]byte{0xab}, 20)}).rom("b.bin", "", 5)
+	nodump := &types.Rom{Name: "c.bin", Size: 7, Status: types.StatusNoDump}
+
+	mr := new(MissReport)
+	for _, dat := range []*types.Dat{
+		{Name: "zeta", Games: types.GameSlice{{Name: "game", Roms: types.RomSlice{present, missing, nodump}}}},
+		{Name: "alpha", Games: types.GameSlice{{Name: "game", Roms: types.RomSlice{present}}}},
+	} {
+		dr, err := depot.MissDat(dat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr.Add(dr)
+	}
+
+	if mr.Have != 2 || mr.Miss != 1 || mr.MissingBytes != 5 {
+		t.Errorf("got %v, want 2 roms had and 1 of 5 bytes missing", mr)
+	}
+
+	err = mr.WriteReports(root, "miss")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csvBytes, err := ioutil.ReadFile(filepath.Join(root, "miss.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(csvBytes)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "alpha,1,0,0,") ||
+		lines[2] != "zeta,1,1,5,"+strings.Repeat("ab", 20) {
+		t.Errorf("unexpected CSV report:\n%s", csvBytes)
+	}
+
+	jsonBytes, err := ioutil.ReadFile(filepath.Join(root, "miss.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back MissReport
+	err = json.Unmarshal(jsonBytes, &back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Dats) != 2 || len(back.Dats[1].Missing) != 1 || back.Dats[1].Missing[0].Rom != "b.bin" {
+		t.Errorf("unexpected JSON report:\n%s", jsonBytes)
+	}
+
+	if exists, _ := PathExists(filepath.Join(root, "miss.txt")); !exists {
+		t.Errorf("text report missing")
+	}
+}
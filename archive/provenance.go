@@ -0,0 +1,227 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// provenanceFilename is the sidecar file in each depot root recording where
+// the roms archived into the depot came from.
+const provenanceFilename = ".romba_provenance"
+
+// ProvenanceRecord tells where a rom in the depot was archived from.
+type ProvenanceRecord struct {
+	Sha1 string
+	// Run identifies the archive run, by the time it started.
+	Run string
+	// ModTime is the modification time of the source file, or of the
+	// container for archive members.
+	ModTime time.Time
+	// Size of the rom, -1 for records written before sizes were recorded.
+	Size int64
+	// PartialHash is the partial hash of loose source files, see
+	// partialHashForFile, and empty for archive members. Together with Path
+	// and ModTime it recognizes files archived before, see TrustDepot.
+	PartialHash string
+	// Path is the source file, for archive members the path of the container
+	// joined with the member name.
+	Path string
+}
+
+func (pr *ProvenanceRecord) String() string {
+	partial := pr.PartialHash
+	if partial == "" {
+		partial = "-"
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%d\t%s\t%s", pr.Sha1, pr.Run, pr.ModTime.UTC().Format(time.RFC3339),
+		pr.Size, partial, strconv.Quote(pr.Path))
+}
+
+// parseProvenanceRecord parses line, as written by String or, without size
+// and partial hash, by earlier versions.
+func parseProvenanceRecord(line string) (*ProvenanceRecord, error) {
+	// the quoted path has no tabs
+	fields := strings.Split(line, "\t")
+	if len(fields) == 4 {
+		fields = []string{fields[0], fields[1], fields[2], "-1", "-", fields[3]}
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed provenance record %q", line)
+	}
+
+	mtime, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	partial := fields[4]
+	if partial == "-" {
+		partial = ""
+	}
+
+	path, err := strconv.Unquote(fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProvenanceRecord{
+		Sha1:        fields[0],
+		Run:         fields[1],
+		ModTime:     mtime,
+		Size:        size,
+		PartialHash: partial,
+		Path:        path,
+	}, nil
+}
+
+// provenanceLog appends provenance records to the sidecar files of the depot
+// roots during an archive run.
+type provenanceLog struct {
+	run     string
+	lock    *sync.Mutex
+	files   []*os.File
+	writers []*bufio.Writer
+}
+
+func openProvenanceLog(depot *Depot, run string) (*provenanceLog, error) {
+	pl := &provenanceLog{
+		run:  run,
+		lock: new(sync.Mutex),
+	}
+
+	for _, root := range depot.roots {
+		file, err := os.OpenFile(filepath.Join(root, provenanceFilename), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			pl.close()
+			return nil, err
+		}
+		pl.files = append(pl.files, file)
+		pl.writers = append(pl.writers, bufio.NewWriter(file))
+	}
+	return pl, nil
+}
+
+// record notes in root where a rom was archived from, pr.Run is filled in.
+func (pl *provenanceLog) record(root int, pr *ProvenanceRecord) error {
+	pr.Run = pl.run
+
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	_, err := fmt.Fprintln(pl.writers[root], pr)
+	return err
+}
+
+func (pl *provenanceLog) close() error {
+	var err error
+	for i, file := range pl.files {
+		if werr := pl.writers[i].Flush(); werr != nil && err == nil {
+			err = werr
+		}
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Provenance returns the records of where the rom with the given hex encoded
+// SHA1 was archived from, oldest first per depot root.
+func (depot *Depot) Provenance(sha1Hex string) ([]*ProvenanceRecord, error) {
+	var prs []*ProvenanceRecord
+
+	err := depot.scanProvenance(sha1Hex+"\t", func(pr *ProvenanceRecord) {
+		prs = append(prs, pr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prs, nil
+}
+
+// scanProvenance calls f for all provenance records starting with prefix.
+func (depot *Depot) scanProvenance(prefix string, f func(pr *ProvenanceRecord)) error {
+	return depot.scanProvenanceLines(func(line string) error {
+		if !strings.HasPrefix(line, prefix) {
+			return nil
+		}
+
+		pr, err := parseProvenanceRecord(line)
+		if err != nil {
+			return err
+		}
+		f(pr)
+		return nil
+	})
+}
+
+// scanProvenanceLines calls f for the lines of the provenance records of all
+// depot roots, stopping at the first error it returns.
+func (depot *Depot) scanProvenanceLines(f func(line string) error) error {
+	for _, root := range depot.roots {
+		file, err := os.Open(filepath.Join(root, provenanceFilename))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			err = f(scanner.Text())
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = scanner.Err()
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestProvenanceRecordRoundTrip(t *testing.T) {
+	pr := &ProvenanceRecord{
+		Sha1:    "0123456789abcdef0123456789abcdef01234567",
+		Run:     "2013-01-02-03_04_05",
+		ModTime: time.Date(2013, 1, 2, 3, 4, 5, 0, time.UTC),
+		Size:    1234,
+		Path:    "/roms/with\ttab/and \"quotes\".zip/rom.bin",
+	}
+
+	for _, partial := range []string{"", "89abcdef0123456789abcdef0123456789abcdef"} {
+		pr.PartialHash = partial
+
+		got, err := parseProvenanceRecord(pr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != *pr {
+			t.Errorf("got %v, want %v", got, pr)
+		}
+	}
+
+	// records from before sizes and partial hashes were recorded
+	old := fmt.Sprintf("%s\t%s\t%s\t%s", pr.Sha1, pr.Run, pr.ModTime.Format(time.RFC3339), strconv.Quote(pr.Path))
+	got, err := parseProvenanceRecord(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := *pr
+	want.Size = -1
+	want.PartialHash = ""
+	if *got != want {
+		t.Errorf("got %v, want %v", got, &want)
+	}
+}
+
+func TestArchiveRecordsProvenance(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-provenance-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	var srcPaths []string
+	data := []byte("rom with two sources")
+
+	for _, dir := range []string{"src1", "src2", "depot", "log"} {
+		err = os.MkdirAll(filepath.Join(root, dir), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dir == "src1" || dir == "src2" {
+			srcPath := filepath.Join(root, dir, "rom.bin")
+			err = ioutil.WriteFile(srcPath, data, 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srcPaths = append(srcPaths, srcPath)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, srcPath := range srcPaths {
+		_, err = depot.Archive([]string{srcPath}, &ArchiveOptions{}, 1, logDir, worker.NewProgressTracker())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sum := sha1.Sum(data)
+	prs, err := depot.Provenance(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prs) != len(srcPaths) {
+		t.Fatalf("got %d provenance records, want %d", len(prs), len(srcPaths))
+	}
+	for i, pr := range prs {
+		if pr.Path != srcPaths[i] {
+			t.Errorf("provenance record %d has path %s, want %s", i, pr.Path, srcPaths[i])
+		}
+		if pr.ModTime.IsZero() || pr.Run == "" {
+			t.Errorf("provenance record %d incomplete: %v", i, pr)
+		}
+	}
+}
+
+// indexingTestDB remembers the roms indexed
+type indexingTestDB struct {
+	archiveTestDB
+	roms []*types.Rom
+}
+
+func (idb *indexingTestDB) IndexRom(rom *types.Rom) error {
+	idb.roms = append(idb.roms, rom)
+	return nil
+}
+
+func TestArchiveTrustsKnownFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-provenance-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srcPath := filepath.Join(srcDir, "rom.bin")
+	data := bytes.Repeat([]byte{0x55}, 3*partialHashChunk)
+	err = ioutil.WriteFile(srcPath, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origSum := sha1.Sum(data)
+
+	romDB := new(indexingTestDB)
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, romDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, &ArchiveOptions{}, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a change in the middle keeping the modification time goes unnoticed
+	// by the partial hash, showing that the file isn't hashed again
+	data[len(data)/2] = 0xaa
+	err = ioutil.WriteFile(srcPath, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(srcPath, fi.ModTime(), fi.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, trust := range []bool{true, false} {
+		romDB.roms = nil
+
+		_, err = depot.Archive([]string{srcDir}, &ArchiveOptions{TrustDepot: trust}, 1, logDir,
+			worker.NewProgressTracker())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(romDB.roms) != 1 {
+			t.Fatalf("indexed %d roms, want 1", len(romDB.roms))
+		}
+		if got := bytes.Equal(romDB.roms[0].Sha1, origSum[:]); got != trust {
+			t.Errorf("trust %v: indexed SHA1 of the archived file %v", trust, got)
+		}
+	}
+
+	// a file modified since is hashed again
+	err = os.Chtimes(srcPath, fi.ModTime(), fi.ModTime().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	romDB.roms = nil
+
+	_, err = depot.Archive([]string{srcDir}, &ArchiveOptions{TrustDepot: true}, 1, logDir,
+		worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(romDB.roms) != 1 || bytes.Equal(romDB.roms[0].Sha1, origSum[:]) {
+		t.Errorf("trusted the depot for a modified file")
+	}
+}
+
+func TestArchiveTrustKeepsSources(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-provenance-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srcPath := filepath.Join(srcDir, "rom.bin")
+	data := bytes.Repeat([]byte{0x55}, 3*partialHashChunk)
+	err = ioutil.WriteFile(srcPath, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, new(indexingTestDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, &ArchiveOptions{}, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same size, start, end and modification time, a different middle
+	data[len(data)/2] = 0xaa
+	err = ioutil.WriteFile(srcPath, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(srcPath, fi.ModTime(), fi.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, &ArchiveOptions{TrustDepot: true, DeleteSources: true}, 1, logDir,
+		worker.NewProgressTracker())
+	if err == nil {
+		t.Errorf("deleting sources while trusting the depot didn't fail")
+	}
+
+	got, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("source file not kept")
+	}
+}
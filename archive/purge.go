@@ -0,0 +1,238 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/trash"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// PurgeOptions controls which depot files a purge run removes and where they go.
+type PurgeOptions struct {
+	// BackupDir receives the purged depot files, keeping the depot layout.
+	// Without it, purged files go to Trash if set and are deleted if not.
+	BackupDir string
+	Trash     *trash.Op
+	// ObsoleteDats are the paths of dats that no longer count as current.
+	ObsoleteDats map[string]bool
+}
+
+type purgeMaster struct {
+	depot       *Depot
+	numWorkers  int
+	pt          worker.ProgressTracker
+	opts        *PurgeOptions
+	generation  int64
+	logMutex    *sync.Mutex
+	logFile     *os.File
+	logWriter   *bufio.Writer
+	numPurged   int
+	bytesPurged int64
+}
+
+type purgeWorker struct {
+	pm *purgeMaster
+}
+
+// Purge removes all depot files whose SHA1 isn't referenced by any current dat
+// in the index. A dat is current if it was indexed by the last refresh, isn't
+// artificial and isn't listed in the obsolete dats. Roms of pinned dats are
+// kept whether their dat is current or not. Purged files are listed in a log
+// in logDir.
+func (depot *Depot) Purge(opts *PurgeOptions, numWorkers int, logDir string, pt worker.ProgressTracker) (string, error) {
+	logPath := filepath.Join(logDir, fmt.Sprintf("purge-%s.log", time.Now().Format("2006-01-02-15_04_05")))
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return "", err
+	}
+
+	pm := new(purgeMaster)
+	pm.depot = depot
+	pm.pt = pt
+	pm.numWorkers = numWorkers
+	pm.opts = opts
+	pm.generation = depot.romDB.Generation()
+	pm.logMutex = new(sync.Mutex)
+	pm.logFile = logFile
+	pm.logWriter = bufio.NewWriter(logFile)
+
+	// worker.Work makes paths absolute in place
+	roots := make([]string, len(depot.roots))
+	copy(roots, depot.roots)
+
+	res, err := worker.Work("purge depot", roots, pm)
+	endMsg := res.Message
+
+	endMsg += fmt.Sprintf("purged %d depot files with %s, see %s\n", pm.numPurged,
+		ByteSize(pm.bytesPurged), logPath)
+	return endMsg, err
+}
+
+func (pm *purgeMaster) Accept(path string) bool {
+	return isDepotFile(path)
+}
+
+func (pm *purgeMaster) NewWorker(workerIndex int) worker.Worker {
+	return &purgeWorker{
+		pm: pm,
+	}
+}
+
+func (pm *purgeMaster) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *purgeMaster) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *purgeMaster) FinishUp() error {
+	pm.depot.writeSizes()
+	pm.logWriter.Flush()
+	return pm.logFile.Close()
+}
+
+func (pm *purgeMaster) Start() error {
+	return nil
+}
+
+func (pm *purgeMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	return nil
+}
+
+func (pm *purgeMaster) isCurrent(dat *types.Dat) bool {
+	return !dat.Artificial && dat.Generation == pm.generation && !pm.opts.ObsoleteDats[dat.Path]
+}
+
+func (w *purgeWorker) Process(path string, size int64) error {
+	sha1Hex := sha1HexForPath(path)
+	sha1Bytes, err := hex.DecodeString(sha1Hex)
+	if err != nil || len(sha1Bytes) != sha1.Size {
+		logger.Warningf("skipping depot file %s with a name that is not a SHA1", path)
+		return worker.Skip("name not a SHA1")
+	}
+
+	rom := new(types.Rom)
+	rom.Sha1 = sha1Bytes
+
+	// dats that only list md5 or crc are found through the depot header
+	dh, err := ReadDepotHeader(path)
+	if err != nil {
+		logger.Warningf("unreadable depot header in %s: %v", path, err)
+	} else if dh != nil {
+		rom.Md5 = dh.Md5
+		rom.Crc = dh.Crc
+	}
+
+	dats, err := w.pm.depot.romDB.DatsForRom(rom)
+	if err != nil {
+		return err
+	}
+
+	for _, dat := range dats {
+		if w.pm.isCurrent(dat) || dat.KeepsRoms() {
+			return nil
+		}
+	}
+
+	return w.pm.purge(path, sha1Hex, size)
+}
+
+func (w *purgeWorker) Close() error {
+	return nil
+}
+
+func (pm *purgeMaster) purge(path, sha1Hex string, size int64) error {
+	k := pm.depot.rootIndex(path)
+	if k == -1 {
+		return fmt.Errorf("depot file %s is in none of the depot roots", path)
+	}
+
+	if pm.opts.BackupDir != "" {
+		backupPath := pathFromSha1HexEncoding(pm.opts.BackupDir, sha1Hex, filepath.Ext(path))
+		err := moveFile(path, backupPath)
+		if err != nil {
+			return err
+		}
+	} else if pm.opts.Trash != nil {
+		err := pm.opts.Trash.Remove(path)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	pm.depot.adjustSize(k, -size)
+
+	pm.logMutex.Lock()
+	defer pm.logMutex.Unlock()
+
+	pm.numPurged++
+	pm.bytesPurged += size
+	fmt.Fprintf(pm.logWriter, "%s\n", path)
+	return nil
+}
+
+// moveFile renames src to dst, falling back to copying if they are on
+// different filesystems.
+func moveFile(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	err = copyFile(src, dst)
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
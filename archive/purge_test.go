@@ -0,0 +1,146 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// purgeTestDB only answers the queries purge makes
+type purgeTestDB struct {
+	db.RomDB
+	generation int64
+	dats       map[string][]*types.Dat
+}
+
+func (pdb *purgeTestDB) Generation() int64 {
+	return pdb.generation
+}
+
+func (pdb *purgeTestDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	return pdb.dats[hex.EncodeToString(rom.Sha1)], nil
+}
+
+func TestPurge(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-purge-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	backupDir := filepath.Join(root, "backup")
+	logDir := filepath.Join(root, "log")
+	err = os.MkdirAll(logDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := &types.Dat{Name: "current", Path: "/dats/current.dat", Generation: 2}
+	orphaned := &types.Dat{Name: "orphaned", Path: "/dats/orphaned.dat", Generation: 1}
+	obsolete := &types.Dat{Name: "obsolete", Path: "/dats/obsolete.dat", Generation: 2}
+	artificial := &types.Dat{Name: "artificial", Path: "/roms/foo", Generation: 2, Artificial: true}
+	pinned := &types.Dat{Name: "pinned", Path: "/dats/pinned.dat", Generation: 1,
+		DatFlags: types.DatFlags{Pinned: true}}
+
+	romDats := map[string][]*types.Dat{
+		"kept":       {orphaned, current},
+		"orphaned":   {orphaned},
+		"obsolete":   {obsolete},
+		"artificial": {artificial},
+		"pinned":     {pinned},
+		"unknown":    nil,
+	}
+
+	pdb := &purgeTestDB{
+		generation: 2,
+		dats:       make(map[string][]*types.Dat),
+	}
+
+	paths := make(map[string]string)
+
+	for name, dats := range romDats {
+		sum := sha1.Sum([]byte(name))
+		sha1Hex := hex.EncodeToString(sum[:])
+		pdb.dats[sha1Hex] = dats
+		paths[name] = pathFromSha1HexEncoding(depotRoot, sha1Hex, gzipSuffix)
+
+		_, err = archive(gzipCodec, paths[name], filepath.Join(depotRoot, tmpDirName), bytes.NewReader([]byte(name)), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &PurgeOptions{
+		BackupDir:    backupDir,
+		ObsoleteDats: map[string]bool{obsolete.Path: true},
+	}
+
+	_, err = depot.Purge(opts, 2, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range romDats {
+		exists, err := PathExists(paths[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		backedUp, err := PathExists(filepath.Join(backupDir, paths[name][len(depotRoot):]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name == "kept" || name == "pinned" {
+			if !exists || backedUp {
+				t.Errorf("rom %s needed by a current or pinned dat got purged", name)
+			}
+		} else if exists || !backedUp {
+			t.Errorf("rom %s not purged into backup dir", name)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// quarantineReportSuffix is appended to the name of a quarantined source file
+// to name the report of why it was quarantined.
+const quarantineReportSuffix = ".romba-error.txt"
+
+// quarantineSource moves, or copies if so configured, the source file path
+// that failed to be archived with procErr into the quarantine directory, next
+// to a report of the error.
+func (pm *archiveMaster) quarantineSource(path string, procErr error) error {
+	dst, err := pm.relocateSource(path, pm.opts.QuarantineDir, pm.opts.QuarantineCopy)
+	if err != nil {
+		return err
+	}
+
+	report := fmt.Sprintf("source: %s\nerror: %v\ntime: %s\n", path, procErr, time.Now().Format(time.RFC3339))
+	err = ioutil.WriteFile(dst+quarantineReportSuffix, []byte(report), 0666)
+	if err != nil {
+		return err
+	}
+
+	logger.Warningf("quarantined %s as %s after error: %v", path, dst, procErr)
+	return nil
+}
+
+// relocateSource moves, or copies if copyOnly is set, the source file path
+// into dir, keeping its location relative to the scanned directories. It
+// returns the new path of the file.
+func (pm *archiveMaster) relocateSource(path, dir string, copyOnly bool) (string, error) {
+	return relocateFile(path, pm.commonRootPath, dir, copyOnly)
+}
+
+// relocateFile moves, or copies if copyOnly is set, the file path into dir,
+// keeping its location relative to root. Files already in dir aren't
+// overwritten, the new file gets a numbered name instead. It returns the new
+// path of the file.
+func relocateFile(path, root, dir string, copyOnly bool) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(path)
+	}
+
+	dst := filepath.Join(dir, rel)
+	for i := 1; ; i++ {
+		exists, err := PathExists(dst)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			break
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s-%d", rel, i))
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return "", err
+	}
+
+	if copyOnly {
+		return dst, copyFile(path, dst)
+	}
+
+	err = os.Rename(path, dst)
+	if err != nil {
+		// across filesystems
+		err = copyFile(path, dst)
+		if err == nil {
+			err = os.Remove(path)
+		}
+	}
+	return dst, err
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestArchiveQuarantinesFailedSources(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-quarantine-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+	qDir := filepath.Join(root, "quarantine")
+
+	for _, dir := range []string{filepath.Join(srcDir, "sub"), depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	badPath := filepath.Join(srcDir, "sub", "broken.zip")
+	err = ioutil.WriteFile(badPath, []byte("not a zip file"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(srcDir, "good.bin"), []byte("good rom"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ArchiveOptions{QuarantineDir: qDir}
+	pt := worker.NewProgressTracker()
+	_, err = depot.Archive([]string{srcDir}, opts, 1, logDir, pt)
+	if err != nil {
+		t.Fatalf("archive failed despite quarantine: %v", err)
+	}
+	if skipped := pt.GetProgress().Skipped; skipped["quarantined"] != 1 {
+		t.Errorf("got skipped %v, want the quarantined source", skipped)
+	}
+
+	if exists, _ := PathExists(badPath); exists {
+		t.Errorf("failed source not moved out")
+	}
+
+	qPath := filepath.Join(qDir, "sub", "broken.zip")
+	if exists, _ := PathExists(qPath); !exists {
+		t.Fatalf("failed source not in quarantine")
+	}
+
+	report, err := ioutil.ReadFile(qPath + quarantineReportSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), badPath) {
+		t.Errorf("quarantine report doesn't name the source: %s", report)
+	}
+}
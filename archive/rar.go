@@ -0,0 +1,107 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"io"
+	"path"
+	"path/filepath"
+
+	"github.com/nwaples/rardecode"
+)
+
+func (w *archiveWorker) archiveRar(inpath string, root int, size int64, addRarItself bool) error {
+	var rr *rardecode.Reader
+	if isRemote(inpath) {
+		// multi-volume rar files can't be read from SFTP servers
+		file, err := w.pm.sources.opener(inpath)()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		rr, err = rardecode.NewReader(file, "")
+		if err != nil {
+			return err
+		}
+	} else {
+		rc, err := rardecode.OpenReader(inpath, "")
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		rr = &rc.Reader
+	}
+
+	limits := &w.pm.opts.Limits
+	members := 0
+
+	for {
+		hdr, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.IsDir {
+			continue
+		}
+
+		members++
+		err = limits.checkMembers(inpath, members)
+		if err != nil {
+			return err
+		}
+
+		memberSize := hdr.UnPackedSize
+		if hdr.UnKnownSize {
+			memberSize = -1
+		}
+		memberPath := filepath.Join(inpath, filepath.FromSlash(hdr.Name))
+
+		err = limits.checkMember(memberPath, memberSize, hdr.PackedSize)
+		if err != nil {
+			return err
+		}
+
+		err = w.archiveSpooled(limits.reader(memberPath, rr), root, path.Base(hdr.Name), memberPath, memberSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if addRarItself {
+		return w.archive(w.pm.sources.opener(inpath), root, filepath.Base(inpath), inpath, size)
+	}
+	return nil
+}
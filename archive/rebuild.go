@@ -0,0 +1,412 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip/czip"
+
+	"github.com/uwedeportivo/romba/trash"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// RebuildOptions controls a rebuild of a set folder.
+type RebuildOptions struct {
+	// Unzipped rebuilds each game as a directory of plain files instead of
+	// a torrentzip file.
+	Unzipped bool
+	// BackupDir, if set, is where files of the set folder that get replaced
+	// or aren't needed by the dat are moved to, instead of being removed.
+	// Without it they go to Trash if set.
+	BackupDir string
+	Trash     *trash.Op
+	// FixDir, if set, is where a fix dat listing the roms neither the set
+	// folder nor the depot has is written to.
+	FixDir string
+}
+
+// setSources opens roms from the files of a set folder, falling back to the
+// depot.
+type setSources struct {
+	depot  *Depot
+	bySha1 map[string]*setFile
+	byCrc  map[string]*setFile
+	zips   map[string]*czip.ReadCloser
+}
+
+func newSetSources(depot *Depot, sfs []*setFile) *setSources {
+	ss := &setSources{
+		depot:  depot,
+		bySha1: make(map[string]*setFile),
+		byCrc:  make(map[string]*setFile),
+		zips:   make(map[string]*czip.ReadCloser),
+	}
+
+	for _, sf := range sfs {
+		ss.bySha1[hex.EncodeToString(sf.rom.Sha1)] = sf
+		ss.byCrc[crcKey(sf.rom.Crc, sf.rom.Size)] = sf
+	}
+	return ss
+}
+
+func (ss *setSources) open(rom *types.Rom) (io.ReadCloser, error) {
+	var sf *setFile
+	if rom.Sha1 != nil {
+		sf = ss.bySha1[hex.EncodeToString(rom.Sha1)]
+	} else {
+		sf = ss.byCrc[crcKey(rom.Crc, rom.Size)]
+	}
+
+	if sf == nil {
+		return ss.depot.openBuildRom(rom)
+	}
+
+	if sf.zipPath == "" {
+		return os.Open(sf.path)
+	}
+
+	zr, ok := ss.zips[sf.zipPath]
+	if !ok {
+		var err error
+		zr, err = czip.OpenReader(sf.zipPath)
+		if err != nil {
+			return nil, err
+		}
+		ss.zips[sf.zipPath] = zr
+	}
+
+	for _, zf := range zr.File {
+		if zf.Name == sf.member {
+			return zf.Open()
+		}
+	}
+	return nil, nil
+}
+
+func (ss *setSources) close() {
+	for path, zr := range ss.zips {
+		zr.Close()
+		delete(ss.zips, path)
+	}
+}
+
+// gamePath returns where game goes in the set folder setpath, or an error
+// if its name leads out of it.
+func gamePath(setpath string, game *types.Game, unzipped bool) (string, error) {
+	name := game.Name
+	if !unzipped {
+		name += zipSuffix
+	}
+	return joinEntryName(setpath, name)
+}
+
+// asidePath returns where fpath of the set folder setpath is put aside in
+// asideDir.
+func asidePath(fpath, setpath, asideDir string) string {
+	return filepath.Join(asideDir, strings.TrimPrefix(fpath, setpath))
+}
+
+// putInPlace moves the game built in buildDir to dst in the set folder
+// setpath, putting whatever is at dst aside into asideDir first. It reports
+// whether something was put aside.
+func putInPlace(game *types.Game, dst, buildDir, asideDir, setpath string, unzipped bool) (bool, error) {
+	staged, err := gamePath(buildDir, game, unzipped)
+	if err != nil {
+		return false, err
+	}
+
+	wasThere, err := PathExists(dst)
+	if err != nil {
+		return false, err
+	}
+	if wasThere {
+		aside := asidePath(dst, setpath, asideDir)
+		err = os.MkdirAll(filepath.Dir(aside), 0777)
+		if err != nil {
+			return false, err
+		}
+		err = os.Rename(dst, aside)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return wasThere, err
+	}
+	return wasThere, os.Rename(staged, dst)
+}
+
+// inPlace reports whether game already is in the set folder exactly as it
+// would be rebuilt, holding all of its roms under their names and nothing
+// else.
+func inPlace(game *types.Game, gpath string, unzipped bool, sfs []*setFile) bool {
+	want := make(map[string]*setRom)
+	for _, rom := range game.AllRoms() {
+		if rom.NoDump() || (rom.Sha1 == nil && rom.Crc == nil) {
+			continue
+		}
+		want[romEntryName(rom)] = &setRom{game: game, rom: rom}
+	}
+	if len(want) == 0 {
+		return false
+	}
+
+	found := 0
+	for _, sf := range sfs {
+		var name string
+		if unzipped {
+			if sf.zipPath != "" || !strings.HasPrefix(sf.path, gpath+string(filepath.Separator)) {
+				continue
+			}
+			name = filepath.ToSlash(sf.path[len(gpath)+1:])
+		} else {
+			if sf.zipPath != gpath {
+				continue
+			}
+			name = sf.member
+		}
+
+		sr, ok := want[name]
+		if !ok || !sr.matches(sf.rom) {
+			return false
+		}
+		found++
+	}
+	return found == len(want)
+}
+
+// RebuildSet rebuilds the set folder setpath in place so that it holds the
+// games of dat named and structured exactly as in the dat, as BuildDat would
+// build them. Roms are taken from wherever they are in the set folder, roms
+// it doesn't have are taken from the depot. Games already matching the dat
+// are left alone, all other files of the set folder are replaced.
+// It returns the number of roms neither the set folder nor the depot has.
+// Set folders of protected dats are refused.
+func (depot *Depot) RebuildSet(dat *types.Dat, setpath string, opts *RebuildOptions) (int, error) {
+	setpath = filepath.Clean(setpath)
+
+	if dat.Protected {
+		return 0, protectedError(dat, setpath)
+	}
+
+	sfs, err := scanSet(setpath)
+	if err != nil {
+		return 0, err
+	}
+
+	// games are built here first, so no source is replaced before all
+	// games are built, and the files they replace are put aside here until
+	// all games are in place. It is kept if putting the games in place
+	// fails, so nothing is lost.
+	stagingDir, err := ioutil.TempDir(setpath, ".romba-rebuild-")
+	if err != nil {
+		return 0, err
+	}
+	keepStaging := false
+	defer func() {
+		if !keepStaging {
+			os.RemoveAll(stagingDir)
+		}
+	}()
+	buildDir := filepath.Join(stagingDir, "games")
+	asideDir := filepath.Join(stagingDir, "replaced")
+
+	newSink := newTorrentzipSink
+	if opts.Unzipped {
+		newSink = newDirSink
+	}
+
+	ss := newSetSources(depot, sfs)
+	defer ss.close()
+
+	kept := make(map[string]bool)
+	seen := make(map[string]bool)
+	var built []*types.Game
+	var fixDat *types.Dat
+	missing := 0
+
+	for _, game := range dat.Games {
+		gpath, err := gamePath(setpath, game, opts.Unzipped)
+		if err != nil {
+			return 0, err
+		}
+		if seen[gpath] {
+			continue
+		}
+		seen[gpath] = true
+
+		if inPlace(game, gpath, opts.Unzipped, sfs) {
+			kept[gpath] = true
+			continue
+		}
+
+		fixGame, _, err := buildGame(game, buildDir, newSink, ss.open)
+		if err != nil {
+			return 0, err
+		}
+		if fixGame != nil {
+			fixDat = addFixGame(fixDat, dat, fixGame)
+			missing += len(fixGame.Roms)
+		}
+
+		staged, err := gamePath(buildDir, game, opts.Unzipped)
+		if err != nil {
+			return 0, err
+		}
+		exists, err := PathExists(staged)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			built = append(built, game)
+		}
+	}
+	// the sources are closed before they are replaced
+	ss.close()
+
+	// whatever is where a built game goes is put aside, the built game is
+	// put in its place
+	replaced := make(map[string]bool)
+	for _, game := range built {
+		dst, err := gamePath(setpath, game, opts.Unzipped)
+		if err == nil {
+			var wasThere bool
+			wasThere, err = putInPlace(game, dst, buildDir, asideDir, setpath, opts.Unzipped)
+			replaced[dst] = wasThere
+		}
+		if err != nil {
+			keepStaging = true
+			return 0, fmt.Errorf("error putting the games rebuilt for dat %s in place, "+
+				"%s holds the games not yet in place and the files replaced so far: %v", dat.Name, stagingDir, err)
+		}
+	}
+
+	// files holding nothing but kept games stay, everything else goes
+	for _, sf := range sfs {
+		fpath := sf.path
+		if sf.zipPath != "" {
+			fpath = sf.zipPath
+		}
+		if kept[fpath] || isInDir(fpath, kept) {
+			continue
+		}
+
+		if replaced[fpath] || isInDir(fpath, replaced) {
+			err = retireSetFile(asidePath(fpath, setpath, asideDir), asideDir, fpath, opts)
+		} else {
+			err = retireSetFile(fpath, setpath, fpath, opts)
+		}
+		if err != nil {
+			keepStaging = true
+			return 0, err
+		}
+	}
+
+	// whatever is left aside wasn't scanned, like .DS_Store files
+	if opts.Trash != nil {
+		for dst, wasThere := range replaced {
+			if !wasThere {
+				continue
+			}
+			aside := asidePath(dst, setpath, asideDir)
+			exists, err := PathExists(aside)
+			if err == nil && exists {
+				err = opts.Trash.RemoveFrom(aside, dst)
+			}
+			if err != nil {
+				keepStaging = true
+				return 0, err
+			}
+		}
+	}
+
+	if fixDat != nil && opts.FixDir != "" {
+		err = writeFixDat(fixDat, opts.FixDir)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	logger.Infof("rebuilt %d games of dat %s in %s, kept %d, %d roms missing", len(built), dat.Name, setpath,
+		len(kept), missing)
+	return missing, nil
+}
+
+// protectedError tells that the set folder setpath of the protected dat was
+// left alone.
+func protectedError(dat *types.Dat, setpath string) error {
+	return fmt.Errorf("dat %s is protected, its set folder %s is left alone", dat.Name, setpath)
+}
+
+// isInDir reports whether fpath is below one of the directories set in dirs.
+func isInDir(fpath string, dirs map[string]bool) bool {
+	for dir := filepath.Dir(fpath); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if dirs[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// retireSetFile moves fpath, which was at orig in the set folder, into the
+// backup dir or the trash of opts, or removes it if neither is set. fpath is
+// below root, either the set folder or where files of it were put aside.
+// Directories left empty are removed.
+func retireSetFile(fpath, root, orig string, opts *RebuildOptions) error {
+	exists, err := PathExists(fpath)
+	if err != nil || !exists {
+		// zips with several members come up more than once
+		return err
+	}
+
+	switch {
+	case opts.BackupDir != "":
+		_, err = relocateFile(fpath, root, opts.BackupDir, false)
+	case opts.Trash != nil:
+		err = opts.Trash.RemoveFrom(fpath, orig)
+	default:
+		err = os.Remove(fpath)
+	}
+	if err != nil {
+		return err
+	}
+
+	pruneEmptyDirs(filepath.Dir(fpath), root)
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+func TestRebuildSet(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-rebuild-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	setDir := filepath.Join(root, "set")
+	depotRoot := filepath.Join(root, "depot")
+	backupDir := filepath.Join(root, "backup")
+
+	for _, dir := range []string{setDir, depotRoot} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataA := []byte("rom a of game one")
+	dataB := []byte("rom b of game one")
+	dataC := []byte("rom c of game two")
+	dataD := []byte("rom d of game three")
+	dataE := []byte("rom e of game one, only in the depot")
+
+	dat := &types.Dat{
+		Name: "rebuild",
+		Games: types.GameSlice{
+			{Name: "one", Roms: types.RomSlice{romFor(t, "a.bin", dataA), romFor(t, "b.bin", dataB),
+				putRom(t, depotRoot, "e.bin", dataE)}},
+			{Name: "two", Roms: types.RomSlice{romFor(t, "c.bin", dataC)}},
+			{Name: "three", Roms: types.RomSlice{romFor(t, "d.bin", dataD)}},
+		},
+	}
+
+	writeZip(t, filepath.Join(setDir, "one.zip"), map[string][]byte{
+		"a.bin":         dataA,
+		"b-renamed.bin": dataB,
+	})
+	writeZip(t, filepath.Join(setDir, "three.zip"), map[string][]byte{
+		"d.bin": dataD,
+	})
+	for name, data := range map[string][]byte{"c.bin": dataC, "junk.txt": []byte("not a rom")} {
+		err = ioutil.WriteFile(filepath.Join(setDir, name), data, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	threeBefore, err := os.Stat(filepath.Join(setDir, "three.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := depot.RebuildSet(dat, setDir, &RebuildOptions{BackupDir: backupDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing != 0 {
+		t.Errorf("got %d missing roms, want none", missing)
+	}
+
+	ar, err := Audit(dat, setDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ar.Have) != 5 || len(ar.Miss) != 0 || len(ar.Unneeded) != 0 || len(ar.WronglyNamed) != 0 {
+		t.Errorf("set not rebuilt: have %d, miss %v, unneeded %v, wrongly named %v", len(ar.Have), ar.Miss,
+			ar.Unneeded, ar.WronglyNamed)
+	}
+
+	threeAfter, err := os.Stat(filepath.Join(setDir, "three.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(threeBefore, threeAfter) {
+		t.Errorf("game matching the dat was rebuilt")
+	}
+
+	for _, name := range []string{"c.bin", "junk.txt", "one.zip"} {
+		if exists, _ := PathExists(filepath.Join(backupDir, name)); !exists {
+			t.Errorf("replaced file %s not backed up", name)
+		}
+	}
+
+	fis, err := ioutil.ReadDir(setDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 3 {
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("got %v in the set folder, want the three games only", names)
+	}
+
+	zr, err := czip.OpenReader(filepath.Join(backupDir, "one.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backedUp := false
+	for _, zf := range zr.File {
+		backedUp = backedUp || zf.Name == "b-renamed.bin"
+	}
+	if !backedUp {
+		t.Errorf("replaced game not backed up as it was")
+	}
+	zr.Close()
+
+	escaping := &types.Dat{
+		Name:  "escaping",
+		Games: types.GameSlice{{Name: "../escaped", Roms: types.RomSlice{romFor(t, "c.bin", dataC)}}},
+	}
+	_, err = depot.RebuildSet(escaping, setDir, &RebuildOptions{BackupDir: backupDir})
+	if err == nil {
+		t.Errorf("rebuilt a game escaping the set folder")
+	}
+	fis, err = ioutil.ReadDir(setDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 3 {
+		t.Errorf("got %d files in the set folder after a failed rebuild, want 3", len(fis))
+	}
+}
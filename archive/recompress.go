@@ -0,0 +1,159 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type recompressMaster struct {
+	depot      *Depot
+	numWorkers int
+	pt         worker.ProgressTracker
+	codec      *codec
+}
+
+type recompressWorker struct {
+	pm *recompressMaster
+}
+
+// Recompress rewrites all depot files that aren't compressed with the named
+// codec with that codec, in place.
+func (depot *Depot) Recompress(name string, numWorkers int, pt worker.ProgressTracker) (string, error) {
+	c, err := codecByName(name)
+	if err != nil {
+		return "", err
+	}
+
+	pm := &recompressMaster{
+		depot:      depot,
+		numWorkers: numWorkers,
+		pt:         pt,
+		codec:      c,
+	}
+
+	// worker.Work makes paths absolute in place
+	roots := make([]string, len(depot.roots))
+	copy(roots, depot.roots)
+
+	res, err := worker.Work("recompress depot to "+name, roots, pm)
+	return res.Message, err
+}
+
+func (pm *recompressMaster) Accept(path string) bool {
+	return isDepotFile(path) && codecForPath(path) != pm.codec
+}
+
+func (pm *recompressMaster) NewWorker(workerIndex int) worker.Worker {
+	return &recompressWorker{
+		pm: pm,
+	}
+}
+
+func (pm *recompressMaster) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *recompressMaster) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *recompressMaster) FinishUp() error {
+	pm.depot.writeSizes()
+	return nil
+}
+
+func (pm *recompressMaster) Start() error {
+	return nil
+}
+
+func (pm *recompressMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	return nil
+}
+
+func (w *recompressWorker) Process(path string, size int64) error {
+	depot := w.pm.depot
+
+	k := depot.rootIndex(path)
+	if k == -1 {
+		return worker.Skip(skipOutsideRoots)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	extra, err := codecForPath(path).readExtra(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// verify against the SHA1 in the header, CHDs don't have one
+	var wantSha1 []byte
+	if len(extra) > 0 {
+		dh, err := parseDepotExtra(extra)
+		if err != nil {
+			return err
+		}
+		wantSha1 = dh.Sha1
+	}
+
+	r, err := openDepotFile(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	root := depot.roots[k]
+	outpath := depot.romPathIn(k, sha1HexForPath(path), w.pm.codec.suffix)
+
+	compressedSize, err := archive(w.pm.codec, outpath, filepath.Join(root, tmpDirName),
+		worker.ThrottleReader(w.pm.pt, r), extra, wantSha1)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	depot.adjustSize(k, compressedSize-size)
+	return nil
+}
+
+func (w *recompressWorker) Close() error {
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestRecompress(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-recompress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := []byte("rom to recompress")
+	hh := newHashes(false)
+	err = hh.forReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha1.Sum(data)
+	sha1Hex := hex.EncodeToString(sum[:])
+	gzPath := pathFromSha1HexEncoding(root, sha1Hex, gzipSuffix)
+
+	_, err = archive(gzipCodec, gzPath, filepath.Join(root, tmpDirName), bytes.NewReader(data),
+		hh.depotExtra(nil, int64(len(data))), sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{root}, []int64{int64(GB)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Recompress("zstd", 2, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := PathExists(gzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("gzip depot file %s still there after recompressing", gzPath)
+	}
+
+	rompath, err := depot.RomPath(sha1Hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(rompath) != zstdSuffix {
+		t.Fatalf("expected zstd depot file, got %q", rompath)
+	}
+
+	dh, err := ReadDepotHeader(rompath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dh == nil || !bytes.Equal(dh.Sha1, sum[:]) || dh.Size != int64(len(data)) {
+		t.Errorf("depot header not carried over: %+v", dh)
+	}
+}
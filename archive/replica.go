@@ -0,0 +1,174 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// uploadDirName is the directory in the first depot root that depot files
+// sent by another romba are received in. Unlike the temp directory it is kept
+// when the depot is opened, so interrupted uploads can be resumed.
+const uploadDirName = ".romba_uploads"
+
+// UploadPath returns the path the depot file name, a hex encoded SHA1 with a
+// codec suffix, is received at when another romba sends it.
+func (depot *Depot) UploadPath(name string) (string, error) {
+	if codecForPath(name) == nil || filepath.Base(name) != name {
+		return "", fmt.Errorf("%s is not a depot file name", name)
+	}
+	sha1Bytes, err := hex.DecodeString(sha1HexForPath(name))
+	if err != nil || len(sha1Bytes) != sha1.Size {
+		return "", fmt.Errorf("%s is not a depot file name", name)
+	}
+	return filepath.Join(depot.roots[0], uploadDirName, name), nil
+}
+
+// StaleUploads returns the names of the depot files being received that
+// weren't written to for maxAge, abandoned uploads most likely.
+func (depot *Depot) StaleUploads(maxAge time.Duration) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(depot.roots[0], uploadDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && time.Since(fi.ModTime()) > maxAge {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// ReceiveUpload adds the completely received depot file at inpath, as
+// returned by UploadPath, to the depot once its contents are checked against
+// its name, and indexes its rom. It reports whether the depot didn't have the
+// rom yet. The received file is gone afterwards, whether it was added or not.
+func (depot *Depot) ReceiveUpload(inpath string) (bool, error) {
+	defer os.Remove(inpath)
+
+	sha1Hex := sha1HexForPath(inpath)
+
+	rom, err := romForDepotFile(inpath, sha1Hex, true)
+	if err != nil {
+		return false, err
+	}
+	if rom == nil {
+		return false, fmt.Errorf("contents of %s don't match its name", filepath.Base(inpath))
+	}
+
+	have, err := depot.RomPath(sha1Hex)
+	if err != nil {
+		return false, err
+	}
+	if have != "" {
+		return false, nil
+	}
+
+	fi, err := os.Stat(inpath)
+	if err != nil {
+		return false, err
+	}
+
+	root, err := depot.reserveRoot(fi.Size(), 0)
+	if err != nil {
+		return false, err
+	}
+	defer depot.adjustSize(root, -fi.Size())
+
+	outpath := depot.romPathIn(root, sha1Hex, filepath.Ext(inpath))
+	n, how, err := moveDepotFile(inpath, outpath, filepath.Join(depot.roots[root], tmpDirName))
+	if err != nil {
+		return false, err
+	}
+	depot.archived(root, n)
+	logger.V(2).Infof("received %s into depot by %s", filepath.Base(inpath), how)
+
+	return true, depot.romDB.IndexRom(rom)
+}
+
+// ErrPinned tells that a rom wasn't removed because a pinned dat has it.
+var ErrPinned = errors.New("rom is kept for a pinned dat")
+
+// RemoveRom removes the depot files holding the rom with the given hex
+// encoded SHA1 from all roots and returns how many there were. Roms of pinned
+// dats are kept and ErrPinned returned.
+func (depot *Depot) RemoveRom(sha1Hex string) (int, error) {
+	sha1Bytes, err := hex.DecodeString(sha1Hex)
+	if err != nil {
+		return 0, err
+	}
+	dats, err := depot.romDB.DatsForRom(&types.Rom{Sha1: sha1Bytes})
+	if err != nil {
+		return 0, err
+	}
+	for _, dat := range dats {
+		if dat.KeepsRoms() {
+			return 0, ErrPinned
+		}
+	}
+
+	removed := 0
+	for k, root := range depot.roots {
+		for _, l := range depot.layoutsOf(k) {
+			for _, c := range codecs {
+				rompath := l.path(root, sha1Hex, c.suffix)
+				fi, err := os.Stat(rompath)
+				if err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					return removed, err
+				}
+
+				err = os.Remove(rompath)
+				if err != nil {
+					return removed, err
+				}
+				depot.adjustSize(k, -fi.Size())
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SourceReport tells what an archive run did with one source file. The run
+// report in the log directory holds one per processed source, as JSON:
+//
+//	{"run": "...", "sources": [{"path": "...", "roms": [...], "error": "..."}, ...]}
+type SourceReport struct {
+	Path string       `json:"path"`
+	Roms []*RomReport `json:"roms,omitempty"`
+	// Tracks are the tracks of a CHD source, if verified.
+	Tracks []*TrackReport `json:"tracks,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// RomReport is a rom found in a source file.
+type RomReport struct {
+	Sha1 string `json:"sha1"`
+	// New is set if the rom was put into the depot by this run, as opposed
+	// to being there already.
+	New bool `json:"new"`
+}
+
+// TrackReport is a track of the CD image in a CHD, extracted to check it
+// against the dats.
+type TrackReport struct {
+	Number int    `json:"number"`
+	Sha1   string `json:"sha1"`
+	Size   int64  `json:"size"`
+	// Dats are the names of the dats listing the track, none if the CHD
+	// doesn't match any dump known.
+	Dats []string `json:"dats,omitempty"`
+}
+
+// runReport streams the source reports of an archive run into a temp file,
+// which is renamed into place once the run is finished, so readers never see
+// a partial report.
+type runReport struct {
+	lock    *sync.Mutex
+	path    string
+	file    *os.File
+	bw      *bufio.Writer
+	sources int
+	err     error
+}
+
+func openRunReport(logDir, run string) (*runReport, error) {
+	path := filepath.Join(logDir, fmt.Sprintf("archive-report-%s.json", run))
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	rr := &runReport{
+		lock: new(sync.Mutex),
+		path: path,
+		file: file,
+		bw:   bufio.NewWriter(file),
+	}
+
+	runJSON, _ := json.Marshal(run)
+	_, rr.err = fmt.Fprintf(rr.bw, "{\"run\": %s, \"sources\": [", runJSON)
+	return rr, nil
+}
+
+func (rr *runReport) add(sr *SourceReport) {
+	bs, err := json.Marshal(sr)
+
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	if rr.err != nil {
+		return
+	}
+	if err != nil {
+		rr.err = err
+		return
+	}
+
+	sep := ",\n"
+	if rr.sources == 0 {
+		sep = "\n"
+	}
+	rr.sources++
+
+	_, rr.err = fmt.Fprintf(rr.bw, "%s%s", sep, bs)
+}
+
+// close completes the report and moves it into place.
+func (rr *runReport) close() error {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	err := rr.err
+	if err == nil {
+		_, err = rr.bw.WriteString("\n]}\n")
+	}
+	if err == nil {
+		err = rr.bw.Flush()
+	}
+	if cerr := rr.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(rr.file.Name())
+		return err
+	}
+	return os.Rename(rr.file.Name(), rr.path)
+}
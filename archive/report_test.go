@@ -0,0 +1,131 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestArchiveWritesRunReport(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-report-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{
+		"a.bin":      "same rom",
+		"b.bin":      "same rom",
+		"broken.zip": "not a zip file",
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), []byte(data), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ArchiveOptions{QuarantineDir: filepath.Join(root, "quarantine")}
+	_, err = depot.Archive([]string{srcDir}, opts, 1, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := filepath.Glob(filepath.Join(logDir, "archive-report-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("got report files %v, want one", reports)
+	}
+
+	bs, err := ioutil.ReadFile(reports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report struct {
+		Run     string
+		Sources []*SourceReport
+	}
+	err = json.Unmarshal(bs, &report)
+	if err != nil {
+		t.Fatalf("report isn't valid JSON: %v\n%s", err, bs)
+	}
+
+	if len(report.Sources) != len(files) {
+		t.Fatalf("got %d sources in report, want %d", len(report.Sources), len(files))
+	}
+
+	newRoms := 0
+	for _, sr := range report.Sources {
+		switch filepath.Base(sr.Path) {
+		case "broken.zip":
+			if sr.Error == "" {
+				t.Errorf("no error reported for %s", sr.Path)
+			}
+		default:
+			if sr.Error != "" {
+				t.Errorf("unexpected error for %s: %s", sr.Path, sr.Error)
+			}
+			if len(sr.Roms) != 1 {
+				t.Fatalf("got %d roms for %s, want 1", len(sr.Roms), sr.Path)
+			}
+			if sr.Roms[0].New {
+				newRoms++
+			}
+		}
+	}
+	if newRoms != 1 {
+		t.Errorf("got %d new roms for two copies of a rom, want 1", newRoms)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"path"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// WithSamples returns dat with the sample sets its games use added as games,
+// see types.Dat.SampleSets, so they are built, audited and fixed along with
+// them. The hashes of the sample files are looked up in the rom DB, filled in
+// from indexed dats of sample sets. It also returns the number of samples
+// whose hashes aren't known, dat itself is returned if it has no samples.
+func (depot *Depot) WithSamples(dat *types.Dat) (*types.Dat, int, error) {
+	sets := dat.SampleSets()
+	if len(sets) == 0 {
+		return dat, 0, nil
+	}
+
+	unknown := 0
+	for _, sg := range sets {
+		set := path.Base(sg.Name)
+		for _, rom := range sg.Roms {
+			err := depot.romDB.CompleteSample(set, rom)
+			if err != nil {
+				return nil, 0, err
+			}
+			if rom.Sha1 == nil {
+				logger.Warningf("dat %s: sample %s of set %s unknown, index a dat of the sample set",
+					dat.Name, rom.Name, set)
+				unknown++
+			}
+		}
+	}
+
+	nd := dat.Header()
+	nd.Games = append(append(make(types.GameSlice, 0, len(dat.Games)+len(sets)), dat.Games...), sets...)
+	return nd, unknown, nil
+}
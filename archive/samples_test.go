@@ -0,0 +1,130 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// sampleTestDB knows the sample files in samples, by set/name
+type sampleTestDB struct {
+	archiveTestDB
+	samples map[string]*types.Rom
+}
+
+func (sdb *sampleTestDB) CompleteSample(set string, rom *types.Rom) error {
+	if sr := sdb.samples[strings.ToLower(set+"/"+rom.Name)]; sr != nil {
+		rom.Sha1 = sr.Sha1
+	}
+	return nil
+}
+
+func TestWithSamples(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-samples-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	outDir := filepath.Join(root, "out")
+
+	for _, dir := range []string{depotRoot, outDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sdb := &sampleTestDB{
+		samples: map[string]*types.Rom{
+			"galaxian/shot.wav": putRom(t, depotRoot, "shot.wav", []byte("pew")),
+		},
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat := &types.Dat{
+		Name: "mame",
+		Games: types.GameSlice{
+			{Name: "galaxian", SampleOf: "galaxian",
+				Roms:    types.RomSlice{putRom(t, depotRoot, "7f.bin", []byte("code"))},
+				Samples: types.SampleSlice{{Name: "death"}, {Name: "shot"}},
+			},
+		},
+	}
+
+	sdat, unknown, err := depot.WithSamples(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown != 1 || len(sdat.Games) != 2 || len(dat.Games) != 1 {
+		t.Fatalf("got %d games with %d unknown samples, want 2 and 1", len(sdat.Games), unknown)
+	}
+
+	report, err := depot.BuildDat(sdat, outDir, &BuildOptions{Unzipped: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Have != 2 || report.Miss != 1 {
+		t.Errorf("got report %v, want 2 roms and 1 missing", report)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(outDir, "mame", types.SamplesDir, "galaxian", "shot.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "pew" {
+		t.Errorf("got sample %q", got)
+	}
+
+	ar, err := Audit(sdat, filepath.Join(outDir, "mame"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ar.Have) != 2 || len(ar.Unneeded) != 0 {
+		t.Errorf("audit has %d roms and %d unneeded files, want 2 and 0", len(ar.Have), len(ar.Unneeded))
+	}
+
+	plain, unknown, err := depot.WithSamples(&types.Dat{Name: "plain"})
+	if err != nil || unknown != 0 || plain.Name != "plain" {
+		t.Errorf("dat without samples changed")
+	}
+}
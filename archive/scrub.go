@@ -0,0 +1,368 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// quarantineDirName is the directory inside each depot root where scrub moves
+// depot files that fail verification.
+const quarantineDirName = ".romba_quarantine"
+
+// ScrubOptions controls a depot verification run.
+type ScrubOptions struct {
+	// ResumePath resumes an interrupted run, skipping all paths up to and including it.
+	ResumePath string
+	// Quarantine moves depot files that fail verification out of the depot.
+	Quarantine bool
+	// MaxBytesPerSecond limits how fast depot files are read, 0 means no limit.
+	MaxBytesPerSecond int64
+}
+
+type scrubMaster struct {
+	depot           *Depot
+	numWorkers      int
+	pt              worker.ProgressTracker
+	opts            *ScrubOptions
+	throttle        *throttle
+	soFar           chan *completed
+	observerDone    chan bool
+	resumeLogFile   *os.File
+	resumeLogWriter *bufio.Writer
+	reportMutex     *sync.Mutex
+	reportFile      *os.File
+	reportWriter    *bufio.Writer
+	numBad          int
+}
+
+type scrubWorker struct {
+	index int
+	sm    *scrubMaster
+}
+
+// Scrub walks all depot roots, decompresses every depot file and checks that
+// the SHA1 of its contents matches its name. Mismatches are written to a report
+// in logDir and, if requested, moved to a quarantine directory in their root.
+func (depot *Depot) Scrub(opts *ScrubOptions, numWorkers int, logDir string, pt worker.ProgressTracker) (string, error) {
+	ts := time.Now().Format("2006-01-02-15_04_05")
+
+	resumeLogFile, err := os.Create(filepath.Join(logDir, fmt.Sprintf("scrub-resume-%s.log", ts)))
+	if err != nil {
+		return "", err
+	}
+
+	reportPath := filepath.Join(logDir, fmt.Sprintf("scrub-report-%s.log", ts))
+	reportFile, err := os.Create(reportPath)
+	if err != nil {
+		resumeLogFile.Close()
+		return "", err
+	}
+
+	sm := new(scrubMaster)
+	sm.depot = depot
+	sm.pt = pt
+	sm.numWorkers = numWorkers
+	sm.opts = opts
+	sm.soFar = make(chan *completed)
+	sm.observerDone = make(chan bool)
+	sm.resumeLogFile = resumeLogFile
+	sm.resumeLogWriter = bufio.NewWriter(resumeLogFile)
+	sm.reportMutex = new(sync.Mutex)
+	sm.reportFile = reportFile
+	sm.reportWriter = bufio.NewWriter(reportFile)
+
+	if opts.MaxBytesPerSecond > 0 {
+		sm.throttle = &throttle{
+			rate:  opts.MaxBytesPerSecond,
+			start: time.Now(),
+		}
+	}
+
+	go sm.loopObserver()
+
+	// worker.Work makes paths absolute in place
+	roots := make([]string, len(depot.roots))
+	copy(roots, depot.roots)
+
+	res, err := worker.Work("scrub depot", roots, sm)
+	endMsg := res.Message
+
+	if sm.numBad > 0 {
+		endMsg += fmt.Sprintf("found %d bad depot files, see %s\n", sm.numBad, reportPath)
+	}
+	return endMsg, err
+}
+
+// isDepotFile reports whether path is a rom stored in the depot as opposed to
+// a partial write, a quarantined file or depot bookkeeping.
+func isDepotFile(path string) bool {
+	if codecForPath(path) == nil {
+		return false
+	}
+
+	return !isDepotBookkeeping(path)
+}
+
+func (sm *scrubMaster) Accept(path string) bool {
+	if !isDepotFile(path) {
+		return false
+	}
+
+	if sm.opts.ResumePath != "" {
+		return path > sm.opts.ResumePath
+	}
+	return true
+}
+
+func (sm *scrubMaster) NewWorker(workerIndex int) worker.Worker {
+	return &scrubWorker{
+		index: workerIndex,
+		sm:    sm,
+	}
+}
+
+func (sm *scrubMaster) NumWorkers() int {
+	return sm.numWorkers
+}
+
+func (sm *scrubMaster) ProgressTracker() worker.ProgressTracker {
+	return sm.pt
+}
+
+func (sm *scrubMaster) FinishUp() error {
+	close(sm.soFar)
+	<-sm.observerDone
+
+	sm.resumeLogWriter.Flush()
+	err := sm.resumeLogFile.Close()
+
+	sm.reportWriter.Flush()
+	if rerr := sm.reportFile.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (sm *scrubMaster) Start() error {
+	return nil
+}
+
+func (sm *scrubMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	return nil
+}
+
+func (sm *scrubMaster) loopObserver() {
+	ticker := time.NewTicker(time.Minute * 1)
+	defer ticker.Stop()
+
+	comps := make([]string, sm.numWorkers)
+	sorted := make([]string, sm.numWorkers)
+
+	for {
+		select {
+		case comp, ok := <-sm.soFar:
+			if !ok {
+				close(sm.observerDone)
+				return
+			}
+			comps[comp.workerIndex] = comp.path
+		case <-ticker.C:
+			copy(sorted, comps)
+			sort.Strings(sorted)
+			if sorted[0] != "" {
+				fmt.Fprintf(sm.resumeLogWriter, "%s\n", sorted[0])
+				sm.resumeLogWriter.Flush()
+			}
+		}
+	}
+}
+
+func (sm *scrubMaster) reportBad(path, problem string) error {
+	sm.reportMutex.Lock()
+	defer sm.reportMutex.Unlock()
+
+	logger.Errorf("scrub: %s: %s", path, problem)
+
+	sm.numBad++
+	fmt.Fprintf(sm.reportWriter, "%s: %s\n", path, problem)
+
+	if !sm.opts.Quarantine {
+		return nil
+	}
+
+	k := sm.depot.rootIndex(path)
+	if k == -1 {
+		return fmt.Errorf("depot file %s is in none of the depot roots", path)
+	}
+
+	qdir := filepath.Join(sm.depot.roots[k], quarantineDirName)
+	err := os.MkdirAll(qdir, 0777)
+	if err != nil {
+		return err
+	}
+
+	qpath := filepath.Join(qdir, filepath.Base(path))
+	fmt.Fprintf(sm.reportWriter, "%s: moved to %s\n", path, qpath)
+	return os.Rename(path, qpath)
+}
+
+func (w *scrubWorker) Process(path string, size int64) error {
+	problem, err := w.verify(path)
+	if err != nil {
+		return err
+	}
+
+	if problem != "" {
+		err = w.sm.reportBad(path, problem)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.sm.soFar <- &completed{
+		path:        path,
+		workerIndex: w.index,
+	}
+	return nil
+}
+
+func (w *scrubWorker) Close() error {
+	return nil
+}
+
+// verify checks the depot file at path. It returns a description of what is
+// wrong with the file or the empty string if it is fine. Errors are only
+// returned for failures unrelated to the contents of the file.
+func (w *scrubWorker) verify(path string) (string, error) {
+	sha1Hex := sha1HexForPath(path)
+	expected, err := hex.DecodeString(sha1Hex)
+	if err != nil || len(expected) != sha1.Size {
+		return "file name is not a SHA1", nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if w.sm.throttle != nil {
+		r = &throttledReader{r: r, t: w.sm.throttle}
+	}
+	r = worker.ThrottleReader(w.sm.pt, r)
+
+	c := codecForPath(path)
+	zr, err := c.newReader(r)
+	if err != nil {
+		return fmt.Sprintf("not a %s file: %v", c.name, err), nil
+	}
+	defer zr.Close()
+
+	br := bufio.NewReader(zr)
+
+	// CHDs are stored under their internal SHA1, not the SHA1 of their contents
+	var chd *CHDInfo
+	if peeked, _ := br.Peek(maxCHDHeaderLen); len(peeked) > 0 {
+		chd, _ = ReadCHDInfo(bytes.NewReader(peeked))
+	}
+
+	h := sha1.New()
+	n, err := io.Copy(h, br)
+	if err != nil {
+		return fmt.Sprintf("decompression failed: %v", err), nil
+	}
+
+	if chd != nil && chd.Sha1 != nil {
+		if !bytes.Equal(chd.Sha1, expected) {
+			return fmt.Sprintf("CHD with internal SHA1 %s", hex.EncodeToString(chd.Sha1)), nil
+		}
+		return "", nil
+	}
+
+	actual := h.Sum(nil)
+	if !bytes.Equal(actual, expected) {
+		return fmt.Sprintf("contents have SHA1 %s", hex.EncodeToString(actual)), nil
+	}
+
+	dh, err := ReadDepotHeader(path)
+	if err != nil {
+		return fmt.Sprintf("unreadable depot header: %v", err), nil
+	}
+
+	if dh != nil && dh.Size >= 0 && dh.Size != n {
+		return fmt.Sprintf("depot header size %d but contents have %d bytes", dh.Size, n), nil
+	}
+	return "", nil
+}
+
+// throttle limits the combined read rate of all the readers sharing it.
+type throttle struct {
+	lock  sync.Mutex
+	rate  int64
+	start time.Time
+	total int64
+}
+
+func (t *throttle) wait(n int) {
+	t.lock.Lock()
+	t.total += int64(n)
+	due := t.start.Add(time.Duration(float64(t.total) / float64(t.rate) * float64(time.Second)))
+	t.lock.Unlock()
+
+	if d := due.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.t.wait(n)
+	return n, err
+}
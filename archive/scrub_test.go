@@ -0,0 +1,108 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestScrubQuarantinesMismatches(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-scrub-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+	err = os.MkdirAll(logDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := []byte("good rom")
+	goodSum := sha1.Sum(good)
+	goodPath := pathFromSha1HexEncoding(depotRoot, hex.EncodeToString(goodSum[:]), gzipSuffix)
+	_, err = archive(gzipCodec, goodPath, filepath.Join(depotRoot, tmpDirName), bytes.NewReader(good), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a depot file whose contents don't match its name
+	badSum := sha1.Sum([]byte("what it should have been"))
+	badPath := pathFromSha1HexEncoding(depotRoot, hex.EncodeToString(badSum[:]), gzipSuffix)
+	_, err = archive(gzipCodec, badPath, filepath.Join(depotRoot, tmpDirName), bytes.NewReader([]byte("rotten")), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Scrub(&ScrubOptions{Quarantine: true}, 2, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := PathExists(goodPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("good depot file %s was removed", goodPath)
+	}
+
+	exists, err = PathExists(badPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("bad depot file %s was not quarantined", badPath)
+	}
+
+	exists, err = PathExists(filepath.Join(depotRoot, quarantineDirName, filepath.Base(badPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("bad depot file %s missing from quarantine", badPath)
+	}
+}
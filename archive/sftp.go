@@ -0,0 +1,187 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/sftp"
+)
+
+// sftpPrefix starts the paths of files on SFTP servers, as in
+// sftp://user@seedbox:2222/home/user/dumps. Paths on the server are absolute.
+const sftpPrefix = "sftp://"
+
+// dialSFTP connects to SFTP servers, replaced in tests.
+var dialSFTP = sftp.Dial
+
+// isRemote reports whether path is on an SFTP server, or is the URL of a
+// file on an HTTP server.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, sftpPrefix) || isHTTP(path)
+}
+
+// splitRemote splits the path of a file on an SFTP server into the address of
+// the server and the path on it.
+func splitRemote(path string) (string, string, error) {
+	rest := strings.TrimPrefix(path, sftpPrefix)
+	i := strings.Index(rest, "/")
+	if i <= 0 {
+		return "", "", fmt.Errorf("%s lacks a server or a path on it", path)
+	}
+	return rest[:i], rest[i:], nil
+}
+
+// remote returns the client of the SFTP server at addr, connecting to it
+// unless there is a connection to it already.
+func (ss *sources) remote(addr string) (*sftp.Client, error) {
+	ss.remoteLock.Lock()
+	defer ss.remoteLock.Unlock()
+
+	c := ss.remotes[addr]
+	if c != nil && c.Err() == nil {
+		return c, nil
+	}
+
+	logger.Infof("connecting to SFTP server %s", addr)
+	c, err := dialSFTP(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ss.remotes == nil {
+		ss.remotes = make(map[string]*sftp.Client)
+	}
+	ss.remotes[addr] = c
+	return c, nil
+}
+
+// openPath opens the local or remote file path.
+func (ss *sources) openPath(path string) (sourceFileReader, error) {
+	if !isRemote(path) {
+		return os.Open(path)
+	}
+	if isHTTP(path) {
+		return openHTTP(ss.http, path)
+	}
+
+	addr, rpath, err := splitRemote(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ss.remote(addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.Open(rpath)
+}
+
+// stat describes the local or remote file path.
+func (ss *sources) stat(path string) (os.FileInfo, error) {
+	if !isRemote(path) {
+		return os.Stat(path)
+	}
+	if isHTTP(path) {
+		return statHTTP(ss.http, path)
+	}
+
+	addr, rpath, err := splitRemote(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ss.remote(addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.Stat(rpath)
+}
+
+// walk walks the local or remote tree below root, like filepath.Walk. Local
+// paths are made absolute first.
+func (ss *sources) walk(root string, walkFn filepath.WalkFunc) error {
+	if !isRemote(root) {
+		absroot, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		return filepath.Walk(absroot, walkFn)
+	}
+	if isHTTP(root) {
+		return walkHTTP(ss.http, root, walkFn)
+	}
+
+	addr, rpath, err := splitRemote(root)
+	if err != nil {
+		return err
+	}
+	c, err := ss.remote(addr)
+	if err != nil {
+		return err
+	}
+
+	prefix := sftpPrefix + addr
+	return c.Walk(rpath, func(path string, fi os.FileInfo, err error) error {
+		return walkFn(prefix+path, fi, err)
+	})
+}
+
+// close disconnects from the SFTP servers.
+func (ss *sources) close() {
+	ss.remoteLock.Lock()
+	defer ss.remoteLock.Unlock()
+
+	for addr, c := range ss.remotes {
+		c.Close()
+		delete(ss.remotes, addr)
+	}
+}
+
+// Walk walks the directories to archive, which may be on SFTP servers, or
+// files at HTTP URLs.
+func (pm *archiveMaster) Walk(root string, walkFn filepath.WalkFunc) error {
+	return pm.sources.walk(root, walkFn)
+}
+
+// archiveRemote archives a file on an SFTP or HTTP server, streaming it
+// without a local copy. Zip, rar and tar files are unpacked, all other files are
+// archived as they are.
+func (w *archiveWorker) archiveRemote(inpath string, root int, size int64) error {
+	switch {
+	case isTar(inpath):
+		return w.archiveTar(inpath, root, size, w.pm.opts.IncludeZips)
+	case filepath.Ext(inpath) == zipSuffix:
+		return w.archiveZip(inpath, root, size, w.pm.opts.IncludeZips)
+	case filepath.Ext(inpath) == rarSuffix:
+		return w.archiveRar(inpath, root, size, w.pm.opts.IncludeZips)
+	}
+	return w.archive(w.pm.sources.opener(inpath), root, filepath.Base(inpath), inpath, size)
+}
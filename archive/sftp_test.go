@@ -0,0 +1,151 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/uwedeportivo/romba/sftp"
+	"github.com/uwedeportivo/romba/sftp/sftptest"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestArchiveFromSFTP(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-sftp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	serverRoot := filepath.Join(root, "server")
+	srcDir := filepath.Join(serverRoot, "home", "dumps")
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	for _, dir := range []string{srcDir, depotRoot, logDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var contents [][]byte
+
+	big := bytes.Repeat([]byte("a rom larger than a single read "), 10000)
+	contents = append(contents, big)
+	err = ioutil.WriteFile(filepath.Join(srcDir, "big.bin"), big, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := make(map[string][]byte)
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("zipped rom %d", i))
+		contents = append(contents, data)
+		members[fmt.Sprintf("rom%d.bin", i)] = data
+	}
+	writeZip(t, filepath.Join(srcDir, "set.zip"), members)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("tarred rom %d", i))
+		contents = append(contents, data)
+		err = tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("rom%d.bin", i), Mode: 0666, Size: int64(len(data))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(srcDir, "set.tar"), buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := sftptest.NewServer(serverRoot)
+	var dials int32
+	defer func(dial func(string) (*sftp.Client, error)) { dialSFTP = dial }(dialSFTP)
+	dialSFTP = func(addr string) (*sftp.Client, error) {
+		if addr != "user@seedbox:2222" {
+			return nil, fmt.Errorf("dialed %s", addr)
+		}
+		atomic.AddInt32(&dials, 1)
+		return sftp.NewClient(server.Conn())
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := "sftp://user@seedbox:2222/home/dumps"
+
+	_, err = depot.Archive([]string{src}, &ArchiveOptions{DeleteSources: true}, 2, logDir, worker.NewProgressTracker())
+	if err == nil {
+		t.Errorf("deleting files on an SFTP server didn't fail")
+	}
+
+	_, err = depot.Archive([]string{src}, &ArchiveOptions{}, 2, logDir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range contents {
+		sum := sha1.Sum(data)
+		rompath, err := depot.RomPath(hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rompath == "" {
+			t.Errorf("rom of %d bytes starting with %q missing from depot", len(data), data[:10])
+		}
+	}
+
+	if dials != 1 {
+		t.Errorf("connected %d times to the SFTP server", dials)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/uwedeportivo/romba/sftp"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// SourceOptions tune how the files to archive are read, for sources on
+// network shares (SMB, NFS), which are slow to seek, easily saturated and
+// prone to transient I/O errors. Zero values mean the defaults.
+type SourceOptions struct {
+	// ReadBufferSize is the size in bytes of the reads issued for files
+	// read in order.
+	ReadBufferSize int
+	// MaxBytesPerSecond limits the combined read rate from source files.
+	MaxBytesPerSecond int64
+	// MaxReadsPerSecond limits the combined number of reads issued to
+	// source files.
+	MaxReadsPerSecond int64
+	// Retries is how many times a read failing with an I/O error is retried,
+	// after reopening the file.
+	Retries int
+	// HTTPAllowedNets are the loopback, private and link-local networks
+	// HTTP and HTTPS sources may be downloaded from. Others are refused.
+	HTTPAllowedNets []*net.IPNet
+}
+
+// retryDelay is the wait before the first retry of a failed read, doubled for
+// each further one.
+var retryDelay = time.Second
+
+// sourceFileReader is what source files are read through, an *os.File, an
+// *sftp.File or an *httpFile.
+type sourceFileReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// sources opens the files to archive according to the SourceOptions of a run.
+type sources struct {
+	opts  *SourceOptions
+	bytes *throttle
+	reads *throttle
+	// pt throttles reads to the limits of the job, see worker.WithLimits
+	pt   worker.ProgressTracker
+	open func(path string) (sourceFileReader, error)
+	http *http.Client
+
+	remoteLock sync.Mutex
+	remotes    map[string]*sftp.Client
+}
+
+func newSources(opts *SourceOptions, pt worker.ProgressTracker) *sources {
+	ss := &sources{opts: opts, pt: pt}
+	ss.open = ss.openPath
+	ss.http = newHTTPClient(opts.HTTPAllowedNets)
+
+	now := time.Now()
+	if opts.MaxBytesPerSecond > 0 {
+		ss.bytes = &throttle{rate: opts.MaxBytesPerSecond, start: now}
+	}
+	if opts.MaxReadsPerSecond > 0 {
+		ss.reads = &throttle{rate: opts.MaxReadsPerSecond, start: now}
+	}
+	return ss
+}
+
+// openFile opens path for random access, see sourceFile.
+func (ss *sources) openFile(path string) (*sourceFile, error) {
+	r, err := ss.open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceFile{ss: ss, path: path, r: r}, nil
+}
+
+// opener returns a readerOpener reading path in order, through a buffer of
+// the configured size.
+func (ss *sources) opener(path string) readerOpener {
+	return func() (io.ReadCloser, error) {
+		sf, err := ss.openFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var br *bufio.Reader
+		if ss.opts.ReadBufferSize > 0 {
+			br = bufio.NewReaderSize(sf, ss.opts.ReadBufferSize)
+		} else {
+			br = bufio.NewReader(sf)
+		}
+		return &bufferedSource{Reader: br, sf: sf}, nil
+	}
+}
+
+type bufferedSource struct {
+	*bufio.Reader
+	sf *sourceFile
+}
+
+func (bs *bufferedSource) Close() error {
+	return bs.sf.Close()
+}
+
+// sourceFile is a source file whose reads are throttled and, if they fail
+// with an I/O error, retried after reopening the file. ReadAt is safe for
+// concurrent use, as needed by zip files whose members are compressed in
+// parallel, Read is not.
+type sourceFile struct {
+	ss   *sources
+	path string
+	off  int64
+
+	lock sync.Mutex
+	r    sourceFileReader
+	// readers replaced by reopening, still possibly in use by other reads
+	stale []sourceFileReader
+}
+
+func (sf *sourceFile) Read(p []byte) (int, error) {
+	n, err := sf.ReadAt(p, sf.off)
+	sf.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (sf *sourceFile) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	delay := retryDelay
+
+	for attempt := 0; ; attempt++ {
+		if sf.ss.reads != nil {
+			sf.ss.reads.wait(1)
+		}
+
+		sf.lock.Lock()
+		r := sf.r
+		sf.lock.Unlock()
+
+		n, err := r.ReadAt(p[read:], off+int64(read))
+		read += n
+		if sf.ss.bytes != nil {
+			sf.ss.bytes.wait(n)
+		}
+		worker.ThrottleWait(sf.ss.pt, n)
+
+		if err == nil || !isIOError(err) || attempt >= sf.ss.opts.Retries {
+			return read, err
+		}
+
+		logger.Warningf("retrying read of %s at offset %d in %v: %v", sf.path, off+int64(read), delay, err)
+		time.Sleep(delay)
+		delay *= 2
+
+		err = sf.reopen(r)
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+// reopen replaces the reader failed unless a concurrent read did so already.
+func (sf *sourceFile) reopen(failed sourceFileReader) error {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+
+	if sf.r != failed {
+		return nil
+	}
+
+	r, err := sf.ss.open(sf.path)
+	if err != nil {
+		return err
+	}
+	sf.stale = append(sf.stale, sf.r)
+	sf.r = r
+	return nil
+}
+
+func (sf *sourceFile) Close() error {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+
+	for _, r := range sf.stale {
+		r.Close()
+	}
+	sf.stale = nil
+	return sf.r.Close()
+}
+
+// isIOError reports whether err is a low level I/O error, as returned for
+// transient failures of network file systems, a lost SFTP connection or a
+// failed download.
+func isIOError(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	if _, ok := err.(*httpError); ok {
+		return true
+	}
+	return err == syscall.EIO || err == sftp.ErrConnClosed
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyFile fails the first read at or past failAt with EIO.
+type flakyFile struct {
+	nopCloseReader
+	failAt int64
+	failed *bool
+}
+
+func (ff *flakyFile) ReadAt(p []byte, off int64) (int, error) {
+	if !*ff.failed && off+int64(len(p)) > ff.failAt {
+		*ff.failed = true
+		n, _ := ff.Reader.ReadAt(p[:ff.failAt-off], off)
+		return n, &os.PathError{Op: "read", Path: "flaky", Err: syscall.EIO}
+	}
+	return ff.Reader.ReadAt(p, off)
+}
+
+type nopCloseReader struct {
+	*bytes.Reader
+}
+
+func (nopCloseReader) Close() error {
+	return nil
+}
+
+func TestSourceRetriesIOErrors(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	data := bytes.Repeat([]byte("network share "), 1000)
+
+	for _, retries := range []int{0, 1} {
+		failed := false
+		opens := 0
+
+		ss := newSources(&SourceOptions{ReadBufferSize: 512, Retries: retries}, nil)
+		ss.open = func(path string) (sourceFileReader, error) {
+			opens++
+			return &flakyFile{nopCloseReader: nopCloseReader{bytes.NewReader(data)}, failAt: 3000, failed: &failed}, nil
+		}
+
+		r, err := ss.opener("flaky")()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+
+		if retries == 0 {
+			if err == nil {
+				t.Errorf("read error not returned without retries")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("read failed despite retry: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("got %d bytes after retry, want %d", len(got), len(data))
+		}
+		if opens != 2 {
+			t.Errorf("got %d opens, want the file reopened once", opens)
+		}
+	}
+}
+
+func TestSourceThrottlesReads(t *testing.T) {
+	data := make([]byte, 4096)
+
+	ss := newSources(&SourceOptions{ReadBufferSize: 1024, MaxReadsPerSecond: 40}, nil)
+	ss.open = func(path string) (sourceFileReader, error) {
+		return nopCloseReader{bytes.NewReader(data)}, nil
+	}
+
+	r, err := ss.opener("slow")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	start := time.Now()
+	buf := make([]byte, 100)
+	for err == nil {
+		_, err = r.Read(buf)
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+
+	// the buffer is filled with 4 reads, and a 5th one hits EOF, at 40 per second
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("reads took %v, not throttled", d)
+	}
+}
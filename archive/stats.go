@@ -0,0 +1,146 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// RootStats are the numbers of one root of the depot.
+type RootStats struct {
+	Root  string `json:"root"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// DepotStats are the numbers of the whole depot, see Depot.Stats.
+type DepotStats struct {
+	Roots []*RootStats `json:"roots"`
+	Files int64        `json:"files"`
+	Bytes int64        `json:"bytes"`
+	// Sources is the number of distinct source files the roms of the depot
+	// were archived from, by their provenance records.
+	Sources int64 `json:"sources"`
+	// DuplicateRoms is the number of roms archived from more than one
+	// source file, and DuplicateSources the number of source files beyond
+	// the first of those roms.
+	DuplicateRoms    int64 `json:"duplicateRoms"`
+	DuplicateSources int64 `json:"duplicateSources"`
+}
+
+// Stats counts the files and bytes in each root of the depot, and the roms
+// archived from more than one source file. Each file counted is added to pt.
+func (depot *Depot) Stats(pt worker.ProgressTracker) (*DepotStats, error) {
+	ds := new(DepotStats)
+
+	var total int64
+	for _, usage := range depot.Usage() {
+		total += usage.Size
+	}
+	pt.SetTotalBytes(total)
+
+	for _, root := range depot.roots {
+		rst := &RootStats{Root: root}
+
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !isDepotFile(path) {
+				return nil
+			}
+			rst.Files++
+			rst.Bytes += info.Size()
+			pt.AddBytesFromFile(info.Size())
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ds.Roots = append(ds.Roots, rst)
+		ds.Files += rst.Files
+		ds.Bytes += rst.Bytes
+	}
+
+	err := depot.countSources(ds)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// countSources fills in the source counts of ds from the provenance records.
+// Records of the same rom and source file, from archiving it again, count
+// once.
+func (depot *Depot) countSources(ds *DepotStats) error {
+	seen := make(map[uint64]struct{})
+	perRom := make(map[[20]byte]int32)
+
+	return depot.scanProvenanceLines(func(line string) error {
+		fields := strings.SplitN(line, "\t", 6)
+		if len(fields) != 6 {
+			return nil
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(fields[0]))
+		h.Write([]byte(fields[5]))
+		key := h.Sum64()
+		if _, ok := seen[key]; ok {
+			return nil
+		}
+		seen[key] = struct{}{}
+
+		var sha1 [20]byte
+		if n, err := hex.Decode(sha1[:], []byte(fields[0])); err != nil || n != len(sha1) {
+			return nil
+		}
+
+		ds.Sources++
+		perRom[sha1]++
+		switch perRom[sha1] {
+		case 1:
+		case 2:
+			ds.DuplicateRoms++
+			ds.DuplicateSources++
+		default:
+			ds.DuplicateSources++
+		}
+		return nil
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestDepotStats(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-stats-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	logDir := filepath.Join(root, "log")
+
+	srcs := map[string]string{
+		"src1/rom.bin":   "rom with two sources",
+		"src2/rom.bin":   "rom with two sources",
+		"src1/other.bin": "rom with one source",
+	}
+	for _, dir := range []string{"src1", "src2", "depot", "log"} {
+		err = os.MkdirAll(filepath.Join(root, dir), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range srcs {
+		err = ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotRoot}, []int64{int64(GB)}, &archiveTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// archiving src1 again adds no sources
+	for _, dir := range []string{"src1", "src2", "src1"} {
+		_, err = depot.Archive([]string{filepath.Join(root, dir)}, &ArchiveOptions{}, 1, logDir, worker.NewProgressTracker())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pt := worker.NewProgressTracker()
+	ds, err := depot.Stats(pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ds.Roots) != 1 || ds.Roots[0].Root != depotRoot || ds.Roots[0].Files != 2 || ds.Files != 2 {
+		t.Errorf("got roots %+v and %d files, want 2 files in %s", ds.Roots[0], ds.Files, depotRoot)
+	}
+	if ds.Bytes <= 0 || ds.Roots[0].Bytes != ds.Bytes {
+		t.Errorf("got %d bytes, %d in the root", ds.Bytes, ds.Roots[0].Bytes)
+	}
+	if ds.Sources != 3 || ds.DuplicateRoms != 1 || ds.DuplicateSources != 1 {
+		t.Errorf("got %d sources, %d duplicate roms and %d duplicate sources, want 3, 1 and 1",
+			ds.Sources, ds.DuplicateRoms, ds.DuplicateSources)
+	}
+	if p := pt.GetProgress(); p.FilesSoFar != 2 || p.BytesSoFar != ds.Bytes {
+		t.Errorf("got progress %+v", p)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/tar"
+	"compress/bzip2"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+
+	"github.com/uwedeportivo/torrentzip/cgzip"
+)
+
+type tarDecompressor func(r io.Reader) (io.Reader, error)
+
+var tarSuffixes = []struct {
+	suffix       string
+	decompressor tarDecompressor
+}{
+	{".tar", nil},
+	{".tar.gz", gzipTarDecompressor},
+	{".tgz", gzipTarDecompressor},
+	{".tar.bz2", bzip2TarDecompressor},
+	{".tbz2", bzip2TarDecompressor},
+	{".tbz", bzip2TarDecompressor},
+	{".tar.xz", xzTarDecompressor},
+	{".txz", xzTarDecompressor},
+}
+
+func gzipTarDecompressor(r io.Reader) (io.Reader, error) {
+	return cgzip.NewReader(r)
+}
+
+func bzip2TarDecompressor(r io.Reader) (io.Reader, error) {
+	return bzip2.NewReader(r), nil
+}
+
+func xzTarDecompressor(r io.Reader) (io.Reader, error) {
+	return xz.NewReader(r)
+}
+
+// isTar reports whether path names a tar file, possibly compressed.
+func isTar(inpath string) bool {
+	_, ok := tarDecompressorFor(inpath)
+	return ok
+}
+
+func tarDecompressorFor(inpath string) (tarDecompressor, bool) {
+	lpath := strings.ToLower(inpath)
+	for _, ts := range tarSuffixes {
+		if strings.HasSuffix(lpath, ts.suffix) {
+			return ts.decompressor, true
+		}
+	}
+	return nil, false
+}
+
+func (w *archiveWorker) archiveTar(inpath string, root int, size int64, addTarItself bool) error {
+	file, err := w.pm.sources.opener(inpath)()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+
+	decompressor, _ := tarDecompressorFor(inpath)
+	if decompressor != nil {
+		r, err = decompressor(file)
+		if err != nil {
+			return err
+		}
+		if rc, ok := r.(io.Closer); ok {
+			defer rc.Close()
+		}
+	}
+
+	tr := tar.NewReader(r)
+
+	limits := &w.pm.opts.Limits
+	members := 0
+	var total int64
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		members++
+		err = limits.checkMembers(inpath, members)
+		if err != nil {
+			return err
+		}
+
+		memberPath := filepath.Join(inpath, filepath.FromSlash(hdr.Name))
+		err = limits.checkMember(memberPath, hdr.Size, -1)
+		if err != nil {
+			return err
+		}
+
+		// members of compressed tars can only be checked all together
+		total += hdr.Size
+		if decompressor != nil {
+			err = limits.checkRatio(inpath, total, size)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = w.archiveSpooled(tr, root, path.Base(hdr.Name), memberPath, hdr.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	if addTarItself {
+		return w.archive(w.pm.sources.opener(inpath), root, filepath.Base(inpath), inpath, size)
+	}
+	return nil
+}
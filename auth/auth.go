@@ -0,0 +1,243 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package auth checks the bearer tokens of requests to the romba daemon and
+// the roles of the users they belong to, so a shared server can answer
+// lookups for everyone while only some may change its ROM archive.
+//
+// Tokens are sent in the Authorization header as "Bearer <token>". Browsers
+// can't set headers on websockets, so the progress websocket at /progress
+// also takes the token parameter of its URL, no other path does. Clients of a daemon checking client
+// certificates may instead present a certificate with the name of a user as
+// common name.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is what a user may do, each role may do what the ones before it may.
+type Role int
+
+const (
+	// ReadOnly users may look up ROMs and watch jobs.
+	ReadOnly Role = iota + 1
+	// Operator users may also run jobs adding to the ROM archive or
+	// reading from it.
+	Operator
+	// Admin users may also run jobs removing or rewriting files of the ROM
+	// archive, mount it and shut the daemon down.
+	Admin
+)
+
+var roleNames = map[Role]string{
+	ReadOnly: "readonly",
+	Operator: "operator",
+	Admin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole returns the role named s.
+func ParseRole(s string) (Role, error) {
+	for r, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q", s)
+}
+
+// MinTokenLength is the length tokens need at least, so they can't be
+// guessed.
+const MinTokenLength = 16
+
+// User is who a token belongs to.
+type User struct {
+	Name string
+	Role Role
+}
+
+// Anonymous is the user of requests to a daemon without tokens, which may
+// do anything.
+var Anonymous = &User{Name: "anonymous", Role: Admin}
+
+// Tokens maps tokens to users. Without tokens, every request is made by
+// Anonymous.
+type Tokens struct {
+	// users are keyed by the SHA256 of their token, so looking them up
+	// takes the same time however much of a wrong token is right
+	users map[[sha256.Size]byte]*User
+	// byName are the users by name, for client certificates
+	byName map[string]*User
+}
+
+// NewTokens returns an empty set of tokens.
+func NewTokens() *Tokens {
+	return &Tokens{
+		users:  make(map[[sha256.Size]byte]*User),
+		byName: make(map[string]*User),
+	}
+}
+
+// Add gives the token to the user with the name and role.
+func (t *Tokens) Add(token, name string, role Role) error {
+	if len(token) < MinTokenLength {
+		return fmt.Errorf("token of %s is shorter than %d characters", name, MinTokenLength)
+	}
+	if _, ok := roleNames[role]; !ok {
+		return fmt.Errorf("invalid role %v of %s", role, name)
+	}
+
+	key := sha256.Sum256([]byte(token))
+	if u, ok := t.users[key]; ok {
+		return fmt.Errorf("token of %s is also the one of %s", name, u.Name)
+	}
+	if u, ok := t.byName[name]; ok && u.Role != role {
+		return fmt.Errorf("%s is both %s and %s", name, u.Role, role)
+	}
+
+	u := &User{Name: name, Role: role}
+	t.users[key] = u
+	t.byName[name] = u
+	return nil
+}
+
+// WebsocketPath is the path of the progress websocket, the only one taking
+// its token from the URL.
+const WebsocketPath = "/progress"
+
+// Enabled reports whether requests need a token.
+func (t *Tokens) Enabled() bool {
+	return t != nil && len(t.users) > 0
+}
+
+// Authenticate returns the user making r.
+func (t *Tokens) Authenticate(r *http.Request) (*User, error) {
+	if !t.Enabled() {
+		return Anonymous, nil
+	}
+
+	var token string
+	if r.URL.Path == WebsocketPath {
+		token = r.URL.Query().Get("token")
+	}
+	if h := r.Header.Get("Authorization"); h != "" {
+		const prefix = "Bearer "
+		if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+			return nil, fmt.Errorf("authorization is not a bearer token")
+		}
+		token = strings.TrimSpace(h[len(prefix):])
+	}
+	if token == "" {
+		return t.authenticateCert(r)
+	}
+
+	u, ok := t.users[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return u, nil
+}
+
+// authenticateCert returns the user named by the common name of the
+// verified client certificate of r.
+func (t *Tokens) authenticateCert(r *http.Request) (*User, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, fmt.Errorf("token missing")
+	}
+
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	u, ok := t.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("certificate of %q is not the one of a user", name)
+	}
+	return u, nil
+}
+
+type userKey struct{}
+
+// WithUser returns a copy of ctx carrying u.
+func WithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// UserFrom returns the user carried by ctx, Anonymous if none.
+func UserFrom(ctx context.Context) *User {
+	if u, ok := ctx.Value(userKey{}).(*User); ok {
+		return u
+	}
+	return Anonymous
+}
+
+// Allowed reports whether u may do what needs role.
+func (u *User) Allowed(role Role) bool {
+	return u.Role >= role
+}
+
+// Handler serves the requests of users with at least role with h, which
+// finds the user in the context of the request. Requests without a valid
+// token are answered with 401 Unauthorized, those of users without the role
+// with 403 Forbidden, both as JSON errors.
+func (t *Tokens) Handler(role Role, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := t.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="romba"`)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if !u.Allowed(role) {
+			writeError(w, http.StatusForbidden, Forbidden(u, role))
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(WithUser(r.Context(), u)))
+	})
+}
+
+// Forbidden returns the error telling that u lacks role.
+func Forbidden(u *User, role Role) error {
+	return fmt.Errorf("%s is %s, this needs %s", u.Name, u.Role, role)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	for _, r := range []Role{ReadOnly, Operator, Admin} {
+		parsed, err := ParseRole(strings.ToUpper(r.String()))
+		if err != nil || parsed != r {
+			t.Errorf("parsed %s as %v, %v", r, parsed, err)
+		}
+	}
+	if _, err := ParseRole("root"); err == nil {
+		t.Errorf("parsed role root")
+	}
+
+	u := &User{Name: "bob", Role: Operator}
+	if !u.Allowed(ReadOnly) || !u.Allowed(Operator) || u.Allowed(Admin) {
+		t.Errorf("operator allowed the wrong roles")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tokens := NewTokens()
+	if tokens.Enabled() {
+		t.Errorf("tokens without users enabled")
+	}
+	u, err := tokens.Authenticate(httptest.NewRequest("GET", "/api/jobs", nil))
+	if err != nil || u != Anonymous {
+		t.Errorf("got user %v, %v without users, want anonymous", u, err)
+	}
+
+	const aliceToken, bobToken = "0123456789abcdef01", "fedcba9876543210fe"
+	for _, err := range []error{
+		tokens.Add(aliceToken, "alice", Admin),
+		tokens.Add(bobToken, "bob", ReadOnly),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tokens.Add("short", "carol", Admin); err == nil {
+		t.Errorf("added a short token")
+	}
+	if err := tokens.Add(aliceToken, "carol", Admin); err == nil || !strings.Contains(err.Error(), "alice") {
+		t.Errorf("got error %v adding the token of alice again", err)
+	}
+	if err := tokens.Add("another-token-of-bob", "bob", Admin); err == nil {
+		t.Errorf("added bob with a second role")
+	}
+
+	for _, tc := range []struct {
+		name, user string
+	}{
+		{"alice", "alice"},
+		{"mallory", ""},
+	} {
+		r := httptest.NewRequest("GET", "/api/jobs", nil)
+		r.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: tc.name}}}},
+		}
+		u, err := tokens.Authenticate(r)
+		switch {
+		case tc.user == "" && err == nil:
+			t.Errorf("certificate of %s authenticated %s", tc.name, u.Name)
+		case tc.user != "" && (err != nil || u.Name != tc.user):
+			t.Errorf("certificate of %s got user %v, %v, want %s", tc.name, u, err, tc.user)
+		}
+	}
+
+	for _, tc := range []struct {
+		url, header string
+		user        string
+	}{
+		{"/api/jobs", "Bearer " + aliceToken, "alice"},
+		{"/api/jobs", "bearer " + bobToken, "bob"},
+		{"/progress?token=" + bobToken, "", "bob"},
+		{"/api/jobs?token=" + bobToken, "", ""},
+		{"/api/progress?token=" + bobToken, "", ""},
+		{"/api/jobs", "", ""},
+		{"/api/jobs", "Bearer " + aliceToken + "x", ""},
+		{"/api/jobs", "Basic YWxpY2U6c2VjcmV0", ""},
+	} {
+		r := httptest.NewRequest("GET", tc.url, nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		u, err := tokens.Authenticate(r)
+		switch {
+		case tc.user == "" && err == nil:
+			t.Errorf("%s with %q authenticated %s", tc.url, tc.header, u.Name)
+		case tc.user != "" && (err != nil || u.Name != tc.user):
+			t.Errorf("%s with %q got user %v, %v, want %s", tc.url, tc.header, u, err, tc.user)
+		}
+	}
+
+	h := tokens.Handler(Operator, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(UserFrom(r.Context()).Name))
+	}))
+	for _, tc := range []struct {
+		token  string
+		status int
+		body   string
+	}{
+		{aliceToken, http.StatusOK, "alice"},
+		{bobToken, http.StatusForbidden, "bob is readonly, this needs operator"},
+		{"", http.StatusUnauthorized, "token missing"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/jobs", nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status || !strings.Contains(w.Body.String(), tc.body) {
+			t.Errorf("got status %d and %q, want %d and %q", w.Code, w.Body.String(), tc.status, tc.body)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package bundle writes and reads state bundles, the state of a romba
+// instance in one tar.gz file: its configuration, the files of its DB, the
+// manifests of its depot roots and its job history. The depot itself is not
+// in a bundle, it is transferred separately. Importing a bundle on a new
+// machine, with the depot copied over, gives a working instance again, for
+// migrations and disaster recovery drills.
+//
+// The first member of a bundle is manifest.json, describing it. The others
+// are below config/, db/, logs/ and depot/<index of the root>/.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/uwedeportivo/romba/logging"
+)
+
+var logger = logging.For("bundle")
+
+// Version is the version of the bundles written, newer ones can't be
+// imported.
+const Version = 1
+
+const (
+	manifestName = "manifest.json"
+	configDir    = "config"
+	dbDir        = "db"
+	logsDir      = "logs"
+	depotDir     = "depot"
+)
+
+// Manifest describes a bundle.
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Host    string    `json:"host"`
+	// Config is the name of the configuration file, DB, LogDir and Roots
+	// are where the state was on the exporting host.
+	Config string   `json:"config"`
+	DB     string   `json:"db"`
+	LogDir string   `json:"logDir"`
+	Roots  []string `json:"roots"`
+}
+
+// Source is the state of an instance to export.
+type Source struct {
+	// Config is the configuration file.
+	Config string
+	// DB is the directory of the DB, which must not change while it is
+	// exported, see db.RomDB.Pause.
+	DB string
+	// LogDir is the log dir and Logs the files and directories in it that
+	// are exported, missing ones are skipped.
+	LogDir string
+	Logs   []string
+	// Roots are the depot roots and RootFiles the files in them that are
+	// exported, missing ones are skipped.
+	Roots     []string
+	RootFiles []string
+}
+
+// Target is where an imported bundle goes.
+type Target struct {
+	// DB is the directory of the DB, it must be empty or not exist.
+	DB     string
+	LogDir string
+	// Roots are the depot roots, by index the same as the exported ones.
+	Roots []string
+}
+
+// Report is what an import did.
+type Report struct {
+	Manifest *Manifest
+	Files    int
+	Bytes    int64
+	// Kept are the depot files not imported because the depot already has
+	// them, Skipped the ones of roots the target doesn't have.
+	Kept    []string
+	Skipped []string
+}
+
+func (r *Report) String() string {
+	s := fmt.Sprintf("imported %d files (%s) of the state bundle exported from %s on %s",
+		r.Files, humanize.IBytes(uint64(r.Bytes)), r.Manifest.Host,
+		r.Manifest.Created.Format("2006-01-02 15:04:05"))
+	if len(r.Kept) > 0 {
+		s += fmt.Sprintf(", kept %d depot files already there", len(r.Kept))
+	}
+	if len(r.Skipped) > 0 {
+		s += fmt.Sprintf(", skipped %d files of depot roots not configured", len(r.Skipped))
+	}
+	return s
+}
+
+// Export writes the state of src to a bundle at outpath.
+func Export(outpath string, src *Source) (*Manifest, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	m := &Manifest{
+		Version: Version,
+		Created: time.Now(),
+		Host:    host,
+		Config:  filepath.Base(src.Config),
+		DB:      src.DB,
+		LogDir:  src.LogDir,
+		Roots:   src.Roots,
+	}
+
+	// the config and DB may hold secrets like tokens and keys
+	tmpPath := outpath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+
+	err = export(file, m, src)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("exporting state to %s failed: %v", outpath, err)
+	}
+	return m, os.Rename(tmpPath, outpath)
+}
+
+func export(w io.Writer, m *Manifest, src *Source) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	bs, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(bs)),
+		ModTime: m.Created,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(bs)
+	if err != nil {
+		return err
+	}
+
+	err = addFile(tw, src.Config, path.Join(configDir, m.Config))
+	if err != nil {
+		return err
+	}
+
+	err = addTree(tw, src.DB, dbDir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range src.Logs {
+		err = addTree(tw, filepath.Join(src.LogDir, name), path.Join(logsDir, filepath.ToSlash(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for i, root := range src.Roots {
+		for _, name := range src.RootFiles {
+			err = addFile(tw, filepath.Join(root, name), path.Join(depotDir, strconv.Itoa(i), name))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// addTree adds the file or the files below the directory at inpath to tw,
+// named below name.
+func addTree(tw *tar.Writer, inpath, name string) error {
+	return filepath.Walk(inpath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(inpath, p)
+		if err != nil {
+			return err
+		}
+		return addFile(tw, p, path.Join(name, filepath.ToSlash(rel)))
+	})
+}
+
+func addFile(tw *tar.Writer, inpath, name string) error {
+	file, err := os.Open(inpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, file, fi.Size())
+	if err != nil {
+		return err
+	}
+	logger.V(3).Infof("bundled %s as %s", inpath, name)
+	return nil
+}
+
+// reader is a bundle being read.
+type reader struct {
+	file *os.File
+	gr   *gzip.Reader
+	tr   *tar.Reader
+	m    *Manifest
+}
+
+func open(inpath string) (*reader, error) {
+	file, err := os.Open(inpath)
+	if err != nil {
+		return nil, err
+	}
+
+	br := &reader{file: file}
+	err = br.readManifest()
+	if err != nil {
+		br.Close()
+		return nil, fmt.Errorf("reading state bundle %s failed: %v", inpath, err)
+	}
+	return br, nil
+}
+
+func (br *reader) readManifest() error {
+	var err error
+	br.gr, err = gzip.NewReader(br.file)
+	if err != nil {
+		return err
+	}
+	br.tr = tar.NewReader(br.gr)
+
+	hdr, err := br.tr.Next()
+	if err != nil {
+		return err
+	}
+	if hdr.Name != manifestName {
+		return fmt.Errorf("not a state bundle, it starts with %s", hdr.Name)
+	}
+
+	br.m = new(Manifest)
+	err = json.NewDecoder(br.tr).Decode(br.m)
+	if err != nil {
+		return err
+	}
+	if br.m.Version > Version {
+		return fmt.Errorf("bundle version %d is newer than the supported version %d", br.m.Version, Version)
+	}
+	return nil
+}
+
+func (br *reader) Close() error {
+	if br.gr != nil {
+		br.gr.Close()
+	}
+	return br.file.Close()
+}
+
+// ReadManifest returns the manifest of the bundle at inpath.
+func ReadManifest(inpath string) (*Manifest, error) {
+	br, err := open(inpath)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	return br.m, nil
+}
+
+// ExtractConfig writes the configuration file in the bundle at inpath to
+// outpath, which must not exist.
+func ExtractConfig(inpath, outpath string) error {
+	br, err := open(inpath)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+
+	name := path.Join(configDir, br.m.Config)
+	for {
+		hdr, err := br.tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("state bundle %s has no config", inpath)
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == name {
+			return extract(br.tr, hdr, outpath, false)
+		}
+	}
+}
+
+// Import reads the bundle at inpath into dst. The configuration in the
+// bundle is not imported, see ExtractConfig.
+func Import(inpath string, dst *Target) (*Report, error) {
+	err := checkEmpty(dst.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	br, err := open(inpath)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+
+	report := &Report{Manifest: br.m}
+
+	for {
+		hdr, err := br.tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading state bundle %s failed: %v", inpath, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		outpath, err := dst.pathFor(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if outpath == "" {
+			if strings.HasPrefix(hdr.Name, depotDir+"/") {
+				report.Skipped = append(report.Skipped, hdr.Name)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(hdr.Name, depotDir+"/") {
+			if _, err := os.Stat(outpath); err == nil {
+				// a depot copied over brings its own files, newer than
+				// the ones in the bundle
+				report.Kept = append(report.Kept, outpath)
+				continue
+			}
+		}
+
+		err = extract(br.tr, hdr, outpath, true)
+		if err != nil {
+			return nil, err
+		}
+		report.Files++
+		report.Bytes += hdr.Size
+	}
+	return report, nil
+}
+
+// pathFor returns where the bundle member name goes, "" if nowhere.
+func (dst *Target) pathFor(name string) (string, error) {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) < 2 {
+		return "", nil
+	}
+
+	var dir, rel string
+	switch parts[0] {
+	case dbDir:
+		dir, rel = dst.DB, strings.Join(parts[1:], "/")
+	case logsDir:
+		dir, rel = dst.LogDir, strings.Join(parts[1:], "/")
+	case depotDir:
+		i, err := strconv.Atoi(parts[1])
+		if err != nil || len(parts) < 3 {
+			return "", fmt.Errorf("bad depot member %s in state bundle", name)
+		}
+		if i >= len(dst.Roots) {
+			return "", nil
+		}
+		dir, rel = dst.Roots[i], parts[2]
+	default:
+		return "", nil
+	}
+
+	rel = path.Clean(rel)
+	if path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("bad member %s in state bundle", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(rel)), nil
+}
+
+func checkEmpty(dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(fis) > 0 {
+		return fmt.Errorf("db dir %s is not empty, remove it to import a state bundle", dir)
+	}
+	return nil
+}
+
+// extract writes the contents of the current member of tr to outpath.
+func extract(tr *tar.Reader, hdr *tar.Header, outpath string, overwrite bool) error {
+	err := os.MkdirAll(filepath.Dir(outpath), 0777)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(outpath, flags, os.FileMode(hdr.Mode).Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, tr)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	logger.V(3).Infof("imported %s as %s", hdr.Name, outpath)
+	return os.Chtimes(outpath, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package bundle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func TestExportImport(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	old := filepath.Join(root, "old")
+	writeFile(t, filepath.Join(old, "romba.toml"), "[general]\n")
+	writeFile(t, filepath.Join(old, "db", "CURRENT"), "MANIFEST-000002")
+	writeFile(t, filepath.Join(old, "db", "sub", "000003.ldb"), "table")
+	writeFile(t, filepath.Join(old, "logs", "romba-queue.json"), "[]")
+	writeFile(t, filepath.Join(old, "logs", "job-logs", "1.log"), "{}")
+	writeFile(t, filepath.Join(old, "logs", "other.log"), "not bundled")
+	writeFile(t, filepath.Join(old, "depot0", ".romba_manifest"), "manifest 0")
+	writeFile(t, filepath.Join(old, "depot1", ".romba_manifest"), "manifest 1")
+
+	src := &Source{
+		Config:    filepath.Join(old, "romba.toml"),
+		DB:        filepath.Join(old, "db"),
+		LogDir:    filepath.Join(old, "logs"),
+		Logs:      []string{"romba-queue.json", "job-logs", "missing"},
+		Roots:     []string{filepath.Join(old, "depot0"), filepath.Join(old, "depot1")},
+		RootFiles: []string{".romba_manifest", ".romba_layout"},
+	}
+
+	bpath := filepath.Join(root, "state.tar.gz")
+	m, err := Export(bpath, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Config != "romba.toml" || len(m.Roots) != 2 {
+		t.Errorf("got manifest %+v", m)
+	}
+	if fi, err := os.Stat(bpath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got bundle %v, %v, want it readable by its owner only", fi, err)
+	}
+
+	m, err = ReadManifest(bpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != Version || m.DB != src.DB {
+		t.Errorf("read manifest %+v", m)
+	}
+
+	nu := filepath.Join(root, "new")
+	err = ExtractConfig(bpath, filepath.Join(nu, "romba.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(nu, "romba.toml")); got != "[general]\n" {
+		t.Errorf("got config %q", got)
+	}
+	err = ExtractConfig(bpath, filepath.Join(nu, "romba.toml"))
+	if err == nil {
+		t.Errorf("extracting the config over an existing one succeeded")
+	}
+
+	// the first depot root was copied over with its manifest, the second
+	// root is not configured on the new machine
+	writeFile(t, filepath.Join(nu, "depot", ".romba_manifest"), "copied")
+
+	dst := &Target{
+		DB:     filepath.Join(nu, "db"),
+		LogDir: filepath.Join(nu, "logs"),
+		Roots:  []string{filepath.Join(nu, "depot")},
+	}
+	report, err := Import(bpath, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 4 || len(report.Kept) != 1 || len(report.Skipped) != 1 {
+		t.Errorf("got report %+v", report)
+	}
+
+	for path, want := range map[string]string{
+		filepath.Join(nu, "db", "CURRENT"):             "MANIFEST-000002",
+		filepath.Join(nu, "db", "sub", "000003.ldb"):   "table",
+		filepath.Join(nu, "logs", "romba-queue.json"):  "[]",
+		filepath.Join(nu, "logs", "job-logs", "1.log"): "{}",
+		filepath.Join(nu, "depot", ".romba_manifest"):  "copied",
+	} {
+		if got := readFile(t, path); got != want {
+			t.Errorf("got %q in %s, want %q", got, path, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(nu, "logs", "other.log")); !os.IsNotExist(err) {
+		t.Errorf("other.log was imported")
+	}
+
+	_, err = Import(bpath, dst)
+	if err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("importing into a non empty db dir: got %v", err)
+	}
+}
+
+func TestImportNotBundle(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	bpath := filepath.Join(root, "state.tar.gz")
+	writeFile(t, bpath, "not a bundle")
+
+	_, err = Import(bpath, &Target{DB: filepath.Join(root, "db")})
+	if err == nil {
+		t.Errorf("importing a file that is not a bundle succeeded")
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package client talks to a romba daemon over its HTTP API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/romba/service"
+)
+
+// Lost event streams are resumed up to maxRetries times in a row, retryDelay
+// apart.
+const (
+	maxRetries = 5
+	retryDelay = 2 * time.Second
+)
+
+// Client is a client of the romba daemon at one address.
+type Client struct {
+	base  string
+	hc    *http.Client
+	token string
+}
+
+// New returns a client of the daemon at addr, a host:port or a URL.
+func New(addr string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Client{
+		base: strings.TrimSuffix(addr, "/"),
+		hc:   http.DefaultClient,
+	}
+}
+
+// SetHTTPClient makes the client send its requests with hc, for daemons
+// serving HTTPS with their own CA or asking for client certificates.
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	c.hc = hc
+}
+
+// SetToken makes the client send token with its requests, for daemons with
+// users.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// newRequest returns a request to the daemon, with the token if set.
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// BusyError is returned for commands refused because of the running job.
+type BusyError struct {
+	// Job is the running job, nil if it ended in the meantime.
+	Job     *service.Job
+	Message string
+}
+
+func (e *BusyError) Error() string {
+	if e.Job != nil {
+		return fmt.Sprintf("busy with job %s (%s)", e.Job.ID, e.Job.Name)
+	}
+	return "busy with another job"
+}
+
+// apiError is how the daemon reports failed requests.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// do sends a request with the JSON of in as body, if not nil, and decodes
+// the reply into out, if not nil. Replies with a status other than the
+// wanted ones are returned as errors.
+func (c *Client) do(method, path string, in, out interface{}, want ...int) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	for _, status := range want {
+		if resp.StatusCode == status {
+			if out == nil {
+				return resp.StatusCode, nil
+			}
+			return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+		}
+	}
+
+	ae := new(apiError)
+	if json.NewDecoder(resp.Body).Decode(ae) == nil && ae.Error != "" {
+		return resp.StatusCode, fmt.Errorf("%s", ae.Error)
+	}
+	return resp.StatusCode, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+}
+
+// Run runs command with args on the daemon. It returns the job the command
+// started, or the output of commands done right away. Commands refused
+// because of the running job fail with a *BusyError.
+func (c *Client) Run(command string, args []string) (*service.Job, string, error) {
+	req := &service.CommandRequest{Command: command, Args: args}
+
+	var raw json.RawMessage
+	status, err := c.do("POST", "/api/jobs", req, &raw, http.StatusOK, http.StatusAccepted, http.StatusConflict)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch status {
+	case http.StatusAccepted:
+		job := new(service.Job)
+		return job, "", json.Unmarshal(raw, job)
+	case http.StatusConflict:
+		reply := new(service.CommandReply)
+		err = json.Unmarshal(raw, reply)
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, reply.Message, &BusyError{Job: reply.Job, Message: reply.Message}
+	default:
+		reply := new(service.CommandReply)
+		err = json.Unmarshal(raw, reply)
+		return nil, reply.Message, err
+	}
+}
+
+// Queue queues command with args to run once the jobs before it are done.
+func (c *Client) Queue(command string, args []string, priority int) (*service.Job, error) {
+	req := &service.QueueRequest{
+		CommandRequest: service.CommandRequest{Command: command, Args: args},
+		Priority:       priority,
+	}
+	job := new(service.Job)
+	_, err := c.do("POST", "/api/queue", req, job, http.StatusAccepted)
+	return job, err
+}
+
+// Jobs returns the jobs the daemon remembers, then the queued ones.
+func (c *Client) Jobs() ([]*service.Job, error) {
+	var jobs []*service.Job
+	_, err := c.do("GET", "/api/jobs", nil, &jobs, http.StatusOK)
+	return jobs, err
+}
+
+// Job returns the job with the given ID.
+func (c *Client) Job(id string) (*service.Job, error) {
+	job := new(service.Job)
+	_, err := c.do("GET", "/api/jobs/"+url.PathEscape(id), nil, job, http.StatusOK)
+	return job, err
+}
+
+// Cancel takes the queued job with the given ID out of the queue.
+func (c *Client) Cancel(id string) (*service.Job, error) {
+	job := new(service.Job)
+	_, err := c.do("DELETE", "/api/jobs/"+url.PathEscape(id), nil, job, http.StatusOK)
+	return job, err
+}
+
+// Lookup looks up hashes, files and game names.
+func (c *Client) Lookup(queries []string) (*service.LookupReply, error) {
+	q := url.Values{"q": queries}
+	reply := new(service.LookupReply)
+	_, err := c.do("GET", "/api/lookup?"+q.Encode(), nil, reply, http.StatusOK)
+	return reply, err
+}
+
+// DBStats returns the statistics of the rom DB.
+func (c *Client) DBStats() (string, error) {
+	reply := new(service.CommandReply)
+	_, err := c.do("GET", "/api/dbstats", nil, reply, http.StatusOK)
+	return reply.Message, err
+}
+
+// Progress follows the progress messages of the daemon, calling fn with
+// each, until fn returns false, ctx is done or the connection ends. It
+// returns once the daemon is sending progress, before any message arrives,
+// and the returned channel delivers the error the stream ended with, nil if
+// fn or ctx ended it.
+func (c *Client) Progress(ctx context.Context, fn func(pmsg *service.ProgressNessage) bool) (<-chan error, error) {
+	req, err := c.newRequest("GET", "/api/progress", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET /api/progress: %s", resp.Status)
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			pmsg := new(service.ProgressNessage)
+			err := json.Unmarshal(scanner.Bytes(), pmsg)
+			if err != nil {
+				errC <- err
+				return
+			}
+			if !fn(pmsg) {
+				errC <- nil
+				return
+			}
+		}
+
+		err := scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		if ctx.Err() != nil {
+			err = nil
+		}
+		errC <- err
+	}()
+	return errC, nil
+}
+
+// Events follows the events of the job with the given ID after the event
+// with ID after, 0 for all the daemon still has, calling fn with each until
+// the job ends, fn returns false or ctx is done. Lost connections are resumed
+// where they broke off.
+func (c *Client) Events(ctx context.Context, id string, after int64, fn func(ev *service.JobEvent) bool) error {
+	failures := 0
+	for {
+		got, done, err := c.readEvents(ctx, id, &after, fn)
+		if done || ctx.Err() != nil {
+			return err
+		}
+
+		if got {
+			failures = 0
+		}
+		failures++
+		if failures > maxRetries {
+			return err
+		}
+
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// readEvents reads one connection of the event stream of a job. It reports
+// whether it got any events and whether following the events is done, and
+// advances after to the ID of the last event it got.
+func (c *Client) readEvents(ctx context.Context, id string, after *int64, fn func(ev *service.JobEvent) bool) (bool, bool, error) {
+	req, err := c.newRequest("GET", "/api/jobs/"+url.PathEscape(id)+"/events", nil)
+	if err != nil {
+		return false, true, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	if *after > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(*after, 10))
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return false, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		ae := new(apiError)
+		if json.NewDecoder(resp.Body).Decode(ae) == nil && ae.Error != "" {
+			return false, true, fmt.Errorf("%s", ae.Error)
+		}
+		return false, true, fmt.Errorf("GET /api/jobs/%s/events: %s", id, resp.Status)
+	}
+
+	got := false
+	var data []string
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if len(data) == 0 {
+				continue
+			}
+			ev := new(service.JobEvent)
+			err := json.Unmarshal([]byte(strings.Join(data, "\n")), ev)
+			if err != nil {
+				return got, true, err
+			}
+			data = data[:0]
+
+			got = true
+			if ev.ID != 0 {
+				*after = ev.ID
+			}
+			if !fn(ev) || ev.Ends() {
+				return got, true, nil
+			}
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	err = scanner.Err()
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return got, false, err
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/service"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// clientTestDB is an empty rom DB.
+type clientTestDB struct {
+	db.RomDB
+}
+
+func (cdb *clientTestDB) GetDat(sha1 []byte) (*types.Dat, error) {
+	return nil, nil
+}
+
+func (cdb *clientTestDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	return nil, nil
+}
+
+func (cdb *clientTestDB) CompleteRom(rom *types.Rom) error {
+	return nil
+}
+
+func (cdb *clientTestDB) PrintStats() string {
+	return "no roms"
+}
+
+func TestClient(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cdb := new(clientTestDB)
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, cdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Index.Dats = datsDir
+	cfg.General.LogDir = root
+	cfg.General.Workers = 1
+
+	rs := service.NewRombaService(cdb, depot, cfg)
+	server := httptest.NewServer(rs.APIHandler())
+	defer server.Close()
+
+	c := New(strings.TrimPrefix(server.URL, "http://"))
+
+	job, msg, err := c.Run("dbstats", nil)
+	if err != nil || job != nil || !strings.Contains(msg, "no roms") {
+		t.Errorf("got job %v, output %q and error %v running dbstats", job, msg, err)
+	}
+
+	_, _, err = c.Run("no-such-command", nil)
+	if err == nil {
+		t.Errorf("unknown command didn't fail")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan struct{})
+	errC, err := c.Progress(ctx, func(pmsg *service.ProgressNessage) bool {
+		if pmsg.Stopping {
+			close(stopped)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, _, err = c.Run("miss", []string{"-out", filepath.Join(root, "out")})
+	if err != nil || job == nil || job.Name != "miss" {
+		t.Fatalf("got job %v and error %v running miss", job, err)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("miss job didn't stop")
+	}
+	if err := <-errC; err != nil {
+		t.Errorf("progress stream failed: %v", err)
+	}
+
+	job, err = c.Job(job.ID)
+	if err != nil || job.State != service.JobDone {
+		t.Errorf("got job %+v and error %v, want a finished miss job", job, err)
+	}
+
+	var events []*service.JobEvent
+	err = c.Events(ctx, job.ID, 0, func(ev *service.JobEvent) bool {
+		events = append(events, ev)
+		return true
+	})
+	if err != nil || len(events) < 2 || !events[len(events)-1].Ends() {
+		t.Errorf("got %d events and error %v, want the events of the miss job up to its end", len(events), err)
+	}
+
+	err = c.Events(ctx, "999", 0, func(ev *service.JobEvent) bool { return true })
+	if err == nil || !strings.Contains(err.Error(), "no job 999") {
+		t.Errorf("got error %v following the events of an unknown job", err)
+	}
+
+	jobs, err := c.Jobs()
+	if err != nil || len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Errorf("got jobs %v and error %v, want the miss job", jobs, err)
+	}
+
+	_, err = c.Cancel(job.ID)
+	if err == nil || !strings.Contains(err.Error(), "only queued jobs") {
+		t.Errorf("got error %v cancelling a finished job", err)
+	}
+
+	stats, err := c.DBStats()
+	if err != nil || stats != "no roms" {
+		t.Errorf("got dbstats %q and error %v", stats, err)
+	}
+
+	reply, err := c.Lookup([]string{"some game"})
+	if err != nil || len(reply.Results) != 1 || reply.Results[0].Kind != service.LookupName {
+		t.Errorf("got lookup reply %+v and error %v", reply, err)
+	}
+}
@@ -33,107 +33,263 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"syscall"
 
-	"code.google.com/p/gcfg"
 	"code.google.com/p/go.net/websocket"
 	"github.com/gorilla/rpc/v2"
 	"github.com/gorilla/rpc/v2/json2"
 
-	"github.com/golang/glog"
-
 	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/auth"
+	"github.com/uwedeportivo/romba/bundle"
+	"github.com/uwedeportivo/romba/config"
 	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/logging"
 	"github.com/uwedeportivo/romba/service"
+	"github.com/uwedeportivo/romba/tlsconf"
 
 	_ "expvar"
 	_ "github.com/uwedeportivo/romba/db/clevel"
+	"github.com/uwedeportivo/romba/db/kivia"
 	_ "net/http/pprof"
 )
 
-type Config struct {
-	General struct {
-		LogDir    string
-		TmpDir    string
-		Workers   int
-		Verbosity int
-	}
-
-	Depot struct {
-		Root    []string
-		MaxSize []int64
-	}
+var logger = logging.For("server")
 
-	Index struct {
-		Db   string
-		Dats string
-	}
+// maxTraceCalls is how many lookups the traces of the kivi backend keep,
+// see Index.TraceDir.
+const maxTraceCalls = 100000
 
-	Server struct {
-		Port int
-	}
-}
+var configPath = flag.String("config", "", "configuration file, romba.toml or romba.ini in the current directory if not set")
+var importPath = flag.String("import", "", "state bundle written by export-state to restore, exits when done")
 
-func signalCatcher(romDB db.RomDB) {
+func signalCatcher(romDB db.RomDB, rs *service.RombaService) {
 	ch := make(chan os.Signal)
 	signal.Notify(ch, syscall.SIGINT)
 	<-ch
-	glog.Info("CTRL-C; exiting")
+	logger.Info("CTRL-C; exiting")
+	rs.UnmountAll()
 	err := romDB.Close()
 	if err != nil {
-		glog.Errorf("error closing DB: %v", err)
+		logger.Errorf("error closing DB: %v", err)
 		os.Exit(1)
 	}
 	os.Exit(0)
 }
 
+// setupLogging makes romba log as the [log] section of cfg says.
+func setupLogging(cfg *config.Config) error {
+	logging.SetLevel(logging.VLevel(cfg.General.Verbosity))
+
+	levels, err := cfg.LogLevels()
+	if err != nil {
+		return err
+	}
+	for subsystem, level := range levels {
+		logging.SetSubsystemLevel(subsystem, level)
+	}
+
+	if cfg.Log.Format == "glog" {
+		return nil
+	}
+
+	w := io.Writer(os.Stderr)
+	if cfg.Log.File != "" {
+		f, err := os.OpenFile(cfg.Log.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	if cfg.Log.Format == "json" {
+		logging.SetHandler(logging.NewJSONHandler(w))
+	} else {
+		logging.SetHandler(logging.NewTextHandler(w))
+	}
+	return nil
+}
+
+// importState restores the state bundle at bundlePath into the paths of the
+// config at path, writing the config of the bundle there first if there is
+// none.
+func importState(bundlePath, path string) error {
+	if path == "" {
+		var err error
+		path, err = config.Find(".")
+		if err != nil {
+			m, err := bundle.ReadManifest(bundlePath)
+			if err != nil {
+				return err
+			}
+			path = m.Config
+		}
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = bundle.ExtractConfig(bundlePath, path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("wrote the config of the bundle to %s\n", path)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	report, err := bundle.Import(bundlePath, &bundle.Target{
+		DB:     cfg.Index.Db,
+		LogDir: cfg.General.LogDir,
+		Roots:  cfg.Depot.Root,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	return nil
+}
+
+// flagSet reports whether the flag named name was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func main() {
-	config := new(Config)
+	flag.Parse()
+
+	if *importPath != "" {
+		err := importState(*importPath, *configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "importing state failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	path := *configPath
+	if path == "" {
+		var err error
+		path, err = config.Find(".")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	err := gcfg.ReadFileInto(config, "romba.ini")
+	cfg, err := config.Load(path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 
-	for i := 0; i < len(config.Depot.MaxSize); i++ {
-		config.Depot.MaxSize[i] *= int64(archive.GB)
+	runtime.GOMAXPROCS(cfg.General.Workers)
+
+	flag.Set("log_dir", cfg.General.LogDir)
+	flag.Set("alsologtostderr", "true")
+	// -v on the command line wins over general.verbosity
+	if !flagSet("v") {
+		flag.Set("v", strconv.Itoa(cfg.General.Verbosity))
 	}
 
-	runtime.GOMAXPROCS(config.General.Workers)
+	err = setupLogging(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configuring logging failed: %v\n", err)
+		os.Exit(1)
+	}
 
-	flag.Set("log_dir", config.General.LogDir)
-	flag.Set("alsologtostderr", "true")
+	if cfg.General.TmpDir != "" {
+		os.Setenv("TMPDIR", cfg.General.TmpDir)
+	}
 
-	romDB, err := db.New(config.Index.Db)
+	backend := cfg.Index.Backend
+	if backend == "" {
+		backend = "leveldb"
+	}
+	err = db.SetStore(backend)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configuring db failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.Index.TraceDir != "" {
+		kivia.EnableTrace(cfg.Index.TraceDir, maxTraceCalls)
+	}
+
+	plainDB, err := db.New(cfg.Index.Db)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "opening db failed: %v\n", err)
 		os.Exit(1)
 	}
+	// lookup timings are exported by /metrics
+	romDB := db.NewTimedRomDB(plainDB)
 
-	depot, err := archive.NewDepot(config.Depot.Root, config.Depot.MaxSize, romDB)
+	depot, err := archive.NewDepot(cfg.Depot.Root, cfg.MaxSizes(), romDB)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "creating depot failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	go signalCatcher(romDB)
+	if cfg.Depot.Compression != "" {
+		err = depot.SetCompression(cfg.Depot.Compression)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuring depot failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.General.HashEngine != "" {
+		err = archive.SetHashEngine(cfg.General.HashEngine)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuring hash engine failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	rs := service.NewRombaService(romDB, depot, cfg)
 
-	rs := service.NewRombaService(romDB, depot, config.Index.Dats, config.General.Workers, config.General.LogDir)
+	go signalCatcher(romDB, rs)
 
 	s := rpc.NewServer()
 	s.RegisterCodec(json2.NewCustomCodec(&rpc.CompressionSelector{}), "application/json")
 	s.RegisterService(rs, "")
 	http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir("./web"))))
-	http.Handle("/jsonrpc/", s)
-	http.Handle("/progress", websocket.Handler(rs.SendProgress))
+	http.Handle("/jsonrpc/", rs.RequireRole(auth.ReadOnly, s))
+	http.Handle("/api/", rs.APIHandler())
+	http.Handle("/dashboard", rs.DashboardHandler())
+	http.Handle("/metrics", rs.MetricsHandler())
+	http.Handle(auth.WebsocketPath, rs.RequireRole(auth.ReadOnly, websocket.Handler(rs.SendProgress)))
 
-	fmt.Printf("starting romba server at localhost:%d/romba.html\n", config.Server.Port)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Server.Port)}
+	scheme := "http"
+	if cfg.Server.TLSCert != "" {
+		server.TLSConfig, err = tlsconf.Server(cfg.Server.TLSCert, cfg.Server.TLSKey, cfg.Server.ClientCA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuring TLS failed: %v\n", err)
+			os.Exit(1)
+		}
+		scheme = "https"
+	}
+
+	fmt.Printf("starting romba server at %s://localhost:%d/romba.html\n", scheme, cfg.Server.Port)
+	fmt.Printf("dashboard at %s://localhost:%d/dashboard\n", scheme, cfg.Server.Port)
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Server.Port), nil))
+	if server.TLSConfig != nil {
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
 }
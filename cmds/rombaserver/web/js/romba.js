@@ -22,6 +22,16 @@ var termFn = function(command, term){
 	}   
 }
 
+// token is the token of the user, for servers with users. It is taken from
+// the token parameter of the page URL and kept for the session.
+var token = (function() {
+	var match = /[?&]token=([^&]*)/.exec(window.location.search);
+	if (match) {
+		sessionStorage.setItem("rombaToken", decodeURIComponent(match[1]));
+	}
+	return sessionStorage.getItem("rombaToken") || "";
+})();
+
 var niceBytes = function (bytes) {
     if (bytes == 0) return '0';
     var sizes = ['B', 'KB', 'MB', 'GB', 'TB', 'PB', 'EB', 'ZB', 'YB'],
@@ -32,6 +42,10 @@ var niceBytes = function (bytes) {
 
 jQuery(document).ready(function($) {
 
+	if (token != "") {
+		$.ajaxSetup({ headers: { "Authorization": "Bearer " + token } });
+	}
+
 	$('#progressbarFiles').progressbar();
 	$('#progressbarBytes').progressbar();
 
@@ -43,7 +57,12 @@ jQuery(document).ready(function($) {
 		}
 	});
 
-	var ws = new WebSocket("ws://" + document.location.host + "/progress");
+	var wsScheme = document.location.protocol == "https:" ? "wss://" : "ws://";
+	var wsURL = wsScheme + document.location.host + "/progress";
+	if (token != "") {
+		wsURL += "?token=" + encodeURIComponent(token);
+	}
+	var ws = new WebSocket(wsURL);
 
 	$('#progress').hide();
 
@@ -0,0 +1,310 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// maxHistory is the number of lines the history keeps.
+const maxHistory = 1000
+
+// completer returns the start of the word ending at pos in line and the
+// candidates to replace it with.
+type completer func(line []rune, pos int) (int, []string)
+
+// lineEditor reads lines from a terminal with editing, history and tab
+// completion, or plain lines if the input isn't a terminal.
+type lineEditor struct {
+	in       *os.File
+	r        *bufio.Reader
+	out      io.Writer
+	history  []string
+	complete completer
+}
+
+func newLineEditor(in *os.File, out io.Writer, complete completer) *lineEditor {
+	return &lineEditor{
+		in:       in,
+		r:        bufio.NewReader(in),
+		out:      out,
+		complete: complete,
+	}
+}
+
+// addHistory appends line to the history, unless it repeats the last one.
+func (le *lineEditor) addHistory(line string) {
+	if line == "" || (len(le.history) > 0 && le.history[len(le.history)-1] == line) {
+		return
+	}
+	le.history = append(le.history, line)
+	if len(le.history) > maxHistory {
+		le.history = le.history[len(le.history)-maxHistory:]
+	}
+}
+
+// loadHistory reads the history from path, one line each.
+func (le *lineEditor) loadHistory(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		le.addHistory(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// saveHistory writes the history to path.
+func (le *lineEditor) saveHistory(path string) error {
+	return ioutil.WriteFile(path, []byte(strings.Join(le.history, "\n")+"\n"), 0600)
+}
+
+// readLine reads a line after writing prompt. It returns io.EOF at the end
+// of the input or on ctrl-D on an empty line.
+func (le *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(le.in.Fd())
+	if err != nil {
+		// not a terminal
+		fmt.Fprint(le.out, prompt)
+		line, err := le.r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	defer restore()
+
+	return le.edit(prompt)
+}
+
+// editState is a line being edited.
+type editState struct {
+	le     *lineEditor
+	prompt string
+	buf    []rune
+	pos    int
+	// hist is the history entry shown, len(history) for the new line,
+	// saved the new line while browsing the history
+	hist  int
+	saved []rune
+}
+
+func (le *lineEditor) edit(prompt string) (string, error) {
+	es := &editState{le: le, prompt: prompt, hist: len(le.history)}
+	es.refresh()
+
+	for {
+		r, _, err := le.r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(le.out, "\r\n")
+			return string(es.buf), nil
+		case 3: // ctrl-C drops the line
+			fmt.Fprint(le.out, "^C\r\n")
+			return "", nil
+		case 4: // ctrl-D
+			if len(es.buf) == 0 {
+				fmt.Fprint(le.out, "\r\n")
+				return "", io.EOF
+			}
+			es.deleteAt(es.pos)
+		case 1: // ctrl-A
+			es.pos = 0
+		case 5: // ctrl-E
+			es.pos = len(es.buf)
+		case 2: // ctrl-B
+			es.move(-1)
+		case 6: // ctrl-F
+			es.move(1)
+		case 11: // ctrl-K
+			es.buf = es.buf[:es.pos]
+		case 21: // ctrl-U
+			es.buf = es.buf[es.pos:]
+			es.pos = 0
+		case 16: // ctrl-P
+			es.browse(-1)
+		case 14: // ctrl-N
+			es.browse(1)
+		case 127, 8: // backspace
+			if es.pos > 0 {
+				es.pos--
+				es.deleteAt(es.pos)
+			}
+		case '\t':
+			es.completeWord()
+		case 27:
+			es.escape()
+		default:
+			if r >= ' ' {
+				es.insert([]rune{r})
+			}
+		}
+		es.refresh()
+	}
+}
+
+// escape handles the escape sequences of arrow, home, end and delete keys.
+func (es *editState) escape() {
+	r, _, err := es.le.r.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return
+	}
+	r, _, err = es.le.r.ReadRune()
+	if err != nil {
+		return
+	}
+
+	switch r {
+	case 'A':
+		es.browse(-1)
+	case 'B':
+		es.browse(1)
+	case 'C':
+		es.move(1)
+	case 'D':
+		es.move(-1)
+	case 'H':
+		es.pos = 0
+	case 'F':
+		es.pos = len(es.buf)
+	case '3':
+		if r, _, err = es.le.r.ReadRune(); err == nil && r == '~' {
+			es.deleteAt(es.pos)
+		}
+	}
+}
+
+func (es *editState) move(delta int) {
+	es.pos += delta
+	if es.pos < 0 {
+		es.pos = 0
+	}
+	if es.pos > len(es.buf) {
+		es.pos = len(es.buf)
+	}
+}
+
+func (es *editState) insert(rs []rune) {
+	buf := make([]rune, 0, len(es.buf)+len(rs))
+	buf = append(buf, es.buf[:es.pos]...)
+	buf = append(buf, rs...)
+	buf = append(buf, es.buf[es.pos:]...)
+	es.buf = buf
+	es.pos += len(rs)
+}
+
+func (es *editState) deleteAt(pos int) {
+	if pos < len(es.buf) {
+		es.buf = append(es.buf[:pos], es.buf[pos+1:]...)
+	}
+}
+
+// browse moves delta entries through the history.
+func (es *editState) browse(delta int) {
+	history := es.le.history
+	next := es.hist + delta
+	if next < 0 || next > len(history) {
+		return
+	}
+
+	if es.hist == len(history) {
+		es.saved = es.buf
+	}
+	es.hist = next
+	if next == len(history) {
+		es.buf = es.saved
+	} else {
+		es.buf = []rune(history[next])
+	}
+	es.pos = len(es.buf)
+}
+
+// completeWord completes the word before the cursor as far as the
+// candidates agree, and lists them if they don't.
+func (es *editState) completeWord() {
+	if es.le.complete == nil {
+		return
+	}
+
+	start, candidates := es.le.complete(es.buf, es.pos)
+	if len(candidates) == 0 {
+		return
+	}
+
+	word := string(es.buf[start:es.pos])
+	prefix := commonPrefix(candidates)
+	if len(candidates) == 1 && !strings.HasSuffix(prefix, "/") {
+		prefix += " "
+	}
+
+	if len([]rune(prefix)) > len([]rune(word)) {
+		es.buf = append(es.buf[:start:start], es.buf[es.pos:]...)
+		es.pos = start
+		es.insert([]rune(prefix))
+		return
+	}
+
+	fmt.Fprint(es.le.out, "\r\n"+strings.Join(candidates, "  ")+"\r\n")
+}
+
+func commonPrefix(ss []string) string {
+	prefix := ss[0]
+	for _, s := range ss[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			r := []rune(prefix)
+			prefix = string(r[:len(r)-1])
+		}
+	}
+	return prefix
+}
+
+// refresh redraws the line with the cursor at its position.
+func (es *editState) refresh() {
+	fmt.Fprintf(es.le.out, "\r%s%s\x1b[K", es.prompt, string(es.buf))
+	if back := len(es.buf) - es.pos; back > 0 {
+		fmt.Fprintf(es.le.out, "\x1b[%dD", back)
+	}
+}
@@ -0,0 +1,456 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// rombashell is an interactive shell for a romba server. It runs the
+// commands of the server with tab completion and history, and follows the
+// progress of the jobs it starts.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/client"
+	"github.com/uwedeportivo/romba/service"
+	"github.com/uwedeportivo/romba/tlsconf"
+	"github.com/uwedeportivo/romba/types"
+)
+
+var (
+	server  = flag.String("server", "localhost:4200", "address of the romba server, https://host:port for servers with TLS")
+	histout = flag.String("history", defaultHistoryPath(), "file keeping the command history, none if empty")
+	token   = flag.String("token", os.Getenv("ROMBA_TOKEN"), "token of the user of the romba server, $ROMBA_TOKEN if not set")
+	caFile  = flag.String("ca", "", "PEM file of the CAs the certificate of the romba server is checked against, the system's if empty")
+	cert    = flag.String("cert", "", "PEM file of the client certificate, for servers asking for one")
+	key     = flag.String("key", "", "PEM file of the key of the client certificate")
+)
+
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".romba_history")
+}
+
+// shellCommands are the commands of the shell itself, next to the ones of
+// the server.
+var shellCommands = []*service.CommandHelp{
+	{Name: "help", Usage: "help [command]", Short: "Lists the commands or describes one."},
+	{Name: "exit", Usage: "exit", Short: "Leaves the shell."},
+	{Name: "follow", Usage: "follow", Short: "Follows the progress of the running job until it ends."},
+}
+
+type shell struct {
+	c        *client.Client
+	out      io.Writer
+	commands []*service.CommandHelp
+}
+
+func main() {
+	flag.Parse()
+
+	sh := &shell{
+		c:        client.New(*server),
+		out:      os.Stdout,
+		commands: append(append([]*service.CommandHelp{}, shellCommands...), service.Commands()...),
+	}
+	hc, err := tlsconf.HTTPClient(*caFile, *cert, *key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "setting up TLS failed: %v\n", err)
+		os.Exit(1)
+	}
+	sh.c.SetHTTPClient(hc)
+	sh.c.SetToken(*token)
+	sort.Slice(sh.commands, func(i, j int) bool { return sh.commands[i].Name < sh.commands[j].Name })
+
+	le := newLineEditor(os.Stdin, os.Stdout, sh.complete)
+	if *histout != "" {
+		err := le.loadHistory(*histout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "loading history failed: %v\n", err)
+		}
+	}
+
+	fmt.Fprintf(sh.out, "romba shell connected to %s, help lists the commands\n", *server)
+
+	for {
+		line, err := le.readLine("romba> ")
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading command failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		le.addHistory(line)
+
+		if !sh.run(line) {
+			break
+		}
+	}
+
+	if *histout != "" {
+		err := le.saveHistory(*histout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "saving history failed: %v\n", err)
+		}
+	}
+}
+
+// run runs the command line and reports whether the shell goes on.
+func (sh *shell) run(line string) bool {
+	args, err := splitArgs(line)
+	if err != nil {
+		fmt.Fprintf(sh.out, "error: %v\n", err)
+		return true
+	}
+
+	name, args := args[0], args[1:]
+	switch name {
+	case "exit", "quit":
+		return false
+	case "help":
+		sh.help(args)
+	case "follow":
+		sh.follow()
+	case "lookup":
+		err = sh.lookup(args)
+	case "dbstats":
+		var stats string
+		stats, err = sh.c.DBStats()
+		fmt.Fprintln(sh.out, strings.TrimSpace(stats))
+	default:
+		err = sh.runServerCommand(name, args)
+	}
+
+	if err != nil {
+		fmt.Fprintf(sh.out, "error: %v\n", err)
+	}
+	return true
+}
+
+// runServerCommand runs a command on the server and follows the job it
+// starts.
+func (sh *shell) runServerCommand(name string, args []string) error {
+	job, msg, err := sh.c.Run(name, args)
+	if be, ok := err.(*client.BusyError); ok {
+		fmt.Fprint(sh.out, msg)
+		return be
+	}
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		fmt.Fprint(sh.out, msg)
+		return nil
+	}
+
+	fmt.Fprintf(sh.out, "started job %s (%s), ctrl-C stops following it\n", job.ID, job.Name)
+	sh.followJob(job.ID)
+	return nil
+}
+
+// follow follows the progress of the running job until it ends.
+func (sh *shell) follow() {
+	jobs, err := sh.c.Jobs()
+	if err != nil {
+		fmt.Fprintf(sh.out, "error: %v\n", err)
+		return
+	}
+
+	var running *service.Job
+	for _, job := range jobs {
+		if job.State == service.JobRunning {
+			running = job
+		}
+	}
+	if running == nil {
+		fmt.Fprintln(sh.out, "no job running")
+		return
+	}
+
+	fmt.Fprintf(sh.out, "following job %s (%s), ctrl-C stops following it\n", running.ID, running.Name)
+	sh.followJob(running.ID)
+}
+
+// followJob prints the progress and log lines of the job with the given ID
+// until it ends or the user presses ctrl-C.
+func (sh *shell) followJob(id string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracker := newProgressTracker(sh.out)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- sh.c.Events(ctx, id, 0, tracker.event)
+	}()
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, os.Interrupt)
+	defer signal.Stop(sigC)
+
+	select {
+	case err := <-errC:
+		tracker.finish()
+		if err != nil {
+			fmt.Fprintf(sh.out, "lost progress: %v\n", err)
+		}
+	case <-sigC:
+		cancel()
+		<-errC
+		tracker.finish()
+		fmt.Fprintln(sh.out, "stopped following, the job goes on")
+	}
+
+	sh.printJobEnd(id)
+}
+
+func (sh *shell) printJobEnd(id string) {
+	job, err := sh.c.Job(id)
+	if err != nil {
+		fmt.Fprintf(sh.out, "error: %v\n", err)
+		return
+	}
+	if job.State == service.JobRunning {
+		return
+	}
+
+	fmt.Fprintf(sh.out, "job %s %s\n", job.ID, job.State)
+	if job.Message != "" {
+		fmt.Fprintln(sh.out, job.Message)
+	}
+	if job.Error != "" {
+		fmt.Fprintf(sh.out, "error: %s\n", job.Error)
+	}
+}
+
+func (sh *shell) lookup(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("lookup needs hashes, files or game names")
+	}
+
+	// files are hashed here, the daemon may not see them, and looked up by
+	// their SHA1
+	files := make(map[int]*types.Rom)
+	for i, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		hh, err := archive.HashesForFile(arg)
+		if err != nil {
+			return err
+		}
+		files[i] = &types.Rom{
+			Name: arg,
+			Size: fi.Size(),
+			Crc:  hh.Crc,
+			Md5:  hh.Md5,
+			Sha1: hh.Sha1,
+		}
+		args[i] = hex.EncodeToString(hh.Sha1)
+	}
+
+	reply, err := sh.c.Lookup(args)
+	if err != nil {
+		return err
+	}
+	for i, lr := range reply.Results {
+		if rom, ok := files[i]; ok {
+			lr.Query = rom.Name
+			lr.Kind = service.LookupFile
+			if lr.Rom.Crc == nil {
+				lr.Rom.Crc = rom.Crc
+			}
+			if lr.Rom.Md5 == nil {
+				lr.Rom.Md5 = rom.Md5
+			}
+		}
+		service.PrintLookupResult(sh.out, lr)
+	}
+	return nil
+}
+
+func (sh *shell) help(args []string) {
+	if len(args) > 0 {
+		for _, ch := range sh.commands {
+			if ch.Name == args[0] {
+				fmt.Fprintf(sh.out, "usage: %s\n\n%s\n", ch.Usage, ch.Short)
+				return
+			}
+		}
+		fmt.Fprintf(sh.out, "unknown command %s\n", args[0])
+		return
+	}
+
+	for _, ch := range sh.commands {
+		fmt.Fprintf(sh.out, "  %-14s %s\n", ch.Name, ch.Short)
+	}
+}
+
+// complete completes command names at the start of the line, their flags and
+// paths after them.
+func (sh *shell) complete(line []rune, pos int) (int, []string) {
+	start := pos
+	for start > 0 && line[start-1] != ' ' {
+		start--
+	}
+	word := string(line[start:pos])
+	fields := strings.Fields(string(line[:start]))
+
+	var candidates []string
+	switch {
+	case len(fields) == 0 || (len(fields) == 1 && fields[0] == "help"):
+		for _, ch := range sh.commands {
+			if strings.HasPrefix(ch.Name, word) {
+				candidates = append(candidates, ch.Name)
+			}
+		}
+	case strings.HasPrefix(word, "-"):
+		for _, ch := range sh.commands {
+			if ch.Name != fields[0] {
+				continue
+			}
+			for _, f := range ch.Flags {
+				if strings.HasPrefix(f, word) {
+					candidates = append(candidates, f)
+				}
+			}
+		}
+	default:
+		candidates = completePath(word)
+	}
+	return start, candidates
+}
+
+// completePath returns the paths starting with word, directories with a
+// trailing slash.
+func completePath(word string) []string {
+	matches, err := filepath.Glob(word + "*")
+	if err != nil {
+		return nil
+	}
+
+	for i, m := range matches {
+		if fi, err := os.Stat(m); err == nil && fi.IsDir() {
+			matches[i] = m + string(filepath.Separator)
+		}
+	}
+	return matches
+}
+
+// splitArgs splits line into words at spaces outside of single or double
+// quotes.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	var quote rune
+	inWord := false
+
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("open quotes in %s", line)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// progressTracker prints the progress of a job on one line, rewriting it with
+// each update, and its log lines above it.
+type progressTracker struct {
+	out io.Writer
+	// printed tells that the progress line is showing
+	printed bool
+}
+
+func newProgressTracker(out io.Writer) *progressTracker {
+	return &progressTracker{out: out}
+}
+
+func (pt *progressTracker) event(ev *service.JobEvent) bool {
+	switch ev.Type {
+	case service.EventProgress:
+		p := ev.Progress
+		fmt.Fprintf(pt.out, "\r%d of %d files, %s of %s\x1b[K", p.FilesSoFar, p.TotalFiles,
+			humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
+		pt.printed = true
+	case service.EventLog:
+		fmt.Fprintf(pt.out, "\r%s\x1b[K\n", ev.Line)
+		pt.printed = false
+	case service.EventTruncated:
+		fmt.Fprintf(pt.out, "\rsome progress was lost\x1b[K\n")
+		pt.printed = false
+	}
+	return true
+}
+
+func (pt *progressTracker) finish() {
+	if pt.printed {
+		fmt.Fprintln(pt.out)
+	}
+}
@@ -0,0 +1,492 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package config holds the settings of romba, read from a TOML file or from
+// the romba.ini of older installations.
+//
+// A TOML configuration looks like
+//
+//	[general]
+//	logdir = "/var/log/romba"
+//	workers = 8
+//	verbosity = 1
+//	hashengine = "std"
+//	recovery = "resume"   # report (the default), resume or rollback
+//	chdman = "/usr/local/bin/chdman"   # for build -chd and archive -verify-chd
+//
+//	[depot]
+//	root = ["/mnt/a/depot", "/mnt/b/depot"]
+//	maxsize = [500, 2000]   # GB per root, a single value applies to all
+//	compression = "gzip"
+//
+//	[index]
+//	db = "/var/lib/romba/db"
+//	dats = "/var/lib/romba/dats"
+//
+//	[server]
+//	port = 4200
+//	tlscert = "/etc/romba/server.crt"
+//	tlskey = "/etc/romba/server.key"
+//	clientca = "/etc/romba/clients.crt"   # clients need certificates signed by these
+//
+//	[replica]
+//	acceptdeletes = false
+//	ca = "/etc/romba/ca.crt"     # the secondary's certificate is checked against these
+//	cert = "/etc/romba/replica.crt"
+//	key = "/etc/romba/replica.key"
+//
+//	[datsync]
+//	url = ["https://example.org/dats/index.html"]
+//	dir = "datsync"   # below index.dats
+//	keep = 5
+//	interval = 24     # hours
+//
+//	[stats]
+//	interval = 24     # hours between samples of the depot statistics
+//	keep = 1000       # samples
+//
+//	[trash]
+//	enabled = true    # removed files go to the trash, for undo
+//	dir = "/var/lib/romba/trash"   # logdir/trash if unset
+//	days = 30         # days files stay in the trash, forever if 0
+//
+//	[notify]
+//	webhook = ["https://hooks.slack.com/services/T000/B000/XXXX"]
+//	smtp = "mail.example.org:587"
+//	from = "romba@example.org"
+//	to = ["me@example.org"]
+//	on = "failure"    # or "all"
+//
+//	[log]
+//	format = "json"   # glog (the default), json or text
+//	file = "/var/log/romba/romba.json"   # stderr if unset
+//	levels = ["archive=v2", "replica=warn"]
+//
+//	[auth]
+//	admin = ["alice:6f1c0e5d9a8b7c3e2f4a"]
+//	operator = ["bob:0d2e4f6a8c1b3d5e7f9a"]
+//	readonly = ["club:9e8d7c6b5a4f3e2d1c0b"]
+//
+// Users of the HTTP API of the daemon are given as name:token, by role. With
+// no users, anyone reaching the daemon may do anything. Clients presenting a
+// certificate signed by one of the CAs of server.clientca are the user named
+// by its common name.
+//
+// Keys match case insensitively and may use underscores or dashes, so
+// log_dir and log-dir both set general.logdir.
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"code.google.com/p/gcfg"
+
+	"github.com/uwedeportivo/romba/auth"
+	"github.com/uwedeportivo/romba/logging"
+)
+
+// GB is the unit of depot max sizes in a configuration.
+const GB = 1 << 30
+
+// Config is the configuration of romba.
+type Config struct {
+	General struct {
+		// LogDir is where logs, reports and the job queue go.
+		LogDir string
+		// TmpDir is for scratch files, the system's if unset.
+		TmpDir  string
+		Workers int
+		// Verbosity is the glog -v level logs are written at, by the
+		// subsystems without a level in log.levels.
+		Verbosity  int
+		HashEngine string
+		// Recovery is what the daemon does at startup with a job a crash
+		// or power failure interrupted: "report" it and wait to be told,
+		// "resume" it or "rollback" what it left behind.
+		Recovery string
+		// Chdman is the chdman of MAME that CHDs are created and extracted
+		// with, looked up in the PATH if unset.
+		Chdman string
+	}
+
+	Depot struct {
+		Root []string
+		// MaxSize is in GB, one per root or a single one for all roots.
+		MaxSize     []int64
+		Compression string
+	}
+
+	Index struct {
+		Db   string
+		Dats string
+		// Backend names the key value store of the DB, leveldb, the
+		// default, or kivi.
+		Backend string
+		// TraceDir is where the kivi backend writes the timings of its
+		// lookups when the DB is closed, not traced if unset.
+		TraceDir string
+	}
+
+	Server struct {
+		Port int
+		// TLSCert and TLSKey are the PEM files of the certificate and key
+		// the daemon serves HTTPS with, plain HTTP if unset.
+		TLSCert string
+		TLSKey  string
+		// ClientCA is a PEM file of CAs, clients need a certificate signed
+		// by one of them if set.
+		ClientCA string
+	}
+
+	Replica struct {
+		// AcceptDeletes lets a romba replicating its depot to this one
+		// remove the roms it doesn't have from this depot.
+		AcceptDeletes bool
+		// Token is sent to the secondary romba replicate pushes to, if it
+		// has users.
+		Token string
+		// CA is a PEM file of the CAs the certificate of an https secondary
+		// is checked against, the system's if unset.
+		CA string
+		// Cert and Key are the PEM files of the client certificate sent to
+		// secondaries asking for one.
+		Cert string
+		Key  string
+	}
+
+	DatSync struct {
+		// URL are where datsync fetches dats from: dat files, zips of dats
+		// or index pages linking to them.
+		URL []string
+		// Dir is where synced dats go, relative to index.dats.
+		Dir string
+		// History is where replaced dats are kept, logdir/dat-history if
+		// unset.
+		History string
+		// Keep is the number of old versions kept of each dat.
+		Keep int
+		// Interval is the number of hours between syncs, 0 to only sync
+		// when asked to.
+		Interval int
+	}
+
+	Stats struct {
+		// Interval is the number of hours between samples of the depot
+		// statistics, 0 to only take them when asked to.
+		Interval int
+		// Keep is the number of samples kept, all if 0.
+		Keep int
+	}
+
+	Trash struct {
+		// Enabled makes purge, fix, rebuild and archive -delete-sources
+		// put the files they remove into the trash, instead of deleting
+		// them.
+		Enabled bool
+		// Dir is where the files removed outside of the depot roots go,
+		// logdir/trash if unset. Depot files go into a trash directory in
+		// their depot root.
+		Dir string
+		// Days is the number of days files stay in the trash, forever if 0.
+		Days int
+	}
+
+	Notify struct {
+		// Webhook are URLs a JSON result is posted to when a job ends,
+		// formatted for Slack or Discord if they point there.
+		Webhook []string
+		// SMTP is the host:port of the mail server results are sent
+		// through, no mail is sent if unset.
+		SMTP     string
+		From     string
+		To       []string
+		Username string
+		Password string
+		// On is "all" to notify of every job or "failure" to only notify
+		// of failed ones.
+		On string
+	}
+
+	Log struct {
+		// Format is glog for glog's files in logdir, json or text for lines
+		// of key value pairs.
+		Format string
+		// File is where json and text lines go, stderr if unset.
+		File string
+		// Levels are the levels of subsystems, as subsystem=level, see
+		// logging.ParseLevel. Other subsystems log at general.verbosity.
+		Levels []string
+	}
+
+	Auth struct {
+		// Admin, Operator and ReadOnly are the users with each role, as
+		// name:token.
+		Admin    []string
+		Operator []string
+		ReadOnly []string
+	}
+
+	// path is the file the configuration was loaded from.
+	path string
+}
+
+// Default returns the configuration used for the settings a file leaves
+// out.
+func Default() *Config {
+	cfg := new(Config)
+	cfg.General.Workers = runtime.NumCPU()
+	cfg.General.HashEngine = "std"
+	cfg.General.Recovery = "report"
+	cfg.Depot.Compression = "gzip"
+	cfg.Server.Port = 4200
+	cfg.DatSync.Dir = "datsync"
+	cfg.DatSync.Keep = 5
+	cfg.Stats.Keep = 1000
+	cfg.Trash.Days = 30
+	cfg.Notify.On = "all"
+	cfg.Log.Format = "glog"
+	return cfg
+}
+
+// Load reads the configuration file at path on top of the defaults and
+// validates it. Files ending in .toml are read as TOML, others as the ini
+// files of older romba versions.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = readTOMLFile(cfg, path)
+	} else {
+		err = gcfg.ReadFileInto(cfg, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s failed: %v", path, err)
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	cfg.path = path
+	return cfg, nil
+}
+
+// Path returns the file cfg was loaded from, "" if it wasn't.
+func (cfg *Config) Path() string {
+	return cfg.path
+}
+
+// Find returns the first of romba.toml and romba.ini existing in dir.
+func Find(dir string) (string, error) {
+	for _, name := range []string{"romba.toml", "romba.ini"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no romba.toml or romba.ini in %s", dir)
+}
+
+// Validate checks that cfg is complete and consistent.
+func (cfg *Config) Validate() error {
+	if cfg.General.LogDir == "" {
+		return fmt.Errorf("general.logdir is not set")
+	}
+	if cfg.General.Workers <= 0 {
+		return fmt.Errorf("general.workers must be positive, not %d", cfg.General.Workers)
+	}
+	if cfg.General.Verbosity < 0 {
+		return fmt.Errorf("general.verbosity must not be negative")
+	}
+	switch cfg.General.Recovery {
+	case "report", "resume", "rollback":
+	default:
+		return fmt.Errorf("general.recovery must be report, resume or rollback, not %q", cfg.General.Recovery)
+	}
+
+	if len(cfg.Depot.Root) == 0 {
+		return fmt.Errorf("depot.root is not set")
+	}
+	for _, root := range cfg.Depot.Root {
+		if root == "" {
+			return fmt.Errorf("depot.root has an empty entry")
+		}
+	}
+	if n := len(cfg.Depot.MaxSize); n != 1 && n != len(cfg.Depot.Root) {
+		return fmt.Errorf("depot has %d roots but %d max sizes", len(cfg.Depot.Root), n)
+	}
+	for _, size := range cfg.Depot.MaxSize {
+		if size <= 0 {
+			return fmt.Errorf("depot.maxsize must be positive, not %d", size)
+		}
+	}
+
+	if cfg.Index.Db == "" {
+		return fmt.Errorf("index.db is not set")
+	}
+	if cfg.Index.Dats == "" {
+		return fmt.Errorf("index.dats is not set")
+	}
+
+	if cfg.Server.Port <= 0 || cfg.Server.Port > 65535 {
+		return fmt.Errorf("server.port %d is out of range", cfg.Server.Port)
+	}
+	if (cfg.Server.TLSCert == "") != (cfg.Server.TLSKey == "") {
+		return fmt.Errorf("server.tlscert and server.tlskey must be set together")
+	}
+	if cfg.Server.ClientCA != "" && cfg.Server.TLSCert == "" {
+		return fmt.Errorf("server.clientca needs server.tlscert and server.tlskey")
+	}
+
+	if (cfg.Replica.Cert == "") != (cfg.Replica.Key == "") {
+		return fmt.Errorf("replica.cert and replica.key must be set together")
+	}
+
+	for _, u := range cfg.DatSync.URL {
+		pu, err := url.Parse(u)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			return fmt.Errorf("datsync.url %q is not an http or https URL", u)
+		}
+	}
+	dir := filepath.Clean(cfg.DatSync.Dir)
+	if filepath.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("datsync.dir must be a directory below index.dats, not %q", cfg.DatSync.Dir)
+	}
+	if cfg.DatSync.Keep < 0 {
+		return fmt.Errorf("datsync.keep must not be negative")
+	}
+	if cfg.DatSync.Interval < 0 {
+		return fmt.Errorf("datsync.interval must not be negative")
+	}
+
+	if cfg.Stats.Interval < 0 {
+		return fmt.Errorf("stats.interval must not be negative")
+	}
+	if cfg.Stats.Keep < 0 {
+		return fmt.Errorf("stats.keep must not be negative")
+	}
+
+	if cfg.Trash.Days < 0 {
+		return fmt.Errorf("trash.days must not be negative")
+	}
+
+	for _, u := range cfg.Notify.Webhook {
+		pu, err := url.Parse(u)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			return fmt.Errorf("notify.webhook %q is not an http or https URL", u)
+		}
+	}
+	if cfg.Notify.SMTP != "" {
+		if cfg.Notify.From == "" {
+			return fmt.Errorf("notify.smtp is set but notify.from is not")
+		}
+		if len(cfg.Notify.To) == 0 {
+			return fmt.Errorf("notify.smtp is set but notify.to is not")
+		}
+	}
+	if cfg.Notify.On != "all" && cfg.Notify.On != "failure" {
+		return fmt.Errorf("notify.on must be all or failure, not %q", cfg.Notify.On)
+	}
+
+	switch cfg.Log.Format {
+	case "glog", "json", "text":
+	default:
+		return fmt.Errorf("log.format must be glog, json or text, not %q", cfg.Log.Format)
+	}
+	_, err := cfg.LogLevels()
+	if err != nil {
+		return err
+	}
+
+	_, err = cfg.Tokens()
+	return err
+}
+
+// MaxSizes returns the max size in bytes of each depot root.
+func (cfg *Config) MaxSizes() []int64 {
+	sizes := make([]int64, len(cfg.Depot.Root))
+	for i := range sizes {
+		size := cfg.Depot.MaxSize[0]
+		if len(cfg.Depot.MaxSize) > 1 {
+			size = cfg.Depot.MaxSize[i]
+		}
+		sizes[i] = size * GB
+	}
+	return sizes
+}
+
+// LogLevels returns the levels of the subsystems in log.levels.
+func (cfg *Config) LogLevels() (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level)
+	for _, sl := range cfg.Log.Levels {
+		i := strings.Index(sl, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("log.levels entries must be subsystem=level, not %q", sl)
+		}
+		level, err := logging.ParseLevel(sl[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("log.levels: %v", err)
+		}
+		levels[strings.TrimSpace(sl[:i])] = level
+	}
+	return levels, nil
+}
+
+// Tokens returns the tokens of the users of the auth section.
+func (cfg *Config) Tokens() (*auth.Tokens, error) {
+	tokens := auth.NewTokens()
+	for _, section := range []struct {
+		key   string
+		users []string
+		role  auth.Role
+	}{
+		{"auth.admin", cfg.Auth.Admin, auth.Admin},
+		{"auth.operator", cfg.Auth.Operator, auth.Operator},
+		{"auth.readonly", cfg.Auth.ReadOnly, auth.ReadOnly},
+	} {
+		for _, user := range section.users {
+			i := strings.Index(user, ":")
+			if i <= 0 {
+				return nil, fmt.Errorf("%s entries must be name:token", section.key)
+			}
+			err := tokens.Add(user[i+1:], user[:i], section.role)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", section.key, err)
+			}
+		}
+	}
+	return tokens, nil
+}
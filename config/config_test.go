@@ -0,0 +1,260 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/logging"
+)
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTOML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeConfig(t, dir, "romba.toml", `
+# a comment
+[general]
+log_dir = "/var/log/romba"   # trailing comment
+Workers = 4
+hash-engine = 'parallel'
+recovery = "resume"
+chdman = "/opt/mame/chdman"
+
+[depot]
+root = [
+	"/mnt/a",
+	"/mnt/b\\depot",  # escaped backslash
+]
+maxsize = [1, 2_000]
+
+[index]
+db = "/var/lib/romba/db"
+dats = "/var/lib/romba/dats"
+backend = "kivi"
+
+[server]
+tls_cert = "/etc/romba/server.crt"
+tls_key = "/etc/romba/server.key"
+client_ca = "/etc/romba/ca.crt"
+
+[replica]
+accept_deletes = true
+ca = "/etc/romba/ca.crt"
+
+[datsync]
+url = ["https://example.org/dats/", "http://example.net/a.dat"]
+interval = 12
+
+[stats]
+interval = 6
+
+[trash]
+enabled = true
+days = 7
+
+[notify]
+webhook = ["https://discord.com/api/webhooks/1/x"]
+smtp = "localhost:25"
+from = "romba@example.org"
+to = ["me@example.org"]
+on = "failure"
+
+[log]
+format = "json"
+levels = ["archive=v2", "replica = warn"]
+
+[auth]
+admin = ["alice:0123456789abcdef0123"]
+read_only = ["club:fedcba9876543210fedc", "kids:00112233445566778899"]
+`)
+
+	found, err := Find(dir)
+	if err != nil || found != path {
+		t.Fatalf("found %s, %v, want %s", found, err, path)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Path() != path {
+		t.Errorf("got path %s, want %s", cfg.Path(), path)
+	}
+
+	if cfg.General.LogDir != "/var/log/romba" || cfg.General.Workers != 4 || cfg.General.HashEngine != "parallel" ||
+		cfg.General.Recovery != "resume" || cfg.General.Chdman != "/opt/mame/chdman" {
+		t.Errorf("got general %+v", cfg.General)
+	}
+	if !reflect.DeepEqual(cfg.Depot.Root, []string{"/mnt/a", `/mnt/b\depot`}) {
+		t.Errorf("got roots %q", cfg.Depot.Root)
+	}
+	if !reflect.DeepEqual(cfg.MaxSizes(), []int64{GB, 2000 * GB}) {
+		t.Errorf("got max sizes %v", cfg.MaxSizes())
+	}
+	if cfg.Index.Backend != "kivi" {
+		t.Errorf("got backend %q", cfg.Index.Backend)
+	}
+	if !cfg.Replica.AcceptDeletes || cfg.Replica.CA != "/etc/romba/ca.crt" {
+		t.Errorf("got replica %+v", cfg.Replica)
+	}
+	if cfg.Server.TLSKey != "/etc/romba/server.key" || cfg.Server.ClientCA != "/etc/romba/ca.crt" {
+		t.Errorf("got server %+v", cfg.Server)
+	}
+	if len(cfg.DatSync.URL) != 2 || cfg.DatSync.Interval != 12 || cfg.DatSync.Dir != "datsync" || cfg.DatSync.Keep != 5 {
+		t.Errorf("got datsync %+v", cfg.DatSync)
+	}
+	if cfg.Stats.Interval != 6 || cfg.Stats.Keep != 1000 {
+		t.Errorf("got stats %+v", cfg.Stats)
+	}
+	if !cfg.Trash.Enabled || cfg.Trash.Dir != "" || cfg.Trash.Days != 7 {
+		t.Errorf("got trash %+v", cfg.Trash)
+	}
+	if len(cfg.Notify.Webhook) != 1 || cfg.Notify.SMTP != "localhost:25" || len(cfg.Notify.To) != 1 || cfg.Notify.On != "failure" {
+		t.Errorf("got notify %+v", cfg.Notify)
+	}
+	levels, err := cfg.LogLevels()
+	if err != nil || cfg.Log.Format != "json" || levels["archive"] != logging.VLevel(2) || levels["replica"] != logging.LevelWarn {
+		t.Errorf("got log %+v, levels %v, error %v", cfg.Log, levels, err)
+	}
+	tokens, err := cfg.Tokens()
+	if err != nil || !tokens.Enabled() || len(cfg.Auth.ReadOnly) != 2 {
+		t.Errorf("got auth %+v, error %v", cfg.Auth, err)
+	}
+	// defaults
+	if cfg.Depot.Compression != "gzip" || cfg.Server.Port != 4200 {
+		t.Errorf("got compression %q and port %d, want the defaults", cfg.Depot.Compression, cfg.Server.Port)
+	}
+}
+
+func TestLoadINI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeConfig(t, dir, "romba.ini", `
+[general]
+logdir=/var/log/romba
+workers=2
+
+[index]
+dats=/var/lib/romba/dats
+db=/var/lib/romba/db
+
+[depot]
+root=/mnt/a
+root=/mnt/b
+maxsize=500
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.MaxSizes(), []int64{500 * GB, 500 * GB}) {
+		t.Errorf("got max sizes %v, want the single one for both roots", cfg.MaxSizes())
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := `
+[general]
+logdir = "/log"
+[index]
+db = "/db"
+dats = "/dats"
+[depot]
+root = ["/a", "/b"]
+maxsize = [1, 2]
+`
+
+	for _, test := range []struct {
+		content string
+		err     string
+	}{
+		{valid + "[server]\nport = 0\n", "server.port"},
+		{valid + "[server]\nport = \"80\"\n", "want an integer"},
+		{valid + "[server]\nhost = \"x\"\n", "unknown key host"},
+		{valid + "[clients]\n", "unknown section"},
+		{valid + "[depot]\n", "duplicated tables"},
+		{valid + "[Depot]\n", "defined twice"},
+		{"workers = 1\n" + valid, "outside of a section"},
+		{valid + "[stats]\nkeep = -1\n", "stats.keep"},
+		{valid + "[trash]\ndays = -1\n", "trash.days"},
+		{strings.Replace(valid, "[general]\n", "[general]\nrecovery = \"undo\"\n", 1), "general.recovery"},
+		{strings.Replace(valid, "[1, 2]", "[1, 2, 3]", 1), "3 max sizes"},
+		{strings.Replace(valid, `"/db"`, `"/db`, 1), "control character"},
+		{strings.Replace(valid, `db = "/db"`, "", 1), "index.db is not set"},
+		{valid + "[datsync]\nurl = [\"ftp://x/a.dat\"]\n", "not an http or https URL"},
+		{valid + "[datsync]\ndir = \"../dats\"\n", "below index.dats"},
+		{valid + "[server]\ntls_cert = \"server.crt\"\n", "set together"},
+		{valid + "[server]\nclient_ca = \"ca.crt\"\n", "needs server.tlscert"},
+		{valid + "[replica]\nkey = \"replica.key\"\n", "set together"},
+		{valid + "[notify]\nsmtp = \"localhost:25\"\nto = [\"me@example.org\"]\n", "notify.from is not"},
+		{valid + "[notify]\non = \"success\"\n", "all or failure"},
+		{valid + "[auth]\nadmin = [\"0123456789abcdef0123\"]\n", "name:token"},
+		{valid + "[auth]\noperator = [\"bob:secret\"]\n", "shorter than"},
+		{valid + "[auth]\nadmin = [\"a:0123456789abcdef\"]\nreadonly = [\"b:0123456789abcdef\"]\n", "also the one of a"},
+		{valid + "[log]\nformat = \"xml\"\n", "log.format"},
+		{valid + "[log]\nlevels = [\"archive\"]\n", "subsystem=level"},
+		{valid + "[log]\nlevels = [\"archive=loud\"]\n", "invalid log level"},
+	} {
+		path := writeConfig(t, dir, "romba.toml", test.content)
+		_, err := Load(path)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("got error %v, want one about %s", err, test.err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// readTOMLFile reads the TOML file at path into cfg.
+func readTOMLFile(cfg *Config, path string) error {
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	return decodeTOML(reflect.ValueOf(cfg).Elem(), tree)
+}
+
+// decodeTOML sets the fields of struct v from tree. Tables match the struct
+// fields of v, keys the fields of those.
+func decodeTOML(v reflect.Value, tree *toml.Tree) error {
+	seen := make(map[string]bool)
+	for _, name := range sortedKeys(tree) {
+		pos := tree.GetPositionPath([]string{name})
+		sub, ok := tree.GetPath([]string{name}).(*toml.Tree)
+		if !ok {
+			return fmt.Errorf("%v: key %s outside of a section", pos, name)
+		}
+		table := fieldByName(v, name)
+		if !table.IsValid() || table.Kind() != reflect.Struct {
+			return fmt.Errorf("%v: unknown section [%s]", pos, name)
+		}
+		tableName := normalizeName(name)
+		if seen[tableName] {
+			return fmt.Errorf("%v: section [%s] defined twice", pos, name)
+		}
+		seen[tableName] = true
+
+		for _, key := range sortedKeys(sub) {
+			pos := sub.GetPositionPath([]string{key})
+			field := fieldByName(table, key)
+			if !field.IsValid() {
+				return fmt.Errorf("%v: unknown key %s in section [%s]", pos, key, tableName)
+			}
+			fullName := tableName + "." + normalizeName(key)
+			if seen[fullName] {
+				return fmt.Errorf("%v: key %s set twice", pos, key)
+			}
+			seen[fullName] = true
+
+			err := setField(field, sub.GetPath([]string{key}))
+			if err != nil {
+				return fmt.Errorf("%v: key %s: %v", pos, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of tree in order, so errors are reported the
+// same way every time.
+func sortedKeys(tree *toml.Tree) []string {
+	keys := tree.Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+// fieldByName returns the exported field of struct v whose name matches name
+// ignoring case, underscores and dashes.
+func fieldByName(v reflect.Value, name string) reflect.Value {
+	name = normalizeName(name)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath == "" && normalizeName(f.Name) == name {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+func setField(field reflect.Value, val interface{}) error {
+	switch field.Kind() {
+	case reflect.String:
+		s, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("want a string, not %v", val)
+		}
+		field.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, ok := val.(int64)
+		if !ok {
+			return fmt.Errorf("want an integer, not %v", val)
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, ok := val.(bool)
+		if !ok {
+			return fmt.Errorf("want true or false, not %v", val)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		// a single value is taken as an array of one
+		vals, ok := val.([]interface{})
+		if !ok {
+			vals = []interface{}{val}
+		}
+		slice := reflect.MakeSlice(field.Type(), len(vals), len(vals))
+		for i, v := range vals {
+			err := setField(slice.Index(i), v)
+			if err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
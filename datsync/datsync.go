@@ -0,0 +1,587 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package datsync keeps dats in step with the places they are published at.
+// Dats are fetched from URLs of dat files, zips of dats or index pages linking
+// to them, and stored in a directory per host below the dats directory. Dats
+// replaced by a newer version or no longer published are moved into a history
+// directory, outside of the dats directory so they aren't indexed, with the
+// time they were replaced in their name.
+package datsync
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/romba/logging"
+	"github.com/uwedeportivo/romba/parser"
+)
+
+var logger = logging.For("datsync")
+
+const (
+	stateFileName = "datsync-state.json"
+	tmpPrefix     = ".datsync-"
+	// versionFormat is the time format in the names of old versions
+	versionFormat = "20060102-150405"
+)
+
+// MaxDatSize is the size of the largest dat or zip of dats fetched.
+var MaxDatSize int64 = 1 << 30
+
+// defaultClient fetches dats unless Options.Client is set. A server that
+// stops answering fails the URL rather than holding up the sync.
+var defaultClient = &http.Client{
+	Timeout: 30 * time.Minute,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// Options controls a sync.
+type Options struct {
+	// Dir is where dats are stored, below the dats directory.
+	Dir string
+	// HistoryDir is where replaced dats and the state of the sync go.
+	HistoryDir string
+	// Keep is the number of old versions kept of each dat.
+	Keep int
+	// Client fetches the dats, a client with timeouts if nil.
+	Client *http.Client
+}
+
+// Report sums up a sync. Dats are listed by their path relative to the
+// directory they are stored in.
+type Report struct {
+	Added     []string
+	Updated   []string
+	Removed   []string
+	Unchanged int
+	// Failed has an error for each URL that couldn't be synced.
+	Failed []string
+}
+
+// Changed reports whether any dat was added, updated or removed.
+func (r *Report) Changed() bool {
+	return len(r.Added)+len(r.Updated)+len(r.Removed) > 0
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("synced dats: %d added, %d updated, %d removed, %d unchanged, %d URLs failed",
+		len(r.Added), len(r.Updated), len(r.Removed), r.Unchanged, len(r.Failed))
+}
+
+// sourceState is what is remembered of a URL between syncs.
+type sourceState struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// Files are the dats stored from the URL.
+	Files []string `json:"files,omitempty"`
+	// Links are the dat URLs an index page linked to.
+	Links []string `json:"links,omitempty"`
+}
+
+type syncer struct {
+	opts   *Options
+	client *http.Client
+	// state is the state of the last sync, next the one of this sync.
+	// Index pages have their own entry, and one for each dat they link to
+	// keyed by the page and the dat URL.
+	state  map[string]*sourceState
+	next   map[string]*sourceState
+	stored map[string]string
+	report *Report
+	now    time.Time
+}
+
+// Sync fetches the dats published at urls into opts.Dir. URLs failing are
+// reported and leave their dats alone, an error is only returned if the sync
+// as a whole can't go on.
+func Sync(urls []string, opts *Options) (*Report, error) {
+	for _, dir := range []string{opts.Dir, opts.HistoryDir} {
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &syncer{
+		opts:   opts,
+		client: opts.Client,
+		next:   make(map[string]*sourceState),
+		stored: make(map[string]string),
+		report: new(Report),
+		now:    time.Now(),
+	}
+	if s.client == nil {
+		s.client = defaultClient
+	}
+
+	err := s.loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range urls {
+		ss, err := s.syncURL(u)
+		if err != nil {
+			logger.Errorf("datsync: failed to sync %s: %v", u, err)
+			s.report.Failed = append(s.report.Failed, fmt.Sprintf("%s: %v", u, err))
+			// keep what it had stored
+			for key, ss := range s.state {
+				if key == u || strings.HasPrefix(key, u+" ") {
+					s.next[key] = ss
+				}
+			}
+			continue
+		}
+		s.next[u] = ss
+	}
+
+	// dats no longer published by any URL still synced go into history,
+	// those of URLs taken out of the configuration as well
+	kept := make(map[string]bool)
+	for _, ss := range s.next {
+		for _, f := range ss.Files {
+			kept[f] = true
+		}
+	}
+	var removed []string
+	for _, ss := range s.state {
+		for _, f := range ss.Files {
+			if !kept[f] {
+				kept[f] = true
+				removed = append(removed, f)
+			}
+		}
+	}
+	sort.Strings(removed)
+	for _, f := range removed {
+		err := s.retire(f)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			s.report.Removed = append(s.report.Removed, f)
+		}
+	}
+
+	s.state = s.next
+	err = s.saveState()
+	if err != nil {
+		return nil, err
+	}
+	return s.report, nil
+}
+
+func (s *syncer) loadState() error {
+	s.state = make(map[string]*sourceState)
+
+	bs, err := ioutil.ReadFile(filepath.Join(s.opts.HistoryDir, stateFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, &s.state)
+}
+
+func (s *syncer) saveState() error {
+	bs, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(s.opts.HistoryDir, stateFileName)
+	err = ioutil.WriteFile(statePath+".tmp", bs, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(statePath+".tmp", statePath)
+}
+
+// haveFiles reports whether the dats stored from the URL of ss are still
+// there.
+func (s *syncer) haveFiles(ss *sourceState) bool {
+	for _, f := range ss.Files {
+		if _, err := os.Stat(filepath.Join(s.opts.Dir, f)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// fetch gets u, conditionally on it having changed since ss if ss isn't nil
+// and its dats are still there. It returns a nil response if it hasn't.
+func (s *syncer) fetch(u string, ss *sourceState) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	conditional := ss != nil && s.haveFiles(ss)
+	if conditional {
+		if ss.ETag != "" {
+			req.Header.Set("If-None-Match", ss.ETag)
+		}
+		if ss.LastModified != "" {
+			req.Header.Set("If-Modified-Since", ss.LastModified)
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotModified:
+		resp.Body.Close()
+		if !conditional {
+			return nil, fmt.Errorf("%s: %s to an unconditional request", u, resp.Status)
+		}
+		return nil, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+}
+
+func newSourceState(resp *http.Response) *sourceState {
+	return &sourceState{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+}
+
+func isIndexPage(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// syncURL syncs the dat or index page at u and returns its new state.
+func (s *syncer) syncURL(u string) (*sourceState, error) {
+	old := s.state[u]
+
+	resp, err := s.fetch(u, old)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp == nil {
+		if old.Links == nil {
+			s.report.Unchanged += len(old.Files)
+			return old, nil
+		}
+		// the page is the same, the dats it links to may not be
+		ss := *old
+		ss.Files, err = s.syncLinks(u, old.Links)
+		return &ss, err
+	}
+	defer resp.Body.Close()
+
+	ss := newSourceState(resp)
+
+	if isIndexPage(resp) {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+		if err != nil {
+			return nil, err
+		}
+		ss.Links, err = datLinks(resp.Request.URL, body)
+		if err != nil {
+			return nil, err
+		}
+		if len(ss.Links) == 0 {
+			return nil, fmt.Errorf("%s links to no dats", u)
+		}
+		ss.Files, err = s.syncLinks(u, ss.Links)
+		return ss, err
+	}
+
+	f, err := s.store(resp)
+	if err != nil {
+		return nil, err
+	}
+	ss.Files = []string{f}
+	return ss, nil
+}
+
+// syncLinks syncs the dats an index page at page links to, each remembered
+// on its own so unchanged ones aren't fetched again.
+func (s *syncer) syncLinks(page string, links []string) ([]string, error) {
+	var files []string
+	for _, link := range links {
+		key := page + " " + link
+		old := s.state[key]
+
+		resp, err := s.fetch(link, old)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp == nil {
+			s.report.Unchanged++
+			s.next[key] = old
+			files = append(files, old.Files...)
+			continue
+		}
+
+		ss := newSourceState(resp)
+		f, err := s.store(resp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		ss.Files = []string{f}
+		s.next[key] = ss
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+var hrefRE = regexp.MustCompile(`(?i)href\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// datLinks returns the URLs of the dats linked to by the HTML page body at
+// base, in the order they appear.
+func datLinks(base *url.URL, body []byte) ([]string, error) {
+	var links []string
+	seen := make(map[string]bool)
+
+	for _, m := range hrefRE.FindAllSubmatch(body, -1) {
+		href := string(bytes.Join(m[1:], nil))
+		href = strings.NewReplacer("&amp;", "&").Replace(href)
+
+		ref, err := url.Parse(href)
+		if err != nil {
+			continue
+		}
+		u := base.ResolveReference(ref)
+		u.Fragment = ""
+		if u.Scheme != "http" && u.Scheme != "https" {
+			continue
+		}
+		if !parser.IsDatFile(u.Path) {
+			continue
+		}
+
+		link := u.String()
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+// fileName returns the name to store the dat of resp under.
+func fileName(resp *http.Response) (string, error) {
+	var name string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = path.Base(resp.Request.URL.Path)
+	}
+
+	name = filepath.Base(filepath.FromSlash(name))
+	if name == "." || name == ".." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("%s has no usable file name", resp.Request.URL)
+	}
+	if !parser.IsDatFile(name) {
+		return "", fmt.Errorf("%s is not a dat or a zip of dats", name)
+	}
+	return name, nil
+}
+
+// store stores the dat in resp in the directory of its host, replacing the
+// version stored before if it differs. It returns the path of the dat relative
+// to the sync directory.
+func (s *syncer) store(resp *http.Response) (string, error) {
+	name, err := fileName(resp)
+	if err != nil {
+		return "", err
+	}
+
+	host := strings.Replace(resp.Request.URL.Host, ":", "_", -1)
+	rel := filepath.Join(host, name)
+	if other, ok := s.stored[rel]; ok {
+		return "", fmt.Errorf("%s is stored as %s already, from %s", resp.Request.URL, rel, other)
+	}
+	s.stored[rel] = resp.Request.URL.String()
+	if resp.ContentLength > MaxDatSize {
+		return "", fmt.Errorf("%s is %d bytes, more than the %d accepted", resp.Request.URL, resp.ContentLength, MaxDatSize)
+	}
+	dir := filepath.Join(s.opts.Dir, host)
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(dir, tmpPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha1.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(resp.Body, MaxDatSize+1))
+	if err == nil && n > MaxDatSize {
+		err = fmt.Errorf("%s is more than the %d bytes accepted", resp.Request.URL, MaxDatSize)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(s.opts.Dir, rel)
+	oldSha1, err := fileSha1(dest)
+	switch {
+	case os.IsNotExist(err):
+		s.report.Added = append(s.report.Added, rel)
+	case err != nil:
+		return "", err
+	case bytes.Equal(oldSha1, h.Sum(nil)):
+		s.report.Unchanged++
+		return rel, nil
+	default:
+		err = s.retire(rel)
+		if err != nil {
+			return "", err
+		}
+		s.report.Updated = append(s.report.Updated, rel)
+	}
+
+	return rel, os.Rename(tmp.Name(), dest)
+}
+
+func fileSha1(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha1.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// retire moves the dat rel into the history directory and drops its oldest
+// versions beyond the ones kept.
+func (s *syncer) retire(rel string) error {
+	ext := filepath.Ext(rel)
+	stem := strings.TrimSuffix(rel, ext)
+	histPath := filepath.Join(s.opts.HistoryDir, stem+"."+s.now.Format(versionFormat)+ext)
+
+	err := os.MkdirAll(filepath.Dir(histPath), 0777)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(filepath.Join(s.opts.Dir, rel), histPath)
+	if err != nil {
+		return err
+	}
+
+	return s.prune(rel)
+}
+
+// Versions returns the paths of the old versions of the dat rel kept in
+// historyDir, oldest first.
+func Versions(historyDir, rel string) ([]string, error) {
+	ext := filepath.Ext(rel)
+	stem := filepath.Base(strings.TrimSuffix(rel, ext))
+	dir := filepath.Join(historyDir, filepath.Dir(rel))
+
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasPrefix(name, stem+".") || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, stem+"."), ext)
+		if _, err := time.Parse(versionFormat, stamp); err != nil {
+			continue
+		}
+		// the time format sorts by name
+		versions = append(versions, filepath.Join(dir, name))
+	}
+	return versions, nil
+}
+
+func (s *syncer) prune(rel string) error {
+	versions, err := Versions(s.opts.HistoryDir, rel)
+	if err != nil {
+		return err
+	}
+
+	for len(versions) > s.opts.Keep {
+		err = os.Remove(versions[0])
+		if err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package datsync
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// datServer serves files with ETags, and counts the full responses.
+type datServer struct {
+	lock  sync.Mutex
+	files map[string]string
+	sent  int
+}
+
+func (ds *datServer) set(path, contents string) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if contents == "" {
+		delete(ds.files, path)
+	} else {
+		ds.files[path] = contents
+	}
+}
+
+func (ds *datServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	contents, ok := ds.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum([]byte(contents)))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if filepath.Ext(r.URL.Path) == ".html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("ETag", etag)
+	ds.sent++
+	w.Write([]byte(contents))
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-datsync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &datServer{files: map[string]string{
+		"/dats/a.dat": "dat a",
+		"/index.html": `<a href="dats/b.xml">b</a> <A HREF='/dats/c.zip#x'>c</A> <a href=readme.txt>no dat</a>`,
+		"/dats/b.xml": "dat b",
+		"/dats/c.zip": "zip c",
+	}}
+	server := httptest.NewServer(ds)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostDir := func(name string) string {
+		return filepath.Join(strings.Replace(u.Host, ":", "_", -1), name)
+	}
+
+	opts := &Options{
+		Dir:        filepath.Join(dir, "dats", "datsync"),
+		HistoryDir: filepath.Join(dir, "history"),
+		Keep:       1,
+	}
+	urls := []string{server.URL + "/dats/a.dat", server.URL + "/index.html"}
+
+	report, err := Sync(urls, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{hostDir("a.dat"), hostDir("b.xml"), hostDir("c.zip")}
+	if !reflect.DeepEqual(report.Added, want) || report.Failed != nil {
+		t.Fatalf("first sync got %+v, want %v added", report, want)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(opts.Dir, hostDir("b.xml")))
+	if err != nil || string(contents) != "dat b" {
+		t.Errorf("b.xml holds %q, %v", contents, err)
+	}
+
+	sent := ds.sent
+	report, err = Sync(urls, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Changed() || report.Unchanged != 3 || ds.sent != sent {
+		t.Errorf("unchanged sync got %+v with %d full responses", report, ds.sent-sent)
+	}
+
+	ds.set("/dats/a.dat", "dat a, version 2")
+	ds.set("/index.html", `<a href="dats/b.xml">b</a>`)
+	report, err = Sync(urls, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Updated, []string{hostDir("a.dat")}) ||
+		!reflect.DeepEqual(report.Removed, []string{hostDir("c.zip")}) || report.Added != nil {
+		t.Errorf("changed sync got %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(opts.Dir, hostDir("c.zip"))); !os.IsNotExist(err) {
+		t.Errorf("removed dat still there: %v", err)
+	}
+
+	for _, rel := range []string{hostDir("a.dat"), hostDir("c.zip")} {
+		versions, err := Versions(opts.HistoryDir, rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 1 {
+			t.Errorf("%s has versions %v, want 1", rel, versions)
+		}
+	}
+
+	// an older version beyond the kept one goes
+	older := filepath.Join(opts.HistoryDir, hostDir("a.20000101-000000.dat"))
+	err = ioutil.WriteFile(older, []byte("dat a, version 0"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.set("/dats/a.dat", "dat a, version 3")
+	ds.set("/dats/b.xml", "")
+	report, err = Sync(urls, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 1 || !reflect.DeepEqual(report.Updated, []string{hostDir("a.dat")}) {
+		t.Errorf("sync with failing URL got %+v", report)
+	}
+	if _, err := os.Stat(older); !os.IsNotExist(err) {
+		t.Errorf("old version beyond the kept ones still there: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(opts.Dir, hostDir("b.xml"))); err != nil {
+		t.Errorf("dat of failing URL removed: %v", err)
+	}
+}
+
+
+func TestSyncMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-datsync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(max int64) { MaxDatSize = max }(MaxDatSize)
+	MaxDatSize = 5
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.URL.Path == "/chunked.dat" {
+			// no Content-Length, the size shows while reading
+			w.Write([]byte("dat "))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("bb"))
+			return
+		}
+		w.Write([]byte(strings.TrimSuffix(path.Base(r.URL.Path), ".dat")))
+	}))
+	defer server.Close()
+
+	opts := &Options{
+		Dir:        filepath.Join(dir, "dats", "datsync"),
+		HistoryDir: filepath.Join(dir, "history"),
+	}
+	report, err := Sync([]string{server.URL + "/small.dat", server.URL + "/toolarge.dat", server.URL + "/chunked.dat"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != 1 || len(report.Failed) != 2 {
+		t.Errorf("got %+v, want one dat added and two failed", report)
+	}
+	for _, f := range report.Failed {
+		if !strings.Contains(f, "accepted") {
+			t.Errorf("unexpected failure %s", f)
+		}
+	}
+}
@@ -40,7 +40,7 @@ var rOptions *levigo.ReadOptions = levigo.NewReadOptions()
 var wOptions *levigo.WriteOptions = levigo.NewWriteOptions()
 
 func init() {
-	db.StoreOpener = openDb
+	db.RegisterStore("leveldb", openDb)
 }
 
 func openDb(path string, keySize int) (db.KVStore, error) {
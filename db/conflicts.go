@@ -0,0 +1,275 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// Kinds of conflicts between the roms of dats.
+const (
+	// ConflictName is a rom of a game defined with different contents by
+	// two dats, or by two games of the same name in one dat.
+	ConflictName = "name"
+	// ConflictSize is a rom defined with the same SHA1 and different sizes.
+	ConflictSize = "size"
+)
+
+// maxConflicts is the most conflicts a report holds, the ones after it are
+// only counted.
+const maxConflicts = 10000
+
+// ConflictRom is a rom involved in a conflict, with hex encoded hashes.
+type ConflictRom struct {
+	Dat  string `json:"dat"`
+	Game string `json:"game"`
+	Rom  string `json:"rom"`
+	Size int64  `json:"size"`
+	Crc  string `json:"crc,omitempty"`
+	Sha1 string `json:"sha1,omitempty"`
+}
+
+func (cr *ConflictRom) String() string {
+	return fmt.Sprintf("%s: %s/%s (size %d, crc %s, sha1 %s)", cr.Dat, cr.Game, cr.Rom, cr.Size, cr.Crc, cr.Sha1)
+}
+
+// Conflict is a rom defined one way first and another way later.
+type Conflict struct {
+	Kind  string       `json:"kind"`
+	First *ConflictRom `json:"first"`
+	Other *ConflictRom `json:"other"`
+}
+
+func (c *Conflict) String() string {
+	return fmt.Sprintf("%s conflict: %v\n  vs %v", c.Kind, c.First, c.Other)
+}
+
+// ConflictReport is the outcome of checking the dats of a refresh for
+// conflicts.
+type ConflictReport struct {
+	Time      time.Time   `json:"time"`
+	Conflicts []*Conflict `json:"conflicts"`
+	// Dropped counts the conflicts left out past maxConflicts.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+func (cr *ConflictReport) String() string {
+	return fmt.Sprintf("found %d rom conflicts between dats", len(cr.Conflicts)+cr.Dropped)
+}
+
+// Write writes cr as JSON to the file path.
+func (cr *ConflictReport) Write(path string) error {
+	bs, err := json.MarshalIndent(cr, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".tmp", bs, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ReadConflictReport reads the report written by Write to path, it returns nil
+// if there is none.
+func ReadConflictReport(path string) (*ConflictReport, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	cr := new(ConflictReport)
+	err = json.Unmarshal(bs, cr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conflict report %s: %v", path, err)
+	}
+	return cr, nil
+}
+
+// conflictRef is what the checker remembers of a rom, the dat it is from is
+// an index into ConflictChecker.dats.
+type conflictRef struct {
+	dat  int32
+	size int64
+	crc  []byte
+	sha1 []byte
+	game string
+	rom  string
+}
+
+// sameContents reports whether a and b have the same contents going by the
+// best hash both have, roms without common hashes can't be told apart.
+func (a *conflictRef) sameContents(b *conflictRef) bool {
+	switch {
+	case a.sha1 != nil && b.sha1 != nil:
+		return bytes.Equal(a.sha1, b.sha1)
+	case a.crc != nil && b.crc != nil:
+		return bytes.Equal(a.crc, b.crc) && a.size == b.size
+	}
+	return true
+}
+
+// ConflictChecker collects the conflicts between the roms of the dats added
+// to it. It is safe for concurrent use. It keeps every rom name and SHA1 seen,
+// so it takes memory in proportion to the dats checked.
+type ConflictChecker struct {
+	mutex  sync.Mutex
+	dats   []string
+	datIDs map[string]int32
+	// byName holds the different contents seen for game/rom names, bySha1
+	// the first rom seen with a SHA1
+	byName map[string][]*conflictRef
+	bySha1 map[string]*conflictRef
+	report *ConflictReport
+}
+
+// NewConflictChecker returns a checker without dats.
+func NewConflictChecker() *ConflictChecker {
+	return &ConflictChecker{
+		datIDs: make(map[string]int32),
+		byName: make(map[string][]*conflictRef),
+		bySha1: make(map[string]*conflictRef),
+		report: new(ConflictReport),
+	}
+}
+
+// AddGame checks the roms of game g of the dat at datPath against the ones
+// added before.
+func (cc *ConflictChecker) AddGame(datPath string, g *types.Game) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	id, ok := cc.datIDs[datPath]
+	if !ok {
+		id = int32(len(cc.dats))
+		cc.dats = append(cc.dats, datPath)
+		cc.datIDs[datPath] = id
+	}
+
+	for _, rom := range g.AllRoms() {
+		if rom.NoDump() {
+			continue
+		}
+
+		ref := &conflictRef{
+			dat:  id,
+			size: rom.Size,
+			crc:  rom.Crc,
+			sha1: rom.Sha1,
+			game: g.Name,
+			rom:  rom.Name,
+		}
+
+		key := g.Name + "/" + rom.Name
+		refs := cc.byName[key]
+		known := false
+		for _, r := range refs {
+			if r.sameContents(ref) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			if len(refs) > 0 {
+				cc.add(ConflictName, refs[0], ref)
+			}
+			cc.byName[key] = append(refs, ref)
+		}
+
+		if rom.Sha1 != nil {
+			first := cc.bySha1[string(rom.Sha1)]
+			switch {
+			case first == nil:
+				cc.bySha1[string(rom.Sha1)] = ref
+			case first.size > 0 && ref.size > 0 && first.size != ref.size:
+				cc.add(ConflictSize, first, ref)
+			}
+		}
+	}
+}
+
+func (cc *ConflictChecker) add(kind string, first, other *conflictRef) {
+	if len(cc.report.Conflicts) >= maxConflicts {
+		cc.report.Dropped++
+		return
+	}
+	cc.report.Conflicts = append(cc.report.Conflicts, &Conflict{
+		Kind:  kind,
+		First: cc.conflictRom(first),
+		Other: cc.conflictRom(other),
+	})
+}
+
+func (cc *ConflictChecker) conflictRom(ref *conflictRef) *ConflictRom {
+	return &ConflictRom{
+		Dat:  cc.dats[ref.dat],
+		Game: ref.game,
+		Rom:  ref.rom,
+		Size: ref.size,
+		Crc:  hex.EncodeToString(ref.crc),
+		Sha1: hex.EncodeToString(ref.sha1),
+	}
+}
+
+// Report returns the conflicts found so far, ordered by kind and rom.
+func (cc *ConflictChecker) Report() *ConflictReport {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cr := &ConflictReport{
+		Time:      time.Now(),
+		Conflicts: append([]*Conflict(nil), cc.report.Conflicts...),
+		Dropped:   cc.report.Dropped,
+	}
+	sort.SliceStable(cr.Conflicts, func(i, j int) bool {
+		a, b := cr.Conflicts[i], cr.Conflicts[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return strings.ToLower(a.Other.Game+"/"+a.Other.Rom) < strings.ToLower(b.Other.Game+"/"+b.Other.Rom)
+	})
+	return cr
+}
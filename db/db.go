@@ -33,28 +33,38 @@ package db
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/golang/glog"
-
+	"github.com/uwedeportivo/romba/logging"
 	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/types"
 	"github.com/uwedeportivo/romba/worker"
 )
 
+var logger = logging.For("db")
+
 const (
 	generationFilename = "romba-generation"
 	MaxBatchSize       = 10485760
 )
 
+// GameStream passes the games of a dat to yield one at a time and returns the
+// dat without them and the SHA1 of the dat file, see parser.ParseXmlStream.
+type GameStream func(yield func(g *types.Game) error) (*types.Dat, []byte, error)
+
 type RomBatch interface {
 	IndexRom(rom *types.Rom) error
 	IndexDat(dat *types.Dat, sha1 []byte) error
+	// IndexDatStream indexes the dat a game at a time, in flat memory.
+	IndexDatStream(stream GameStream) error
 	Size() int64
 	Flush() error
 	Close() error
@@ -65,14 +75,37 @@ type RomDB interface {
 	IndexRom(rom *types.Rom) error
 	IndexDat(dat *types.Dat, sha1 []byte) error
 	OrphanDats() error
+	// OrphanDatsUnder orphans the current dats at path, a dat file or a
+	// directory, and below it and returns how many it orphaned.
+	OrphanDatsUnder(path string) (int, error)
+	// DatPathsUnder returns the paths of the current dats at path, a dat
+	// file or a directory, and below it, like the dats in a zip file. Dats
+	// indexed before version 3 of the DB are only known after the next full
+	// refresh.
+	DatPathsUnder(path string) ([]string, error)
+	Generation() int64
 	Flush()
 	Close() error
 	GetDat(sha1 []byte) (*types.Dat, error)
 	DatsForRom(rom *types.Rom) ([]*types.Dat, error)
 	CompleteRom(rom *types.Rom) error
+	// CompleteSample fills in the SHA1 of rom, the sample file of sample set
+	// set, from the sample set dats indexed. It is left nil if unknown.
+	CompleteSample(set string, rom *types.Rom) error
 	BeginDatRefresh() error
 	EndDatRefresh() error
+	// EndFullRefresh records that a refresh of all the dats completed, see
+	// RefreshPending.
+	EndFullRefresh() error
+	// Pause flushes the DB and holds off writes to it until resume is
+	// called, so its files can be copied consistently.
+	Pause() (resume func())
 	PrintStats() string
+	// DatFlags returns the flags set on dats, by dat path.
+	DatFlags() (map[string]types.DatFlags, error)
+	// SetDatFlags sets the flags of the dat at path, clearing them if flags
+	// is zero. Dats returned by GetDat and DatsForRom carry their flags.
+	SetDatFlags(path string, flags types.DatFlags) error
 }
 
 var DBFactory func(path string) (RomDB, error)
@@ -116,15 +149,30 @@ func Upd(key, value, old []byte) ([]byte, bool, error) {
 	return append(old, value...), true, nil
 }
 
+// New opens the DB at path, upgrading it to the current Version first after
+// backing it up.
 func New(path string) (RomDB, error) {
-	glog.Infof("Loading DB")
+	from, err := Migrate(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := RefreshPending(path)
+	if err != nil {
+		return nil, err
+	}
+	if pending && from == Version {
+		logger.Warningf("DB %s was upgraded and still needs a full refresh-dats to complete it", path)
+	}
+
+	logger.Infof("Loading DB")
 	startTime := time.Now()
 
 	db, err := DBFactory(path)
 
 	elapsed := time.Since(startTime)
 
-	glog.Infof("Done Loading DB in %s", FormatDuration(elapsed))
+	logger.Infof("Done Loading DB in %s", FormatDuration(elapsed))
 
 	return db, err
 }
@@ -166,22 +214,98 @@ func ReadGenerationFile(root string) (int64, error) {
 }
 
 type refreshWorker struct {
+	pm       *refreshMaster
 	romBatch RomBatch
 }
 
 func (pw *refreshWorker) Process(path string, size int64) error {
 	if pw.romBatch.Size() >= MaxBatchSize {
-		glog.Infof("flushing batch of size %d", pw.romBatch.Size())
+		logger.Infof("flushing batch of size %d", pw.romBatch.Size())
 		err := pw.romBatch.Flush()
 		if err != nil {
 			return fmt.Errorf("failed to flush: %v", err)
 		}
 	}
-	dat, sha1Bytes, err := parser.Parse(path)
+	if !parser.IsContainer(path) {
+		format, _, err := parser.DetectFile(path)
+		if err != nil {
+			return err
+		}
+		if format == parser.FormatUnknown {
+			logger.Warningf("skipping %s, it is not a dat of a known format", path)
+			return worker.Skip("unknown format")
+		}
+	}
+
+	streamable, err := parser.Streamable(path)
 	if err != nil {
 		return err
 	}
-	return pw.romBatch.IndexDat(dat, sha1Bytes)
+	if streamable {
+		return pw.indexStreamed(path)
+	}
+
+	dats, sha1s, warnings, err := parser.ParseAllFiltered(path, pw.pm.keep)
+	if _, ok := err.(*parser.NoDatsError); ok {
+		logger.Warningf("skipping %s, it holds no dats", path)
+		return worker.Skip("no dats")
+	}
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		logger.Warningf("skipped over %v: %q", w, w.Snippet)
+	}
+	for i, dat := range dats {
+		err = pw.romBatch.IndexDat(dat, pw.pm.datKey(sha1s[i]))
+		if err != nil {
+			return err
+		}
+		if pw.pm.conflicts != nil {
+			for _, g := range dat.Games {
+				pw.pm.conflicts.AddGame(dat.Path, g)
+			}
+		}
+	}
+	return nil
+}
+
+// indexStreamed indexes the XML dat path while it is parsed, which hashes it
+// too.
+func (pw *refreshWorker) indexStreamed(path string) error {
+	err := pw.romBatch.IndexDatStream(func(yield func(g *types.Game) error) (*types.Dat, []byte, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer file.Close()
+
+		keep := pw.pm.keep
+		conflicts := pw.pm.conflicts
+		dat, sha1Bytes, err := parser.ParseXmlStream(file, path, func(g *types.Game) error {
+			if keep != nil && !keep(g) {
+				return nil
+			}
+			if conflicts != nil {
+				conflicts.AddGame(path, g)
+			}
+			return yield(g)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// nothing is stored before the stream ends
+		err = parser.VerifySidecar(path, sha1Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return dat, pw.pm.datKey(sha1Bytes), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index dat %s: %v", path, err)
+	}
+	return nil
 }
 
 func (pw *refreshWorker) Close() error {
@@ -194,15 +318,32 @@ type refreshMaster struct {
 	romdb      RomDB
 	numWorkers int
 	pt         worker.ProgressTracker
+	keep       types.GameFilter
+	// filterKey is the key of the filter keep is from, see datKey.
+	filterKey string
+	conflicts *ConflictChecker
+}
+
+// datKey returns the key a dat with sha1Bytes is indexed under. Dats with only
+// the games of a filter aren't the dats of their files, so they are keyed by
+// the filter too.
+func (pm *refreshMaster) datKey(sha1Bytes []byte) []byte {
+	if pm.filterKey == "" {
+		return sha1Bytes
+	}
+	h := sha1.New()
+	h.Write(sha1Bytes)
+	io.WriteString(h, pm.filterKey)
+	return h.Sum(nil)
 }
 
 func (pm *refreshMaster) Accept(path string) bool {
-	ext := filepath.Ext(path)
-	return ext == ".dat" || ext == ".xml"
+	return parser.IsDatFile(path)
 }
 
 func (pm *refreshMaster) NewWorker(workerIndex int) worker.Worker {
 	return &refreshWorker{
+		pm:       pm,
 		romBatch: pm.romdb.StartBatch(),
 	}
 }
@@ -225,19 +366,62 @@ func (pm *refreshMaster) Start() error {
 	return pm.romdb.BeginDatRefresh()
 }
 
-func (pm *refreshMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+func (pm *refreshMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	return nil
+}
 
-func Refresh(romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTracker) (string, error) {
+// Refresh indexes the dats under datsPath, with only the games filter keeps
+// if it isn't nil. Filtered dats are keyed apart from their whole dats, see
+// refreshMaster.datKey. The games indexed are checked for conflicts with
+// conflicts if it isn't nil. Only an unfiltered refresh completes the
+// upgrades needing one, see RomDB.EndFullRefresh.
+func Refresh(romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTracker, filter *parser.Filter,
+	conflicts *ConflictChecker) (string, error) {
 	err := romdb.OrphanDats()
 	if err != nil {
 		return "", err
 	}
 
+	endMsg, err := refresh(romdb, []string{datsPath}, numWorkers, pt, filter, conflicts)
+	if err != nil || filter != nil {
+		return endMsg, err
+	}
+	return endMsg, romdb.EndFullRefresh()
+}
+
+// RefreshPaths indexes the dats at paths, dat files or directories below the
+// dats directory, and leaves the other dats as they are. The dats indexed at
+// paths before are orphaned first, so those removed or changed since don't
+// stay current. filter and conflicts are as for Refresh, conflicts are only
+// checked among the dats at paths.
+func RefreshPaths(romdb RomDB, paths []string, numWorkers int, pt worker.ProgressTracker, filter *parser.Filter,
+	conflicts *ConflictChecker) (string, error) {
+	orphaned := 0
+	for _, path := range paths {
+		n, err := romdb.OrphanDatsUnder(path)
+		if err != nil {
+			return "", err
+		}
+		orphaned += n
+	}
+	logger.Infof("orphaned %d dats to refresh %s", orphaned, strings.Join(paths, ", "))
+
+	return refresh(romdb, paths, numWorkers, pt, filter, conflicts)
+}
+
+func refresh(romdb RomDB, paths []string, numWorkers int, pt worker.ProgressTracker, filter *parser.Filter,
+	conflicts *ConflictChecker) (string, error) {
 	pm := &refreshMaster{
 		romdb:      romdb,
 		numWorkers: numWorkers,
 		pt:         pt,
+		conflicts:  conflicts,
+	}
+	if filter != nil {
+		pm.keep = filter.GameFilter()
+		pm.filterKey = filter.Key()
 	}
 
-	return worker.Work("refresh dats", []string{datsPath}, pm)
+	res, err := worker.Work("refresh dats", paths, pm)
+	return res.Message, err
 }
@@ -0,0 +1,183 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package db
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+const (
+	datFlagsDBName = "datflags_db"
+	// legacyDatFlagsFilename is the file of the DB directory the flags were
+	// kept in before version 4, moved into the store when opened.
+	legacyDatFlagsFilename = "romba-dat-flags.json"
+)
+
+// datFlagsKey is the key the flags of all dats are stored under, as JSON by
+// dat path.
+var datFlagsKey = sha1.Sum([]byte("dat flags"))
+
+// datFlags are the flags set on dats by dat path, kept in a store of their
+// own so they outlive refreshes reindexing the dats.
+type datFlags struct {
+	store KVStore
+	lock  sync.Mutex
+	flags map[string]types.DatFlags
+}
+
+func openDatFlags(root string) (*datFlags, error) {
+	store, err := openDb(filepath.Join(root, datFlagsDBName), keySizeSha1)
+	if err != nil {
+		return nil, err
+	}
+
+	df := &datFlags{
+		store: store,
+		flags: make(map[string]types.DatFlags),
+	}
+
+	bs, err := store.Get(datFlagsKey[:])
+	if err == nil && bs != nil {
+		err = json.Unmarshal(bs, &df.flags)
+	}
+	if err == nil {
+		err = df.importLegacy(filepath.Join(root, legacyDatFlagsFilename))
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return df, nil
+}
+
+// importLegacy moves the flags of the file at path into the store.
+func (df *datFlags) importLegacy(path string) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	legacy := make(map[string]types.DatFlags)
+	err = json.Unmarshal(bs, &legacy)
+	if err != nil {
+		return err
+	}
+	for path, f := range legacy {
+		if _, ok := df.flags[path]; !ok {
+			df.flags[path] = f
+		}
+	}
+
+	err = df.write()
+	if err != nil {
+		return err
+	}
+	logger.Infof("moved the flags of %d dats from %s into the DB", len(legacy), path)
+	return os.Remove(path)
+}
+
+func (df *datFlags) get(path string) types.DatFlags {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	return df.flags[path]
+}
+
+func (df *datFlags) all() map[string]types.DatFlags {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	flags := make(map[string]types.DatFlags, len(df.flags))
+	for path, f := range df.flags {
+		flags[path] = f
+	}
+	return flags
+}
+
+func (df *datFlags) set(path string, flags types.DatFlags) error {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	old, had := df.flags[path]
+	if flags == (types.DatFlags{}) {
+		delete(df.flags, path)
+	} else {
+		df.flags[path] = flags
+	}
+
+	err := df.write()
+	if err != nil {
+		if had {
+			df.flags[path] = old
+		} else {
+			delete(df.flags, path)
+		}
+	}
+	return err
+}
+
+// write stores the flags. The caller holds the lock of df, if needed.
+func (df *datFlags) write() error {
+	bs, err := json.Marshal(df.flags)
+	if err != nil {
+		return err
+	}
+
+	err = df.store.Set(datFlagsKey[:], bs)
+	if err != nil {
+		return err
+	}
+	df.store.Flush()
+	return nil
+}
+
+// DatFlags returns the flags set on dats, by dat path.
+func (kvdb *kvStore) DatFlags() (map[string]types.DatFlags, error) {
+	return kvdb.flags.all(), nil
+}
+
+// SetDatFlags sets the flags of the dat at path, clearing them if flags is
+// zero.
+func (kvdb *kvStore) SetDatFlags(path string, flags types.DatFlags) error {
+	kvdb.writeLock.RLock()
+	defer kvdb.writeLock.RUnlock()
+
+	return kvdb.flags.set(path, flags)
+}
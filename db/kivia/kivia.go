@@ -32,12 +32,31 @@ package kivia
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+
 	"github.com/uwedeportivo/romba/db"
 	"github.com/uwedeportivo/romba/kivi"
 )
 
 func init() {
-	db.StoreOpener = openDb
+	db.RegisterStore("kivi", openDb)
+}
+
+var (
+	// traceDir is where stores write the traces of their lookups, see
+	// EnableTrace.
+	traceDir   string
+	traceCalls int
+)
+
+// EnableTrace makes the stores opened after it trace their lookups and
+// write the traces into dir when closed, as <store>-trace.pprof with the
+// time taken by each phase of all lookups and <store>-trace.csv with up to
+// maxCalls lookups.
+func EnableTrace(dir string, maxCalls int) {
+	traceDir = dir
+	traceCalls = maxCalls
 }
 
 func openDb(path string, keySize int) (db.KVStore, error) {
@@ -46,13 +65,22 @@ func openDb(path string, keySize int) (db.KVStore, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open db at %s: %v\n", path, err)
 	}
-	return &store{
-		dbn: dbn,
-	}, nil
+
+	s := &store{
+		dbn:  dbn,
+		name: filepath.Base(path),
+	}
+	if traceDir != "" {
+		s.trace = kivi.NewTrace(traceCalls)
+		dbn.SetTrace(s.trace)
+	}
+	return s, nil
 }
 
 type store struct {
-	dbn *kivi.DB
+	dbn   *kivi.DB
+	name  string
+	trace *kivi.Trace
 }
 
 func (s *store) Flush() {
@@ -102,7 +130,43 @@ func (s *store) WriteBatch(b db.KVBatch) error {
 }
 
 func (s *store) Close() error {
-	return s.dbn.Close()
+	err := s.dbn.Close()
+	if err != nil {
+		return err
+	}
+	if s.trace == nil {
+		return nil
+	}
+	return s.writeTrace()
+}
+
+func (s *store) writeTrace() error {
+	err := os.MkdirAll(traceDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range []struct {
+		suffix string
+		write  func(f *os.File) error
+	}{
+		{"-trace.pprof", func(f *os.File) error { return s.trace.WriteProfile(f) }},
+		{"-trace.csv", func(f *os.File) error { return s.trace.WriteCSV(f) }},
+	} {
+		f, err := os.Create(filepath.Join(traceDir, s.name+t.suffix))
+		if err != nil {
+			return err
+		}
+
+		err = t.write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *store) BeginRefresh() error {
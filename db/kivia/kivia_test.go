@@ -0,0 +1,596 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package kivia
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func testDat(name, crc string) string {
+	return fmt.Sprintf(`
+clrmamepro (
+	name "%s"
+	description "%s"
+)
+
+game (
+	name "game"
+	description "game"
+	rom ( name "game.bin" size 4 crc %s )
+)
+`, name, name, crc)
+}
+
+func TestRefreshPaths(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-kivia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = db.SetStore("kivi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir := filepath.Join(root, "db")
+	datsDir := filepath.Join(root, "dats")
+
+	texts := map[string]string{
+		"a/a.dat": testDat("a", "11111111"),
+		"b/b.dat": testDat("b", "22222222"),
+	}
+	for _, dir := range []string{dbDir, filepath.Join(datsDir, "a"), filepath.Join(datsDir, "b")} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDat := func(name string) {
+		err := ioutil.WriteFile(filepath.Join(datsDir, name), []byte(texts[name]), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDat("a/a.dat")
+	writeDat("b/b.dat")
+
+	romdb, err := db.NewKVStoreDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer romdb.Close()
+
+	_, err = db.Refresh(romdb, datsDir, 1, worker.NewProgressTracker(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generation := func(text string) int64 {
+		t.Helper()
+		sum := sha1.Sum([]byte(text))
+		dat, err := romdb.GetDat(sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dat == nil {
+			t.Fatalf("dat %q not indexed", text)
+		}
+		return dat.Generation
+	}
+
+	current := romdb.Generation()
+	oldA := texts["a/a.dat"]
+
+	texts["a/a.dat"] = testDat("a", "33333333")
+	writeDat("a/a.dat")
+
+	_, err = db.RefreshPaths(romdb, []string{filepath.Join(datsDir, "a")}, 1, worker.NewProgressTracker(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if romdb.Generation() != current {
+		t.Errorf("refreshing a path changed the generation from %d to %d", current, romdb.Generation())
+	}
+	if g := generation(oldA); g == current {
+		t.Errorf("replaced dat a is still current")
+	}
+	if g := generation(texts["a/a.dat"]); g != current {
+		t.Errorf("new dat a has generation %d, want %d", g, current)
+	}
+	if g := generation(texts["b/b.dat"]); g != current {
+		t.Errorf("dat b outside the refreshed path has generation %d, want %d", g, current)
+	}
+
+	paths, err := romdb.DatPathsUnder(filepath.Join(datsDir, "a"))
+	if err != nil || len(paths) != 1 || paths[0] != filepath.Join(datsDir, "a", "a.dat") {
+		t.Errorf("got dat paths %v, %v under a, want a.dat", paths, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-kivia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = db.SetStore("kivi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a DB made before versions were recorded
+	dbDir := filepath.Join(root, "db")
+	err = os.MkdirAll(dbDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WriteGenerationFile(dbDir, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// with dat flags in the file they were kept in before version 4
+	legacyFlags := filepath.Join(dbDir, "romba-dat-flags.json")
+	err = ioutil.WriteFile(legacyFlags, []byte(`{"/dats/a.dat": {"pinned": true}}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	romdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if romdb.Generation() != 7 {
+		t.Errorf("got generation %d after upgrade, want 7", romdb.Generation())
+	}
+	err = romdb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacyFlags); !os.IsNotExist(err) {
+		t.Errorf("dat flags file left after upgrade: %v", err)
+	}
+	if pending, err := db.RefreshPending(dbDir); err != nil || !pending {
+		t.Errorf("got refresh pending %v, %v after upgrade, want true", pending, err)
+	}
+
+	romdb, err = db.New(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := romdb.DatFlags()
+	if err != nil || len(flags) != 1 || !flags["/dats/a.dat"].Pinned {
+		t.Errorf("got dat flags %v, %v after upgrade, want a.dat pinned", flags, err)
+	}
+	if pending, err := db.RefreshPending(dbDir); err != nil || !pending {
+		t.Errorf("got refresh pending %v, %v after reopening, want true", pending, err)
+	}
+
+	datsDir := filepath.Join(root, "dats")
+	err = os.MkdirAll(datsDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a refresh of a part of the dats doesn't complete the upgrade
+	_, err = db.RefreshPaths(romdb, []string{datsDir}, 1, worker.NewProgressTracker(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := db.RefreshPending(dbDir); !pending {
+		t.Errorf("refreshing a path completed the upgrade")
+	}
+	// neither does a filtered one
+	filter := &parser.Filter{Regions: []string{"Europe"}}
+	_, err = db.Refresh(romdb, datsDir, 1, worker.NewProgressTracker(), filter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := db.RefreshPending(dbDir); !pending {
+		t.Errorf("a filtered refresh completed the upgrade")
+	}
+	_, err = db.Refresh(romdb, datsDir, 1, worker.NewProgressTracker(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := db.RefreshPending(dbDir); err != nil || pending {
+		t.Errorf("got refresh pending %v, %v after a full refresh, want false", pending, err)
+	}
+
+	err = romdb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := db.ReadVersion(dbDir)
+	if err != nil || version != db.Version {
+		t.Errorf("got version %d, %v after upgrade, want %d", version, err, db.Version)
+	}
+
+	backupVersion, err := db.ReadVersion(db.BackupDir(dbDir, 1))
+	if err != nil || backupVersion != 1 {
+		t.Errorf("got backup version %d, %v, want 1", backupVersion, err)
+	}
+
+	from, err := db.Migrate(dbDir, true)
+	if err != nil || from != db.Version {
+		t.Errorf("migrating an upgraded DB got version %d, %v, want %d", from, err, db.Version)
+	}
+
+	newDir := filepath.Join(root, "new")
+	from, err = db.Migrate(newDir, true)
+	if err != nil || from != db.Version {
+		t.Errorf("migrating a new DB got version %d, %v, want %d", from, err, db.Version)
+	}
+	if _, err := os.Stat(db.BackupDir(newDir, from)); !os.IsNotExist(err) {
+		t.Errorf("a new DB was backed up: %v", err)
+	}
+
+	// backups left by upgrades that didn't finish are reused if of the
+	// version upgraded from, and refused otherwise
+	for _, tc := range []struct {
+		backupVersion int
+		ok            bool
+	}{
+		{1, true},
+		{2, false},
+	} {
+		oldDir := filepath.Join(root, fmt.Sprintf("old%d", tc.backupVersion))
+		backupDir := db.BackupDir(oldDir, 1)
+		for _, dir := range []string{oldDir, backupDir} {
+			err = os.MkdirAll(dir, 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.WriteGenerationFile(dir, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tc.backupVersion != 1 {
+			err = ioutil.WriteFile(filepath.Join(backupDir, "romba-db-version"), []byte(fmt.Sprint(tc.backupVersion)), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = db.Migrate(oldDir, true)
+		if tc.ok && err != nil {
+			t.Errorf("upgrading with a backup of version %d left: %v", tc.backupVersion, err)
+		}
+		if !tc.ok && (err == nil || !strings.Contains(err.Error(), "move it away")) {
+			t.Errorf("upgrading with a backup of version %d left: got %v", tc.backupVersion, err)
+		}
+	}
+}
+
+func TestRefreshStreamsDats(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-kivia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = db.SetStore("kivi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir := filepath.Join(root, "db")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{dbDir, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// enough games for several chunks
+	const numGames = 20000
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\"?>\n<datafile>\n<header><name>big</name><description>big</description></header>\n")
+	for i := 0; i < numGames; i++ {
+		fmt.Fprintf(&buf, "<game name=\"game%05d\"><description>game %d</description>"+
+			"<rom name=\"game%05d.bin\" size=\"4\" crc=\"%08x\"/></game>\n", i, i, i, i+1)
+	}
+	buf.WriteString("</datafile>\n")
+	text := buf.Bytes()
+
+	err = ioutil.WriteFile(filepath.Join(datsDir, "big.xml"), text, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	romdb, err := db.NewKVStoreDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer romdb.Close()
+
+	sum := sha1.Sum(text)
+	check := func() {
+		t.Helper()
+		dat, err := romdb.GetDat(sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dat == nil {
+			t.Fatalf("streamed dat not indexed")
+		}
+		if len(dat.Games) != numGames || dat.Games[numGames-1].Name != fmt.Sprintf("game%05d", numGames-1) {
+			t.Fatalf("got %d games for the streamed dat, want %d", len(dat.Games), numGames)
+		}
+		if dat.Generation != romdb.Generation() {
+			t.Errorf("streamed dat has generation %d, want %d", dat.Generation, romdb.Generation())
+		}
+
+		dats, err := romdb.DatsForRom(&types.Rom{Crc: []byte{0, 0, 0x4e, 0x20}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dats) != 1 || dats[0].Name != "big" {
+			t.Errorf("got %d dats for the rom of the last game, want dat big", len(dats))
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		// the second refresh finds the dat indexed and keeps it
+		_, err = db.Refresh(romdb, datsDir, 1, worker.NewProgressTracker(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check()
+	}
+}
+
+func TestRefreshKeysFilteredDats(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-kivia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = db.SetStore("kivi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir := filepath.Join(root, "db")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{dbDir, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const text = `<?xml version="1.0"?>
+<datafile>
+	<header><name>filtered</name></header>
+	<game name="a (USA)"><rom name="a.bin" size="4" crc="01020304"/></game>
+	<game name="b (Europe)"><rom name="b.bin" size="4" crc="05060708"/></game>
+</datafile>
+`
+	err = ioutil.WriteFile(filepath.Join(datsDir, "filtered.xml"), []byte(text), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	romdb, err := db.NewKVStoreDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer romdb.Close()
+
+	filter := &parser.Filter{Regions: []string{"Europe"}}
+	_, err = db.Refresh(romdb, datsDir, 1, worker.NewProgressTracker(), filter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usa := &types.Rom{Crc: []byte{1, 2, 3, 4}}
+	dats, err := romdb.DatsForRom(usa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dats) != 0 {
+		t.Errorf("rom of a filtered out game is indexed")
+	}
+
+	// the filtered dat doesn't pass for the whole dat
+	_, err = db.Refresh(romdb, datsDir, 1, worker.NewProgressTracker(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha1.Sum([]byte(text))
+	dat, err := romdb.GetDat(sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dat == nil || len(dat.Games) != 2 {
+		t.Fatalf("got dat %v after an unfiltered refresh, want both games", dat)
+	}
+	dats, err = romdb.DatsForRom(usa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dats) != 1 || dats[0].Generation != romdb.Generation() {
+		t.Errorf("rom of a filtered out game not indexed by an unfiltered refresh")
+	}
+}
+
+func TestPause(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-kivia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = db.SetStore("kivi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	romdb, err := db.New(filepath.Join(root, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer romdb.Close()
+
+	resume := romdb.Pause()
+	done := make(chan error)
+	go func() {
+		done <- romdb.SetDatFlags("/dats/a.dat", types.DatFlags{Pinned: true})
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("write to the paused DB returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resume()
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := romdb.DatFlags()
+	if err != nil || !flags["/dats/a.dat"].Pinned {
+		t.Errorf("got flags %v, %v after resuming, want a.dat pinned", flags, err)
+	}
+}
+
+func sampleDat(name, sha1Hex string, others bool) string {
+	text := fmt.Sprintf(`
+clrmamepro (
+	name "%s"
+	description "%s"
+)
+
+game (
+	name "invaders"
+	description "invaders"
+	rom ( name "0.wav" size 4 crc 11111111 sha1 %s )
+`, name, name, sha1Hex)
+	if others {
+		text += "\trom ( name \"game.bin\" size 4 crc 22222222 )\n"
+	}
+	return text + ")\n"
+}
+
+func TestSamples(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-kivia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = db.SetStore("kivi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir := filepath.Join(root, "db")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{dbDir, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const (
+		oldSha1   = "1111111111111111111111111111111111111111"
+		newSha1   = "2222222222222222222222222222222222222222"
+		otherSha1 = "3333333333333333333333333333333333333333"
+	)
+	writeDat := func(name, text string) {
+		err := ioutil.WriteFile(filepath.Join(datsDir, name), []byte(text), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDat("samples.dat", sampleDat("samples", oldSha1, false))
+	// a .wav among the roms of a game doesn't make a sample set
+	writeDat("game.dat", sampleDat("game", otherSha1, true))
+
+	romdb, err := db.NewKVStoreDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer romdb.Close()
+
+	sample := func() string {
+		t.Helper()
+		_, err := db.Refresh(romdb, datsDir, 1, worker.NewProgressTracker(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rom := &types.Rom{Name: "0.wav"}
+		err = romdb.CompleteSample("invaders", rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%x", rom.Sha1)
+	}
+
+	if got := sample(); got != oldSha1 {
+		t.Errorf("got sample %s, want %s", got, oldSha1)
+	}
+
+	writeDat("samples.dat", sampleDat("samples", newSha1, false))
+	if got := sample(); got != newSha1 {
+		t.Errorf("got sample %s after updating the dat, want %s", got, newSha1)
+	}
+
+	err = os.Remove(filepath.Join(datsDir, "samples.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sample(); got != "" {
+		t.Errorf("got sample %s after removing the dat, want none", got)
+	}
+}
@@ -39,8 +39,9 @@ import (
 	"github.com/uwedeportivo/romba/types"
 	"io"
 	"path/filepath"
-
-	"github.com/golang/glog"
+	"sort"
+	"strings"
+	"sync"
 )
 
 const (
@@ -50,6 +51,7 @@ const (
 	sha1DBName    = "sha1_db"
 	crcsha1DBName = "crcsha1_db"
 	md5sha1DBName = "md5sha1_db"
+	samplesDBName = "samples_db"
 )
 
 const (
@@ -84,6 +86,31 @@ type KVBatch interface {
 
 var StoreOpener func(pathPrefix string, keySize int) (KVStore, error)
 
+var stores = make(map[string]func(pathPrefix string, keySize int) (KVStore, error))
+
+// RegisterStore makes the key value store opened by opener available to
+// SetStore under name, and makes it the one used.
+func RegisterStore(name string, opener func(pathPrefix string, keySize int) (KVStore, error)) {
+	stores[name] = opener
+	StoreOpener = opener
+}
+
+// SetStore selects the registered key value store name for the DBs opened
+// from now on.
+func SetStore(name string) error {
+	opener, ok := stores[name]
+	if !ok {
+		names := make([]string, 0, len(stores))
+		for n := range stores {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown DB backend %q, have %s", name, strings.Join(names, ", "))
+	}
+	StoreOpener = opener
+	return nil
+}
+
 type kvStore struct {
 	generation int64
 	datsDB     KVStore
@@ -92,7 +119,15 @@ type kvStore struct {
 	sha1DB     KVStore
 	crcsha1DB  KVStore
 	md5sha1DB  KVStore
-	path       string
+	// samplesDB maps sample keys, see sampleKey, to the SHA1 of the sample
+	// files of sample set dats, each followed by the SHA1 of its dat.
+	samplesDB KVStore
+	path      string
+	flags     *datFlags
+	paths     *datPaths
+	// writeLock is held shared by writes to the stores and files of the
+	// DB, exclusively while Pause holds them off
+	writeLock sync.RWMutex
 }
 
 type kvBatch struct {
@@ -103,6 +138,7 @@ type kvBatch struct {
 	sha1Batch    KVBatch
 	crcsha1Batch KVBatch
 	md5sha1Batch KVBatch
+	samplesBatch KVBatch
 	size         int64
 }
 
@@ -114,55 +150,73 @@ func NewKVStoreDB(path string) (RomDB, error) {
 	kvdb := new(kvStore)
 	kvdb.path = path
 
-	glog.Infof("Loading Generation File")
+	logger.Infof("Loading Generation File")
 	gen, err := ReadGenerationFile(path)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.generation = gen
 
-	glog.Infof("Loading Dats DB")
+	kvdb.paths, err = readDatPaths(path)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("Loading Dats DB")
 	db, err := openDb(filepath.Join(path, datsDBName), keySizeSha1)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.datsDB = db
 
-	glog.Infof("Loading CRC DB")
+	logger.Infof("Loading CRC DB")
 	db, err = openDb(filepath.Join(path, crcDBName), keySizeCrc)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.crcDB = db
 
-	glog.Infof("Loading MD5 DB")
+	logger.Infof("Loading MD5 DB")
 	db, err = openDb(filepath.Join(path, md5DBName), keySizeMd5)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.md5DB = db
 
-	glog.Infof("Loading SHA1 DB")
+	logger.Infof("Loading SHA1 DB")
 	db, err = openDb(filepath.Join(path, sha1DBName), keySizeSha1)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.sha1DB = db
 
-	glog.Infof("Loading CRC -> SHA1 DB")
+	logger.Infof("Loading CRC -> SHA1 DB")
 	db, err = openDb(filepath.Join(path, crcsha1DBName), keySizeCrc)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.crcsha1DB = db
 
-	glog.Infof("Loading MD5 -> SHA1 DB")
+	logger.Infof("Loading MD5 -> SHA1 DB")
 	db, err = openDb(filepath.Join(path, md5sha1DBName), keySizeMd5)
 	if err != nil {
 		return nil, err
 	}
 	kvdb.md5sha1DB = db
 
+	logger.Infof("Loading Samples DB")
+	db, err = openDb(filepath.Join(path, samplesDBName), keySizeSha1)
+	if err != nil {
+		return nil, err
+	}
+	kvdb.samplesDB = db
+
+	logger.Infof("Loading Dat Flags DB")
+	kvdb.flags, err = openDatFlags(path)
+	if err != nil {
+		return nil, err
+	}
+
 	return kvdb, nil
 }
 
@@ -189,12 +243,74 @@ func (kvdb *kvStore) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 }
 
 func (kvdb *kvStore) OrphanDats() error {
+	kvdb.writeLock.RLock()
+	defer kvdb.writeLock.RUnlock()
+
 	kvdb.generation++
 	err := WriteGenerationFile(kvdb.path, kvdb.generation)
 	if err != nil {
 		return err
 	}
-	return nil
+	kvdb.paths.clear()
+	return kvdb.paths.write()
+}
+
+// OrphanDatsUnder orphans the dats of the current generation at path, a dat
+// file or a directory, and below it, leaving the other dats current. It
+// returns the number of dats orphaned.
+func (kvdb *kvStore) OrphanDatsUnder(path string) (int, error) {
+	kvdb.writeLock.RLock()
+	defer kvdb.writeLock.RUnlock()
+
+	taken, err := kvdb.paths.takeUnder(path)
+	if err != nil {
+		return 0, err
+	}
+
+	orphaned := 0
+	for datPath, sha1Bytes := range taken {
+		dBytes, err := kvdb.datsDB.Get(sha1Bytes)
+		if err != nil {
+			return orphaned, err
+		}
+		if dBytes == nil {
+			continue
+		}
+
+		dat, parts, err := decodeDat(dBytes)
+		if err != nil {
+			return orphaned, err
+		}
+		if dat.Generation != kvdb.generation {
+			continue
+		}
+
+		logger.Infof("orphaning dat %s", datPath)
+		dat.Generation = kvdb.generation - 1
+
+		dBytes, err = encodeDat(dat, parts)
+		if err != nil {
+			return orphaned, err
+		}
+		err = kvdb.datsDB.Set(sha1Bytes, dBytes)
+		if err != nil {
+			return orphaned, err
+		}
+		orphaned++
+	}
+	return orphaned, kvdb.paths.write()
+}
+
+// DatPathsUnder returns the paths of the current dats at path, a dat file or
+// a directory, and below it, like the dats in a zip file.
+func (kvdb *kvStore) DatPathsUnder(path string) ([]string, error) {
+	return kvdb.paths.under(path), nil
+}
+
+// Generation returns the current dat generation. Dats indexed by the most
+// recent refresh have it, orphaned dats have an older one.
+func (kvdb *kvStore) Generation() int64 {
+	return kvdb.generation
 }
 
 func (kvdb *kvStore) GetDat(sha1Bytes []byte) (*types.Dat, error) {
@@ -206,21 +322,104 @@ func (kvdb *kvStore) GetDat(sha1Bytes []byte) (*types.Dat, error) {
 	if dBytes == nil {
 		return nil, nil
 	}
-	buf := bytes.NewBuffer(dBytes)
-	datDecoder := gob.NewDecoder(buf)
 
-	var dat types.Dat
+	dat, parts, err := decodeDat(dBytes)
+	if err != nil {
+		return nil, err
+	}
+	if parts != nil {
+		err = kvdb.loadGames(dat, sha1Bytes, parts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dat.DatFlags = kvdb.flags.get(dat.Path)
+	return dat, nil
+}
 
-	err = datDecoder.Decode(&dat)
+// datParts follows the dat in the records of streamed dats, whose games are
+// stored apart in chunks, see chunkKey.
+type datParts struct {
+	Chunks int
+	// Indexed is set once the roms of all games are indexed.
+	Indexed bool
+}
+
+// chunkKey returns the key of chunk i of the games of the streamed dat with
+// sha1Bytes. Keys of the dats DB are SHA1 sized, so it is derived by hashing.
+func chunkKey(sha1Bytes []byte, i int) []byte {
+	h := sha1.New()
+	h.Write(sha1Bytes)
+	fmt.Fprintf(h, "games %d", i)
+	return h.Sum(nil)
+}
+
+func encodeDat(dat *types.Dat, parts *datParts) ([]byte, error) {
+	var buf bytes.Buffer
+
+	gobEncoder := gob.NewEncoder(&buf)
+	err := gobEncoder.Encode(dat)
+	if err == nil && parts != nil {
+		err = gobEncoder.Encode(parts)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &dat, nil
+	return buf.Bytes(), nil
+}
+
+// decodeDat decodes a dat record. The parts of streamed dats are returned
+// too, their games are loaded by loadGames.
+func decodeDat(dBytes []byte) (*types.Dat, *datParts, error) {
+	datDecoder := gob.NewDecoder(bytes.NewReader(dBytes))
+
+	var dat types.Dat
+
+	err := datDecoder.Decode(&dat)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parts := new(datParts)
+	err = datDecoder.Decode(parts)
+	if err == io.EOF {
+		return &dat, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &dat, parts, nil
+}
+
+// loadGames reads the games of the streamed dat with sha1Bytes into dat.
+func (kvdb *kvStore) loadGames(dat *types.Dat, sha1Bytes []byte, parts *datParts) error {
+	for i := 0; i < parts.Chunks; i++ {
+		cBytes, err := kvdb.datsDB.Get(chunkKey(sha1Bytes, i))
+		if err != nil {
+			return err
+		}
+		if cBytes == nil {
+			return fmt.Errorf("games of dat %s are missing chunk %d", dat.Path, i)
+		}
+
+		err = decodeGames(cBytes, func(g *types.Game) error {
+			dat.Games = append(dat.Games, g)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (kvdb *kvStore) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	err := rom.ValidHashes()
+	if err != nil {
+		return nil, err
+	}
+
 	var dBytes []byte
-	var err error
 
 	switch {
 	case rom.Sha1 != nil:
@@ -268,15 +467,21 @@ func (kvdb *kvStore) CompleteRom(rom *types.Rom) error {
 		return nil
 	}
 
+	err := rom.ValidHashes()
+	if err != nil {
+		return err
+	}
+
 	if rom.Md5 != nil {
 		dBytes, err := kvdb.md5sha1DB.Get(rom.Md5)
 		if err != nil {
 			return err
 		}
 		if len(dBytes) >= sha1.Size {
-			rom.Sha1 = dBytes
+			// the first mapping wins if there are several
+			rom.Sha1 = dBytes[:sha1.Size]
 		} else {
-			glog.Warningf("no mapping from MD5 %s to SHA1", hex.EncodeToString(rom.Md5))
+			logger.Warningf("no mapping from MD5 %s to SHA1", hex.EncodeToString(rom.Md5))
 		}
 		return nil
 	}
@@ -287,14 +492,91 @@ func (kvdb *kvStore) CompleteRom(rom *types.Rom) error {
 			return err
 		}
 		if len(dBytes) >= sha1.Size {
-			rom.Sha1 = dBytes
+			rom.Sha1 = dBytes[:sha1.Size]
+		} else {
+			logger.Warningf("no mapping from CRC %s to SHA1", hex.EncodeToString(rom.Crc))
+		}
+	}
+	return nil
+}
+
+// sampleKey is the key of the sample file name of sample set set. MAME
+// matches sample names without regard to case.
+func sampleKey(set, name string) []byte {
+	key := sha1.Sum([]byte(strings.ToLower(set + "/" + name)))
+	return key[:]
+}
+
+// sampleEntrySize is the size of the entries of samplesDB, the SHA1 of a
+// sample file followed by the SHA1 of its dat.
+const sampleEntrySize = 2 * sha1.Size
+
+// isSampleFile reports whether a rom named name is a sample file.
+func isSampleFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), types.SampleSuffix)
+}
+
+// sampleSetCheck tells whether the games it is shown are those of a sample
+// set dat, holding nothing but sample files.
+type sampleSetCheck struct {
+	samples bool
+	others  bool
+}
+
+func (sc *sampleSetCheck) add(g *types.Game) {
+	for _, r := range g.Roms {
+		if isSampleFile(r.Name) {
+			sc.samples = true
 		} else {
-			glog.Warningf("no mapping from CRC %s to SHA1", hex.EncodeToString(rom.Crc))
+			sc.others = true
+		}
+	}
+}
+
+func (sc *sampleSetCheck) sampleSets() bool {
+	return sc.samples && !sc.others
+}
+
+func (kvdb *kvStore) CompleteSample(set string, rom *types.Rom) error {
+	if rom.Sha1 != nil {
+		return nil
+	}
+
+	dBytes, err := kvdb.samplesDB.Get(sampleKey(set, rom.Name))
+	if err != nil {
+		return err
+	}
+
+	// the first sample of a current dat wins if there are several, those of
+	// orphaned dats are stale
+	for i := 0; i+sampleEntrySize <= len(dBytes); i += sampleEntrySize {
+		current, err := kvdb.datCurrent(dBytes[i+sha1.Size : i+sampleEntrySize])
+		if err != nil {
+			return err
+		}
+		if current {
+			rom.Sha1 = dBytes[i : i+sha1.Size]
+			return nil
 		}
 	}
 	return nil
 }
 
+// datCurrent reports whether the dat with sha1Bytes is stored and of the
+// current generation.
+func (kvdb *kvStore) datCurrent(sha1Bytes []byte) (bool, error) {
+	dBytes, err := kvdb.datsDB.Get(sha1Bytes)
+	if err != nil || dBytes == nil {
+		return false, err
+	}
+
+	dat, _, err := decodeDat(dBytes)
+	if err != nil {
+		return false, err
+	}
+	return dat.Generation == kvdb.generation, nil
+}
+
 func (kvdb *kvStore) Flush() {
 	kvdb.datsDB.Flush()
 	kvdb.crcDB.Flush()
@@ -302,12 +584,32 @@ func (kvdb *kvStore) Flush() {
 	kvdb.sha1DB.Flush()
 	kvdb.crcsha1DB.Flush()
 	kvdb.md5sha1DB.Flush()
+	kvdb.samplesDB.Flush()
+	kvdb.flags.store.Flush()
+}
+
+// Pause flushes the DB and holds off writes to it until resume is called,
+// so its files can be copied.
+func (kvdb *kvStore) Pause() (resume func()) {
+	kvdb.writeLock.Lock()
+
+	kvdb.Flush()
+	err := kvdb.paths.write()
+	if err != nil {
+		logger.Errorf("failed to write the dat paths of the paused DB: %v", err)
+	}
+	return kvdb.writeLock.Unlock
 }
 
 func (kvdb *kvStore) Close() error {
 	kvdb.Flush()
 
-	err := kvdb.datsDB.Close()
+	err := kvdb.paths.write()
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.datsDB.Close()
 	if err != nil {
 		return err
 	}
@@ -336,10 +638,23 @@ func (kvdb *kvStore) Close() error {
 	if err != nil {
 		return err
 	}
+
+	err = kvdb.samplesDB.Close()
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.flags.store.Close()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 func (kvdb *kvStore) BeginDatRefresh() error {
+	kvdb.writeLock.RLock()
+	defer kvdb.writeLock.RUnlock()
+
 	return kvdb.datsDB.BeginRefresh()
 }
 
@@ -352,14 +667,28 @@ func (kvdb *kvStore) PrintStats() string {
 	fmt.Fprintf(buf, "sha1DB stats: %s\n", kvdb.sha1DB.PrintStats())
 	fmt.Fprintf(buf, "crcsha1DB stats: %s\n", kvdb.crcsha1DB.PrintStats())
 	fmt.Fprintf(buf, "md5sha1DB stats: %s\n", kvdb.md5sha1DB.PrintStats())
+	fmt.Fprintf(buf, "samplesDB stats: %s\n", kvdb.samplesDB.PrintStats())
+	fmt.Fprintf(buf, "datFlagsDB stats: %s\n", kvdb.flags.store.PrintStats())
 
 	return buf.String()
 }
 
 func (kvdb *kvStore) EndDatRefresh() error {
+	kvdb.writeLock.RLock()
+	defer kvdb.writeLock.RUnlock()
+
+	err := kvdb.paths.write()
+	if err != nil {
+		return err
+	}
 	return kvdb.datsDB.EndRefresh()
 }
 
+// EndFullRefresh clears the mark of upgrades needing a full refresh.
+func (kvdb *kvStore) EndFullRefresh() error {
+	return clearRefreshPending(kvdb.path)
+}
+
 func (kvdb *kvStore) StartBatch() RomBatch {
 	return &kvBatch{
 		db:           kvdb,
@@ -369,6 +698,7 @@ func (kvdb *kvStore) StartBatch() RomBatch {
 		sha1Batch:    kvdb.sha1DB.StartBatch(),
 		crcsha1Batch: kvdb.crcsha1DB.StartBatch(),
 		md5sha1Batch: kvdb.md5sha1DB.StartBatch(),
+		samplesBatch: kvdb.samplesDB.StartBatch(),
 	}
 }
 
@@ -377,6 +707,9 @@ func (kvb *kvBatch) Flush() error {
 		return nil
 	}
 
+	kvb.db.writeLock.RLock()
+	defer kvb.db.writeLock.RUnlock()
+
 	err := kvb.db.datsDB.WriteBatch(kvb.datsBatch)
 	if err != nil {
 		return err
@@ -413,6 +746,12 @@ func (kvb *kvBatch) Flush() error {
 	}
 	kvb.md5sha1Batch.Clear()
 
+	err = kvb.db.samplesDB.WriteBatch(kvb.samplesBatch)
+	if err != nil {
+		return err
+	}
+	kvb.samplesBatch.Clear()
+
 	kvb.size = 0
 	return nil
 }
@@ -424,7 +763,7 @@ func (kvb *kvBatch) Close() error {
 }
 
 func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
-	//glog.Infof("indexing rom %s", rom.Name)
+	//logger.Infof("indexing rom %s", rom.Name)
 
 	dats, err := kvb.db.DatsForRom(rom)
 	if err != nil {
@@ -433,7 +772,7 @@ func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 
 	if len(dats) > 0 {
 		if rom.Crc != nil && rom.Sha1 != nil {
-			//glog.Infof("declaring crc %s -> sha1 %s ampping", hex.EncodeToString(rom.Crc), hex.EncodeToString(rom.Sha1))
+			//logger.Infof("declaring crc %s -> sha1 %s ampping", hex.EncodeToString(rom.Crc), hex.EncodeToString(rom.Sha1))
 			err = kvb.crcsha1Batch.Append(rom.Crc, rom.Sha1)
 			if err != nil {
 				return err
@@ -441,7 +780,7 @@ func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 			kvb.size += int64(sha1.Size)
 		}
 		if rom.Md5 != nil && rom.Sha1 != nil {
-			//glog.Infof("declaring md5 %s -> sha1 %s ampping", hex.EncodeToString(rom.Md5), hex.EncodeToString(rom.Sha1))
+			//logger.Infof("declaring md5 %s -> sha1 %s ampping", hex.EncodeToString(rom.Md5), hex.EncodeToString(rom.Sha1))
 			err = kvb.md5sha1Batch.Append(rom.Md5, rom.Sha1)
 			if err != nil {
 				return err
@@ -452,7 +791,7 @@ func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 	}
 
 	if rom.Sha1 == nil {
-		glog.Warningf("indexing rom %s with missing SHA1", rom.Name)
+		logger.Warningf("indexing rom %s with missing SHA1", rom.Name)
 	}
 
 	dat := new(types.Dat)
@@ -482,82 +821,266 @@ func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 }
 
 func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
-	glog.Infof("indexing dat %s", dat.Name)
+	logger.Infof("indexing dat %s", dat.Name)
 
 	if sha1Bytes == nil {
 		return fmt.Errorf("sha1 is nil for %s", dat.Path)
 	}
 
-	dat.Generation = kvb.db.generation
+	sc := new(sampleSetCheck)
+	for _, g := range dat.Games {
+		if err := validGameHashes(g); err != nil {
+			return fmt.Errorf("failed to index dat %s: %v", dat.Path, err)
+		}
+		sc.add(g)
+	}
 
-	var buf bytes.Buffer
+	exists, err := kvb.datExists(dat, sha1Bytes)
+	if err != nil {
+		return err
+	}
 
-	gobEncoder := gob.NewEncoder(&buf)
-	err := gobEncoder.Encode(dat)
+	err = kvb.storeDat(dat, sha1Bytes, nil)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		for _, g := range dat.Games {
+			err = kvb.indexGame(g, sha1Bytes)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if sc.sampleSets() {
+		for _, g := range dat.Games {
+			err = kvb.indexSamples(g, sha1Bytes)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// IndexDatStream spills the games of the streamed dat into a temporary file
+// in chunks, so memory stays flat however big the dat is. Once the dat is
+// read and its SHA1 known, the chunks are stored first, then the dat, then
+// the rom indexes, so no rom index points at a dat that isn't stored. The dat
+// is marked indexed last, a refresh interrupted before indexes the roms again.
+func (kvb *kvBatch) IndexDatStream(stream GameStream) error {
+	spill, err := newGameSpill()
 	if err != nil {
 		return err
 	}
+	defer spill.close()
 
-	var exists bool
+	sc := new(sampleSetCheck)
+	dat, sha1Bytes, err := stream(func(g *types.Game) error {
+		if err := validGameHashes(g); err != nil {
+			return err
+		}
+		sc.add(g)
+		return spill.add(g)
+	})
+	if err != nil {
+		return err
+	}
+	err = spill.endChunk()
+	if err != nil {
+		return err
+	}
 
+	indexed, err := kvb.db.datIndexed(sha1Bytes)
+	if err != nil {
+		return err
+	}
+
+	// the chunks are stored even if the dat is indexed, a refresh forgets
+	// records it didn't write
+	err = spill.each(func(i int, cBytes []byte) error {
+		err := kvb.datsBatch.Set(chunkKey(sha1Bytes, i), cBytes)
+		if err != nil {
+			return err
+		}
+		kvb.size += int64(sha1.Size + len(cBytes))
+		return kvb.flushIfFull()
+	})
+	if err != nil {
+		return err
+	}
+
+	parts := &datParts{Chunks: spill.chunks, Indexed: indexed}
+	err = kvb.storeDat(dat, sha1Bytes, parts)
+	if err != nil {
+		return err
+	}
+
+	if sc.sampleSets() {
+		err = spill.each(func(i int, cBytes []byte) error {
+			return decodeGames(cBytes, func(g *types.Game) error {
+				return kvb.indexSamples(g, sha1Bytes)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if indexed {
+		return nil
+	}
+
+	err = spill.each(func(i int, cBytes []byte) error {
+		return decodeGames(cBytes, func(g *types.Game) error {
+			err := kvb.indexGame(g, sha1Bytes)
+			if err != nil {
+				return err
+			}
+			return kvb.flushIfFull()
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("indexed streamed dat %s", dat.Name)
+
+	parts.Indexed = true
+	return kvb.storeDat(dat, sha1Bytes, parts)
+}
+
+// flushIfFull writes the batch once it grows past MaxBatchSize, so big dats
+// are indexed in flat memory.
+func (kvb *kvBatch) flushIfFull() error {
+	if kvb.size >= MaxBatchSize {
+		return kvb.Flush()
+	}
+	return nil
+}
+
+// validGameHashes checks the hashes of the roms of g, they end up as fixed
+// size keys.
+func validGameHashes(g *types.Game) error {
+	for _, r := range g.AllRoms() {
+		if err := r.ValidHashes(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kvb *kvBatch) datExists(dat *types.Dat, sha1Bytes []byte) (bool, error) {
 	if dat.Artificial {
-		exists = false
-	} else {
-		existsSha1, err := kvb.db.datsDB.Exists(sha1Bytes)
+		return false, nil
+	}
+	return kvb.db.datIndexed(sha1Bytes)
+}
+
+// datIndexed reports whether the dat with sha1Bytes is stored with the roms
+// of all its games indexed.
+func (kvdb *kvStore) datIndexed(sha1Bytes []byte) (bool, error) {
+	dBytes, err := kvdb.datsDB.Get(sha1Bytes)
+	if err != nil {
+		return false, fmt.Errorf("failed to lookup sha1 indexing dats: %v", err)
+	}
+	if dBytes == nil {
+		return false, nil
+	}
+
+	_, parts, err := decodeDat(dBytes)
+	if err != nil {
+		return false, err
+	}
+	return parts == nil || parts.Indexed, nil
+}
+
+// storeDat stores dat under sha1Bytes, with parts for streamed dats whose
+// games are stored apart.
+func (kvb *kvBatch) storeDat(dat *types.Dat, sha1Bytes []byte, parts *datParts) error {
+	dat.Generation = kvb.db.generation
+
+	dBytes, err := encodeDat(dat, parts)
+	if err != nil {
+		return err
+	}
+
+	err = kvb.datsBatch.Set(sha1Bytes, dBytes)
+	if err != nil {
+		return err
+	}
+	if !dat.Artificial && dat.Path != "" {
+		kvb.db.paths.set(dat.Path, sha1Bytes)
+	}
+
+	kvb.size += int64(sha1.Size + len(dBytes))
+	return nil
+}
+
+// indexSamples maps the sample files of g, a sample set of the sample set dat
+// with sha1Bytes, to their SHA1 and the dat. Unlike the roms of games, samples
+// are indexed at every refresh of their dat, so that the refresh fills in the
+// samples of dats indexed before samplesDB was.
+func (kvb *kvBatch) indexSamples(g *types.Game, sha1Bytes []byte) error {
+	for _, r := range g.Roms {
+		if r.Sha1 == nil {
+			continue
+		}
+
+		entry := make([]byte, 0, sampleEntrySize)
+		entry = append(append(entry, r.Sha1...), sha1Bytes...)
+		err := dbEntryAppend(kvb.db.samplesDB, kvb.samplesBatch, sampleKey(g.Name, r.Name), entry)
 		if err != nil {
-			return fmt.Errorf("failed to lookup sha1 indexing dats: %v", err)
+			return err
 		}
-		exists = existsSha1
+		kvb.size += sampleEntrySize
 	}
+	return nil
+}
 
-	kvb.datsBatch.Set(sha1Bytes, buf.Bytes())
+// indexGame maps the hashes of the roms of g to the dat with sha1Bytes.
+func (kvb *kvBatch) indexGame(g *types.Game, sha1Bytes []byte) error {
+	for _, r := range g.AllRoms() {
+		if r.Sha1 != nil {
+			err := kvb.sha1Batch.Append(r.Sha1, sha1Bytes)
+			if err != nil {
+				return err
+			}
+			kvb.size += int64(sha1.Size)
+		}
 
-	kvb.size += int64(sha1.Size + buf.Len())
+		if r.Md5 != nil {
+			err := kvb.md5Batch.Append(r.Md5, sha1Bytes)
+			if err != nil {
+				return err
+			}
+			kvb.size += int64(sha1.Size)
 
-	if !exists {
-		for _, g := range dat.Games {
-			for _, r := range g.Roms {
-				if r.Sha1 != nil {
-					err = kvb.sha1Batch.Append(r.Sha1, sha1Bytes)
-					if err != nil {
-						return err
-					}
-					kvb.size += int64(sha1.Size)
+			if r.Sha1 != nil {
+				//logger.Infof("declaring md5 %s -> sha1 %s ampping", hex.EncodeToString(r.Md5), hex.EncodeToString(r.Sha1))
+				err = kvb.md5sha1Batch.Append(r.Md5, r.Sha1)
+				if err != nil {
+					return err
 				}
+				kvb.size += int64(sha1.Size)
+			}
+		}
 
-				if r.Md5 != nil {
-					err = kvb.md5Batch.Append(r.Md5, sha1Bytes)
-					if err != nil {
-						return err
-					}
-					kvb.size += int64(sha1.Size)
-
-					if r.Sha1 != nil {
-						//glog.Infof("declaring md5 %s -> sha1 %s ampping", hex.EncodeToString(r.Md5), hex.EncodeToString(r.Sha1))
-						err = kvb.md5sha1Batch.Append(r.Md5, r.Sha1)
-						if err != nil {
-							return err
-						}
-						kvb.size += int64(sha1.Size)
-					}
-				}
+		if r.Crc != nil {
+			err := kvb.crcBatch.Append(r.Crc, sha1Bytes)
+			if err != nil {
+				return err
+			}
+			kvb.size += int64(sha1.Size)
 
-				if r.Crc != nil {
-					err = kvb.crcBatch.Append(r.Crc, sha1Bytes)
-					if err != nil {
-						return err
-					}
-					kvb.size += int64(sha1.Size)
-
-					if r.Sha1 != nil {
-						//glog.Infof("declaring crc %s -> sha1 %s ampping", hex.EncodeToString(r.Crc), hex.EncodeToString(r.Sha1))
-						err = kvb.crcsha1Batch.Append(r.Crc, r.Sha1)
-						if err != nil {
-							return err
-						}
-						kvb.size += int64(sha1.Size)
-					}
+			if r.Sha1 != nil {
+				//logger.Infof("declaring crc %s -> sha1 %s ampping", hex.EncodeToString(r.Crc), hex.EncodeToString(r.Sha1))
+				err = kvb.crcsha1Batch.Append(r.Crc, r.Sha1)
+				if err != nil {
+					return err
 				}
+				kvb.size += int64(sha1.Size)
 			}
 		}
 	}
@@ -569,25 +1092,31 @@ func (kvb *kvBatch) Size() int64 {
 }
 
 func dbSha1Append(db KVStore, batch KVBatch, key, sha1Bytes []byte) error {
+	return dbEntryAppend(db, batch, key, sha1Bytes)
+}
+
+// dbEntryAppend appends entry to the entries of its size stored under key,
+// unless it is among them already.
+func dbEntryAppend(db KVStore, batch KVBatch, key, entry []byte) error {
 	if key == nil {
 		return nil
 	}
 
 	vBytes, err := db.Get(key)
 	if err != nil {
-		return fmt.Errorf("failed to lookup in dbSha1Append: %v", err)
+		return fmt.Errorf("failed to lookup in dbEntryAppend: %v", err)
 	}
 
 	found := false
-	for i := 0; i < len(vBytes); i += sha1.Size {
-		if bytes.Equal(sha1Bytes, vBytes[i:i+sha1.Size]) {
+	for i := 0; i+len(entry) <= len(vBytes); i += len(entry) {
+		if bytes.Equal(entry, vBytes[i:i+len(entry)]) {
 			found = true
 			break
 		}
 	}
 
 	if !found {
-		vBytes = append(vBytes, sha1Bytes...)
+		vBytes = append(vBytes, entry...)
 		batch.Set(key, vBytes)
 	}
 	return nil
@@ -0,0 +1,305 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	versionFilename = "romba-db-version"
+	// refreshPendingFilename marks DBs upgraded by migrations needing a full
+	// refresh until one completes.
+	refreshPendingFilename = "romba-db-refresh-pending"
+)
+
+// Version is the version of the layout of the DB directory written by this
+// romba. DBs of older versions are upgraded by Migrate.
+const Version = 5
+
+// Migration upgrades a DB directory from version From to From+1.
+type Migration struct {
+	From        int
+	Description string
+	// Migrate changes the files of the DB directory dir, the stores aren't
+	// open. Nil if the new layout is made when the DB is opened.
+	Migrate func(dir string) error
+	// NeedsRefresh tells that the new layout is only filled in by the next
+	// full refresh of the dats, see RefreshPending.
+	NeedsRefresh bool
+}
+
+// migrations are the upgrades from each version to the next, in order. A
+// format change adds one here and increments Version.
+var migrations = []Migration{
+	{
+		From:         1,
+		Description:  "adds the index of the sample files of sample set dats",
+		NeedsRefresh: true,
+	},
+	{
+		From:         2,
+		Description:  "records the dat file each dat was indexed from, used by refreshes of parts of the dats",
+		NeedsRefresh: true,
+	},
+	{
+		From:        3,
+		Description: "moves the flags set on dats from romba-dat-flags.json into a store of the DB",
+	},
+	{
+		From:        4,
+		Description: "keys the index of sample files to the sample set dats they come from",
+		Migrate: func(dir string) error {
+			return os.RemoveAll(filepath.Join(dir, samplesDBName))
+		},
+		NeedsRefresh: true,
+	},
+}
+
+// ReadVersion returns the version of the DB directory dir. DBs made before
+// versions were recorded are version 1, directories without a DB are of the
+// current version.
+func ReadVersion(dir string) (int, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(dir, versionFilename))
+	if err == nil {
+		return strconv.Atoi(strings.TrimSpace(string(bs)))
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	_, err = os.Stat(filepath.Join(dir, generationFilename))
+	if err == nil {
+		return 1, nil
+	}
+	if os.IsNotExist(err) {
+		return Version, nil
+	}
+	return 0, err
+}
+
+func writeVersion(dir string, version int) error {
+	path := filepath.Join(dir, versionFilename)
+	err := ioutil.WriteFile(path+".tmp", []byte(strconv.Itoa(version)), 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Migrate upgrades the DB directory dir to Version one migration at a time,
+// recording the version reached after each. If backup is set, dir is copied
+// into BackupDir first, unless a complete backup of the same version is there
+// from an upgrade that didn't finish. It returns the version dir was of. DBs
+// of a newer version than Version are refused.
+func Migrate(dir string, backup bool) (int, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return 0, err
+	}
+
+	from, err := ReadVersion(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read DB version: %v", err)
+	}
+	if from > Version {
+		return from, fmt.Errorf("DB %s is version %d, newer than version %d of this romba", dir, from, Version)
+	}
+	if from == Version {
+		return from, writeVersion(dir, Version)
+	}
+
+	if backup {
+		err = backupDB(dir, from)
+		if err != nil {
+			return from, err
+		}
+	}
+
+	needsRefresh := false
+	for _, m := range migrations {
+		if m.From < from {
+			continue
+		}
+
+		logger.Infof("upgrading DB from version %d to %d: %s", m.From, m.From+1, m.Description)
+		if m.NeedsRefresh {
+			// marked before the version is, so an upgrade cut short
+			// doesn't lose it
+			err = ioutil.WriteFile(filepath.Join(dir, refreshPendingFilename), []byte(strconv.Itoa(m.From+1)), 0666)
+			if err != nil {
+				return from, err
+			}
+		}
+		if m.Migrate != nil {
+			err = m.Migrate(dir)
+			if err != nil {
+				return from, fmt.Errorf("failed to upgrade DB from version %d: %v", m.From, err)
+			}
+		}
+
+		err = writeVersion(dir, m.From+1)
+		if err != nil {
+			return from, err
+		}
+		needsRefresh = needsRefresh || m.NeedsRefresh
+	}
+
+	if needsRefresh {
+		logger.Warningf("upgraded DB from version %d to %d, a full refresh-dats is needed to complete it", from, Version)
+	}
+	return from, nil
+}
+
+// RefreshPending reports whether the DB directory dir was upgraded by a
+// migration needing a full refresh of the dats, and no full refresh completed
+// since.
+func RefreshPending(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, refreshPendingFilename))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// clearRefreshPending records that a full refresh of the dats completed the
+// upgrades of the DB directory dir, see RefreshPending.
+func clearRefreshPending(dir string) error {
+	err := os.Remove(filepath.Join(dir, refreshPendingFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// BackupDir returns the directory the DB directory dir is copied into
+// before being upgraded from version from.
+func BackupDir(dir string, from int) string {
+	return fmt.Sprintf("%s-v%d-backup", filepath.Clean(dir), from)
+}
+
+// backupDB copies the DB directory dir of version from into its BackupDir.
+// The copy is made next to it and renamed once complete, so a BackupDir left
+// by an upgrade that didn't finish is a complete backup, and reused if of the
+// same version.
+func backupDB(dir string, from int) error {
+	backupDir := BackupDir(dir, from)
+
+	_, err := os.Stat(backupDir)
+	if err == nil {
+		version, err := ReadVersion(backupDir)
+		if err != nil {
+			return fmt.Errorf("failed to read the version of the backup %s left by an earlier upgrade: %v", backupDir, err)
+		}
+		if version != from {
+			return fmt.Errorf("backup %s left by an earlier upgrade is of version %d, not %d: move it away to upgrade the DB",
+				backupDir, version, from)
+		}
+		logger.Infof("reusing backup %s of DB version %d left by an earlier upgrade", backupDir, from)
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmpDir := backupDir + ".tmp"
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("backing up DB version %d at %s into %s, copying the whole DB before opening it", from, dir, backupDir)
+	err = copyDir(dir, tmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to back up DB before upgrading: %v", err)
+	}
+	return os.Rename(tmpDir, backupDir)
+}
+
+// copyDir copies the files of src into dst, which mustn't exist.
+func copyDir(src, dst string) error {
+	_, err := os.Stat(dst)
+	if err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		return copyFile(p, target, info.Mode())
+	})
+	if err != nil {
+		os.RemoveAll(dst)
+	}
+	return err
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
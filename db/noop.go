@@ -49,6 +49,10 @@ func (noop *NoOpDB) OrphanDats() error {
 	return nil
 }
 
+func (noop *NoOpDB) Generation() int64 {
+	return 0
+}
+
 func (noop *NoOpDB) Close() error {
 	return nil
 }
@@ -61,6 +65,26 @@ func (noop *NoOpDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
 	return nil, nil
 }
 
+func (noop *NoOpDB) Pause() func() {
+	return func() {}
+}
+
+func (noop *NoOpDB) DatPathsUnder(path string) ([]string, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) EndFullRefresh() error {
+	return nil
+}
+
+func (noop *NoOpDB) DatFlags() (map[string]types.DatFlags, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) SetDatFlags(path string, flags types.DatFlags) error {
+	return nil
+}
+
 func (noop *NoOpDB) StartBatch() RomBatch {
 	return new(NoOpBatch)
 }
@@ -81,6 +105,11 @@ func (noop *NoOpBatch) IndexDat(dat *types.Dat, sha1 []byte) error {
 	return nil
 }
 
+func (noop *NoOpBatch) IndexDatStream(stream GameStream) error {
+	_, _, err := stream(func(g *types.Game) error { return nil })
+	return err
+}
+
 func (noop *NoOpBatch) Size() int64 {
 	return 0
 }
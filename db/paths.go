@@ -0,0 +1,163 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const datPathsFilename = "romba-dat-paths.json"
+
+// datPaths are the SHA1s of the dats of the current generation by dat path,
+// kept in a file of the DB directory so refreshes of a part of the dats
+// directory know which dats to orphan. Dats indexed before the file existed
+// are only known after the next full refresh.
+type datPaths struct {
+	path  string
+	lock  sync.Mutex
+	sha1s map[string]string
+	dirty bool
+}
+
+func readDatPaths(root string) (*datPaths, error) {
+	dp := &datPaths{
+		path:  filepath.Join(root, datPathsFilename),
+		sha1s: make(map[string]string),
+	}
+
+	bs, err := ioutil.ReadFile(dp.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dp, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(bs, &dp.sha1s)
+	if err != nil {
+		return nil, err
+	}
+	return dp, nil
+}
+
+func (dp *datPaths) set(path string, sha1Bytes []byte) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	dp.sha1s[path] = hex.EncodeToString(sha1Bytes)
+	dp.dirty = true
+}
+
+func (dp *datPaths) clear() {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	dp.sha1s = make(map[string]string)
+	dp.dirty = true
+}
+
+// under returns the paths of the dats at root, a dat file or a directory,
+// and below it.
+func (dp *datPaths) under(root string) []string {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	root = filepath.Clean(root)
+	prefix := root + string(filepath.Separator)
+
+	var paths []string
+	for path := range dp.sha1s {
+		if path == root || strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// takeUnder removes the dats at root, a dat file or a directory, and below it
+// and returns their SHA1s by path.
+func (dp *datPaths) takeUnder(root string) (map[string][]byte, error) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	root = filepath.Clean(root)
+	prefix := root + string(filepath.Separator)
+
+	taken := make(map[string][]byte)
+	for path, sha1Hex := range dp.sha1s {
+		if path != root && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		sha1Bytes, err := hex.DecodeString(sha1Hex)
+		if err != nil {
+			return nil, err
+		}
+		taken[path] = sha1Bytes
+		delete(dp.sha1s, path)
+		dp.dirty = true
+	}
+	return taken, nil
+}
+
+// write writes the dat paths into their file if they changed since read or
+// last written.
+func (dp *datPaths) write() error {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	if !dp.dirty {
+		return nil
+	}
+
+	bs, err := json.MarshalIndent(dp.sha1s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(dp.path+".tmp", bs, 0666)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(dp.path+".tmp", dp.path)
+	if err != nil {
+		return err
+	}
+	dp.dirty = false
+	return nil
+}
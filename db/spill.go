@@ -0,0 +1,160 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// datChunkSize is about how many bytes of encoded games of a streamed dat
+// go into one chunk.
+const datChunkSize = 1 << 20
+
+// gameSpill holds the games of a streamed dat in a temporary file, gob
+// encoded in chunks of about datChunkSize bytes, each prefixed by its length.
+type gameSpill struct {
+	file   *os.File
+	w      *bufio.Writer
+	chunk  bytes.Buffer
+	enc    *gob.Encoder
+	chunks int
+}
+
+func newGameSpill() (*gameSpill, error) {
+	file, err := ioutil.TempFile("", "romba-dat-stream-")
+	if err != nil {
+		return nil, err
+	}
+	return &gameSpill{
+		file: file,
+		w:    bufio.NewWriter(file),
+	}, nil
+}
+
+// add encodes g into the current chunk, ending it once it is full.
+func (gs *gameSpill) add(g *types.Game) error {
+	if gs.enc == nil {
+		gs.enc = gob.NewEncoder(&gs.chunk)
+	}
+	err := gs.enc.Encode(g)
+	if err != nil {
+		return err
+	}
+	if gs.chunk.Len() >= datChunkSize {
+		return gs.endChunk()
+	}
+	return nil
+}
+
+// endChunk writes the current chunk out, if it has any games.
+func (gs *gameSpill) endChunk() error {
+	if gs.chunk.Len() == 0 {
+		return nil
+	}
+
+	err := binary.Write(gs.w, binary.BigEndian, uint32(gs.chunk.Len()))
+	if err != nil {
+		return err
+	}
+	_, err = gs.w.Write(gs.chunk.Bytes())
+	if err != nil {
+		return err
+	}
+
+	gs.chunk.Reset()
+	gs.enc = nil
+	gs.chunks++
+	return nil
+}
+
+// each passes the chunks written so far to fn, in order.
+func (gs *gameSpill) each(fn func(i int, cBytes []byte) error) error {
+	err := gs.w.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = gs.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(gs.file)
+	for i := 0; i < gs.chunks; i++ {
+		var n uint32
+		err = binary.Read(r, binary.BigEndian, &n)
+		if err != nil {
+			return err
+		}
+		cBytes := make([]byte, n)
+		_, err = io.ReadFull(r, cBytes)
+		if err != nil {
+			return err
+		}
+
+		err = fn(i, cBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gs *gameSpill) close() {
+	gs.file.Close()
+	os.Remove(gs.file.Name())
+}
+
+// decodeGames passes the games of a chunk to fn one at a time.
+func decodeGames(cBytes []byte, fn func(g *types.Game) error) error {
+	dec := gob.NewDecoder(bytes.NewReader(cBytes))
+	for {
+		g := new(types.Game)
+		err := dec.Decode(g)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(g)
+		if err != nil {
+			return err
+		}
+	}
+}
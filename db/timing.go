@@ -0,0 +1,108 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// LookupTiming is how many lookups of one kind were done and how long they
+// took all together.
+type LookupTiming struct {
+	Count int64
+	Total time.Duration
+}
+
+// TimedRomDB is a RomDB keeping the timings of its lookups.
+type TimedRomDB struct {
+	RomDB
+	lock    sync.Mutex
+	timings map[string]*LookupTiming
+}
+
+// NewTimedRomDB returns romDB timing its GetDat, DatsForRom and CompleteRom
+// lookups.
+func NewTimedRomDB(romDB RomDB) *TimedRomDB {
+	return &TimedRomDB{
+		RomDB:   romDB,
+		timings: make(map[string]*LookupTiming),
+	}
+}
+
+func (tdb *TimedRomDB) record(op string, start time.Time) {
+	d := time.Since(start)
+
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+
+	lt := tdb.timings[op]
+	if lt == nil {
+		lt = new(LookupTiming)
+		tdb.timings[op] = lt
+	}
+	lt.Count++
+	lt.Total += d
+}
+
+// Timings returns the timings of the lookups so far by the name of the
+// RomDB method doing them.
+func (tdb *TimedRomDB) Timings() map[string]LookupTiming {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+
+	timings := make(map[string]LookupTiming, len(tdb.timings))
+	for op, lt := range tdb.timings {
+		timings[op] = *lt
+	}
+	return timings
+}
+
+func (tdb *TimedRomDB) GetDat(sha1 []byte) (*types.Dat, error) {
+	defer tdb.record("GetDat", time.Now())
+	return tdb.RomDB.GetDat(sha1)
+}
+
+func (tdb *TimedRomDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	defer tdb.record("DatsForRom", time.Now())
+	return tdb.RomDB.DatsForRom(rom)
+}
+
+func (tdb *TimedRomDB) CompleteRom(rom *types.Rom) error {
+	defer tdb.record("CompleteRom", time.Now())
+	return tdb.RomDB.CompleteRom(rom)
+}
+
+func (tdb *TimedRomDB) CompleteSample(set string, rom *types.Rom) error {
+	defer tdb.record("CompleteSample", time.Now())
+	return tdb.RomDB.CompleteSample(set, rom)
+}
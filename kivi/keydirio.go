@@ -43,8 +43,6 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
-
-	"github.com/golang/glog"
 )
 
 const (
@@ -366,7 +364,7 @@ func openKeydir(root string) (*keydir, int32, error) {
 			return kd, fileId, nil
 		}
 		if err != nil {
-			glog.Errorf("error opening keydir %d: %v", fileId, err)
+			logger.Errorf("error opening keydir %d: %v", fileId, err)
 		}
 	}
 	return nil, -1, nil
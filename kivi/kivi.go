@@ -46,10 +46,13 @@ import (
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/golang/glog"
 	"github.com/golang/groupcache/lru"
+
+	"github.com/uwedeportivo/romba/logging"
 )
 
+var logger = logging.For("kivi")
+
 const (
 	dataFilenamePrefix = "data_"
 )
@@ -80,6 +83,8 @@ type DB struct {
 	activeFileId  int32
 	openDataFiles *lru.Cache
 	openCacheLock *sync.Mutex
+	// trace records the Gets if not nil
+	trace *Trace
 }
 
 func dataFilename(root string, fileId int32) string {
@@ -147,7 +152,7 @@ func populateKeydir(root string, kd *keydir, fileId int32) error {
 }
 
 func readDataFiles(root string, kd *keydir, maxFileId int32) (int32, error) {
-	glog.Info("reading data files")
+	logger.Info("reading data files")
 	files, err := ioutil.ReadDir(root)
 	if err != nil {
 		return 0, err
@@ -176,7 +181,7 @@ func readDataFiles(root string, kd *keydir, maxFileId int32) (int32, error) {
 	index := sort.SearchInts(fileIds, int(maxFileId+1))
 
 	for i := index; i < l; i++ {
-		glog.Infof("populating keydir from data file %d\n", fileIds[i])
+		logger.Infof("populating keydir from data file %d\n", fileIds[i])
 		err = populateKeydir(root, kd, int32(fileIds[i]))
 		if err != nil {
 			return 0, err
@@ -215,12 +220,12 @@ func closeEvictedDataFile(key lru.Key, value interface{}) {
 	fileId := key.(int32)
 	err := readCloser.Close()
 	if err != nil {
-		glog.Errorf("error closing data file %d: %v", fileId, err)
+		logger.Errorf("error closing data file %d: %v", fileId, err)
 	}
 }
 
 func Open(root string, keySize int) (*DB, error) {
-	glog.Infof("Opening database %s\n", root)
+	logger.Infof("Opening database %s\n", root)
 	startTime := time.Now()
 
 	err := os.MkdirAll(root, 0766)
@@ -234,7 +239,7 @@ func Open(root string, keySize int) (*DB, error) {
 	}
 
 	if kd == nil {
-		glog.Infof("no keydir file")
+		logger.Infof("no keydir file")
 		kd = newKeydir(keySize)
 	}
 
@@ -262,7 +267,7 @@ func Open(root string, keySize int) (*DB, error) {
 	go runWrites(kvdb)
 
 	elapsed := time.Since(startTime)
-	glog.Infof("finished opening %s (elapsed time %s) \n", root, formatDuration(elapsed))
+	logger.Infof("finished opening %s (elapsed time %s) \n", root, formatDuration(elapsed))
 
 	return kvdb, nil
 }
@@ -285,7 +290,7 @@ func formatDuration(d time.Duration) string {
 }
 
 func (kvdb *DB) Close() error {
-	glog.Infof("Closing database %s\n", kvdb.root)
+	logger.Infof("Closing database %s\n", kvdb.root)
 	startTime := time.Now()
 
 	close(kvdb.wchan)
@@ -305,7 +310,7 @@ func (kvdb *DB) Close() error {
 	}
 
 	elapsed := time.Since(startTime)
-	glog.Infof("finished closing %s (elapsed time %s)\n", kvdb.root, formatDuration(elapsed))
+	logger.Infof("finished closing %s (elapsed time %s)\n", kvdb.root, formatDuration(elapsed))
 
 	kvdb.kd = nil
 	return nil
@@ -336,11 +341,12 @@ func (kvdb *DB) dataReader(fileId int32) (io.ReaderAt, error) {
 	return reader, nil
 }
 
-func (kvdb *DB) getAt(kde *keydirEntry, keybuf, key []byte) ([]byte, error) {
+func (kvdb *DB) getAt(kde *keydirEntry, keybuf, key []byte, tr *tracing) ([]byte, error) {
 	dataReader, err := kvdb.dataReader(kde.fileId)
 	if err != nil {
 		return nil, err
 	}
+	tr.phase(PhaseSeek, kde.fileId)
 
 	buflen := int(kde.vsize) + kvdb.kd.keySize + 4 + 4 + 1
 
@@ -350,6 +356,7 @@ func (kvdb *DB) getAt(kde *keydirEntry, keybuf, key []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	tr.phase(PhaseRead, kde.fileId)
 
 	br := bytes.NewBuffer(buf)
 
@@ -382,13 +389,18 @@ func (kvdb *DB) getAt(kde *keydirEntry, keybuf, key []byte) ([]byte, error) {
 	if calcCrc != crc {
 		return nil, fmt.Errorf("calculated crc %d differs from saved crc %d", calcCrc, crc)
 	}
+	tr.phase(PhaseDecode, kde.fileId)
 
 	return vbuf, nil
 }
 
 func (kvdb *DB) Get(key []byte) ([]byte, error) {
+	tr := kvdb.trace.begin(key)
+
 	kdes := kvdb.kd.get(key)
+	tr.phase(PhaseKeydir, -1)
 	if kdes == nil {
+		kvdb.trace.end(tr, 0, 0)
 		return nil, nil
 	}
 
@@ -397,7 +409,7 @@ func (kvdb *DB) Get(key []byte) ([]byte, error) {
 	var rBuf []byte
 
 	for _, kde := range kdes {
-		v, err := kvdb.getAt(kde, keybuf, key)
+		v, err := kvdb.getAt(kde, keybuf, key, tr)
 		if err != nil {
 			return nil, err
 		}
@@ -406,6 +418,7 @@ func (kvdb *DB) Get(key []byte) ([]byte, error) {
 			rBuf = append(rBuf, v...)
 		}
 	}
+	kvdb.trace.end(tr, len(kdes), len(rBuf))
 	return rBuf, nil
 }
 
@@ -540,13 +553,13 @@ func runWrites(kvdb *DB) {
 
 			err := binary.Write(cw, binary.BigEndian, crc)
 			if err != nil {
-				glog.Errorf("failed to write crc: %v", err)
+				logger.Errorf("failed to write crc: %v", err)
 				continue
 			}
 
 			_, err = cw.Write(buf.Bytes())
 			if err != nil {
-				glog.Errorf("failed to write: %v", err)
+				logger.Errorf("failed to write: %v", err)
 				continue
 			}
 
@@ -569,12 +582,12 @@ func runWrites(kvdb *DB) {
 		if kvp.op == FlushOp {
 			err := bw.Flush()
 			if err != nil {
-				glog.Errorf("failed to flush: %v", err)
+				logger.Errorf("failed to flush: %v", err)
 			}
 		} else if kvp.op == RotateOp {
 			err := kvdb.active.Close()
 			if err != nil {
-				glog.Errorf("failed to rotate close active: %v", err)
+				logger.Errorf("failed to rotate close active: %v", err)
 				panic(err)
 			}
 
@@ -582,7 +595,7 @@ func runWrites(kvdb *DB) {
 
 			f, err := os.OpenFile(dataFilename(kvdb.root, kvdb.activeFileId), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 			if err != nil {
-				glog.Errorf("failed to rotate open active: %v", err)
+				logger.Errorf("failed to rotate open active: %v", err)
 				panic(err)
 			}
 			kvdb.active = f
@@ -601,7 +614,7 @@ func runWrites(kvdb *DB) {
 
 	err := bw.Flush()
 	if err != nil {
-		glog.Errorf("failed to flush: %v", err)
+		logger.Errorf("failed to flush: %v", err)
 	}
 	kvdb.closing <- true
 }
@@ -35,7 +35,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/google/pprof/profile"
 )
 
 func TestBasic(t *testing.T) {
@@ -194,3 +197,86 @@ func TestNoKeydirFile(t *testing.T) {
 		t.Fatal("values differ")
 	}
 }
+
+func TestTrace(t *testing.T) {
+	root, err := ioutil.TempDir("", "kivi_test")
+	if err != nil {
+		t.Fatalf("cannot open tempdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	kdb, err := Open(root, keySizeSha1)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+
+	trace := NewTrace(1)
+	kdb.SetTrace(trace)
+
+	key := randomBytes(t, keySizeSha1)
+	err = kdb.Put(key, randomBytes(t, 50))
+	if err != nil {
+		t.Fatal("failed to insert")
+	}
+	err = kdb.Append(key, randomBytes(t, 10))
+	if err != nil {
+		t.Fatal("failed to append")
+	}
+	kdb.Flush()
+
+	for i := 0; i < 2; i++ {
+		_, err = kdb.Get(key)
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+	}
+
+	calls, dropped := trace.Calls()
+	if len(calls) != 1 || dropped != 1 {
+		t.Fatalf("got %d calls, %d dropped, want 1 and 1", len(calls), dropped)
+	}
+	if c := calls[0]; c.Entries != 2 || c.Bytes != 60 || !bytes.Equal(c.Key, key) {
+		t.Errorf("got call of %d entries, %d bytes, want 2 and 60", c.Entries, c.Bytes)
+	}
+
+	buf := new(bytes.Buffer)
+	err = trace.WriteCSV(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || lines[0] != "start,key,entries,bytes,keydir_ns,seek_ns,read_ns,decode_ns,total_ns" {
+		t.Errorf("got CSV %q", buf.String())
+	}
+
+	buf.Reset()
+	err = trace.WriteProfile(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := profile.Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.CheckValid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, fn := range p.Function {
+		names[fn.Name] = true
+	}
+	for _, name := range []string{"kivi.Get", "kivi.keydir", "kivi.read", "data_0"} {
+		if !names[name] {
+			t.Errorf("profile has no %s", name)
+		}
+	}
+	if len(p.SampleType) != 2 || p.SampleType[1].Unit != "nanoseconds" {
+		t.Errorf("got sample types %v, want calls and time", p.SampleType)
+	}
+
+	err = kdb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package kivi
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// TracePhase is a part of a Get timed by a Trace.
+type TracePhase int
+
+const (
+	// PhaseKeydir looks up the data file entries of the key in the keydir.
+	PhaseKeydir TracePhase = iota
+	// PhaseSeek finds the data file of an entry, opening it unless it is
+	// open already. Entries are read at their offset, without seeking the
+	// file, so opening it is what this phase costs.
+	PhaseSeek
+	// PhaseRead reads an entry from its data file.
+	PhaseRead
+	// PhaseDecode checks the key and CRC of an entry and copies its value
+	// out, values are stored uncompressed.
+	PhaseDecode
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"keydir", "seek", "read", "decode"}
+
+func (p TracePhase) String() string {
+	return phaseNames[p]
+}
+
+// TraceCall is a Get recorded by a Trace.
+type TraceCall struct {
+	Start time.Time
+	Key   []byte
+	// Entries is the number of data file entries read, one for each put and
+	// append of the key since the last put.
+	Entries int
+	Bytes   int
+	Phases  [numPhases]time.Duration
+}
+
+// Total returns how long c took.
+func (c *TraceCall) Total() time.Duration {
+	var total time.Duration
+	for _, d := range c.Phases {
+		total += d
+	}
+	return total
+}
+
+// traceKey is what a Trace sums up durations by, fileId is -1 for the
+// keydir phase.
+type traceKey struct {
+	phase  TracePhase
+	fileId int32
+}
+
+type traceSum struct {
+	count    int64
+	duration time.Duration
+}
+
+// Trace records the timings of the Gets of DBs it is set on, see SetTrace.
+// It keeps up to a given number of calls and sums up all of them by phase
+// and data file. It is safe for concurrent use.
+type Trace struct {
+	lock     sync.Mutex
+	start    time.Time
+	maxCalls int
+	calls    []*TraceCall
+	dropped  int64
+	sums     map[traceKey]*traceSum
+}
+
+// NewTrace returns a Trace keeping up to maxCalls calls.
+func NewTrace(maxCalls int) *Trace {
+	return &Trace{
+		start:    time.Now(),
+		maxCalls: maxCalls,
+		sums:     make(map[traceKey]*traceSum),
+	}
+}
+
+// SetTrace makes kvdb record its Gets in t, or stop recording them if t is
+// nil. It is set before kvdb is used.
+func (kvdb *DB) SetTrace(t *Trace) {
+	kvdb.trace = t
+}
+
+// traceSpan is a phase of a traced call, for one data file.
+type traceSpan struct {
+	traceKey
+	duration time.Duration
+}
+
+// tracing is a Get being traced, nil if the DB isn't traced.
+type tracing struct {
+	call  TraceCall
+	last  time.Time
+	spans []traceSpan
+}
+
+func (t *Trace) begin(key []byte) *tracing {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	tr := &tracing{last: now}
+	tr.call.Start = now
+	tr.call.Key = append([]byte(nil), key...)
+	return tr
+}
+
+// phase ends phase p of the call, for data file fileId.
+func (tr *tracing) phase(p TracePhase, fileId int32) {
+	if tr == nil {
+		return
+	}
+	now := time.Now()
+	d := now.Sub(tr.last)
+	tr.last = now
+
+	tr.call.Phases[p] += d
+	tr.spans = append(tr.spans, traceSpan{traceKey{p, fileId}, d})
+}
+
+func (t *Trace) end(tr *tracing, entries, n int) {
+	if tr == nil {
+		return
+	}
+	tr.call.Entries = entries
+	tr.call.Bytes = n
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, span := range tr.spans {
+		sum := t.sums[span.traceKey]
+		if sum == nil {
+			sum = new(traceSum)
+			t.sums[span.traceKey] = sum
+		}
+		sum.count++
+		sum.duration += span.duration
+	}
+
+	if len(t.calls) < t.maxCalls {
+		t.calls = append(t.calls, &tr.call)
+	} else {
+		t.dropped++
+	}
+}
+
+// Calls returns the calls kept, in the order they ended, and how many more
+// were dropped.
+func (t *Trace) Calls() ([]*TraceCall, int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return append([]*TraceCall(nil), t.calls...), t.dropped
+}
+
+// WriteCSV writes the calls kept as CSV, a line each with the durations of
+// its phases in nanoseconds.
+func (t *Trace) WriteCSV(w io.Writer) error {
+	calls, _ := t.Calls()
+
+	cw := csv.NewWriter(w)
+	header := []string{"start", "key", "entries", "bytes"}
+	for _, name := range phaseNames {
+		header = append(header, name+"_ns")
+	}
+	header = append(header, "total_ns")
+	cw.Write(header)
+
+	for _, c := range calls {
+		record := []string{
+			c.Start.Format(time.RFC3339Nano),
+			hex.EncodeToString(c.Key),
+			strconv.Itoa(c.Entries),
+			strconv.Itoa(c.Bytes),
+		}
+		for _, d := range c.Phases {
+			record = append(record, strconv.FormatInt(int64(d), 10))
+		}
+		record = append(record, strconv.FormatInt(int64(c.Total()), 10))
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteProfile writes the sums of all calls as a gzipped pprof profile, with
+// a count and a time value for each phase of each data file under a kivi.Get
+// root, to be looked at with go tool pprof.
+func (t *Trace) WriteProfile(w io.Writer) error {
+	t.lock.Lock()
+	keys := make([]traceKey, 0, len(t.sums))
+	sums := make(map[traceKey]traceSum, len(t.sums))
+	for key, sum := range t.sums {
+		keys = append(keys, key)
+		sums[key] = *sum
+	}
+	start := t.start
+	t.lock.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].phase != keys[j].phase {
+			return keys[i].phase < keys[j].phase
+		}
+		return keys[i].fileId < keys[j].fileId
+	})
+
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "calls", Unit: "count"},
+			{Type: "time", Unit: "nanoseconds"},
+		},
+		PeriodType:    &profile.ValueType{Type: "time", Unit: "nanoseconds"},
+		Period:        1,
+		TimeNanos:     start.UnixNano(),
+		DurationNanos: int64(time.Since(start)),
+	}
+
+	// a function and a location for each frame name
+	locs := make(map[string]*profile.Location)
+	location := func(name string) *profile.Location {
+		loc := locs[name]
+		if loc == nil {
+			id := uint64(len(p.Location) + 1)
+			fn := &profile.Function{ID: id, Name: name, SystemName: name}
+			loc = &profile.Location{ID: id, Line: []profile.Line{{Function: fn}}}
+			p.Function = append(p.Function, fn)
+			p.Location = append(p.Location, loc)
+			locs[name] = loc
+		}
+		return loc
+	}
+	getLoc := location("kivi.Get")
+
+	for _, key := range keys {
+		stack := []*profile.Location{location("kivi." + key.phase.String())}
+		if key.fileId >= 0 {
+			stack = append(stack, location(fmt.Sprintf("%s%d", dataFilenamePrefix, key.fileId)))
+		}
+		stack = append(stack, getLoc)
+
+		sum := sums[key]
+		p.Sample = append(p.Sample, &profile.Sample{
+			Location: stack,
+			Value:    []int64{sum.count, int64(sum.duration)},
+		})
+	}
+
+	return p.Write(w)
+}
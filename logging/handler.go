@@ -0,0 +1,127 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"runtime"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// handlerOptions let every record through, Logger drops the ones below the
+// levels.
+var handlerOptions = &slog.HandlerOptions{AddSource: true, Level: slog.Level(-100)}
+
+// NewJSONHandler returns a handler writing records as JSON lines to w.
+func NewJSONHandler(w io.Writer) slog.Handler {
+	return slog.NewJSONHandler(w, handlerOptions)
+}
+
+// NewTextHandler returns a handler writing records as key=value lines to w.
+func NewTextHandler(w io.Writer) slog.Handler {
+	return slog.NewTextHandler(w, handlerOptions)
+}
+
+// glogHandler hands records to glog, with their attributes appended to the
+// message as key=value.
+type glogHandler struct {
+	attrs []slog.Attr
+}
+
+// NewGlogHandler returns a handler logging records with glog, to its files
+// and in its format.
+func NewGlogHandler() slog.Handler {
+	return &glogHandler{}
+}
+
+func (h *glogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *glogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+
+	appendAttr := func(a slog.Attr) bool {
+		// the subsystem is clear from the file logging
+		if a.Key == "subsystem" {
+			return true
+		}
+		b.WriteString(" ")
+		b.WriteString(a.Key)
+		b.WriteString("=")
+		b.WriteString(a.Value.String())
+		return true
+	}
+	for _, a := range h.attrs {
+		appendAttr(a)
+	}
+	r.Attrs(appendAttr)
+
+	depth := callerDepth(r.PC)
+	switch {
+	case r.Level >= LevelError:
+		glog.ErrorDepth(depth, b.String())
+	case r.Level >= LevelWarn:
+		glog.WarningDepth(depth, b.String())
+	default:
+		glog.InfoDepth(depth, b.String())
+	}
+	return nil
+}
+
+// callerDepth returns the glog depth of the frame of pc, relative to the
+// caller of callerDepth, so glog names the file and line the record was
+// logged from.
+func callerDepth(pc uintptr) int {
+	var pcs [32]uintptr
+	n := runtime.Callers(2, pcs[:])
+	for i := 0; i < n; i++ {
+		if pcs[i] == pc {
+			return i
+		}
+	}
+	return 0
+}
+
+func (h *glogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &glogHandler{attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+// WithGroup is not supported, the attributes of groups are logged without
+// their group.
+func (h *glogHandler) WithGroup(name string) slog.Handler {
+	return h
+}
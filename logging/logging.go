@@ -0,0 +1,288 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package logging is how romba logs. Each subsystem, like archive or
+// replica, logs through its own Logger with its own level, into one
+// log/slog handler: glog's files by default, or JSON or text lines for log
+// shippers like Loki or Elasticsearch.
+//
+// Records carry the subsystem as attribute. Those logged through a logger
+// bound to a job, see Logger.Job, also carry its ID as job attribute and are
+// captured into a writer of the job's own.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Levels of records, those of slog. Verbose records of V(n) are logged at
+// VLevel(n).
+const (
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
+)
+
+// VLevel is the level of the records of V(v), LevelDebug for V(1) and one
+// further below for each level of verbosity above it.
+func VLevel(v int) slog.Level {
+	return LevelInfo - slog.Level(4*v)
+}
+
+// ParseLevel parses debug, info, warn or error, or vN for VLevel(N).
+func ParseLevel(s string) (slog.Level, error) {
+	ls := strings.ToLower(strings.TrimSpace(s))
+	if strings.HasPrefix(ls, "v") {
+		v, err := strconv.Atoi(ls[1:])
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid log level %q", s)
+		}
+		return VLevel(v), nil
+	}
+
+	switch ls {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+var state = struct {
+	sync.RWMutex
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+}{
+	handler: NewGlogHandler(),
+	level:   LevelInfo,
+	levels:  make(map[string]slog.Level),
+}
+
+// SetHandler makes records go to h.
+func SetHandler(h slog.Handler) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.handler = h
+}
+
+// SetLevel sets the level below which records are dropped, for subsystems
+// without a level of their own.
+func SetLevel(level slog.Level) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.level = level
+}
+
+// SetSubsystemLevel sets the level below which the records of subsystem are
+// dropped.
+func SetSubsystemLevel(subsystem string, level slog.Level) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.levels[subsystem] = level
+}
+
+// Job is where the records of a job are captured, besides the handler of
+// all records.
+type Job struct {
+	id      string
+	handler slog.Handler
+}
+
+// BeginJob returns the capture of the records of the job id into w, as JSON
+// lines. Only the records logged through loggers bound to it are captured,
+// other jobs and the rest of the process log as before.
+func BeginJob(id string, w io.Writer) *Job {
+	return &Job{
+		id:      id,
+		handler: slog.NewJSONHandler(w, &slog.HandlerOptions{AddSource: true, Level: slog.Level(-100)}),
+	}
+}
+
+// ID returns the ID of the job.
+func (j *Job) ID() string {
+	return j.id
+}
+
+type jobKey struct{}
+
+// NewContext returns a copy of ctx carrying j.
+func NewContext(ctx context.Context, j *Job) context.Context {
+	return context.WithValue(ctx, jobKey{}, j)
+}
+
+// FromContext returns the job ctx carries, nil if none.
+func FromContext(ctx context.Context) *Job {
+	j, _ := ctx.Value(jobKey{}).(*Job)
+	return j
+}
+
+// Logger logs the records of a subsystem.
+type Logger struct {
+	subsystem string
+	job       *Job
+}
+
+// For returns the logger of subsystem.
+func For(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// Job returns a logger of the subsystem of l whose records carry the ID of j
+// as job attribute and are captured by j too. A nil j returns l.
+func (l *Logger) Job(j *Job) *Logger {
+	if j == nil {
+		return l
+	}
+	return &Logger{subsystem: l.subsystem, job: j}
+}
+
+// Ctx returns l bound to the job ctx carries, see Job.
+func (l *Logger) Ctx(ctx context.Context) *Logger {
+	return l.Job(FromContext(ctx))
+}
+
+// Enabled reports whether records of level are logged.
+func (l *Logger) Enabled(level slog.Level) bool {
+	state.RLock()
+	defer state.RUnlock()
+
+	min, ok := state.levels[l.subsystem]
+	if !ok {
+		min = state.level
+	}
+	return level >= min
+}
+
+// log logs a record of level with msg and the key value pairs or slog.Attr
+// of args, attributed to the caller of the exported method calling it.
+func (l *Logger) log(level slog.Level, msg string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	r.AddAttrs(slog.String("subsystem", l.subsystem))
+
+	state.RLock()
+	handler := state.handler
+	state.RUnlock()
+
+	job := l.job
+	if job != nil {
+		r.AddAttrs(slog.String("job", job.id))
+	}
+	r.Add(args...)
+
+	ctx := context.Background()
+	if handler.Enabled(ctx, level) {
+		handler.Handle(ctx, r)
+	}
+	if job != nil {
+		job.handler.Handle(ctx, r.Clone())
+	}
+}
+
+// Debug logs msg with the attributes of args, as in slog.
+func (l *Logger) Debug(msg string, args ...interface{}) {
+	l.log(LevelDebug, msg, args...)
+}
+
+// Info logs msg with the attributes of args, as in slog.
+func (l *Logger) Info(msg string, args ...interface{}) {
+	l.log(LevelInfo, msg, args...)
+}
+
+// Warn logs msg with the attributes of args, as in slog.
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.log(LevelWarn, msg, args...)
+}
+
+// Error logs msg with the attributes of args, as in slog.
+func (l *Logger) Error(msg string, args ...interface{}) {
+	l.log(LevelError, msg, args...)
+}
+
+// Infof logs a message formatted as in fmt.Sprintf.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// Warningf logs a warning formatted as in fmt.Sprintf.
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+// Errorf logs an error formatted as in fmt.Sprintf.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, args...))
+}
+
+// Verbose logs the records of a level of verbosity.
+type Verbose struct {
+	l     *Logger
+	level slog.Level
+}
+
+// V returns the logger of records logged at VLevel(v), like glog.V.
+func (l *Logger) V(v int) Verbose {
+	return Verbose{l: l, level: VLevel(v)}
+}
+
+// Enabled reports whether the records of v are logged.
+func (v Verbose) Enabled() bool {
+	return v.l.Enabled(v.level)
+}
+
+// Infof logs a message formatted as in fmt.Sprintf.
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v.l.Enabled(v.level) {
+		v.l.log(v.level, fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// withHandler runs f with records going to h, and the levels reset.
+func withHandler(h slog.Handler, f func()) {
+	state.Lock()
+	saved, savedLevel := state.handler, state.level
+	state.handler, state.level = h, LevelInfo
+	state.levels = make(map[string]slog.Level)
+	state.Unlock()
+
+	defer func() {
+		state.Lock()
+		state.handler, state.level = saved, savedLevel
+		state.levels = make(map[string]slog.Level)
+		state.Unlock()
+	}()
+	f()
+}
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		rec := make(map[string]interface{})
+		err := json.Unmarshal([]byte(line), &rec)
+		if err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]slog.Level{
+		"debug":   LevelDebug,
+		"INFO":    LevelInfo,
+		"warning": LevelWarn,
+		"error":   LevelError,
+		"v0":      LevelInfo,
+		"v2":      LevelDebug - 4,
+	} {
+		got, err := ParseLevel(s)
+		if err != nil || got != want {
+			t.Errorf("parsed %s as %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "loud", "v-1", "vx"} {
+		if _, err := ParseLevel(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	withHandler(NewJSONHandler(buf), func() {
+		archive := For("archive")
+		replica := For("replica")
+
+		SetSubsystemLevel("replica", LevelWarn)
+		archive.Infof("archived %d files", 3)
+		archive.V(2).Infof("not logged")
+		replica.Info("not logged either")
+		replica.Warn("remote slow", "remote", "b:4200")
+
+		SetLevel(VLevel(2))
+		archive.V(2).Infof("moved %s", "a.zip")
+		if !archive.V(2).Enabled() || replica.V(1).Enabled() {
+			t.Errorf("wrong verbosity enabled")
+		}
+	})
+
+	records := decodeLines(t, buf)
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3:\n%s", len(records), buf)
+	}
+	if records[0]["msg"] != "archived 3 files" || records[0]["subsystem"] != "archive" || records[0]["level"] != "INFO" {
+		t.Errorf("got first record %v", records[0])
+	}
+	if records[1]["remote"] != "b:4200" || records[1]["subsystem"] != "replica" || records[1]["level"] != "WARN" {
+		t.Errorf("got second record %v", records[1])
+	}
+	if records[2]["msg"] != "moved a.zip" || records[2]["level"] != "DEBUG-4" {
+		t.Errorf("got third record %v", records[2])
+	}
+
+	source, _ := records[0]["source"].(map[string]interface{})
+	if file, _ := source["file"].(string); filepath.Base(file) != "logging_test.go" {
+		t.Errorf("got source %v, want this file", source)
+	}
+}
+
+func TestJobCapture(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jobBuf := new(bytes.Buffer)
+	otherBuf := new(bytes.Buffer)
+	withHandler(NewJSONHandler(buf), func() {
+		l := For("service")
+		job := BeginJob("7", jobBuf)
+		other := BeginJob("8", otherBuf)
+
+		l.Info("before")
+		l.Job(job).Info("during", "files", 2)
+		For("archive").Ctx(NewContext(context.Background(), job)).Error("still during")
+		l.Ctx(context.Background()).Info("unbound")
+		l.Job(other).Info("other")
+		l.Info("after")
+	})
+
+	all := decodeLines(t, buf)
+	if len(all) != 6 || all[0]["job"] != nil || all[1]["job"] != "7" || all[2]["job"] != "7" ||
+		all[3]["job"] != nil || all[4]["job"] != "8" || all[5]["job"] != nil {
+		t.Errorf("got records %v", all)
+	}
+
+	job := decodeLines(t, jobBuf)
+	if len(job) != 2 || job[0]["msg"] != "during" || job[0]["files"] != 2.0 || job[1]["msg"] != "still during" ||
+		job[1]["subsystem"] != "archive" {
+		t.Errorf("got job records %v", job)
+	}
+
+	other := decodeLines(t, otherBuf)
+	if len(other) != 1 || other[0]["msg"] != "other" {
+		t.Errorf("got records of other job %v", other)
+	}
+}
+
+// logVia calls handle with the PC of its caller, as Logger hands records to
+// handlers.
+func logVia(handle func(pc uintptr) int) int {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	return handle(pcs[0])
+}
+
+func TestCallerDepth(t *testing.T) {
+	depth := logVia(func(pc uintptr) int {
+		return callerDepth(pc)
+	})
+	// the handler, then logVia, then here
+	if depth != 2 {
+		t.Errorf("got depth %d, want 2", depth)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package migrate reads the scan results other ROM managers export as DATs,
+// so romba's index knows the hashes of the files a collection managed by
+// them has. ROMVault exports them as Logiqx XML ("Save Full DAT"),
+// clrmamepro in its own format ("Create DAT" in the scanner).
+//
+// Only those DAT exports are read. The binary caches the tools keep their
+// scan results in, the RomVault3cache.Cache file and the cache files of
+// clrmamepro's scanner, are not: their formats are undocumented and change
+// between versions of the tools. Detect recognizes them and refuses them
+// with ErrBinaryCache, which tells how to export the DAT instead.
+package migrate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/logging"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+var logger = logging.For("migrate")
+
+// Tool is a ROM manager whose DAT exports can be imported. It is told by
+// the format of the DAT: Logiqx XML is taken as ROMVault's export.
+type Tool string
+
+const (
+	ROMVault   Tool = "romvault"
+	ClrMamePro Tool = "clrmamepro"
+)
+
+// ErrBinaryCache is returned for the binary scan caches of the tools, which
+// aren't read.
+var ErrBinaryCache = errors.New("binary scan caches can't be read, export the scan results as a DAT: " +
+	"\"Save Full DAT\" in ROMVault, \"Create DAT\" in the clrmamepro scanner")
+
+// binarySniffSize is how much of a file is looked at for NUL bytes.
+const binarySniffSize = 8 * 1024
+
+// Detect returns the tool that wrote the scan results in path.
+func Detect(path string) (Tool, error) {
+	name := strings.ToLower(filepath.Base(path))
+	if strings.HasPrefix(name, "romvault") && strings.HasSuffix(name, ".cache") {
+		return "", ErrBinaryCache
+	}
+
+	binary, err := isBinary(path)
+	if err != nil {
+		return "", err
+	}
+	if binary && !parser.IsContainer(path) {
+		return "", ErrBinaryCache
+	}
+
+	format, _, err := parser.DetectFile(path)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case parser.FormatLogiqx:
+		return ROMVault, nil
+	case parser.FormatClrMamePro:
+		return ClrMamePro, nil
+	case parser.FormatUnknown:
+		if parser.IsContainer(path) {
+			// told apart when parsed, both read the same
+			return ROMVault, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a ROMVault or clrmamepro DAT but %v", path, format)
+}
+
+func isBinary(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, binarySniffSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return bytes.IndexByte(buf[:n], 0) >= 0, nil
+}
+
+// Report is what was read from the scan results of a tool.
+type Report struct {
+	Path  string
+	Tool  Tool
+	Sets  int
+	Roms  int
+	Bytes int64
+	// NoSha1 are the roms skipped for lacking a SHA1, romba's index is by
+	// SHA1.
+	NoSha1 int
+}
+
+func (r *Report) String() string {
+	s := fmt.Sprintf("%s: %d roms of %d sets from %s", r.Path, r.Roms, r.Sets, r.Tool)
+	if r.NoSha1 > 0 {
+		s += fmt.Sprintf(", skipped %d roms without SHA1", r.NoSha1)
+	}
+	return s
+}
+
+// Read calls f for the roms the tool found, read from the scan results in
+// path. The path of the roms is where the tool keeps them, the folder of the
+// set below root.
+func Read(path, root string, f func(rom *types.Rom) error) (*Report, error) {
+	tool, err := Detect(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dat, _, err := parser.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Path: path,
+		Tool: tool,
+	}
+
+	for _, game := range dat.Games {
+		found := false
+		for _, rom := range game.Roms {
+			if rom.Status == types.StatusNoDump {
+				continue
+			}
+			if rom.Sha1 == nil {
+				report.NoSha1++
+				continue
+			}
+
+			rom.Path = filepath.Join(root, game.Name, rom.Name)
+			err = f(rom)
+			if err != nil {
+				return nil, err
+			}
+			found = true
+			report.Roms++
+			report.Bytes += rom.Size
+		}
+		if found {
+			report.Sets++
+		}
+	}
+	logger.V(2).Infof("read %d roms of %d sets from %s", report.Roms, report.Sets, path)
+	return report, nil
+}
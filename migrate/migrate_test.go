@@ -0,0 +1,87 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package migrate
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestDetect(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		tool Tool
+		err  error
+	}{
+		{"romvault.xml", ROMVault, nil},
+		{"cmpro.dat", ClrMamePro, nil},
+		{"RomVault3cache.Cache", "", ErrBinaryCache},
+	} {
+		tool, err := Detect(filepath.Join("testdata", tc.file))
+		if tool != tc.tool || err != tc.err {
+			t.Errorf("%s: got %q, %v, want %q, %v", tc.file, tool, err, tc.tool, tc.err)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	var roms []*types.Rom
+	report, err := Read(filepath.Join("testdata", "romvault.xml"), "/roms", func(rom *types.Rom) error {
+		roms = append(roms, rom)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Tool != ROMVault || report.Sets != 1 || report.Roms != 2 || report.Bytes != 8192 ||
+		report.NoSha1 != 1 {
+		t.Errorf("got report %+v", report)
+	}
+	if len(roms) != 2 {
+		t.Fatalf("got %d roms, want 2", len(roms))
+	}
+	if roms[0].Path != filepath.Join("/roms", "pacman", "pacman.6e") || roms[0].Md5 == nil || roms[0].Crc == nil {
+		t.Errorf("got rom %+v", roms[0])
+	}
+
+	report, err = Read(filepath.Join("testdata", "cmpro.dat"), "/roms", func(rom *types.Rom) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Tool != ClrMamePro || report.Roms != 1 {
+		t.Errorf("got report %+v", report)
+	}
+}
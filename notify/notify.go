@@ -0,0 +1,84 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package notify tells about jobs that ended, so long runs like an overnight
+// archive don't have to be checked on by hand. Notifiers post to webhooks,
+// like those of Slack and Discord, or send mail.
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Result is how a job ended.
+type Result struct {
+	// Host is the name of the machine romba runs on.
+	Host      string    `json:"host"`
+	JobID     string    `json:"jobId"`
+	Job       string    `json:"job"`
+	Succeeded bool      `json:"succeeded"`
+	Message   string    `json:"message,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+// Subject is a one line summary of r.
+func (r *Result) Subject() string {
+	outcome := "done"
+	if !r.Succeeded {
+		outcome = "failed"
+	}
+	return fmt.Sprintf("romba on %s: job %s %s %s", r.Host, r.JobID, r.Job, outcome)
+}
+
+// Text describes r in full.
+func (r *Result) Text() string {
+	var b strings.Builder
+	b.WriteString(r.Subject())
+	b.WriteString("\n")
+	if !r.Started.IsZero() {
+		fmt.Fprintf(&b, "ran from %s for %s\n", r.Started.Format(time.RFC1123),
+			r.Finished.Sub(r.Started).Round(time.Second))
+	}
+	if r.Message != "" {
+		fmt.Fprintf(&b, "%s\n", r.Message)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, "error: %s\n", r.Error)
+	}
+	return b.String()
+}
+
+// Notifier tells about a job that ended.
+type Notifier interface {
+	Notify(r *Result) error
+}
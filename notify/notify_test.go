@@ -0,0 +1,168 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testResult() *Result {
+	started := time.Date(2014, 3, 1, 22, 0, 0, 0, time.UTC)
+	return &Result{
+		Host:      "vault",
+		JobID:     "7",
+		Job:       "archive",
+		Succeeded: false,
+		Message:   "archived 10 files",
+		Error:     "disk full",
+		Started:   started,
+		Finished:  started.Add(90 * time.Minute),
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		bodies = append(bodies, body)
+		if r.URL.Path == "/broken" {
+			http.Error(w, "no such hook", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	r := testResult()
+
+	wh, err := NewWebhook(server.URL + "/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wh.Format != FormatJSON {
+		t.Errorf("got format %s for a local hook, want json", wh.Format)
+	}
+	err = wh.Notify(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Result
+	err = json.Unmarshal(bodies[0], &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != *r {
+		t.Errorf("posted %+v, want %+v", got, *r)
+	}
+
+	wh.Format = FormatSlack
+	err = wh.Notify(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slack map[string]string
+	err = json.Unmarshal(bodies[1], &slack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(slack["text"], "job 7 archive failed") || !strings.Contains(slack["text"], "disk full") {
+		t.Errorf("posted slack message %q", slack["text"])
+	}
+
+	wh.URL = server.URL + "/broken"
+	err = wh.Notify(r)
+	if err == nil || !strings.Contains(err.Error(), "no such hook") {
+		t.Errorf("got error %v posting to a broken hook", err)
+	}
+}
+
+func TestFormatForHost(t *testing.T) {
+	for host, want := range map[string]string{
+		"hooks.slack.com":  FormatSlack,
+		"discord.com":      FormatDiscord,
+		"ptb.discord.com":  FormatDiscord,
+		"discordapp.com":   FormatDiscord,
+		"example.org":      FormatJSON,
+		"slack.example.eu": FormatJSON,
+	} {
+		if got := formatForHost(host); got != want {
+			t.Errorf("host %s got format %s, want %s", host, got, want)
+		}
+	}
+}
+
+func TestMail(t *testing.T) {
+	var sent []byte
+	var sentTo []string
+	var sentAuth smtp.Auth
+
+	m := &Mail{
+		Addr:     "mail.example.org:587",
+		From:     "romba@example.org",
+		To:       []string{"a@example.org", "b@example.org"},
+		Username: "romba",
+		Password: "secret",
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			sent, sentTo, sentAuth = msg, to, a
+			return nil
+		},
+	}
+
+	err := m.Notify(testResult())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sentAuth == nil || len(sentTo) != 2 {
+		t.Errorf("sent to %v with auth %v", sentTo, sentAuth)
+	}
+
+	msg := string(sent)
+	for _, want := range []string{
+		"To: a@example.org, b@example.org\r\n",
+		"Subject: romba on vault: job 7 archive failed\r\n",
+		"\r\n\r\nromba on vault",
+		"ran from Sat, 01 Mar 2014 22:00:00 UTC for 1h30m0s\r\n",
+		"error: disk full\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("mail lacks %q:\n%s", want, msg)
+		}
+	}
+}
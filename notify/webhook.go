@@ -0,0 +1,125 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Formats of webhook posts.
+const (
+	// FormatJSON posts the Result as is.
+	FormatJSON = "json"
+	// FormatSlack posts a message to a Slack incoming webhook.
+	FormatSlack = "slack"
+	// FormatDiscord posts a message to a Discord webhook.
+	FormatDiscord = "discord"
+)
+
+// Webhook posts results to a URL.
+type Webhook struct {
+	URL string
+	// Format is one of the Format constants, guessed from the host of URL
+	// if empty.
+	Format string
+	Client *http.Client
+}
+
+// NewWebhook returns a webhook posting to rawurl in the format its host
+// takes.
+func NewWebhook(rawurl string) (*Webhook, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webhook %s is not an http or https URL", rawurl)
+	}
+
+	return &Webhook{
+		URL:    rawurl,
+		Format: formatForHost(u.Hostname()),
+	}, nil
+}
+
+func formatForHost(host string) string {
+	host = strings.ToLower(host)
+	switch {
+	case host == "hooks.slack.com":
+		return FormatSlack
+	case host == "discord.com" || host == "discordapp.com" || strings.HasSuffix(host, ".discord.com"):
+		return FormatDiscord
+	}
+	return FormatJSON
+}
+
+// Notify posts r.
+func (wh *Webhook) Notify(r *Result) error {
+	var body interface{}
+	switch wh.Format {
+	case FormatSlack:
+		body = map[string]string{"text": r.Text()}
+	case FormatDiscord:
+		body = map[string]string{"content": r.Text()}
+	case FormatJSON, "":
+		body = r
+	default:
+		return fmt.Errorf("unknown webhook format %q", wh.Format)
+	}
+
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	client := wh.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Post(wh.URL, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook %s: %s: %s", wh.URL, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
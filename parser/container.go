@@ -0,0 +1,234 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// IsContainer reports whether path names a zip or gzip file, which dats are
+// commonly distributed in.
+func IsContainer(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".zip", ".gz":
+		return true
+	}
+	return false
+}
+
+// IsDatFile reports whether path names a dat file Parse can read, going by its
+// name. Gzip files are dat files if the file they unpack to is, like
+// foo.dat.gz, zip files are if they hold any, see NoDatsError.
+func IsDatFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".dat", ".xml", ".zip":
+		return true
+	case ".gz":
+		return IsDatFile(gzipMemberName(path))
+	}
+	return false
+}
+
+// gzipMemberName returns the name of the file the gzip file path unpacks to.
+func gzipMemberName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// maxContainerDepth is how deep containers held by containers are unpacked.
+const maxContainerDepth = 3
+
+// maxUnpackedSize is how many bytes a container and the containers it holds
+// may unpack to, so zip bombs don't fill the disk.
+var maxUnpackedSize int64 = 4 << 30
+
+// NoDatsError is returned for containers that hold no dats.
+type NoDatsError struct {
+	Path string
+}
+
+func (e *NoDatsError) Error() string {
+	return fmt.Sprintf("no dat files in %s", e.Path)
+}
+
+// parseContainer parses the dats in the zip or gzip file path like ParseAll.
+// The dats get the SHA1 of their unpacked contents, so they are the same dats
+// as their unpacked files, and a path below path. Members that aren't dats
+// are skipped.
+func parseContainer(path string, opts parseOptions) ([]*types.Dat, [][]byte, []*ParseError, error) {
+	if opts.depth >= maxContainerDepth {
+		return nil, nil, nil, fmt.Errorf("%s is nested in more than %d containers", path, maxContainerDepth)
+	}
+	opts.depth++
+	if opts.unpackable == nil {
+		unpackable := maxUnpackedSize
+		opts.unpackable = &unpackable
+	}
+
+	if strings.ToLower(filepath.Ext(path)) == ".gz" {
+		name := gzipMemberName(path)
+		if !IsDatFile(name) {
+			return nil, nil, nil, &NoDatsError{Path: path}
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer file.Close()
+
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to open %s: %v", path, err)
+		}
+		defer gr.Close()
+
+		dats, sha1s, warnings, err := parseMember(gr, path, name, opts)
+		if err == nil && len(dats) == 0 {
+			err = &NoDatsError{Path: path}
+		}
+		return dats, sha1s, warnings, err
+	}
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer zr.Close()
+
+	var (
+		dats     []*types.Dat
+		sha1s    [][]byte
+		warnings []*ParseError
+	)
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !IsDatFile(f.Name) {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to open %s in %s: %v", f.Name, path, err)
+		}
+
+		mdats, msha1s, mwarnings, err := parseMember(rc, path, f.Name, opts)
+		rc.Close()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		dats = append(dats, mdats...)
+		sha1s = append(sha1s, msha1s...)
+		warnings = append(warnings, mwarnings...)
+	}
+
+	if len(dats) == 0 {
+		return nil, nil, nil, &NoDatsError{Path: path}
+	}
+	return dats, sha1s, warnings, nil
+}
+
+// parseMember parses the dat name of the container path read from r. It is
+// unpacked to a temporary file first, telling the kind of a dat takes
+// seeking. Members of unknown formats give no dats.
+func parseMember(r io.Reader, path, name string, opts parseOptions) ([]*types.Dat, [][]byte, []*ParseError, error) {
+	tmp, err := ioutil.TempFile("", "romba-dat-*"+filepath.Ext(name))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(r, *opts.unpackable+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > *opts.unpackable {
+		err = fmt.Errorf("unpacks to more than %d bytes", maxUnpackedSize)
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to unpack %s from %s: %v", name, path, err)
+	}
+	*opts.unpackable -= n
+
+	memberPath := filepath.Join(path, filepath.FromSlash(name))
+
+	if !IsContainer(name) {
+		format, _, err := DetectFile(tmp.Name())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if format == FormatUnknown {
+			logger.Warningf("skipping %s, it is not a dat of a known format", memberPath)
+			return nil, nil, nil, nil
+		}
+	}
+
+	dats, sha1s, warnings, err := parseAll(tmp.Name(), opts)
+	if _, ok := err.(*NoDatsError); ok {
+		logger.Warningf("skipping %s, it holds no dats", memberPath)
+		return nil, nil, nil, nil
+	}
+
+	if pe, ok := err.(*ParseError); ok {
+		pe.Path = memberPath
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, d := range dats {
+		d.Path = memberPath
+	}
+	for _, w := range warnings {
+		w.Path = memberPath
+	}
+	return dats, sha1s, warnings, nil
+}
+
+// parseSingle returns the only dat of the container path.
+func parseSingle(path string) (*types.Dat, []byte, []*ParseError, error) {
+	dats, sha1s, warnings, err := parseContainer(path, parseOptions{lenient: true})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(dats) != 1 {
+		return nil, nil, nil, fmt.Errorf("%s holds %d dats instead of one", path, len(dats))
+	}
+	return dats[0], sha1s[0], warnings, nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Format is a dat file format.
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatClrMamePro
+	FormatLogiqx
+	FormatMAME
+	FormatSoftwareList
+	FormatRomCenter
+)
+
+var formatNames = map[Format]string{
+	FormatUnknown:      "unknown",
+	FormatClrMamePro:   "clrmamepro",
+	FormatLogiqx:       "Logiqx XML",
+	FormatMAME:         "MAME XML",
+	FormatSoftwareList: "MAME software list",
+	FormatRomCenter:    "RomCenter",
+}
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
+// detectSize is how much of a file Detect looks at. MAME XML starts with its
+// DTD, which takes a few KB.
+const detectSize = 64 * 1024
+
+// Detect recognizes the format of the dat in r from its start. The confidence,
+// from 0 to 1, is 1 if the dat starts the way its format requires (a
+// clrmamepro header, a known XML root, RomCenter sections) and lower if the
+// format is only likely. Unknown formats have a confidence of 0.
+func Detect(r io.Reader) (Format, float64, error) {
+	snippet, err := ioutil.ReadAll(newUTF8Reader(io.LimitReader(r, detectSize)))
+	if err != nil {
+		return FormatUnknown, 0, err
+	}
+	text := strings.TrimSpace(string(snippet))
+
+	switch {
+	case strings.HasPrefix(text, "<"):
+		return detectXML(snippet)
+	case hasRomCenterStart(text):
+		if strings.Contains(strings.ToUpper(text), "[GAMES]") {
+			return FormatRomCenter, 1, nil
+		}
+		return FormatRomCenter, 0.8, nil
+	}
+	return detectClrMamePro(snippet)
+}
+
+func detectXML(snippet []byte) (Format, float64, error) {
+	root, err := xmlRoot(bytes.NewReader(snippet))
+	if err != nil {
+		// the root is past the start looked at
+		return FormatLogiqx, 0.5, nil
+	}
+
+	switch root {
+	case "datafile":
+		return FormatLogiqx, 1, nil
+	case "mame":
+		return FormatMAME, 1, nil
+	case "softwarelist", "softwarelists":
+		return FormatSoftwareList, 1, nil
+	}
+	return FormatUnknown, 0, nil
+}
+
+// detectClrMamePro goes by the first statement of the dat, the header or a
+// game.
+func detectClrMamePro(snippet []byte) (Format, float64, error) {
+	ll := lex("detect", bytes.NewReader(snippet))
+	var prev item
+	for i := ll.nextItem(); i.typ != itemEOF && i.typ != itemError; i = ll.nextItem() {
+		if i.typ == itemOpenBrace {
+			switch prev.typ {
+			case itemClrMamePro:
+				return FormatClrMamePro, 1, nil
+			case itemGame:
+				return FormatClrMamePro, 0.8, nil
+			}
+		}
+		prev = i
+	}
+	return FormatUnknown, 0, nil
+}
+
+// DetectFile returns the format of the dat file path, see Detect. Dats in zip
+// or gzip files are told apart when parsed, their format is unknown.
+func DetectFile(path string) (Format, float64, error) {
+	if IsContainer(path) {
+		return FormatUnknown, 0, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return FormatUnknown, 0, err
+	}
+	defer file.Close()
+
+	return Detect(file)
+}
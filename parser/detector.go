@@ -0,0 +1,222 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// xmlDetector is a clrmamepro header skipper definition.
+type xmlDetector struct {
+	Name    string     `xml:"name"`
+	Author  string     `xml:"author"`
+	Version string     `xml:"version"`
+	Rules   []*xmlRule `xml:"rule"`
+}
+
+type xmlRule struct {
+	StartOffset string `xml:"start_offset,attr"`
+	EndOffset   string `xml:"end_offset,attr"`
+	Operation   string `xml:"operation,attr"`
+	// the tests of a rule are told apart by element name, in order
+	Tests []*xmlTest `xml:",any"`
+}
+
+type xmlTest struct {
+	XMLName  xml.Name
+	Offset   string `xml:"offset,attr"`
+	Value    string `xml:"value,attr"`
+	Mask     string `xml:"mask,attr"`
+	Size     string `xml:"size,attr"`
+	Operator string `xml:"operator,attr"`
+	Result   string `xml:"result,attr"`
+}
+
+// ParseDetector parses a clrmamepro header skipper definition, as shipped with
+// No-Intro dats. Offsets and sizes are hex, as in the definitions.
+func ParseDetector(r io.Reader, path string) (*types.Detector, error) {
+	xd := new(xmlDetector)
+
+	decoder := newXMLDecoder(r)
+	err := decoder.Decode(xd)
+	if err != nil {
+		return nil, xmlError(decoder, path, err)
+	}
+
+	d := &types.Detector{
+		Name:    xd.Name,
+		Author:  xd.Author,
+		Version: xd.Version,
+	}
+
+	for _, xr := range xd.Rules {
+		rule, err := xr.rule()
+		if err != nil {
+			return nil, fmt.Errorf("error in header skipper %s: %v", path, err)
+		}
+		d.Rules = append(d.Rules, rule)
+	}
+	return d, nil
+}
+
+// ParseDetectors parses the header skipper definitions, the .xml files, in
+// dir.
+func ParseDetectors(dir string) ([]*types.Detector, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ds []*types.Detector
+	for _, path := range paths {
+		d, err := parseDetectorFile(path)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+func parseDetectorFile(path string) (*types.Detector, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseDetector(file, path)
+}
+
+func (xr *xmlRule) rule() (*types.DetectorRule, error) {
+	r := &types.DetectorRule{
+		EndOffset: -1,
+		Operation: types.OpNone,
+	}
+
+	var err error
+
+	if xr.StartOffset != "" {
+		r.StartOffset, err = parseHex(xr.StartOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if xr.EndOffset != "" && !strings.EqualFold(xr.EndOffset, "EOF") {
+		r.EndOffset, err = parseHex(xr.EndOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch op := strings.ToLower(xr.Operation); op {
+	case "":
+	case types.OpNone, types.OpBitSwap, types.OpByteSwap, types.OpWordSwap, types.OpWordByteSwap:
+		r.Operation = op
+	default:
+		return nil, fmt.Errorf("unknown operation %q", xr.Operation)
+	}
+
+	for _, xt := range xr.Tests {
+		t, err := xt.test()
+		if err != nil {
+			return nil, err
+		}
+		r.Tests = append(r.Tests, t)
+	}
+	return r, nil
+}
+
+func (xt *xmlTest) test() (*types.DetectorTest, error) {
+	t := &types.DetectorTest{
+		Kind:   xt.XMLName.Local,
+		Result: !strings.EqualFold(xt.Result, "false"),
+	}
+
+	var err error
+
+	switch t.Kind {
+	case types.TestData, types.TestOr, types.TestAnd, types.TestXor:
+		if xt.Offset != "" {
+			t.Offset, err = parseHex(xt.Offset)
+			if err != nil {
+				return nil, err
+			}
+		}
+		t.Value, err = hex.DecodeString(xt.Value)
+		if err != nil {
+			return nil, fmt.Errorf("bad value %q: %v", xt.Value, err)
+		}
+		if t.Kind != types.TestData {
+			t.Mask, err = hex.DecodeString(xt.Mask)
+			if err != nil {
+				return nil, fmt.Errorf("bad mask %q: %v", xt.Mask, err)
+			}
+		}
+	case types.TestFile:
+		if strings.EqualFold(xt.Size, "PO2") {
+			t.Size = -1
+		} else {
+			t.Size, err = parseHex(xt.Size)
+			if err != nil {
+				return nil, err
+			}
+		}
+		t.Operator = strings.ToLower(xt.Operator)
+		switch t.Operator {
+		case "":
+			t.Operator = "equal"
+		case "equal", "less", "greater":
+		default:
+			return nil, fmt.Errorf("unknown file test operator %q", xt.Operator)
+		}
+	default:
+		return nil, fmt.Errorf("unknown test %q", t.Kind)
+	}
+	return t, nil
+}
+
+func parseHex(s string) (int64, error) {
+	v, err := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad hex number %q", s)
+	}
+	return v, nil
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// cp1252 holds the characters of Windows-1252 that differ from Latin-1, for
+// the bytes from 0x80 to 0x9f. Undefined ones are kept as the Latin-1 control
+// characters.
+var cp1252 = [32]rune{
+	0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+	0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+}
+
+// utf8Reader transcodes dats to UTF-8. Older dats are often Latin-1 or
+// Windows-1252, some are UTF-16.
+type utf8Reader struct {
+	br *bufio.Reader
+	// order is the byte order of UTF-16 input, nil for 8 bit input.
+	order binary.ByteOrder
+	out   []byte
+	buf   []byte
+	err   error
+	// bom is the length of the dropped byte order mark. exact is set as long
+	// as the output is the input byte for byte after it.
+	bom   int64
+	exact bool
+}
+
+// newUTF8Reader returns a reader of r as UTF-8. UTF-16 is recognized by its
+// byte order mark, or by starting with '<' as XML does. Otherwise the input is
+// taken as UTF-8, with bytes that aren't valid UTF-8 taken as Windows-1252,
+// which covers Latin-1 as well. A byte order mark is dropped.
+func newUTF8Reader(r io.Reader) *utf8Reader {
+	ur := &utf8Reader{
+		br:  bufio.NewReader(r),
+		buf: make([]byte, 4096),
+	}
+
+	start, _ := ur.br.Peek(4)
+	switch {
+	case strings.HasPrefix(string(start), "\xff\xfe"):
+		ur.order = binary.LittleEndian
+		ur.br.Discard(2)
+	case strings.HasPrefix(string(start), "\xfe\xff"):
+		ur.order = binary.BigEndian
+		ur.br.Discard(2)
+	case strings.HasPrefix(string(start), "<\x00"):
+		ur.order = binary.LittleEndian
+	case strings.HasPrefix(string(start), "\x00<"):
+		ur.order = binary.BigEndian
+	case strings.HasPrefix(string(start), "\xef\xbb\xbf"):
+		ur.br.Discard(3)
+		ur.bom = 3
+	}
+	ur.exact = ur.order == nil
+	return ur
+}
+
+func (r *utf8Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill transcodes up to a buffer of input.
+func (r *utf8Reader) fill() {
+	n := 0
+	for n+utf8.UTFMax <= len(r.buf) {
+		c, err := r.next()
+		if err != nil {
+			r.err = err
+			break
+		}
+		n += utf8.EncodeRune(r.buf[n:], c)
+	}
+	r.out = r.buf[:n]
+}
+
+func (r *utf8Reader) next() (rune, error) {
+	if r.order != nil {
+		c, err := r.unit()
+		if err != nil || !utf16.IsSurrogate(c) {
+			return c, err
+		}
+		c2, err := r.unit()
+		if err != nil {
+			return utf8.RuneError, nil
+		}
+		return utf16.DecodeRune(c, c2), nil
+	}
+
+	c, size, err := r.br.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	if c == utf8.RuneError && size == 1 {
+		r.exact = false
+		r.br.UnreadRune()
+		b, _ := r.br.ReadByte()
+		if b >= 0x80 && b < 0xa0 {
+			return cp1252[b-0x80], nil
+		}
+		return rune(b), nil
+	}
+	return c, nil
+}
+
+// unit reads a UTF-16 code unit.
+func (r *utf8Reader) unit() (rune, error) {
+	var b [2]byte
+	_, err := io.ReadFull(r.br, b[:])
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rune(r.order.Uint16(b[:])), nil
+}
+
+// newXMLDecoder returns a decoder of the XML in r, transcoded to UTF-8 and
+// held to DefaultLimits.
+func newXMLDecoder(r io.Reader) *xml.Decoder {
+	return utf8XMLDecoder(newUTF8Reader(r))
+}
+
+// utf8XMLDecoder returns a decoder of the XML read from ur, held to
+// DefaultLimits.
+func utf8XMLDecoder(ur *utf8Reader) *xml.Decoder {
+	limits := DefaultLimits
+	decoder := xml.NewDecoder(newXMLLimitReader(ur, &limits))
+	decoder.CharsetReader = transcodedCharset
+	return decoder
+}
+
+// transcodedCharset accepts the encodings declared by XML dats that
+// newUTF8Reader transcodes.
+func transcodedCharset(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-16", "utf-16le", "utf-16be", "iso-8859-1", "iso-8859-15", "latin1", "latin-1",
+		"windows-1252", "cp1252", "us-ascii", "ascii":
+		return input, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %s", charset)
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// ParseError is a problem found parsing a dat file. Lenient parsing returns
+// the problems it recovered from as ParseErrors too, see ParseDatLenient.
+type ParseError struct {
+	Path   string
+	Line   int // starting at 1
+	Column int // in runes, starting at 1, 0 if unknown
+	// Token is the offending token, empty if there is none.
+	Token string
+	// Snippet is the line of the problem as far as it had been read.
+	Snippet string
+	Err     error
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("%s:%d", e.Path, e.Line)
+	if e.Column > 0 {
+		msg += fmt.Sprintf(":%d", e.Column)
+	}
+	msg += fmt.Sprintf(": %v", e.Err)
+	if e.Token != "" {
+		msg += fmt.Sprintf(" at %s", e.Token)
+	}
+	return msg
+}
+
+// errorAt returns a ParseError for err at item i.
+func (p *parser) errorAt(i item, err error) *ParseError {
+	pe := &ParseError{
+		Path:    p.path,
+		Line:    i.line,
+		Column:  i.col,
+		Snippet: p.ll.lineText(i.line),
+		Err:     err,
+	}
+	switch i.typ {
+	case itemError:
+		pe.Err = fmt.Errorf("%v: %s", err, i.val)
+	case itemEOF:
+	default:
+		pe.Token = i.String()
+	}
+	return pe
+}
+
+func (p *parser) errorf(i item, format string, args ...interface{}) *ParseError {
+	return p.errorAt(i, fmt.Errorf(format, args...))
+}
+
+// warn records a problem p recovered from.
+func (p *parser) warn(err error) {
+	pe, ok := err.(*ParseError)
+	if !ok {
+		pe = &ParseError{Path: p.path, Line: p.ll.lineNumber(), Err: err}
+	}
+	p.warnings = append(p.warnings, pe)
+}
+
+// xmlError returns a ParseError for err at the position of decoder.
+func xmlError(decoder *xml.Decoder, path string, err error) error {
+	line, col := decoder.InputPos()
+	return &ParseError{
+		Path:   path,
+		Line:   line,
+		Column: col,
+		Err:    err,
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// Filter picks the games to keep when parsing dats, so games nobody wants
+// cost neither indexing nor room in the DB. Games have to pass each of its
+// fields that are set, the zero Filter keeps all games.
+type Filter struct {
+	// Include keeps the games whose name matches one of them.
+	Include []*regexp.Regexp
+	// Exclude drops the games whose name matches one of them.
+	Exclude []*regexp.Regexp
+	// Regions keeps the games whose name tags one of them, see
+	// types.InRegions.
+	Regions []string
+	// Categories keeps the games of one of them, see types.InCategories.
+	Categories []string
+}
+
+// GameFilter returns the filter picking the games f keeps, nil if f keeps all
+// of them.
+func (f *Filter) GameFilter() types.GameFilter {
+	var filters []types.GameFilter
+
+	if len(f.Include) > 0 {
+		filters = append(filters, anyNameMatches(f.Include))
+	}
+	if len(f.Exclude) > 0 {
+		filters = append(filters, types.Not(anyNameMatches(f.Exclude)))
+	}
+	if len(f.Regions) > 0 {
+		filters = append(filters, types.InRegions(f.Regions))
+	}
+	if len(f.Categories) > 0 {
+		filters = append(filters, types.InCategories(f.Categories))
+	}
+
+	if len(filters) == 0 {
+		return nil
+	}
+	return func(g *types.Game) bool {
+		for _, keep := range filters {
+			if !keep(g) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Key returns what tells filters keeping different games apart, the empty
+// string if f keeps all games.
+func (f *Filter) Key() string {
+	if f.GameFilter() == nil {
+		return ""
+	}
+
+	exprs := func(res []*regexp.Regexp) []string {
+		var ss []string
+		for _, re := range res {
+			ss = append(ss, re.String())
+		}
+		return ss
+	}
+	sorted := func(ss []string) string {
+		ss = append([]string(nil), ss...)
+		sort.Strings(ss)
+		return strings.Join(ss, "\x00")
+	}
+	return fmt.Sprintf("include=%s\nexclude=%s\nregions=%s\ncategories=%s", sorted(exprs(f.Include)),
+		sorted(exprs(f.Exclude)), sorted(f.Regions), sorted(f.Categories))
+}
+
+func anyNameMatches(res []*regexp.Regexp) types.GameFilter {
+	return func(g *types.Game) bool {
+		for _, re := range res {
+			if re.MatchString(g.Name) {
+				return true
+			}
+		}
+		return false
+	}
+}
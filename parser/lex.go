@@ -59,6 +59,22 @@ const (
 	itemVersion
 	itemAuthor
 	itemClrMamePro
+	itemDisk
+	itemSha256
+	itemBlake3
+	itemCloneOf
+	itemRomOf
+	itemSampleOf
+	itemSample
+	itemMerge
+	itemFlags
+	itemStatus
+	itemBios
+	itemDate
+	itemEmail
+	itemHomepage
+	itemURL
+	itemComment
 )
 
 var itemTypePrettyPrint = map[itemType]string{
@@ -79,8 +95,11 @@ func (i itemType) String() string {
 }
 
 type item struct {
-	typ itemType
-	val string
+	typ  itemType
+	val  string
+	line int   // line of the item, starting at 1
+	col  int   // column of the item in runes, starting at 1
+	end  int64 // byte offset of the end of the item
 }
 
 func (i item) String() string {
@@ -110,6 +129,22 @@ var key = map[string]itemType{
 	"version":     itemVersion,
 	"author":      itemAuthor,
 	"clrmamepro":  itemClrMamePro,
+	"disk":        itemDisk,
+	"sha256":      itemSha256,
+	"blake3":      itemBlake3,
+	"cloneof":     itemCloneOf,
+	"romof":       itemRomOf,
+	"sampleof":    itemSampleOf,
+	"sample":      itemSample,
+	"merge":       itemMerge,
+	"flags":       itemFlags,
+	"status":      itemStatus,
+	"bios":        itemBios,
+	"date":        itemDate,
+	"email":       itemEmail,
+	"homepage":    itemHomepage,
+	"url":         itemURL,
+	"comment":     itemComment,
 }
 
 // isSpace reports whether r is a space character.
@@ -148,19 +183,35 @@ type lexer struct {
 	err      error         // last read error
 	ln       int           // line number
 	lastRune rune          // last read rune
+	pos      int64         // byte offset of the next rune
+	lastSize int           // size of the last read rune in bytes
+	cur      []rune        // the current line, up to the last read rune
+	prev     []rune        // the line before cur
+	depth    int           // open parentheses
+	limits   Limits
 }
 
 // next returns the next rune in the input.
 func (l *lexer) next() rune {
-	switch r, _, err := l.br.ReadRune(); {
+	switch r, size, err := l.br.ReadRune(); {
 	case err == nil:
 		l.lastRune = r
+		l.lastSize = size
+		l.pos += int64(size)
 		if r == '\n' {
 			l.ln++
+			l.prev, l.cur = l.cur, l.prev[:0]
+		} else {
+			l.cur = append(l.cur, r)
 		}
 		l.tk = append(l.tk, r)
+		if err := l.limits.checkTokenLength(len(l.tk)); err != nil {
+			l.err = err
+			return readErrRune
+		}
 		return r
 	case err == io.EOF:
+		l.lastRune = eof
 		return eof
 	default:
 		l.err = err
@@ -185,10 +236,15 @@ func (l *lexer) peek() rune {
 
 // backup steps back one rune. Can only be called once per call of next.
 func (l *lexer) backup() {
-	if l.err == nil {
+	// nothing was read at the end of the input
+	if l.err == nil && l.lastRune != eof {
 		l.tk = l.tk[:len(l.tk)-1]
+		l.pos -= int64(l.lastSize)
 		if l.lastRune == '\n' {
 			l.ln--
+			l.prev, l.cur = l.cur, l.prev
+		} else {
+			l.cur = l.cur[:len(l.cur)-1]
 		}
 		l.br.UnreadRune()
 	}
@@ -196,7 +252,13 @@ func (l *lexer) backup() {
 
 // emit passes an item back to the client.
 func (l *lexer) emit(t itemType) {
-	l.items <- item{t, string(l.tk)}
+	l.items <- item{
+		typ:  t,
+		val:  string(l.tk),
+		line: l.lineNumber(),
+		col:  len(l.cur) - len(l.tk) + 1,
+		end:  l.pos,
+	}
 	l.tk = nil
 }
 
@@ -226,16 +288,45 @@ func (l *lexer) lineNumber() int {
 	return l.ln + 1
 }
 
+// lineText returns what has been read of the given line, if it is one of the
+// last two.
+func (l *lexer) lineText(line int) string {
+	switch line {
+	case l.lineNumber():
+		return string(l.cur)
+	case l.lineNumber() - 1:
+		return string(l.prev)
+	}
+	return ""
+}
+
 // error returns an error token and terminates the scan by passing
 // back a nil pointer that will be the next state, terminating l.nextItem.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, fmt.Sprintf(format, args...)}
+	l.recoverf(format, args...)
 	return nil
 }
 
-// nextItem returns the next item from the input.
+// recoverf returns an error token and goes on with the scan after it.
+func (l *lexer) recoverf(format string, args ...interface{}) stateFn {
+	l.items <- item{
+		typ:  itemError,
+		val:  fmt.Sprintf(format, args...),
+		line: l.lineNumber(),
+		col:  len(l.cur) + 1,
+		end:  l.pos,
+	}
+	l.tk = nil
+	return lexDefault
+}
+
+// nextItem returns the next item from the input, EOF once the scan is
+// terminated.
 func (l *lexer) nextItem() item {
 	for {
+		if l.state == nil {
+			return item{typ: itemEOF, line: l.lineNumber(), col: len(l.cur) + 1, end: l.pos}
+		}
 		select {
 		case item := <-l.items:
 			return item
@@ -249,11 +340,12 @@ func (l *lexer) nextItem() item {
 // lex creates a new scanner for the input string.
 func lex(name string, rd io.Reader) *lexer {
 	l := &lexer{
-		tk:    make([]rune, 0, 2048),
-		name:  name,
-		br:    bufio.NewReader(rd),
-		state: lexDefault,
-		items: make(chan item, 2), // Two items of buffering is sufficient for all state functions
+		tk:     make([]rune, 0, 2048),
+		name:   name,
+		br:     bufio.NewReader(rd),
+		state:  lexDefault,
+		limits: DefaultLimits,
+		items:  make(chan item, 2), // Two items of buffering is sufficient for all state functions
 	}
 	return l
 }
@@ -264,16 +356,21 @@ func lex(name string, rd io.Reader) *lexer {
 func lexQuote(l *lexer) stateFn {
 Loop:
 	for {
-		switch l.next() {
+		r := l.next()
+		switch r {
 		case readErrRune:
 			return l.errorf("error reading: %v", l.err)
 		case '\\':
-			if r := l.next(); r != eof && r != '\n' {
+			if r = l.next(); r != eof && r != '\n' {
 				break
 			}
 			fallthrough
 		case eof, '\n':
-			return l.errorf("unterminated quoted string")
+			if r == '\n' {
+				// report the error on the line of the string
+				l.backup()
+			}
+			return l.recoverf("unterminated quoted string")
 		case '"':
 			break Loop
 		}
@@ -317,8 +414,16 @@ func lexDefault(l *lexer) stateFn {
 	case r == '"':
 		return lexQuote
 	case r == '(' && isSpace(l.peek()):
+		l.depth++
+		if err := l.limits.checkDepth(l.depth); err != nil {
+			l.err = err
+			return l.errorf("%v", err)
+		}
 		l.emit(itemOpenBrace)
 	case r == ')':
+		if l.depth > 0 {
+			l.depth--
+		}
 		l.emit(itemCloseBrace)
 	default:
 		l.backup()
@@ -0,0 +1,165 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"fmt"
+	"io"
+)
+
+// Limits bound what parsing a dat may take, so corrupted or hostile dat files
+// can't exhaust memory. Zero fields are not checked.
+type Limits struct {
+	// MaxTokenLength bounds the length of tokens: words and strings of
+	// clrmamepro dats, lines of RomCenter dats and tags, attribute values and
+	// text of XML dats.
+	MaxTokenLength int
+	// MaxDepth bounds the nesting of parentheses and XML elements.
+	MaxDepth int
+	// MaxElements bounds the number of games, roms and disks of dats, and of
+	// elements of XML dats.
+	MaxElements int
+}
+
+// DefaultLimits are the limits dats are parsed with. They are far above what
+// real dats, MAME's included, come to.
+var DefaultLimits = Limits{
+	MaxTokenLength: 1 << 20,
+	MaxDepth:       32,
+	MaxElements:    20000000,
+}
+
+func (l *Limits) checkTokenLength(n int) error {
+	if l.MaxTokenLength > 0 && n > l.MaxTokenLength {
+		return fmt.Errorf("token longer than the limit of %d", l.MaxTokenLength)
+	}
+	return nil
+}
+
+func (l *Limits) checkDepth(depth int) error {
+	if l.MaxDepth > 0 && depth > l.MaxDepth {
+		return fmt.Errorf("nesting deeper than the limit of %d", l.MaxDepth)
+	}
+	return nil
+}
+
+func (l *Limits) checkElements(n int) error {
+	if l.MaxElements > 0 && n > l.MaxElements {
+		return fmt.Errorf("more elements than the limit of %d", l.MaxElements)
+	}
+	return nil
+}
+
+// xmlLimitReader checks XML read through it against limits. It looks at the
+// bytes only, tags in comments or CDATA sections count as elements too.
+type xmlLimitReader struct {
+	r      io.Reader
+	limits *Limits
+
+	run      int  // bytes since the last tag boundary
+	depth    int  // open elements
+	elements int  // elements so far
+	inTag    bool // between '<' and '>'
+	tagStart bool // right after '<'
+	quote    byte // quote of the attribute value being read, 0 if none
+	prev     byte
+	err      error
+}
+
+func newXMLLimitReader(r io.Reader, limits *Limits) *xmlLimitReader {
+	return &xmlLimitReader{
+		r:      r,
+		limits: limits,
+	}
+}
+
+func (lr *xmlLimitReader) Read(p []byte) (int, error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+
+	n, err := lr.r.Read(p)
+	for i, b := range p[:n] {
+		lr.err = lr.scan(b)
+		if lr.err != nil {
+			return i, lr.err
+		}
+	}
+	return n, err
+}
+
+func (lr *xmlLimitReader) scan(b byte) error {
+	defer func() { lr.prev = b }()
+
+	if lr.quote != 0 {
+		if b == lr.quote {
+			lr.quote = 0
+		}
+		lr.run++
+		return lr.limits.checkTokenLength(lr.run)
+	}
+
+	if lr.tagStart {
+		lr.tagStart = false
+		switch b {
+		case '/':
+			lr.depth--
+		case '!', '?':
+		default:
+			lr.depth++
+			lr.elements++
+			if err := lr.limits.checkDepth(lr.depth); err != nil {
+				return err
+			}
+			if err := lr.limits.checkElements(lr.elements); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch {
+	case b == '<':
+		lr.run = 0
+		lr.inTag = true
+		lr.tagStart = true
+	case b == '>':
+		lr.run = 0
+		if lr.inTag && lr.prev == '/' {
+			lr.depth--
+		}
+		lr.inTag = false
+	case lr.inTag && (b == '"' || b == '\''):
+		lr.quote = b
+	default:
+		lr.run++
+		return lr.limits.checkTokenLength(lr.run)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+const (
+	// clrmamepro dats at least this big are parsed in parallel chunks.
+	parallelParseSize = 64 << 20
+	minChunkSize      = 16 << 20
+)
+
+// parseDatFile parses the clrmamepro dat in file. Big dats are split at game
+// boundaries and the chunks parsed concurrently, see parseDatChunks.
+func parseDatFile(file *os.File, path string, opts parseOptions) (*types.Dat, []byte, []*ParseError, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	chunks := int(fi.Size() / minChunkSize)
+	if chunks > runtime.NumCPU() {
+		chunks = runtime.NumCPU()
+	}
+
+	if fi.Size() < parallelParseSize || chunks < 2 || isUTF16(file) {
+		return parseDat(file, path, opts)
+	}
+	return parseDatChunks(file, fi.Size(), path, opts, chunks)
+}
+
+// isUTF16 reports whether the dat in file looks like UTF-16, which can't be
+// split at arbitrary lines.
+func isUTF16(file *os.File) bool {
+	var start [2]byte
+	n, _ := file.ReadAt(start[:], 0)
+	return n == 2 && (start[0] == 0 || start[1] == 0 || string(start[:]) == "\xff\xfe" || string(start[:]) == "\xfe\xff")
+}
+
+// datChunk is a part of a dat file starting at a game.
+type datChunk struct {
+	start, end int64
+	d          *types.Dat
+	warnings   []*ParseError
+	err        error
+	elements   int
+}
+
+// parseDatChunks parses the clrmamepro dat in file of the given size in up to
+// n chunks concurrently and merges them. The result is the same as parseDat's.
+func parseDatChunks(file *os.File, size int64, path string, opts parseOptions, n int) (*types.Dat, []byte, []*ParseError, error) {
+	var chunks []*datChunk
+	start := int64(0)
+	for k := 1; k < n; k++ {
+		end, err := gameBoundary(file, size, size*int64(k)/int64(n))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if end <= start {
+			continue
+		}
+		chunks = append(chunks, &datChunk{start: start, end: end})
+		start = end
+		if start == size {
+			break
+		}
+	}
+	if start < size {
+		chunks = append(chunks, &datChunk{start: start, end: size})
+	}
+
+	var (
+		wg        sync.WaitGroup
+		sha1Bytes []byte
+		hashErr   error
+	)
+
+	wg.Add(len(chunks) + 1)
+	go func() {
+		defer wg.Done()
+		h := sha1.New()
+		_, hashErr = io.Copy(h, io.NewSectionReader(file, 0, size))
+		sha1Bytes = h.Sum(nil)
+	}()
+	for _, c := range chunks {
+		go func(c *datChunk) {
+			defer wg.Done()
+			p := newDatParser(io.NewSectionReader(file, c.start, c.end-c.start), path, opts)
+			p.base = c.start
+			c.err = p.parse()
+			if c.err == nil {
+				c.err = p.checkSpans()
+			}
+			c.d = p.d
+			c.warnings = p.warnings
+			c.elements = p.elements
+		}(c)
+	}
+	wg.Wait()
+
+	if hashErr != nil {
+		return nil, nil, nil, hashErr
+	}
+
+	d := chunks[0].d
+	var warnings []*ParseError
+	elements := 0
+	for k, c := range chunks {
+		if c.err != nil || len(c.warnings) > 0 {
+			err := c.shiftLines(file)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		if c.err != nil {
+			return nil, nil, nil, c.err
+		}
+		if k > 0 {
+			d.Games = append(d.Games, c.d.Games...)
+		}
+		warnings = append(warnings, c.warnings...)
+
+		elements += c.elements
+		err := DefaultLimits.checkElements(elements)
+		if err != nil {
+			return nil, nil, nil, &ParseError{Path: path, Err: err}
+		}
+	}
+
+	d.Normalize()
+	d.Path = path
+	return d, sha1Bytes, warnings, nil
+}
+
+// shiftLines moves the lines of the errors of c from the start of c to the
+// start of file.
+func (c *datChunk) shiftLines(file *os.File) error {
+	if c.start == 0 {
+		return nil
+	}
+
+	lines := 0
+	buf := make([]byte, 64*1024)
+	sr := io.NewSectionReader(file, 0, c.start)
+	for {
+		n, err := sr.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if pe, ok := c.err.(*ParseError); ok {
+		pe.Line += lines
+	}
+	for _, w := range c.warnings {
+		w.Line += lines
+	}
+	return nil
+}
+
+// gameBoundary returns the offset of the first line starting a game at or
+// after offset, the size of file if there is none. Quoted strings don't span
+// lines, so such a line is the start of a game statement.
+func gameBoundary(file *os.File, size int64, offset int64) (int64, error) {
+	br := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+
+	pos := offset
+	atLineStart := offset == 0
+	if !atLineStart {
+		var prev [1]byte
+		_, err := file.ReadAt(prev[:], offset-1)
+		if err != nil {
+			return 0, err
+		}
+		atLineStart = prev[0] == '\n'
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if atLineStart && startsGame(line) {
+			return pos, nil
+		}
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		pos += int64(len(line))
+		atLineStart = true
+	}
+}
+
+func startsGame(line string) bool {
+	line = strings.TrimLeft(line, " \t")
+	if !strings.HasPrefix(line, "game") {
+		return false
+	}
+	rest := line[len("game"):]
+	return rest != "" && isSpace(rune(rest[0]))
+}
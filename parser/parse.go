@@ -34,8 +34,8 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"encoding/hex"
-	"encoding/xml"
 	"fmt"
+	"github.com/uwedeportivo/romba/logging"
 	"github.com/uwedeportivo/romba/types"
 	"hash"
 	"io"
@@ -45,18 +45,93 @@ import (
 	"strings"
 )
 
+var logger = logging.For("parser")
+
 const (
-	xmlPrefix        = "<?xml"
-	xmlPrefixWithBOM = "\xef\xbb\xbf<?xml"
+	xmlPrefix = "<?xml"
 )
 
+// parseOptions are the ways of parsing clrmamepro dats.
+type parseOptions struct {
+	// lenient parsers skip games they fail to parse, see ParseDatLenient.
+	lenient bool
+	// spans has the spans of games recorded, see ParseSpans.
+	spans bool
+	// keep picks the games to keep, all if nil. See ParseAllFiltered.
+	keep types.GameFilter
+	// depth is how many containers the dat being parsed is in, unpackable
+	// how many more bytes they may unpack to, see parseContainer.
+	depth      int
+	unpackable *int64
+}
+
+// filter returns d with the games opts keeps.
+func (opts *parseOptions) filter(d *types.Dat) *types.Dat {
+	if opts.keep == nil {
+		return d
+	}
+	return d.Filter(opts.keep)
+}
+
 type parser struct {
-	ll *lexer
-	d  *types.Dat
+	parseOptions
+	ll       *lexer
+	ur       *utf8Reader
+	d        *types.Dat
+	path     string
+	base     int64 // offset of the input in the dat file
+	end      int64 // offset of the end of the last item
+	warnings []*ParseError
+	pushed   *item // item to return again from next
+	elements int   // games, roms and disks so far
+	// fatal is set once p went over a limit, lenient parsers stop too.
+	fatal error
 }
 
-func (p *parser) consumeStringValue() (string, error) {
+// count adds n to the elements of p and checks them against the limits.
+func (p *parser) count(i item, n int) error {
+	p.elements += n
+	err := p.ll.limits.checkElements(p.elements)
+	if err != nil {
+		p.fatal = p.errorAt(i, err)
+		return p.fatal
+	}
+	return nil
+}
+
+// next returns the next item, the pushed back one if there is one.
+func (p *parser) next() item {
+	if p.pushed != nil {
+		i := *p.pushed
+		p.pushed = nil
+		p.end = i.end
+		return i
+	}
 	i := p.ll.nextItem()
+	p.end = i.end
+	return i
+}
+
+// span returns the span of the dat file from the offset start of p's input
+// to the end of the last item.
+func (p *parser) span(start int64) *types.Span {
+	return &types.Span{
+		Start: p.base + p.ur.bom + start,
+		End:   p.base + p.ur.bom + p.end,
+	}
+}
+
+// checkSpans fails if p recorded spans of a dat that isn't UTF-8, they are
+// offsets of the transcoded input then.
+func (p *parser) checkSpans() error {
+	if p.spans && !p.ur.exact {
+		return fmt.Errorf("%s is not UTF-8, spans of games can't be recorded", p.path)
+	}
+	return nil
+}
+
+func (p *parser) consumeStringValue() (string, error) {
+	i := p.next()
 	switch {
 	case i.typ == itemQuotedString:
 		return i.val[1 : len(i.val)-1], nil
@@ -65,7 +140,7 @@ func (p *parser) consumeStringValue() (string, error) {
 	case i.typ > itemValue:
 		return i.val, nil
 	default:
-		return "", fmt.Errorf("expected quoted string or value, got %v", i)
+		return "", p.errorf(i, "expected quoted string or value")
 	}
 }
 
@@ -87,39 +162,63 @@ func stringValue2Bytes(input string, expectedLength int) ([]byte, error) {
 		input = strings.Repeat("0", expectedLength-len(input)) + input
 	}
 
+	if len(input) > expectedLength {
+		return nil, fmt.Errorf("hash %s has %d hex digits instead of %d", input, len(input), expectedLength)
+	}
+
 	return hex.DecodeString(input)
 }
 
 func (p *parser) consumeIntegerValue() (int64, error) {
-	i := p.ll.nextItem()
-	if i.typ == itemValue {
-		return stringValue2Int(i.val)
+	var (
+		v   int64
+		err error
+	)
+
+	i := p.next()
+	switch i.typ {
+	case itemValue:
+		v, err = stringValue2Int(i.val)
+	case itemQuotedString:
+		v, err = stringValue2Int(i.val[1 : len(i.val)-1])
+	default:
+		return 0, p.errorf(i, "expected value")
 	}
-	if i.typ == itemQuotedString {
-		return stringValue2Int(i.val[1 : len(i.val)-1])
+	if err != nil {
+		return 0, p.errorAt(i, err)
 	}
-	return 0, fmt.Errorf("expected value, got %v", i)
+	return v, nil
 }
 
 func (p *parser) consumeHexBytes(expectedLength int) ([]byte, error) {
-	i := p.ll.nextItem()
-	if i.typ == itemValue {
-		return stringValue2Bytes(i.val, expectedLength)
+	var (
+		v   []byte
+		err error
+	)
+
+	i := p.next()
+	switch i.typ {
+	case itemValue:
+		v, err = stringValue2Bytes(i.val, expectedLength)
+	case itemQuotedString:
+		v, err = stringValue2Bytes(i.val[1:len(i.val)-1], expectedLength)
+	default:
+		return nil, p.errorf(i, "expected value")
 	}
-	if i.typ == itemQuotedString {
-		return stringValue2Bytes(i.val[1:len(i.val)-1], expectedLength)
+	if err != nil {
+		return nil, p.errorAt(i, err)
 	}
-	return nil, fmt.Errorf("expected value, got %v", i)
+	return v, nil
 }
 
 func (p *parser) datStmt() error {
-	i := p.ll.nextItem()
+	i := p.next()
 	err := p.match(i, itemOpenBrace)
 	if err != nil {
 		return err
 	}
 
-	for i = p.ll.nextItem(); i.typ != itemCloseBrace && i.typ != itemEOF && i.typ != itemError; i = p.ll.nextItem() {
+	for i = p.next(); i.typ != itemCloseBrace && i.typ != itemEOF && i.typ != itemError; i = p.next() {
 		switch {
 		case i.typ == itemName:
 			p.d.Name, err = p.consumeStringValue()
@@ -131,32 +230,77 @@ func (p *parser) datStmt() error {
 			if err != nil {
 				return err
 			}
+		case i.typ == itemCategory:
+			p.d.Category, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemVersion:
+			p.d.Version, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemDate:
+			p.d.Date, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemAuthor:
+			p.d.Author, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemEmail:
+			p.d.Email, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemHomepage:
+			p.d.Homepage, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemURL:
+			p.d.URL, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemComment:
+			p.d.Comment, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	if i.typ == itemEOF {
-		return fmt.Errorf("unexpected end of input")
+		return p.errorf(i, "unexpected end of input")
 	}
 	if i.typ == itemError {
-		return lexError(i)
+		return p.lexError(i)
 	}
 	return nil
 }
 
-func lexError(i item) error {
-	return fmt.Errorf("lexer error: %v", i)
+func (p *parser) lexError(i item) error {
+	return p.errorf(i, "lexer error")
 }
 
 func (p *parser) gameStmt() (*types.Game, error) {
-	i := p.ll.nextItem()
+	i := p.next()
 	err := p.match(i, itemOpenBrace)
 	if err != nil {
 		return nil, err
 	}
 
+	err = p.count(i, 1)
+	if err != nil {
+		return nil, err
+	}
+
 	g := &types.Game{}
 
-	for i = p.ll.nextItem(); i.typ != itemCloseBrace && i.typ != itemEOF && i.typ != itemError; i = p.ll.nextItem() {
+	for i = p.next(); i.typ != itemCloseBrace && i.typ != itemEOF && i.typ != itemError; i = p.next() {
 		switch {
 		case i.typ == itemName:
 			g.Name, err = p.consumeStringValue()
@@ -168,7 +312,43 @@ func (p *parser) gameStmt() (*types.Game, error) {
 			if err != nil {
 				return nil, err
 			}
+		case i.typ == itemCloneOf:
+			g.CloneOf, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemRomOf:
+			g.RomOf, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemSampleOf:
+			g.SampleOf, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemCategory:
+			g.Category, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemSample:
+			err = p.count(i, 1)
+			if err != nil {
+				return nil, err
+			}
+
+			name, err := p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+			g.Samples = append(g.Samples, &types.Sample{Name: name})
 		case i.typ == itemRom:
+			err = p.count(i, 1)
+			if err != nil {
+				return nil, err
+			}
+
 			r, err := p.romStmt()
 			if err != nil {
 				return nil, err
@@ -177,20 +357,40 @@ func (p *parser) gameStmt() (*types.Game, error) {
 			if r != nil {
 				g.Roms = append(g.Roms, r)
 			}
+		case i.typ == itemDisk:
+			err = p.count(i, 1)
+			if err != nil {
+				return nil, err
+			}
+
+			r, err := p.romStmt()
+			if err != nil {
+				return nil, err
+			}
+
+			if r != nil {
+				g.Disks = append(g.Disks, &types.Disk{
+					Name:   r.Name,
+					Sha1:   r.Sha1,
+					Md5:    r.Md5,
+					Status: r.Status,
+					Merge:  r.Merge,
+				})
+			}
 		}
 	}
 
 	if i.typ == itemEOF {
-		return nil, fmt.Errorf("unexpected end of input")
+		return nil, p.errorf(i, "unexpected end of input")
 	}
 	if i.typ == itemError {
-		return nil, lexError(i)
+		return nil, p.lexError(i)
 	}
 	return g, nil
 }
 
 func (p *parser) romStmt() (*types.Rom, error) {
-	i := p.ll.nextItem()
+	i := p.next()
 	err := p.match(i, itemOpenBrace)
 	if err != nil {
 		return nil, err
@@ -198,7 +398,7 @@ func (p *parser) romStmt() (*types.Rom, error) {
 
 	r := &types.Rom{}
 
-	for i = p.ll.nextItem(); i.typ != itemCloseBrace && i.typ != itemEOF && i.typ != itemError; i = p.ll.nextItem() {
+	for i = p.next(); i.typ != itemCloseBrace && i.typ != itemEOF && i.typ != itemError; i = p.next() {
 		switch {
 		case i.typ == itemName:
 			r.Name, err = p.consumeStringValue()
@@ -213,81 +413,177 @@ func (p *parser) romStmt() (*types.Rom, error) {
 		case i.typ == itemMd5:
 			r.Md5, err = p.consumeHexBytes(32)
 			if err != nil {
-				return nil, nil
+				return nil, p.dropRom(err)
 			}
 		case i.typ == itemCrc:
 			r.Crc, err = p.consumeHexBytes(8)
 			if err != nil {
-				return nil, nil
+				return nil, p.dropRom(err)
 			}
 		case i.typ == itemSha1:
 			r.Sha1, err = p.consumeHexBytes(40)
 			if err != nil {
-				return nil, nil
+				return nil, p.dropRom(err)
+			}
+		case i.typ == itemSha256:
+			r.Sha256, err = p.consumeHexBytes(64)
+			if err != nil {
+				return nil, p.dropRom(err)
+			}
+		case i.typ == itemBlake3:
+			r.Blake3, err = p.consumeHexBytes(64)
+			if err != nil {
+				return nil, p.dropRom(err)
+			}
+		case i.typ == itemMerge:
+			r.Merge, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemFlags || i.typ == itemStatus:
+			r.Status, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemBios:
+			r.Bios, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
 			}
 		}
 	}
 
 	if i.typ == itemEOF {
-		return nil, fmt.Errorf("unexpected end of input")
+		return nil, p.errorf(i, "unexpected end of input")
 	}
 	if i.typ == itemError {
-		return nil, lexError(i)
+		return nil, p.lexError(i)
 	}
 	return r, nil
 }
 
 func (p *parser) parse() error {
-	var i item
-
-	for i = p.ll.nextItem(); i.typ != itemEOF && i.typ != itemError; i = p.ll.nextItem() {
+	for i := p.next(); i.typ != itemEOF; i = p.next() {
 		switch {
+		case i.typ == itemError:
+			err := p.skipGame(p.lexError(i))
+			if err != nil {
+				return err
+			}
 		case i.typ == itemClrMamePro:
 			err := p.datStmt()
 			if err != nil {
-				return err
+				err = p.skipGame(err)
+				if err != nil {
+					return err
+				}
 			}
 		case i.typ == itemGame:
+			start := i.end - int64(len(i.val))
 			g, err := p.gameStmt()
 			if err != nil {
-				return err
+				err = p.skipGame(err)
+				if err != nil {
+					return err
+				}
+				continue
 			}
-			if g != nil {
+			if g != nil && (p.keep == nil || p.keep(g)) {
+				if p.spans {
+					g.Span = p.span(start)
+				}
 				p.d.Games = append(p.d.Games, g)
 			}
 		}
 	}
-	if i.typ == itemError {
-		return lexError(i)
+	if p.ll.err != nil {
+		return &ParseError{Path: p.path, Line: p.ll.lineNumber(), Err: p.ll.err}
 	}
 	return nil
 }
 
+// skipGame recovers from err by skipping to the next game if p is lenient.
+// It returns err otherwise.
+func (p *parser) skipGame(err error) error {
+	if !p.lenient || p.ll.err != nil || p.fatal != nil {
+		return err
+	}
+	p.warn(err)
+
+	for {
+		i := p.next()
+		if i.typ == itemGame || i.typ == itemEOF {
+			p.pushed = &i
+			return nil
+		}
+	}
+}
+
+// dropRom skips the rest of a rom statement after err and records err.
+func (p *parser) dropRom(err error) error {
+	p.warn(err)
+
+	for {
+		i := p.next()
+		switch i.typ {
+		case itemCloseBrace:
+			return nil
+		case itemEOF, itemError:
+			p.pushed = &i
+			return nil
+		}
+	}
+}
+
 func (p *parser) match(i item, typ itemType) error {
 	if i.typ == typ {
 		return nil
 	}
-	return fmt.Errorf("expected token of type %v, got %v instead", typ, i)
+	return p.errorf(i, "expected token of type %v", typ)
 }
 
 func ParseDat(r io.Reader, path string) (*types.Dat, []byte, error) {
+	d, sha1Bytes, _, err := parseDat(r, path, parseOptions{})
+	return d, sha1Bytes, err
+}
+
+// ParseDatLenient parses the clrmamepro dat in r like ParseDat, except that
+// games it fails to parse are skipped instead of failing the whole dat. The
+// problems skipped over, as well as the roms dropped for bad hashes, are
+// returned as warnings. Only failing to read r is an error.
+func ParseDatLenient(r io.Reader, path string) (*types.Dat, []byte, []*ParseError, error) {
+	return parseDat(r, path, parseOptions{lenient: true})
+}
+
+func parseDat(r io.Reader, path string, opts parseOptions) (*types.Dat, []byte, []*ParseError, error) {
 	hr := hashingReader{
 		ir: r,
 		h:  sha1.New(),
 	}
 
-	p := &parser{
-		ll: lex("dat", hr),
-		d:  &types.Dat{},
-	}
+	p := newDatParser(hr, path, opts)
 
 	err := p.parse()
+	if err == nil {
+		err = p.checkSpans()
+	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("error in file %s on line %d: %v", path, p.ll.lineNumber(), err)
+		return nil, nil, nil, err
 	}
 	p.d.Normalize()
 	p.d.Path = path
-	return p.d, hr.h.Sum(nil), nil
+	return p.d, hr.h.Sum(nil), p.warnings, nil
+}
+
+func newDatParser(r io.Reader, path string, opts parseOptions) *parser {
+	ur := newUTF8Reader(r)
+	return &parser{
+		parseOptions: opts,
+		ll:           lex("dat", ur),
+		ur:           ur,
+		d:            &types.Dat{},
+		path:         path,
+	}
 }
 
 type hashingReader struct {
@@ -303,23 +599,6 @@ func (r hashingReader) Read(buf []byte) (int, error) {
 	return n, err
 }
 
-type lineCountingReader struct {
-	ir   io.Reader
-	line int
-}
-
-func (r lineCountingReader) Read(buf []byte) (int, error) {
-	n, err := r.ir.Read(buf)
-	if err == nil {
-		for _, b := range buf[:n] {
-			if b == '\n' {
-				r.line++
-			}
-		}
-	}
-	return n, err
-}
-
 func isXML(path string) (bool, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -327,23 +606,105 @@ func isXML(path string) (bool, error) {
 	}
 	defer file.Close()
 
+	// room for UTF-16 and a byte order mark
 	lr := io.LimitedReader{
 		R: file,
-		N: 21,
+		N: int64(2 * (len(xmlPrefix) + 1)),
 	}
 
-	snippet, err := ioutil.ReadAll(&lr)
+	snippet, err := ioutil.ReadAll(newUTF8Reader(&lr))
 	if err != nil {
 		return false, err
 	}
 
-	ss := string(snippet)
+	return strings.HasPrefix(string(snippet), xmlPrefix), nil
+}
+
+// ParseLenient parses the dat file path like Parse, except that clrmamepro
+// dats are parsed by ParseDatLenient.
+func ParseLenient(path string) (*types.Dat, []byte, []*ParseError, error) {
+	var (
+		dat       *types.Dat
+		sha1Bytes []byte
+		warnings  []*ParseError
+		err       error
+	)
+
+	if IsContainer(path) {
+		dat, sha1Bytes, warnings, err = parseSingle(path)
+	} else {
+		dat, sha1Bytes, warnings, err = parseLenient(path, parseOptions{lenient: true})
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	return strings.HasPrefix(ss, xmlPrefix) || strings.HasPrefix(ss, xmlPrefixWithBOM), nil
+	err = verifyParsed(path, sha1Bytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return dat, sha1Bytes, warnings, nil
 }
 
+// verifyParsed checks the dat file path against its sidecar checksum file,
+// see VerifySidecar. sha1Bytes is the SHA1 of the single dat parsed from it.
+func verifyParsed(path string, sha1Bytes []byte) error {
+	if IsContainer(path) {
+		// the SHA1 is the one of the unpacked dat
+		sha1Bytes = nil
+	}
+	return VerifySidecar(path, sha1Bytes)
+}
+
+func parseLenient(path string, opts parseOptions) (*types.Dat, []byte, []*ParseError, error) {
+	format, _, err := DetectFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if format != FormatClrMamePro {
+		dat, sha1Bytes, err := parse(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return opts.filter(dat), sha1Bytes, nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer file.Close()
+
+	return parseDatFile(file, path, opts)
+}
+
+// Parse parses the dat file path, a clrmamepro, RomCenter or XML dat or a zip
+// or gzip file holding one. The format is told by Detect, files of unknown
+// formats are errors. Big clrmamepro dats are parsed in parallel chunks.
+//
+// Dat files accompanied by a sidecar checksum file are checked against it, see
+// VerifySidecar.
 func Parse(path string) (*types.Dat, []byte, error) {
-	isXML, err := isXML(path)
+	dat, sha1Bytes, err := parse(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = verifyParsed(path, sha1Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dat, sha1Bytes, nil
+}
+
+func parse(path string) (*types.Dat, []byte, error) {
+	if IsContainer(path) {
+		dat, sha1Bytes, _, err := parseSingle(path)
+		return dat, sha1Bytes, err
+	}
+
+	format, _, err := DetectFile(path)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -354,47 +715,113 @@ func Parse(path string) (*types.Dat, []byte, error) {
 	}
 	defer file.Close()
 
-	if isXML {
+	switch format {
+	case FormatClrMamePro:
+		dat, sha1Bytes, _, err := parseDatFile(file, path, parseOptions{})
+		return dat, sha1Bytes, err
+	case FormatRomCenter:
+		return ParseRomCenter(file, path)
+	case FormatLogiqx, FormatMAME:
 		return ParseXml(file, path)
+	case FormatSoftwareList:
+		dats, sha1s, err := ParseSoftwareLists(file, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(dats) != 1 {
+			return nil, nil, fmt.Errorf("%s holds %d software lists instead of one", path, len(dats))
+		}
+		return dats[0], sha1s[0], nil
 	}
-	return ParseDat(file, path)
+	return nil, nil, fmt.Errorf("%s is not a dat of a known format", path)
 }
 
-func fixHashes(rom *types.Rom) {
-	if rom.Crc != nil {
-		strV := string(rom.Crc)
-		if strV != "" {
-			v, err := hex.DecodeString(string(rom.Crc))
-			if err != nil {
-				rom.Crc = nil
-			}
-			rom.Crc = v
-		} else {
-			rom.Crc = nil
-		}
+// ParseSpans parses the dat file path like Parse and records where each of
+// its games is in the file, see types.Game.Span. Only clrmamepro and XML dats
+// in UTF-8 are supported, the bytes of other encodings don't match the parsed
+// text.
+func ParseSpans(path string) (*types.Dat, []byte, error) {
+	if IsContainer(path) {
+		return nil, nil, fmt.Errorf("%s is a container, spans of games can't be recorded", path)
 	}
-	if rom.Md5 != nil {
-		strV := string(rom.Md5)
-		if strV != "" {
-			v, err := hex.DecodeString(string(rom.Md5))
-			if err != nil {
-				rom.Md5 = nil
-			}
-			rom.Md5 = v
-		} else {
-			rom.Md5 = nil
+
+	err := VerifySidecar(path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	format, _, err := DetectFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	opts := parseOptions{spans: true}
+
+	switch format {
+	case FormatClrMamePro:
+		dat, sha1Bytes, _, err := parseDatFile(file, path, opts)
+		return dat, sha1Bytes, err
+	case FormatLogiqx, FormatMAME, FormatSoftwareList:
+		var games types.GameSlice
+		dat, sha1Bytes, err := parseXmlStream(file, path, opts, func(g *types.Game) error {
+			games = append(games, g)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
 		}
+		dat.Games = games
+		dat.Normalize()
+		return dat, sha1Bytes, nil
 	}
-	if rom.Sha1 != nil {
-		strV := string(rom.Sha1)
-		if strV != "" {
-			v, err := hex.DecodeString(string(rom.Sha1))
-			if err != nil {
-				rom.Sha1 = nil
+	return nil, nil, fmt.Errorf("%s is a %s dat, spans of games can't be recorded", path, format)
+}
+
+// xml attributes are decoded as raw strings, fixHash turns them into bytes.
+func fixHash(h []byte) []byte {
+	if len(h) == 0 {
+		return nil
+	}
+	v, err := hex.DecodeString(string(h))
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// Hashes of the wrong length are dropped like invalid ones.
+func fixHashes(rom *types.Rom) {
+	rom.Crc, _ = types.ParseCrc32(string(rom.Crc))
+	rom.Md5, _ = types.ParseMd5Sum(string(rom.Md5))
+	rom.Sha1, _ = types.ParseSha1Sum(string(rom.Sha1))
+	rom.Sha256 = fixHash(rom.Sha256)
+	rom.Blake3 = fixHash(rom.Blake3)
+}
+
+func fixDiskHashes(disk *types.Disk) {
+	disk.Md5, _ = types.ParseMd5Sum(string(disk.Md5))
+	disk.Sha1, _ = types.ParseSha1Sum(string(disk.Sha1))
+}
+
+func fixGameHashes(gameLists ...types.GameSlice) {
+	for _, games := range gameLists {
+		for _, g := range games {
+			for _, roms := range []types.RomSlice{g.Roms, g.Parts, g.Regions} {
+				for _, rom := range roms {
+					fixHashes(rom)
+				}
+			}
+			for _, disks := range []types.DiskSlice{g.Disks, g.PartDisks} {
+				for _, disk := range disks {
+					fixDiskHashes(disk)
+				}
 			}
-			rom.Sha1 = v
-		} else {
-			rom.Sha1 = nil
 		}
 	}
 }
@@ -407,47 +834,15 @@ func ParseXml(r io.Reader, path string) (*types.Dat, []byte, error) {
 		h:  sha1.New(),
 	}
 
-	lr := lineCountingReader{
-		ir: hr,
-	}
-
 	d := new(types.Dat)
-	decoder := xml.NewDecoder(lr)
+	decoder := newXMLDecoder(hr)
 
 	err := decoder.Decode(d)
 	if err != nil {
-		return nil, nil, fmt.Errorf("xml parsing error %d: %v", lr.line, err)
-	}
-
-	for _, g := range d.Games {
-		for _, rom := range g.Roms {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Disks {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Parts {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Regions {
-			fixHashes(rom)
-		}
+		return nil, nil, xmlError(decoder, path, err)
 	}
 
-	for _, g := range d.Software {
-		for _, rom := range g.Roms {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Disks {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Parts {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Regions {
-			fixHashes(rom)
-		}
-	}
+	fixGameHashes(d.Games, d.Software, d.Machines)
 
 	d.Normalize()
 	d.Path = path
@@ -31,10 +31,24 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package parser
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/uwedeportivo/romba/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"testing"
+	"unicode/utf16"
 )
 
 func TestParserDatGoesThrough(t *testing.T) {
@@ -229,6 +243,7 @@ func TestParseXml(t *testing.T) {
 			&types.Game{
 				Name:        "megaman7p",
 				Description: "Mega Man 7 (USA, Final Prototype)",
+				CloneOf:     "megaman7",
 				Roms: []*types.Rom{
 					&types.Rom{
 						Name: "rom 0.u1",
@@ -290,3 +305,1440 @@ func TestParseXml(t *testing.T) {
 		t.Fatalf("parsed dat differs from golden dat")
 	}
 }
+
+const diskDatText = `
+clrmamepro (
+	name "MAME CHDs"
+	description "MAME CHDs"
+)
+
+game (
+	name "area51"
+	description "Area 51 (R3000)"
+	disk ( name "area51" sha1 3b303bc37e206a6d7339352c869f050d04186f11 )
+)
+`
+
+func TestParseDatDisk(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(diskDatText), "testing/diskdat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	if len(dat.Games) != 1 || len(dat.Games[0].Roms) != 0 || len(dat.Games[0].Disks) != 1 {
+		t.Fatalf("expected one game with one disk, got %s", string(types.PrintDat(dat)))
+	}
+
+	disk := dat.Games[0].Disks[0]
+	if disk.Name != "area51" || hex.EncodeToString(disk.Sha1) != "3b303bc37e206a6d7339352c869f050d04186f11" {
+		t.Fatalf("disk parsed incorrectly: %s", string(types.PrintDat(dat)))
+	}
+
+	reparsed, _, err := ParseDat(bytes.NewReader(types.PrintDat(dat)), "testing/printed")
+	if err != nil {
+		t.Fatalf("error parsing printed dat: %v", err)
+	}
+	if !dat.Games.Equals(reparsed.Games) {
+		t.Fatalf("disk lost in printed dat: %s", string(types.PrintDat(dat)))
+	}
+
+	if roms := dat.Games[0].AllRoms(); len(roms) != 1 || !bytes.Equal(roms[0].Sha1, disk.Sha1) {
+		t.Fatalf("disk missing from all roms of its game")
+	}
+}
+
+func TestComposeDatXMLRoundTrip(t *testing.T) {
+	dat := &types.Dat{
+		Name:        "Tom & Jerry <Collection>",
+		Description: "Tom & Jerry \"Collection\"",
+		Games: []*types.Game{
+			&types.Game{
+				Name:        "area51",
+				Description: "Area 51 (R3000)",
+				Roms: []*types.Rom{
+					&types.Rom{
+						Name:   "area51.bin",
+						Size:   4,
+						Crc:    []byte{0x17, 0x5a, 0x3f, 0x26},
+						Sha1:   []byte{0x80, 0x35, 0x3c, 0xb1, 0x68, 0xdc, 0x5d, 0x7c, 0xc1, 0xdc, 0xe5, 0x79, 0x71, 0xf4, 0xea, 0x26, 0x40, 0xa5, 0xa, 0xc4},
+						Status: "baddump",
+					},
+				},
+				Disks: []*types.Disk{
+					&types.Disk{
+						Name: "area51",
+						Sha1: []byte{0x3b, 0x30, 0x3b, 0xc3, 0x7e, 0x20, 0x6a, 0x6d, 0x73, 0x39, 0x35, 0x2c, 0x86, 0x9f, 0x05, 0x0d, 0x04, 0x18, 0x6f, 0x11},
+					},
+				},
+			},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	err := types.ComposeDatXML(dat, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _, err := ParseXml(buf, "testing/composed")
+	if err != nil {
+		t.Fatalf("error parsing composed dat: %v\n%s", err, buf.Bytes())
+	}
+
+	dat.Normalize()
+
+	if parsed.Name != dat.Name || parsed.Description != dat.Description || !dat.Equals(parsed) {
+		t.Fatalf("composed dat differs after parsing:\n%s", string(types.PrintDat(parsed)))
+	}
+
+	for _, rom := range parsed.Games[0].Roms {
+		if rom.Name == "area51.bin" && rom.Status != "baddump" {
+			t.Errorf("got status %q for rom, want baddump", rom.Status)
+		}
+	}
+}
+
+const cloneDatText = `
+clrmamepro (
+	name "MAME"
+	description "MAME"
+)
+
+game (
+	name "pacmanf"
+	description "Pac-Man (speedup hack)"
+	cloneof "puckman"
+	romof "puckman"
+	sampleof "puckman"
+	rom ( name "pacman.6e" size 4096 crc c1e6ab10 )
+)
+`
+
+func TestParseDatClone(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(cloneDatText), "testing/clonedat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	g := dat.Games[0]
+	if g.CloneOf != "puckman" || g.RomOf != "puckman" || g.SampleOf != "puckman" {
+		t.Fatalf("clone relationships parsed incorrectly: %s", string(types.PrintDat(dat)))
+	}
+
+	reparsed, _, err := ParseDat(bytes.NewReader(types.PrintDat(dat)), "testing/printed")
+	if err != nil {
+		t.Fatalf("error parsing printed dat: %v", err)
+	}
+	rg := reparsed.Games[0]
+	if rg.CloneOf != g.CloneOf || rg.RomOf != g.RomOf || rg.SampleOf != g.SampleOf {
+		t.Fatalf("clone relationships lost in printed dat: %s", string(types.PrintDat(dat)))
+	}
+}
+
+const samplesDatText = `
+clrmamepro (
+	name "MAME"
+	description "MAME"
+)
+
+game (
+	name "galaxian"
+	description "Galaxian (Namco set 1)"
+	sampleof "galaxian"
+	rom ( name "7f.bin" size 4096 crc 4335b1de )
+	sample "shot"
+	sample "death"
+	sample shot
+)
+`
+
+const samplesXMLText = `<?xml version="1.0"?>
+<datafile>
+	<header>
+		<name>MAME</name>
+		<description>MAME</description>
+	</header>
+	<machine name="galaxian" sampleof="galaxian">
+		<description>Galaxian (Namco set 1)</description>
+		<rom name="7f.bin" size="4096" crc="4335b1de"/>
+		<sample name="shot"/>
+		<sample name="death"/>
+	</machine>
+</datafile>
+`
+
+func TestParseSamples(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(samplesDatText), "testing/samplesdat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	xdat, _, err := ParseXml(strings.NewReader(samplesXMLText), "testing/samplesxml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	composed := new(bytes.Buffer)
+	err = types.ComposeDatXML(dat, composed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		text []byte
+		xml  bool
+	}{
+		{"parsed", nil, false},
+		{"printed", types.PrintDat(dat), false},
+		{"composed", composed.Bytes(), true},
+	} {
+		d := dat
+		switch {
+		case test.xml:
+			d, _, err = ParseXml(bytes.NewReader(test.text), "testing/"+test.name)
+		case test.text != nil:
+			d, _, err = ParseDat(bytes.NewReader(test.text), "testing/"+test.name)
+		}
+		if err != nil {
+			t.Fatalf("error parsing %s dat: %v", test.name, err)
+		}
+
+		samples := d.Games[0].Samples
+		if len(samples) != 2 || samples[0].Name != "death" || samples[1].Name != "shot" {
+			t.Errorf("%s dat has samples %v, want death and shot", test.name, samples)
+		}
+		if !d.Equals(xdat) {
+			t.Errorf("%s dat differs from the XML one:\n%s", test.name, types.PrintDat(d))
+		}
+	}
+}
+
+const flagsDatText = `
+clrmamepro (
+	name "MAME"
+	description "MAME"
+)
+
+game (
+	name "pacmanf"
+	description "Pac-Man (speedup hack)"
+	cloneof "puckman"
+	rom ( name "pacman.6e" merge "pacman.6e" size 4096 crc c1e6ab10 bios "default" )
+	rom ( name "pacman.7f" size 4096 flags nodump )
+	rom ( name "pacman.8h" size 4096 crc 0c944964 flags baddump )
+)
+`
+
+func TestParseDatFlags(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(flagsDatText), "testing/flagsdat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	check := func(dat *types.Dat) {
+		roms := dat.Games[0].Roms
+		if len(roms) != 3 {
+			t.Fatalf("expected 3 roms, got %s", string(types.PrintDat(dat)))
+		}
+		if roms[0].Merge != "pacman.6e" || roms[0].Bios != "default" || roms[0].Status != "" {
+			t.Errorf("merged rom parsed incorrectly: %s", string(types.PrintDat(dat)))
+		}
+		if !roms[1].NoDump() || roms[1].Crc != nil {
+			t.Errorf("nodump rom parsed incorrectly: %s", string(types.PrintDat(dat)))
+		}
+		if roms[2].Status != types.StatusBadDump {
+			t.Errorf("baddump rom parsed incorrectly: %s", string(types.PrintDat(dat)))
+		}
+	}
+	check(dat)
+
+	reparsed, _, err := ParseDat(bytes.NewReader(types.PrintDat(dat)), "testing/printed")
+	if err != nil {
+		t.Fatalf("error parsing printed dat: %v", err)
+	}
+	check(reparsed)
+}
+
+func TestParseDatDropsLongHash(t *testing.T) {
+	const dat = `
+game (
+	name "pacman"
+	rom ( name "pacman.5e" size 4096 crc 0c944964 )
+	rom ( name "pacman.6e" size 4096 crc c1e6ab1000 )
+)
+`
+	d, _, err := ParseDat(strings.NewReader(dat), "testing/longhash")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	for _, g := range d.Games {
+		for _, rom := range g.Roms {
+			if !rom.Crc.Valid() {
+				t.Errorf("rom %s kept with crc %s", rom.Name, rom.Crc.Hex())
+			}
+		}
+	}
+}
+
+func TestParseXmlDropsBadHashes(t *testing.T) {
+	const dat = `<?xml version="1.0"?>
+<datafile>
+	<game name="pacman">
+		<rom name="pacman.6e" size="4096" crc="c1e6ab10" sha1="e87e059c5be45753f7e9f33dff851f16d6751181ff"/>
+	</game>
+</datafile>
+`
+	d, _, err := ParseXml(strings.NewReader(dat), "testing/badhashes")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	rom := d.Games[0].Roms[0]
+	if rom.Crc.Hex() != "c1e6ab10" || rom.Sha1 != nil {
+		t.Errorf("got crc %s and sha1 %s", rom.Crc.Hex(), rom.Sha1.Hex())
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	header := func(d *types.Dat) string {
+		return strings.Join([]string{d.Name, d.Description, d.Category, d.Version, d.Date,
+			d.Author, d.Email, d.Homepage, d.URL, d.Comment}, "|")
+	}
+
+	dat, _, err := ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	want := "Acorn Archimedes - Applications|Acorn Archimedes - Applications (TOSEC-v2008-10-11)|" +
+		"Acorn Archimedes - Applications|2008-10-11||C0llector - Cassiel||||"
+	if got := header(dat); got != want {
+		t.Errorf("got header %s, want %s", got, want)
+	}
+
+	xmlDat, _, err := Parse("testdata/example.xml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	want = "AgeMame Artwork|AgeMame Artwork|Standard DatFile|0.134|Sep 16 2009|-insert author-|" +
+		"-insert email-|AGEMAME HQ|http://agemame.mameworld.info/|-insert comment-"
+	if got := header(xmlDat); got != want {
+		t.Errorf("got header %s, want %s", got, want)
+	}
+
+	reparsed, _, err := ParseDat(bytes.NewReader(types.PrintDat(xmlDat)), "testing/printed")
+	if err != nil {
+		t.Fatalf("error parsing printed dat: %v", err)
+	}
+	if got := header(reparsed); got != want {
+		t.Errorf("got header %s from printed dat, want %s", got, want)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := types.ComposeDatXML(xmlDat, buf); err != nil {
+		t.Fatal(err)
+	}
+	reparsed, _, err = ParseXml(buf, "testing/composed")
+	if err != nil {
+		t.Fatalf("error parsing composed dat: %v", err)
+	}
+	if got := header(reparsed); got != want {
+		t.Errorf("got header %s from composed dat, want %s", got, want)
+	}
+}
+
+const listXMLText = `<?xml version="1.0"?>
+<mame build="0.250">
+	<machine name="neogeo" sourcefile="neogeo.cpp" isbios="yes">
+		<description>Neo-Geo MV-6F</description>
+		<year>1990</year>
+		<manufacturer>SNK</manufacturer>
+		<biosset name="euro" description="Europe MVS (Ver. 2)" default="yes"/>
+		<biosset name="japan" description="Japan MVS (Ver. 3)"/>
+		<rom name="sp-s2.sp1" bios="euro" size="131072" crc="9036d879" sha1="4f5ed7105b7128794654ce82b51723e16e389543" region="mainbios" offset="0"/>
+		<device_ref name="68000"/>
+		<device_ref name="z80"/>
+		<chip type="cpu" tag="maincpu" name="68000" clock="12000000"/>
+	</machine>
+	<machine name="kof98" romof="neogeo">
+		<description>The King of Fighters '98</description>
+		<year>1998</year>
+		<manufacturer>SNK</manufacturer>
+		<rom name="242-pn1.p1" size="4194304" crc="61ac868a" sha1="26577264aa72d6af272952a876fcd3775f53e3fa"/>
+		<disk name="kof98" sha1="e87e059c5be45753f7e9f33dff851f16d6751181" region="ata"/>
+	</machine>
+	<machine name="z80" isdevice="yes" runnable="no">
+		<description>Zilog Z80</description>
+	</machine>
+</mame>
+`
+
+const releaseXMLText = `<?xml version="1.0"?>
+<datafile>
+	<header>
+		<name>Nintendo - Game Boy</name>
+		<description>Nintendo - Game Boy</description>
+	</header>
+	<game name="Tetris (World)">
+		<description>Tetris (World)</description>
+		<release name="Tetris (World)" region="USA" language="En" date="1989"/>
+		<release name="Tetris (World)" region="JPN" default="yes"/>
+		<rom name="Tetris (World).gb" size="32768" crc="46df91ad"/>
+	</game>
+</datafile>
+`
+
+func TestParseListXML(t *testing.T) {
+	dat, _, err := ParseXml(strings.NewReader(listXMLText), "testing/listxml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	if len(dat.Games) != 3 || dat.Machines != nil {
+		t.Fatalf("got %d games, want the 3 machines", len(dat.Games))
+	}
+
+	kof98, neogeo, z80 := dat.Games[0], dat.Games[1], dat.Games[2]
+	if !neogeo.IsBios || neogeo.IsDevice || neogeo.Year != "1990" || neogeo.Manufacturer != "SNK" {
+		t.Errorf("got bios %+v", neogeo)
+	}
+	if len(neogeo.BiosSets) != 2 || neogeo.BiosSets[0].Name != "euro" || !neogeo.BiosSets[0].Default ||
+		neogeo.BiosSets[1].Default {
+		t.Errorf("got bios sets %+v", neogeo.BiosSets)
+	}
+	if len(neogeo.DeviceRefs) != 2 || neogeo.DeviceRefs[1].Name != "z80" {
+		t.Errorf("got device refs %+v", neogeo.DeviceRefs)
+	}
+	if rom := neogeo.Roms[0]; rom.Bios != "euro" || rom.Sha1.Hex() != "4f5ed7105b7128794654ce82b51723e16e389543" {
+		t.Errorf("got bios rom %+v", rom)
+	}
+	if kof98.RomOf != "neogeo" || len(kof98.Disks) != 1 || kof98.Disks[0].Sha1 == nil {
+		t.Errorf("got machine %+v", kof98)
+	}
+	if !z80.IsDevice {
+		t.Errorf("device not flagged")
+	}
+
+	if bios := dat.Filter(dat.BiosSets()); len(bios.Games) != 1 || bios.Games[0] != neogeo {
+		t.Errorf("got BIOS sets %v", bios.Games)
+	}
+}
+
+func TestParseReleasesRoundTrip(t *testing.T) {
+	dat, _, err := ParseXml(strings.NewReader(releaseXMLText), "testing/releases")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	check := func(d *types.Dat) {
+		rs := d.Games[0].Releases
+		if len(rs) != 2 || rs[0].Region != "USA" || rs[0].Language != "En" || rs[0].Date != "1989" ||
+			rs[0].Default || !rs[1].Default {
+			t.Errorf("got releases %+v", rs)
+		}
+	}
+	check(dat)
+
+	buf := new(bytes.Buffer)
+	if err := types.ComposeDatXML(dat, buf); err != nil {
+		t.Fatal(err)
+	}
+	reparsed, _, err := ParseXml(buf, "testing/composed")
+	if err != nil {
+		t.Fatalf("error parsing composed dat: %v\n%s", err, buf.String())
+	}
+	check(reparsed)
+}
+
+const softwareListText = `<?xml version="1.0"?>
+<!DOCTYPE softwarelist SYSTEM "softwarelist.dtd">
+<softwarelist name="gameboy" description="Nintendo Game Boy cartridges">
+	<software name="tetris">
+		<description>Tetris (World)</description>
+		<year>1989</year>
+		<publisher>Nintendo</publisher>
+		<part name="cart" interface="gameboy_cart">
+			<dataarea name="rom" size="32768">
+				<rom name="dmg-tra-1.bin" size="32768" crc="63f9407d" sha1="aa3e4d6b1e4e4b8e2a2d1a4c1d0b6e7e9bd53c2b" offset="0"/>
+			</dataarea>
+		</part>
+	</software>
+	<software name="tetrisa" cloneof="tetris">
+		<description>Tetris (Japan)</description>
+		<part name="cart" interface="gameboy_cart">
+			<dataarea name="rom" size="65536">
+				<rom name="tetrisa.bin" size="32768" crc="46df91ad" sha1="bb3e4d6b1e4e4b8e2a2d1a4c1d0b6e7e9bd53c2b" offset="0"/>
+				<rom size="32768" offset="0x8000" loadflag="continue"/>
+			</dataarea>
+			<diskarea name="cdrom">
+				<disk name="tetrisa" sha1="cc3e4d6b1e4e4b8e2a2d1a4c1d0b6e7e9bd53c2b"/>
+			</diskarea>
+		</part>
+	</software>
+</softwarelist>
+`
+
+func TestParseSoftwareList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "softlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gameboy.xml")
+	if err := ioutil.WriteFile(path, []byte(softwareListText), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dat, sha1Bytes, err := Parse(path)
+	if err != nil {
+		t.Fatalf("error parsing software list: %v", err)
+	}
+	if dat.Name != "gameboy" || dat.Description != "Nintendo Game Boy cartridges" || dat.Path != path {
+		t.Errorf("got header %+v", dat.Header())
+	}
+	if len(sha1Bytes) != 20 {
+		t.Errorf("got sha1 %x", sha1Bytes)
+	}
+	if len(dat.Games) != 2 || dat.Software != nil {
+		t.Fatalf("got %d games, want the 2 software", len(dat.Games))
+	}
+
+	tetris, tetrisa := dat.Games[0], dat.Games[1]
+	if tetris.Year != "1989" || len(tetris.Roms) != 1 || tetris.Roms[0].Crc.Hex() != "63f9407d" {
+		t.Errorf("got software %+v", tetris)
+	}
+	if tetrisa.CloneOf != "tetris" || len(tetrisa.Roms) != 1 || tetrisa.Roms[0].Name != "tetrisa.bin" {
+		t.Errorf("got clone with roms %v", tetrisa.Roms)
+	}
+	if len(tetrisa.Disks) != 1 || tetrisa.Disks[0].Sha1 == nil {
+		t.Errorf("got clone with disks %v", tetrisa.Disks)
+	}
+}
+
+func TestParseSoftwareLists(t *testing.T) {
+	list := softwareListText[strings.Index(softwareListText, "<softwarelist "):]
+	text := "<softwarelists>\n" + list + strings.Replace(list, `"gameboy"`, `"gbcolor"`, 1) + "</softwarelists>\n"
+
+	dats, sha1s, err := ParseSoftwareLists(strings.NewReader(text), "testing/softwarelists")
+	if err != nil {
+		t.Fatalf("error parsing software lists: %v", err)
+	}
+	if len(dats) != 2 || dats[0].Name != "gameboy" || dats[1].Name != "gbcolor" {
+		t.Fatalf("got %d dats", len(dats))
+	}
+	if bytes.Equal(sha1s[0], sha1s[1]) {
+		t.Errorf("lists share sha1 %x", sha1s[0])
+	}
+	for _, d := range dats {
+		if len(d.Games) != 2 {
+			t.Errorf("got %d games in %s", len(d.Games), d.Name)
+		}
+	}
+}
+
+func TestParseXmlStreamMatchesParseXml(t *testing.T) {
+	parseSoftwareList := func(r io.Reader, path string) (*types.Dat, []byte, error) {
+		dats, sha1s, err := ParseSoftwareLists(r, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return dats[0], sha1s[0], nil
+	}
+
+	for _, test := range []struct {
+		text  string
+		parse func(r io.Reader, path string) (*types.Dat, []byte, error)
+	}{
+		{listXMLText, ParseXml},
+		{releaseXMLText, ParseXml},
+		{softwareListText, parseSoftwareList},
+	} {
+		text := test.text
+		dat, sha1Bytes, err := test.parse(strings.NewReader(text), "testing/whole")
+		if err != nil {
+			t.Fatalf("error parsing test data: %v", err)
+		}
+
+		var games types.GameSlice
+		hdr, streamedSha1, err := ParseXmlStream(strings.NewReader(text), "testing/streamed", func(g *types.Game) error {
+			games = append(games, g)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("error streaming test data: %v", err)
+		}
+
+		if hdr.Games != nil || hdr.Path != "testing/streamed" {
+			t.Errorf("got header %+v", hdr)
+		}
+		if !bytes.Equal(sha1Bytes, streamedSha1) {
+			t.Errorf("got sha1 %x, want %x", streamedSha1, sha1Bytes)
+		}
+
+		sort.Stable(games)
+		if !games.Equals(dat.Games) {
+			t.Errorf("streamed games %v differ from parsed %v", games, dat.Games)
+		}
+	}
+}
+
+func TestParseXmlStreamStops(t *testing.T) {
+	stop := fmt.Errorf("stop")
+	n := 0
+	_, _, err := ParseXmlStream(strings.NewReader(listXMLText), "testing/stops", func(g *types.Game) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("got error %v after %d games", err, n)
+	}
+}
+
+const malformedDat = `clrmamepro (
+	name "malformed"
+)
+
+game (
+	name "good"
+	rom ( name "good.bin" size 4 crc 01020304 )
+)
+
+game (
+	name "badsize"
+	rom ( name "badsize.bin" size four crc 01020304 )
+)
+
+game (
+	name "badcrc"
+	rom ( name "badcrc.bin" size 4 crc zz020304 sha1 0102030405060708090a0b0c0d0e0f1011121314 )
+	rom ( name "kept.bin" size 4 crc 01020304 )
+)
+
+game (
+	name "unterminated
+	rom ( name "unterminated.bin" size 4 crc 01020304 )
+)
+
+game (
+	name "last"
+	rom ( name "last.bin" size 4 crc 01020304 )
+)
+`
+
+func TestParseDatErrorPosition(t *testing.T) {
+	_, _, err := ParseDat(strings.NewReader(malformedDat), "testing/malformed")
+	pe, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("got error %v, want a ParseError", err)
+	}
+
+	if pe.Path != "testing/malformed" || pe.Line != 12 || pe.Column != 32 || pe.Token != `"four"` {
+		t.Errorf("got error at %s:%d:%d on %s", pe.Path, pe.Line, pe.Column, pe.Token)
+	}
+	if !strings.HasSuffix(pe.Snippet, "size four") {
+		t.Errorf("got snippet %q", pe.Snippet)
+	}
+	if msg := pe.Error(); !strings.HasPrefix(msg, "testing/malformed:12:32: ") {
+		t.Errorf("got message %q", msg)
+	}
+}
+
+func TestParseDatLenient(t *testing.T) {
+	d, sha1Bytes, warnings, err := ParseDatLenient(strings.NewReader(malformedDat), "testing/malformed")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	if d.Name != "malformed" || sha1Bytes == nil {
+		t.Errorf("got dat %s with sha1 %x", d.Name, sha1Bytes)
+	}
+
+	var names []string
+	for _, g := range d.Games {
+		names = append(names, g.Name)
+	}
+	if got := strings.Join(names, " "); got != "badcrc good last" {
+		t.Errorf("got games %s", got)
+	}
+	if got := romNames(d, "badcrc"); got != "kept.bin" {
+		t.Errorf("got roms %s for game with bad crc", got)
+	}
+
+	var lines []int
+	for _, w := range warnings {
+		lines = append(lines, w.Line)
+	}
+	if fmt.Sprint(lines) != "[12 17 22]" {
+		t.Errorf("got warnings on lines %v: %v", lines, warnings)
+	}
+	if len(warnings) == 3 && !strings.Contains(warnings[2].Error(), "unterminated quoted string") {
+		t.Errorf("got warning %v", warnings[2])
+	}
+}
+
+func romNames(d *types.Dat, game string) string {
+	for _, g := range d.Games {
+		if g.Name == game {
+			var names []string
+			for _, r := range g.Roms {
+				names = append(names, r.Name)
+			}
+			return strings.Join(names, " ")
+		}
+	}
+	return ""
+}
+
+const nesSkipperText = `<?xml version="1.0"?>
+<detector>
+	<name>Nintendo Famicon/NES</name>
+	<author>Roman Scherzer</author>
+	<version>1.1</version>
+	<rule start_offset="10" end_offset="EOF" operation="none">
+		<data offset="0" value="4E45531A" result="true"/>
+	</rule>
+	<rule start_offset="0x200" operation="byteswap">
+		<and offset="1" mask="F0" value="10"/>
+		<file size="PO2" result="false"/>
+		<file size="4000" operator="less"/>
+	</rule>
+</detector>
+`
+
+func TestParseDetector(t *testing.T) {
+	d, err := ParseDetector(strings.NewReader(nesSkipperText), "testing/nes.xml")
+	if err != nil {
+		t.Fatalf("error parsing header skipper: %v", err)
+	}
+
+	if d.Name != "Nintendo Famicon/NES" || d.Author != "Roman Scherzer" || d.Version != "1.1" || len(d.Rules) != 2 {
+		t.Fatalf("got detector %+v", d)
+	}
+
+	nes, other := d.Rules[0], d.Rules[1]
+	if nes.StartOffset != 0x10 || nes.EndOffset != -1 || nes.Operation != types.OpNone || len(nes.Tests) != 1 {
+		t.Errorf("got rule %+v", nes)
+	}
+	if test := nes.Tests[0]; test.Kind != types.TestData || string(test.Value) != "NES\x1a" || !test.Result {
+		t.Errorf("got test %+v", test)
+	}
+	if rule := d.Match([]byte("NES\x1a0123456789ab"), 32); rule != nes {
+		t.Errorf("NES header matched by %+v", rule)
+	}
+
+	if other.StartOffset != 0x200 || other.Operation != types.OpByteSwap || len(other.Tests) != 3 {
+		t.Fatalf("got rule %+v", other)
+	}
+	kinds := []string{other.Tests[0].Kind, other.Tests[1].Kind, other.Tests[2].Kind}
+	if strings.Join(kinds, " ") != "and file file" {
+		t.Errorf("got tests %v out of order", kinds)
+	}
+	if test := other.Tests[1]; test.Size != -1 || test.Result || test.Operator != "equal" {
+		t.Errorf("got file test %+v", test)
+	}
+	if test := other.Tests[2]; test.Size != 0x4000 || !test.Result || test.Operator != "less" {
+		t.Errorf("got file test %+v", test)
+	}
+}
+
+func TestParseDetectorErrors(t *testing.T) {
+	for _, text := range []string{
+		strings.Replace(nesSkipperText, `operation="byteswap"`, `operation="rot13"`, 1),
+		strings.Replace(nesSkipperText, `<file size="PO2"`, `<size value="PO2"`, 1),
+		strings.Replace(nesSkipperText, `value="4E45531A"`, `value="NES"`, 1),
+		strings.Replace(nesSkipperText, `size="4000"`, `size="lots"`, 1),
+		strings.Replace(nesSkipperText, `</detector>`, ``, 1),
+	} {
+		if _, err := ParseDetector(strings.NewReader(text), "testing/bad.xml"); err == nil {
+			t.Errorf("no error for\n%s", text)
+		}
+	}
+}
+
+func TestParseContainers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	datText, err := ioutil.ReadFile("testdata/example.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmlText, err := ioutil.ReadFile("testdata/example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, plainSha1, err := Parse("testdata/example.dat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	gzPath := filepath.Join(dir, "example.dat.gz")
+	gzFile, err := os.Create(gzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(gzFile)
+	gw.Write(datText)
+	gw.Close()
+	gzFile.Close()
+
+	dat, sha1Bytes, err := Parse(gzPath)
+	if err != nil {
+		t.Fatalf("error parsing gzipped dat: %v", err)
+	}
+	if !bytes.Equal(sha1Bytes, plainSha1) {
+		t.Errorf("got sha1 %x for gzipped dat, want %x", sha1Bytes, plainSha1)
+	}
+	if dat.Path != filepath.Join(gzPath, "example.dat") || !dat.Games.Equals(plain.Games) {
+		t.Errorf("got gzipped dat %s with %d games", dat.Path, len(dat.Games))
+	}
+
+	zipPath := filepath.Join(dir, "examples.zip")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zipFile)
+	for name, text := range map[string][]byte{
+		"dats/example.dat": datText,
+		"example.xml":      xmlText,
+		"readme.txt":       []byte("not a dat"),
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(text)
+	}
+	zw.Close()
+	zipFile.Close()
+
+	dats, sha1s, _, err := ParseAll(zipPath)
+	if err != nil {
+		t.Fatalf("error parsing zipped dats: %v", err)
+	}
+	if len(dats) != 2 {
+		t.Fatalf("got %d dats from zip", len(dats))
+	}
+	found := false
+	for i, d := range dats {
+		if d.Path == filepath.Join(zipPath, "dats", "example.dat") {
+			found = true
+			if !bytes.Equal(sha1s[i], plainSha1) {
+				t.Errorf("got sha1 %x for zipped dat, want %x", sha1s[i], plainSha1)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("zipped dat not found in %v", dats)
+	}
+
+	if _, _, err := Parse(zipPath); err == nil {
+		t.Errorf("no error parsing zip with 2 dats as one")
+	}
+	if !IsDatFile(zipPath) || !IsDatFile(gzPath) || IsDatFile("readme.txt") || IsDatFile("backup.tar.gz") {
+		t.Errorf("dat files not told apart")
+	}
+}
+
+// writeTestZip writes a zip file holding members at path.
+func writeTestZip(t *testing.T, path string, members map[string][]byte) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range members {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	zw.Close()
+
+	err := ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseContainerLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	datText, err := ioutil.ReadFile("testdata/example.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mixedPath := filepath.Join(dir, "mixed.zip")
+	writeTestZip(t, mixedPath, map[string][]byte{
+		"example.dat": datText,
+		"notes.xml":   []byte("<?xml version=\"1.0\"?>\n<notes><note>not a dat</note></notes>\n"),
+	})
+	dats, _, _, err := ParseAll(mixedPath)
+	if err != nil {
+		t.Fatalf("error parsing zip with a member that isn't a dat: %v", err)
+	}
+	if len(dats) != 1 {
+		t.Errorf("got %d dats from zip with one dat", len(dats))
+	}
+
+	noDatsPath := filepath.Join(dir, "nodats.zip")
+	writeTestZip(t, noDatsPath, map[string][]byte{"readme.txt": []byte("not a dat")})
+	if _, _, _, err := ParseAll(noDatsPath); err == nil {
+		t.Errorf("no error parsing zip without dats")
+	} else if _, ok := err.(*NoDatsError); !ok {
+		t.Errorf("got %v parsing zip without dats, want a NoDatsError", err)
+	}
+
+	nested := datText
+	name := "example.dat"
+	for i := 0; i <= maxContainerDepth; i++ {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(nested)
+		zw.Close()
+		nested = buf.Bytes()
+		name = fmt.Sprintf("nested%d.zip", i)
+	}
+	nestedPath := filepath.Join(dir, name)
+	err = ioutil.WriteFile(nestedPath, nested, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ParseAll(nestedPath); err == nil {
+		t.Errorf("no error parsing containers nested too deeply")
+	}
+
+	defer func(size int64) { maxUnpackedSize = size }(maxUnpackedSize)
+	maxUnpackedSize = int64(len(datText)) - 1
+	bigPath := filepath.Join(dir, "big.zip")
+	writeTestZip(t, bigPath, map[string][]byte{"example.dat": datText})
+	if _, _, _, err := ParseAll(bigPath); err == nil {
+		t.Errorf("no error parsing container unpacking to more than the max size")
+	}
+}
+
+func TestParseDatLatin1(t *testing.T) {
+	const dat = "game (\n\tname \"Pok\xe9mon \x93Red\x94\"\n\trom ( name \"caf\xe9.bin\" size 4 crc 01020304 )\n)\n"
+
+	d, _, err := ParseDat(strings.NewReader(dat), "testing/latin1")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	if g := d.Games[0]; g.Name != "Pokémon “Red”" || g.Roms[0].Name != "café.bin" {
+		t.Errorf("got game %q with rom %q", g.Name, g.Roms[0].Name)
+	}
+}
+
+func TestParseXmlEncodings(t *testing.T) {
+	const latin1 = "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n" +
+		"<datafile><game name=\"Pok\xe9mon\"><rom name=\"a.bin\" size=\"4\" crc=\"01020304\"/></game></datafile>\n"
+
+	d, _, err := ParseXml(strings.NewReader(latin1), "testing/latin1")
+	if err != nil {
+		t.Fatalf("error parsing Latin-1 XML: %v", err)
+	}
+	if name := d.Games[0].Name; name != "Pokémon" {
+		t.Errorf("got game %q from Latin-1 XML", name)
+	}
+
+	dir, err := ioutil.TempDir("", "encodings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utf8Text := strings.Replace(latin1, "ISO-8859-1", "UTF-16", 1)
+	utf8Text = strings.Replace(utf8Text, "\xe9", "é", 1)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, order, utf16.Encode(append([]rune{0xfeff}, []rune(utf8Text)...)))
+
+		path := filepath.Join(dir, fmt.Sprintf("utf16%v.xml", order))
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		d, _, err := Parse(path)
+		if err != nil {
+			t.Fatalf("error parsing UTF-16 XML: %v", err)
+		}
+		if name := d.Games[0].Name; name != "Pokémon" {
+			t.Errorf("got game %q from UTF-16 XML", name)
+		}
+	}
+}
+
+const romCenterText = `[CREDITS]
+author=Some Author
+version=0.37b5
+comment=Converted from MAME
+
+[DAT]
+version=2.50
+plugin=arcade.dll
+
+[EMULATOR]
+refname=MAME
+version=MAME 0.37b5
+
+[GAMES]
+¬pacman¬Pac-Man (Midway)¬pacman¬Pac-Man (Midway)¬pacman.6e¬c1e6ab10¬4096¬¬¬
+¬pacman¬Pac-Man (Midway)¬pacman¬Pac-Man (Midway)¬pacman.6f¬1a6fb2d4¬4096¬¬¬
+¬pacman¬Pac-Man (Midway)¬puckman¬PuckMan (Japan)¬pm1_prg1.6e¬f36e88ab¬2048¬pacman¬¬
+¬pacman¬Pac-Man (Midway)¬puckman¬PuckMan (Japan)¬pacman.6f¬1a6fb2d4¬4096¬pacman¬pacman.6f¬
+¬pacman¬Pac-Man (Midway)¬puckman¬PuckMan (Japan)¬bad.bin¬xyz¬4096¬pacman¬¬
+`
+
+func TestParseRomCenter(t *testing.T) {
+	latin1 := strings.Replace(romCenterText, "¬", "\xac", -1)
+
+	for _, text := range []string{romCenterText, latin1} {
+		dat, _, err := ParseRomCenter(strings.NewReader(text), "testing/romcenter")
+		if err != nil {
+			t.Fatalf("error parsing RomCenter dat: %v", err)
+		}
+
+		if dat.Name != "MAME" || dat.Description != "MAME 0.37b5" || dat.Author != "Some Author" ||
+			dat.Version != "0.37b5" || dat.Comment != "Converted from MAME" {
+			t.Errorf("got header %+v", dat.Header())
+		}
+		if len(dat.Games) != 2 {
+			t.Fatalf("got %d games", len(dat.Games))
+		}
+
+		pacman, puckman := dat.Games[0], dat.Games[1]
+		if pacman.CloneOf != "" || pacman.Description != "Pac-Man (Midway)" || len(pacman.Roms) != 2 {
+			t.Errorf("got parent %+v", pacman)
+		}
+		if puckman.CloneOf != "pacman" || puckman.RomOf != "pacman" || len(puckman.Roms) != 2 {
+			t.Errorf("got clone %+v with roms %v", puckman, puckman.Roms)
+		}
+		if rom := puckman.Roms[0]; rom.Name != "pacman.6f" || rom.Merge != "pacman.6f" || rom.Size != 4096 ||
+			rom.Crc.Hex() != "1a6fb2d4" {
+			t.Errorf("got rom %+v", rom)
+		}
+	}
+}
+
+func TestParseRomCenterFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romcenter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mame.dat")
+	if err := ioutil.WriteFile(path, []byte(romCenterText), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dat, _, err := Parse(path)
+	if err != nil {
+		t.Fatalf("error parsing RomCenter dat: %v", err)
+	}
+	if dat.Name != "MAME" || len(dat.Games) != 2 {
+		t.Errorf("got dat %s with %d games", dat.Name, len(dat.Games))
+	}
+
+	bad := strings.Replace(romCenterText, "¬4096¬¬¬\n", "¬4096\n", 1)
+	_, _, err = ParseRomCenter(strings.NewReader(bad), "testing/bad")
+	if pe, ok := err.(*ParseError); !ok || pe.Line != 15 {
+		t.Errorf("got error %v for short row", err)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	datText, err := ioutil.ReadFile("testdata/example.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmlText, err := ioutil.ReadFile("testdata/example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		text       string
+		format     Format
+		confidence float64
+	}{
+		{string(datText), FormatClrMamePro, 1},
+		{"game (\n\tname \"pacman\"\n)\n", FormatClrMamePro, 0.8},
+		{string(xmlText), FormatLogiqx, 1},
+		{listXMLText, FormatMAME, 1},
+		{softwareListText, FormatSoftwareList, 1},
+		{romCenterText, FormatRomCenter, 1},
+		{"[CREDITS]\nauthor=someone\n", FormatRomCenter, 0.8},
+		{"<?xml version=\"1.0\"?>\n<html></html>\n", FormatUnknown, 0},
+		{"this game is not a dat\n", FormatUnknown, 0},
+		{"", FormatUnknown, 0},
+	} {
+		format, confidence, err := Detect(strings.NewReader(test.text))
+		if err != nil {
+			t.Fatalf("error detecting format: %v", err)
+		}
+		if format != test.format || confidence != test.confidence {
+			t.Errorf("got %v (%v), want %v (%v) for %.40q", format, confidence, test.format, test.confidence, test.text)
+		}
+	}
+}
+
+func withLimits(limits Limits, f func()) {
+	saved := DefaultLimits
+	DefaultLimits = limits
+	defer func() { DefaultLimits = saved }()
+	f()
+}
+
+func TestParseDatChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	buf.WriteString("clrmamepro (\n\tname \"chunks\"\n)\n\n")
+	for k := 0; k < 100; k++ {
+		fmt.Fprintf(&buf, "game (\n\tname \"game%03d\"\n\trom ( name \"game%03d.bin\" size %d crc %08x )\n)\n\n", k, k, k, k)
+	}
+
+	for _, test := range []struct {
+		name    string
+		text    string
+		lenient bool
+	}{
+		{"games.dat", buf.String(), false},
+		{"malformed.dat", malformedDat, true},
+	} {
+		path := filepath.Join(dir, test.name)
+		err = ioutil.WriteFile(path, []byte(test.text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, wantSha1, wantWarnings, err := parseDat(strings.NewReader(test.text), path, parseOptions{lenient: test.lenient})
+		if err != nil {
+			t.Fatalf("error parsing test data: %v", err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for n := 1; n <= 8; n++ {
+			got, gotSha1, gotWarnings, err := parseDatChunks(file, int64(len(test.text)), path, parseOptions{lenient: test.lenient}, n)
+			if err != nil {
+				t.Fatalf("error parsing %s in %d chunks: %v", test.name, n, err)
+			}
+			if !reflect.DeepEqual(got, want) || !bytes.Equal(gotSha1, wantSha1) {
+				t.Errorf("parsing %s in %d chunks got a different dat", test.name, n)
+			}
+			if !reflect.DeepEqual(gotWarnings, wantWarnings) {
+				t.Errorf("parsing %s in %d chunks got warnings %v, want %v", test.name, n, gotWarnings, wantWarnings)
+			}
+		}
+		file.Close()
+	}
+}
+
+func TestParseSpans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	xmlText, err := ioutil.ReadFile("testdata/example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const utf8Dat = "\xef\xbb\xbfclrmamepro (\n\tname \"spans\"\n)\n\n" +
+		"game (\n\tname \"café\"\n\trom ( name \"café.bin\" size 4 crc 01020304 )\n)\n\n" +
+		"game (\n\tname \"crème\"\n\trom ( name \"crème.bin\" size 4 crc 01020304 )\n)\n"
+
+	for _, test := range []struct {
+		name   string
+		text   string
+		prefix string
+	}{
+		{"utf8.dat", utf8Dat, "game ("},
+		{"example.xml", string(xmlText), "<game "},
+	} {
+		path := filepath.Join(dir, test.name)
+		err = ioutil.WriteFile(path, []byte(test.text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, _, err := ParseSpans(path)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", test.name, err)
+		}
+		if len(d.Games) == 0 {
+			t.Fatalf("got no games from %s", test.name)
+		}
+
+		for _, g := range d.Games {
+			if g.Span == nil {
+				t.Errorf("got no span for game %s of %s", g.Name, test.name)
+				continue
+			}
+			src := test.text[g.Span.Start:g.Span.End]
+			if !strings.HasPrefix(src, test.prefix) || !strings.Contains(src, g.Name) {
+				t.Errorf("got span %q for game %s of %s", src, g.Name, test.name)
+			}
+			if strings.HasSuffix(test.name, ".dat") && !strings.HasSuffix(src, ")") {
+				t.Errorf("got span %q for game %s of %s", src, g.Name, test.name)
+			}
+		}
+
+		if strings.HasSuffix(test.name, ".dat") {
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunked, _, _, err := parseDatChunks(file, int64(len(test.text)), path, parseOptions{spans: true}, 2)
+			file.Close()
+			if err != nil {
+				t.Fatalf("error parsing %s in chunks: %v", test.name, err)
+			}
+			if !reflect.DeepEqual(chunked, d) {
+				t.Errorf("parsing %s in chunks got different spans", test.name)
+			}
+		}
+	}
+
+	path := filepath.Join(dir, "latin1.dat")
+	err = ioutil.WriteFile(path, []byte("game (\n\tname \"caf\xe9\"\n)\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ParseSpans(path)
+	if err == nil || !strings.Contains(err.Error(), "not UTF-8") {
+		t.Errorf("got error %v for a Latin-1 dat", err)
+	}
+}
+
+func TestParseAllFiltered(t *testing.T) {
+	f := Filter{
+		Exclude: []*regexp.Regexp{regexp.MustCompile("^unterminated")},
+		Regions: []string{"Europe"},
+	}
+	keep := f.GameFilter()
+
+	dir, err := ioutil.TempDir("", "filtered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const dat = `clrmamepro (
+	name "filtered"
+)
+
+game (
+	name "a (USA)"
+	category "Games"
+	rom ( name "a.bin" size 4 crc 01020304 )
+)
+
+game (
+	name "b (Europe)"
+	category "Games"
+	rom ( name "b.bin" size 4 crc 01020304 )
+)
+
+game (
+	name "unterminated (Europe)"
+	rom ( name "c.bin" size 4 crc 01020304 )
+)
+`
+	const xmlDat = `<?xml version="1.0"?>
+<datafile>
+	<header><name>filtered</name></header>
+	<game name="a (USA)"><category>Games</category><rom name="a.bin" size="4" crc="01020304"/></game>
+	<game name="b (Europe)"><category>Games</category><rom name="b.bin" size="4" crc="01020304"/></game>
+</datafile>
+`
+
+	for name, text := range map[string]string{"filtered.dat": dat, "filtered.xml": xmlDat} {
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dats, _, _, err := ParseAllFiltered(path, keep)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", name, err)
+		}
+		if len(dats) != 1 || len(dats[0].Games) != 1 || dats[0].Games[0].Name != "b (Europe)" {
+			t.Errorf("got games %v from %s", dats[0].Games, name)
+		}
+		if dats[0].Games[0].Category != "Games" {
+			t.Errorf("got category %q from %s", dats[0].Games[0].Category, name)
+		}
+	}
+
+	if keep := new(Filter).GameFilter(); keep != nil {
+		t.Errorf("the zero Filter filters games")
+	}
+
+	reordered := Filter{
+		Exclude: f.Exclude,
+		Regions: []string{"Europe"},
+	}
+	if new(Filter).Key() != "" || f.Key() == "" || f.Key() != reordered.Key() {
+		t.Errorf("got keys %q and %q for the same filter", f.Key(), reordered.Key())
+	}
+	if other := (Filter{Regions: []string{"USA"}}); other.Key() == f.Key() {
+		t.Errorf("filters keeping different games have the same key %q", f.Key())
+	}
+}
+
+func TestVerifySidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	datText, err := ioutil.ReadFile("testdata/example.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	datSha1 := sha1.Sum(datText)
+	good := hex.EncodeToString(datSha1[:])
+	bad := strings.Repeat("0", 40)
+
+	path := filepath.Join(dir, "example.dat")
+	err = ioutil.WriteFile(path, datText, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		sidecar  string
+		text     string
+		mismatch bool
+	}{
+		{"", "", false},
+		{"example.dat.sha1", good + "  example.dat\n", false},
+		{"example.dat.sha1", bad + " *example.dat\n", true},
+		{"example.sha1", good + "\n", false},
+		{"example.sha1", bad + "\n", true},
+		{"example.sha1", "SHA1 (example.dat) = " + bad + "\n", true},
+		{"example.sha1", bad + "  other.dat\n" + good + "  example.dat\n", false},
+		{"example.sha1", bad + "  example.zip\n", false},
+	} {
+		if test.sidecar != "" {
+			err = ioutil.WriteFile(filepath.Join(dir, test.sidecar), []byte(test.text), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, _, err = Parse(path)
+		_, _, _, allErr := ParseAll(path)
+		_, mismatch := err.(*ChecksumError)
+		_, allMismatch := allErr.(*ChecksumError)
+		if mismatch != test.mismatch || allMismatch != test.mismatch {
+			t.Errorf("got errors %v and %v for %s holding %q", err, allErr, test.sidecar, test.text)
+		}
+		if !test.mismatch && (err != nil || allErr != nil) {
+			t.Errorf("got errors %v and %v for %s holding %q", err, allErr, test.sidecar, test.text)
+		}
+
+		if test.sidecar != "" {
+			os.Remove(filepath.Join(dir, test.sidecar))
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	xmlText, err := ioutil.ReadFile("testdata/example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	datText, err := ioutil.ReadFile("testdata/example.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		limits Limits
+		text   string
+	}{
+		{Limits{MaxTokenLength: 16}, `game ( name "a name longer than sixteen" )`},
+		{Limits{MaxDepth: 3}, "game ( rom ( ( ( ) ) ) )"},
+		{Limits{MaxElements: 2}, string(datText)},
+		{Limits{MaxTokenLength: 16}, `<?xml version="1.0"?><datafile><game name="a name longer than sixteen"/></datafile>`},
+		{Limits{MaxDepth: 3}, `<?xml version="1.0"?><datafile><game name="a"><rom><a><b/></a></rom></game></datafile>`},
+		{Limits{MaxElements: 2}, string(xmlText)},
+	} {
+		withLimits(test.limits, func() {
+			var err error
+			if strings.HasPrefix(test.text, "<") {
+				_, _, err = ParseXml(strings.NewReader(test.text), "testing/limits")
+			} else {
+				_, _, _, err = ParseDatLenient(strings.NewReader(test.text), "testing/limits")
+			}
+			if err == nil || !strings.Contains(err.Error(), "limit") {
+				t.Errorf("got error %v with limits %+v", err, test.limits)
+			}
+		})
+	}
+
+	withLimits(Limits{MaxTokenLength: 64, MaxDepth: 3, MaxElements: 10}, func() {
+		const ok = `<?xml version="1.0"?><datafile><game name="a"><rom name="b" size="1" crc="01020304"/></game></datafile>`
+		if _, _, err := ParseXml(strings.NewReader(ok), "testing/limits"); err != nil {
+			t.Errorf("error parsing dat within limits: %v", err)
+		}
+	})
+}
+
+func FuzzParseDat(f *testing.F) {
+	datText, err := ioutil.ReadFile("testdata/example.dat")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(string(datText))
+	f.Add(malformedDat)
+	f.Add(romCenterText)
+
+	f.Fuzz(func(t *testing.T, text string) {
+		ParseDat(strings.NewReader(text), "fuzz")
+		ParseDatLenient(strings.NewReader(text), "fuzz")
+		ParseRomCenter(strings.NewReader(text), "fuzz")
+		Detect(strings.NewReader(text))
+	})
+}
+
+func FuzzParseXml(f *testing.F) {
+	f.Add(listXMLText)
+	f.Add(softwareListText)
+	f.Add(nesSkipperText)
+
+	f.Fuzz(func(t *testing.T, text string) {
+		ParseXml(strings.NewReader(text), "fuzz")
+		ParseXmlStream(strings.NewReader(text), "fuzz", func(g *types.Game) error { return nil })
+		ParseSoftwareLists(strings.NewReader(text), "fuzz")
+		ParseDetector(strings.NewReader(text), "fuzz")
+	})
+}
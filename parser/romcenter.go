@@ -0,0 +1,198 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// RomCenter dats are INI files. Their games are the rows of the [GAMES]
+// section, a row per rom with the fields
+//
+//	¬parent name¬parent description¬game name¬game description¬rom name¬rom crc¬rom size¬romof name¬merge name¬
+const (
+	rcSeparator = "¬"
+	rcFields    = 9
+)
+
+// hasRomCenterStart reports whether the start of a dat s is that of a
+// RomCenter dat, going by its first section.
+func hasRomCenterStart(s string) bool {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	for _, section := range []string{"[CREDITS]", "[DAT]", "[EMULATOR]"} {
+		if strings.HasPrefix(s, section) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRomCenter parses the RomCenter dat in r. The dat is named after the
+// emulator it is for, its header is filled in from the credits. Roms with bad
+// CRCs are dropped, like with clrmamepro dats.
+func ParseRomCenter(r io.Reader, path string) (*types.Dat, []byte, error) {
+	hr := hashingReader{
+		ir: r,
+		h:  sha1.New(),
+	}
+
+	d := new(types.Dat)
+	games := make(map[string]*types.Game)
+
+	limits := DefaultLimits
+
+	scanner := bufio.NewScanner(newUTF8Reader(hr))
+	if limits.MaxTokenLength > 0 {
+		scanner.Buffer(nil, limits.MaxTokenLength)
+	}
+
+	section := ""
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToUpper(line[1 : len(line)-1])
+			continue
+		}
+
+		if section == "GAMES" {
+			err := limits.checkElements(ln)
+			if err == nil {
+				err = addRomCenterRow(d, games, line)
+			}
+			if err != nil {
+				return nil, nil, &ParseError{Path: path, Line: ln, Snippet: line, Err: err}
+			}
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(line[:eq])), strings.TrimSpace(line[eq+1:])
+
+		switch section + "." + key {
+		case "CREDITS.author":
+			d.Author = value
+		case "CREDITS.email":
+			d.Email = value
+		case "CREDITS.homepage":
+			d.Homepage = value
+		case "CREDITS.url":
+			d.URL = value
+		case "CREDITS.version":
+			d.Version = value
+		case "CREDITS.date":
+			d.Date = value
+		case "CREDITS.comment":
+			d.Comment = value
+		case "EMULATOR.refname":
+			d.Name = value
+		case "EMULATOR.version":
+			d.Description = value
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the rest of r counts for its SHA1
+	_, err = io.Copy(ioutil.Discard, hr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d.Normalize()
+	d.Path = path
+	return d, hr.h.Sum(nil), nil
+}
+
+// addRomCenterRow adds the rom of a row of the [GAMES] section to its game.
+func addRomCenterRow(d *types.Dat, games map[string]*types.Game, row string) error {
+	fields := strings.Split(row, rcSeparator)
+	if len(fields) < rcFields+1 || fields[0] != "" {
+		return fmt.Errorf("expected %d fields separated by %s", rcFields, rcSeparator)
+	}
+	fields = fields[1:]
+
+	parent, name, description := fields[0], fields[2], fields[3]
+	if name == "" {
+		return fmt.Errorf("game without name")
+	}
+
+	g := games[name]
+	if g == nil {
+		g = &types.Game{
+			Name:        name,
+			Description: description,
+			RomOf:       fields[7],
+		}
+		if parent != "" && parent != name {
+			g.CloneOf = parent
+		}
+		games[name] = g
+		d.Games = append(d.Games, g)
+	}
+
+	if fields[4] == "" {
+		return nil
+	}
+
+	crc, err := stringValue2Bytes(fields[5], 8)
+	if err != nil {
+		return nil
+	}
+
+	size, err := stringValue2Int(fields[6])
+	if err != nil {
+		return fmt.Errorf("bad size %q", fields[6])
+	}
+
+	g.Roms = append(g.Roms, &types.Rom{
+		Name:  fields[4],
+		Crc:   crc,
+		Size:  size,
+		Merge: fields[8],
+	})
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChecksumError is returned for dat files that don't match the checksum of
+// their sidecar file, most likely because they got corrupted downloading.
+type ChecksumError struct {
+	Path    string
+	Sidecar string
+	Want    []byte
+	Got     []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s has SHA1 %x instead of %x listed in %s", e.Path, e.Got, e.Want, e.Sidecar)
+}
+
+// sidecarPaths are the checksum files that can accompany the dat file path:
+// foo.dat.sha1 and foo.sha1.
+func sidecarPaths(path string) []string {
+	return []string{
+		path + ".sha1",
+		strings.TrimSuffix(path, filepath.Ext(path)) + ".sha1",
+	}
+}
+
+// VerifySidecar checks the dat file path against the SHA1 listed for it in
+// its sidecar file, foo.dat.sha1 or foo.sha1, if there is one. sha1Bytes is
+// the SHA1 of the file, nil to have it computed. Mismatches are returned as
+// ChecksumErrors.
+func VerifySidecar(path string, sha1Bytes []byte) error {
+	for _, sidecar := range sidecarPaths(path) {
+		want, err := sidecarSha1(sidecar, filepath.Base(path))
+		if err != nil {
+			return err
+		}
+		if want == nil {
+			continue
+		}
+
+		if sha1Bytes == nil {
+			sha1Bytes, err = fileSha1(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !bytes.Equal(want, sha1Bytes) {
+			return &ChecksumError{
+				Path:    path,
+				Sidecar: sidecar,
+				Want:    want,
+				Got:     sha1Bytes,
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// sidecarSha1 returns the SHA1 listed for the file name in the checksum file
+// sidecar, nil if it isn't listed or there is no such file. Lines are as
+// written by sha1sum, a SHA1 and a file name, or a bare SHA1 that stands for
+// any file. BSD style lines, SHA1 (name) = SHA1, are read as well.
+func sidecarSha1(sidecar, name string) ([]byte, error) {
+	file, err := os.Open(sidecar)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		var sum, listed string
+		if strings.HasPrefix(line, "SHA1 (") {
+			end := strings.LastIndex(line, ") = ")
+			if end < 0 {
+				continue
+			}
+			listed, sum = line[len("SHA1 ("):end], line[end+len(") = "):]
+		} else {
+			fields := strings.SplitN(line, " ", 2)
+			sum = fields[0]
+			if len(fields) == 2 {
+				listed = strings.TrimPrefix(strings.TrimSpace(fields[1]), "*")
+			}
+		}
+
+		if sum == "" || listed != "" && listed != name {
+			continue
+		}
+
+		want, err := hex.DecodeString(sum)
+		if err != nil || len(want) != sha1.Size {
+			return nil, fmt.Errorf("bad SHA1 %q for %s in %s", sum, name, sidecar)
+		}
+		return want, nil
+	}
+	return nil, scanner.Err()
+}
+
+func fileSha1(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha1.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
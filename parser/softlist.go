@@ -0,0 +1,226 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// softwareList is a MAME software list. Its software hold their roms in
+// parts, see types.Game.
+type softwareList struct {
+	Name        string          `xml:"name,attr"`
+	Description string          `xml:"description,attr"`
+	Software    types.GameSlice `xml:"software"`
+}
+
+// xmlRoot returns the name of the root element of the XML document in r.
+func xmlRoot(r io.Reader) (string, error) {
+	decoder := newXMLDecoder(r)
+	for {
+		t, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return se.Name.Local, nil
+		}
+	}
+}
+
+// ParseSoftwareLists parses a MAME software list, or the software lists of
+// -listsoftware output, into a dat per list named after it. A single list has
+// the SHA1 of r as its SHA1 like other dats; each of several lists has the
+// SHA1 of the SHA1 of r and its name.
+func ParseSoftwareLists(r io.Reader, path string) ([]*types.Dat, [][]byte, error) {
+	hr := hashingReader{
+		ir: bufio.NewReader(r),
+		h:  sha1.New(),
+	}
+
+	var dats []*types.Dat
+
+	decoder := newXMLDecoder(hr)
+	for {
+		t, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, xmlError(decoder, path, err)
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "softwarelist" {
+			continue
+		}
+
+		sl := new(softwareList)
+		err = decoder.DecodeElement(sl, &se)
+		if err != nil {
+			return nil, nil, xmlError(decoder, path, err)
+		}
+
+		dats = append(dats, softwareListDat(sl, path))
+	}
+
+	// the rest of r counts for its SHA1
+	_, err := io.Copy(ioutil.Discard, hr)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := hr.h.Sum(nil)
+
+	if len(dats) == 1 {
+		return dats, [][]byte{sum}, nil
+	}
+
+	sha1s := make([][]byte, len(dats))
+	for i, d := range dats {
+		h := sha1.New()
+		h.Write(sum)
+		io.WriteString(h, d.Name)
+		sha1s[i] = h.Sum(nil)
+	}
+	return dats, sha1s, nil
+}
+
+func softwareListDat(sl *softwareList, path string) *types.Dat {
+	fixGameHashes(sl.Software)
+
+	for _, g := range sl.Software {
+		dropContinuations(g)
+	}
+
+	d := &types.Dat{
+		Name:        sl.Name,
+		Description: sl.Description,
+		Software:    sl.Software,
+		Path:        path,
+	}
+	d.Normalize()
+	return d
+}
+
+// dropContinuations drops the nameless roms data areas list for the
+// continuations of roms from the parts of g.
+func dropContinuations(g *types.Game) {
+	parts := g.Parts[:0]
+	for _, rom := range g.Parts {
+		if rom.Name != "" {
+			parts = append(parts, rom)
+		}
+	}
+	g.Parts = parts
+}
+
+// ParseAll parses the dat file path like ParseLenient, except that it returns
+// a dat for each list of files with several software lists, and for each dat
+// of zip files.
+func ParseAll(path string) ([]*types.Dat, [][]byte, []*ParseError, error) {
+	return verifiedParseAll(path, parseOptions{lenient: true})
+}
+
+// ParseAllFiltered parses the dat file path like ParseAll, keeping only the
+// games keep picks. The games of clrmamepro dats are dropped as they are
+// parsed, those of other dats once they are.
+func ParseAllFiltered(path string, keep types.GameFilter) ([]*types.Dat, [][]byte, []*ParseError, error) {
+	return verifiedParseAll(path, parseOptions{lenient: true, keep: keep})
+}
+
+// verifiedParseAll is parseAll, checking path against its sidecar checksum
+// file.
+func verifiedParseAll(path string, opts parseOptions) ([]*types.Dat, [][]byte, []*ParseError, error) {
+	dats, sha1s, warnings, err := parseAll(path, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var sha1Bytes []byte
+	if len(dats) == 1 {
+		sha1Bytes = sha1s[0]
+	}
+	err = verifyParsed(path, sha1Bytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return dats, sha1s, warnings, nil
+}
+
+func parseAll(path string, opts parseOptions) ([]*types.Dat, [][]byte, []*ParseError, error) {
+	if IsContainer(path) {
+		return parseContainer(path, opts)
+	}
+
+	isXML, err := isXML(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if isXML {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer file.Close()
+
+		root, err := xmlRoot(file)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if root == "softwarelists" {
+			_, err = file.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			dats, sha1s, err := ParseSoftwareLists(file, path)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for i, dat := range dats {
+				dats[i] = opts.filter(dat)
+			}
+			return dats, sha1s, nil, nil
+		}
+	}
+
+	dat, sha1Bytes, warnings, err := parseLenient(path, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return []*types.Dat{dat}, [][]byte{sha1Bytes}, warnings, nil
+}
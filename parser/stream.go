@@ -0,0 +1,183 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package parser
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// GameFunc is called by ParseXmlStream with each game of a dat.
+type GameFunc func(g *types.Game) error
+
+// xmlHeader is the header of a Logiqx dat, see types.Dat.
+type xmlHeader struct {
+	Name        string `xml:"name"`
+	Description string `xml:"description"`
+	Category    string `xml:"category"`
+	Version     string `xml:"version"`
+	Date        string `xml:"date"`
+	Author      string `xml:"author"`
+	Email       string `xml:"email"`
+	Homepage    string `xml:"homepage"`
+	URL         string `xml:"url"`
+	Comment     string `xml:"comment"`
+}
+
+// ParseXmlStream parses the XML dat in r like ParseXml, except that its games
+// are passed to fn one at a time, normalized, as they are decoded instead of
+// being collected. The returned dat only holds the header. Parsing stops at
+// the first error returned by fn.
+//
+// The games of a dat in one software list are streamed too, dats with several
+// lists are rejected.
+func ParseXmlStream(r io.Reader, path string, fn GameFunc) (*types.Dat, []byte, error) {
+	return parseXmlStream(r, path, parseOptions{}, fn)
+}
+
+// parseXmlStream is ParseXmlStream, recording the spans of games if asked to.
+// Only the spans option applies.
+func parseXmlStream(r io.Reader, path string, opts parseOptions, fn GameFunc) (*types.Dat, []byte, error) {
+	hr := hashingReader{
+		ir: bufio.NewReader(r),
+		h:  sha1.New(),
+	}
+
+	d := &types.Dat{Path: path}
+	lists := 0
+
+	ur := newUTF8Reader(hr)
+	decoder := utf8XMLDecoder(ur)
+	for {
+		start := decoder.InputOffset()
+		t, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, xmlError(decoder, path, err)
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch se.Name.Local {
+		case "softwarelist":
+			lists++
+			if lists > 1 {
+				return nil, nil, fmt.Errorf("%s holds several software lists", path)
+			}
+			for _, attr := range se.Attr {
+				switch attr.Name.Local {
+				case "name":
+					d.Name = attr.Value
+				case "description":
+					d.Description = attr.Value
+				}
+			}
+		case "header":
+			hdr := new(xmlHeader)
+			err = decoder.DecodeElement(hdr, &se)
+			if err != nil {
+				return nil, nil, xmlError(decoder, path, err)
+			}
+			d.Name = hdr.Name
+			d.Description = hdr.Description
+			d.Category = hdr.Category
+			d.Version = hdr.Version
+			d.Date = hdr.Date
+			d.Author = hdr.Author
+			d.Email = hdr.Email
+			d.Homepage = hdr.Homepage
+			d.URL = hdr.URL
+			d.Comment = hdr.Comment
+		case "game", "machine", "software":
+			g := new(types.Game)
+			err = decoder.DecodeElement(g, &se)
+			if err != nil {
+				return nil, nil, xmlError(decoder, path, err)
+			}
+			fixGameHashes(types.GameSlice{g})
+			dropContinuations(g)
+			g.Normalize()
+			if opts.spans {
+				if !ur.exact {
+					return nil, nil, fmt.Errorf("%s is not UTF-8, spans of games can't be recorded", path)
+				}
+				g.Span = &types.Span{
+					Start: ur.bom + start,
+					End:   ur.bom + decoder.InputOffset(),
+				}
+			}
+
+			err = fn(g)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// the rest of r counts for its SHA1
+	_, err := io.Copy(ioutil.Discard, hr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, hr.h.Sum(nil), nil
+}
+
+// Streamable reports whether the dat file path can be parsed by
+// ParseXmlStream.
+func Streamable(path string) (bool, error) {
+	isXML, err := isXML(path)
+	if err != nil || !isXML {
+		return false, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	root, err := xmlRoot(file)
+	if err != nil {
+		return false, err
+	}
+	return root != "softwarelists", nil
+}
@@ -34,7 +34,6 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
 	"runtime"
 
 	"github.com/uwedeportivo/romba/parser"
@@ -72,8 +71,7 @@ func (pw *parseWorker) Close() error {
 type parseMaster struct{}
 
 func (pm *parseMaster) Accept(path string) bool {
-	ext := filepath.Ext(path)
-	return ext == ".dat" || ext == ".xml"
+	return parser.IsDatFile(path)
 }
 
 func (pm *parseMaster) NewWorker(workerIndex int) worker.Worker {
@@ -92,7 +90,9 @@ func (pm *parseMaster) Start() error {
 	return nil
 }
 
-func (pm *parseMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+func (pm *parseMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	return nil
+}
 
 func (pm *parseMaster) ProgressTracker() worker.ProgressTracker {
 	return worker.NewProgressTracker()
@@ -0,0 +1,391 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package replica keeps a secondary romba's depot in step with this one, over
+// the HTTP API of the secondary:
+//
+//	GET    /api/replica/manifest            the depot manifest, one JSON
+//	                                        archive.ManifestEntry per line
+//	HEAD   /api/replica/uploads/<file>      200 if the depot has the rom of
+//	                                        the depot file, else 204 with the
+//	                                        received length as Upload-Offset
+//	PUT    /api/replica/uploads/<file>      append the body at Upload-Offset
+//	                                        to the depot file of Upload-Length
+//	                                        bytes
+//	DELETE /api/replica/roms/<sha1>         remove the rom from the depot
+//
+// Depot files are named after their SHA1 with the suffix of their
+// compression. A PUT at the wrong offset answers 409 Conflict with the
+// received length, so an interrupted upload resumes where it stopped. The
+// PUT completing a file answers 201 Created once its contents are checked
+// against its name and it is added to the depot, or 422 Unprocessable Entity
+// if they don't match, in which case the received data is dropped. Depot files
+// longer than MaxUploadLength are refused with 413 Request Entity Too Large,
+// and uploads not resumed within UploadExpiry are dropped. A DELETE
+// of a rom kept for a pinned dat answers 409 Conflict.
+package replica
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/logging"
+)
+
+var logger = logging.For("replica")
+
+const (
+	offsetHeader = "Upload-Offset"
+	lengthHeader = "Upload-Length"
+)
+
+// MaxUploadLength is the size of the largest depot file received.
+var MaxUploadLength int64 = 64 << 30
+
+// UploadExpiry is how long a partial upload is kept without being resumed.
+var UploadExpiry = 24 * time.Hour
+
+type handler struct {
+	depot         *archive.Depot
+	acceptDeletes bool
+
+	mutex   sync.Mutex
+	uploads map[string]*uploadLock
+}
+
+// uploadLock serializes the requests for a depot file, so a retried chunk
+// can't interleave with one still being received. It is dropped once no
+// request holds it, the state of an upload being its partial file.
+type uploadLock struct {
+	sync.Mutex
+	// refs counts the requests holding or waiting for the lock, under
+	// handler.mutex
+	refs int
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// DeleteReply is the answer to DELETE /api/replica/roms/<sha1>.
+type DeleteReply struct {
+	Removed int `json:"removed"`
+}
+
+// NewHandler returns the handler receiving replicated depot files into depot,
+// to be mounted at /api/replica/. Deletions are refused with 403 Forbidden
+// unless acceptDeletes is set.
+func NewHandler(depot *archive.Depot, acceptDeletes bool) http.Handler {
+	h := &handler{
+		depot:         depot,
+		acceptDeletes: acceptDeletes,
+		uploads:       make(map[string]*uploadLock),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/replica/manifest", h.handleManifest)
+	mux.HandleFunc("/api/replica/uploads/", h.handleUpload)
+	mux.HandleFunc("/api/replica/roms/", h.handleRom)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Errorf("error writing replica reply: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &apiError{Error: err.Error()})
+}
+
+func notAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+}
+
+// acquireUpload returns the lock of the depot file name, held or waited for
+// by the caller until it calls releaseUpload, after unlocking it.
+func (h *handler) acquireUpload(name string) *uploadLock {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ul, ok := h.uploads[name]
+	if !ok {
+		ul = new(uploadLock)
+		h.uploads[name] = ul
+	}
+	ul.refs++
+	return ul
+}
+
+// releaseUpload drops the lock of the depot file name once no other request
+// holds it.
+func (h *handler) releaseUpload(name string, ul *uploadLock) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ul.refs--
+	if ul.refs == 0 {
+		delete(h.uploads, name)
+	}
+}
+
+// expireUploads drops the partial uploads not resumed within UploadExpiry.
+func (h *handler) expireUploads() {
+	names, err := h.depot.StaleUploads(UploadExpiry)
+	if err != nil {
+		logger.Errorf("error listing partial uploads: %v", err)
+		return
+	}
+
+	for _, name := range names {
+		ul := h.acquireUpload(name)
+		if !ul.TryLock() {
+			// being received right now
+			h.releaseUpload(name, ul)
+			continue
+		}
+		path, err := h.depot.UploadPath(name)
+		if err == nil {
+			err = os.Remove(path)
+		}
+		ul.Unlock()
+		h.releaseUpload(name, ul)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Errorf("error removing abandoned upload %s: %v", name, err)
+			continue
+		}
+		logger.Infof("removed abandoned upload %s", name)
+	}
+}
+
+func (h *handler) handleManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		notAllowed(w, r, "GET")
+		return
+	}
+
+	// every push starts here, a good time to drop the uploads of earlier
+	// ones that never finished
+	h.expireUploads()
+
+	_, err := h.depot.UpdateManifest("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	err = h.depot.Manifest("", func(root string, me *archive.ManifestEntry) {
+		if err == nil {
+			err = enc.Encode(me)
+		}
+	})
+	if err != nil {
+		logger.Errorf("error sending depot manifest: %v", err)
+	}
+}
+
+// uploadedLength returns how many bytes of the upload at path were received.
+func uploadedLength(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// have reports whether the depot has the rom of the depot file name.
+func (h *handler) have(name string) (bool, error) {
+	rompath, err := h.depot.RomPath(strings.TrimSuffix(name, filepath.Ext(name)))
+	return rompath != "", err
+}
+
+func (h *handler) handleUpload(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/replica/uploads/")
+
+	path, err := h.depot.UploadPath(name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if r.Method != "HEAD" && r.Method != "PUT" {
+		notAllowed(w, r, "HEAD, PUT")
+		return
+	}
+
+	ul := h.acquireUpload(name)
+	ul.Lock()
+	defer h.releaseUpload(name, ul)
+	defer ul.Unlock()
+
+	have, err := h.have(name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if have {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	offset, err := uploadedLength(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if r.Method == "HEAD" {
+		w.Header().Set(offsetHeader, strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h.receiveChunk(w, r, name, path, offset)
+}
+
+func (h *handler) receiveChunk(w http.ResponseWriter, r *http.Request, name, path string, offset int64) {
+	at, err := strconv.ParseInt(r.Header.Get(offsetHeader), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad %s header: %v", offsetHeader, err))
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get(lengthHeader), 10, 64)
+	if err != nil || length <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad %s header %q", lengthHeader, r.Header.Get(lengthHeader)))
+		return
+	}
+	if length > MaxUploadLength {
+		writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("%s of %d bytes is longer than the %d accepted", name, length, MaxUploadLength))
+		return
+	}
+
+	if at != offset {
+		w.Header().Set(offsetHeader, strconv.FormatInt(offset, 10))
+		writeError(w, http.StatusConflict, fmt.Errorf("upload of %s is at offset %d, not %d", name, offset, at))
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// whatever arrives before an error is kept, the client resumes after it
+	n, err := io.Copy(file, io.LimitReader(r.Body, length-offset))
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	offset += n
+	if err != nil {
+		w.Header().Set(offsetHeader, strconv.FormatInt(offset, 10))
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if offset < length {
+		w.Header().Set(offsetHeader, strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	added, err := h.depot.ReceiveUpload(path)
+	if err != nil {
+		logger.Errorf("rejected replicated depot file %s: %v", name, err)
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if added {
+		logger.V(2).Infof("received replicated depot file %s", name)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *handler) handleRom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		notAllowed(w, r, "DELETE")
+		return
+	}
+
+	if !h.acceptDeletes {
+		writeError(w, http.StatusForbidden, fmt.Errorf("this depot doesn't accept deletions"))
+		return
+	}
+
+	sha1Hex := strings.TrimPrefix(r.URL.Path, "/api/replica/roms/")
+	sha1Bytes, err := hex.DecodeString(sha1Hex)
+	if err != nil || len(sha1Bytes) != sha1.Size {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%q is not a SHA1", sha1Hex))
+		return
+	}
+
+	n, err := h.depot.RemoveRom(sha1Hex)
+	if err == archive.ErrPinned {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Infof("removed %d depot files of %s on request of the primary", n, sha1Hex)
+	writeJSON(w, http.StatusOK, &DeleteReply{Removed: n})
+}
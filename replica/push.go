@@ -0,0 +1,483 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package replica
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// What Push does with roms only the remote depot has.
+const (
+	// KeepExtras leaves them alone.
+	KeepExtras = "keep"
+	// ReportExtras lists them in the report.
+	ReportExtras = "report"
+	// DeleteExtras removes them from the remote depot, which has to accept
+	// deletions.
+	DeleteExtras = "delete"
+)
+
+// DefaultChunkSize is the size of the pieces depot files are uploaded in.
+const DefaultChunkSize = 8 << 20
+
+const (
+	maxRetries = 5
+	retryDelay = 2 * time.Second
+)
+
+// MaxExtrasFraction is the part of the remote depot Push deletes at most
+// without Options.Force. More extras than that usually mean the wrong depot
+// or remote was given rather than roms to be dropped.
+const MaxExtrasFraction = 0.1
+
+// Options controls a replication run.
+type Options struct {
+	// Remote is the address of the secondary romba, host:port or a URL.
+	Remote string
+	// Deletions is the policy for roms only the remote depot has, one of
+	// KeepExtras, ReportExtras and DeleteExtras. KeepExtras if empty.
+	Deletions string
+	// ChunkSize is the size of the upload requests, DefaultChunkSize if 0.
+	ChunkSize int64
+	// Client makes the requests, http.DefaultClient if nil.
+	Client *http.Client
+	// Force deletes the extras even if the local depot is empty or they are
+	// more than MaxExtrasFraction of the remote depot.
+	Force bool
+	// Token is sent as bearer token to remotes with users, see package
+	// auth. Uploads need an operator, deletions an admin.
+	Token string
+}
+
+// Report sums up a replication run.
+type Report struct {
+	// Local and Remote are the numbers of roms in each depot before the run.
+	Local  int
+	Remote int
+	// Uploaded counts the depot files sent, UploadedBytes their size.
+	Uploaded      int
+	UploadedBytes int64
+	// Present counts the files the remote found it had when they were
+	// about to be sent.
+	Present int
+	// Failed lists the SHA1s of the roms that couldn't be sent.
+	Failed []string
+	// Extras lists the SHA1s of the roms only the remote depot has, unless
+	// they are kept.
+	Extras []string
+	// Deleted counts the extras removed from the remote depot, Pinned
+	// those it kept for its pinned dats.
+	Deleted int
+	Pinned  int
+}
+
+func (r *Report) String() string {
+	s := fmt.Sprintf("replicated %d roms to remote depot with %d: uploaded %d files (%s), %d already present, %d failed",
+		r.Local, r.Remote, r.Uploaded, humanize.Bytes(uint64(r.UploadedBytes)), r.Present, len(r.Failed))
+	if len(r.Extras) > 0 {
+		s += fmt.Sprintf(", %d only in remote depot, %d of them deleted", len(r.Extras), r.Deleted)
+		if r.Pinned > 0 {
+			s += fmt.Sprintf(", %d kept for pinned dats", r.Pinned)
+		}
+	}
+	return s
+}
+
+type pusher struct {
+	depot     *archive.Depot
+	base      string
+	client    *http.Client
+	chunkSize int64
+	token     string
+}
+
+func (p *pusher) url(elem ...string) string {
+	return p.base + path.Join(append([]string{"/api/replica"}, elem...)...)
+}
+
+// newRequest returns a request for the replica URL of elem, with the token
+// if set.
+func (p *pusher) newRequest(method string, body io.Reader, elem ...string) (*http.Request, error) {
+	req, err := http.NewRequest(method, p.url(elem...), body)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	return req, nil
+}
+
+// replyError turns an unexpected reply into an error.
+func replyError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var apiErr apiError
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+		return fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
+
+// remoteManifest returns the SHA1s of the roms in the remote depot.
+func (p *pusher) remoteManifest() (map[string]bool, error) {
+	req, err := p.newRequest("GET", nil, "manifest")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting remote manifest failed: %v", replyError(resp))
+	}
+
+	remote := make(map[string]bool)
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		me := new(archive.ManifestEntry)
+		err := dec.Decode(me)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading remote manifest failed: %v", err)
+		}
+		remote[me.Sha1] = true
+	}
+	return remote, nil
+}
+
+// remoteOffset returns how much of the depot file name the remote has
+// received, or -1 if it has the rom already.
+func (p *pusher) remoteOffset(name string) (int64, error) {
+	req, err := p.newRequest("HEAD", nil, "uploads", name)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return -1, nil
+	case http.StatusNoContent:
+		return strconv.ParseInt(resp.Header.Get(offsetHeader), 10, 64)
+	}
+	return 0, fmt.Errorf("%s", resp.Status)
+}
+
+// sendChunk sends the chunk of file at offset and returns the offset to
+// continue at, or -1 once the remote has the rom.
+func (p *pusher) sendChunk(name string, file *os.File, offset, length int64) (int64, error) {
+	n := length - offset
+	if n > p.chunkSize {
+		n = p.chunkSize
+	}
+
+	req, err := p.newRequest("PUT", io.NewSectionReader(file, offset, n), "uploads", name)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = n
+	req.Header.Set(offsetHeader, strconv.FormatInt(offset, 10))
+	req.Header.Set(lengthHeader, strconv.FormatInt(length, 10))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return -1, nil
+	case http.StatusNoContent, http.StatusConflict:
+		return strconv.ParseInt(resp.Header.Get(offsetHeader), 10, 64)
+	case http.StatusUnprocessableEntity:
+		return 0, &verifyError{replyError(resp)}
+	}
+	return 0, replyError(resp)
+}
+
+// verifyError is the remote rejecting a depot file, which is not retried.
+type verifyError struct {
+	err error
+}
+
+func (e *verifyError) Error() string {
+	return "remote rejected depot file: " + e.err.Error()
+}
+
+// upload sends the depot file at inpath, resuming after what the remote
+// already received and retrying after network errors. It reports whether the
+// file was sent, as opposed to found in the remote depot.
+func (p *pusher) upload(inpath string) (bool, error) {
+	name := filepath.Base(inpath)
+
+	file, err := os.Open(inpath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	length := fi.Size()
+
+	offset, err := p.remoteOffset(name)
+	retries := 0
+	for {
+		if err == nil {
+			if offset < 0 {
+				return false, nil
+			}
+			if offset > length {
+				return false, fmt.Errorf("remote has %d bytes of %s, more than its %d", offset, name, length)
+			}
+
+			var next int64
+			next, err = p.sendChunk(name, file, offset, length)
+			if err == nil {
+				if next < 0 {
+					return true, nil
+				}
+				if next > offset {
+					retries = 0
+				}
+				offset = next
+				continue
+			}
+		}
+
+		if _, ok := err.(*verifyError); ok || retries >= maxRetries {
+			return false, err
+		}
+		retries++
+		logger.Warningf("uploading %s failed, retrying: %v", name, err)
+		time.Sleep(retryDelay)
+
+		offset, err = p.remoteOffset(name)
+	}
+}
+
+// errRemotePinned tells that the remote kept a rom for one of its pinned
+// dats.
+var errRemotePinned = errors.New("rom is pinned in the remote depot")
+
+func (p *pusher) deleteRemote(sha1Hex string) error {
+	req, err := p.newRequest("DELETE", nil, "roms", sha1Hex)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return errRemotePinned
+	}
+	if resp.StatusCode != http.StatusOK {
+		return replyError(resp)
+	}
+	return nil
+}
+
+// Push replicates depot to the secondary romba at opts.Remote: the manifests
+// of both depots are compared, the depot files of the roms the remote is
+// missing are uploaded and checked by the remote, and the roms only the
+// remote has are dealt with according to opts.Deletions.
+func Push(depot *archive.Depot, opts *Options, pt worker.ProgressTracker) (*Report, error) {
+	deletions := opts.Deletions
+	switch deletions {
+	case "":
+		deletions = KeepExtras
+	case KeepExtras, ReportExtras, DeleteExtras:
+	default:
+		return nil, fmt.Errorf("unknown deletion policy %q", deletions)
+	}
+
+	p := &pusher{
+		depot:     depot,
+		base:      strings.TrimSuffix(opts.Remote, "/"),
+		client:    opts.Client,
+		chunkSize: opts.ChunkSize,
+		token:     opts.Token,
+	}
+	if !strings.Contains(p.base, "://") {
+		p.base = "http://" + p.base
+	}
+	if p.client == nil {
+		p.client = http.DefaultClient
+	}
+	if p.chunkSize <= 0 {
+		p.chunkSize = DefaultChunkSize
+	}
+
+	_, err := depot.UpdateManifest("")
+	if err != nil {
+		return nil, err
+	}
+
+	local := make(map[string]string)
+	err = depot.Manifest("", func(root string, me *archive.ManifestEntry) {
+		local[me.Sha1] = filepath.Join(root, filepath.FromSlash(me.Path))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := p.remoteManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Local:  len(local),
+		Remote: len(remote),
+	}
+
+	if deletions != KeepExtras {
+		for sha1Hex := range remote {
+			if _, ok := local[sha1Hex]; !ok {
+				report.Extras = append(report.Extras, sha1Hex)
+			}
+		}
+		sort.Strings(report.Extras)
+	}
+
+	if deletions == DeleteExtras && !opts.Force {
+		if len(local) == 0 && len(remote) > 0 {
+			return nil, fmt.Errorf("refusing to delete all %d roms of the remote depot, the local depot is empty", len(remote))
+		}
+		if float64(len(report.Extras)) > MaxExtrasFraction*float64(len(remote)) {
+			return nil, fmt.Errorf("refusing to delete %d of the %d roms of the remote depot, more than %.0f%% of them",
+				len(report.Extras), len(remote), MaxExtrasFraction*100)
+		}
+	}
+
+	var missing []string
+	var missingBytes int64
+	for sha1Hex, inpath := range local {
+		if remote[sha1Hex] {
+			continue
+		}
+		missing = append(missing, sha1Hex)
+		if fi, err := os.Stat(inpath); err == nil {
+			missingBytes += fi.Size()
+		}
+	}
+	sort.Strings(missing)
+
+	pt.SetTotalFiles(int32(len(missing)))
+	pt.SetTotalBytes(missingBytes)
+
+	for _, sha1Hex := range missing {
+		inpath := local[sha1Hex]
+
+		var size int64
+		if fi, err := os.Stat(inpath); err == nil {
+			size = fi.Size()
+		}
+
+		sent, err := p.upload(inpath)
+		pt.AddBytesFromFile(size)
+		if err != nil {
+			logger.Errorf("failed to replicate %s: %v", inpath, err)
+			report.Failed = append(report.Failed, sha1Hex)
+			continue
+		}
+		if sent {
+			report.Uploaded++
+			report.UploadedBytes += size
+		} else {
+			report.Present++
+		}
+	}
+
+	if deletions == DeleteExtras {
+		for _, sha1Hex := range report.Extras {
+			err = p.deleteRemote(sha1Hex)
+			if err == errRemotePinned {
+				report.Pinned++
+				continue
+			}
+			if err != nil {
+				return report, fmt.Errorf("deleting %s from remote depot failed: %v", sha1Hex, err)
+			}
+			report.Deleted++
+		}
+	}
+	return report, nil
+}
+
+// WriteExtras writes the SHA1s of the roms only the remote depot has to w,
+// one per line.
+func (r *Report) WriteExtras(w io.Writer) error {
+	var buf bytes.Buffer
+	for _, sha1Hex := range r.Extras {
+		buf.WriteString(sha1Hex)
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,392 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package replica
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// replicaTestDB accepts every rom and knows no dats
+type replicaTestDB struct {
+	db.RomDB
+}
+
+func (rdb *replicaTestDB) IndexRom(rom *types.Rom) error {
+	return nil
+}
+
+func (rdb *replicaTestDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	return nil, nil
+}
+
+func (rdb *replicaTestDB) CompleteRom(rom *types.Rom) error {
+	return nil
+}
+
+// newTestDepot returns a depot in dir holding the roms with the given
+// contents.
+func newTestDepot(t *testing.T, dir string, roms ...string) *archive.Depot {
+	depotRoot := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	for _, d := range []string{depotRoot, srcDir} {
+		err := os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, contents := range roms {
+		err := ioutil.WriteFile(filepath.Join(srcDir, strconv.Itoa(i)+".bin"), []byte(contents), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, &replicaTestDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, &archive.ArchiveOptions{}, 1, dir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return depot
+}
+
+func sha1Hex(contents string) string {
+	sum := sha1.Sum([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
+
+func hasRom(t *testing.T, depot *archive.Depot, contents string) bool {
+	rompath, err := depot.RomPath(sha1Hex(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rompath != ""
+}
+
+func put(t *testing.T, url string, body []byte, offset, length int64) *http.Response {
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(offsetHeader, strconv.FormatInt(offset, 10))
+	req.Header.Set(lengthHeader, strconv.FormatInt(length, 10))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestPush(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-replica-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	roms := []string{"first rom", "second rom, a bit longer than the first", "third rom"}
+	extra := "rom only the secondary has"
+
+	primary := newTestDepot(t, filepath.Join(root, "primary"), roms...)
+	secondary := newTestDepot(t, filepath.Join(root, "secondary"), roms[2], extra)
+
+	server := httptest.NewServer(NewHandler(secondary, false))
+	defer server.Close()
+
+	// an interrupted upload of the second rom
+	partial, err := primary.RomPath(sha1Hex(roms[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadURL := server.URL + "/api/replica/uploads/" + filepath.Base(partial)
+	resp := put(t, uploadURL, data[:10], 0, int64(len(data)))
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get(offsetHeader) != "10" {
+		t.Fatalf("partial upload answered %s with offset %q", resp.Status, resp.Header.Get(offsetHeader))
+	}
+	resp = put(t, uploadURL, data[20:], 20, int64(len(data)))
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get(offsetHeader) != "10" {
+		t.Errorf("upload at wrong offset answered %s with offset %q", resp.Status, resp.Header.Get(offsetHeader))
+	}
+
+	report, err := Push(primary, &Options{Remote: server.URL, ChunkSize: 16, Deletions: ReportExtras},
+		worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Local != 3 || report.Remote != 2 || report.Uploaded != 2 || len(report.Failed) != 0 {
+		t.Errorf("unexpected report %v", report)
+	}
+	if len(report.Extras) != 1 || report.Extras[0] != sha1Hex(extra) || report.Deleted != 0 {
+		t.Errorf("got extras %v, deleted %d", report.Extras, report.Deleted)
+	}
+	for _, contents := range roms {
+		if !hasRom(t, secondary, contents) {
+			t.Errorf("rom %q not replicated", contents)
+		}
+	}
+
+	// the extra is a quarter of the secondary's roms
+	_, err = Push(primary, &Options{Remote: server.URL, Deletions: DeleteExtras}, worker.NewProgressTracker())
+	if err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Errorf("got error %v deleting many extras without -force", err)
+	}
+	empty := newTestDepot(t, filepath.Join(root, "empty"))
+	_, err = Push(empty, &Options{Remote: server.URL, Deletions: DeleteExtras}, worker.NewProgressTracker())
+	if err == nil || !strings.Contains(err.Error(), "local depot is empty") {
+		t.Errorf("got error %v deleting from an empty depot", err)
+	}
+
+	_, err = Push(primary, &Options{Remote: server.URL, Deletions: DeleteExtras, Force: true}, worker.NewProgressTracker())
+	if err == nil {
+		t.Errorf("deletion accepted by secondary refusing them")
+	}
+	if !hasRom(t, secondary, extra) {
+		t.Errorf("extra rom deleted by secondary refusing deletions")
+	}
+
+	server.Config.Handler = NewHandler(secondary, true)
+	report, err = Push(primary, &Options{Remote: server.URL, Deletions: DeleteExtras, Force: true},
+		worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Uploaded != 0 || report.Deleted != 1 {
+		t.Errorf("unexpected report %v", report)
+	}
+	if hasRom(t, secondary, extra) {
+		t.Errorf("extra rom not deleted")
+	}
+}
+
+func TestPushTLS(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-replica-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	primary := newTestDepot(t, filepath.Join(root, "primary"), "a rom")
+	secondary := newTestDepot(t, filepath.Join(root, "secondary"))
+
+	const token = "0123456789abcdef"
+	handler := NewHandler(secondary, false)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "token missing", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	_, err = Push(primary, &Options{Remote: server.URL}, worker.NewProgressTracker())
+	if err == nil {
+		t.Errorf("pushed to a server with an unknown certificate")
+	}
+	_, err = Push(primary, &Options{Remote: server.URL, Client: server.Client()}, worker.NewProgressTracker())
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("got error %v pushing without token", err)
+	}
+
+	report, err := Push(primary, &Options{Remote: server.URL, Client: server.Client(), Token: token},
+		worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Uploaded != 1 || !hasRom(t, secondary, "a rom") {
+		t.Errorf("unexpected report %v", report)
+	}
+}
+
+func TestUploadVerified(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-replica-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	primary := newTestDepot(t, filepath.Join(root, "primary"), "a rom")
+	secondary := newTestDepot(t, filepath.Join(root, "secondary"))
+
+	server := httptest.NewServer(NewHandler(secondary, false))
+	defer server.Close()
+
+	rompath, err := primary.RomPath(sha1Hex("a rom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(rompath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the depot file of one rom under the name of another
+	wrongName := sha1Hex("another rom") + filepath.Ext(rompath)
+	resp := put(t, server.URL+"/api/replica/uploads/"+wrongName, data, 0, int64(len(data)))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("mismatching upload answered %s", resp.Status)
+	}
+	if hasRom(t, secondary, "another rom") {
+		t.Errorf("mismatching upload added to depot")
+	}
+
+	resp = put(t, server.URL+"/api/replica/uploads/not-a-depot-file", data, 0, int64(len(data)))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("upload with bad name answered %s", resp.Status)
+	}
+
+	resp = put(t, server.URL+"/api/replica/uploads/"+filepath.Base(rompath), data, 0, int64(len(data)))
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload answered %s", resp.Status)
+	}
+	if !hasRom(t, secondary, "a rom") {
+		t.Errorf("upload not added to depot")
+	}
+}
+
+func TestUploadLocksDropped(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-replica-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	primary := newTestDepot(t, filepath.Join(root, "primary"), "a rom", "another rom")
+	secondary := newTestDepot(t, filepath.Join(root, "secondary"), "another rom")
+
+	h := &handler{depot: secondary, uploads: make(map[string]*uploadLock)}
+	server := httptest.NewServer(http.HandlerFunc(h.handleUpload))
+	defer server.Close()
+
+	var urls []string
+	for _, contents := range []string{"a rom", "another rom"} {
+		rompath, err := primary.RomPath(sha1Hex(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, server.URL+"/api/replica/uploads/"+filepath.Base(rompath))
+	}
+
+	// probing a missing and a present depot file, then a partial upload
+	for _, url := range urls {
+		resp, err := http.Head(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	resp := put(t, urls[0], []byte("some"), 0, 100)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("partial upload answered %s", resp.Status)
+	}
+
+	if len(h.uploads) != 0 {
+		t.Errorf("%d upload locks kept after the requests", len(h.uploads))
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-replica-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	secondary := newTestDepot(t, filepath.Join(root, "secondary"))
+
+	server := httptest.NewServer(NewHandler(secondary, false))
+	defer server.Close()
+
+	name := sha1Hex("a rom") + ".gz"
+	resp := put(t, server.URL+"/api/replica/uploads/"+name, []byte("some"), 0, MaxUploadLength+1)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("overlong upload answered %s", resp.Status)
+	}
+
+	resp = put(t, server.URL+"/api/replica/uploads/"+name, []byte("some"), 0, 100)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("partial upload answered %s", resp.Status)
+	}
+	path, err := secondary.UploadPath(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getManifest := func() {
+		resp, err := http.Get(server.URL + "/api/replica/manifest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	getManifest()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("fresh partial upload dropped: %v", err)
+	}
+
+	old := time.Now().Add(-2 * UploadExpiry)
+	err = os.Chtimes(path, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getManifest()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("abandoned partial upload kept: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package romfs
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// cacheEntry is the decompressed contents of a rom, kept in a file of the
+// cache directory.
+type cacheEntry struct {
+	key     string
+	file    *os.File
+	size    int64
+	refs    int
+	lastUse time.Time
+	// ready is closed once the contents are in place or failed with err
+	ready chan struct{}
+	err   error
+}
+
+// ReadAt reads from the contents of the rom.
+func (e *cacheEntry) ReadAt(p []byte, off int64) (int, error) {
+	return e.file.ReadAt(p, off)
+}
+
+// cache materializes roms from the depot into files of dir. Roms not in use
+// are removed, least recently used first, once the cache holds more than max
+// bytes.
+type cache struct {
+	dir  string
+	max  int64
+	open func(rom *types.Rom) (io.ReadCloser, error)
+
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+}
+
+func newCache(dir string, max int64, open func(rom *types.Rom) (io.ReadCloser, error)) *cache {
+	return &cache{
+		dir:     dir,
+		max:     max,
+		open:    open,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// acquire returns the contents of rom, materializing them if they aren't in
+// the cache. Opens of the same rom wait for the first to finish.
+func (c *cache) acquire(rom *types.Rom) (*cacheEntry, error) {
+	key := hex.EncodeToString(rom.Sha1)
+
+	c.lock.Lock()
+	e := c.entries[key]
+	if e != nil {
+		e.refs++
+		c.lock.Unlock()
+
+		<-e.ready
+		if e.err != nil {
+			c.release(e)
+			return nil, e.err
+		}
+		return e, nil
+	}
+
+	e = &cacheEntry{
+		key:   key,
+		refs:  1,
+		ready: make(chan struct{}),
+	}
+	c.entries[key] = e
+	c.lock.Unlock()
+
+	file, size, err := c.materialize(rom, key)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e.file, e.size, e.err = file, size, err
+	close(e.ready)
+
+	if e.err != nil {
+		// let later opens try again
+		delete(c.entries, key)
+		e.refs--
+		return nil, e.err
+	}
+
+	c.size += e.size
+	e.lastUse = time.Now()
+	c.evict()
+	return e, nil
+}
+
+func (c *cache) materialize(rom *types.Rom, key string) (*os.File, int64, error) {
+	rc, err := c.open(rom)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rc == nil {
+		return nil, 0, os.ErrNotExist
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile(c.dir, key+".tmp")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := io.Copy(tmp, rc)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+
+	path := filepath.Join(c.dir, key)
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// release gives back contents returned by acquire.
+func (c *cache) release(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e.refs--
+	e.lastUse = time.Now()
+	c.evict()
+}
+
+// evict removes roms not in use until the cache fits. Must be called with
+// c.lock held.
+func (c *cache) evict() {
+	for c.size > c.max {
+		var oldest *cacheEntry
+		for _, e := range c.entries {
+			if e.refs > 0 || e.file == nil {
+				continue
+			}
+			if oldest == nil || e.lastUse.Before(oldest.lastUse) {
+				oldest = e
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		c.remove(oldest)
+	}
+}
+
+func (c *cache) remove(e *cacheEntry) {
+	e.file.Close()
+	os.Remove(e.file.Name())
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+// close removes all roms from the cache.
+func (c *cache) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, e := range c.entries {
+		if e.file != nil {
+			c.remove(e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package romfs presents the indexed dats as a read-only filesystem, so
+// emulators can read sets without building them first. The dats directory is
+// mirrored with a directory for each dat file, holding a directory for each
+// game with the roms of the game the depot has. Dat files with several dats,
+// like zipped software lists, get a directory for each dat in between.
+// Everything is loaded when first looked at. Rom contents are decompressed
+// from the depot into a cache directory when a rom is opened.
+package romfs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/logging"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+var logger = logging.For("romfs")
+
+// node is a file or directory of the filesystem.
+type node struct {
+	ino     uint64
+	name    string
+	dir     bool
+	size    int64
+	modTime time.Time
+	// rom is what a file holds
+	rom *types.Rom
+
+	// load lists a directory, it is called on first use and again after
+	// the directory was unloaded
+	load     func() ([]*node, error)
+	loadLock sync.Mutex
+	loaded   bool
+	loadErr  error
+	children []*node
+	byName   map[string]*node
+}
+
+// FS is the tree of dats, games and roms.
+type FS struct {
+	romDB db.RomDB
+	depot *archive.Depot
+	cache *cache
+	root  *node
+
+	lock    sync.Mutex
+	lastIno uint64
+}
+
+// New returns the filesystem of the dats below datsDir, with rom contents from
+// depot. Opened roms are kept in cacheDir, which is trimmed to maxCache bytes
+// of roms not in use.
+func New(datsDir string, romDB db.RomDB, depot *archive.Depot, cacheDir string, maxCache int64) *FS {
+	fs := &FS{
+		romDB: romDB,
+		depot: depot,
+		cache: newCache(cacheDir, maxCache, depot.OpenDatRom),
+	}
+
+	fs.root = fs.newNode("", true, time.Now())
+	fs.root.load = fs.dirLoader(datsDir)
+	return fs
+}
+
+func (fs *FS) newNode(name string, dir bool, modTime time.Time) *node {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.lastIno++
+	return &node{
+		ino:     fs.lastIno,
+		name:    name,
+		dir:     dir,
+		modTime: modTime,
+	}
+}
+
+// children lists the directory n, loading it on first use.
+func (fs *FS) children(n *node) ([]*node, error) {
+	if !n.dir {
+		return nil, fmt.Errorf("%s is not a directory", n.name)
+	}
+
+	n.loadLock.Lock()
+	defer n.loadLock.Unlock()
+
+	if n.loaded || n.load == nil {
+		return n.children, n.loadErr
+	}
+	n.loaded = true
+
+	children, err := n.load()
+	if err != nil {
+		logger.Errorf("romfs: failed to list %s: %v", n.name, err)
+		n.loadErr = err
+		return nil, err
+	}
+
+	n.byName = make(map[string]*node, len(children))
+	for _, c := range children {
+		if _, ok := n.byName[c.name]; ok {
+			continue
+		}
+		n.byName[c.name] = c
+		n.children = append(n.children, c)
+	}
+	sort.Slice(n.children, func(i, j int) bool { return n.children[i].name < n.children[j].name })
+	return n.children, nil
+}
+
+// unload forgets the listing of the directory n, once nothing below it is in
+// use, so it is loaded again on next use.
+func (fs *FS) unload(n *node) {
+	n.loadLock.Lock()
+	defer n.loadLock.Unlock()
+
+	if n.load == nil {
+		return
+	}
+	n.loaded = false
+	n.loadErr = nil
+	n.children = nil
+	n.byName = nil
+}
+
+// lookup returns the entry name of the directory n, or nil if there is none.
+func (fs *FS) lookup(n *node, name string) (*node, error) {
+	_, err := fs.children(n)
+	if err != nil {
+		return nil, err
+	}
+	return n.byName[name], nil
+}
+
+// entryName turns a dat or game name into a file name.
+func entryName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(name)
+	if name == "." || name == ".." {
+		name = strings.Repeat("_", len(name))
+	}
+	return name
+}
+
+// dirLoader lists a directory below the dats directory, with the dat files
+// in it as directories named after them without their suffix.
+func (fs *FS) dirLoader(dir string) func() ([]*node, error) {
+	return func() ([]*node, error) {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		var children []*node
+		for _, fi := range fis {
+			path := filepath.Join(dir, fi.Name())
+			switch {
+			case fi.IsDir():
+				c := fs.newNode(fi.Name(), true, fi.ModTime())
+				c.load = fs.dirLoader(path)
+				children = append(children, c)
+			case parser.IsDatFile(path):
+				name := strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))
+				c := fs.newNode(name, true, fi.ModTime())
+				c.load = fs.datFileLoader(path, fi.ModTime())
+				children = append(children, c)
+			}
+		}
+		return children, nil
+	}
+}
+
+// datsOfFile returns the indexed dats of the dat file path.
+func (fs *FS) datsOfFile(path string) ([]*types.Dat, error) {
+	var sha1s [][]byte
+	if parser.IsContainer(path) {
+		_, hashes, _, err := parser.ParseAll(path)
+		if err != nil {
+			return nil, err
+		}
+		sha1s = hashes
+	} else {
+		hh, err := archive.HashesForFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sha1s = [][]byte{hh.Sha1}
+	}
+
+	var dats []*types.Dat
+	for _, sha1 := range sha1s {
+		dat, err := fs.romDB.GetDat(sha1)
+		if err != nil {
+			return nil, err
+		}
+		if dat == nil {
+			logger.Warningf("romfs: %s with SHA1 %s is not indexed, maybe a refresh is needed",
+				path, hex.EncodeToString(sha1))
+			continue
+		}
+		dats = append(dats, dat)
+	}
+	return dats, nil
+}
+
+// datFileLoader lists the games of the dat file path, or its dats if it has
+// several.
+func (fs *FS) datFileLoader(path string, modTime time.Time) func() ([]*node, error) {
+	return func() ([]*node, error) {
+		dats, err := fs.datsOfFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(dats) == 1 {
+			return fs.games(dats[0], modTime), nil
+		}
+
+		var children []*node
+		for _, dat := range dats {
+			dat := dat
+			c := fs.newNode(entryName(dat.Name), true, modTime)
+			c.load = func() ([]*node, error) { return fs.games(dat, modTime), nil }
+			children = append(children, c)
+		}
+		return children, nil
+	}
+}
+
+func (fs *FS) games(dat *types.Dat, modTime time.Time) []*node {
+	var children []*node
+	for _, game := range dat.Games {
+		game := game
+		c := fs.newNode(entryName(game.Name), true, modTime)
+		c.load = func() ([]*node, error) { return fs.roms(game, modTime) }
+		children = append(children, c)
+	}
+	return children
+}
+
+// roms lists the roms of game the depot has. Roms with slashes or
+// backslashes in their names go into subdirectories.
+func (fs *FS) roms(game *types.Game, modTime time.Time) ([]*node, error) {
+	top := &node{dir: true, byName: make(map[string]*node)}
+
+	for _, rom := range game.AllRoms() {
+		if rom.NoDump() {
+			continue
+		}
+
+		if rom.Sha1 == nil {
+			// dats are shared with other directories, complete a copy
+			crom := *rom
+			err := fs.romDB.CompleteRom(&crom)
+			if err != nil {
+				return nil, err
+			}
+			if crom.Sha1 == nil {
+				continue
+			}
+			rom = &crom
+		}
+
+		have, err := fs.depot.HasDatRom(rom)
+		if err != nil {
+			return nil, err
+		}
+		if !have {
+			continue
+		}
+
+		parts := strings.Split(strings.Replace(rom.Name, "\\", "/", -1), "/")
+		dir := top
+		for i, part := range parts {
+			if part == "" || part == "." || part == ".." {
+				continue
+			}
+
+			c := dir.byName[part]
+			if c == nil {
+				c = fs.newNode(part, i < len(parts)-1, modTime)
+				if c.dir {
+					c.byName = make(map[string]*node)
+				} else {
+					c.rom = rom
+					c.size = rom.Size
+				}
+				dir.byName[part] = c
+				dir.children = append(dir.children, c)
+			}
+			if !c.dir {
+				break
+			}
+			dir = c
+		}
+	}
+
+	// subdirectories are complete already
+	var fill func(n *node)
+	fill = func(n *node) {
+		for _, c := range n.children {
+			if c.dir {
+				children := c.children
+				c.children = nil
+				c.byName = nil
+				c.load = func() ([]*node, error) { return children, nil }
+				for _, gc := range children {
+					fill(gc)
+				}
+			}
+		}
+	}
+	fill(top)
+	return top.children, nil
+}
+
+// open returns the contents of the rom file n, materialized in the cache.
+// They have to be released once done.
+func (fs *FS) open(n *node) (*cacheEntry, error) {
+	if n.rom == nil {
+		return nil, os.ErrInvalid
+	}
+	return fs.cache.acquire(n.rom)
+}
+
+// release gives back contents returned by open.
+func (fs *FS) release(e *cacheEntry) {
+	fs.cache.release(e)
+}
+
+// Close removes the cache.
+func (fs *FS) Close() error {
+	return fs.cache.close()
+}
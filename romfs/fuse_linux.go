@@ -0,0 +1,269 @@
+//go:build linux
+// +build linux
+
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package romfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	attrValid = 60 // seconds
+	blockSize = 4096
+)
+
+// Server serves an FS to the kernel, through go-fuse. Inodes are dropped once
+// the kernel forgets them, and with them the listings of their directories.
+type Server struct {
+	fs     *FS
+	server *fuse.Server
+	uid    uint32
+	gid    uint32
+
+	lock    sync.Mutex
+	handles map[*handle]bool
+}
+
+func newServer(fs *FS) *Server {
+	return &Server{
+		fs:      fs,
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		handles: make(map[*handle]bool),
+	}
+}
+
+// rawFS returns the FUSE requests handler of s.
+func (s *Server) rawFS() fuse.RawFileSystem {
+	timeout := attrValid * time.Second
+	return fusefs.NewNodeFS(&inode{s: s, n: s.fs.root}, &fusefs.Options{
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+	})
+}
+
+// Mount mounts fs on dir. Requests are answered once Serve runs. The serving
+// process itself can't open files of the mount with package os, the poller
+// would wait on the server.
+func Mount(dir string, fs *FS) (*Server, error) {
+	s := newServer(fs)
+	server, err := fuse.NewServer(s.rawFS(), dir, &fuse.MountOptions{
+		FsName:  "romba",
+		Name:    "romfs",
+		Options: []string{"ro"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount %s: %v", dir, err)
+	}
+	s.server = server
+	return s, nil
+}
+
+// Unmount unmounts the filesystem, which makes Serve return.
+func (s *Server) Unmount() error {
+	return s.server.Unmount()
+}
+
+// Serve answers requests until the filesystem is unmounted.
+func (s *Server) Serve() error {
+	defer s.releaseAll()
+
+	s.server.Serve()
+	return nil
+}
+
+// releaseAll releases the files left open when serving stops.
+func (s *Server) releaseAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for h := range s.handles {
+		s.fs.release(h.e)
+		delete(s.handles, h)
+	}
+}
+
+// inode is the go-fuse inode of a node.
+type inode struct {
+	fusefs.Inode
+	s *Server
+	n *node
+}
+
+var (
+	_ fusefs.NodeLookuper    = (*inode)(nil)
+	_ fusefs.NodeReaddirer   = (*inode)(nil)
+	_ fusefs.NodeGetattrer   = (*inode)(nil)
+	_ fusefs.NodeOpener      = (*inode)(nil)
+	_ fusefs.NodeStatfser    = (*inode)(nil)
+	_ fusefs.NodeOnForgetter = (*inode)(nil)
+)
+
+func (s *Server) fillAttr(attr *fuse.Attr, n *node) {
+	if n.dir {
+		attr.Mode, attr.Nlink = syscall.S_IFDIR|0555, 2
+	} else {
+		attr.Mode, attr.Nlink = syscall.S_IFREG|0444, 1
+	}
+	attr.Ino = n.ino
+	attr.Size = uint64(n.size)
+	attr.Blocks = uint64((n.size + 511) / 512)
+	attr.SetTimes(&n.modTime, &n.modTime, &n.modTime)
+	attr.Uid = s.uid
+	attr.Gid = s.gid
+	attr.Blksize = blockSize
+}
+
+func stableAttr(n *node) fusefs.StableAttr {
+	if n.dir {
+		return fusefs.StableAttr{Mode: syscall.S_IFDIR, Ino: n.ino}
+	}
+	return fusefs.StableAttr{Mode: syscall.S_IFREG, Ino: n.ino}
+}
+
+func (in *inode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if !in.n.dir {
+		return nil, syscall.ENOTDIR
+	}
+
+	c, err := in.s.fs.lookup(in.n, name)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	if c == nil {
+		return nil, syscall.ENOENT
+	}
+
+	in.s.fillAttr(&out.Attr, c)
+	return in.NewInode(ctx, &inode{s: in.s, n: c}, stableAttr(c)), 0
+}
+
+func (in *inode) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	if !in.n.dir {
+		return nil, syscall.ENOTDIR
+	}
+
+	children, err := in.s.fs.children(in.n)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	entries := make([]fuse.DirEntry, len(children))
+	for i, c := range children {
+		entries[i] = fuse.DirEntry{Name: c.name, Mode: stableAttr(c).Mode, Ino: c.ino}
+	}
+	return fusefs.NewListDirStream(entries), 0
+}
+
+func (in *inode) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	in.s.fillAttr(&out.Attr, in.n)
+	return 0
+}
+
+func (in *inode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	out.Bsize = blockSize
+	out.Frsize = blockSize
+	out.NameLen = 255
+	return 0
+}
+
+// OnForget drops the listing of a directory the kernel no longer knows, the
+// inodes below it are forgotten already.
+func (in *inode) OnForget() {
+	if in.n.dir {
+		in.s.fs.unload(in.n)
+	}
+}
+
+func (in *inode) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, 0, syscall.EROFS
+	}
+	if in.n.dir {
+		return nil, 0, syscall.EISDIR
+	}
+
+	e, err := in.s.fs.open(in.n)
+	if os.IsNotExist(err) {
+		return nil, 0, syscall.ENOENT
+	}
+	if err != nil {
+		logger.Errorf("romfs: failed to open %s: %v", in.n.name, err)
+		return nil, 0, syscall.EIO
+	}
+
+	h := &handle{s: in.s, e: e}
+	in.s.lock.Lock()
+	in.s.handles[h] = true
+	in.s.lock.Unlock()
+	return h, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// handle is an opened rom file.
+type handle struct {
+	s *Server
+	e *cacheEntry
+}
+
+var (
+	_ fusefs.FileReader   = (*handle)(nil)
+	_ fusefs.FileReleaser = (*handle)(nil)
+)
+
+func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.e.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *handle) Release(ctx context.Context) syscall.Errno {
+	h.s.lock.Lock()
+	open := h.s.handles[h]
+	delete(h.s.handles, h)
+	h.s.lock.Unlock()
+
+	if open {
+		h.s.fs.release(h.e)
+	}
+	return 0
+}
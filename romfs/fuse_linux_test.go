@@ -0,0 +1,221 @@
+//go:build linux
+// +build linux
+
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package romfs
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func direntNames(buf []byte) []string {
+	var names []string
+	for len(buf) >= 24 {
+		namelen := int(binary.NativeEndian.Uint32(buf[16:]))
+		if namelen == 0 {
+			break
+		}
+		names = append(names, string(buf[24:24+namelen]))
+		buf = buf[(24+namelen+7)&^7:]
+	}
+	return names
+}
+
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-romfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := newTestFS(t, dir, 1<<20)
+	defer fs.Close()
+
+	s := newServer(fs)
+	raw := s.rawFS()
+
+	lookup := func(parent uint64, name string) (uint64, fuse.Status) {
+		var out fuse.EntryOut
+		st := raw.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, &out)
+		return out.NodeId, st
+	}
+
+	var path []uint64
+	id := uint64(fuse.FUSE_ROOT_ID)
+	for _, name := range []string{"consoles", "test", "game1"} {
+		var st fuse.Status
+		id, st = lookup(id, name)
+		if !st.Ok() {
+			t.Fatalf("lookup of %s failed: %v", name, st)
+		}
+		path = append(path, id)
+	}
+	game := id
+
+	_, st := lookup(game, "missing.bin")
+	if st != fuse.ENOENT {
+		t.Errorf("lookup of missing.bin got %v, want ENOENT", st)
+	}
+
+	var openOut fuse.OpenOut
+	st = raw.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: game}}, &openOut)
+	if !st.Ok() {
+		t.Fatalf("opendir failed: %v", st)
+	}
+	buf := make([]byte, 4096)
+	st = raw.ReadDir(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: game}, Fh: openOut.Fh, Size: 4096},
+		fuse.NewDirEntryList(buf, 0))
+	if !st.Ok() {
+		t.Fatalf("readdir failed: %v", st)
+	}
+	if names := direntNames(buf); !sameNames(names, []string{"a.bin"}) {
+		t.Errorf("readdir got %v", names)
+	}
+	raw.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: game}, Fh: openOut.Fh})
+
+	rom, st := lookup(game, "a.bin")
+	if !st.Ok() {
+		t.Fatalf("lookup of a.bin failed: %v", st)
+	}
+
+	var attrOut fuse.AttrOut
+	st = raw.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: rom}}, &attrOut)
+	if !st.Ok() || attrOut.Size != uint64(len("first rom")) {
+		t.Errorf("getattr got %v with size %d", st, attrOut.Size)
+	}
+
+	st = raw.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: rom}, Flags: syscall.O_RDWR}, &openOut)
+	if st != fuse.EROFS {
+		t.Errorf("open for writing got %v, want EROFS", st)
+	}
+
+	st = raw.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: rom}, Flags: syscall.O_RDONLY}, &openOut)
+	if !st.Ok() {
+		t.Fatalf("open failed: %v", st)
+	}
+
+	rr, st := raw.Read(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: rom}, Fh: openOut.Fh, Offset: 6, Size: 100}, buf)
+	if !st.Ok() {
+		t.Fatalf("read failed: %v", st)
+	}
+	data, _ := rr.Bytes(buf)
+	if string(data) != "rom" {
+		t.Errorf("read got %q, want %q", data, "rom")
+	}
+
+	raw.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: rom}, Fh: openOut.Fh})
+	if len(s.handles) != 0 {
+		t.Errorf("%d handles left after release", len(s.handles))
+	}
+
+	// forgetting the game drops its listing, the one of its dat stays
+	gameNode := walkTo(t, fs, "consoles", "test", "game1")
+	raw.Forget(rom, 1)
+	raw.Forget(game, 1)
+	if gameNode.loaded || gameNode.children != nil {
+		t.Errorf("forgotten game still listed")
+	}
+	if datNode := walkTo(t, fs, "consoles", "test"); !datNode.loaded {
+		t.Errorf("dat of forgotten game unloaded")
+	}
+
+	// and is loaded again on next use
+	game, st = lookup(path[1], "game1")
+	if !st.Ok() {
+		t.Fatalf("lookup of game1 again failed: %v", st)
+	}
+	if _, st = lookup(game, "a.bin"); !st.Ok() {
+		t.Errorf("lookup of a.bin after forget failed: %v", st)
+	}
+}
+
+func TestMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-romfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := newTestFS(t, dir, 1<<20)
+	defer fs.Close()
+
+	mnt := filepath.Join(dir, "mnt")
+	err = os.Mkdir(mnt, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Mount(mnt, fs)
+	if err != nil {
+		t.Skipf("can't mount here: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve()
+	}()
+
+	// files of the mount are opened bypassing the poller, which would ask
+	// the server whether they are pollable while blocking it
+	fd, err := syscall.Open(filepath.Join(mnt, "consoles", "test", "game2", "sub", "c.bin"), syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Error(err)
+	} else {
+		buf := make([]byte, 100)
+		n, err := syscall.Read(fd, buf)
+		if err != nil {
+			t.Error(err)
+		} else if string(buf[:n]) != "third rom, in a subdirectory" {
+			t.Errorf("c.bin holds %q", buf[:n])
+		}
+		syscall.Close(fd)
+	}
+
+	_, err = syscall.Open(filepath.Join(mnt, "consoles", "test", "game2", "new.bin"), syscall.O_WRONLY|syscall.O_CREAT, 0666)
+	if err != syscall.EROFS {
+		t.Errorf("create got %v, want EROFS", err)
+	}
+
+	err = s.Unmount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-done
+	if err != nil {
+		t.Errorf("serve failed: %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package romfs
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// romfsTestDB accepts every rom and knows one dat, whatever the SHA1 asked
+// for
+type romfsTestDB struct {
+	db.RomDB
+	dat *types.Dat
+}
+
+func (rdb *romfsTestDB) IndexRom(rom *types.Rom) error {
+	return nil
+}
+
+func (rdb *romfsTestDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	return nil, nil
+}
+
+func (rdb *romfsTestDB) CompleteRom(rom *types.Rom) error {
+	return nil
+}
+
+func (rdb *romfsTestDB) GetDat(sha1 []byte) (*types.Dat, error) {
+	return rdb.dat, nil
+}
+
+func testRom(name, contents string) *types.Rom {
+	sum := sha1.Sum([]byte(contents))
+	return &types.Rom{Name: name, Size: int64(len(contents)), Sha1: sum[:]}
+}
+
+// newTestFS returns a filesystem of a dat with two games, backed by a depot
+// holding all their roms but one.
+func newTestFS(t *testing.T, dir string, maxCache int64) *FS {
+	depotRoot := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	datsDir := filepath.Join(dir, "dats", "consoles")
+	cacheDir := filepath.Join(dir, "cache")
+	for _, d := range []string{depotRoot, srcDir, datsDir, cacheDir} {
+		err := os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, contents := range []string{"first rom", "second rom", "third rom, in a subdirectory"} {
+		err := ioutil.WriteFile(filepath.Join(srcDir, strconv.Itoa(i)+".bin"), []byte(contents), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := ioutil.WriteFile(filepath.Join(datsDir, "test.dat"), []byte("not parsed"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(datsDir, "readme.txt"), []byte("not a dat"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rdb := &romfsTestDB{
+		dat: &types.Dat{
+			Name: "test",
+			Games: types.GameSlice{
+				{
+					Name: "game1",
+					Roms: types.RomSlice{
+						testRom("a.bin", "first rom"),
+						testRom("missing.bin", "rom not in the depot"),
+						{Name: "nodump.bin", Status: types.StatusNoDump},
+					},
+				},
+				{
+					Name: "game2",
+					Roms: types.RomSlice{
+						testRom("b.bin", "second rom"),
+						testRom("sub\\c.bin", "third rom, in a subdirectory"),
+						testRom("../escape.bin", "first rom"),
+					},
+				},
+			},
+		},
+	}
+
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, &archive.ArchiveOptions{}, 1, dir, worker.NewProgressTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(filepath.Join(dir, "dats"), rdb, depot, cacheDir, maxCache)
+}
+
+func childNames(t *testing.T, fs *FS, n *node) []string {
+	children, err := fs.children(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, c := range children {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func walkTo(t *testing.T, fs *FS, names ...string) *node {
+	n := fs.root
+	for _, name := range names {
+		c, err := fs.lookup(n, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == nil {
+			t.Fatalf("%s not found in %s", name, n.name)
+		}
+		n = c
+	}
+	return n
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-romfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := newTestFS(t, dir, 1<<20)
+	defer fs.Close()
+
+	tests := []struct {
+		path []string
+		want []string
+	}{
+		{nil, []string{"consoles"}},
+		{[]string{"consoles"}, []string{"test"}},
+		{[]string{"consoles", "test"}, []string{"game1", "game2"}},
+		{[]string{"consoles", "test", "game1"}, []string{"a.bin"}},
+		{[]string{"consoles", "test", "game2"}, []string{"b.bin", "escape.bin", "sub"}},
+		{[]string{"consoles", "test", "game2", "sub"}, []string{"c.bin"}},
+	}
+
+	for _, test := range tests {
+		got := childNames(t, fs, walkTo(t, fs, test.path...))
+		if !sameNames(got, test.want) {
+			t.Errorf("%v has %v, want %v", test.path, got, test.want)
+		}
+	}
+
+	rom := walkTo(t, fs, "consoles", "test", "game2", "sub", "c.bin")
+	if rom.dir || rom.size != int64(len("third rom, in a subdirectory")) {
+		t.Errorf("c.bin is dir %t with size %d", rom.dir, rom.size)
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-romfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// room for one of the roms only
+	fs := newTestFS(t, dir, 12)
+	defer fs.Close()
+
+	read := func(n *node) (*cacheEntry, string) {
+		e, err := fs.open(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, n.size)
+		_, err = e.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e, string(buf)
+	}
+
+	a := walkTo(t, fs, "consoles", "test", "game1", "a.bin")
+	b := walkTo(t, fs, "consoles", "test", "game2", "b.bin")
+
+	ea, contents := read(a)
+	if contents != "first rom" {
+		t.Errorf("a.bin holds %q", contents)
+	}
+	ea2, _ := read(a)
+	if ea2 != ea {
+		t.Errorf("a.bin materialized twice")
+	}
+
+	eb, contents := read(b)
+	if contents != "second rom" {
+		t.Errorf("b.bin holds %q", contents)
+	}
+
+	// both are in use, nothing can go
+	if len(fs.cache.entries) != 2 {
+		t.Errorf("cache has %d entries, want 2", len(fs.cache.entries))
+	}
+
+	fs.release(ea)
+	fs.release(ea2)
+	if _, ok := fs.cache.entries[ea.key]; ok {
+		t.Errorf("a.bin still cached after release")
+	}
+	if _, err := os.Stat(ea.file.Name()); !os.IsNotExist(err) {
+		t.Errorf("a.bin still in the cache directory: %v", err)
+	}
+
+	fs.release(eb)
+	if _, ok := fs.cache.entries[eb.key]; !ok {
+		t.Errorf("b.bin evicted though it fits")
+	}
+}
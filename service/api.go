@@ -0,0 +1,476 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/uwedeportivo/romba/auth"
+)
+
+// The HTTP API speaks JSON, for scripts and web UIs controlling a romba
+// daemon:
+//
+//	POST /api/jobs           run the command {"command": "...", "args": [...]},
+//	                         its job restricted by "limits": {"workers": n,
+//	                         "nice": n, "bytesPerSecond": n} if set
+//	POST /api/refresh        shorthands for POST /api/jobs with the command
+//	POST /api/archive        refresh-dats, archive and build, taking
+//	POST /api/build          {"args": [...], "limits": {...}}
+//	POST /api/queue          queue the command {"command": "...", "args": [...],
+//	                         "priority": n, "limits": {...}} to run after the
+//	                         jobs before it
+//	GET  /api/jobs           the jobs the service remembers, then the queue
+//	GET  /api/jobs/<id>      one job, with its progress while running and
+//	                         the files it skipped once done
+//	DELETE /api/jobs/<id>    cancel a queued job
+//	GET  /api/jobs/<id>/events
+//	                         server-sent events of the job: state changes,
+//	                         progress and log lines, resuming after the
+//	                         Last-Event-ID header or the after parameter
+//	GET  /api/jobs/<id>/log  the records logged while the job ran, as JSON
+//	                         lines
+//	GET  /api/recovery       the jobs interrupted by the last shutdown of the
+//	                         daemon, with how to resume and roll them back
+//	POST /api/recovery/<id>/resume
+//	                         queue the command resuming an interrupted job
+//	POST /api/recovery/<id>/rollback
+//	                         remove the partial files of an interrupted job
+//	GET  /api/lookup?q=...   lookup of hashes, files and game names
+//	GET  /api/dbstats        statistics of the rom DB
+//	GET  /api/depot          size, maximum size and free disk space per root
+//	GET  /api/stats          the latest depot statistics and the growth of the
+//	                         depot over the last day, week and month
+//	GET  /api/stats/history?since=...
+//	                         the samples of the depot statistics since a time
+//	                         or a duration ago like 720h, all without since
+//	GET  /api/trash          the operations whose removed files are in the
+//	                         trash
+//	GET  /api/trash/<id>     the files in the trash of an operation
+//	POST /api/trash/<id>/undo
+//	                         move the files of an operation back
+//	GET  /api/pins           the flags of pinned and protected dats by path
+//	GET  /api/progress       stream of progress messages, one JSON per line
+//	/api/replica/...         receiving end of depot replication, see package
+//	                         replica
+//
+// Commands starting a job and queued commands answer with 202 Accepted, the
+// job and its location. Other commands answer with their output, 409 Conflict
+// tells that the command couldn't start because of the running job.
+//
+// If the daemon has users, requests need the token of one, see package auth.
+// Readonly users may make the GET requests and run commands like lookup and
+// dbstats, operators may run jobs, cancel the ones they queued and push
+// replicas, except for jobs removing or moving files like archive
+// -delete-sources, admins may do anything. Requests without a valid token answer 401 Unauthorized, those of
+// users without the role they need 403 Forbidden.
+
+// CommandRequest is the body of POST /api/jobs.
+type CommandRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// Limits restrict the job the command starts, if set.
+	Limits *Limits `json:"limits,omitempty"`
+}
+
+// QueueRequest is the body of POST /api/queue.
+type QueueRequest struct {
+	CommandRequest
+	Priority int `json:"priority"`
+}
+
+// CommandReply is the answer to commands not starting a job.
+type CommandReply struct {
+	Message string `json:"message,omitempty"`
+	// Job is the running job, for commands refused because of it.
+	Job *Job `json:"job,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// APIHandler returns the handler of the HTTP API, to be mounted at /api/.
+func (rs *RombaService) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/jobs", rs.handleJobs)
+	mux.HandleFunc("/api/jobs/", rs.handleJob)
+	mux.HandleFunc("/api/queue", rs.handleQueue)
+	mux.HandleFunc("/api/refresh", rs.commandHandler("refresh-dats"))
+	mux.HandleFunc("/api/archive", rs.commandHandler("archive"))
+	mux.HandleFunc("/api/build", rs.commandHandler("build"))
+	mux.HandleFunc("/api/recovery", rs.handleRecoveries)
+	mux.HandleFunc("/api/recovery/", rs.handleRecovery)
+	mux.HandleFunc("/api/lookup", rs.handleLookup)
+	mux.HandleFunc("/api/dbstats", rs.handleDBStats)
+	mux.HandleFunc("/api/depot", rs.handleDepot)
+	mux.HandleFunc("/api/stats", rs.handleStats)
+	mux.HandleFunc("/api/stats/history", rs.handleStatsHistory)
+	mux.HandleFunc("/api/trash", rs.handleTrash)
+	mux.HandleFunc("/api/trash/", rs.handleTrashOperation)
+	mux.HandleFunc("/api/pins", rs.handlePins)
+	mux.HandleFunc("/api/conflicts", rs.handleConflicts)
+	mux.HandleFunc("/api/progress", rs.handleProgress)
+	mux.Handle("/api/replica/", authorizeReplica(rs.replica))
+	return rs.RequireRole(auth.ReadOnly, mux)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Errorf("error writing API reply: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &apiError{Error: err.Error()})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+func (rs *RombaService) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, rs.listJobs())
+	case "POST":
+		req := new(CommandRequest)
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		rs.serveCommand(w, r, req)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	}
+}
+
+func (rs *RombaService) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+
+	if strings.HasSuffix(id, "/events") {
+		rs.handleJobEvents(w, r, strings.TrimSuffix(id, "/events"))
+		return
+	}
+	if strings.HasSuffix(id, "/log") {
+		rs.handleJobLog(w, r, strings.TrimSuffix(id, "/log"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		job := rs.findJob(id)
+		if job == nil {
+			writeAPIError(w, http.StatusNotFound, fmt.Errorf("no job %s", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	case "DELETE":
+		if !allowRole(w, r, commandRole("cancel")) {
+			return
+		}
+		if rs.findJob(id) == nil {
+			writeAPIError(w, http.StatusNotFound, fmt.Errorf("no job %s", id))
+			return
+		}
+		job, err := rs.cancelJob(auth.UserFrom(r.Context()), id)
+		if _, ok := err.(*forbiddenError); ok {
+			writeAPIError(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	}
+}
+
+// commandHandler serves POST requests running the command name, with the
+// arguments given in the body.
+func (rs *RombaService) commandHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "POST") {
+			return
+		}
+
+		req := new(CommandRequest)
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil && err != io.EOF {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		req.Command = name
+		rs.serveCommand(w, r, req)
+	}
+}
+
+// serveCommand runs the command of req for the user making r and answers
+// with the job it started, or with its output.
+func (rs *RombaService) serveCommand(w http.ResponseWriter, r *http.Request, req *CommandRequest) {
+	if req.Command == "" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("command missing"))
+		return
+	}
+
+	if req.Limits != nil {
+		err := req.Limits.Validate()
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	msg, job, err := rs.runCommandAs(auth.UserFrom(r.Context()), append([]string{req.Command}, req.Args...), nil, req.Limits)
+	if _, ok := err.(*forbiddenError); ok {
+		writeAPIError(w, http.StatusForbidden, err)
+		return
+	}
+	if err == errBusy {
+		rs.jobMutex.Lock()
+		var busyJob *Job
+		if rs.currentJob != nil {
+			busyJob = rs.jobSnapshot(rs.currentJob)
+		}
+		rs.jobMutex.Unlock()
+
+		writeJSON(w, http.StatusConflict, &CommandReply{Message: msg, Job: busyJob})
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if job != nil {
+		rs.jobMutex.Lock()
+		job = rs.jobSnapshot(job)
+		rs.jobMutex.Unlock()
+
+		w.Header().Set("Location", "/api/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+	writeJSON(w, http.StatusOK, &CommandReply{Message: msg})
+}
+
+func (rs *RombaService) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+
+	req := new(QueueRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Command == "" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("command missing"))
+		return
+	}
+
+	u := auth.UserFrom(r.Context())
+	argv := append([]string{req.Command}, req.Args...)
+	err = authorizeCommand(u, []string{"queue"})
+	if err == nil {
+		err = authorizeCommand(u, argv)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusForbidden, err)
+		return
+	}
+
+	job, err := rs.enqueueJob(u, argv, req.Priority, req.Limits)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (rs *RombaService) handleRecoveries(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, rs.listRecoveries())
+}
+
+func (rs *RombaService) handleRecovery(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	if !allowRole(w, r, commandRole("recover")) {
+		return
+	}
+
+	id, action := path.Split(strings.TrimPrefix(r.URL.Path, "/api/recovery/"))
+	id = strings.TrimSuffix(id, "/")
+	if rs.findRecovery(id) == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("%v %s", errNoRecovery, id))
+		return
+	}
+
+	switch action {
+	case "resume":
+		job, err := rs.resumeJob(auth.UserFrom(r.Context()), id)
+		if _, ok := err.(*forbiddenError); ok {
+			writeAPIError(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, err)
+			return
+		}
+		w.Header().Set("Location", "/api/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+	case "rollback":
+		rec, err := rs.rollbackJob(id)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("unknown recovery action %q", action))
+	}
+}
+
+func (rs *RombaService) handleLookup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	reply := new(LookupReply)
+	err := rs.Lookup(r, &LookupRequest{Queries: r.URL.Query()["q"]}, reply)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+func (rs *RombaService) handleDBStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	rs.jobMutex.Lock()
+	stats := rs.romDB.PrintStats()
+	rs.jobMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, &CommandReply{Message: stats})
+}
+
+func (rs *RombaService) handleDepot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, rs.depot.Usage())
+}
+
+// handleProgress streams the progress messages broadcast by the service, as
+// the websocket at /progress does, until the client goes away.
+func (rs *RombaService) handleProgress(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	b := make([]byte, 10)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	listName := hex.EncodeToString(b)
+	listC := make(chan *ProgressNessage)
+
+	rs.registerProgressListener(listName, listC)
+	defer func() {
+		// a broadcast may be waiting on listC, keep receiving until the
+		// listener is gone
+		go func() {
+			for range listC {
+			}
+		}()
+		rs.unregisterProgressListener(listName)
+		close(listC)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case pmsg := <-listC:
+			err = enc.Encode(pmsg)
+			if err != nil {
+				logger.Infof("error sending progress: %v", err)
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestAPI(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-api-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	outDir := filepath.Join(root, "out")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	datPath := filepath.Join(datsDir, "test.dat")
+	err = ioutil.WriteFile(datPath, []byte("a dat file"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datHashes, err := archive.HashesForFile(datPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ldb := &lookupTestDB{
+		datSha1: datHashes.Sha1,
+		dat: &types.Dat{
+			Name:  "test",
+			Games: types.GameSlice{{Name: "game", Roms: types.RomSlice{{Name: "a.bin", Sha1: datHashes.Sha1}}}},
+		},
+	}
+
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, ldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewRombaService(ldb, depot, testConfig(datsDir, root))
+	mux := http.NewServeMux()
+	mux.Handle("/api/", rs.APIHandler())
+	mux.Handle("/dashboard", rs.DashboardHandler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	limits := &Limits{Workers: 1, BytesPerSecond: 1 << 30}
+	body, _ := json.Marshal(&CommandRequest{Command: "miss", Args: []string{"-out", outDir}, Limits: limits})
+	resp, err := http.Post(server.URL+"/api/jobs", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := new(Job)
+	err = json.NewDecoder(resp.Body).Decode(job)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted || job.Name != "miss" || job.Limits == nil || *job.Limits != *limits {
+		t.Fatalf("got status %d and job %+v, want a limited miss job accepted", resp.StatusCode, job)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/api/jobs/"+job.ID {
+		t.Errorf("got location %s for job %s", loc, job.ID)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for job.State == JobRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+
+		resp, err = http.Get(server.URL + "/api/jobs/" + job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(job)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.State != JobDone || job.Finished == nil || !strings.Contains(job.Message, "miss 1 roms") {
+		t.Errorf("got job %+v, want a finished miss job", job)
+	}
+
+	resp, err = http.Get(server.URL + "/api/jobs/" + job.ID + "/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobLog, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(jobLog)), "\n")
+	if resp.StatusCode != http.StatusOK || len(lines) == 0 {
+		t.Fatalf("got status %d and log %q", resp.StatusCode, jobLog)
+	}
+	for _, line := range lines {
+		var rec struct {
+			Job string `json:"job"`
+			Msg string `json:"msg"`
+		}
+		err = json.Unmarshal([]byte(line), &rec)
+		if err != nil || rec.Job != job.ID || rec.Msg == "" {
+			t.Errorf("got log line %q, want a record of job %s", line, job.ID)
+		}
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/dashboard", http.StatusOK},
+		{"GET", "/api/jobs", http.StatusOK},
+		{"GET", "/api/jobs/999", http.StatusNotFound},
+		{"GET", "/api/jobs/999/log", http.StatusNotFound},
+		{"GET", "/api/lookup?q=game", http.StatusOK},
+		{"POST", "/api/lookup", http.StatusMethodNotAllowed},
+		{"GET", "/api/build", http.StatusMethodNotAllowed},
+		{"GET", "/api/depot", http.StatusOK},
+		{"GET", "/api/stats", http.StatusOK},
+		{"GET", "/api/stats/history?since=720h", http.StatusOK},
+		{"GET", "/api/stats/history?since=yesterday", http.StatusBadRequest},
+		{"GET", "/api/recovery", http.StatusOK},
+		{"GET", "/api/recovery/1/resume", http.StatusMethodNotAllowed},
+		{"POST", "/api/recovery/999/rollback", http.StatusNotFound},
+		{"GET", "/api/trash", http.StatusOK},
+		{"GET", "/api/pins", http.StatusOK},
+		{"GET", "/api/trash/nope", http.StatusNotFound},
+		{"GET", "/api/trash/nope/undo", http.StatusMethodNotAllowed},
+		{"POST", "/api/trash/nope/undo", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(tc.method, server.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.path, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestCommandRoles(t *testing.T) {
+	for _, c := range Commands() {
+		if _, ok := commandRoles[c.Name]; !ok {
+			t.Errorf("command %s has no role", c.Name)
+		}
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-api-auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ldb := new(lookupTestDB)
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, ldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		adminToken    = "admin-0123456789abcdef"
+		operatorToken = "operator-0123456789abcdef"
+		readerToken   = "reader-0123456789abcdef"
+	)
+	cfg := testConfig(datsDir, root)
+	cfg.Auth.Admin = []string{"alice:" + adminToken}
+	cfg.Auth.Operator = []string{"bob:" + operatorToken}
+	cfg.Auth.ReadOnly = []string{"club:" + readerToken}
+
+	rs := NewRombaService(ldb, depot, cfg)
+	server := httptest.NewServer(rs.APIHandler())
+	defer server.Close()
+
+	for _, tc := range []struct {
+		token        string
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		{"", "GET", "/api/jobs", nil, http.StatusUnauthorized},
+		{"wrong-0123456789abcdef", "GET", "/api/jobs", nil, http.StatusUnauthorized},
+		{readerToken, "GET", "/api/jobs", nil, http.StatusOK},
+		{readerToken, "GET", "/api/lookup?q=game", nil, http.StatusOK},
+		{readerToken, "POST", "/api/jobs", &CommandRequest{Command: "jobs"}, http.StatusOK},
+		{readerToken, "POST", "/api/jobs", &CommandRequest{Command: "memstats"}, http.StatusOK},
+		{readerToken, "POST", "/api/refresh", nil, http.StatusForbidden},
+		{readerToken, "POST", "/api/jobs", &CommandRequest{Command: "queue", Args: []string{"jobs"}}, http.StatusForbidden},
+		{readerToken, "DELETE", "/api/jobs/999", nil, http.StatusForbidden},
+		{readerToken, "PUT", "/api/replica/uploads/x.gz", nil, http.StatusForbidden},
+		{operatorToken, "POST", "/api/jobs", &CommandRequest{Command: "purge-delete"}, http.StatusForbidden},
+		{operatorToken, "POST", "/api/jobs", &CommandRequest{Command: "queue", Args: []string{"shutdown"}}, http.StatusForbidden},
+		{operatorToken, "POST", "/api/queue", &QueueRequest{CommandRequest: CommandRequest{Command: "relayout"}}, http.StatusForbidden},
+		{operatorToken, "DELETE", "/api/replica/roms/0123", nil, http.StatusForbidden},
+		{operatorToken, "POST", "/api/jobs", &CommandRequest{Command: "archive"}, http.StatusOK},
+		{operatorToken, "POST", "/api/jobs", &CommandRequest{Command: "archive", Args: []string{"-delete-sources=false"}}, http.StatusOK},
+		{operatorToken, "POST", "/api/jobs", &CommandRequest{Command: "archive", Args: []string{"-delete-sources"}}, http.StatusForbidden},
+		{operatorToken, "POST", "/api/jobs", &CommandRequest{Command: "archive", Args: []string{"--trash=/tmp"}}, http.StatusForbidden},
+		{operatorToken, "POST", "/api/jobs", &CommandRequest{Command: "queue", Args: []string{"archive", "-move-imports"}}, http.StatusForbidden},
+		{operatorToken, "POST", "/api/queue", &QueueRequest{CommandRequest: CommandRequest{Command: "archive", Args: []string{"-quarantine", "q"}}}, http.StatusForbidden},
+		{adminToken, "POST", "/api/jobs", &CommandRequest{Command: "archive", Args: []string{"-delete-sources"}}, http.StatusOK},
+		{operatorToken, "DELETE", "/api/jobs/999", nil, http.StatusNotFound},
+		{operatorToken, "POST", "/api/trash/nope/undo", nil, http.StatusForbidden},
+		{adminToken, "DELETE", "/api/replica/roms/0123", nil, http.StatusForbidden},
+		{adminToken, "POST", "/api/jobs", &CommandRequest{Command: "no-such-command"}, http.StatusBadRequest},
+		{adminToken, "POST", "/api/jobs", &CommandRequest{Command: "jobs", Limits: &Limits{Workers: -1}}, http.StatusBadRequest},
+	} {
+		var body []byte
+		if tc.body != nil {
+			body, _ = json.Marshal(tc.body)
+		}
+		req, err := http.NewRequest(tc.method, server.URL+tc.path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s %v: got status %d (%s), want %d", tc.method, tc.path, tc.body, resp.StatusCode, reply, tc.status)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/uwedeportivo/romba/auth"
+)
+
+// commandRoles are the roles needed to run the commands. Commands missing
+// here need auth.Admin.
+var commandRoles = map[string]auth.Role{
+	"help":      auth.ReadOnly,
+	"lookup":    auth.ReadOnly,
+	"progress":  auth.ReadOnly,
+	"memstats":  auth.ReadOnly,
+	"dbstats":   auth.ReadOnly,
+	"jobs":      auth.ReadOnly,
+	"conflicts": auth.ReadOnly,
+
+	"refresh-dats": auth.Operator,
+	"archive":      auth.Operator,
+	"dir2dat":      auth.Operator,
+	"diffdat":      auth.Operator,
+	"fixdat":       auth.Operator,
+	"miss":         auth.Operator,
+	"build":        auth.Operator,
+	"scrub":        auth.Operator,
+	"export":       auth.Operator,
+	"manifest":     auth.Operator,
+	"hash-bench":   auth.Operator,
+	"audit":        auth.Operator,
+	"queue":        auth.Operator,
+	"cancel":       auth.Operator,
+	"replicate":    auth.Operator,
+	"torrent":      auth.Operator,
+	"datsync":      auth.Operator,
+	"recover":      auth.Operator,
+	"stats":        auth.Operator,
+	"import-scan":  auth.Operator,
+	"dedup":        auth.Operator,
+
+	"purge-delete": auth.Admin,
+	"purge-backup": auth.Admin,
+	"shutdown":     auth.Admin,
+	"recompress":   auth.Admin,
+	"relayout":     auth.Admin,
+	"rebuild":      auth.Admin,
+	"fix":          auth.Admin,
+	"mount":        auth.Admin,
+	"unmount":      auth.Admin,
+	"undo":         auth.Admin,
+	"pin":          auth.Admin,
+	// bundles have the config, tokens included
+	"export-state": auth.Admin,
+}
+
+// adminFlags are the flags of commands that need auth.Admin whatever the
+// role of the command, as they remove or move files on the server.
+var adminFlags = map[string][]string{
+	"archive": {"delete-sources", "move-imports", "quarantine", "trash"},
+}
+
+func commandRole(name string) auth.Role {
+	if role, ok := commandRoles[name]; ok {
+		return role
+	}
+	return auth.Admin
+}
+
+// hasFlag reports whether args set one of the flags names, other than to
+// false. Arguments after the flags are looked at as well, erring on the
+// safe side.
+func hasFlag(args []string, names []string) bool {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, value := strings.TrimLeft(arg, "-"), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], name[i+1:]
+		}
+		for _, n := range names {
+			if name == n && value != "false" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forbiddenError tells that a user may not run a command.
+type forbiddenError struct {
+	err error
+}
+
+func (e *forbiddenError) Error() string {
+	return e.err.Error()
+}
+
+// authorizeCommand checks that u may run the command given by argv. A nil u
+// is the service itself, running queued jobs, which may run anything.
+func authorizeCommand(u *auth.User, argv []string) error {
+	if u == nil || len(argv) == 0 {
+		return nil
+	}
+	role := commandRole(argv[0])
+	if hasFlag(argv[1:], adminFlags[argv[0]]) {
+		role = auth.Admin
+	}
+	if !u.Allowed(role) {
+		return &forbiddenError{fmt.Errorf("%s: %v", argv[0], auth.Forbidden(u, role))}
+	}
+	return nil
+}
+
+// RequireRole returns a handler serving the requests of users with at least
+// role with h, see auth.Tokens.Handler.
+func (rs *RombaService) RequireRole(role auth.Role, h http.Handler) http.Handler {
+	return rs.tokens.Handler(role, h)
+}
+
+// allowRole checks that the user making r has role, answering with 403
+// Forbidden if not.
+func allowRole(w http.ResponseWriter, r *http.Request, role auth.Role) bool {
+	u := auth.UserFrom(r.Context())
+	if !u.Allowed(role) {
+		writeAPIError(w, http.StatusForbidden, auth.Forbidden(u, role))
+		return false
+	}
+	return true
+}
+
+// replicaRoles are the roles needed for the requests of depot replication
+// by method.
+var replicaRoles = map[string]auth.Role{
+	"GET":    auth.ReadOnly,
+	"HEAD":   auth.ReadOnly,
+	"PUT":    auth.Operator,
+	"DELETE": auth.Admin,
+}
+
+func authorizeReplica(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, ok := replicaRoles[r.Method]
+		if !ok {
+			role = auth.Admin
+		}
+		if !allowRole(w, r, role) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
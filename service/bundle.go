@@ -0,0 +1,100 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/bundle"
+)
+
+// stateSource returns what export-state puts in a state bundle.
+func (rs *RombaService) stateSource() *bundle.Source {
+	src := &bundle.Source{
+		Config:    rs.cfg.Path(),
+		DB:        rs.cfg.Index.Db,
+		LogDir:    rs.logDir,
+		Logs:      []string{queueFilename, jobLogDir, statsFilename},
+		Roots:     rs.cfg.Depot.Root,
+		RootFiles: archive.StateFiles(),
+	}
+
+	// the dat history is only bundled if it is kept in the log dir
+	rel, err := filepath.Rel(rs.logDir, rs.datSyncOpts.HistoryDir)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		src.Logs = append(src.Logs, rel)
+	}
+	return src
+}
+
+func (rs *RombaService) startExportState(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
+	if outpath == "" {
+		fmt.Fprintf(cmd.Stdout, "-out argument required")
+		return nil
+	}
+	if rs.cfg.Path() == "" {
+		fmt.Fprintf(cmd.Stdout, "the server wasn't started with a config file, its state can't be exported")
+		return nil
+	}
+
+	rs.startJob("export-state", func() (string, error) {
+		// no other job writes to the DB while this one runs, pausing it
+		// holds off the writes of commands like pin too
+		resume := rs.romDB.Pause()
+		var endMsg string
+		m, err := bundle.Export(outpath, rs.stateSource())
+		resume()
+		if err != nil {
+			logger.Errorf("error exporting state: %v", err)
+			endMsg = fmt.Sprintf("error exporting state: %v", err)
+		} else {
+			endMsg = fmt.Sprintf("exported the state of %s to %s, import it with rombaserver -import",
+				m.Host, outpath)
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started exporting state")
+	return nil
+}
@@ -33,10 +33,13 @@ package service
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"unicode"
 
 	"github.com/gonuts/commander"
 	"github.com/gonuts/flag"
+
+	"github.com/uwedeportivo/romba/replica"
 )
 
 type splitState struct {
@@ -107,20 +110,37 @@ func splitIntoArgs(argLine string) ([]string, error) {
 func newCommander(writer io.Writer, rs *RombaService) *commander.Commander {
 	cmd := new(commander.Commander)
 	cmd.Name = "Romba"
-	cmd.Commands = make([]*commander.Command, 14)
+	cmd.Commands = make([]*commander.Command, 39)
 	cmd.Flag = flag.NewFlagSet("romba", flag.ContinueOnError)
 	cmd.Stdout = writer
 	cmd.Stderr = writer
 
 	cmd.Commands[0] = &commander.Command{
 		Run:       rs.startRefreshDats,
-		UsageLine: "refresh-dats",
+		UsageLine: "refresh-dats [-include <regexp>] [-exclude <regexp>] [-regions <list>] [-categories <list>] [-conflicts] [list of DAT files or folders in the DAT master directory]",
 		Short:     "Refreshes the DAT index from the files in the DAT master directory tree.",
 		Long: `
 Refreshes the DAT index from the files in the DAT master directory tree.
 Detects any changes in the DAT master directory tree and updates the DAT index
 accordingly, marking deleted or overwritten dats as orphaned and updating
-contents of any changed dats.`,
+contents of any changed dats.
+The include, exclude, regions and categories flags leave games out of the
+index as DATs are parsed: only games whose name matches -include and not
+-exclude, whose name tags one of the comma-separated -regions, as in
+"Game (USA, Europe)", and that are of one of the comma-separated -categories
+are indexed. DATs indexed before keep their games, filters only apply to new
+or changed DATs.
+If -conflicts is set, the ROMs of all DATs are checked against each other for
+ROMs of a game defined with different hashes by two DATs, or by two games of
+the same name in one DAT, and for the same SHA1 given with different sizes.
+Those make builds pick ROMs the DATs don't agree on. The conflicts found are
+kept in the log directory and listed by the conflicts command. The check
+holds every ROM name and hash in memory while the DATs are read.
+If DAT files or folders are specified, relative to the DAT master directory
+or absolute, only those are refreshed: the DATs indexed from them before are
+marked as orphaned and they are indexed again, all other DATs are left as
+they are. A DAT index made by older versions of romba needs one full refresh
+before its DATs can be orphaned this way.`,
 		Flag:   *flag.NewFlagSet("romba-refresh-dats", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -128,50 +148,147 @@ contents of any changed dats.`,
 
 	cmd.Commands[1] = &commander.Command{
 		Run:       rs.startArchive,
-		UsageLine: "archive [-only-needed] [-include-zips] [-resume resumelog] <space-separated list of directories of ROM files>",
+		UsageLine: "archive [-only-needed] [-include-zips] [-extra-hashes] [-skip-headers] [-skippers <dir>] [-verify-imports] [-move-imports] [-member-buffer <MB>] [-quarantine <dir>] [-quarantine-copy] [-delete-sources] [-trash <dir>] [-trust-depot] [-low-water <MB>] [-require-space] [-max-member-size <MB>] [-max-ratio <ratio>] [-max-members <n>] [-read-buffer <KB>] [-max-read-rate <MB/s>] [-max-read-ops <n/s>] [-read-retries <n>] [-urls <file>] [-http-allow <nets>] [-resume resumelog] <space-separated list of directories of ROM files>",
 		Short:     "Adds ROM files from the specified directories to the ROM archive.",
 		Long: `
 Adds ROM files from the specified directories to the ROM archive.
-Traverses the specified directory trees looking for zip files and normal files.
+Traverses the specified directory trees looking for zip files, rar files,
+tar files (optionally compressed with gzip, bzip2 or xz) and normal files.
 Unpacked files will be stored as individual entries. Prior to unpacking a zip
 file, the external SHA1 is checked against the DAT index. 
+Gzip files made by other tools are stored both as they are and decompressed.
+Files laid out like a ROM archive (for example another romba depot) are
+taken over as they are, cloned or hardlinked where the filesystem allows it,
+instead of being recompressed. Their names are checked against the hashes in
+their headers, or against their decompressed contents if they have none or
+-verify-imports is set. Files that don't match are skipped. If -move-imports
+is set, they are moved instead.
+Members of zip, rar and tar files are hashed while being compressed into the
+ROM archive, in a single pass. With -skip-headers, which reads them a second
+time, members up to the size given by -member-buffer are held in memory,
+larger ones are read again from zip files and spooled into temp files for rar
+and tar files.
+If -quarantine is set, files that fail to be hashed or unpacked are moved into
+the specified directory, each with a report of its error, and the run goes on.
+If -quarantine-copy is set as well, they are copied instead.
+If -delete-sources is set, files are removed once all their contents are
+verified present in the ROM archive, along with directories left empty. Zip,
+rar and tar files are only removed if all their members were stored. If the
+trash is enabled, removed files go into it, from where undo restores them. If
+-trash is set as well, files are moved into the specified directory instead.
+If -trust-depot is set, files archived before from the same path are
+recognized by their modification time, size and a hash of their start and end
+and are not hashed again, as long as the ROM archive still has a file of the
+same size for them. It can't be combined with -delete-sources.
+Before starting, the size of the files to archive is compared against the space
+left in the ROM archive. If it doesn't fit, a warning is logged, or the archive
+refuses to start if -require-space is set. While running, archiving pauses
+whenever the free disk space of the ROM archive drops below the size given by
+-low-water, until space is freed.
+Zip, rar and tar files from untrusted sources can be guarded against with
+-max-member-size, -max-ratio and -max-members, which limit the decompressed
+size of members, the ratio of their decompressed to compressed size and the
+number of members. Files exceeding a limit fail to be archived.
+For files on network shares, -read-buffer sets the size of the reads issued,
+-max-read-rate and -max-read-ops limit how much and how often is read, and
+-read-retries sets how many times a read failing with an I/O error is retried
+after reopening the file. Rar files are read directly and not covered.
+Directories on SFTP servers are given as sftp://[user@]host[:port]/path, with
+an absolute path. Their files are streamed over ssh, which has to log in
+without prompting, instead of being copied first. Dropped connections are
+reopened as for -read-retries. Gzip, CHD and files laid out like a ROM archive
+are stored as they are, rar files must be single volume, and -quarantine and
+-delete-sources can't be used with them.
+Files on HTTP servers, like archive.org or other mirrors, are given by their
+http:// or https:// URLs, or listed one per line in the file named by -urls.
+They are streamed into the ROM archive like files on SFTP servers. Downloads
+cut short are resumed where they stopped, as many times as -read-retries
+allows, and fail if no data arrives for a minute. Servers are connected to
+directly, not through proxies, and those on loopback, private or link-local
+addresses are refused unless their network is listed, comma separated in
+CIDR notation, in -http-allow. The run report records each file by its URL.
+Each run writes a JSON report into the log directory, listing every file
+processed with the SHA1s of the ROMs found in it, whether they were new to
+the ROM archive, and the error it failed with, if any.
 If -only-needed is set, only those files are put in the ROM archive that
-have a current entry in the DAT index.`,
+have a current entry in the DAT index.
+If -extra-hashes is set, SHA256 and BLAKE3 digests are computed in addition
+to CRC, MD5 and SHA1 and stored with the ROM files.
+If -skip-headers is set, ROM files with a known header (NES, FDS, Lynx,
+Atari 7800) are additionally indexed and stored without their header, so
+that DATs listing headerless hashes match. -skippers names a directory of
+clrmamepro header skipper definitions (XML files, as shipped with No-Intro
+DATs) to use instead of the built-in ones.
+If -verify-chd is set, the tracks of CD image CHDs are extracted with chdman
+(general.chdman) and looked up in the DAT index, which lists them for redump
+DATs. The run report has the tracks of each CHD with the DATs listing them,
+tracks in no DAT are logged.`,
 
 		Flag:   *flag.NewFlagSet("romba-archive", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
+	cmd.Commands[0].Flag.String("include", "", "only index games whose name matches this regular expression")
+	cmd.Commands[0].Flag.String("exclude", "", "leave out games whose name matches this regular expression")
+	cmd.Commands[0].Flag.String("regions", "", "only index games tagged with one of these comma-separated regions")
+	cmd.Commands[0].Flag.String("categories", "", "only index games of one of these comma-separated categories")
+	cmd.Commands[0].Flag.Bool("conflicts", false, "check the ROMs of the DATs for conflicts")
+
 	cmd.Commands[1].Flag.Bool("only-needed", false, "only archive ROM files actually referenced by DAT files from the DAT index")
 	cmd.Commands[1].Flag.String("resume", "", "resume a previously interrupted archive operation from the specified path")
-	cmd.Commands[1].Flag.Bool("include-zips", false, "add zip files themselves into the depot in addition to their contents")
+	cmd.Commands[1].Flag.Bool("include-zips", false, "add zip, rar and tar files themselves into the depot in addition to their contents")
+	cmd.Commands[1].Flag.Bool("extra-hashes", false, "compute sha256 and blake3 digests in addition to crc, md5 and sha1")
+	cmd.Commands[1].Flag.Bool("skip-headers", false, "also archive headered ROM files without their header")
+	cmd.Commands[1].Flag.String("skippers", "", "directory of header skipper definitions to use with -skip-headers")
+	cmd.Commands[1].Flag.Bool("verify-imports", false, "decompress files from another ROM archive to verify them")
+	cmd.Commands[1].Flag.Bool("move-imports", false, "move files from another ROM archive instead of linking them")
+	cmd.Commands[1].Flag.Int("member-buffer", 4, "size in MB up to which archive members are held in memory for -skip-headers")
+	cmd.Commands[1].Flag.String("quarantine", "", "directory to move files that fail to be archived to")
+	cmd.Commands[1].Flag.Bool("quarantine-copy", false, "copy files that fail to be archived to the quarantine directory instead of moving them")
+	cmd.Commands[1].Flag.Bool("delete-sources", false, "remove files once their contents are in the ROM archive")
+	cmd.Commands[1].Flag.String("trash", "", "directory to move files to instead of removing them with -delete-sources")
+	cmd.Commands[1].Flag.Bool("trust-depot", false, "skip hashing files archived before if the ROM archive still has them")
+	cmd.Commands[1].Flag.Int("low-water", 1024, "free disk space in MB below which archiving pauses, 0 to disable")
+	cmd.Commands[1].Flag.Bool("require-space", false, "refuse to start if the files to archive may not fit into the ROM archive")
+	cmd.Commands[1].Flag.Int("max-member-size", 0, "largest decompressed size in MB of archive members, 0 for no limit")
+	cmd.Commands[1].Flag.Int("max-ratio", 0, "largest ratio of decompressed to compressed size of archive members, 0 for no limit")
+	cmd.Commands[1].Flag.Int("max-members", 0, "largest number of members of archives, 0 for no limit")
+	cmd.Commands[1].Flag.Int("read-buffer", 0, "size in KB of the reads issued to files to archive, 0 for the default")
+	cmd.Commands[1].Flag.Int("max-read-rate", 0, "limit reading files to archive to this many MB per second, 0 for no limit")
+	cmd.Commands[1].Flag.Int("max-read-ops", 0, "limit reading files to archive to this many reads per second, 0 for no limit")
+	cmd.Commands[1].Flag.Int("read-retries", 0, "how many times to retry reads of files to archive failing with an I/O error")
+	cmd.Commands[1].Flag.String("urls", "", "file listing URLs of files to archive, one per line")
+	cmd.Commands[1].Flag.String("http-allow", "", "comma separated networks in CIDR notation HTTP servers on loopback, private or link-local addresses may be in")
+	cmd.Commands[1].Flag.Bool("verify-chd", false, "extract the tracks of CD image CHDs to check them against the DATs")
 
 	cmd.Commands[2] = &commander.Command{
-		Run:       runCmd,
+		Run:       rs.purgeDelete,
 		UsageLine: "purge-delete <list of DAT files or folders with DAT files>",
-		Short:     "Deletes DAT index entries for orphaned DATs.",
+		Short:     "Deletes ROM files that are no longer needed by any current DAT.",
 		Long: `
-Deletes DAT index entries for orphaned DATs and deletes ROM files that are no
-longer associated with any current DATs. Deletes ROM files that are only
-associated with the specified DATs. It also deletes the specified DATs from
-the DAT index.`,
+Deletes ROM files that are no longer associated with any current DATs.
+A DAT is current if it was found by the last refresh-dats. The specified DATs
+are treated as no longer current, so ROM files that are only associated with
+them get deleted as well. ROM files of DATs pinned with pin are kept. If the
+trash is enabled, deleted ROM files are moved into it, from where undo restores
+them.`,
 		Flag:   *flag.NewFlagSet("romba-purge-delete", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
 	cmd.Commands[3] = &commander.Command{
-		Run:       runCmd,
+		Run:       rs.purgeBackup,
 		UsageLine: "purge-backup -backup <backupdir> <list of DAT files or folders with DAT files>",
-		Short:     "Moves DAT index entries for orphaned DATs.",
-		Long: `
-Deletes DAT index entries for orphaned DATs and moves ROM files that are no
-longer associated with any current DATs to the specified backup folder.
-Moves to the specified backup folder those ROM files that are only associated
-with the specified DATs. The files will be placed in the backup location using
-a folder structure according to the original DAT master directory tree
-structure. It also deletes the specified DATs from the DAT index.`,
+		Short:     "Moves ROM files that are no longer needed by any current DAT.",
+		Long: `
+Moves ROM files that are no longer associated with any current DATs to the
+specified backup folder. A DAT is current if it was found by the last
+refresh-dats. The specified DATs are treated as no longer current, so ROM
+files that are only associated with them get moved as well. The files will
+be placed in the backup location using the same folder structure as the
+ROM archive. ROM files of DATs pinned with pin are kept.`,
 		Flag:   *flag.NewFlagSet("romba-purge-backup", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -181,11 +298,18 @@ structure. It also deletes the specified DATs from the DAT index.`,
 
 	cmd.Commands[4] = &commander.Command{
 		Run:       rs.dir2dat,
-		UsageLine: "dir2dat -out <outputfile> -source <sourcedir>",
-		Short:     "Creates a DAT file for the specified input directory and saves it to the -out filename.",
+		UsageLine: "dir2dat [-grouping top|folders|files] [-xml] -out <outputdir> -source <sourcedir>",
+		Short:     "Creates a DAT file for the specified input directory and saves it in the -out directory.",
 		Long: `
 Walks the specified input directory and builds a DAT file that mirrors its
-structure. Saves this DAT file in specified output filename.`,
+structure. Saves this DAT file, named after -name, in the -out directory.
+Every file is hashed, including the members of zip files, which count as
+directories named like the zip file without its extension.
+-grouping decides which games files belong to: top makes a game of each
+directory directly in the input directory (the default), folders a game of
+each directory holding files and files a game of each file. Files directly in
+the input directory are games of their own.
+If -xml is set, a Logiqx XML DAT is written instead of a clrmamepro one.`,
 		Flag:   *flag.NewFlagSet("romba-dir2dat", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -198,14 +322,21 @@ structure. Saves this DAT file in specified output filename.`,
 	cmd.Commands[4].Flag.String("category", "", "category value in DAT header")
 	cmd.Commands[4].Flag.String("version", "", "vesrion value in DAT header")
 	cmd.Commands[4].Flag.String("author", "", "author value in DAT header")
+	cmd.Commands[4].Flag.String("grouping", "top", "games to make: top, folders or files")
+	cmd.Commands[4].Flag.Bool("xml", false, "write a Logiqx XML DAT")
 
 	cmd.Commands[5] = &commander.Command{
-		Run:       runCmd,
-		UsageLine: "diffdat -old <datfile> -new <datfile> -out <outputfile>",
+		Run:       rs.diffdat,
+		UsageLine: "diffdat -old <datfile> -new <datfile> [-out <outputfile>] [-json]",
 		Short:     "Creates a DAT file with those entries that are in -new DAT.",
 		Long: `
 Creates a DAT file with those entries that are in -new DAT file and not
-in -old DAT file. Ignores those entries in -old that are not in -new.`,
+in -old DAT file. Ignores those entries in -old that are not in -new.
+
+Prints the games and roms that were added, removed or changed between
+the two DAT files, down to the hashes that differ. With -json the
+changes are printed as a JSON object. Without -out only the changes
+are printed.`,
 		Flag:   *flag.NewFlagSet("romba-diffdat", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -214,6 +345,7 @@ in -old DAT file. Ignores those entries in -old that are not in -new.`,
 	cmd.Commands[5].Flag.String("out", "", "output filename")
 	cmd.Commands[5].Flag.String("old", "", "old DAT file")
 	cmd.Commands[5].Flag.String("new", "", "new DAT file")
+	cmd.Commands[5].Flag.Bool("json", false, "print the changes as JSON")
 
 	cmd.Commands[6] = &commander.Command{
 		Run:       runCmd,
@@ -231,14 +363,15 @@ particular DAT.`,
 	cmd.Commands[6].Flag.String("out", "", "output dir")
 
 	cmd.Commands[7] = &commander.Command{
-		Run:       runCmd,
-		UsageLine: "miss -out <outputdir> <list of DAT files or folders with DAT files>",
-		Short:     "For each specified DAT file it creates a miss file and a have file.",
+		Run:       rs.miss,
+		UsageLine: "miss -out <outputdir> [list of DAT files or folders with DAT files]",
+		Short:     "Reports the ROMs of the DAT files missing from the ROM archive.",
 		Long: `
-For each specified DAT file it creates a miss file and a have file in the
-specified output dir. The files will be placed in the specified location using
-a folder structure according to the original DAT master directory
-tree structure.`,
+For each specified DAT file, or for every indexed DAT file if none is
+specified, it checks which ROMs are in the ROM archive. A consolidated report
+with the number of ROMs had and missed per DAT, the total size of the missing
+ROMs and the hashes of the missing ROMs is written into the specified output
+dir as miss.txt, miss.csv and miss.json.`,
 		Flag:   *flag.NewFlagSet("romba-miss", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -248,30 +381,62 @@ tree structure.`,
 
 	cmd.Commands[8] = &commander.Command{
 		Run:       rs.build,
-		UsageLine: "build -out <outputdir> <list of DAT files or folders with DAT files>",
+		UsageLine: "build [-unzipped] [-chd] [-sets <mode>] -out <outputdir> <list of DAT files or folders with DAT files>",
 		Short:     "For each specified DAT file it creates the torrentzip files.",
 		Long: `
 For each specified DAT file it creates the torrentzip files in the specified
 output dir. The files will be placed in the specified location using a folder
-structure according to the original DAT master directory tree structure.`,
+structure according to the original DAT master directory tree structure.
+Games are written as torrentzip files, so identical sets always produce
+byte-identical zips. Roms missing from the ROM archive are listed in a
+fix-<DAT name>.dat next to the built DAT. Roms known only by CRC or MD5 are
+looked up in the DB. Games of a DAT are built in parallel, and the number of
+roms found and missing is reported when the build is done.
+If -unzipped is set, games are written as plain directories of files instead
+of zips, for emulators and flash carts that cannot read zips.
+If -chd is set, games of CD images, those with a cue or gdi file like in
+redump DATs, are written as CHDs made by chdman (general.chdman) from their
+tracks. Games missing tracks are written as plain directories.
+-sets picks how the roms of parents and clones, as given by the cloneof and
+romof attributes of the DAT, are spread over the games, like MAME expects
+them: non-merged games hold all their roms, split clones leave out the roms of
+their parent and BIOS, and merged parents also hold the roms of their clones,
+which aren't built; clone roms named like a different parent rom go in a
+folder named after the clone. By default games are built as the DAT lists
+them.
+The samples of games are built as sample sets, samples/<set>.zip next to the
+games, holding <sample>.wav files. Sample files are found by way of indexed
+DATs of sample sets, games named after the set with the .wav files as ROMs.
+Samples not in any of them are missing. Miss, audit, rebuild and fix handle
+samples the same way.`,
 		Flag:   *flag.NewFlagSet("romba-build", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
 	cmd.Commands[8].Flag.String("out", "", "output dir")
+	cmd.Commands[8].Flag.Bool("unzipped", false, "write games as directories instead of torrentzip files")
+	cmd.Commands[8].Flag.Bool("chd", false, "write games of CD images as CHDs")
+	cmd.Commands[8].Flag.String("sets", "", "build parents and clones as non-merged, split or merged sets")
 
 	cmd.Commands[9] = &commander.Command{
 		Run:       rs.lookup,
-		UsageLine: "lookup <list of hashes>",
-		Short:     "For each specified hash it looks up any available information.",
+		UsageLine: "lookup [-json] <list of hashes, files or game names>",
+		Short:     "For each specified hash, file or game name it looks up any available information.",
 		Long: `
-For each specified hash it looks up any available information (dat or rom).`,
+For each specified hash it looks up any available information: the DAT with
+that hash, the games of the indexed DATs referencing the rom, whether the ROM
+archive has it and the source files it was archived from. Files of the server
+are hashed and looked up the same way, for operators and admins. Anything else is taken as part of a game name, and the
+games of the indexed DATs with names containing it, ignoring case, are listed.
+If -json is set, the results are printed as JSON objects.`,
 		Flag:   *flag.NewFlagSet("romba-lookup", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
+	cmd.Commands[9].Flag.Bool("json", false, "print the results as JSON")
+
 	cmd.Commands[10] = &commander.Command{
 		Run:       rs.progress,
 		UsageLine: "progress",
@@ -315,5 +480,557 @@ Print db stats.`,
 		Stdout: writer,
 		Stderr: writer,
 	}
+
+	cmd.Commands[14] = &commander.Command{
+		Run:       rs.startScrub,
+		UsageLine: "scrub [-quarantine] [-max-rate <MB/s>] [-resume resumelog]",
+		Short:     "Verifies the contents of all files in the ROM archive.",
+		Long: `
+Verifies the contents of all files in the ROM archive.
+Decompresses every file in the depot and checks that the SHA1 of its contents
+matches its name. Files that fail verification are listed in a report in the
+log directory. If -quarantine is set, they are also moved out of the depot
+into a quarantine folder in their depot root.`,
+		Flag:   *flag.NewFlagSet("romba-scrub", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[14].Flag.Bool("quarantine", false, "move files that fail verification out of the depot")
+	cmd.Commands[14].Flag.Int("max-rate", 0, "limit reading from the depot to this many MB per second, 0 for no limit")
+	cmd.Commands[14].Flag.String("resume", "", "resume a previously interrupted scrub operation from the specified path")
+
+	cmd.Commands[15] = &commander.Command{
+		Run:       rs.startRecompress,
+		UsageLine: "recompress -compression <gzip|zstd>",
+		Short:     "Recompresses all files in the ROM archive with the specified compression.",
+		Long: `
+Recompresses all files in the ROM archive that are not already compressed with
+the specified compression (gzip or zstd). Files are replaced in place.
+To keep writing new files with the same compression, set compression in the
+depot section of the config file.`,
+		Flag:   *flag.NewFlagSet("romba-recompress", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[15].Flag.String("compression", "", "compression to convert the ROM archive to, gzip or zstd")
+
+	cmd.Commands[16] = &commander.Command{
+		Run:       rs.export,
+		UsageLine: "export [-by-game] [-copy] -out <outputdir> <list of DAT files or folders with DAT files>",
+		Short:     "Exports the ROM archive files needed by the specified DAT files.",
+		Long: `
+Exports the files of the ROM archive needed by each specified DAT file into the
+specified output dir, so a single set can be shared without handing over the
+whole ROM archive. Files are exported as they are stored in the ROM archive,
+cloned or hardlinked where the filesystem allows it and copied otherwise.
+By default the output dir gets the same layout as the ROM archive and can be
+archived into another one as is. If -by-game is set, files are placed into a
+folder per game instead, named after their ROM, in a folder structure according
+to the original DAT master directory tree structure.
+If -copy is set, files are always copied.`,
+		Flag:   *flag.NewFlagSet("romba-export", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[16].Flag.String("out", "", "output dir")
+	cmd.Commands[16].Flag.Bool("by-game", false, "lay out exported files by game instead of by SHA1")
+	cmd.Commands[16].Flag.Bool("copy", false, "copy files instead of cloning or hardlinking them")
+
+	cmd.Commands[17] = &commander.Command{
+		Run:       rs.startManifest,
+		UsageLine: "manifest [-subtree <path>]",
+		Short:     "Updates the manifest of the ROM archive.",
+		Long: `
+Updates the manifest file .romba_manifest in the root of each depot dir. It
+lists every file of the ROM archive with its SHA1, uncompressed size, path
+relative to the depot dir and compression, one per line and sorted by path, so
+off-site replication tools and integrity checkers can work off it instead of
+walking the ROM archive.
+Only files added since the manifest was last updated have their headers read.
+If -subtree is set, only the part of the depot dirs below that relative path
+(for example ab/cd) is walked and the rest of the manifest is kept as is.`,
+		Flag:   *flag.NewFlagSet("romba-manifest", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[17].Flag.String("subtree", "", "relative path of the part of the depot to update")
+
+	cmd.Commands[18] = &commander.Command{
+		Run:       rs.startRelayout,
+		UsageLine: "relayout -depth <levels> -width <hex digits>",
+		Short:     "Changes how the ROM archive is split into directories.",
+		Long: `
+Moves every file of the ROM archive into a directory tree of the specified
+depth, with directories named after the specified number of leading hex digits
+of the SHA1. The default layout has a depth of 4 and a width of 2, some
+filesystems perform better with fewer or more directories.
+The layout is recorded in the file .romba_layout in the root of each depot dir.
+An interrupted relayout can be finished by running it again, in the meantime
+files are found in either layout.`,
+		Flag:   *flag.NewFlagSet("romba-relayout", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[18].Flag.Int("depth", 4, "number of directory levels")
+	cmd.Commands[18].Flag.Int("width", 2, "number of hex digits per directory level")
+
+	cmd.Commands[19] = &commander.Command{
+		Run:       rs.hashBench,
+		UsageLine: "hash-bench [-size <MB>]",
+		Short:     "Benchmarks and self-tests the hash engines.",
+		Long: `
+Hashes a buffer of the specified size, at most 1024 MB, with every algorithm of
+every hash engine and prints the throughput of each, and of all algorithms together as ROM files
+are hashed. Fails if an engine computes different digests than the std engine.
+The engine ROM files are hashed with is chosen with hashengine in the general
+section of romba.ini.`,
+		Flag:   *flag.NewFlagSet("romba-hash-bench", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[19].Flag.Int("size", 64, "size in MB of the buffer to hash")
+
+	cmd.Commands[20] = &commander.Command{
+		Run:       rs.audit,
+		UsageLine: "audit -set <set folder> -out <outputdir> <list of DAT files or folders with DAT files>",
+		Short:     "Checks a set folder against the specified DAT files.",
+		Long: `
+Compares the contents of the set folder against each specified DAT file, without
+changing anything. Games are expected as zip files or folders named after the
+game, holding files named after its ROMs, as build creates them. Sample
+sets are expected in the samples folder of the set folder.
+For each DAT file, four reports are written into the specified output dir, in a
+folder structure according to the original DAT master directory tree structure:
+<dat>-have.txt lists the ROMs found where they belong, <dat>-miss.txt the ROMs
+not found, <dat>-unneeded.txt the files the DAT doesn't need and
+<dat>-wrongly-named.txt the files holding a ROM of the DAT under the wrong name
+or in the wrong game, along with where they belong.`,
+		Flag:   *flag.NewFlagSet("romba-audit", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[20].Flag.String("set", "", "set folder to check")
+	cmd.Commands[20].Flag.String("out", "", "output dir")
+
+	cmd.Commands[21] = &commander.Command{
+		Run:       rs.rebuild,
+		UsageLine: "rebuild [-unzipped] [-backup <dir>] -set <set folder> -out <outputdir> <DAT file>",
+		Short:     "Rebuilds a set folder in place to match the specified DAT file.",
+		Long: `
+Renames, moves and rezips the contents of the set folder so that it holds the
+games of the specified DAT file named and structured exactly as in the DAT, as
+build would create them. ROM files are taken from wherever they are in the set
+folder, ROM files it doesn't have are taken from the ROM archive. Games already
+matching the DAT are left alone, every other file in the set folder is replaced.
+Replaced files are moved into the specified directory if -backup is set, into
+the trash, from where undo restores them, if it is enabled.
+Set folders of DATs protected with pin -protect are refused.
+If -unzipped is set, games are rebuilt as folders of plain files instead of
+torrentzip files.
+ROM files missing from both the set folder and the ROM archive are listed in a
+fix DAT written into the specified output dir.`,
+		Flag:   *flag.NewFlagSet("romba-rebuild", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[21].Flag.Bool("unzipped", false, "rebuild games as folders of plain files")
+	cmd.Commands[21].Flag.String("backup", "", "directory to move replaced files to")
+	cmd.Commands[21].Flag.String("set", "", "set folder to rebuild")
+	cmd.Commands[21].Flag.String("out", "", "output dir")
+
+	cmd.Commands[22] = &commander.Command{
+		Run:       rs.fix,
+		UsageLine: "fix [-unzipped] [-backup <dir>] -set <set folder> -out <outputdir> <DAT file>",
+		Short:     "Fixes a set folder in place against the specified DAT file.",
+		Long: `
+Audits the set folder against the specified DAT file, then renames wrongly
+named ROM files, removes files the DAT doesn't need and fills in missing ROM
+files from the ROM archive. Games already matching the DAT are left alone.
+Removed and replaced files are moved into the specified directory if -backup is
+set, into the trash, from where undo restores them, if it is enabled.
+Set folders of DATs protected with pin -protect are refused.
+If -unzipped is set, games are expected and written as folders of plain files
+instead of torrentzip files.
+The audit reports of the set folder as it was found, as written by audit, and a
+fix DAT of the ROM files still missing are written into the specified output
+dir.`,
+		Flag:   *flag.NewFlagSet("romba-fix", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[22].Flag.Bool("unzipped", false, "games are folders of plain files")
+	cmd.Commands[22].Flag.String("backup", "", "directory to move removed files to")
+	cmd.Commands[22].Flag.String("set", "", "set folder to fix")
+	cmd.Commands[22].Flag.String("out", "", "output dir")
+
+	cmd.Commands[23] = &commander.Command{
+		Run:       rs.queueCmd,
+		UsageLine: "queue [-priority <n>] [-workers <n>] [-nice <n>] [-io-limit <rate>] <command> [flags and arguments of the command]",
+		Short:     "Queues a command to run once the jobs before it are done.",
+		Long: `
+Queues the specified command, like archive, refresh-dats or build, to run after
+the running job and the jobs queued before it, so heavy operations run one
+after the other instead of being refused while another one is running.
+Commands with a higher -priority run first, commands with the same priority in
+the order they were queued. The queue survives a restart of the server.
+
+-workers, -nice and -io-limit limit the resources of the job, so that a
+background job like a scrub can run alongside interactive use of the server:
+the number of workers instead of general.workers, the niceness added to the
+worker threads (on linux, negative values need privileges) and the bytes per
+second the workers read, like 20MB, shared by the reads of archive, scrub,
+recompress and dir2dat.`,
+		Flag:   *flag.NewFlagSet("romba-queue", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[23].Flag.Int("priority", 0, "priority of the command, higher runs first")
+	cmd.Commands[23].Flag.Int("workers", 0, "number of workers of the job, general.workers if 0")
+	cmd.Commands[23].Flag.Int("nice", 0, "niceness added to the workers of the job")
+	cmd.Commands[23].Flag.String("io-limit", "", "bytes per second the workers of the job read")
+
+	cmd.Commands[24] = &commander.Command{
+		Run:       rs.jobsCmd,
+		UsageLine: "jobs [-skipped] [job ID]",
+		Short:     "Lists the recent jobs and the queue.",
+		Long: `
+Lists the recent jobs with their state and end message, then the queued jobs in
+the order they will run. If a job ID is specified, only that job is shown.
+Jobs that skipped files, because they weren't of the kind the job handles,
+couldn't be read, failed or were left out for another reason, give how many
+for each reason. If -skipped is set and a job ID is specified, the first
+files the job skipped are listed with their reason.`,
+		Flag:   *flag.NewFlagSet("romba-jobs", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[24].Flag.Bool("skipped", false, "list the files skipped by the job")
+
+	cmd.Commands[25] = &commander.Command{
+		Run:       rs.cancelCmd,
+		UsageLine: "cancel <list of job IDs>",
+		Short:     "Takes queued jobs out of the queue.",
+		Long: `
+Takes the specified jobs out of the queue. Running jobs cannot be cancelled.
+Only admins may cancel jobs queued by other users or by the service.`,
+		Flag:   *flag.NewFlagSet("romba-cancel", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[26] = &commander.Command{
+		Run:       rs.startReplicate,
+		UsageLine: "replicate -remote <host:port> [-deletions keep|report|delete] [-force] [-chunk <MB>]",
+		Short:     "Copies the ROM archive to a secondary romba.",
+		Long: `
+Compares the manifests of the ROM archive and of the one of the romba server
+listening at the specified address, and uploads the files the secondary is
+missing. Uploads are sent in chunks of the specified size in MB, an interrupted
+upload is resumed where it stopped, and the secondary checks every file against
+its SHA1 before adding it.
+ROMs only the secondary has are kept by default. With -deletions report they
+are listed in a file in the log dir, with -deletions delete they are removed
+from the secondary, which needs acceptdeletes set in its [replica] config.
+Deleting is refused if the ROM archive is empty or more than a tenth of the
+secondary's ROMs would go, unless -force is given.
+If the secondary has users, token in the [replica] config is sent along, it
+needs to be the one of an operator of the secondary, or of an admin for
+-deletions delete.`,
+		Flag:   *flag.NewFlagSet("romba-replicate", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[26].Flag.String("remote", "", "address of the secondary romba server")
+	cmd.Commands[26].Flag.String("deletions", replica.KeepExtras, "what to do with ROMs only the secondary has: keep, report or delete")
+	cmd.Commands[26].Flag.Bool("force", false, "delete ROMs only the secondary has even if they are many")
+	cmd.Commands[26].Flag.Int("chunk", replica.DefaultChunkSize>>20, "upload chunk size in MB")
+
+	cmd.Commands[27] = &commander.Command{
+		Run:       rs.mount,
+		UsageLine: "mount [-cache <MB>] <dir>",
+		Short:     "Mounts a read-only view of the DATs built from the ROM archive.",
+		Long: `
+Mounts a read-only filesystem on the specified directory that mirrors the DAT
+master directory tree, with a directory for each DAT holding a directory for
+each game with the ROM files of the game in the ROM archive, so emulators can
+read sets without building them. DAT files holding several DATs get a
+directory for each DAT in between.
+ROM files are decompressed from the ROM archive when opened and kept in a
+cache of at most the specified size in MB. Only Linux is supported.`,
+		Flag:   *flag.NewFlagSet("romba-mount", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[27].Flag.Int("cache", 1024, "cache size in MB")
+
+	cmd.Commands[28] = &commander.Command{
+		Run:       rs.unmount,
+		UsageLine: "unmount <dir>",
+		Short:     "Unmounts a view of the DATs mounted by mount.",
+		Long: `
+Unmounts the view of the DATs mounted on the specified directory by mount and
+removes its cache. Unmounting fails while files of the view are in use.`,
+		Flag:   *flag.NewFlagSet("romba-unmount", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[29] = &commander.Command{
+		Run:       rs.makeTorrents,
+		UsageLine: "torrent [-piece <KB>] [-trackers <list>] [-comment <text>] [-private] [-skip-check] -out <outputdir> <list of DAT files or folders with DAT files>",
+		Short:     "Creates torrent files of the sets built by build.",
+		Long: `
+For each specified DAT file it creates a torrent file of the torrentzip files
+built by build into the specified output dir, named after the DAT and placed
+next to its folder. Torrents hold no creation date, so torrents of the same
+sets with the same options are identical wherever they are created.
+Before creating a torrent, every game of the DAT is built again from the ROM
+archive in memory and compared to the built torrentzip file, so only sets that
+are byte-identical to what romba builds get a torrent. DATs with missing,
+changed or unknown files are reported and skipped. -skip-check leaves out the
+comparison.
+The piece size is picked from the size of the set unless set with -piece, in
+KB, to a power of two. -trackers takes a comma-separated list of announce
+URLs.`,
+		Flag:   *flag.NewFlagSet("romba-torrent", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[29].Flag.String("out", "", "output dir of the build")
+	cmd.Commands[29].Flag.Int("piece", 0, "piece size in KB, picked from the set size if 0")
+	cmd.Commands[29].Flag.String("trackers", "", "comma-separated list of tracker announce URLs")
+	cmd.Commands[29].Flag.String("comment", "", "comment stored in the torrents")
+	cmd.Commands[29].Flag.Bool("private", false, "mark the torrents private")
+	cmd.Commands[29].Flag.Bool("skip-check", false, "don't compare the sets to a build from the ROM archive")
+
+	cmd.Commands[30] = &commander.Command{
+		Run:       rs.startDatSync,
+		UsageLine: "datsync [-no-refresh]",
+		Short:     "Fetches DATs from the URLs in the datsync config.",
+		Long: `
+Fetches the DAT files, zips of DATs and the DATs linked to by index pages at
+the URLs in the [datsync] section of the config into a folder for each host in
+the datsync folder of the DAT master directory tree. DATs that haven't changed
+since the last sync are not fetched again. DATs replaced by a newer version or
+no longer published are moved into the DAT history folder, which keeps the
+configured number of old versions of each DAT.
+If any DAT was added, updated or removed, the DAT index is refreshed like
+refresh-dats does, unless -no-refresh is set. With an interval in the config,
+a datsync is queued that often.`,
+		Flag:   *flag.NewFlagSet("romba-datsync", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[30].Flag.Bool("no-refresh", false, "don't refresh the DAT index after changes")
+
+	cmd.Commands[31] = &commander.Command{
+		Run:       rs.recoverCmd,
+		UsageLine: "recover [-resume | -rollback] [<list of job ids>]",
+		Short:     "Lists, resumes or rolls back jobs interrupted by a crash.",
+		Long: `
+Jobs the daemon stopped in the middle of, because of a crash, a power failure
+or a shutdown, are found when it starts again and kept as interrupted. Without
+flags, recover lists how each of them can be finished: archive and scrub runs
+resume after the path their resume log says they were done up to, other jobs
+run their command again. Builds leave partial games behind in their output
+folder, which a rollback removes.
+With -resume the jobs are queued to run again, with -rollback the partial
+files they left behind are removed. Without job IDs all interrupted jobs are
+listed, resumed or rolled back. The recovery setting of the [general] config
+section does either at startup.`,
+		Flag:   *flag.NewFlagSet("romba-recover", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[31].Flag.Bool("resume", false, "queue the jobs to run again from where they stopped")
+	cmd.Commands[31].Flag.Bool("rollback", false, "remove the partial files the jobs left behind")
+
+	cmd.Commands[32] = &commander.Command{
+		Run:       rs.startStats,
+		UsageLine: "stats",
+		Short:     "Counts the files and bytes of the depot and reports its growth.",
+		Long: `
+Counts the files and bytes in each root of the depot, and the roms that were
+archived from more than one source file by the provenance records. The counts
+are kept as a sample in the log folder, and the growth of the depot over the
+last day, week and month is worked out from the samples kept. With an
+interval in the [stats] section of the config, stats is queued that often.`,
+		Flag:   *flag.NewFlagSet("romba-stats", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[33] = &commander.Command{
+		Run:       rs.undoCmd,
+		UsageLine: "undo [<list of trash operation ids>]",
+		Short:     "Lists the trash or restores the files an operation moved into it.",
+		Long: `
+If enabled in the [trash] section of the config, files removed by purge-delete,
+fix, rebuild and archive -delete-sources are moved into the trash instead, one
+dated folder per run, unless a backup or trash folder is given to them. The
+message of the job tells the id of its trash operation. Without arguments, undo
+lists the operations in the trash.
+Given ids, it moves the files of those operations back to where they were.
+Files whose path is taken again stay in the trash and are restored by a later
+undo once it is free. Undo refuses to run while a job is running.
+Depot files go into the .romba_trash folder of their depot root, other files
+into the dir of the [trash] section, logdir/trash by default. Operations older
+than its days are emptied for good.`,
+		Flag:   *flag.NewFlagSet("romba-undo", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[34] = &commander.Command{
+		Run:       rs.pin,
+		UsageLine: "pin [-protect | -unpin] [<list of DAT files or folders with DAT files>]",
+		Short:     "Pins or protects DATs against destructive commands.",
+		Long: `
+Pins the specified DATs: the ROM files they need are never removed from the ROM
+archive, neither by purge-delete and purge-backup, even once the DATs are no
+longer current, nor by a primary replicating with deletions. If -protect is
+set, the DATs are protected as well: fix and rebuild refuse to change set
+folders against them. If -unpin is set, the DATs lose both flags.
+Only DATs indexed by refresh-dats can be flagged, zip and gzip files flag the
+DATs in them. Flags are kept in the DB by DAT path and last across
+refresh-dats. Without arguments, pin lists the flagged DATs.`,
+		Flag:   *flag.NewFlagSet("romba-pin", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[34].Flag.Bool("protect", false, "also refuse fix and rebuild of set folders against the DATs")
+	cmd.Commands[34].Flag.Bool("unpin", false, "clear the flags of the DATs")
+
+	cmd.Commands[35] = &commander.Command{
+		Run:       rs.startExportState,
+		UsageLine: "export-state -out <file>",
+		Short:     "Exports the state of romba into a bundle.",
+		Long: `
+Writes the state of romba into one tar.gz file: the config file, the DB, the
+manifest, layout and provenance files of the depot roots, the job queue, the
+job logs, the depot statistics and the DAT history. The depot itself is not
+in the bundle, it has to be copied separately.
+
+To move romba to a new machine, or for a disaster recovery drill, copy the
+depot and run rombaserver -import <file> there before starting it. The DB is
+restored into the DB dir of the config given with -config, which must not
+exist yet; the bundled config is used if there is no config file.`,
+		Flag:   *flag.NewFlagSet("romba-export-state", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[35].Flag.String("out", "", "the bundle file to write")
+
+	cmd.Commands[36] = &commander.Command{
+		Run:       rs.startImportScan,
+		UsageLine: "import-scan [-root <dir>] <list of scan result DATs>",
+		Short:     "Indexes the roms in the scan result DATs other ROM managers export.",
+		Long: `
+Reads the scan results ROMVault or clrmamepro export as DATs and indexes the
+roms in them with their hashes, as archive does for the files it archives, for
+users switching to romba. Roms without a SHA1 are skipped.
+
+Only the DAT exports are read: "Save Full DAT" in ROMVault, "Create DAT" in the
+clrmamepro scanner. The binary caches of the tools (RomVault3cache.Cache, the
+clrmamepro scanner cache) are not, their formats are undocumented and change
+between versions, and are refused with a hint to export the DAT.
+
+The roms are indexed with the folder of their set below -root, where the tool
+keeps the collection, or below the folder of the scan result file if -root is
+not set.`,
+		Flag:   *flag.NewFlagSet("romba-import-scan", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[36].Flag.String("root", "", "the folder the tool keeps the collection in")
+
+	cmd.Commands[37] = &commander.Command{
+		Run:       rs.conflicts,
+		UsageLine: "conflicts [-kind name|size] [-json]",
+		Short:     "Lists the ROM conflicts between DATs found by the last refresh.",
+		Long: `
+Lists the conflicts found by the last refresh-dats -conflicts: ROMs of a game
+defined with different hashes by two DATs or two games of one DAT (kind name),
+and ROMs with the same SHA1 and different sizes (kind size). Each conflict
+gives the DAT, game, ROM, size and hashes of the first definition seen and of
+the one differing from it. -kind only lists conflicts of that kind, -json
+writes them as JSON. The report is also served at /api/conflicts.`,
+		Flag:   *flag.NewFlagSet("romba-conflicts", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[37].Flag.String("kind", "", "only list conflicts of this kind, name or size")
+	cmd.Commands[37].Flag.Bool("json", false, "write the conflicts as JSON")
+
+	cmd.Commands[38] = &commander.Command{
+		Run:       rs.dedup,
+		UsageLine: "dedup [-top <n>] -out <outputdir> [list of DAT files or folders with DAT files]",
+		Short:     "Reports how much the DAT files share their ROMs.",
+		Long: `
+For each specified DAT file, or for every indexed DAT file if none is
+specified, it counts the different ROMs of the DAT and their size, and how
+many of them no other DAT has. Those are the marginal cost of the DAT: the
+ROMs the ROM archive only holds for it. The same is counted for each tree of
+DATs, the folders right below the specified folder, against the DATs of the
+other trees. Along with the ROMs referenced by the most DATs, -top of them,
+the report is written into the specified output dir as dedup.txt and
+dedup.json, with DATs and trees ordered by marginal size. ROMs are told apart
+by SHA1, or by CRC and size for DATs without SHA1s.`,
+		Flag:   *flag.NewFlagSet("romba-dedup", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Commands[38].Flag.Int("top", 100, "number of most shared ROMs to report")
+	cmd.Commands[38].Flag.String("out", "", "output dir")
 	return cmd
 }
+
+// CommandHelp describes a command of the service.
+type CommandHelp struct {
+	Name  string
+	Usage string
+	Short string
+	// Flags are the flag names of the command, with their dash.
+	Flags []string
+}
+
+// Commands describes the commands the service runs, for clients offering
+// them.
+func Commands() []*CommandHelp {
+	cmd := newCommander(ioutil.Discard, nil)
+
+	helps := make([]*CommandHelp, 0, len(cmd.Commands))
+	for _, c := range cmd.Commands {
+		ch := &CommandHelp{
+			Name:  c.Name(),
+			Usage: c.UsageLine,
+			Short: c.Short,
+		}
+		c.Flag.VisitAll(func(f *flag.Flag) {
+			ch.Flags = append(ch.Flags, "-"+f.Name)
+		})
+		helps = append(helps, ch)
+	}
+	return helps
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/db"
+)
+
+// conflictsFilename is the file in the log dir the conflicts found by the
+// last refresh-dats -conflicts are kept in.
+const conflictsFilename = "refresh-conflicts.json"
+
+func (rs *RombaService) conflictsPath() string {
+	return filepath.Join(rs.logDir, conflictsFilename)
+}
+
+// saveConflicts writes the report of cc into the log dir and returns its
+// summary.
+func (rs *RombaService) saveConflicts(cc *db.ConflictChecker) string {
+	report := cc.Report()
+	err := report.Write(rs.conflictsPath())
+	if err != nil {
+		logger.Errorf("error writing conflicts report: %v", err)
+		return fmt.Sprintf("failed to write conflicts report: %v", err)
+	}
+	return report.String()
+}
+
+func (rs *RombaService) conflicts(cmd *commander.Command, args []string) error {
+	report, err := db.ReadConflictReport(rs.conflictsPath())
+	if err != nil {
+		return err
+	}
+	if report == nil {
+		fmt.Fprintf(cmd.Stdout, "no conflicts report, run refresh-dats -conflicts")
+		return nil
+	}
+
+	kind := cmd.Flag.Lookup("kind").Value.Get().(string)
+	if kind != "" && kind != db.ConflictName && kind != db.ConflictSize {
+		return fmt.Errorf("unknown conflict kind %q, want %s or %s", kind, db.ConflictName, db.ConflictSize)
+	}
+
+	conflicts := report.Conflicts[:0:0]
+	for _, c := range report.Conflicts {
+		if kind == "" || c.Kind == kind {
+			conflicts = append(conflicts, c)
+		}
+	}
+
+	if cmd.Flag.Lookup("json").Value.Get().(bool) {
+		bs, err := json.MarshalIndent(conflicts, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.Stdout, "%s", bs)
+		return nil
+	}
+
+	fmt.Fprintf(cmd.Stdout, "%v as of %s", report, report.Time.Format("2006-01-02 15:04"))
+	for _, c := range conflicts {
+		fmt.Fprintf(cmd.Stdout, "\n%v", c)
+	}
+	if report.Dropped > 0 {
+		fmt.Fprintf(cmd.Stdout, "\n%d more conflicts left out", report.Dropped)
+	}
+	return nil
+}
+
+func (rs *RombaService) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	report, err := db.ReadConflictReport(rs.conflictsPath())
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if report == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no conflicts report, run refresh-dats -conflicts"))
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
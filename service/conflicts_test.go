@@ -0,0 +1,173 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// refreshTestDB takes dats to index and forgets them
+type refreshTestDB struct {
+	lookupTestDB
+}
+
+func (rdb *refreshTestDB) OrphanDats() error      { return nil }
+func (rdb *refreshTestDB) BeginDatRefresh() error { return nil }
+func (rdb *refreshTestDB) EndDatRefresh() error   { return nil }
+func (rdb *refreshTestDB) Flush()                 {}
+func (rdb *refreshTestDB) StartBatch() db.RomBatch {
+	return new(db.NoOpBatch)
+}
+
+const conflictsDatA = `
+clrmamepro (
+	name "a"
+	description "a"
+)
+
+game (
+	name "game"
+	description "game"
+	rom ( name "a.bin" size 4 crc 12345678 sha1 0123456789012345678901234567890123456789 )
+	rom ( name "b.bin" size 4 crc 87654321 sha1 9876543210987654321098765432109876543210 )
+)
+`
+
+const conflictsDatB = `
+clrmamepro (
+	name "b"
+	description "b"
+)
+
+game (
+	name "game"
+	description "game"
+	rom ( name "a.bin" size 4 crc 12345678 sha1 0123456789012345678901234567890123456789 )
+	rom ( name "b.bin" size 4 crc 11111111 sha1 1111111111111111111111111111111111111111 )
+)
+
+game (
+	name "other"
+	description "other"
+	rom ( name "c.bin" size 8 sha1 0123456789012345678901234567890123456789 )
+)
+`
+
+func TestConflicts(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-conflicts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, text := range map[string]string{"a.dat": conflictsDatA, "b.dat": conflictsDatB} {
+		err = ioutil.WriteFile(filepath.Join(datsDir, name), []byte(text), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rdb := &refreshTestDB{lookupTestDB{dat: &types.Dat{Name: "test"}}}
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewRombaService(rdb, depot, testConfig(datsDir, root))
+
+	out, _, err := rs.runCommand([]string{"conflicts"}, nil)
+	if err != nil || !strings.HasPrefix(out, "no conflicts report") {
+		t.Errorf("got %q, %v before any refresh", out, err)
+	}
+
+	_, started, err := rs.runCommand([]string{"refresh-dats", "-conflicts"}, nil)
+	if err != nil || started == nil {
+		t.Fatalf("refresh-dats didn't start a job: %v", err)
+	}
+	job := waitForJob(t, rs, started.ID)
+	if job.State != JobDone || !strings.Contains(job.Message, "found 2 rom conflicts") {
+		t.Fatalf("got job %+v, want 2 conflicts found", job)
+	}
+
+	out, _, err = rs.runCommand([]string{"conflicts", "-kind", "name"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "name conflict") || !strings.Contains(out, "game/b.bin") ||
+		strings.Contains(out, "size conflict") {
+		t.Errorf("got name conflicts %q", out)
+	}
+
+	server := httptest.NewServer(rs.APIHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := new(db.ConflictReport)
+	err = json.NewDecoder(resp.Body).Decode(report)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := make(map[string]int)
+	for _, c := range report.Conflicts {
+		kinds[c.Kind]++
+		if c.Kind == db.ConflictSize && (c.First.Size != 4 || c.Other.Size != 8 || c.Other.Game != "other") {
+			t.Errorf("got size conflict %v", c)
+		}
+	}
+	if kinds[db.ConflictName] != 1 || kinds[db.ConflictSize] != 1 {
+		t.Errorf("got conflicts %v, want one of each kind", kinds)
+	}
+}
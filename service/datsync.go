@@ -0,0 +1,113 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/datsync"
+	"github.com/uwedeportivo/romba/db"
+)
+
+func (rs *RombaService) startDatSync(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	if len(rs.datSyncURLs) == 0 {
+		return fmt.Errorf("no datsync.url in the config")
+	}
+
+	noRefresh := cmd.Flag.Lookup("no-refresh").Value.Get().(bool)
+
+	rs.startJob("datsync", func() (string, error) {
+		var endMsg string
+		report, err := datsync.Sync(rs.datSyncURLs, rs.datSyncOpts)
+		if err != nil {
+			logger.Errorf("error syncing dats: %v", err)
+			endMsg = fmt.Sprintf("error syncing dats: %v", err)
+		} else {
+			for _, f := range report.Added {
+				rs.jobLogf("added dat %s", f)
+			}
+			for _, f := range report.Updated {
+				rs.jobLogf("updated dat %s", f)
+			}
+			for _, f := range report.Removed {
+				rs.jobLogf("removed dat %s", f)
+			}
+			for _, f := range report.Failed {
+				rs.jobLogf("failed to sync %s", f)
+			}
+			endMsg = report.String()
+
+			if report.Changed() && !noRefresh {
+				rs.jobLogf("refreshing dats")
+
+				var refreshMsg string
+				refreshMsg, err = rs.refreshSynced(report)
+				if err != nil {
+					logger.Errorf("error refreshing dats: %v", err)
+				}
+				endMsg += "\n" + refreshMsg
+			}
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started datsync")
+	return nil
+}
+
+// refreshSynced indexes the dats a sync added or updated, and orphans the
+// ones it removed, leaving the other dats alone.
+func (rs *RombaService) refreshSynced(report *datsync.Report) (string, error) {
+	for _, f := range report.Removed {
+		_, err := rs.romDB.OrphanDatsUnder(filepath.Join(rs.datSyncOpts.Dir, f))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var paths []string
+	for _, f := range append(report.Added, report.Updated...) {
+		paths = append(paths, filepath.Join(rs.datSyncOpts.Dir, f))
+	}
+	if len(paths) == 0 {
+		return fmt.Sprintf("orphaned the dats of %d removed files", len(report.Removed)), nil
+	}
+	return db.RefreshPaths(rs.romDB, paths, rs.workers(), rs.tracker(), nil, nil)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func (rs *RombaService) dedup(cmd *commander.Command, args []string) error {
+	if len(args) == 0 {
+		args = []string{rs.dats}
+	}
+
+	top := cmd.Flag.Lookup("top").Value.Get().(int)
+	if top < 0 {
+		return fmt.Errorf("-top must not be negative")
+	}
+
+	outpath, err := filepath.Abs(cmd.Flag.Lookup("out").Value.Get().(string))
+	if err != nil {
+		return err
+	}
+
+	dd := types.NewDedup(rs.romDB.CompleteRom)
+
+	summary := func() string {
+		report := dd.Report(top)
+		err := writeDedupReport(report, outpath)
+		if err != nil {
+			logger.Errorf("error writing dedup reports: %v", err)
+			return fmt.Sprintf("failed to write dedup reports: %v", err)
+		}
+		return report.String()
+	}
+
+	return rs.startDatJob(cmd, args, "dedup", summary, func(dat *types.Dat, datdir string) error {
+		return dd.Add(dat, dedupTree(outpath, datdir))
+	})
+}
+
+// dedupTree returns the tree of dats a dat with output going to datdir is
+// in: the first directory below the common root of the dats.
+func dedupTree(outpath, datdir string) string {
+	rel, err := filepath.Rel(outpath, datdir)
+	if err != nil {
+		return datdir
+	}
+	return strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+}
+
+func writeDedupReport(report *types.DedupReport, outpath string) error {
+	for _, r := range []struct {
+		name  string
+		write func(w io.Writer) error
+	}{
+		{"dedup.txt", report.WriteText},
+		{"dedup.json", report.WriteJSON},
+	} {
+		file, err := os.Create(filepath.Join(outpath, r.name))
+		if err != nil {
+			return err
+		}
+
+		err = r.write(file)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/notify"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// Types of job events.
+const (
+	// EventState tells a job changed state, ending the events of the job
+	// if it is done, failed or cancelled.
+	EventState = "state"
+	// EventProgress is a snapshot of the progress of a running job.
+	EventProgress = "progress"
+	// EventLog is a line the job logged.
+	EventLog = "log"
+	// EventTruncated tells that events a resuming client missed are gone.
+	EventTruncated = "truncated"
+)
+
+// maxEvents is the number of job events the service keeps for clients to
+// catch up on.
+const maxEvents = 10000
+
+// eventKeepAlive is how often an idle event stream sends a comment, so
+// proxies don't close it.
+const eventKeepAlive = 15 * time.Second
+
+// JobEvent is something that happened to a job. Events are numbered across
+// all jobs, a client reconnecting to the event stream of a job passes the ID
+// of the last event it got to catch up on the ones it missed.
+type JobEvent struct {
+	ID   int64     `json:"id,omitempty"`
+	Job  string    `json:"job"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// State, Message and Error are set for state events.
+	State   string `json:"state,omitempty"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Progress is set for progress events.
+	Progress *worker.Progress `json:"progress,omitempty"`
+	// Line is set for log events.
+	Line string `json:"line,omitempty"`
+}
+
+// Ends reports whether ev is the last event of its job.
+func (ev *JobEvent) Ends() bool {
+	return ev.Type == EventState && jobEnded(ev.State)
+}
+
+func jobEnded(state string) bool {
+	return state == JobDone || state == JobFailed || state == JobCancelled || state == JobInterrupted
+}
+
+// eventLog keeps the most recent job events.
+type eventLog struct {
+	lock   sync.Mutex
+	events []*JobEvent
+	lastID int64
+	// changed is closed and replaced when an event is added
+	changed chan struct{}
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{changed: make(chan struct{})}
+}
+
+// add numbers ev and adds it to the log. Progress events replace the
+// progress event of the same job right before them, so a long running job
+// doesn't crowd out the events of the others.
+func (el *eventLog) add(ev *JobEvent) {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	el.lastID++
+	ev.ID = el.lastID
+
+	if n := len(el.events); ev.Type == EventProgress && n > 0 {
+		last := el.events[n-1]
+		if last.Type == EventProgress && last.Job == ev.Job {
+			el.events = el.events[:n-1]
+		}
+	}
+
+	el.events = append(el.events, ev)
+	if len(el.events) > maxEvents {
+		el.events = el.events[len(el.events)-maxEvents:]
+	}
+
+	close(el.changed)
+	el.changed = make(chan struct{})
+}
+
+// since returns the events of job after the event with ID after, whether
+// some events after it are gone from the log, and a channel closed once
+// there are more events.
+func (el *eventLog) since(job string, after int64) ([]*JobEvent, bool, <-chan struct{}) {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	var events []*JobEvent
+	for _, ev := range el.events {
+		if ev.ID > after && ev.Job == job {
+			events = append(events, ev)
+		}
+	}
+
+	truncated := len(el.events) > 0 && el.events[0].ID > after+1
+	return events, truncated, el.changed
+}
+
+// jobStarted records that job started running. The caller holds jobMutex.
+func (rs *RombaService) jobStarted(job *Job) {
+	rs.metrics.jobStarted(job)
+	rs.events.add(&JobEvent{Job: job.ID, Type: EventState, State: job.State})
+}
+
+// jobEnded records that job ended. The caller holds jobMutex.
+func (rs *RombaService) jobEnded(job *Job) {
+	rs.metrics.jobFinished(job)
+	rs.events.add(&JobEvent{
+		Job:     job.ID,
+		Type:    EventState,
+		State:   job.State,
+		Message: job.Message,
+		Error:   job.Error,
+	})
+	rs.notifyJob(job)
+}
+
+// notifyJob tells the notifiers about job, which ended. Cancelled jobs
+// were stopped by someone who knows about it already.
+func (rs *RombaService) notifyJob(job *Job) {
+	if len(rs.notifiers) == 0 || job.State == JobCancelled {
+		return
+	}
+	if rs.notifyFailuresOnly && job.State != JobFailed {
+		return
+	}
+
+	r := &notify.Result{
+		Host:      rs.hostname,
+		JobID:     job.ID,
+		Job:       job.Name,
+		Succeeded: job.State == JobDone,
+		Message:   job.Message,
+		Error:     job.Error,
+	}
+	if job.Started != nil {
+		r.Started = *job.Started
+	}
+	if job.Finished != nil {
+		r.Finished = *job.Finished
+	}
+
+	for _, n := range rs.notifiers {
+		go func(n notify.Notifier) {
+			err := n.Notify(r)
+			if err != nil {
+				logger.Errorf("error notifying of job %s: %v", r.JobID, err)
+			}
+		}(n)
+	}
+}
+
+// jobLogf logs a line for the running job, to the log and to its event
+// stream.
+func (rs *RombaService) jobLogf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+
+	rs.jobMutex.Lock()
+	job := rs.currentJob
+	jl := rs.jobLogger()
+	rs.jobMutex.Unlock()
+
+	jl.Info(line)
+
+	if job != nil {
+		rs.events.add(&JobEvent{Job: job.ID, Type: EventLog, Line: line})
+	}
+}
+
+// recordProgress adds a snapshot of the progress of the running job to its
+// events.
+func (rs *RombaService) recordProgress(p *worker.Progress) {
+	rs.jobMutex.Lock()
+	job := rs.currentJob
+	rs.jobMutex.Unlock()
+
+	if job != nil {
+		rs.events.add(&JobEvent{Job: job.ID, Type: EventProgress, Progress: p})
+	}
+}
+
+func writeEvent(w io.Writer, ev *JobEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if ev.ID != 0 {
+		_, err = fmt.Fprintf(w, "id: %d\n", ev.ID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
+
+// handleJobEvents streams the events of the job with the given ID as
+// server-sent events, until the job ends or the client goes away. Clients
+// resume after the event given by the Last-Event-ID header or the after
+// parameter.
+func (rs *RombaService) handleJobEvents(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	var after int64
+	token := r.Header.Get("Last-Event-ID")
+	if token == "" {
+		token = r.URL.Query().Get("after")
+	}
+	if token != "" {
+		var err error
+		after, err = strconv.ParseInt(token, 10, 64)
+		if err != nil || after < 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid resume token %q", token))
+			return
+		}
+	}
+	resuming := after > 0
+
+	if rs.findJob(id) == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no job %s", id))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		// the job is looked at before its events, so the event it ended
+		// with is among them if it ended by now
+		job := rs.findJob(id)
+		events, truncated, changed := rs.events.since(id, after)
+
+		if truncated && resuming {
+			resuming = false
+			err := writeEvent(w, &JobEvent{Job: id, Type: EventTruncated, Time: time.Now()})
+			if err != nil {
+				return
+			}
+		}
+
+		for _, ev := range events {
+			err := writeEvent(w, ev)
+			if err != nil {
+				logger.Infof("error sending job events: %v", err)
+				return
+			}
+			after = ev.ID
+			if ev.Ends() {
+				flusher.Flush()
+				return
+			}
+		}
+
+		if job == nil {
+			return
+		}
+		if jobEnded(job.State) {
+			// the event the job ended with is gone, make up for it
+			writeEvent(w, &JobEvent{
+				Job:     id,
+				Type:    EventState,
+				Time:    time.Now(),
+				State:   job.State,
+				Message: job.Message,
+				Error:   job.Error,
+			})
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
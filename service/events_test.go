@@ -0,0 +1,235 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/notify"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestEventLog(t *testing.T) {
+	el := newEventLog()
+
+	el.add(&JobEvent{Job: "1", Type: EventState, State: JobRunning})
+	el.add(&JobEvent{Job: "1", Type: EventProgress, Progress: &worker.Progress{FilesSoFar: 1}})
+	el.add(&JobEvent{Job: "1", Type: EventProgress, Progress: &worker.Progress{FilesSoFar: 2}})
+	el.add(&JobEvent{Job: "2", Type: EventState, State: JobQueued})
+
+	events, truncated, changed := el.since("1", 0)
+	if truncated || len(events) != 2 {
+		t.Fatalf("got %d events, truncated %v, want the state and the last progress", len(events), truncated)
+	}
+	if events[0].ID != 1 || events[1].ID != 3 || events[1].Progress.FilesSoFar != 2 {
+		t.Errorf("got events %+v %+v", events[0], events[1])
+	}
+
+	el.add(&JobEvent{Job: "1", Type: EventState, State: JobDone})
+	select {
+	case <-changed:
+	default:
+		t.Errorf("adding an event didn't signal the change")
+	}
+
+	events, _, _ = el.since("1", 3)
+	if len(events) != 1 || !events[0].Ends() {
+		t.Errorf("got events %v after 3, want the end of job 1", events)
+	}
+
+	for i := 0; i < maxEvents; i++ {
+		el.add(&JobEvent{Job: "2", Type: EventLog, Line: "x"})
+	}
+	events, truncated, _ = el.since("1", 1)
+	if !truncated || len(events) != 0 {
+		t.Errorf("got %d events, truncated %v, want the events of job 1 gone", len(events), truncated)
+	}
+}
+
+type chanNotifier chan *notify.Result
+
+func (cn chanNotifier) Notify(r *notify.Result) error {
+	cn <- r
+	return nil
+}
+
+func TestNotifyJob(t *testing.T) {
+	cn := make(chanNotifier, 4)
+	rs := &RombaService{notifiers: []notify.Notifier{cn}, hostname: "vault"}
+
+	started := time.Now()
+	finished := started.Add(time.Minute)
+	job := &Job{ID: "3", Name: "archive", State: JobDone, Message: "archived", Started: &started, Finished: &finished}
+
+	rs.notifyJob(job)
+	select {
+	case r := <-cn:
+		if r.Host != "vault" || r.JobID != "3" || !r.Succeeded || !r.Finished.Equal(finished) {
+			t.Errorf("got result %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no notification of a done job")
+	}
+
+	rs.notifyFailuresOnly = true
+	rs.notifyJob(job)
+	job.State = JobCancelled
+	rs.notifyJob(job)
+	job.State = JobFailed
+	job.Error = "disk full"
+	rs.notifyJob(job)
+
+	r := <-cn
+	if r.Succeeded || r.Error != "disk full" {
+		t.Errorf("got result %+v, want the failed job", r)
+	}
+	select {
+	case r = <-cn:
+		t.Errorf("got notified of %+v, want only failures", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// readEvents reads the server-sent events of resp until the stream ends.
+func readEvents(t *testing.T, resp *http.Response) []*JobEvent {
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %s", ct)
+	}
+
+	var events []*JobEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+			ev := new(JobEvent)
+			err := json.Unmarshal([]byte(data), ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, ev)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestJobEvents(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-events-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ldb := new(lookupTestDB)
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, ldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewRombaService(ldb, depot, testConfig(datsDir, root))
+	server := httptest.NewServer(rs.APIHandler())
+	defer server.Close()
+
+	_, job, err := rs.runCommand([]string{"miss", "-out", filepath.Join(root, "out")}, nil)
+	if err != nil || job == nil {
+		t.Fatalf("got job %v and error %v running miss", job, err)
+	}
+
+	eventsURL := server.URL + "/api/jobs/" + job.ID + "/events"
+
+	resp, err := http.Get(eventsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(t, resp)
+	if len(events) < 2 {
+		t.Fatalf("got %d events, want at least the start and the end", len(events))
+	}
+	first, last := events[0], events[len(events)-1]
+	if first.Type != EventState || first.State != JobRunning || first.Job != job.ID {
+		t.Errorf("got first event %+v, want the job starting", first)
+	}
+	if !last.Ends() || last.State != JobDone || !strings.Contains(last.Message, "miss 0 roms") {
+		t.Errorf("got last event %+v, want the job done", last)
+	}
+
+	req, err := http.NewRequest("GET", eventsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed := readEvents(t, resp)
+	if len(resumed) != len(events)-1 || resumed[0].ID != events[1].ID {
+		t.Errorf("got %d events resuming after the first, want %d", len(resumed), len(events)-1)
+	}
+
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		{eventsURL + "?after=x", http.StatusBadRequest},
+		{server.URL + "/api/jobs/999/events", http.StatusNotFound},
+	} {
+		resp, err = http.Get(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("got status %d for %s, want %d", resp.StatusCode, test.url, test.status)
+		}
+	}
+}
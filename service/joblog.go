@@ -0,0 +1,155 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uwedeportivo/romba/logging"
+)
+
+// jobLogDir is the directory in the log dir with the logs of the jobs, one
+// file of JSON lines per job, named after its ID.
+const jobLogDir = "job-logs"
+
+func (rs *RombaService) jobLogPath(id string) string {
+	return filepath.Join(rs.logDir, jobLogDir, id+".log")
+}
+
+// captureJobLog makes the records logged for job, through the logger
+// jobLogger returns, go to its log file too. The caller holds jobMutex.
+func (rs *RombaService) captureJobLog(job *Job) {
+	path := rs.jobLogPath(job.ID)
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		logger.Errorf("error creating job log dir: %v", err)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		logger.Errorf("error creating job log: %v", err)
+		return
+	}
+	rs.jobLog = f
+	rs.jobCapture = logging.BeginJob(job.ID, f)
+}
+
+// jobLogger returns the logger of the records of the running job, the
+// service's logger if there is none. The caller holds jobMutex.
+func (rs *RombaService) jobLogger() *logging.Logger {
+	return logger.Job(rs.jobCapture)
+}
+
+// endJobLog ends the capture of the log of job and removes the logs of the
+// jobs the service doesn't remember anymore. The caller holds jobMutex.
+func (rs *RombaService) endJobLog(job *Job) {
+	rs.jobCapture = nil
+	if rs.jobLog == nil {
+		return
+	}
+
+	err := rs.jobLog.Close()
+	if err != nil {
+		logger.Errorf("error closing job log: %v", err)
+	}
+	rs.jobLog = nil
+
+	err = pruneJobLogs(filepath.Join(rs.logDir, jobLogDir), maxJobs)
+	if err != nil {
+		logger.Errorf("error removing old job logs: %v", err)
+	}
+}
+
+// pruneJobLogs removes all but the keep job logs of dir with the highest
+// IDs.
+func pruneJobLogs(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	for _, e := range entries {
+		id, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), ".log"), 10, 64)
+		if err == nil && strings.HasSuffix(e.Name(), ".log") {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) <= keep {
+		return nil
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids[:len(ids)-keep] {
+		err = os.Remove(filepath.Join(dir, strconv.FormatInt(id, 10)+".log"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleJobLog serves the log of the job id, as JSON lines.
+func (rs *RombaService) handleJobLog(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	if rs.findJob(id) == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no job %s", id))
+		return
+	}
+
+	f, err := os.Open(rs.jobLogPath(id))
+	if os.IsNotExist(err) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no log of job %s", id))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	_, err = io.Copy(w, f)
+	if err != nil {
+		logger.Infof("error sending log of job %s: %v", id, err)
+	}
+}
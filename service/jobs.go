@@ -0,0 +1,710 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/auth"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// maxJobs is the number of started jobs the service remembers.
+const maxJobs = 100
+
+// queueFilename is the file in the log dir the job queue is kept in, so that
+// queued jobs survive a restart.
+const queueFilename = "romba-queue.json"
+
+// States of jobs.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+	// JobInterrupted is the state of a job the daemon stopped in the middle
+	// of, see Recovery.
+	JobInterrupted = "interrupted"
+)
+
+// Job is a long running operation of the service, like refreshing the dats or
+// an archive run. The service runs one job at a time, as they share the
+// progress tracker and would only slow each other down on the same disks.
+// Jobs are started by commands directly or queued to run one after the other.
+type Job struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// Args is the command line of the job, the command name first.
+	Args []string `json:"args,omitempty"`
+	// User is the name of the user who ran or queued the job, empty for
+	// jobs the service runs by itself.
+	User string `json:"user,omitempty"`
+	// Priority orders the queue, higher first and in queueing order among
+	// equals.
+	Priority int `json:"priority,omitempty"`
+	// Limits are the resource limits the job runs with, the configured
+	// ones if nil.
+	Limits   *Limits    `json:"limits,omitempty"`
+	Queued   *time.Time `json:"queued,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Message is the summary the job ended with.
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Skipped counts the files the job skipped by reason once it is done,
+	// SkippedFiles lists the first of them. They are only listed for single
+	// jobs.
+	Skipped      map[string]int64     `json:"skipped,omitempty"`
+	SkippedFiles []worker.SkippedFile `json:"skippedFiles,omitempty"`
+	// Progress is set while the job is running.
+	Progress *worker.Progress `json:"progress,omitempty"`
+
+	seq int64
+}
+
+// Limits restrict the resources of a job, so that a background job can
+// coexist with interactive use of the server.
+type Limits struct {
+	// Workers is the number of workers of the job, general.workers if 0.
+	Workers int `json:"workers,omitempty"`
+	// Nice is added to the niceness of the workers, on linux.
+	Nice int `json:"nice,omitempty"`
+	// BytesPerSecond caps the rate the workers read their files at, no cap
+	// if 0.
+	BytesPerSecond int64 `json:"bytesPerSecond,omitempty"`
+}
+
+// Validate checks that the limits are in range.
+func (l *Limits) Validate() error {
+	if l.Workers < 0 {
+		return fmt.Errorf("workers must not be negative")
+	}
+	if l.Nice < -20 || l.Nice > 19 {
+		return fmt.Errorf("nice must be between -20 and 19, not %d", l.Nice)
+	}
+	if l.BytesPerSecond < 0 {
+		return fmt.Errorf("bytes per second must not be negative")
+	}
+	return nil
+}
+
+func (l *Limits) String() string {
+	var parts []string
+	if l.Workers > 0 {
+		parts = append(parts, fmt.Sprintf("%d workers", l.Workers))
+	}
+	if l.Nice != 0 {
+		parts = append(parts, fmt.Sprintf("nice %d", l.Nice))
+	}
+	if l.BytesPerSecond > 0 {
+		parts = append(parts, humanize.Bytes(uint64(l.BytesPerSecond))+"/s")
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// workers returns the number of workers of the job being started or run.
+func (rs *RombaService) workers() int {
+	if rs.limits != nil && rs.limits.Workers > 0 {
+		return rs.limits.Workers
+	}
+	return rs.numWorkers
+}
+
+// tracker returns the progress tracker of the job being started or run,
+// restricting its workers to its limits.
+func (rs *RombaService) tracker() worker.ProgressTracker {
+	if rs.limits == nil {
+		return rs.pt
+	}
+	return worker.WithLimits(rs.pt, worker.Limits{
+		Nice:           rs.limits.Nice,
+		BytesPerSecond: rs.limits.BytesPerSecond,
+	})
+}
+
+// errBusy tells that a command couldn't start its job because of the running
+// one.
+var errBusy = errors.New("busy with another job")
+
+// refuseBusy reports whether the service is busy with a job, telling so on
+// the output of cmd. The caller holds jobMutex.
+func (rs *RombaService) refuseBusy(cmd *commander.Command) bool {
+	if !rs.busy {
+		return false
+	}
+
+	p := rs.pt.GetProgress()
+
+	fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+		p.FilesSoFar, p.TotalFiles, humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
+	rs.refused = true
+	return true
+}
+
+// newJobID returns the ID of a new job. The caller holds jobMutex.
+func (rs *RombaService) newJobID() (string, int64) {
+	rs.lastJobID++
+	return strconv.FormatInt(rs.lastJobID, 10), rs.lastJobID
+}
+
+// startJob runs fn in the background as a job named name, broadcasting the
+// progress every 5 seconds while it runs. The message and error fn returns end
+// the job. The caller holds jobMutex and has checked that the service isn't
+// busy.
+func (rs *RombaService) startJob(name string, fn func() (string, error)) {
+	rs.beginJob(name)
+	jl := rs.jobLogger()
+
+	go func() {
+		jl.Infof("service starting %s", name)
+		rs.broadCastProgress(time.Now(), true, false, "")
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			logger.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "")
+				case <-stopTicker:
+					logger.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		endMsg, err := fn()
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.endJob(endMsg, err)
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg)
+		logger.Infof("service finished %s", name)
+	}()
+}
+
+// beginJob marks the service busy with a job named name, the queued job being
+// run if there is one. The caller holds jobMutex.
+func (rs *RombaService) beginJob(name string) *Job {
+	rs.pt.Reset()
+	// broadCastProgress reads them under progressMutex only
+	rs.progressMutex.Lock()
+	rs.busy = true
+	rs.jobName = name
+	rs.progressMutex.Unlock()
+
+	job := rs.pendingJob
+	if job == nil {
+		job = new(Job)
+		job.ID, job.seq = rs.newJobID()
+		if rs.caller != nil {
+			job.User = rs.caller.Name
+		}
+	}
+	rs.pendingJob = nil
+
+	now := time.Now()
+	job.Name = name
+	job.State = JobRunning
+	job.Started = &now
+	if len(job.Args) == 0 {
+		job.Args = rs.runArgs
+	}
+	job.Limits = rs.limits
+
+	rs.addJob(job)
+	rs.writeJournal(job)
+	rs.captureJobLog(job)
+	rs.jobStarted(job)
+	rs.currentJob = job
+	rs.startedJob = job
+	return job
+}
+
+// addJob adds job to the jobs the service remembers. The caller holds
+// jobMutex.
+func (rs *RombaService) addJob(job *Job) {
+	rs.jobs = append(rs.jobs, job)
+	if len(rs.jobs) > maxJobs {
+		rs.jobs = rs.jobs[len(rs.jobs)-maxJobs:]
+	}
+}
+
+// endJob records the end of the current job, with its summary endMsg and
+// error err if it failed, and lets the next queued job run.
+func (rs *RombaService) endJob(endMsg string, err error) {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	rs.progressMutex.Lock()
+	rs.busy = false
+	rs.jobName = ""
+	rs.progressMutex.Unlock()
+	rs.clearJournal()
+
+	rs.limits = nil
+
+	job := rs.currentJob
+	rs.currentJob = nil
+	if job != nil {
+		p := rs.pt.GetProgress()
+		job.Skipped = p.Skipped
+		job.SkippedFiles = p.SkippedFiles
+		finishJob(job, endMsg, err)
+		rs.jobEnded(job)
+		rs.endJobLog(job)
+	}
+
+	rs.wakeQueue()
+}
+
+func finishJob(job *Job, msg string, err error) {
+	now := time.Now()
+	job.Finished = &now
+	job.Message = strings.TrimSpace(msg)
+	job.State = JobDone
+	if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+}
+
+// jobSnapshot returns a copy of job with its progress filled in if it is
+// running. The caller holds jobMutex.
+func (rs *RombaService) jobSnapshot(job *Job) *Job {
+	js := *job
+	if js.State == JobRunning {
+		js.Progress = rs.pt.GetProgress()
+	}
+	return &js
+}
+
+// findJob returns a snapshot of the job with the given ID, or nil if the
+// service doesn't know it (anymore).
+func (rs *RombaService) findJob(id string) *Job {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	for _, jobs := range [][]*Job{rs.jobs, rs.queue} {
+		for _, job := range jobs {
+			if job.ID == id {
+				return rs.jobSnapshot(job)
+			}
+		}
+	}
+	return nil
+}
+
+// listJobs returns snapshots of the jobs the service remembers, oldest first,
+// followed by the queued jobs in the order they will run.
+func (rs *RombaService) listJobs() []*Job {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	jobs := make([]*Job, 0, len(rs.jobs)+len(rs.queue))
+	for _, job := range rs.jobs {
+		js := rs.jobSnapshot(job)
+		js.SkippedFiles = nil
+		jobs = append(jobs, js)
+	}
+	for _, job := range rs.queue {
+		jobs = append(jobs, rs.jobSnapshot(job))
+	}
+	return jobs
+}
+
+// enqueueJob queues the command argv, its name followed by flags and
+// arguments, for the user u, nil for the service, to run once the jobs before
+// it are done, with limits if not nil.
+func (rs *RombaService) enqueueJob(u *auth.User, argv []string, priority int, limits *Limits) (*Job, error) {
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("command missing")
+	}
+	if limits != nil {
+		err := limits.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	now := time.Now()
+	job := &Job{
+		Name:     argv[0],
+		State:    JobQueued,
+		Args:     argv,
+		Priority: priority,
+		Limits:   limits,
+		Queued:   &now,
+	}
+	if u != nil {
+		job.User = u.Name
+	}
+	job.ID, job.seq = rs.newJobID()
+
+	rs.queue = append(rs.queue, job)
+	rs.sortQueue()
+	rs.events.add(&JobEvent{Job: job.ID, Type: EventState, State: job.State})
+
+	err := rs.saveQueue()
+	if err != nil {
+		return nil, err
+	}
+
+	rs.wakeQueue()
+	return rs.jobSnapshot(job), nil
+}
+
+// cancelJob takes the job with the given ID out of the queue for the user u,
+// nil for the service. Users other than admins may only cancel the jobs they
+// queued. Running jobs can't be cancelled.
+func (rs *RombaService) cancelJob(u *auth.User, id string) (*Job, error) {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	for i, job := range rs.queue {
+		if job.ID != id {
+			continue
+		}
+		if u != nil && job.User != u.Name && !u.Allowed(auth.Admin) {
+			return nil, &forbiddenError{fmt.Errorf("job %s was queued by another user, cancelling it: %v",
+				id, auth.Forbidden(u, auth.Admin))}
+		}
+
+		rs.queue = append(rs.queue[:i], rs.queue[i+1:]...)
+
+		now := time.Now()
+		job.State = JobCancelled
+		job.Finished = &now
+		rs.addJob(job)
+		rs.jobEnded(job)
+		return rs.jobSnapshot(job), rs.saveQueue()
+	}
+
+	for _, job := range rs.jobs {
+		if job.ID == id {
+			return nil, fmt.Errorf("job %s is %s, only queued jobs can be cancelled", id, job.State)
+		}
+	}
+	return nil, fmt.Errorf("no job %s", id)
+}
+
+// sortQueue orders the queue by priority, then by queueing order. The caller
+// holds jobMutex.
+func (rs *RombaService) sortQueue() {
+	sort.SliceStable(rs.queue, func(i, j int) bool {
+		if rs.queue[i].Priority != rs.queue[j].Priority {
+			return rs.queue[i].Priority > rs.queue[j].Priority
+		}
+		return rs.queue[i].seq < rs.queue[j].seq
+	})
+}
+
+// saveQueue writes the queued jobs into the queue file. The caller holds
+// jobMutex.
+func (rs *RombaService) saveQueue() error {
+	if rs.logDir == "" {
+		return nil
+	}
+
+	bs, err := json.MarshalIndent(rs.queue, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	qpath := filepath.Join(rs.logDir, queueFilename)
+	err = ioutil.WriteFile(qpath+".tmp", bs, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(qpath+".tmp", qpath)
+}
+
+// loadQueue reads the jobs queued before the last shutdown.
+func (rs *RombaService) loadQueue() error {
+	if rs.logDir == "" {
+		return nil
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(rs.logDir, queueFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var queue []*Job
+	err = json.Unmarshal(bs, &queue)
+	if err != nil {
+		return err
+	}
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	for _, job := range queue {
+		seq, err := strconv.ParseInt(job.ID, 10, 64)
+		if err != nil || len(job.Args) == 0 {
+			logger.Warningf("dropping malformed queued job %s", job.ID)
+			continue
+		}
+
+		job.seq = seq
+		if seq > rs.lastJobID {
+			rs.lastJobID = seq
+		}
+		rs.queue = append(rs.queue, job)
+	}
+	rs.sortQueue()
+
+	if len(rs.queue) > 0 {
+		logger.Infof("loaded %d queued jobs", len(rs.queue))
+		rs.wakeQueue()
+	}
+	return nil
+}
+
+// wakeQueue makes the scheduler look at the queue. The caller holds jobMutex.
+func (rs *RombaService) wakeQueue() {
+	select {
+	case rs.queueWake <- struct{}{}:
+	default:
+	}
+}
+
+// nextQueuedJob takes the first job out of the queue if the service isn't
+// busy, nil otherwise.
+func (rs *RombaService) nextQueuedJob() *Job {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy || len(rs.queue) == 0 {
+		return nil
+	}
+
+	job := rs.queue[0]
+	rs.queue = rs.queue[1:]
+
+	err := rs.saveQueue()
+	if err != nil {
+		logger.Errorf("error saving job queue: %v", err)
+	}
+	return job
+}
+
+// runQueue runs the queued jobs one after the other, for as long as the
+// service lives.
+func (rs *RombaService) runQueue() {
+	for range rs.queueWake {
+		for {
+			job := rs.nextQueuedJob()
+			if job == nil {
+				break
+			}
+
+			logger.Infof("running queued job %s: %s", job.ID, strings.Join(job.Args, " "))
+
+			msg, started, err := rs.runCommand(job.Args, job)
+
+			rs.jobMutex.Lock()
+			switch {
+			case started != nil:
+				// the job runs in the background and ends with endJob
+			case err == errBusy:
+				// another job got in first, try again once it is done
+				job.State = JobQueued
+				rs.queue = append([]*Job{job}, rs.queue...)
+				rs.sortQueue()
+				if err := rs.saveQueue(); err != nil {
+					logger.Errorf("error saving job queue: %v", err)
+				}
+			default:
+				// the command was done right away, or failed
+				now := time.Now()
+				job.Started = &now
+				finishJob(job, msg, err)
+				rs.addJob(job)
+				rs.jobEnded(job)
+			}
+			rs.jobMutex.Unlock()
+		}
+	}
+}
+
+// scheduleCommand queues the command name every interval, unless it is
+// queued already.
+func (rs *RombaService) scheduleCommand(name string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if rs.isQueued(name) {
+			continue
+		}
+
+		_, err := rs.enqueueJob(nil, []string{name}, 0, nil)
+		if err != nil {
+			logger.Errorf("error queueing %s: %v", name, err)
+		}
+	}
+}
+
+// isQueued reports whether the command name is queued.
+func (rs *RombaService) isQueued(name string) bool {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	for _, job := range rs.queue {
+		if job.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs *RombaService) queueCmd(cmd *commander.Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("queue needs a command")
+	}
+
+	err := authorizeCommand(rs.caller, args)
+	if err != nil {
+		return err
+	}
+
+	priority := cmd.Flag.Lookup("priority").Value.Get().(int)
+
+	limits := &Limits{
+		Workers: cmd.Flag.Lookup("workers").Value.Get().(int),
+		Nice:    cmd.Flag.Lookup("nice").Value.Get().(int),
+	}
+	if rate := cmd.Flag.Lookup("io-limit").Value.Get().(string); rate != "" {
+		bps, err := humanize.ParseBytes(rate)
+		if err != nil {
+			return fmt.Errorf("bad -io-limit %s: %v", rate, err)
+		}
+		limits.BytesPerSecond = int64(bps)
+	}
+	if *limits == (Limits{}) {
+		limits = nil
+	}
+
+	job, err := rs.enqueueJob(rs.caller, args, priority, limits)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "queued job %s: %s\n", job.ID, strings.Join(args, " "))
+	return nil
+}
+
+func (rs *RombaService) jobsCmd(cmd *commander.Command, args []string) error {
+	var jobs []*Job
+	if len(args) == 0 {
+		jobs = rs.listJobs()
+	}
+	for _, id := range args {
+		job := rs.findJob(id)
+		if job == nil {
+			return fmt.Errorf("no job %s", id)
+		}
+		jobs = append(jobs, job)
+	}
+
+	listSkipped := cmd.Flag.Lookup("skipped").Value.Get().(bool)
+
+	for _, job := range jobs {
+		printJob(cmd.Stdout, job)
+		if listSkipped {
+			for _, sf := range job.SkippedFiles {
+				fmt.Fprintf(cmd.Stdout, "\t%v\n", sf)
+			}
+		}
+	}
+	return nil
+}
+
+func (rs *RombaService) cancelCmd(cmd *commander.Command, args []string) error {
+	for _, id := range args {
+		_, err := rs.cancelJob(rs.caller, id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.Stdout, "cancelled job %s\n", id)
+	}
+	return nil
+}
+
+// printJob writes job in the format of the jobs command.
+func printJob(w io.Writer, job *Job) {
+	fmt.Fprintf(w, "%s\t%s\t%s", job.ID, job.State, job.Name)
+	switch job.State {
+	case JobQueued:
+		fmt.Fprintf(w, "\tpriority %d: %s", job.Priority, strings.Join(job.Args, " "))
+		if job.Limits != nil {
+			fmt.Fprintf(w, "\tlimits: %v", job.Limits)
+		}
+	case JobRunning:
+		p := job.Progress
+		fmt.Fprintf(w, "\t(%d of %d files) and (%s of %s)", p.FilesSoFar, p.TotalFiles,
+			humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
+	default:
+		if job.Message != "" {
+			fmt.Fprintf(w, "\t%s", job.Message)
+		}
+		if job.Error != "" {
+			fmt.Fprintf(w, "\terror: %s", job.Error)
+		}
+		if sm := worker.SkipSummary(job.Skipped); sm != "" && !strings.Contains(job.Message, sm) {
+			fmt.Fprintf(w, "\t%s", sm)
+		}
+	}
+	fmt.Fprintln(w)
+}
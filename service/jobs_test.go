@@ -0,0 +1,242 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/auth"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// waitForJob waits for the job with the given ID to be done.
+func waitForJob(t *testing.T, rs *RombaService, id string) *Job {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job := rs.findJob(id)
+		if job != nil && job.State != JobQueued && job.State != JobRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s not done in time", id)
+	return nil
+}
+
+func TestJobQueue(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-jobs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ldb := &lookupTestDB{dat: &types.Dat{Name: "test"}}
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, ldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewRombaService(ldb, depot, testConfig(datsDir, root))
+
+	// keep the service busy while queueing
+	rs.jobMutex.Lock()
+	rs.beginJob("blocker")
+	rs.jobMutex.Unlock()
+
+	missCmd := []string{"miss", "-out", filepath.Join(root, "out")}
+	low, err := rs.enqueueJob(nil, missCmd, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := rs.enqueueJob(nil, missCmd, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := &auth.User{Name: "bob", Role: auth.Operator}
+	cancelled, err := rs.enqueueJob(bob, missCmd, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.User != "bob" {
+		t.Errorf("job queued by bob has user %q", cancelled.User)
+	}
+
+	// operators may only cancel their own jobs
+	_, err = rs.cancelJob(&auth.User{Name: "carol", Role: auth.Operator}, cancelled.ID)
+	if _, ok := err.(*forbiddenError); !ok {
+		t.Errorf("got error %v cancelling the job of another operator, want forbidden", err)
+	}
+	_, err = rs.cancelJob(bob, cancelled.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rs.cancelJob(nil, "1"); err == nil {
+		t.Errorf("running job cancelled")
+	}
+
+	jobs := rs.listJobs()
+	var ids []string
+	for _, job := range jobs {
+		ids = append(ids, job.ID)
+	}
+	if len(ids) != 4 || ids[0] != "1" || ids[1] != cancelled.ID || ids[2] != high.ID || ids[3] != low.ID {
+		t.Errorf("got jobs %v, want the blocker, the cancelled job, then the queue by priority", ids)
+	}
+
+	// a restarted service picks up the queue
+	restarted := &RombaService{logDir: root, jobMutex: new(sync.Mutex), queueWake: make(chan struct{}, 1)}
+	err = restarted.loadQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.queue) != 2 || restarted.queue[0].ID != high.ID || restarted.lastJobID != 3 {
+		t.Errorf("restarted service has queue %v", restarted.queue)
+	}
+
+	rs.endJob("blocker done", nil)
+
+	highDone := waitForJob(t, rs, high.ID)
+	lowDone := waitForJob(t, rs, low.ID)
+	if highDone.State != JobDone || lowDone.State != JobDone {
+		t.Fatalf("queued jobs ended as %s and %s", highDone.State, lowDone.State)
+	}
+	if lowDone.Started.Before(*highDone.Started) {
+		t.Errorf("low priority job ran first")
+	}
+	if rs.findJob(cancelled.ID).State != JobCancelled {
+		t.Errorf("cancelled job ran")
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-limits-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ldb := &lookupTestDB{dat: &types.Dat{Name: "test"}}
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, ldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewRombaService(ldb, depot, testConfig(datsDir, root))
+
+	rs.jobMutex.Lock()
+	rs.beginJob("blocker")
+	rs.jobMutex.Unlock()
+
+	_, _, err = rs.runCommand([]string{"queue", "-nice", "20", "miss", "-out", filepath.Join(root, "out")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "nice") {
+		t.Errorf("queueing with nice 20: got %v", err)
+	}
+
+	msg, _, err := rs.runCommand([]string{"queue", "-workers", "2", "-nice", "5", "-io-limit", "100MB",
+		"miss", "-out", filepath.Join(root, "out")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSuffix(strings.Fields(msg)[2], ":")
+
+	queued := rs.findJob(id)
+	want := Limits{Workers: 2, Nice: 5, BytesPerSecond: 100000000}
+	if queued == nil || queued.Limits == nil || *queued.Limits != want {
+		t.Fatalf("got queued job %+v", queued)
+	}
+	if rs.workers() != rs.numWorkers || worker.LimitsOf(rs.tracker()) != (worker.Limits{}) {
+		t.Errorf("the running job got the limits of the queued one")
+	}
+
+	rs.endJob("blocker done", nil)
+
+	done := waitForJob(t, rs, id)
+	if done.State != JobDone || done.Limits == nil || *done.Limits != want {
+		t.Errorf("got job %+v", done)
+	}
+	if l := worker.LimitsOf(rs.tracker()); l != (worker.Limits{}) {
+		t.Errorf("worker limits %+v left after the job", l)
+	}
+}
+
+func TestPruneJobLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-joblogs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"1.log", "2.log", "9.log", "10.log", "notes.txt"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = pruneJobLogs(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var left []string
+	entries, _ := ioutil.ReadDir(dir)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if len(left) != 3 || left[0] != "10.log" || left[1] != "9.log" || left[2] != "notes.txt" {
+		t.Errorf("got %v left, want the logs of jobs 9 and 10", left)
+	}
+}
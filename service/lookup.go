@@ -0,0 +1,304 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/auth"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// Kinds of lookup queries.
+const (
+	LookupHash = "hash"
+	LookupFile = "file"
+	LookupName = "name"
+)
+
+// LookupRequest asks what is known about each query, a hex encoded SHA1, MD5
+// or CRC, the path of a file to hash or part of a game name. Files are hashed
+// by the server, so only for operators and admins.
+type LookupRequest struct {
+	Queries []string
+}
+
+type LookupReply struct {
+	Results []*LookupResult
+}
+
+// LookupMatch is a game of a dat referencing the looked up rom, or matching
+// the looked up name. Rom is empty for name matches.
+type LookupMatch struct {
+	Dat     string `json:"dat"`
+	DatPath string `json:"datPath,omitempty"`
+	Game    string `json:"game"`
+	Rom     string `json:"rom,omitempty"`
+}
+
+// LookupResult is what is known about a query.
+type LookupResult struct {
+	Query string `json:"query"`
+	Kind  string `json:"kind"`
+	// Rom holds the hashes looked up, completed from the DB where possible.
+	// It is nil for name lookups.
+	Rom *types.Rom `json:"rom,omitempty"`
+	// Dat is set if the query is the SHA1 of an indexed DAT file.
+	Dat     *LookupMatch   `json:"dat,omitempty"`
+	Matches []*LookupMatch `json:"matches,omitempty"`
+	// DepotPath is the depot file holding the rom, empty if the depot
+	// doesn't have it.
+	DepotPath string                      `json:"depotPath,omitempty"`
+	Archived  []*archive.ProvenanceRecord `json:"archived,omitempty"`
+}
+
+// Lookup is the JSON-RPC variant of the lookup command.
+func (rs *RombaService) Lookup(r *http.Request, req *LookupRequest, reply *LookupReply) error {
+	u := auth.UserFrom(r.Context())
+	for _, query := range req.Queries {
+		lr, err := rs.lookupQuery(query, u)
+		if err != nil {
+			return err
+		}
+		reply.Results = append(reply.Results, lr)
+	}
+	return nil
+}
+
+// lookupQuery tells what query is: a file if there is one with that path, a
+// hash if it decodes as one of a known size, a part of a game name otherwise,
+// like 1942 or dead. Files are only looked at for users who may read the
+// files of the server, a nil u being the service itself.
+func (rs *RombaService) lookupQuery(query string, u *auth.User) (*LookupResult, error) {
+	// whether the file exists isn't even told to others
+	if u == nil || u.Allowed(auth.Operator) {
+		if fi, err := os.Stat(query); err == nil && fi.Mode().IsRegular() {
+			hh, err := archive.HashesForFile(query)
+			if err != nil {
+				return nil, err
+			}
+
+			lr := &LookupResult{
+				Query: query,
+				Kind:  LookupFile,
+				Rom: &types.Rom{
+					Name: filepath.Base(query),
+					Size: fi.Size(),
+					Crc:  hh.Crc,
+					Md5:  hh.Md5,
+					Sha1: hh.Sha1,
+				},
+			}
+			return lr, rs.lookupRom(lr)
+		}
+	}
+
+	hash, err := hex.DecodeString(query)
+	if err == nil && isHashSize(len(hash)) {
+		rom := new(types.Rom)
+		switch len(hash) {
+		case md5.Size:
+			rom.Md5 = hash
+		case crc32.Size:
+			rom.Crc = hash
+		case sha1.Size:
+			rom.Sha1 = hash
+		}
+
+		lr := &LookupResult{
+			Query: query,
+			Kind:  LookupHash,
+			Rom:   rom,
+		}
+
+		if rom.Sha1 != nil {
+			dat, err := rs.romDB.GetDat(hash)
+			if err != nil {
+				return nil, err
+			}
+			if dat != nil {
+				lr.Dat = &LookupMatch{Dat: dat.Name, DatPath: dat.Path}
+			}
+		}
+		return lr, rs.lookupRom(lr)
+	}
+
+	lr := &LookupResult{
+		Query: query,
+		Kind:  LookupName,
+	}
+	return lr, rs.lookupName(lr)
+}
+
+// isHashSize reports whether n is the size of a CRC, MD5 or SHA1.
+func isHashSize(n int) bool {
+	return n == crc32.Size || n == md5.Size || n == sha1.Size
+}
+
+// lookupRom fills in the games referencing lr.Rom and where the depot has it.
+func (rs *RombaService) lookupRom(lr *LookupResult) error {
+	rom := lr.Rom
+
+	dats, err := rs.romDB.DatsForRom(rom)
+	if err != nil {
+		return err
+	}
+
+	for _, dat := range dats {
+		for _, game := range dat.Games {
+			for _, gr := range game.AllRoms() {
+				if sameContent(rom, gr) {
+					lr.Matches = append(lr.Matches, &LookupMatch{
+						Dat:     dat.Name,
+						DatPath: dat.Path,
+						Game:    game.Name,
+						Rom:     gr.Name,
+					})
+				}
+			}
+		}
+	}
+
+	err = rs.romDB.CompleteRom(rom)
+	if err != nil {
+		return err
+	}
+
+	if rom.Sha1 == nil {
+		return nil
+	}
+
+	sha1Hex := hex.EncodeToString(rom.Sha1)
+
+	lr.DepotPath, err = rs.depot.RomPath(sha1Hex)
+	if err != nil {
+		return err
+	}
+
+	lr.Archived, err = rs.depot.Provenance(sha1Hex)
+	return err
+}
+
+// sameContent reports whether the roms a and b agree on their strongest
+// common hash.
+func sameContent(a, b *types.Rom) bool {
+	switch {
+	case a.Sha1 != nil && b.Sha1 != nil:
+		return bytes.Equal(a.Sha1, b.Sha1)
+	case a.Md5 != nil && b.Md5 != nil:
+		return bytes.Equal(a.Md5, b.Md5)
+	case a.Crc != nil && b.Crc != nil:
+		return bytes.Equal(a.Crc, b.Crc)
+	}
+	return false
+}
+
+// lookupName finds the games whose name contains lr.Query, ignoring case, in
+// the indexed DAT files. There is no index of game names, so this reads all
+// of them.
+func (rs *RombaService) lookupName(lr *LookupResult) error {
+	query := strings.ToLower(lr.Query)
+
+	return filepath.Walk(rs.dats, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		ext := filepath.Ext(path)
+		if fi.IsDir() || (ext != ".dat" && ext != ".xml") {
+			return nil
+		}
+
+		hh, err := archive.HashesForFile(path)
+		if err != nil {
+			return err
+		}
+
+		dat, err := rs.romDB.GetDat(hh.Sha1)
+		if err != nil || dat == nil {
+			return err
+		}
+
+		for _, game := range dat.Games {
+			if strings.Contains(strings.ToLower(game.Name), query) {
+				lr.Matches = append(lr.Matches, &LookupMatch{
+					Dat:     dat.Name,
+					DatPath: path,
+					Game:    game.Name,
+				})
+			}
+		}
+		return nil
+	})
+}
+
+// PrintLookupResult writes lr in the text format of the lookup command.
+func PrintLookupResult(w io.Writer, lr *LookupResult) {
+	fmt.Fprintf(w, "%s (%s):\n", lr.Query, lr.Kind)
+
+	if lr.Dat != nil {
+		fmt.Fprintf(w, "  dat %s (%s)\n", lr.Dat.Dat, lr.Dat.DatPath)
+	}
+
+	if lr.Rom != nil {
+		fmt.Fprintf(w, "  sha1 %s md5 %s crc %s\n", hex.EncodeToString(lr.Rom.Sha1),
+			hex.EncodeToString(lr.Rom.Md5), hex.EncodeToString(lr.Rom.Crc))
+		if lr.DepotPath != "" {
+			fmt.Fprintf(w, "  in depot at %s\n", lr.DepotPath)
+		} else {
+			fmt.Fprintf(w, "  not in depot\n")
+		}
+	}
+
+	for _, m := range lr.Matches {
+		if m.Rom != "" {
+			fmt.Fprintf(w, "  rom %s of game %s in dat %s\n", m.Rom, m.Game, m.Dat)
+		} else {
+			fmt.Fprintf(w, "  game %s in dat %s\n", m.Game, m.Dat)
+		}
+	}
+
+	for _, pr := range lr.Archived {
+		fmt.Fprintf(w, "  archived from %s (modified %s, archive run %s)\n", pr.Path,
+			pr.ModTime.Format(time.RFC3339), pr.Run)
+	}
+}
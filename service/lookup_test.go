@@ -0,0 +1,204 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/auth"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// lookupTestDB knows a single dat, indexed under datSha1
+type lookupTestDB struct {
+	db.RomDB
+	dat     *types.Dat
+	datSha1 []byte
+	flags   map[string]types.DatFlags
+}
+
+func (ldb *lookupTestDB) GetDat(sha1Bytes []byte) (*types.Dat, error) {
+	if bytes.Equal(sha1Bytes, ldb.datSha1) {
+		dat := *ldb.dat
+		dat.DatFlags = ldb.flags[dat.Path]
+		return &dat, nil
+	}
+	return nil, nil
+}
+
+func (ldb *lookupTestDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
+	dat := *ldb.dat
+	dat.DatFlags = ldb.flags[dat.Path]
+	return []*types.Dat{&dat}, nil
+}
+
+func (ldb *lookupTestDB) DatPathsUnder(path string) ([]string, error) {
+	if ldb.dat.Path == path || strings.HasPrefix(ldb.dat.Path, path+string(filepath.Separator)) {
+		return []string{ldb.dat.Path}, nil
+	}
+	return nil, nil
+}
+
+func (ldb *lookupTestDB) EndFullRefresh() error {
+	return nil
+}
+
+func (ldb *lookupTestDB) DatFlags() (map[string]types.DatFlags, error) {
+	return ldb.flags, nil
+}
+
+func (ldb *lookupTestDB) SetDatFlags(path string, flags types.DatFlags) error {
+	if ldb.flags == nil {
+		ldb.flags = make(map[string]types.DatFlags)
+	}
+	ldb.flags[path] = flags
+	return nil
+}
+
+func (ldb *lookupTestDB) CompleteRom(rom *types.Rom) error {
+	return nil
+}
+
+// testConfig is the configuration of a service with one worker.
+func testConfig(dats, logDir string) *config.Config {
+	cfg := config.Default()
+	cfg.Index.Dats = dats
+	cfg.General.LogDir = logDir
+	cfg.General.Workers = 1
+	return cfg
+}
+
+func TestLookup(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-lookup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	datPath := filepath.Join(datsDir, "test.dat")
+	err = ioutil.WriteFile(datPath, []byte("a dat file"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datHashes, err := archive.HashesForFile(datPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	romPath := filepath.Join(root, "some.bin")
+	err = ioutil.WriteFile(romPath, []byte("some rom"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	romHashes, err := archive.HashesForFile(romPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ldb := &lookupTestDB{
+		datSha1: datHashes.Sha1,
+		dat: &types.Dat{
+			Name: "test",
+			Games: types.GameSlice{
+				{Name: "Some Game (Europe)", Roms: types.RomSlice{{Name: "game.bin", Sha1: romHashes.Sha1}}},
+				{Name: "Other Game", Roms: types.RomSlice{{Name: "other.bin", Sha1: datHashes.Sha1}}},
+			},
+		},
+	}
+
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, ldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewRombaService(ldb, depot, testConfig(datsDir, root))
+
+	reader := &auth.User{Name: "reader", Role: auth.ReadOnly}
+
+	for _, tc := range []struct {
+		query string
+		user  *auth.User
+		kind  string
+		games []string
+		dat   bool
+	}{
+		{romPath, nil, LookupFile, []string{"Some Game (Europe)"}, false},
+		{romPath, auth.Anonymous, LookupFile, []string{"Some Game (Europe)"}, false},
+		// files of the server aren't hashed for read-only users
+		{romPath, reader, LookupName, nil, false},
+		{hex.EncodeToString(datHashes.Sha1), reader, LookupHash, []string{"Other Game"}, true},
+		{hex.EncodeToString(romHashes.Crc), reader, LookupHash, nil, false},
+		{"some game", reader, LookupName, []string{"Some Game (Europe)"}, false},
+		// hex, but not of a hash size
+		{"eeee", nil, LookupName, nil, false},
+	} {
+		lr, err := rs.lookupQuery(tc.query, tc.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lr.Kind != tc.kind {
+			t.Errorf("%s looked up as %s, want %s", tc.query, lr.Kind, tc.kind)
+		}
+		if (lr.Dat != nil) != tc.dat {
+			t.Errorf("%s: got dat %v, want dat %v", tc.query, lr.Dat, tc.dat)
+		}
+		if len(lr.Matches) != len(tc.games) {
+			t.Errorf("%s: got %d matches, want %v", tc.query, len(lr.Matches), tc.games)
+			continue
+		}
+		for i, m := range lr.Matches {
+			if m.Game != tc.games[i] {
+				t.Errorf("%s: got game %s, want %s", tc.query, m.Game, tc.games[i])
+			}
+		}
+		if lr.DepotPath != "" {
+			t.Errorf("%s found in an empty depot", tc.query)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uwedeportivo/romba/auth"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// serviceMetrics counts what the service did since it started.
+type serviceMetrics struct {
+	lock          sync.Mutex
+	jobsStarted   map[string]int64
+	jobsFinished  map[jobKey]int64
+	commandErrors int64
+}
+
+type jobKey struct {
+	name  string
+	state string
+}
+
+func newServiceMetrics() *serviceMetrics {
+	return &serviceMetrics{
+		jobsStarted:  make(map[string]int64),
+		jobsFinished: make(map[jobKey]int64),
+	}
+}
+
+func (sm *serviceMetrics) jobStarted(job *Job) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	sm.jobsStarted[job.Name]++
+}
+
+func (sm *serviceMetrics) jobFinished(job *Job) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	sm.jobsFinished[jobKey{name: job.Name, state: job.State}]++
+}
+
+func (sm *serviceMetrics) commandFailed() {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	sm.commandErrors++
+}
+
+// MetricsHandler returns the handler serving the metrics of the service in
+// the Prometheus text format, to be mounted at /metrics.
+func (rs *RombaService) MetricsHandler() http.Handler {
+	return rs.RequireRole(auth.ReadOnly, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		rs.writeMetrics(w)
+	}))
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (mw *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample of name, labels being pairs of label names and
+// values.
+func (mw *metricsWriter) sample(name string, value interface{}, labels ...string) {
+	io.WriteString(mw.w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		fmt.Fprintf(mw.w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(mw.w, " %v\n", value)
+}
+
+func (mw *metricsWriter) single(name, typ, help string, value interface{}) {
+	mw.header(name, typ, help)
+	mw.sample(name, value)
+}
+
+func (rs *RombaService) writeMetrics(w io.Writer) {
+	mw := &metricsWriter{w: w}
+
+	rs.writeJobMetrics(mw)
+
+	if rs.depot != nil {
+		files, bytes := rs.depot.Archived()
+		mw.single("romba_archived_files_total", "counter", "Files written into the depot.", files)
+		mw.single("romba_archived_bytes_total", "counter", "Bytes written into the depot.", bytes)
+
+		usage := rs.depot.Usage()
+		mw.header("romba_depot_size_bytes", "gauge", "Size of a depot root.")
+		for _, u := range usage {
+			mw.sample("romba_depot_size_bytes", u.Size, "root", u.Root)
+		}
+		mw.header("romba_depot_max_size_bytes", "gauge", "Maximum size of a depot root.")
+		for _, u := range usage {
+			mw.sample("romba_depot_max_size_bytes", u.MaxSize, "root", u.Root)
+		}
+		mw.header("romba_depot_disk_free_bytes", "gauge", "Free space of the disk holding a depot root.")
+		for _, u := range usage {
+			if u.DiskFree >= 0 {
+				mw.sample("romba_depot_disk_free_bytes", u.DiskFree, "root", u.Root)
+			}
+		}
+	}
+
+	if tdb, ok := rs.romDB.(*db.TimedRomDB); ok {
+		timings := tdb.Timings()
+		ops := make([]string, 0, len(timings))
+		for op := range timings {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+
+		mw.header("romba_db_lookup_seconds", "summary", "Time spent in rom DB lookups.")
+		for _, op := range ops {
+			lt := timings[op]
+			mw.sample("romba_db_lookup_seconds_sum", lt.Total.Seconds(), "op", op)
+			mw.sample("romba_db_lookup_seconds_count", lt.Count, "op", op)
+		}
+	}
+
+	ws := worker.CurrentStats()
+	mw.single("romba_workers", "gauge", "Workers running.", ws.Workers)
+	mw.single("romba_workers_busy", "gauge", "Workers processing a file.", ws.Busy)
+	mw.single("romba_worker_busy_seconds_total", "counter", "Time workers spent processing files.", ws.BusyTime.Seconds())
+	mw.single("romba_worker_files_total", "counter", "Files processed by workers.", ws.Processed)
+	mw.single("romba_worker_errors_total", "counter", "Files workers failed to process.", ws.Failed)
+}
+
+func (rs *RombaService) writeJobMetrics(mw *metricsWriter) {
+	rs.jobMutex.Lock()
+	running := 0
+	if rs.busy {
+		running = 1
+	}
+	queued := len(rs.queue)
+	rs.jobMutex.Unlock()
+
+	sm := rs.metrics
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	names := make([]string, 0, len(sm.jobsStarted))
+	for name := range sm.jobsStarted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mw.header("romba_jobs_started_total", "counter", "Jobs started, by name.")
+	for _, name := range names {
+		mw.sample("romba_jobs_started_total", sm.jobsStarted[name], "job", name)
+	}
+
+	keys := make([]jobKey, 0, len(sm.jobsFinished))
+	for key := range sm.jobsFinished {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].state < keys[j].state
+	})
+
+	mw.header("romba_jobs_finished_total", "counter", "Jobs finished, by name and final state.")
+	for _, key := range keys {
+		mw.sample("romba_jobs_finished_total", sm.jobsFinished[key], "job", key.name, "state", key.state)
+	}
+
+	mw.single("romba_job_running", "gauge", "Whether a job is running.", running)
+	mw.single("romba_jobs_queued", "gauge", "Jobs waiting in the queue.", queued)
+	mw.single("romba_command_errors_total", "counter", "Commands that failed to run.", sm.commandErrors)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestMetrics(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-metrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	datPath := filepath.Join(datsDir, "test.dat")
+	err = ioutil.WriteFile(datPath, []byte("a dat file"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datHashes, err := archive.HashesForFile(datPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tdb := db.NewTimedRomDB(&lookupTestDB{
+		datSha1: datHashes.Sha1,
+		dat: &types.Dat{
+			Name:  "test",
+			Games: types.GameSlice{{Name: "game", Roms: types.RomSlice{{Name: "a.bin", Sha1: datHashes.Sha1}}}},
+		},
+	})
+
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, tdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewRombaService(tdb, depot, testConfig(datsDir, root))
+
+	_, job, err := rs.runCommand([]string{"miss", "-out", filepath.Join(root, "out")}, nil)
+	if err != nil || job == nil {
+		t.Fatalf("got job %v and error %v running miss", job, err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if rs.findJob(job.ID).State != JobRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, _, err = rs.runCommand([]string{"no-such-command"}, nil)
+	if err == nil {
+		t.Fatal("unknown command didn't fail")
+	}
+
+	server := httptest.NewServer(rs.MetricsHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := string(body)
+
+	for _, want := range []string{
+		"# TYPE romba_jobs_started_total counter\n",
+		`romba_jobs_started_total{job="miss"} 1` + "\n",
+		`romba_jobs_finished_total{job="miss",state="done"} 1` + "\n",
+		"romba_job_running 0\n",
+		"romba_jobs_queued 0\n",
+		"romba_command_errors_total 1\n",
+		"romba_archived_files_total 0\n",
+		`romba_depot_size_bytes{root="` + depotRoot + `"} 0` + "\n",
+		`romba_depot_max_size_bytes{root="` + depotRoot + `"} 1073741824` + "\n",
+		"# TYPE romba_db_lookup_seconds summary\n",
+		`romba_db_lookup_seconds_count{op="GetDat"} 1` + "\n",
+		"# TYPE romba_workers gauge\n",
+		"# TYPE romba_worker_errors_total counter\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics lack %q:\n%s", want, metrics)
+		}
+	}
+}
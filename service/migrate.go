@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/migrate"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// importScans indexes the roms in the scan results of other tools in paths,
+// found below root, the folder of each file if root is empty.
+func (rs *RombaService) importScans(paths []string, root string) (string, error) {
+	rs.pt.SetTotalFiles(int32(len(paths)))
+
+	batch := rs.romDB.StartBatch()
+	var lines []string
+	for _, path := range paths {
+		dir := root
+		if dir == "" {
+			dir = filepath.Dir(path)
+		}
+
+		report, err := migrate.Read(path, dir, func(rom *types.Rom) error {
+			if batch.Size() >= db.MaxBatchSize {
+				err := batch.Flush()
+				if err != nil {
+					return fmt.Errorf("failed to flush: %v", err)
+				}
+			}
+			return batch.IndexRom(rom)
+		})
+		if err != nil {
+			batch.Close()
+			return "", fmt.Errorf("importing %s failed: %v", path, err)
+		}
+		rs.pt.AddBytesFromFile(report.Bytes)
+		rs.jobLogf("imported %v", report)
+		lines = append(lines, report.String())
+	}
+
+	err := batch.Close()
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (rs *RombaService) startImportScan(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintf(cmd.Stdout, "no scan results to import")
+		return nil
+	}
+
+	// refuse the binary caches up front
+	for _, path := range args {
+		_, err := migrate.Detect(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	root := cmd.Flag.Lookup("root").Value.Get().(string)
+
+	rs.startJob("import-scan", func() (string, error) {
+		endMsg, err := rs.importScans(args, root)
+		if err != nil {
+			logger.Errorf("error importing scan results: %v", err)
+			endMsg = fmt.Sprintf("error importing scan results: %v", err)
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started importing scan results")
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/romfs"
+)
+
+// rombaMount is a filesystem view of the dats mounted by the mount command.
+type rombaMount struct {
+	server   *romfs.Server
+	fs       *romfs.FS
+	cacheDir string
+}
+
+func (rs *RombaService) mount(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if len(args) != 1 {
+		return fmt.Errorf("mount needs exactly one directory")
+	}
+
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	if rs.mounts[dir] != nil {
+		return fmt.Errorf("%s is mounted already", dir)
+	}
+
+	maxCache := int64(cmd.Flag.Lookup("cache").Value.Get().(int)) << 20
+	if maxCache <= 0 {
+		return fmt.Errorf("-cache must be positive")
+	}
+
+	cacheDir, err := ioutil.TempDir("", "romba-fs")
+	if err != nil {
+		return err
+	}
+
+	fs := romfs.New(rs.dats, rs.romDB, rs.depot, cacheDir, maxCache)
+	server, err := romfs.Mount(dir, fs)
+	if err != nil {
+		os.RemoveAll(cacheDir)
+		return err
+	}
+
+	m := &rombaMount{server: server, fs: fs, cacheDir: cacheDir}
+	rs.mounts[dir] = m
+
+	go func() {
+		err := m.server.Serve()
+		if err != nil {
+			logger.Errorf("error serving %s: %v", dir, err)
+		}
+
+		m.fs.Close()
+		os.RemoveAll(m.cacheDir)
+
+		rs.jobMutex.Lock()
+		if rs.mounts[dir] == m {
+			delete(rs.mounts, dir)
+		}
+		rs.jobMutex.Unlock()
+		logger.Infof("service unmounted %s", dir)
+	}()
+
+	fmt.Fprintf(cmd.Stdout, "mounted dats on %s", dir)
+	return nil
+}
+
+func (rs *RombaService) unmount(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if len(args) != 1 {
+		return fmt.Errorf("unmount needs exactly one directory")
+	}
+
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	m := rs.mounts[dir]
+	if m == nil {
+		return fmt.Errorf("%s is not mounted", dir)
+	}
+
+	err = m.server.Unmount()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "unmounted %s", dir)
+	return nil
+}
+
+// UnmountAll unmounts the filesystem views of the dats, for shutting down.
+func (rs *RombaService) UnmountAll() {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	for dir, m := range rs.mounts {
+		err := m.server.Unmount()
+		if err != nil {
+			logger.Errorf("error unmounting %s: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func (rs *RombaService) pin(cmd *commander.Command, args []string) error {
+	protect := cmd.Flag.Lookup("protect").Value.Get().(bool)
+	unpin := cmd.Flag.Lookup("unpin").Value.Get().(bool)
+	if protect && unpin {
+		return fmt.Errorf("only one of -protect and -unpin can be given")
+	}
+
+	if len(args) == 0 {
+		flags, err := rs.romDB.DatFlags()
+		if err != nil {
+			return err
+		}
+		if len(flags) == 0 {
+			fmt.Fprintf(cmd.Stdout, "no dats are pinned\n")
+		}
+		paths := make([]string, 0, len(flags))
+		for path := range flags {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			fmt.Fprintf(cmd.Stdout, "%s\t%v\n", path, flags[path])
+		}
+		return nil
+	}
+
+	var flags types.DatFlags
+	if !unpin {
+		flags.Pinned = true
+		flags.Protected = protect
+	}
+
+	paths, err := rs.datPaths(args)
+	if err != nil {
+		return err
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	for _, path := range sorted {
+		err = rs.romDB.SetDatFlags(path, flags)
+		if err != nil {
+			return err
+		}
+		logger.Infof("set flags of dat %s to %v", path, flags)
+		fmt.Fprintf(cmd.Stdout, "%s\t%v\n", path, flags)
+	}
+	return nil
+}
+
+func (rs *RombaService) handlePins(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	flags, err := rs.romDB.DatFlags()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if flags == nil {
+		flags = map[string]types.DatFlags{}
+	}
+	writeJSON(w, http.StatusOK, flags)
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+const pinTestDat = `clrmamepro (
+	name "test"
+)
+
+game (
+	name "game"
+	rom ( name "a.bin" size 3 crc 00000000 sha1 da39a3ee5e6b4b0d3255bfef95601890afd80709 )
+)
+`
+
+func TestPin(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-pin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	setDir := filepath.Join(root, "set")
+	datPath := filepath.Join(datsDir, "test.dat")
+	romPath := filepath.Join(depotRoot, "da", "39", "a3", "ee", "da39a3ee5e6b4b0d3255bfef95601890afd80709.gz")
+	junkPath := filepath.Join(setDir, "junk.txt")
+	for path, content := range map[string]string{datPath: pinTestDat, romPath: "rom", junkPath: "junk"} {
+		err = os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hashes, err := archive.HashesForFile(datPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, _, err := parser.ParseDat(strings.NewReader(pinTestDat), datPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb := &trashTestDB{lookupTestDB{dat: dat, datSha1: hashes.Sha1}}
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, tdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewRombaService(tdb, depot, testConfig(datsDir, root))
+
+	out, _, err := rs.runCommand([]string{"pin", "-protect", datsDir}, nil)
+	if err != nil || !strings.Contains(out, "protected") {
+		t.Fatalf("pin answered %q, %v", out, err)
+	}
+	if f := tdb.flags[datPath]; !f.Pinned || !f.Protected {
+		t.Fatalf("got flags %+v of %s, want pinned and protected", f, datPath)
+	}
+
+	// the only dat of the rom is obsolete but pinned
+	_, started, err := rs.runCommand([]string{"purge-delete", datPath}, nil)
+	if err != nil || started == nil {
+		t.Fatalf("purge-delete didn't start a job: %v", err)
+	}
+	job := waitForJob(t, rs, started.ID)
+	if job.State != JobDone {
+		t.Fatalf("got job %+v", job)
+	}
+	if _, err := os.Stat(romPath); err != nil {
+		t.Errorf("rom of a pinned dat purged: %v", err)
+	}
+
+	_, started, err = rs.runCommand([]string{"fix", "-set", setDir, "-out", filepath.Join(root, "out"), datPath}, nil)
+	if err != nil || started == nil {
+		t.Fatalf("fix didn't start a job: %v", err)
+	}
+	job = waitForJob(t, rs, started.ID)
+	if job.State != JobFailed || !strings.Contains(job.Error, "protected") {
+		t.Errorf("got job %+v, want fix refused for the protected dat", job)
+	}
+	if _, err := os.Stat(junkPath); err != nil {
+		t.Errorf("set folder of a protected dat changed: %v", err)
+	}
+
+	for _, arg := range []string{junkPath, setDir} {
+		out, _, err = rs.runCommand([]string{"pin", arg}, nil)
+		if err == nil {
+			t.Errorf("pin of %s answered %q, want it refused", arg, out)
+		}
+	}
+
+	out, _, err = rs.runCommand([]string{"pin", "-unpin", datPath}, nil)
+	if err != nil || tdb.flags[datPath] != (types.DatFlags{}) {
+		t.Errorf("unpin answered %q, %v, flags %+v", out, err, tdb.flags[datPath])
+	}
+}
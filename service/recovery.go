@@ -0,0 +1,445 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gonuts/commander"
+	"github.com/gonuts/flag"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/auth"
+)
+
+// journalFilename is the file in the log dir the running job is written to
+// for as long as it runs. Finding it at startup tells that the daemon died
+// in the middle of the job.
+const journalFilename = "romba-running.json"
+
+// resumeLogTimeFormat is the format of the start time in the names of the
+// resume logs of archive and scrub runs.
+const resumeLogTimeFormat = "2006-01-02-15_04_05"
+
+// resumeLogPrefixes are the names the resume logs of the commands start
+// with, by command. The logs list the paths the runs were done up to, the
+// last one being where the command resumes with -resume.
+var resumeLogPrefixes = map[string]string{
+	"archive": "archive-resume-",
+	"scrub":   "scrub-resume-",
+}
+
+// Recovery is a job interrupted by a crash, power failure or shutdown of the
+// daemon, and how to finish it. It is either resumed, running its command
+// again from where it stopped, or rolled back, removing the partial files it
+// left behind.
+type Recovery struct {
+	Job *Job `json:"job"`
+	// Checkpoint is the path archive and scrub runs were done up to, from
+	// their resume logs.
+	Checkpoint string `json:"checkpoint,omitempty"`
+	// Resume is the command line resuming the job, empty if it can't be.
+	Resume []string `json:"resume,omitempty"`
+	// Leftovers are the partial files of the job a rollback removes.
+	Leftovers []string `json:"leftovers,omitempty"`
+}
+
+// errNoRecovery tells that there is no interrupted job with some ID.
+var errNoRecovery = errors.New("no interrupted job")
+
+// writeJournal records job as the running job. The caller holds jobMutex.
+func (rs *RombaService) writeJournal(job *Job) {
+	if rs.logDir == "" {
+		return
+	}
+
+	bs, err := json.MarshalIndent(job, "", "  ")
+	if err == nil {
+		jpath := filepath.Join(rs.logDir, journalFilename)
+		err = ioutil.WriteFile(jpath+".tmp", bs, 0666)
+		if err == nil {
+			err = os.Rename(jpath+".tmp", jpath)
+		}
+	}
+	if err != nil {
+		logger.Errorf("error writing job journal: %v", err)
+	}
+}
+
+// clearJournal records that no job is running. The caller holds jobMutex.
+func (rs *RombaService) clearJournal() {
+	if rs.logDir == "" {
+		return
+	}
+
+	err := os.Remove(filepath.Join(rs.logDir, journalFilename))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Errorf("error removing job journal: %v", err)
+	}
+}
+
+// loadJournal looks for a job interrupted before the last shutdown and
+// remembers it as interrupted, with how to recover it.
+func (rs *RombaService) loadJournal() error {
+	if rs.logDir == "" {
+		return nil
+	}
+
+	jpath := filepath.Join(rs.logDir, journalFilename)
+	bs, err := ioutil.ReadFile(jpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	job := new(Job)
+	err = json.Unmarshal(bs, job)
+	if err == nil {
+		job.seq, err = strconv.ParseInt(job.ID, 10, 64)
+	}
+	if err != nil {
+		os.Remove(jpath)
+		return fmt.Errorf("dropping malformed job journal: %v", err)
+	}
+	job.State = JobInterrupted
+	job.Error = "interrupted, the daemon stopped while the job ran"
+
+	rec := rs.newRecovery(job)
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if job.seq > rs.lastJobID {
+		rs.lastJobID = job.seq
+	}
+	rs.addJob(job)
+	rs.recoveries = append(rs.recoveries, rec)
+	rs.events.add(&JobEvent{Job: job.ID, Type: EventState, State: job.State})
+	rs.clearJournal()
+
+	logger.Warningf("job %s (%s) was interrupted: %s", job.ID, strings.Join(job.Args, " "), describeRecovery(rec))
+	return nil
+}
+
+// newRecovery works out how to resume and roll back the interrupted job.
+func (rs *RombaService) newRecovery(job *Job) *Recovery {
+	rec := &Recovery{Job: job}
+	if len(job.Args) == 0 {
+		return rec
+	}
+	rec.Resume = job.Args
+
+	fs, err := rs.commandFlags(job.Args)
+	if err != nil {
+		logger.Warningf("can't resume job %s: %v", job.ID, err)
+		rec.Resume = nil
+		return rec
+	}
+
+	if prefix, ok := resumeLogPrefixes[job.Args[0]]; ok && job.Started != nil {
+		rec.Checkpoint, err = findCheckpoint(rs.logDir, prefix, *job.Started)
+		if err != nil {
+			logger.Warningf("error reading the resume log of job %s: %v", job.ID, err)
+		}
+		if rec.Checkpoint != "" {
+			rec.Resume = withFlag(job.Args[0], fs, "resume", rec.Checkpoint)
+		}
+	}
+
+	if job.Args[0] == "build" {
+		outpath := fs.Lookup("out").Value.Get().(string)
+		if outpath != "" {
+			rec.Leftovers, err = archive.BuildLeftovers(outpath)
+			if err != nil {
+				logger.Warningf("error looking for the leftovers of job %s: %v", job.ID, err)
+			}
+		}
+	}
+	return rec
+}
+
+// commandFlags returns the flags of the command given by argv, parsed.
+func (rs *RombaService) commandFlags(argv []string) (*flag.FlagSet, error) {
+	cmd := newCommander(ioutil.Discard, rs)
+	for _, sub := range cmd.Commands {
+		if sub != nil && sub.Name() == argv[0] {
+			fs := &sub.Flag
+			err := fs.Parse(argv[1:])
+			if err != nil {
+				return nil, err
+			}
+			return fs, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown command %s", argv[0])
+}
+
+// withFlag returns the command line of the command name with the flags fs
+// was parsed with, flag being set to value.
+func withFlag(name string, fs *flag.FlagSet, flagName, value string) []string {
+	argv := []string{name}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != flagName {
+			argv = append(argv, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+		}
+	})
+	argv = append(argv, fmt.Sprintf("-%s=%s", flagName, value))
+	return append(argv, fs.Args()...)
+}
+
+// findCheckpoint returns the last path in the resume log of the run started
+// with the job started at started, the empty string if there is none. The
+// run's log is the first one in logDir named prefix and a time no earlier
+// than started.
+func findCheckpoint(logDir, prefix string, started time.Time) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(logDir, prefix+"*.log"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+
+	since := started.Truncate(time.Second)
+	for _, path := range paths {
+		ts := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), prefix), ".log")
+		t, err := time.ParseInLocation(resumeLogTimeFormat, ts, time.Local)
+		if err != nil || t.Before(since) {
+			continue
+		}
+		return lastLine(path)
+	}
+	return "", nil
+}
+
+// lastLine returns the last line of the file at path that isn't empty.
+func lastLine(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var last string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			last = line
+		}
+	}
+	return last, scanner.Err()
+}
+
+func describeRecovery(rec *Recovery) string {
+	var parts []string
+	if rec.Checkpoint != "" {
+		parts = append(parts, "done up to "+rec.Checkpoint)
+	}
+	if len(rec.Resume) > 0 {
+		parts = append(parts, "resume with: "+strings.Join(rec.Resume, " "))
+	} else {
+		parts = append(parts, "can't be resumed")
+	}
+	if len(rec.Leftovers) > 0 {
+		parts = append(parts, fmt.Sprintf("%d partial files to roll back", len(rec.Leftovers)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// listRecoveries returns the interrupted jobs waiting to be recovered.
+func (rs *RombaService) listRecoveries() []*Recovery {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	recs := make([]*Recovery, len(rs.recoveries))
+	for i, rec := range rs.recoveries {
+		rc := *rec
+		rc.Job = rs.jobSnapshot(rec.Job)
+		recs[i] = &rc
+	}
+	return recs
+}
+
+// takeRecovery removes the recovery of the job with the given ID from the
+// ones waiting. The caller holds jobMutex.
+func (rs *RombaService) takeRecovery(id string) (*Recovery, error) {
+	for i, rec := range rs.recoveries {
+		if rec.Job.ID == id {
+			rs.recoveries = append(rs.recoveries[:i], rs.recoveries[i+1:]...)
+			return rec, nil
+		}
+	}
+	return nil, fmt.Errorf("%v %s", errNoRecovery, id)
+}
+
+// resumeJob queues the command resuming the interrupted job with the given
+// ID, for the user u, and returns the queued job.
+func (rs *RombaService) resumeJob(u *auth.User, id string) (*Job, error) {
+	rs.jobMutex.Lock()
+	rec, err := rs.takeRecovery(id)
+	if err == nil && len(rec.Resume) == 0 {
+		err = fmt.Errorf("job %s can't be resumed", id)
+	}
+	if err == nil {
+		err = authorizeCommand(u, rec.Resume)
+	}
+	if err != nil && rec != nil {
+		rs.recoveries = append(rs.recoveries, rec)
+	}
+	rs.jobMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := rs.enqueueJob(u, rec.Resume, rec.Job.Priority, rec.Job.Limits)
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if err != nil {
+		rs.recoveries = append(rs.recoveries, rec)
+		return nil, err
+	}
+	rec.Job.Message = "resumed as job " + job.ID
+
+	logger.Infof("resuming interrupted job %s as job %s: %s", id, job.ID, strings.Join(rec.Resume, " "))
+	return job, nil
+}
+
+// rollbackJob removes the partial files left behind by the interrupted job
+// with the given ID and returns its recovery.
+func (rs *RombaService) rollbackJob(id string) (*Recovery, error) {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	rec, err := rs.takeRecovery(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range rec.Leftovers {
+		err = os.RemoveAll(path)
+		if err != nil {
+			rs.recoveries = append(rs.recoveries, rec)
+			return nil, err
+		}
+	}
+
+	rec.Job.Message = fmt.Sprintf("rolled back, removed %d partial files", len(rec.Leftovers))
+	logger.Infof("rolled back interrupted job %s, removed %d partial files", id, len(rec.Leftovers))
+
+	rc := *rec
+	rc.Job = rs.jobSnapshot(rec.Job)
+	return &rc, nil
+}
+
+// findRecovery returns a snapshot of the recovery of the interrupted job with
+// the given ID, nil if there is none.
+func (rs *RombaService) findRecovery(id string) *Recovery {
+	for _, rec := range rs.listRecoveries() {
+		if rec.Job.ID == id {
+			return rec
+		}
+	}
+	return nil
+}
+
+// recoverAll resumes or rolls back all interrupted jobs as told by mode, the
+// general.recovery setting. Jobs which can't be resumed are rolled back.
+func (rs *RombaService) recoverAll(mode string) {
+	for _, rec := range rs.listRecoveries() {
+		var err error
+		switch {
+		case mode == "resume" && len(rec.Resume) > 0:
+			_, err = rs.resumeJob(nil, rec.Job.ID)
+		case mode == "resume" || mode == "rollback":
+			_, err = rs.rollbackJob(rec.Job.ID)
+		}
+		if err != nil {
+			logger.Errorf("error recovering job %s: %v", rec.Job.ID, err)
+		}
+	}
+}
+
+func (rs *RombaService) recoverCmd(cmd *commander.Command, args []string) error {
+	resume := cmd.Flag.Lookup("resume").Value.Get().(bool)
+	rollback := cmd.Flag.Lookup("rollback").Value.Get().(bool)
+	if resume && rollback {
+		return fmt.Errorf("only one of -resume and -rollback can be given")
+	}
+
+	if len(args) == 0 {
+		for _, rec := range rs.listRecoveries() {
+			args = append(args, rec.Job.ID)
+		}
+	}
+
+	for _, id := range args {
+		switch {
+		case resume:
+			job, err := rs.resumeJob(rs.caller, id)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.Stdout, "resumed job %s as job %s: %s\n", id, job.ID, strings.Join(job.Args, " "))
+		case rollback:
+			rec, err := rs.rollbackJob(id)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.Stdout, "rolled back job %s, removed %d partial files\n", id, len(rec.Leftovers))
+		default:
+			rec := rs.findRecovery(id)
+			if rec == nil {
+				return fmt.Errorf("%v %s", errNoRecovery, id)
+			}
+			printRecovery(cmd.Stdout, rec)
+		}
+	}
+	return nil
+}
+
+// printRecovery writes rec in the format of the recover command.
+func printRecovery(w io.Writer, rec *Recovery) {
+	fmt.Fprintf(w, "%s\t%s\t%s\n", rec.Job.ID, rec.Job.Name, describeRecovery(rec))
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/auth"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestRecovery(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-recovery-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	outDir := filepath.Join(root, "out")
+	for _, dir := range []string{depotRoot, datsDir, filepath.Join(outDir, "test")} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ldb := &lookupTestDB{dat: &types.Dat{Name: "test"}}
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, ldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an archive run dies after its resume log got to /roms/b
+	rs := NewRombaService(ldb, depot, testConfig(datsDir, root))
+	rs.jobMutex.Lock()
+	rs.runArgs = []string{"archive", "-only-needed", "/roms"}
+	archiveJob := rs.beginJob("archive")
+	rs.jobMutex.Unlock()
+
+	resumeLog := filepath.Join(root, "archive-resume-"+archiveJob.Started.Format(resumeLogTimeFormat)+".log")
+	err = ioutil.WriteFile(resumeLog, []byte("/roms/a\n/roms/b\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs = NewRombaService(ldb, depot, testConfig(datsDir, root))
+
+	recs := rs.listRecoveries()
+	if len(recs) != 1 || recs[0].Job.ID != archiveJob.ID || recs[0].Job.State != JobInterrupted {
+		t.Fatalf("got recoveries %+v, want the interrupted archive job", recs)
+	}
+	wantResume := []string{"archive", "-only-needed=true", "-resume=/roms/b", "/roms"}
+	if recs[0].Checkpoint != "/roms/b" || !reflect.DeepEqual(recs[0].Resume, wantResume) {
+		t.Errorf("got checkpoint %q and resume %q, want /roms/b and %q", recs[0].Checkpoint, recs[0].Resume, wantResume)
+	}
+	if job := rs.findJob(archiveJob.ID); job == nil || job.State != JobInterrupted {
+		t.Errorf("got job %+v, want it interrupted", job)
+	}
+
+	// a build keeps the service busy while the archive run is resumed, and
+	// dies leaving a partial game behind
+	rs.jobMutex.Lock()
+	rs.runArgs = []string{"build", "-out", outDir, datsDir}
+	buildJob := rs.beginJob("build")
+	rs.jobMutex.Unlock()
+
+	partial := filepath.Join(outDir, "test", ".romba-build-123")
+	game := filepath.Join(outDir, "test", "game.zip")
+	for _, path := range []string{partial, game} {
+		err = ioutil.WriteFile(path, []byte("zip"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = rs.resumeJob(&auth.User{Name: "club", Role: auth.ReadOnly}, archiveJob.ID)
+	if _, ok := err.(*forbiddenError); !ok {
+		t.Errorf("readonly user resumed job: %v", err)
+	}
+	resumed, err := rs.resumeJob(nil, archiveJob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.State != JobQueued || !reflect.DeepEqual(resumed.Args, wantResume) {
+		t.Errorf("got resumed job %+v, want %q queued", resumed, wantResume)
+	}
+	if recs := rs.listRecoveries(); len(recs) != 0 {
+		t.Errorf("got recoveries %+v after resuming", recs)
+	}
+	_, err = rs.cancelJob(nil, resumed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the partial game of the build is rolled back at startup
+	cfg := testConfig(datsDir, root)
+	cfg.General.Recovery = "rollback"
+	rs = NewRombaService(ldb, depot, cfg)
+
+	if recs := rs.listRecoveries(); len(recs) != 0 {
+		t.Errorf("got recoveries %+v after rolling back", recs)
+	}
+	job := rs.findJob(buildJob.ID)
+	if job == nil || job.State != JobInterrupted || job.Message != "rolled back, removed 1 partial files" {
+		t.Errorf("got job %+v, want it rolled back", job)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial game not removed: %v", err)
+	}
+	if _, err := os.Stat(game); err != nil {
+		t.Errorf("built game removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, journalFilename)); !os.IsNotExist(err) {
+		t.Errorf("journal left behind: %v", err)
+	}
+}
@@ -31,17 +31,17 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/md5"
 	"crypto/rand"
-	"crypto/sha1"
-	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"hash/crc32"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/debug"
 	"strings"
@@ -50,15 +50,27 @@ import (
 
 	"code.google.com/p/go.net/websocket"
 	"github.com/dustin/go-humanize"
-	"github.com/golang/glog"
 	"github.com/gonuts/commander"
 
 	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/auth"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/datsync"
 	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/logging"
+	"github.com/uwedeportivo/romba/notify"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/replica"
+	"github.com/uwedeportivo/romba/stats"
+	"github.com/uwedeportivo/romba/tlsconf"
+	"github.com/uwedeportivo/romba/torrent"
+	"github.com/uwedeportivo/romba/trash"
 	"github.com/uwedeportivo/romba/types"
 	"github.com/uwedeportivo/romba/worker"
 )
 
+var logger = logging.For("service")
+
 type ProgressNessage struct {
 	TotalFiles      int32
 	TotalBytes      int64
@@ -72,6 +84,8 @@ type ProgressNessage struct {
 }
 
 type RombaService struct {
+	// cfg is the configuration the service was started with
+	cfg               *config.Config
 	romDB             db.RomDB
 	depot             *archive.Depot
 	logDir            string
@@ -83,6 +97,66 @@ type RombaService struct {
 	jobName           string
 	progressMutex     *sync.Mutex
 	progressListeners map[string]chan *ProgressNessage
+	// jobs are the most recent started jobs and queue the jobs waiting to
+	// run, guarded by jobMutex like busy
+	jobs       []*Job
+	queue      []*Job
+	currentJob *Job
+	// recoveries are the interrupted jobs waiting to be resumed or rolled
+	// back, guarded by jobMutex
+	recoveries []*Recovery
+	// jobLog is the log file of currentJob and jobCapture the capture of its
+	// records into it
+	jobLog     *os.File
+	jobCapture *logging.Job
+	lastJobID  int64
+	// pendingJob is the queued job whose command is being run, startedJob
+	// the job started by the command being run and runArgs its command line
+	pendingJob *Job
+	runArgs    []string
+	// limits are the limits of the job being started or run, set while
+	// the service isn't busy and read by the running job
+	limits     *Limits
+	startedJob *Job
+	refused    bool
+	queueWake  chan struct{}
+	// cmdMutex serializes commands, so the job started by a command is
+	// known
+	cmdMutex *sync.Mutex
+	metrics  *serviceMetrics
+	events   *eventLog
+	replica  http.Handler
+	// mounts are the filesystem views of the dats by mount directory,
+	// guarded by jobMutex
+	mounts map[string]*rombaMount
+	// datSyncURLs are where datsync fetches dats from
+	datSyncURLs []string
+	datSyncOpts *datsync.Options
+	// stats are the samples of the depot statistics
+	stats *stats.History
+	// chdman creates and extracts CHDs for build -chd and archive
+	// -verify-chd
+	chdman archive.CHDTool
+	// trash keeps what purge, fix, rebuild and archive -delete-sources
+	// remove, for undo, if trashEnabled
+	trash        *trash.Trash
+	trashEnabled bool
+	// notifiers are told about the jobs that end, only about failed ones
+	// if notifyFailuresOnly
+	notifiers          []notify.Notifier
+	notifyFailuresOnly bool
+	hostname           string
+	// replicaToken is sent to the secondary replicate pushes to, over TLS
+	// with the CA, certificate and key files of the [replica] config
+	replicaToken string
+	replicaCA    string
+	replicaCert  string
+	replicaKey   string
+	// tokens are the users of the HTTP API
+	tokens *auth.Tokens
+	// caller is the user running the current command, nil for the service
+	// itself, guarded by cmdMutex
+	caller *auth.User
 }
 
 type TerminalRequest struct {
@@ -93,17 +167,100 @@ type TerminalReply struct {
 	Message string
 }
 
-func NewRombaService(romDB db.RomDB, depot *archive.Depot, dats string, numWorkers int, logDir string) *RombaService {
+func NewRombaService(romDB db.RomDB, depot *archive.Depot, cfg *config.Config) *RombaService {
 	rs := new(RombaService)
+	rs.cfg = cfg
 	rs.romDB = romDB
 	rs.depot = depot
-	rs.dats = dats
-	rs.logDir = logDir
-	rs.numWorkers = numWorkers
+	rs.dats = cfg.Index.Dats
+	rs.logDir = cfg.General.LogDir
+	rs.numWorkers = cfg.General.Workers
 	rs.pt = worker.NewProgressTracker()
 	rs.jobMutex = new(sync.Mutex)
 	rs.progressMutex = new(sync.Mutex)
+	rs.cmdMutex = new(sync.Mutex)
 	rs.progressListeners = make(map[string]chan *ProgressNessage)
+	rs.queueWake = make(chan struct{}, 1)
+	rs.metrics = newServiceMetrics()
+	rs.events = newEventLog()
+	rs.replica = replica.NewHandler(depot, cfg.Replica.AcceptDeletes)
+	rs.replicaToken = cfg.Replica.Token
+	rs.replicaCA = cfg.Replica.CA
+	rs.replicaCert = cfg.Replica.Cert
+	rs.replicaKey = cfg.Replica.Key
+	rs.mounts = make(map[string]*rombaMount)
+	rs.chdman = archive.NewChdman(cfg.General.Chdman)
+	rs.stats = stats.NewHistory(filepath.Join(rs.logDir, statsFilename), cfg.Stats.Keep)
+
+	trashDir := cfg.Trash.Dir
+	if trashDir == "" {
+		trashDir = filepath.Join(rs.logDir, "trash")
+	}
+	rs.trash = trash.New(trashDir, time.Duration(cfg.Trash.Days)*24*time.Hour)
+	rs.trashEnabled = cfg.Trash.Enabled
+	for _, a := range depot.TrashAreas() {
+		err := rs.trash.AddArea(a.Root, a.Dir)
+		if err != nil {
+			logger.Errorf("error adding trash of depot root %s: %v", a.Root, err)
+		}
+	}
+
+	rs.datSyncURLs = cfg.DatSync.URL
+	rs.datSyncOpts = &datsync.Options{
+		Dir:        filepath.Join(cfg.Index.Dats, cfg.DatSync.Dir),
+		HistoryDir: cfg.DatSync.History,
+		Keep:       cfg.DatSync.Keep,
+	}
+	if rs.datSyncOpts.HistoryDir == "" {
+		rs.datSyncOpts.HistoryDir = filepath.Join(rs.logDir, "dat-history")
+	}
+
+	for _, u := range cfg.Notify.Webhook {
+		wh, err := notify.NewWebhook(u)
+		if err != nil {
+			logger.Errorf("error setting up notifications: %v", err)
+			continue
+		}
+		rs.notifiers = append(rs.notifiers, wh)
+	}
+	if cfg.Notify.SMTP != "" {
+		rs.notifiers = append(rs.notifiers, &notify.Mail{
+			Addr:     cfg.Notify.SMTP,
+			From:     cfg.Notify.From,
+			To:       cfg.Notify.To,
+			Username: cfg.Notify.Username,
+			Password: cfg.Notify.Password,
+		})
+	}
+	rs.notifyFailuresOnly = cfg.Notify.On == "failure"
+	rs.hostname, _ = os.Hostname()
+
+	tokens, err := cfg.Tokens()
+	if err != nil {
+		// Load validated cfg, this only happens to hand-made ones, which
+		// get no users rather than a daemon refusing everyone
+		logger.Errorf("error setting up users: %v", err)
+		tokens = auth.NewTokens()
+	}
+	rs.tokens = tokens
+
+	err = rs.loadJournal()
+	if err != nil {
+		logger.Errorf("error loading job journal: %v", err)
+	}
+	err = rs.loadQueue()
+	if err != nil {
+		logger.Errorf("error loading job queue: %v", err)
+	}
+	rs.recoverAll(cfg.General.Recovery)
+	go rs.runQueue()
+
+	if cfg.DatSync.Interval > 0 && len(rs.datSyncURLs) > 0 {
+		go rs.scheduleCommand("datsync", time.Duration(cfg.DatSync.Interval)*time.Hour)
+	}
+	if cfg.Stats.Interval > 0 {
+		go rs.scheduleCommand("stats", time.Duration(cfg.Stats.Interval)*time.Hour)
+	}
 	return rs
 }
 
@@ -132,6 +289,10 @@ func (rs *RombaService) broadCastProgress(t time.Time, starting bool, stopping b
 	}
 	rs.progressMutex.Unlock()
 
+	if p != nil {
+		rs.recordProgress(p)
+	}
+
 	pmsg := new(ProgressNessage)
 
 	pmsg.Starting = starting
@@ -158,32 +319,96 @@ func (rs *RombaService) broadCastProgress(t time.Time, starting bool, stopping b
 }
 
 func (rs *RombaService) Execute(r *http.Request, req *TerminalRequest, reply *TerminalReply) error {
-	outbuf := new(bytes.Buffer)
-
-	cmd := newCommander(outbuf, rs)
-
 	cmdTxtSplit, err := splitIntoArgs(req.CmdTxt)
 	if err != nil {
 		reply.Message = fmt.Sprintf("error: splitting command failed: %v\n", err)
 		return nil
 	}
 
-	err = cmd.Flag.Parse(cmdTxtSplit)
+	reply.Message, _, err = rs.runCommandAs(auth.UserFrom(r.Context()), cmdTxtSplit, nil, nil)
+	if err != nil && err != errBusy {
+		reply.Message = fmt.Sprintf("error: %v\n", err)
+	}
+	return nil
+}
+
+// runCommand runs the command given by argv, its name followed by flags and
+// arguments, and returns its output and the job it started, if any. queued is
+// the queued job the command runs for, nil for commands run directly. It
+// returns errBusy along with the output if the command couldn't start its job
+// because of the running one.
+func (rs *RombaService) runCommand(argv []string, queued *Job) (string, *Job, error) {
+	var limits *Limits
+	if queued != nil {
+		limits = queued.Limits
+	}
+	return rs.runCommandAs(nil, argv, queued, limits)
+}
+
+// runCommandAs runs the command given by argv like runCommand, for the user
+// u, with the job it starts restricted to limits if not nil. It returns a
+// *forbiddenError if u may not run the command.
+func (rs *RombaService) runCommandAs(u *auth.User, argv []string, queued *Job, limits *Limits) (string, *Job, error) {
+	rs.cmdMutex.Lock()
+	defer rs.cmdMutex.Unlock()
+
+	err := authorizeCommand(u, argv)
 	if err != nil {
-		reply.Message = fmt.Sprintf("error: parsing command failed: %v\n", err)
-		return nil
+		logger.Infof("refused command %s: %v", strings.Join(argv, " "), err)
+		return "", nil, err
+	}
+	rs.caller = u
+	defer func() {
+		rs.caller = nil
+	}()
+
+	outbuf := new(bytes.Buffer)
+
+	cmd := newCommander(outbuf, rs)
+
+	err = cmd.Flag.Parse(argv)
+	if err != nil {
+		rs.metrics.commandFailed()
+		return "", nil, fmt.Errorf("parsing command failed: %v", err)
 	}
 
+	rs.jobMutex.Lock()
+	rs.pendingJob = queued
+	if !rs.busy {
+		// the running job keeps its limits
+		rs.limits = limits
+	}
+	rs.runArgs = argv
+	rs.startedJob = nil
+	rs.refused = false
+	rs.jobMutex.Unlock()
+
 	args := cmd.Flag.Args()
 	err = cmd.Run(args)
+
+	rs.jobMutex.Lock()
+	started := rs.startedJob
+	refused := rs.refused
+	rs.pendingJob = nil
+	rs.runArgs = nil
+	rs.startedJob = nil
+	rs.refused = false
+	rs.jobMutex.Unlock()
+
+	if fe, ok := err.(*forbiddenError); ok {
+		logger.Infof("refused command %s: %v", strings.Join(argv, " "), err)
+		return "", nil, fe
+	}
 	if err != nil {
-		reply.Message = fmt.Sprintf("error: executing command failed: %v\n", err)
-		glog.Errorf("error executing command %s: %v", req.CmdTxt, err)
-		return nil
+		rs.metrics.commandFailed()
+		logger.Errorf("error executing command %s: %v", strings.Join(argv, " "), err)
+		return "", nil, fmt.Errorf("executing command failed: %v", err)
+	}
+	if refused {
+		return outbuf.String(), nil, errBusy
 	}
 
-	reply.Message = outbuf.String()
-	return nil
+	return outbuf.String(), started, nil
 }
 
 func runCmd(cmd *commander.Command, args []string) error {
@@ -195,100 +420,124 @@ func (rs *RombaService) startRefreshDats(cmd *commander.Command, args []string)
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
 
-	if rs.busy {
-		p := rs.pt.GetProgress()
-
-		fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
-			p.FilesSoFar, p.TotalFiles, humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
+	if rs.refuseBusy(cmd) {
 		return nil
 	}
 
-	rs.pt.Reset()
-	rs.busy = true
-	rs.jobName = "refresh-dats"
-
-	go func() {
-		glog.Infof("service starting refresh-dats")
-		rs.broadCastProgress(time.Now(), true, false, "")
-		ticker := time.NewTicker(time.Second * 5)
-		stopTicker := make(chan bool)
-		go func() {
-			glog.Infof("starting progress broadcaster")
-			for {
-				select {
-				case t := <-ticker.C:
-					rs.broadCastProgress(t, false, false, "")
-				case <-stopTicker:
-					glog.Info("stopped progress broadcaster")
-					return
-				}
-			}
-		}()
-
-		endMsg, err := db.Refresh(rs.romDB, rs.dats, rs.numWorkers, rs.pt)
-		if err != nil {
-			glog.Errorf("error refreshing dats: %v", err)
-		}
+	filter, err := refreshFilter(cmd)
+	if err != nil {
+		return err
+	}
 
-		ticker.Stop()
-		stopTicker <- true
+	paths, err := rs.refreshPaths(args)
+	if err != nil {
+		return err
+	}
 
-		rs.jobMutex.Lock()
-		rs.busy = false
-		rs.jobName = ""
-		rs.jobMutex.Unlock()
+	var conflicts *db.ConflictChecker
+	if cmd.Flag.Lookup("conflicts").Value.Get().(bool) {
+		conflicts = db.NewConflictChecker()
+	}
 
-		rs.broadCastProgress(time.Now(), false, true, endMsg)
-		glog.Infof("service finished refresh-dats")
-	}()
+	rs.startJob("refresh-dats", func() (string, error) {
+		var endMsg string
+		if len(paths) > 0 {
+			endMsg, err = db.RefreshPaths(rs.romDB, paths, rs.workers(), rs.tracker(), filter, conflicts)
+		} else {
+			endMsg, err = db.Refresh(rs.romDB, rs.dats, rs.workers(), rs.tracker(), filter, conflicts)
+		}
+		if err != nil {
+			logger.Errorf("error refreshing dats: %v", err)
+		} else if conflicts != nil {
+			endMsg += "\n" + rs.saveConflicts(conflicts)
+		}
+		return endMsg, err
+	})
 
 	fmt.Fprintf(cmd.Stdout, "started refresh dats")
 	return nil
 }
 
-func (rs *RombaService) lookup(cmd *commander.Command, args []string) error {
+// refreshPaths returns the dat files or directories args of refresh-dats
+// name, relative ones taken from the DAT master directory. They have to be
+// in it.
+func (rs *RombaService) refreshPaths(args []string) ([]string, error) {
+	dats := filepath.Clean(rs.dats)
+
+	var paths []string
 	for _, arg := range args {
-		hash, err := hex.DecodeString(arg)
-		if err != nil {
-			return err
+		path := arg
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dats, path)
 		}
+		path = filepath.Clean(path)
 
-		if len(hash) == sha1.Size {
-			dat, err := rs.romDB.GetDat(hash)
-			if err != nil {
-				return err
-			}
+		rel, err := filepath.Rel(dats, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is not in the DAT master directory %s", arg, rs.dats)
+		}
 
-			if dat != nil {
-				fmt.Fprintf(cmd.Stdout, "dat with sha1 %s = %s\n", arg, types.PrintShortDat(dat))
-			}
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
 		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
 
-		r := new(types.Rom)
-		switch len(hash) {
-		case md5.Size:
-			r.Md5 = hash
-		case crc32.Size:
-			r.Crc = hash
-		case sha1.Size:
-			r.Sha1 = hash
-		default:
-			return fmt.Errorf("found unknown hash size: %d", len(hash))
+// refreshFilter returns the filter of games set by the flags of refresh-dats.
+func refreshFilter(cmd *commander.Command) (*parser.Filter, error) {
+	var f parser.Filter
+
+	for _, opt := range []struct {
+		name string
+		res  *[]*regexp.Regexp
+	}{
+		{"include", &f.Include},
+		{"exclude", &f.Exclude},
+	} {
+		if expr := cmd.Flag.Lookup(opt.name).Value.Get().(string); expr != "" {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("bad -%s: %v", opt.name, err)
+			}
+			*opt.res = append(*opt.res, re)
 		}
+	}
 
-		dats, err := rs.romDB.DatsForRom(r)
-		if err != nil {
-			return err
+	f.Regions = splitList(cmd.Flag.Lookup("regions").Value.Get().(string))
+	f.Categories = splitList(cmd.Flag.Lookup("categories").Value.Get().(string))
+	return &f, nil
+}
+
+// splitList returns the entries of a comma-separated list.
+func splitList(list string) []string {
+	var entries []string
+	for _, e := range strings.Split(list, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			entries = append(entries, e)
 		}
+	}
+	return entries
+}
+
+func (rs *RombaService) lookup(cmd *commander.Command, args []string) error {
+	asJSON := cmd.Flag.Lookup("json").Value.Get().(bool)
 
-		err = rs.romDB.CompleteRom(r)
+	for _, arg := range args {
+		lr, err := rs.lookupQuery(arg, rs.caller)
 		if err != nil {
 			return err
 		}
 
-		if len(dats) > 0 {
-			fmt.Fprintf(cmd.Stdout, "rom in %s\n", types.PrintRomInDats(dats))
+		if asJSON {
+			err = json.NewEncoder(cmd.Stdout).Encode(lr)
+			if err != nil {
+				return err
+			}
+			continue
 		}
+		PrintLookupResult(cmd.Stdout, lr)
 	}
 
 	return nil
@@ -317,7 +566,7 @@ func (rs *RombaService) shutdown(cmd *commander.Command, args []string) error {
 
 	err := rs.romDB.Close()
 	if err != nil {
-		glog.Errorf("error closing rom database: %v", err)
+		logger.Errorf("error closing rom database: %v", err)
 	}
 
 	fmt.Printf("done saving cached data, exiting...\n")
@@ -342,8 +591,8 @@ func (pw *buildWorker) Process(path string, size int64) error {
 
 	if dat == nil {
 		// TODO(uwe): maybe parse it and add it to the DB
-		glog.Warningf("did not find a DAT for %s, maybe a refresh is needed", path)
-		return nil
+		logger.Warningf("did not find a DAT for %s, maybe a refresh is needed", path)
+		return worker.Skip("not indexed")
 	}
 
 	reldatdir, err := filepath.Rel(pw.pm.commonRootPath, filepath.Dir(path))
@@ -353,7 +602,7 @@ func (pw *buildWorker) Process(path string, size int64) error {
 
 	datdir := filepath.Join(pw.pm.outpath, reldatdir)
 
-	glog.Infof("buildWorker processing %s, reldatdir=%s, datdir=%s", path, reldatdir, datdir)
+	logger.Infof("buildWorker processing %s, reldatdir=%s, datdir=%s", path, reldatdir, datdir)
 
 	err = os.MkdirAll(datdir, 0777)
 	if err != nil {
@@ -361,7 +610,7 @@ func (pw *buildWorker) Process(path string, size int64) error {
 	}
 
 	for _, game := range dat.Games {
-		for _, rom := range game.Roms {
+		for _, rom := range game.AllRoms() {
 			err = pw.pm.rs.romDB.CompleteRom(rom)
 			if err != nil {
 				return err
@@ -369,16 +618,7 @@ func (pw *buildWorker) Process(path string, size int64) error {
 		}
 	}
 
-	datComplete, err := pw.pm.rs.depot.BuildDat(dat, datdir)
-	if err != nil {
-		return err
-	}
-
-	glog.Infof("finished building dat %s in directory %s\n", dat.Name, datdir)
-	if !datComplete {
-		glog.Info("dat has missing roms")
-	}
-	return nil
+	return pw.pm.process(dat, datdir)
 }
 
 func (pw *buildWorker) Close() error {
@@ -391,6 +631,8 @@ type buildMaster struct {
 	pt             worker.ProgressTracker
 	commonRootPath string
 	outpath        string
+	// process handles a dat, with its output going to datdir
+	process func(dat *types.Dat, datdir string) error
 }
 
 func (pm *buildMaster) Accept(path string) bool {
@@ -420,255 +662,1047 @@ func (pm *buildMaster) Start() error {
 	return nil
 }
 
-func (pm *buildMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) {
-	glog.Infof("buildMaster common root path: %s", commonRootPath)
+func (pm *buildMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	logger.Infof("buildMaster common root path: %s", commonRootPath)
 	pm.commonRootPath = commonRootPath
 	fi, err := os.Stat(pm.commonRootPath)
 	if err != nil {
 		pm.commonRootPath = "/"
-		return
+		return nil
 	}
 	if !fi.IsDir() {
 		pm.commonRootPath = filepath.Dir(pm.commonRootPath)
 	}
+	return nil
 }
 
 func (rs *RombaService) build(cmd *commander.Command, args []string) error {
-	rs.jobMutex.Lock()
-	defer rs.jobMutex.Unlock()
-
-	if rs.busy {
-		p := rs.pt.GetProgress()
-
-		fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
-			p.FilesSoFar, p.TotalFiles, humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
-		return nil
+	sets, err := types.ParseSetMode(cmd.Flag.Lookup("sets").Value.Get().(string))
+	if err != nil {
+		return err
 	}
 
-	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
-	if !filepath.IsAbs(outpath) {
-		absoutpath, err := filepath.Abs(outpath)
-		if err != nil {
-			return err
-		}
-		outpath = absoutpath
+	opts := &archive.BuildOptions{
+		Unzipped:   cmd.Flag.Lookup("unzipped").Value.Get().(bool),
+		Sets:       sets,
+		NumWorkers: rs.workers(),
+		Progress: func(datName string, done, total int) {
+			// log every tenth of the dat
+			if total > 0 && done*10/total != (done-1)*10/total {
+				rs.jobLogf("building dat %s: %d of %d games", datName, done, total)
+			}
+		},
 	}
-
-	if err := os.MkdirAll(outpath, 0777); err != nil {
-		return err
+	if cmd.Flag.Lookup("chd").Value.Get().(bool) {
+		opts.CHD = rs.chdman
 	}
 
-	rs.pt.Reset()
-	rs.busy = true
-	rs.jobName = "build"
-
-	go func() {
-		glog.Infof("service starting build")
-		rs.broadCastProgress(time.Now(), true, false, "")
-		ticker := time.NewTicker(time.Second * 5)
-		stopTicker := make(chan bool)
-		go func() {
-			glog.Infof("starting progress broadcaster")
-			for {
-				select {
-				case t := <-ticker.C:
-					rs.broadCastProgress(t, false, false, "")
-				case <-stopTicker:
-					glog.Info("stopped progress broadcaster")
-					return
-				}
-			}
-		}()
+	var reportMutex sync.Mutex
+	total := new(archive.BuildReport)
 
-		pm := &buildMaster{
-			outpath:    outpath,
-			rs:         rs,
-			numWorkers: rs.numWorkers,
-			pt:         rs.pt,
-		}
+	summary := func() string {
+		reportMutex.Lock()
+		defer reportMutex.Unlock()
+		return total.String()
+	}
 
-		endMsg, err := worker.Work("building dats", args, pm)
+	return rs.startDatJob(cmd, args, "build", summary, func(dat *types.Dat, datdir string) error {
+		dat, err := rs.withSamples(dat)
 		if err != nil {
-			glog.Errorf("error building dats: %v", err)
+			return err
 		}
 
-		ticker.Stop()
-		stopTicker <- true
-
-		rs.jobMutex.Lock()
-		rs.busy = false
-		rs.jobName = ""
-		rs.jobMutex.Unlock()
+		report, err := rs.depot.BuildDat(dat, datdir, opts)
+		if err != nil {
+			return err
+		}
 
-		rs.broadCastProgress(time.Now(), false, true, endMsg)
-		glog.Infof("service finished build")
-	}()
+		rs.jobLogf("finished building dat %s in directory %s: %v", dat.Name, datdir, report)
 
-	fmt.Fprintf(cmd.Stdout, "started build")
-	return nil
+		reportMutex.Lock()
+		total.Add(report)
+		reportMutex.Unlock()
+		return nil
+	})
 }
 
-func (rs *RombaService) memstats(cmd *commander.Command, args []string) error {
-	rs.jobMutex.Lock()
-	defer rs.jobMutex.Unlock()
-
-	debug.FreeOSMemory()
+func (rs *RombaService) makeTorrents(cmd *commander.Command, args []string) error {
+	opts := &torrent.Options{
+		PieceLength: int64(cmd.Flag.Lookup("piece").Value.Get().(int)) << 10,
+		Comment:     cmd.Flag.Lookup("comment").Value.Get().(string),
+		Private:     cmd.Flag.Lookup("private").Value.Get().(bool),
+		Trackers:    splitList(cmd.Flag.Lookup("trackers").Value.Get().(string)),
+	}
+	skipCheck := cmd.Flag.Lookup("skip-check").Value.Get().(bool)
 
-	s := new(runtime.MemStats)
-	runtime.ReadMemStats(s)
+	var countMutex sync.Mutex
+	var created, differing int
 
-	fmt.Fprintf(cmd.Stdout, "\n# runtime.MemStats\n")
-	fmt.Fprintf(cmd.Stdout, "# Alloc = %s\n", humanize.Bytes(s.Alloc))
-	fmt.Fprintf(cmd.Stdout, "# TotalAlloc = %s\n", humanize.Bytes(s.TotalAlloc))
-	fmt.Fprintf(cmd.Stdout, "# Sys = %s\n", humanize.Bytes(s.Sys))
-	fmt.Fprintf(cmd.Stdout, "# Lookups = %d\n", s.Lookups)
-	fmt.Fprintf(cmd.Stdout, "# Mallocs = %d\n", s.Mallocs)
-	fmt.Fprintf(cmd.Stdout, "# Frees = %d\n", s.Frees)
+	summary := func() string {
+		countMutex.Lock()
+		defer countMutex.Unlock()
+		return fmt.Sprintf("created %d torrents, %d dats not matching a build from the depot", created, differing)
+	}
 
-	fmt.Fprintf(cmd.Stdout, "# HeapAlloc = %s\n", humanize.Bytes(s.HeapAlloc))
-	fmt.Fprintf(cmd.Stdout, "# HeapSys = %s\n", humanize.Bytes(s.HeapSys))
-	fmt.Fprintf(cmd.Stdout, "# HeapIdle = %s\n", humanize.Bytes(s.HeapIdle))
-	fmt.Fprintf(cmd.Stdout, "# HeapInuse = %s\n", humanize.Bytes(s.HeapInuse))
-	fmt.Fprintf(cmd.Stdout, "# HeapReleased = %s\n", humanize.Bytes(s.HeapReleased))
-	fmt.Fprintf(cmd.Stdout, "# HeapObjects = %d\n", s.HeapObjects)
+	return rs.startDatJob(cmd, args, "torrent", summary, func(dat *types.Dat, datdir string) error {
+		datPath := filepath.Join(datdir, dat.Name)
 
-	fmt.Fprintf(cmd.Stdout, "# Stack = %d / %d\n", s.StackInuse, s.StackSys)
-	fmt.Fprintf(cmd.Stdout, "# MSpan = %d / %d\n", s.MSpanInuse, s.MSpanSys)
-	fmt.Fprintf(cmd.Stdout, "# MCache = %d / %d\n", s.MCacheInuse, s.MCacheSys)
-	fmt.Fprintf(cmd.Stdout, "# BuckHashSys = %d\n", s.BuckHashSys)
+		if !skipCheck {
+			differ, err := rs.depot.CheckBuiltDat(dat, datdir)
+			if err != nil {
+				return err
+			}
+			if len(differ) > 0 {
+				rs.jobLogf("not creating torrent of dat %s, %d files in %s don't match a build from the depot: %s",
+					dat.Name, len(differ), datPath, strings.Join(differ, ", "))
+
+				countMutex.Lock()
+				differing++
+				countMutex.Unlock()
+				return nil
+			}
+		}
 
-	fmt.Fprintf(cmd.Stdout, "# NextGC = %d\n", s.NextGC)
-	fmt.Fprintf(cmd.Stdout, "# PauseNs = %d\n", s.PauseNs)
-	fmt.Fprintf(cmd.Stdout, "# NumGC = %d\n", s.NumGC)
-	fmt.Fprintf(cmd.Stdout, "# EnableGC = %v\n", s.EnableGC)
-	fmt.Fprintf(cmd.Stdout, "# DebugGC = %v\n", s.DebugGC)
+		t, err := torrent.Create(datPath, opts)
+		if err != nil {
+			return err
+		}
 
-	return nil
-}
+		err = t.Write(filepath.Join(datdir, dat.Name+".torrent"))
+		if err != nil {
+			return err
+		}
 
-func (rs *RombaService) dbstats(cmd *commander.Command, args []string) error {
-	rs.jobMutex.Lock()
-	defer rs.jobMutex.Unlock()
+		rs.jobLogf("created torrent of dat %s: %v", dat.Name, t)
 
-	fmt.Fprintf(cmd.Stdout, "dbstats = %s", rs.romDB.PrintStats())
-	return nil
+		countMutex.Lock()
+		created++
+		countMutex.Unlock()
+		return nil
+	})
 }
 
-func (rs *RombaService) SendProgress(ws *websocket.Conn) {
-	b := make([]byte, 10)
-	n, err := io.ReadFull(rand.Reader, b)
+func (rs *RombaService) miss(cmd *commander.Command, args []string) error {
+	if len(args) == 0 {
+		args = []string{rs.dats}
+	}
 
-	if n != len(b) || err != nil {
-		glog.Errorf("cannot generate random progress listener name: %v", err)
-		return
+	outpath, err := filepath.Abs(cmd.Flag.Lookup("out").Value.Get().(string))
+	if err != nil {
+		return err
 	}
 
-	listName := string(b)
-	listC := make(chan *ProgressNessage)
+	var reportMutex sync.Mutex
+	report := new(archive.MissReport)
 
-	rs.registerProgressListener(listName, listC)
+	summary := func() string {
+		reportMutex.Lock()
+		defer reportMutex.Unlock()
 
-	for pmsg := range listC {
-		err = websocket.JSON.Send(ws, *pmsg)
+		err := report.WriteReports(outpath, "miss")
 		if err != nil {
-			glog.Infof("error sending progress: %v", err)
-			break
+			logger.Errorf("error writing miss reports: %v", err)
+			return fmt.Sprintf("failed to write miss reports: %v", err)
 		}
+		return report.String()
 	}
 
-	rs.unregisterProgressListener(listName)
-	close(listC)
-}
+	return rs.startDatJob(cmd, args, "miss", summary, func(dat *types.Dat, datdir string) error {
+		dat, err := rs.withSamples(dat)
+		if err != nil {
+			return err
+		}
 
-func (rs *RombaService) startArchive(cmd *commander.Command, args []string) error {
-	rs.jobMutex.Lock()
-	defer rs.jobMutex.Unlock()
+		dr, err := rs.depot.MissDat(dat)
+		if err != nil {
+			return err
+		}
 
-	if len(args) == 0 {
+		reportMutex.Lock()
+		report.Add(dr)
+		reportMutex.Unlock()
 		return nil
-	}
-
-	if rs.busy {
-		p := rs.pt.GetProgress()
+	})
+}
 
-		fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
-			p.FilesSoFar, p.TotalFiles, humanize.Bytes(uint64(p.BytesSoFar)), humanize.Bytes(uint64(p.TotalBytes)))
-		return nil
+func (rs *RombaService) export(cmd *commander.Command, args []string) error {
+	opts := &archive.ExportOptions{
+		ByGame: cmd.Flag.Lookup("by-game").Value.Get().(bool),
+		Copy:   cmd.Flag.Lookup("copy").Value.Get().(bool),
 	}
 
-	rs.pt.Reset()
-	rs.busy = true
-	rs.jobName = "archive"
-
-	go func() {
-		glog.Infof("service starting archive")
-		rs.broadCastProgress(time.Now(), true, false, "")
-		ticker := time.NewTicker(time.Second * 5)
-		stopTicker := make(chan bool)
-		go func() {
-			glog.Infof("starting progress broadcaster")
-			for {
-				select {
-				case t := <-ticker.C:
-					rs.broadCastProgress(t, false, false, "")
-				case <-stopTicker:
-					glog.Info("stopped progress broadcaster")
-					return
-				}
-			}
-		}()
+	depotOut, err := filepath.Abs(cmd.Flag.Lookup("out").Value.Get().(string))
+	if err != nil {
+		return err
+	}
 
-		resume := cmd.Flag.Lookup("resume").Value.Get().(string)
-		includezips := cmd.Flag.Lookup("include-zips").Value.Get().(bool)
-		onlyneeded := cmd.Flag.Lookup("only-needed").Value.Get().(bool)
+	return rs.startDatJob(cmd, args, "export", nil, func(dat *types.Dat, datdir string) error {
+		outpath := datdir
+		if !opts.ByGame {
+			// all dats share one depot layout tree
+			outpath = depotOut
+		}
 
-		endMsg, err := rs.depot.Archive(args, resume, includezips, onlyneeded, rs.numWorkers, rs.logDir, rs.pt)
+		exported, missing, err := rs.depot.ExportDat(dat, outpath, opts)
 		if err != nil {
-			glog.Errorf("error archiving: %v", err)
+			return err
 		}
 
-		ticker.Stop()
-		stopTicker <- true
-
-		rs.jobMutex.Lock()
-		rs.busy = false
-		rs.jobName = ""
-		rs.jobMutex.Unlock()
-
-		rs.broadCastProgress(time.Now(), false, true, endMsg)
-		glog.Infof("service finished archiving")
-	}()
-
-	fmt.Fprintf(cmd.Stdout, "started archiving")
-	return nil
+		rs.jobLogf("exported %d files of dat %s to %s, %d roms missing", exported, dat.Name, outpath, missing)
+		return nil
+	})
 }
 
-func (rs *RombaService) dir2dat(cmd *commander.Command, args []string) error {
-	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
-
-	if err := os.MkdirAll(outpath, 0777); err != nil {
-		return err
+func (rs *RombaService) audit(cmd *commander.Command, args []string) error {
+	setpath := cmd.Flag.Lookup("set").Value.Get().(string)
+	if setpath == "" {
+		return fmt.Errorf("-set is required")
 	}
 
-	srcpath := cmd.Flag.Lookup("source").Value.Get().(string)
-	srcInfo, err := os.Stat(srcpath)
+	setpath, err := filepath.Abs(setpath)
 	if err != nil {
 		return err
 	}
 
-	if !srcInfo.IsDir() {
+	return rs.startDatJob(cmd, args, "audit", nil, func(dat *types.Dat, datdir string) error {
+		dat, err := rs.withSamples(dat)
+		if err != nil {
+			return err
+		}
+
+		ar, err := archive.Audit(dat, setpath)
+		if err != nil {
+			return err
+		}
+
+		err = ar.WriteReports(datdir, dat.Name)
+		if err != nil {
+			return err
+		}
+
+		rs.jobLogf("audited %s against dat %s, %d unneeded, %d wrongly named", setpath, dat.Name,
+			len(ar.Unneeded), len(ar.WronglyNamed))
+		return nil
+	})
+}
+
+// setJobArgs checks the arguments of a job changing the set folder given by
+// the set flag and returns its absolute path.
+func setJobArgs(cmd *commander.Command, args []string) (string, error) {
+	setpath := cmd.Flag.Lookup("set").Value.Get().(string)
+	if setpath == "" {
+		return "", fmt.Errorf("-set is required")
+	}
+
+	// a set folder holds the games of a single dat, changing it for
+	// another one would throw them out
+	if len(args) != 1 {
+		return "", fmt.Errorf("%s takes exactly one DAT file", cmd.Name())
+	}
+	fi, err := os.Stat(args[0])
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("%s is not a DAT file", args[0])
+	}
+
+	return filepath.Abs(setpath)
+}
+
+func (rs *RombaService) rebuild(cmd *commander.Command, args []string) error {
+	setpath, err := setJobArgs(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	opts := &archive.RebuildOptions{
+		Unzipped: cmd.Flag.Lookup("unzipped").Value.Get().(bool),
+	}
+
+	if backupDir := cmd.Flag.Lookup("backup").Value.Get().(string); backupDir != "" {
+		opts.BackupDir, err = filepath.Abs(backupDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	var trashed string
+	summary := func() string {
+		return trashed
+	}
+
+	return rs.startDatJob(cmd, args, "rebuild", summary, func(dat *types.Dat, datdir string) error {
+		opts.FixDir = datdir
+
+		if opts.BackupDir == "" {
+			op, err := rs.beginTrash("rebuild")
+			if err != nil {
+				return err
+			}
+			if op != nil {
+				opts.Trash = op
+				defer func() { trashed = closeTrash(op) }()
+			}
+		}
+
+		dat, err := rs.withSamples(dat)
+		if err != nil {
+			return err
+		}
+
+		missing, err := rs.depot.RebuildSet(dat, setpath, opts)
+		if err != nil {
+			return err
+		}
+
+		rs.jobLogf("finished rebuilding %s for dat %s, %d roms missing", setpath, dat.Name, missing)
+		return nil
+	})
+}
+
+func (rs *RombaService) fix(cmd *commander.Command, args []string) error {
+	setpath, err := setJobArgs(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	opts := &archive.FixOptions{
+		Unzipped: cmd.Flag.Lookup("unzipped").Value.Get().(bool),
+	}
+
+	if backupDir := cmd.Flag.Lookup("backup").Value.Get().(string); backupDir != "" {
+		opts.BackupDir, err = filepath.Abs(backupDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	var report *archive.FixReport
+	var trashed string
+	summary := func() string {
+		if report == nil {
+			return "set not fixed"
+		}
+		if trashed != "" {
+			return report.String() + "\n" + trashed
+		}
+		return report.String()
+	}
+
+	return rs.startDatJob(cmd, args, "fix", summary, func(dat *types.Dat, datdir string) error {
+		opts.ReportDir = datdir
+
+		if opts.BackupDir == "" {
+			op, err := rs.beginTrash("fix")
+			if err != nil {
+				return err
+			}
+			if op != nil {
+				opts.Trash = op
+				defer func() { trashed = closeTrash(op) }()
+			}
+		}
+
+		dat, err := rs.withSamples(dat)
+		if err != nil {
+			return err
+		}
+
+		fr, err := rs.depot.Fix(dat, setpath, opts)
+		if err != nil {
+			return err
+		}
+
+		report = fr
+		rs.jobLogf("fixed %s for dat %s: %v", setpath, dat.Name, fr)
+		return nil
+	})
+}
+
+// withSamples adds the sample sets of dat to it, see archive.WithSamples,
+// logging samples whose hashes aren't known to the job.
+func (rs *RombaService) withSamples(dat *types.Dat) (*types.Dat, error) {
+	sdat, unknown, err := rs.depot.WithSamples(dat)
+	if err != nil {
+		return nil, err
+	}
+	if unknown > 0 {
+		rs.jobLogf("dat %s has %d samples not in any indexed sample set dat", dat.Name, unknown)
+	}
+	return sdat, nil
+}
+
+// startDatJob runs process on the DAT files given in args in the background.
+// Output goes to the directory given by the out flag, mirroring the directory
+// tree of the DAT files. If summary isn't nil, its result, if not empty, is
+// added to the message sent when the job is done.
+func (rs *RombaService) startDatJob(cmd *commander.Command, args []string, jobName string,
+	summary func() string, process func(dat *types.Dat, datdir string) error) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
+	if !filepath.IsAbs(outpath) {
+		absoutpath, err := filepath.Abs(outpath)
+		if err != nil {
+			return err
+		}
+		outpath = absoutpath
+	}
+
+	if err := os.MkdirAll(outpath, 0777); err != nil {
+		return err
+	}
+
+	rs.startJob(jobName, func() (string, error) {
+		pm := &buildMaster{
+			outpath:    outpath,
+			rs:         rs,
+			numWorkers: rs.workers(),
+			pt:         rs.tracker(),
+			process:    process,
+		}
+
+		res, err := worker.Work(jobName+" dats", args, pm)
+		endMsg := res.Message
+		if err != nil {
+			logger.Errorf("error in %s of dats: %v", jobName, err)
+		}
+
+		if summary != nil {
+			if sm := summary(); sm != "" {
+				logger.Infof("%s of dats: %s", jobName, sm)
+				endMsg += "\n" + sm
+			}
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started %s", jobName)
+	return nil
+}
+
+func (rs *RombaService) memstats(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	debug.FreeOSMemory()
+
+	s := new(runtime.MemStats)
+	runtime.ReadMemStats(s)
+
+	fmt.Fprintf(cmd.Stdout, "\n# runtime.MemStats\n")
+	fmt.Fprintf(cmd.Stdout, "# Alloc = %s\n", humanize.Bytes(s.Alloc))
+	fmt.Fprintf(cmd.Stdout, "# TotalAlloc = %s\n", humanize.Bytes(s.TotalAlloc))
+	fmt.Fprintf(cmd.Stdout, "# Sys = %s\n", humanize.Bytes(s.Sys))
+	fmt.Fprintf(cmd.Stdout, "# Lookups = %d\n", s.Lookups)
+	fmt.Fprintf(cmd.Stdout, "# Mallocs = %d\n", s.Mallocs)
+	fmt.Fprintf(cmd.Stdout, "# Frees = %d\n", s.Frees)
+
+	fmt.Fprintf(cmd.Stdout, "# HeapAlloc = %s\n", humanize.Bytes(s.HeapAlloc))
+	fmt.Fprintf(cmd.Stdout, "# HeapSys = %s\n", humanize.Bytes(s.HeapSys))
+	fmt.Fprintf(cmd.Stdout, "# HeapIdle = %s\n", humanize.Bytes(s.HeapIdle))
+	fmt.Fprintf(cmd.Stdout, "# HeapInuse = %s\n", humanize.Bytes(s.HeapInuse))
+	fmt.Fprintf(cmd.Stdout, "# HeapReleased = %s\n", humanize.Bytes(s.HeapReleased))
+	fmt.Fprintf(cmd.Stdout, "# HeapObjects = %d\n", s.HeapObjects)
+
+	fmt.Fprintf(cmd.Stdout, "# Stack = %d / %d\n", s.StackInuse, s.StackSys)
+	fmt.Fprintf(cmd.Stdout, "# MSpan = %d / %d\n", s.MSpanInuse, s.MSpanSys)
+	fmt.Fprintf(cmd.Stdout, "# MCache = %d / %d\n", s.MCacheInuse, s.MCacheSys)
+	fmt.Fprintf(cmd.Stdout, "# BuckHashSys = %d\n", s.BuckHashSys)
+
+	fmt.Fprintf(cmd.Stdout, "# NextGC = %d\n", s.NextGC)
+	fmt.Fprintf(cmd.Stdout, "# PauseNs = %d\n", s.PauseNs)
+	fmt.Fprintf(cmd.Stdout, "# NumGC = %d\n", s.NumGC)
+	fmt.Fprintf(cmd.Stdout, "# EnableGC = %v\n", s.EnableGC)
+	fmt.Fprintf(cmd.Stdout, "# DebugGC = %v\n", s.DebugGC)
+
+	return nil
+}
+
+func (rs *RombaService) dbstats(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	fmt.Fprintf(cmd.Stdout, "dbstats = %s", rs.romDB.PrintStats())
+	return nil
+}
+
+func (rs *RombaService) hashBench(cmd *commander.Command, args []string) error {
+	size := int64(cmd.Flag.Lookup("size").Value.Get().(int)) * int64(archive.MB)
+	if size <= 0 || size > archive.MaxHashBenchmarkSize {
+		return fmt.Errorf("-size must be between 1 and %d", archive.MaxHashBenchmarkSize/int64(archive.MB))
+	}
+
+	hbs, err := archive.BenchmarkHashEngines(size)
+	for _, hb := range hbs {
+		fmt.Fprintf(cmd.Stdout, "%s\n", hb)
+	}
+	return err
+}
+
+func (rs *RombaService) SendProgress(ws *websocket.Conn) {
+	b := make([]byte, 10)
+	n, err := io.ReadFull(rand.Reader, b)
+
+	if n != len(b) || err != nil {
+		logger.Errorf("cannot generate random progress listener name: %v", err)
+		return
+	}
+
+	listName := string(b)
+	listC := make(chan *ProgressNessage)
+
+	rs.registerProgressListener(listName, listC)
+
+	for pmsg := range listC {
+		err = websocket.JSON.Send(ws, *pmsg)
+		if err != nil {
+			logger.Infof("error sending progress: %v", err)
+			break
+		}
+	}
+
+	rs.unregisterProgressListener(listName)
+	close(listC)
+}
+
+// readURLs reads the list of URLs at path, one per line. Blank lines and
+// lines starting with # are left out.
+func readURLs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var urls []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "http://") && !strings.HasPrefix(line, "https://") {
+			return nil, fmt.Errorf("%s: %q is not an HTTP(S) URL", path, line)
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+func (rs *RombaService) startArchive(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if urlsPath := cmd.Flag.Lookup("urls").Value.Get().(string); urlsPath != "" {
+		urls, err := readURLs(urlsPath)
+		if err != nil {
+			return err
+		}
+		args = append(args, urls...)
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	var dirs []string
+	for _, name := range []string{"quarantine", "trash"} {
+		dir := cmd.Flag.Lookup(name).Value.Get().(string)
+		if dir != "" {
+			absdir, err := filepath.Abs(dir)
+			if err != nil {
+				return err
+			}
+			dir = absdir
+		}
+		dirs = append(dirs, dir)
+	}
+	quarantineDir, trashDir := dirs[0], dirs[1]
+
+	var allowedNets []*net.IPNet
+	if nets := cmd.Flag.Lookup("http-allow").Value.Get().(string); nets != "" {
+		for _, cidr := range strings.Split(nets, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return err
+			}
+			allowedNets = append(allowedNets, n)
+		}
+	}
+
+	var detectors []*types.Detector
+	if cmd.Flag.Lookup("skip-headers").Value.Get().(bool) {
+		detectors = archive.BuiltinDetectors
+
+		if dir := cmd.Flag.Lookup("skippers").Value.Get().(string); dir != "" {
+			ds, err := parser.ParseDetectors(dir)
+			if err != nil {
+				return err
+			}
+			if len(ds) == 0 {
+				return fmt.Errorf("no header skippers in %s", dir)
+			}
+			detectors = ds
+		}
+	}
+
+	deleteSources := cmd.Flag.Lookup("delete-sources").Value.Get().(bool)
+	if deleteSources && cmd.Flag.Lookup("trust-depot").Value.Get().(bool) {
+		return fmt.Errorf("-delete-sources can't be combined with -trust-depot")
+	}
+	var trashOp *trash.Op
+	if deleteSources && trashDir == "" {
+		op, err := rs.beginTrash("archive")
+		if err != nil {
+			return err
+		}
+		trashOp = op
+	}
+
+	rs.startJob("archive", func() (string, error) {
+		opts := &archive.ArchiveOptions{
+			ResumePath:       cmd.Flag.Lookup("resume").Value.Get().(string),
+			IncludeZips:      cmd.Flag.Lookup("include-zips").Value.Get().(bool),
+			OnlyNeeded:       cmd.Flag.Lookup("only-needed").Value.Get().(bool),
+			ExtraHashes:      cmd.Flag.Lookup("extra-hashes").Value.Get().(bool),
+			VerifyImports:    cmd.Flag.Lookup("verify-imports").Value.Get().(bool),
+			MoveImports:      cmd.Flag.Lookup("move-imports").Value.Get().(bool),
+			MemberBufferSize: int64(cmd.Flag.Lookup("member-buffer").Value.Get().(int)) * int64(archive.MB),
+			QuarantineDir:    quarantineDir,
+			QuarantineCopy:   cmd.Flag.Lookup("quarantine-copy").Value.Get().(bool),
+			DeleteSources:    deleteSources,
+			Trash:            trashOp,
+			TrashDir:         trashDir,
+			TrustDepot:       cmd.Flag.Lookup("trust-depot").Value.Get().(bool),
+			LowWaterMark:     int64(cmd.Flag.Lookup("low-water").Value.Get().(int)) * int64(archive.MB),
+			RequireSpace:     cmd.Flag.Lookup("require-space").Value.Get().(bool),
+			Limits: archive.ContainerLimits{
+				MaxMemberSize: int64(cmd.Flag.Lookup("max-member-size").Value.Get().(int)) * int64(archive.MB),
+				MaxRatio:      int64(cmd.Flag.Lookup("max-ratio").Value.Get().(int)),
+				MaxMembers:    cmd.Flag.Lookup("max-members").Value.Get().(int),
+			},
+			Source: archive.SourceOptions{
+				ReadBufferSize:    cmd.Flag.Lookup("read-buffer").Value.Get().(int) * int(archive.KB),
+				MaxBytesPerSecond: int64(cmd.Flag.Lookup("max-read-rate").Value.Get().(int)) * int64(archive.MB),
+				MaxReadsPerSecond: int64(cmd.Flag.Lookup("max-read-ops").Value.Get().(int)),
+				Retries:           cmd.Flag.Lookup("read-retries").Value.Get().(int),
+				HTTPAllowedNets:   allowedNets,
+			},
+		}
+		opts.Detectors = detectors
+		if cmd.Flag.Lookup("verify-chd").Value.Get().(bool) {
+			opts.VerifyCHD = rs.chdman
+		}
+
+		endMsg, err := rs.depot.Archive(args, opts, rs.workers(), rs.logDir, rs.tracker())
+		if err != nil {
+			logger.Errorf("error archiving: %v", err)
+		}
+		if trashOp != nil {
+			if trashed := closeTrash(trashOp); trashed != "" {
+				endMsg += "\n" + trashed
+			}
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started archiving")
+	return nil
+}
+
+func (rs *RombaService) startScrub(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	rs.startJob("scrub", func() (string, error) {
+		opts := &archive.ScrubOptions{
+			ResumePath:        cmd.Flag.Lookup("resume").Value.Get().(string),
+			Quarantine:        cmd.Flag.Lookup("quarantine").Value.Get().(bool),
+			MaxBytesPerSecond: int64(cmd.Flag.Lookup("max-rate").Value.Get().(int)) * int64(archive.MB),
+		}
+
+		endMsg, err := rs.depot.Scrub(opts, rs.workers(), rs.logDir, rs.tracker())
+		if err != nil {
+			logger.Errorf("error scrubbing: %v", err)
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started scrubbing")
+	return nil
+}
+
+func (rs *RombaService) startRecompress(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	compression := cmd.Flag.Lookup("compression").Value.Get().(string)
+	if compression == "" {
+		return fmt.Errorf("-compression is required")
+	}
+
+	rs.startJob("recompress", func() (string, error) {
+		endMsg, err := rs.depot.Recompress(compression, rs.workers(), rs.tracker())
+		if err != nil {
+			logger.Errorf("error recompressing: %v", err)
+			endMsg = fmt.Sprintf("error recompressing: %v", err)
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started recompressing")
+	return nil
+}
+
+func (rs *RombaService) startManifest(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	subtree := cmd.Flag.Lookup("subtree").Value.Get().(string)
+
+	rs.startJob("manifest", func() (string, error) {
+		endMsg, err := rs.depot.UpdateManifest(subtree)
+		if err != nil {
+			logger.Errorf("error updating manifest: %v", err)
+			endMsg = fmt.Sprintf("error updating manifest: %v", err)
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started updating manifest")
+	return nil
+}
+
+func (rs *RombaService) startRelayout(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	layout := archive.Layout{
+		Depth: cmd.Flag.Lookup("depth").Value.Get().(int),
+		Width: cmd.Flag.Lookup("width").Value.Get().(int),
+	}
+	err := layout.Validate()
+	if err != nil {
+		return err
+	}
+
+	rs.startJob("relayout", func() (string, error) {
+		endMsg, err := rs.depot.Relayout(layout, rs.workers(), rs.tracker())
+		if err != nil {
+			logger.Errorf("error changing depot layout: %v", err)
+			endMsg = fmt.Sprintf("error changing depot layout: %v", err)
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started changing depot layout")
+	return nil
+}
+
+func (rs *RombaService) startReplicate(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	opts := &replica.Options{
+		Remote:    cmd.Flag.Lookup("remote").Value.Get().(string),
+		Deletions: cmd.Flag.Lookup("deletions").Value.Get().(string),
+		Force:     cmd.Flag.Lookup("force").Value.Get().(bool),
+		ChunkSize: int64(cmd.Flag.Lookup("chunk").Value.Get().(int)) << 20,
+		Token:     rs.replicaToken,
+	}
+
+	if opts.Remote == "" {
+		return fmt.Errorf("-remote is required")
+	}
+	switch opts.Deletions {
+	case replica.KeepExtras, replica.ReportExtras, replica.DeleteExtras:
+	default:
+		return fmt.Errorf("-deletions must be keep, report or delete, not %q", opts.Deletions)
+	}
+
+	var err error
+	opts.Client, err = tlsconf.HTTPClient(rs.replicaCA, rs.replicaCert, rs.replicaKey)
+	if err != nil {
+		return fmt.Errorf("setting up TLS for replication failed: %v", err)
+	}
+
+	rs.startJob("replicate", func() (string, error) {
+		var endMsg string
+		report, err := replica.Push(rs.depot, opts, rs.pt)
+		if report != nil {
+			endMsg = report.String()
+			if len(report.Extras) > 0 && opts.Deletions == replica.ReportExtras {
+				extrasPath, werr := rs.writeExtras(report)
+				if werr != nil {
+					logger.Errorf("error writing roms only in remote depot: %v", werr)
+				} else {
+					endMsg += fmt.Sprintf(", listed in %s", extrasPath)
+				}
+			}
+		}
+		if err != nil {
+			logger.Errorf("error replicating: %v", err)
+			if endMsg != "" {
+				endMsg += "; "
+			}
+			endMsg += fmt.Sprintf("error replicating: %v", err)
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started replicating to %s", opts.Remote)
+	return nil
+}
+
+// writeExtras lists the roms only the remote depot of a replication has in a
+// file in the log dir and returns its path.
+func (rs *RombaService) writeExtras(report *replica.Report) (string, error) {
+	extrasPath := filepath.Join(rs.logDir,
+		fmt.Sprintf("replicate-extras-%s.log", time.Now().Format("2006-01-02-15_04_05")))
+	file, err := os.Create(extrasPath)
+	if err != nil {
+		return "", err
+	}
+
+	err = report.WriteExtras(file)
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	return extrasPath, err
+}
+
+func (rs *RombaService) purgeDelete(cmd *commander.Command, args []string) error {
+	return rs.startPurge(cmd, args, "")
+}
+
+func (rs *RombaService) purgeBackup(cmd *commander.Command, args []string) error {
+	backupDir := cmd.Flag.Lookup("backup").Value.Get().(string)
+	if backupDir == "" {
+		return fmt.Errorf("-backup is required")
+	}
+
+	if !filepath.IsAbs(backupDir) {
+		absBackupDir, err := filepath.Abs(backupDir)
+		if err != nil {
+			return err
+		}
+		backupDir = absBackupDir
+	}
+
+	return rs.startPurge(cmd, args, backupDir)
+}
+
+// datPaths returns the paths of the current dats indexed from args, which
+// can be dat files, zip or gzip files of dats or folders with dat files.
+// Arguments that are neither or hold no indexed dats are refused.
+func (rs *RombaService) datPaths(args []string) (map[string]bool, error) {
+	paths := make(map[string]bool)
+
+	for _, arg := range args {
+		abspath, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(abspath)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() && !parser.IsDatFile(abspath) {
+			return nil, fmt.Errorf("%s is not a DAT file", arg)
+		}
+
+		indexed, err := rs.romDB.DatPathsUnder(abspath)
+		if err != nil {
+			return nil, err
+		}
+		if len(indexed) == 0 {
+			return nil, fmt.Errorf("no indexed DAT files in %s, refresh-dats indexes them", arg)
+		}
+		for _, path := range indexed {
+			paths[path] = true
+		}
+	}
+	return paths, nil
+}
+
+func (rs *RombaService) startPurge(cmd *commander.Command, args []string, backupDir string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	obsoleteDats, err := rs.datPaths(args)
+	if err != nil {
+		return err
+	}
+
+	var trashOp *trash.Op
+	if backupDir == "" {
+		trashOp, err = rs.beginTrash("purge")
+		if err != nil {
+			return err
+		}
+	}
+
+	rs.startJob("purge", func() (string, error) {
+		opts := &archive.PurgeOptions{
+			BackupDir:    backupDir,
+			Trash:        trashOp,
+			ObsoleteDats: obsoleteDats,
+		}
+
+		endMsg, err := rs.depot.Purge(opts, rs.workers(), rs.logDir, rs.tracker())
+		if err != nil {
+			logger.Errorf("error purging: %v", err)
+		}
+		if trashOp != nil {
+			if trashed := closeTrash(trashOp); trashed != "" {
+				endMsg += "\n" + trashed
+			}
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started purging")
+	return nil
+}
+
+func (rs *RombaService) dir2dat(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
+
+	if err := os.MkdirAll(outpath, 0777); err != nil {
+		return err
+	}
+
+	srcpath := cmd.Flag.Lookup("source").Value.Get().(string)
+	srcInfo, err := os.Stat(srcpath)
+	if err != nil {
+		return err
+	}
+
+	if !srcInfo.IsDir() {
 		return fmt.Errorf("%s is not a directory", srcpath)
 	}
 
 	dat := new(types.Dat)
 	dat.Name = cmd.Flag.Lookup("name").Value.Get().(string)
+	if dat.Name == "" {
+		dat.Name = filepath.Base(srcpath)
+	}
 	dat.Description = cmd.Flag.Lookup("description").Value.Get().(string)
+	dat.Category = cmd.Flag.Lookup("category").Value.Get().(string)
+	dat.Version = cmd.Flag.Lookup("version").Value.Get().(string)
+	dat.Author = cmd.Flag.Lookup("author").Value.Get().(string)
 
-	err = archive.Dir2Dat(dat, srcpath, outpath)
+	grouping, err := archive.ParseGameGrouping(cmd.Flag.Lookup("grouping").Value.Get().(string))
 	if err != nil {
 		return err
 	}
+	opts := &archive.Dir2DatOptions{
+		Grouping: grouping,
+		XML:      cmd.Flag.Lookup("xml").Value.Get().(bool),
+	}
+
+	rs.startJob("dir2dat", func() (string, error) {
+		endMsg, err := archive.Dir2Dat(dat, srcpath, outpath, opts, rs.workers(), rs.tracker())
+		if err != nil {
+			logger.Errorf("error composing DAT: %v", err)
+			endMsg = fmt.Sprintf("error composing DAT: %v", err)
+		} else {
+			endMsg = fmt.Sprintf("dir2dat completed a DAT in %s for directory %s\n%s", outpath, srcpath, endMsg)
+		}
+		return endMsg, err
+	})
 
-	fmt.Fprintf(cmd.Stdout, "dir2dat successfully completed a DAT in %s for directory %s", outpath, srcpath)
+	fmt.Fprintf(cmd.Stdout, "started dir2dat")
 	return nil
 }
+
+func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
+	oldpath := cmd.Flag.Lookup("old").Value.Get().(string)
+	newpath := cmd.Flag.Lookup("new").Value.Get().(string)
+	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
+
+	if oldpath == "" || newpath == "" {
+		return fmt.Errorf("diffdat needs both -old and -new")
+	}
+
+	oldDat, _, err := parser.Parse(oldpath)
+	if err != nil {
+		return err
+	}
+
+	newDat, _, err := parser.Parse(newpath)
+	if err != nil {
+		return err
+	}
+
+	dd := types.DiffDats(oldDat, newDat)
+
+	if cmd.Flag.Lookup("json").Value.Get().(bool) {
+		err = dd.WriteJSON(cmd.Stdout)
+	} else {
+		err = dd.WriteText(cmd.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if outpath == "" {
+		return nil
+	}
+
+	outf, err := os.Create(outpath)
+	if err != nil {
+		return err
+	}
+	defer outf.Close()
+
+	outbuf := bufio.NewWriter(outf)
+	err = types.ComposeDat(dd.Dat(newDat), outbuf)
+	if err != nil {
+		return err
+	}
+	return outbuf.Flush()
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/stats"
+)
+
+// statsFilename is the file in the log dir the samples of the depot
+// statistics are kept in.
+const statsFilename = "depot-stats.jsonl"
+
+func (rs *RombaService) startStats(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.refuseBusy(cmd) {
+		return nil
+	}
+
+	rs.startJob("stats", func() (string, error) {
+		endMsg, err := rs.sampleStats()
+		if err != nil {
+			logger.Errorf("error taking depot stats: %v", err)
+			endMsg = fmt.Sprintf("error taking depot stats: %v", err)
+		}
+		return endMsg, err
+	})
+
+	fmt.Fprintf(cmd.Stdout, "started stats")
+	return nil
+}
+
+// sampleStats counts the depot, adds the sample to the history and returns
+// the report of the history.
+func (rs *RombaService) sampleStats() (string, error) {
+	ds, err := rs.depot.Stats(rs.pt)
+	if err != nil {
+		return "", err
+	}
+
+	err = rs.stats.Add(&stats.Sample{Time: time.Now(), DepotStats: ds})
+	if err != nil {
+		return "", err
+	}
+
+	samples, err := rs.stats.Samples(time.Time{})
+	if err != nil {
+		return "", err
+	}
+	return formatStatsReport(stats.NewReport(samples)), nil
+}
+
+func formatStatsReport(r *stats.Report) string {
+	if r.Latest == nil {
+		return "no depot stats taken yet"
+	}
+
+	s := r.Latest
+	lines := []string{fmt.Sprintf("depot has %d files, %s", s.Files, humanize.Bytes(uint64(s.Bytes)))}
+	for _, root := range s.Roots {
+		lines = append(lines, fmt.Sprintf("  %s: %d files, %s", root.Root, root.Files, humanize.Bytes(uint64(root.Bytes))))
+	}
+	lines = append(lines, fmt.Sprintf("archived from %d source files, %d roms from more than one (%d duplicate source files)",
+		s.Sources, s.DuplicateRoms, s.DuplicateSources))
+	for _, g := range r.Growth {
+		lines = append(lines, fmt.Sprintf("grew by %d files, %s over the last %s since %s (%s per day)", g.Files,
+			signedBytes(g.Bytes), g.Period, g.From.Format("2006-01-02 15:04"), signedBytes(int64(g.BytesPerDay))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func signedBytes(n int64) string {
+	if n < 0 {
+		return "-" + humanize.Bytes(uint64(-n))
+	}
+	return humanize.Bytes(uint64(n))
+}
+
+// statsReport returns the report of the samples of the depot statistics.
+func (rs *RombaService) statsReport() (*stats.Report, error) {
+	samples, err := rs.stats.Samples(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return stats.NewReport(samples), nil
+}
+
+func (rs *RombaService) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	report, err := rs.statsReport()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleStatsHistory answers with the samples of the depot statistics taken
+// since the time given by the since parameter, either RFC 3339 or a duration
+// before now like 720h, all of them without.
+func (rs *RombaService) handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	var since time.Time
+	if param := r.URL.Query().Get("since"); param != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, param)
+		if err != nil {
+			d, derr := time.ParseDuration(param)
+			if derr != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid since %q, want a time or a duration", param))
+				return
+			}
+			since = time.Now().Add(-d)
+		}
+	}
+
+	samples, err := rs.stats.Samples(since)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if samples == nil {
+		samples = []*stats.Sample{}
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestStatsJob(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-stats-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	for _, dir := range []string{depotRoot, datsDir} {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ldb := &lookupTestDB{dat: &types.Dat{Name: "test"}}
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, ldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := NewRombaService(ldb, depot, testConfig(datsDir, root))
+
+	for i := 0; i < 2; i++ {
+		_, started, err := rs.runCommand([]string{"stats"}, nil)
+		if err != nil || started == nil {
+			t.Fatalf("stats didn't start a job: %v", err)
+		}
+		job := waitForJob(t, rs, started.ID)
+		if job.State != JobDone || !strings.HasPrefix(job.Message, "depot has 0 files") {
+			t.Errorf("got job %+v, want the stats of an empty depot", job)
+		}
+	}
+
+	report, err := rs.statsReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Latest == nil || len(report.Latest.Roots) != 1 || report.Latest.Roots[0].Root != depotRoot {
+		t.Errorf("got latest sample %+v", report.Latest)
+	}
+	if len(report.Growth) == 0 || report.Growth[0].Files != 0 {
+		t.Errorf("got growth %+v, want none between the two samples", report.Growth)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gonuts/commander"
+
+	"github.com/uwedeportivo/romba/trash"
+)
+
+// beginTrash starts the trash operation of a job named name, nil if the
+// trash isn't enabled and removed files are deleted.
+func (rs *RombaService) beginTrash(name string) (*trash.Op, error) {
+	if !rs.trashEnabled {
+		return nil, nil
+	}
+	return rs.trash.Begin(name)
+}
+
+// closeTrash ends the trash operation op of a job and returns the line
+// telling how to undo it, empty if it trashed nothing.
+func closeTrash(op *trash.Op) string {
+	desc, err := op.Close()
+	if err != nil {
+		logger.Errorf("error closing trash operation %s: %v", op.ID(), err)
+		return fmt.Sprintf("error closing trash operation %s: %v", op.ID(), err)
+	}
+	if desc.Files == 0 {
+		return ""
+	}
+	return fmt.Sprintf("moved %d files (%s) to the trash, undo with: undo %s",
+		desc.Files, humanize.Bytes(uint64(desc.Bytes)), desc.ID)
+}
+
+// undo moves the files trashed by the operation with the given ID back,
+// returning errBusy while a job runs, which might be using their paths.
+func (rs *RombaService) undo(id string) (*trash.UndoReport, error) {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		return nil, errBusy
+	}
+
+	ur, err := rs.trash.Undo(id)
+	if ur != nil {
+		for _, e := range ur.Restored {
+			rs.depot.Restored(e.Path, e.Size)
+		}
+		logger.Infof("undo %s", ur)
+	}
+	return ur, err
+}
+
+func (rs *RombaService) undoCmd(cmd *commander.Command, args []string) error {
+	if len(args) == 0 {
+		ops, err := rs.trash.List()
+		if err != nil {
+			return err
+		}
+		if len(ops) == 0 {
+			fmt.Fprintf(cmd.Stdout, "the trash in %s is empty\n", rs.trash.Dir())
+		}
+		for _, op := range ops {
+			printOperation(cmd.Stdout, op)
+		}
+		return nil
+	}
+
+	for _, id := range args {
+		ur, err := rs.undo(id)
+		if err == errBusy {
+			rs.refuseBusy(cmd)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.Stdout, "%s\n", ur)
+		for _, e := range ur.Conflicts {
+			fmt.Fprintf(cmd.Stdout, "not restored, path taken: %s\n", e.Path)
+		}
+	}
+	return nil
+}
+
+// printOperation writes op in the format of the undo command.
+func printOperation(w io.Writer, op *trash.Operation) {
+	state := "unfinished"
+	if op.Finished != nil {
+		state = op.Finished.Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%d files (%s)", op.ID, op.Name, state,
+		op.Files, humanize.Bytes(uint64(op.Bytes)))
+	if op.Undone != nil {
+		fmt.Fprintf(w, "\t%d restored", op.Restored)
+	}
+	fmt.Fprintln(w)
+}
+
+func (rs *RombaService) handleTrash(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	ops, err := rs.trash.List()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ops == nil {
+		ops = []*trash.Operation{}
+	}
+	writeJSON(w, http.StatusOK, ops)
+}
+
+// handleTrashOperation answers GET /api/trash/<id> with the files in the
+// trash of an operation and POST /api/trash/<id>/undo by undoing it.
+func (rs *RombaService) handleTrashOperation(w http.ResponseWriter, r *http.Request) {
+	id, action := path.Split(strings.TrimPrefix(r.URL.Path, "/api/trash/"))
+	if id == "" {
+		id, action = action, ""
+	}
+	id = strings.TrimSuffix(id, "/")
+
+	switch action {
+	case "":
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		entries, err := rs.trash.Entries(id)
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, err)
+			return
+		}
+		if entries == nil {
+			entries = []*trash.Entry{}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	case "undo":
+		if !allowMethod(w, r, "POST") {
+			return
+		}
+		if !allowRole(w, r, commandRole("undo")) {
+			return
+		}
+		if _, err := rs.trash.Entries(id); err != nil {
+			writeAPIError(w, http.StatusNotFound, err)
+			return
+		}
+		ur, err := rs.undo(id)
+		if err == errBusy {
+			writeAPIError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ur)
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("unknown trash action %q", action))
+	}
+}
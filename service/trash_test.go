@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// trashTestDB is a lookupTestDB for purges
+type trashTestDB struct {
+	lookupTestDB
+}
+
+func (tdb *trashTestDB) Generation() int64 {
+	return 0
+}
+
+func TestPurgeUndo(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-trash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	depotRoot := filepath.Join(root, "depot")
+	datsDir := filepath.Join(root, "dats")
+	datPath := filepath.Join(datsDir, "test.dat")
+	romPath := filepath.Join(depotRoot, "da", "39", "a3", "ee", "da39a3ee5e6b4b0d3255bfef95601890afd80709.gz")
+	for path, content := range map[string]string{datPath: "dat", romPath: "rom"} {
+		err = os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tdb := &trashTestDB{lookupTestDB{dat: &types.Dat{Name: "test", Path: datPath}}}
+	depot, err := archive.NewDepot([]string{depotRoot}, []int64{1 << 30}, tdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(datsDir, root)
+	cfg.Trash.Enabled = true
+	rs := NewRombaService(tdb, depot, cfg)
+
+	// the only dat of the rom is made obsolete
+	_, started, err := rs.runCommand([]string{"purge-delete", datPath}, nil)
+	if err != nil || started == nil {
+		t.Fatalf("purge-delete didn't start a job: %v", err)
+	}
+	job := waitForJob(t, rs, started.ID)
+	if job.State != JobDone || !strings.Contains(job.Message, "undo with: undo ") {
+		t.Fatalf("got job %+v, want a purge into the trash", job)
+	}
+	if _, err := os.Stat(romPath); !os.IsNotExist(err) {
+		t.Fatalf("purged rom still in the depot: %v", err)
+	}
+
+	ops, err := rs.trash.List()
+	if err != nil || len(ops) != 1 || ops[0].Name != "purge" || ops[0].Files != 1 {
+		t.Fatalf("got trash %+v, %v, want the purge", ops, err)
+	}
+	trashed := filepath.Join(depotRoot, ".romba_trash", ops[0].ID, "da", "39", "a3", "ee", filepath.Base(romPath))
+	if _, err := os.Stat(trashed); err != nil {
+		t.Errorf("purged rom not in the trash of its depot root: %v", err)
+	}
+
+	out, _, err := rs.runCommand([]string{"undo", ops[0].ID}, nil)
+	if err != nil || !strings.HasPrefix(out, "restored 1 files") {
+		t.Fatalf("undo answered %q, %v", out, err)
+	}
+	if bs, err := ioutil.ReadFile(romPath); err != nil || string(bs) != "rom" {
+		t.Errorf("rom not restored: %q, %v", bs, err)
+	}
+	if usage := depot.Usage(); usage[0].Size != 3 {
+		t.Errorf("got depot size %d after the undo, want 3", usage[0].Size)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package sftp reads files from SFTP servers. Connections go through the ssh
+// command, so host keys, user keys, agents and ~/.ssh/config work as they do
+// for ssh itself, and the SFTP protocol is spoken by github.com/pkg/sftp.
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// ErrConnClosed is returned for requests on a client whose connection is gone.
+var ErrConnClosed error = sftp.ErrSSHFxConnectionLost
+
+// Client is a connection to an SFTP server. It is safe for concurrent use.
+type Client struct {
+	*sftp.Client
+	cmd *exec.Cmd
+
+	done chan struct{}
+	err  error
+}
+
+// Dial connects to the SFTP server at addr, [user@]host[:port], by running
+// ssh with its sftp subsystem. ssh runs in batch mode, so authentication has
+// to work without prompting.
+func Dial(addr string) (*Client, error) {
+	host, port := addr, ""
+	if i := strings.LastIndex(addr, ":"); i > strings.LastIndex(addr, "]") {
+		host, port = addr[:i], addr[i+1:]
+	}
+	host = strings.NewReplacer("[", "", "]", "").Replace(host)
+
+	// neither may pass for an option of ssh
+	user := ""
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user = host[:i]
+	}
+	if host == "" || strings.HasPrefix(host, "-") || strings.HasPrefix(user, "-") {
+		return nil, fmt.Errorf("bad SFTP server address %q", addr)
+	}
+	for _, r := range port {
+		if r < '0' || r > '9' {
+			return nil, fmt.Errorf("bad port in SFTP server address %q", addr)
+		}
+	}
+
+	args := []string{"-o", "BatchMode=yes", "-s"}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", host, "sftp")
+
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("connecting to %s failed: %v", addr, err)
+	}
+	return newClient(sc, cmd), nil
+}
+
+// NewClient starts an SFTP session over conn.
+func NewClient(conn io.ReadWriteCloser) (*Client, error) {
+	sc, err := sftp.NewClientPipe(conn, conn)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(sc, nil), nil
+}
+
+func newClient(sc *sftp.Client, cmd *exec.Cmd) *Client {
+	c := &Client{
+		Client: sc,
+		cmd:    cmd,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		c.err = sc.Wait()
+		if c.err == nil {
+			c.err = ErrConnClosed
+		}
+		close(c.done)
+	}()
+	return c
+}
+
+// Err returns the error the connection ended with, nil while it is up.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close ends the session, and the ssh command if there is one.
+func (c *Client) Close() error {
+	err := c.Client.Close()
+	if c.cmd != nil {
+		c.cmd.Wait()
+	}
+	return err
+}
+
+// ReadDir lists the directory at path, sorted by name and without . and ..
+func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
+	fis, err := c.Client.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 0
+	for _, fi := range fis {
+		if fi.Name() != "." && fi.Name() != ".." {
+			fis[n] = fi
+			n++
+		}
+	}
+	fis = fis[:n]
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+// Walk walks the tree below root on the server like filepath.Walk does
+// locally: in lexical order, without following symlinks, calling walkFn for
+// every file and directory, which can return filepath.SkipDir.
+func (c *Client) Walk(root string, walkFn filepath.WalkFunc) error {
+	fi, err := c.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = c.walk(root, fi, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) walk(p string, fi os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !fi.IsDir() {
+		return walkFn(p, fi, nil)
+	}
+
+	fis, err := c.ReadDir(p)
+	err1 := walkFn(p, fi, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, child := range fis {
+		err = c.walk(path.Join(p, child.Name()), child, walkFn)
+		if err != nil {
+			if !child.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
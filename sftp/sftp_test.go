@@ -0,0 +1,166 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package sftp_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uwedeportivo/romba/sftp"
+	"github.com/uwedeportivo/romba/sftp/sftptest"
+)
+
+func TestClient(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-sftp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	files := map[string][]byte{
+		"a/big.bin":   big,
+		"a/b/small":   []byte("small file"),
+		"a/b/empty":   nil,
+		"top.txt":     []byte("top"),
+		"a/c/deep/x1": []byte("x"),
+	}
+	for name, contents := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(p), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, contents, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := sftptest.NewServer(root)
+
+	c, err := sftp.NewClient(server.Conn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var walked []string
+	err = c.Walk("/", func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Name() == "c" {
+			return filepath.SkipDir
+		}
+		if !fi.IsDir() {
+			walked = append(walked, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/a/b/empty /a/b/small /a/big.bin /top.txt"
+	if got := strings.Join(walked, " "); got != want {
+		t.Errorf("walked %s, want %s", got, want)
+	}
+
+	fi, err := c.Stat("/a/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(big)) || !fi.Mode().IsRegular() {
+		t.Errorf("got size %d and mode %v", fi.Size(), fi.Mode())
+	}
+
+	_, err = c.Stat("/missing")
+	if !os.IsNotExist(err) {
+		t.Errorf("got %v for missing file", err)
+	}
+	_, err = c.Open("/missing")
+	if !os.IsNotExist(err) {
+		t.Errorf("got %v opening missing file", err)
+	}
+
+	f, err := c.Open("/a/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, off := range []int64{0, 1, 100000, int64(len(big)) - 70000} {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+
+			buf := make([]byte, 70000)
+			n, err := f.ReadAt(buf, off)
+			end := off + int64(n)
+			if err != nil && err != io.EOF || !bytes.Equal(buf[:n], big[off:end]) || n != 70000 {
+				t.Errorf("read %d bytes at %d with error %v", n, off, err)
+			}
+		}(off)
+	}
+	wg.Wait()
+
+	buf := make([]byte, 100)
+	n, err := f.ReadAt(buf, int64(len(big))-10)
+	if n != 10 || err != io.EOF {
+		t.Errorf("read %d bytes at the end with error %v", n, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	c.Close()
+	_, err = c.Stat("/top.txt")
+	if err == nil {
+		t.Errorf("closed client still answers")
+	}
+}
+
+func TestDialRejectsOptions(t *testing.T) {
+	for _, addr := range []string{"-oProxyCommand=touch x", "-oProxyCommand=x@host", "host:22 -v", ""} {
+		_, err := sftp.Dial(addr)
+		if err == nil || !strings.Contains(err.Error(), "SFTP server address") {
+			t.Errorf("got error %v dialing %q", err, addr)
+		}
+	}
+}
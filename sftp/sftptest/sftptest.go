@@ -0,0 +1,147 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package sftptest provides an SFTP server of a local directory for tests.
+package sftptest
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+)
+
+// Server is a read-only SFTP server of the files below Root, which is / to
+// its clients.
+type Server struct {
+	Root string
+}
+
+// NewServer returns a server of the files below root.
+func NewServer(root string) *Server {
+	return &Server{Root: root}
+}
+
+type conn struct {
+	io.Reader
+	io.Writer
+	closers []io.Closer
+}
+
+func (c *conn) Close() error {
+	for _, cl := range c.closers {
+		cl.Close()
+	}
+	return nil
+}
+
+// Conn starts a session with the server and returns the client end of its
+// connection. Closing it ends the session.
+func (s *Server) Conn() io.ReadWriteCloser {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	h := &handlers{s: s}
+	rs := sftp.NewRequestServer(&conn{Reader: sr, Writer: sw, closers: []io.Closer{sr, sw}}, sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	})
+	go func() {
+		rs.Serve()
+		rs.Close()
+	}()
+	return &conn{Reader: cr, Writer: cw, closers: []io.Closer{cr, cw}}
+}
+
+type handlers struct {
+	s *Server
+}
+
+func (h *handlers) local(p string) string {
+	return filepath.Join(h.s.Root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return os.Open(h.local(r.Filepath))
+}
+
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return nil, os.ErrPermission
+}
+
+func (h *handlers) Filecmd(r *sftp.Request) error {
+	return os.ErrPermission
+}
+
+type lister []os.FileInfo
+
+func (l lister) ListAt(fis []os.FileInfo, off int64) (int, error) {
+	if off >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(fis, l[off:])
+	if n < len(fis) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	p := h.local(r.Filepath)
+	switch r.Method {
+	case "List":
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fis, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return lister(fis), nil
+	case "Stat":
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return lister{fi}, nil
+	case "Lstat":
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		return lister{fi}, nil
+	}
+	return nil, os.ErrPermission
+}
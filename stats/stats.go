@@ -0,0 +1,221 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package stats keeps the history of the depot statistics, samples of the
+// file and byte counts of the depot taken from time to time, and works out
+// how fast the depot grows from them. Samples are kept as JSON lines in a
+// file, the oldest ones being dropped beyond a limit.
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+)
+
+// Sample is the statistics of the depot at one time.
+type Sample struct {
+	Time time.Time `json:"time"`
+	*archive.DepotStats
+}
+
+// History is the file of samples.
+type History struct {
+	path string
+	keep int
+	lock sync.Mutex
+}
+
+// NewHistory returns the history of samples in the file at path, keeping
+// the newest keep of them, all if keep is 0.
+func NewHistory(path string, keep int) *History {
+	return &History{
+		path: path,
+		keep: keep,
+	}
+}
+
+// Add appends s to the history.
+func (h *History) Add(s *Sample) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	samples, err := h.read()
+	if err != nil {
+		return err
+	}
+	samples = append(samples, s)
+	if h.keep > 0 && len(samples) > h.keep {
+		samples = samples[len(samples)-h.keep:]
+	}
+
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, s := range samples {
+		err = enc.Encode(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(h.path+".tmp", buf.Bytes(), 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(h.path+".tmp", h.path)
+}
+
+// Samples returns the samples taken since the given time, oldest first.
+func (h *History) Samples(since time.Time) ([]*Sample, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	samples, err := h.read()
+	if err != nil {
+		return nil, err
+	}
+
+	i := 0
+	for i < len(samples) && samples[i].Time.Before(since) {
+		i++
+	}
+	return samples[i:], nil
+}
+
+func (h *History) read() ([]*Sample, error) {
+	file, err := os.Open(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var samples []*Sample
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		s := new(Sample)
+		err = json.Unmarshal(scanner.Bytes(), s)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// Growth is how much the depot grew between two samples.
+type Growth struct {
+	// Period names the period the growth is over.
+	Period string    `json:"period"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Files  int64     `json:"files"`
+	Bytes  int64     `json:"bytes"`
+	// BytesPerDay is the average growth per day.
+	BytesPerDay float64 `json:"bytesPerDay"`
+}
+
+// GrowthOver returns the growth of the depot from the newest of samples
+// taken at least period before the last one, or from the first one, to the
+// last one. It returns nil for fewer than two samples.
+func GrowthOver(samples []*Sample, period time.Duration) *Growth {
+	if len(samples) < 2 {
+		return nil
+	}
+
+	last := samples[len(samples)-1]
+	first := samples[0]
+	for _, s := range samples[:len(samples)-1] {
+		if last.Time.Sub(s.Time) < period {
+			break
+		}
+		first = s
+	}
+
+	g := &Growth{
+		From:  first.Time,
+		To:    last.Time,
+		Files: last.Files - first.Files,
+		Bytes: last.Bytes - first.Bytes,
+	}
+	if days := last.Time.Sub(first.Time).Hours() / 24; days > 0 {
+		g.BytesPerDay = float64(g.Bytes) / days
+	}
+	return g
+}
+
+// periods are the periods a report gives the growth over.
+var periods = []struct {
+	name   string
+	period time.Duration
+}{
+	{"day", 24 * time.Hour},
+	{"week", 7 * 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+	{"all", 0},
+}
+
+// Report is the latest sample with the growth of the depot over the last
+// day, week, month and all samples.
+type Report struct {
+	Latest *Sample   `json:"latest,omitempty"`
+	Growth []*Growth `json:"growth,omitempty"`
+}
+
+// NewReport returns the report of samples, oldest first.
+func NewReport(samples []*Sample) *Report {
+	r := new(Report)
+	if len(samples) == 0 {
+		return r
+	}
+	r.Latest = samples[len(samples)-1]
+
+	for _, p := range periods {
+		period := p.period
+		if period == 0 {
+			period = r.Latest.Time.Sub(samples[0].Time)
+		}
+		g := GrowthOver(samples, period)
+		if g == nil {
+			break
+		}
+		g.Period = p.name
+		r.Growth = append(r.Growth, g)
+	}
+	return r
+}
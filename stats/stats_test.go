@@ -0,0 +1,127 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/archive"
+)
+
+func sampleAt(t time.Time, files, bytes int64) *Sample {
+	return &Sample{
+		Time:       t,
+		DepotStats: &archive.DepotStats{Files: files, Bytes: bytes},
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba-stats-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := NewHistory(filepath.Join(dir, "stats.jsonl"), 3)
+
+	samples, err := h.Samples(time.Time{})
+	if err != nil || len(samples) != 0 {
+		t.Fatalf("got %v, %v from an empty history", samples, err)
+	}
+
+	start := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := int64(0); i < 5; i++ {
+		err = h.Add(sampleAt(start.Add(time.Duration(i)*time.Hour), i, 100*i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	samples, err = NewHistory(h.path, 3).Samples(start.Add(3 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 || samples[0].Files != 3 || samples[1].Bytes != 400 || !samples[1].Time.Equal(start.Add(4*time.Hour)) {
+		t.Errorf("got samples %+v, want the last two", samples)
+	}
+
+	samples, err = h.Samples(time.Time{})
+	if err != nil || len(samples) != 3 || samples[0].Files != 2 {
+		t.Errorf("got %d samples starting with %+v, %v, want the newest 3", len(samples), samples[0], err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	now := time.Date(2013, 3, 1, 0, 0, 0, 0, time.UTC)
+	samples := []*Sample{
+		sampleAt(now.Add(-60*24*time.Hour), 0, 0),
+		sampleAt(now.Add(-10*24*time.Hour), 100, 1000),
+		sampleAt(now.Add(-2*24*time.Hour), 150, 1500),
+		sampleAt(now.Add(-time.Hour), 190, 1900),
+		sampleAt(now, 200, 2000),
+	}
+
+	r := NewReport(samples)
+	if r.Latest != samples[4] {
+		t.Errorf("got latest %+v", r.Latest)
+	}
+
+	want := []struct {
+		period string
+		from   int
+	}{
+		{"day", 2},
+		{"week", 1},
+		{"month", 0},
+		{"all", 0},
+	}
+	if len(r.Growth) != len(want) {
+		t.Fatalf("got %d growths, want %d", len(r.Growth), len(want))
+	}
+	for i, w := range want {
+		g := r.Growth[i]
+		from := samples[w.from]
+		if g.Period != w.period || !g.From.Equal(from.Time) || g.Files != 200-from.Files || g.Bytes != 2000-from.Bytes {
+			t.Errorf("got %s growth %+v, want it from sample %d", w.period, g, w.from)
+		}
+	}
+	if got := r.Growth[0].BytesPerDay; got != 250 {
+		t.Errorf("got %f bytes per day, want 250", got)
+	}
+
+	if r := NewReport(samples[:1]); r.Latest != samples[0] || len(r.Growth) != 0 {
+		t.Errorf("got report %+v of one sample", r)
+	}
+}
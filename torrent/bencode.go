@@ -0,0 +1,99 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// dict is a bencoded dictionary, its keys are written sorted as the format
+// requires.
+type dict map[string]interface{}
+
+// list is a bencoded list.
+type list []interface{}
+
+// bencode appends the encoding of v, made of dicts, lists, strings, byte
+// slices and integers, to buf.
+func bencode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case dict:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, k := range keys {
+			bencodeString(buf, []byte(k))
+			err := bencode(buf, v[k])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case list:
+		buf.WriteByte('l')
+		for _, e := range v {
+			err := bencode(buf, e)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case string:
+		bencodeString(buf, []byte(v))
+	case []byte:
+		bencodeString(buf, v)
+	case int:
+		bencodeInt(buf, int64(v))
+	case int64:
+		bencodeInt(buf, v)
+	default:
+		return fmt.Errorf("can't bencode %T", v)
+	}
+	return nil
+}
+
+func bencodeString(buf *bytes.Buffer, s []byte) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.Write(s)
+}
+
+func bencodeInt(buf *bytes.Buffer, n int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(n, 10))
+	buf.WriteByte('e')
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package torrent creates the metadata files of BitTorrent, for distributing
+// built sets. Torrents are reproducible: they carry no creation date and list
+// files in a fixed order, so everyone creating a torrent of the same files
+// with the same options gets the same torrent, and the same info hash.
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// MinPieceLength and MaxPieceLength bound the piece length, which must
+	// be a power of two.
+	MinPieceLength = 16 << 10
+	MaxPieceLength = 16 << 20
+
+	// piece lengths picked for the size of the files stay at least this
+	// long and grow until there are at most targetPieces pieces
+	autoMinPieceLength = 256 << 10
+	targetPieces       = 2000
+
+	createdBy = "romba"
+)
+
+// Options controls the contents of a torrent.
+type Options struct {
+	// PieceLength is the length of the pieces files are hashed in, picked
+	// from the size of the files if zero.
+	PieceLength int64
+	// Trackers are the announce URLs of the trackers, tried in order.
+	Trackers []string
+	// Comment is an optional free text.
+	Comment string
+	// Private marks the torrent as only shared through its trackers.
+	Private bool
+}
+
+// Torrent is the metadata of a torrent.
+type Torrent struct {
+	// Data is the bencoded metadata, the contents of a .torrent file.
+	Data []byte
+	// InfoHash identifies the torrent to trackers and peers.
+	InfoHash [sha1.Size]byte
+	Files    int
+	Size     int64
+}
+
+// Write writes the torrent into a file at path.
+func (t *Torrent) Write(path string) error {
+	return ioutil.WriteFile(path, t.Data, 0666)
+}
+
+func (t *Torrent) String() string {
+	return fmt.Sprintf("%d files, %d bytes, info hash %x", t.Files, t.Size, t.InfoHash)
+}
+
+// file is a file of a torrent.
+type file struct {
+	path   string
+	parts  []string
+	length int64
+}
+
+// Create returns a torrent of the files below the directory root, named after
+// root. Hidden files, like those left by interrupted builds, are left out.
+func Create(root string, opts *Options) (*Torrent, error) {
+	files, err := listFiles(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s has no files", root)
+	}
+
+	var size int64
+	for _, f := range files {
+		size += f.length
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = autoPieceLength(size)
+	}
+	if pieceLength < MinPieceLength || pieceLength > MaxPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d is not a power of two between %d and %d",
+			pieceLength, MinPieceLength, MaxPieceLength)
+	}
+
+	pieces, err := hashPieces(files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	infoFiles := make(list, 0, len(files))
+	for _, f := range files {
+		path := make(list, len(f.parts))
+		for i, p := range f.parts {
+			path[i] = p
+		}
+		infoFiles = append(infoFiles, dict{
+			"length": f.length,
+			"path":   path,
+		})
+	}
+
+	info := dict{
+		"name":         filepath.Base(root),
+		"piece length": pieceLength,
+		"pieces":       pieces,
+		"files":        infoFiles,
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+
+	var infoBuf bytes.Buffer
+	err = bencode(&infoBuf, info)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := dict{
+		"info":       info,
+		"created by": createdBy,
+	}
+	if len(opts.Trackers) > 0 {
+		meta["announce"] = opts.Trackers[0]
+	}
+	if len(opts.Trackers) > 1 {
+		tiers := make(list, len(opts.Trackers))
+		for i, tr := range opts.Trackers {
+			tiers[i] = list{tr}
+		}
+		meta["announce-list"] = tiers
+	}
+	if opts.Comment != "" {
+		meta["comment"] = opts.Comment
+	}
+
+	var buf bytes.Buffer
+	err = bencode(&buf, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Torrent{
+		Data:     buf.Bytes(),
+		InfoHash: sha1.Sum(infoBuf.Bytes()),
+		Files:    len(files),
+		Size:     size,
+	}, nil
+}
+
+// autoPieceLength picks the piece length for files of size bytes.
+func autoPieceLength(size int64) int64 {
+	pieceLength := int64(autoMinPieceLength)
+	for pieceLength < MaxPieceLength && size/pieceLength >= targetPieces {
+		pieceLength <<= 1
+	}
+	return pieceLength
+}
+
+// listFiles returns the files below root, sorted by their path.
+func listFiles(root string) ([]*file, error) {
+	var files []*file
+
+	// filepath.Walk visits names in lexical order
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &file{
+			path:   path,
+			parts:  strings.Split(filepath.ToSlash(rel), "/"),
+			length: fi.Size(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// hashPieces returns the concatenated SHA1s of the pieces of the files
+// laid end to end.
+func hashPieces(files []*file, pieceLength int64) ([]byte, error) {
+	var pieces []byte
+	piece := make([]byte, pieceLength)
+	n := 0
+
+	for _, f := range files {
+		r, err := os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+
+		var read int64
+		for {
+			m, err := io.ReadFull(r, piece[n:])
+			n += m
+			read += int64(m)
+			if n == len(piece) {
+				sum := sha1.Sum(piece)
+				pieces = append(pieces, sum[:]...)
+				n = 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		r.Close()
+
+		if read != f.length {
+			return nil, fmt.Errorf("%s changed while hashing", f.path)
+		}
+	}
+
+	if n > 0 {
+		sum := sha1.Sum(piece[:n])
+		pieces = append(pieces, sum[:]...)
+	}
+	return pieces, nil
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBencode(t *testing.T) {
+	var buf bytes.Buffer
+	err := bencode(&buf, dict{
+		"b":    list{1, "x", []byte("yz")},
+		"a":    int64(-3),
+		"ccc":  dict{},
+		"name": "set",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "d1:ai-3e1:bli1e1:x2:yze3:cccde4:name3:sete"
+	if buf.String() != want {
+		t.Errorf("got %s, want %s", buf.String(), want)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-torrent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	set := filepath.Join(root, "My Set")
+	files := map[string]string{
+		"b.zip":         strings.Repeat("b", 20<<10),
+		"a.zip":         strings.Repeat("a", 10<<10),
+		"sub/c.zip":     "c",
+		".romba-build-": "interrupted build",
+	}
+	for name, contents := range files {
+		path := filepath.Join(set, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(contents), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := &Options{
+		PieceLength: MinPieceLength,
+		Trackers:    []string{"http://tracker.example/announce", "udp://backup.example:6969"},
+	}
+	tt, err := Create(set, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tt.Files != 3 || tt.Size != 30<<10+1 {
+		t.Errorf("got %d files of %d bytes", tt.Files, tt.Size)
+	}
+
+	// pieces run over file boundaries in path order
+	all := []byte(files["a.zip"] + files["b.zip"] + files["sub/c.zip"])
+	var pieces []byte
+	for len(all) > 0 {
+		n := MinPieceLength
+		if n > len(all) {
+			n = len(all)
+		}
+		sum := sha1.Sum(all[:n])
+		pieces = append(pieces, sum[:]...)
+		all = all[n:]
+	}
+
+	var info bytes.Buffer
+	info.WriteString("d5:filesl")
+	info.WriteString("d6:lengthi10240e4:pathl5:a.zipee")
+	info.WriteString("d6:lengthi20480e4:pathl5:b.zipee")
+	info.WriteString("d6:lengthi1e4:pathl3:sub5:c.zipee")
+	info.WriteString("e4:name6:My Set12:piece lengthi16384e6:pieces")
+	info.WriteString(strconv.Itoa(len(pieces)) + ":")
+	info.Write(pieces)
+	info.WriteString("e")
+
+	var want bytes.Buffer
+	want.WriteString("d8:announce31:http://tracker.example/announce")
+	want.WriteString("13:announce-listll31:http://tracker.example/announceel25:udp://backup.example:6969ee")
+	want.WriteString("10:created by5:romba4:info")
+	want.Write(info.Bytes())
+	want.WriteString("e")
+
+	if !bytes.Equal(tt.Data, want.Bytes()) {
+		t.Errorf("got torrent\n%q\nwant\n%q", tt.Data, want.Bytes())
+	}
+	if tt.InfoHash != sha1.Sum(info.Bytes()) {
+		t.Errorf("got info hash %x", tt.InfoHash)
+	}
+
+	again, err := Create(set, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Data, tt.Data) {
+		t.Errorf("torrent not reproducible")
+	}
+}
+
+func TestPieceLength(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int64
+	}{
+		{0, 256 << 10},
+		{100 << 20, 256 << 10},
+		{1 << 30, 1 << 20},
+		{1 << 40, MaxPieceLength},
+	}
+
+	for _, test := range tests {
+		got := autoPieceLength(test.size)
+		if got != test.want {
+			t.Errorf("size %d got piece length %d, want %d", test.size, got, test.want)
+		}
+	}
+
+	_, err := Create(os.TempDir(), &Options{PieceLength: 100 << 10})
+	if err == nil {
+		t.Errorf("piece length not a power of two accepted")
+	}
+}
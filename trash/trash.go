@@ -0,0 +1,715 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package trash keeps the files destructive operations remove, so they can
+// be undone. Each operation, like a purge of the depot or a fix of a set
+// folder, gets a dated directory in the trash holding the files it removed,
+// below their original absolute paths, and a manifest of where they came
+// from. Files below the root of an area, like a depot root, go into the
+// area's directory instead, on the same filesystem, so trashing them is a
+// rename and not a copy. Undoing an operation moves its files back.
+// Operations older than the keep time of the trash are emptied for good.
+package trash
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/logging"
+)
+
+var logger = logging.For("trash")
+
+const (
+	operationFile = "operation.json"
+	manifestFile  = "manifest.jsonl"
+	filesDir      = "files"
+	// idFormat is the time format operation IDs start with
+	idFormat = "2006-01-02-15_04_05"
+)
+
+// Operation describes a destructive operation and the files it removed.
+type Operation struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Started and Finished are when the operation ran, Finished is nil for
+	// operations that didn't finish.
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Files and Bytes are what is in the trash of the operation.
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// Restored is the number of files moved back by undos, Undone the time
+	// of the last undo.
+	Restored int64      `json:"restored,omitempty"`
+	Undone   *time.Time `json:"undone,omitempty"`
+}
+
+// Entry is a file in the trash.
+type Entry struct {
+	// Path is where the file was, Trashed where it is now, relative to the
+	// directory of the operation in Area if set, to its files directory if
+	// not.
+	Path    string    `json:"path"`
+	Area    string    `json:"area,omitempty"`
+	Trashed string    `json:"trashed"`
+	Size    int64     `json:"size"`
+	Time    time.Time `json:"time"`
+}
+
+// Area is a directory the files below Root are trashed into, on the same
+// filesystem as them.
+type Area struct {
+	Root string
+	Dir  string
+}
+
+// Trash is a directory of trashed operations.
+type Trash struct {
+	dir   string
+	keep  time.Duration
+	areas []Area
+	lock  sync.Mutex
+}
+
+// New returns the trash in dir, emptying operations older than keep, none
+// if keep is 0.
+func New(dir string, keep time.Duration) *Trash {
+	return &Trash{
+		dir:  dir,
+		keep: keep,
+	}
+}
+
+// AddArea makes the files below root go into dir when trashed.
+func (t *Trash) AddArea(root, dir string) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.areas = append(t.areas, Area{Root: root, Dir: dir})
+	return nil
+}
+
+// area returns the area path is in, nil if none.
+func (t *Trash) area(path string) *Area {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, a := range t.areas {
+		if path == a.Root || strings.HasPrefix(path, a.Root+string(filepath.Separator)) {
+			return &t.areas[i]
+		}
+	}
+	return nil
+}
+
+// Dir returns the directory of the trash.
+func (t *Trash) Dir() string {
+	return t.dir
+}
+
+// Op is a running operation putting files into the trash.
+type Op struct {
+	t        *Trash
+	dir      string
+	lock     sync.Mutex
+	op       *Operation
+	manifest *os.File
+	mw       *bufio.Writer
+}
+
+// Begin starts an operation named name and expires old ones.
+func (t *Trash) Begin(name string) (*Op, error) {
+	err := t.expire()
+	if err != nil {
+		logger.Warningf("error expiring trash: %v", err)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	base := now.Format(idFormat) + "-" + name
+	id := base
+	for i := 2; ; i++ {
+		_, err = os.Stat(filepath.Join(t.dir, id))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	dir := filepath.Join(t.dir, id)
+	err = os.MkdirAll(filepath.Join(dir, filesDir), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &Op{
+		t:   t,
+		dir: dir,
+		op: &Operation{
+			ID:      id,
+			Name:    name,
+			Started: now,
+		},
+	}
+	err = writeOperation(dir, op.op)
+	if err != nil {
+		return nil, err
+	}
+
+	op.manifest, err = os.Create(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	op.mw = bufio.NewWriter(op.manifest)
+	return op, nil
+}
+
+// ID returns the ID of the operation, which undoes it.
+func (op *Op) ID() string {
+	return op.op.ID
+}
+
+// Remove moves the file or directory at path into the trash.
+func (op *Op) Remove(path string) error {
+	return op.RemoveFrom(path, path)
+}
+
+// RemoveFrom moves the file or directory at path, which was put aside from
+// orig, into the trash. Undoing the operation moves it back to orig.
+func (op *Op) RemoveFrom(path, orig string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	orig, err = filepath.Abs(orig)
+	if err != nil {
+		return err
+	}
+
+	size, err := pathSize(path)
+	if err != nil {
+		return err
+	}
+
+	name, base := trashedName(orig), filepath.Join(op.dir, filesDir)
+	var areaDir string
+	if a := op.t.area(path); a != nil {
+		name, err = filepath.Rel(a.Root, path)
+		if err != nil {
+			return err
+		}
+		areaDir = a.Dir
+		base = filepath.Join(a.Dir, op.op.ID)
+	}
+
+	op.lock.Lock()
+	defer op.lock.Unlock()
+
+	rel := name
+	dst := filepath.Join(base, rel)
+	for i := 1; ; i++ {
+		_, err = os.Lstat(dst)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rel = fmt.Sprintf("%s-%d", name, i)
+		dst = filepath.Join(base, rel)
+	}
+
+	err = move(path, dst)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(op.mw).Encode(&Entry{
+		Path:    orig,
+		Area:    areaDir,
+		Trashed: filepath.ToSlash(rel),
+		Size:    size,
+		Time:    time.Now(),
+	})
+	if err == nil {
+		// the manifest is kept current, so the trash of an interrupted
+		// operation can be undone too
+		err = op.mw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	op.op.Files++
+	op.op.Bytes += size
+	logger.V(2).Infof("trashed %s in %s", orig, op.op.ID)
+	return nil
+}
+
+// Close ends the operation and returns its description. The trash of
+// operations that removed nothing is removed.
+func (op *Op) Close() (*Operation, error) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+
+	err := op.mw.Flush()
+	if cerr := op.manifest.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if op.op.Files == 0 {
+		op.t.lock.Lock()
+		defer op.t.lock.Unlock()
+		return op.op, op.t.remove(op.dir, op.op.ID, nil)
+	}
+
+	now := time.Now()
+	op.op.Finished = &now
+	return op.op, writeOperation(op.dir, op.op)
+}
+
+// remove removes the operation with the given ID in dir and its directories
+// in the areas of the trash and of entries. The caller holds the lock of t.
+func (t *Trash) remove(dir, id string, entries []*Entry) error {
+	dirs := make(map[string]bool)
+	for _, e := range entries {
+		if e.Area != "" {
+			dirs[e.Area] = true
+		}
+	}
+	for _, a := range t.areas {
+		dirs[a.Dir] = true
+	}
+
+	for adir := range dirs {
+		err := os.RemoveAll(filepath.Join(adir, id))
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// trashedPath returns where the file of e is in the trash of the operation
+// in dir.
+func trashedPath(dir string, e *Entry) string {
+	if e.Area != "" {
+		return filepath.Join(e.Area, filepath.Base(dir), filepath.FromSlash(e.Trashed))
+	}
+	return filepath.Join(dir, filesDir, filepath.FromSlash(e.Trashed))
+}
+
+// trashedName returns where path goes below the files directory of an
+// operation.
+func trashedName(path string) string {
+	vol := filepath.VolumeName(path)
+	rel := strings.TrimLeft(path[len(vol):], `/\`)
+	if vol != "" {
+		rel = filepath.Join(strings.Trim(vol, `:\/`), rel)
+	}
+	return rel
+}
+
+func pathSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// move renames src to dst, copying it if they are on different filesystems.
+func move(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	err = copyTree(src, dst)
+	if err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		return copyFile(p, target, info.Mode())
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writeOperation(dir string, op *Operation) error {
+	bs, err := json.MarshalIndent(op, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	opath := filepath.Join(dir, operationFile)
+	err = ioutil.WriteFile(opath+".tmp", bs, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(opath+".tmp", opath)
+}
+
+func readOperation(dir string) (*Operation, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(dir, operationFile))
+	if err != nil {
+		return nil, err
+	}
+
+	op := new(Operation)
+	err = json.Unmarshal(bs, op)
+	if err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func readManifest(dir string) ([]*Entry, error) {
+	file, err := os.Open(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		e := new(Entry)
+		err = json.Unmarshal(scanner.Bytes(), e)
+		if err != nil {
+			// the last line of an interrupted operation may be cut off
+			logger.Warningf("skipping malformed trash manifest line in %s: %v", dir, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func writeManifest(dir string, entries []*Entry) error {
+	mpath := filepath.Join(dir, manifestFile)
+	file, err := os.Create(mpath + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		err = enc.Encode(e)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(mpath + ".tmp")
+		return err
+	}
+	return os.Rename(mpath+".tmp", mpath)
+}
+
+// List returns the operations in the trash, oldest first.
+func (t *Trash) List() ([]*Operation, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.list()
+}
+
+func (t *Trash) list() ([]*Operation, error) {
+	fis, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ops []*Operation
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(t.dir, fi.Name())
+		op, err := readOperation(dir)
+		if err != nil {
+			logger.Warningf("skipping trash %s: %v", dir, err)
+			continue
+		}
+
+		if op.Finished == nil {
+			// interrupted, the manifest tells what is in the trash
+			entries, err := readManifest(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			op.Files, op.Bytes = 0, 0
+			for _, e := range entries {
+				op.Files++
+				op.Bytes += e.Size
+			}
+		}
+		ops = append(ops, op)
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Started.Before(ops[j].Started)
+	})
+	return ops, nil
+}
+
+// Entries returns the files in the trash of the operation with the given ID.
+func (t *Trash) Entries(id string) ([]*Entry, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	dir, err := t.opDir(id)
+	if err != nil {
+		return nil, err
+	}
+	return readManifest(dir)
+}
+
+func (t *Trash) opDir(id string) (string, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid trash operation %q", id)
+	}
+
+	dir := filepath.Join(t.dir, id)
+	_, err := os.Stat(filepath.Join(dir, operationFile))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("no trash operation %s", id)
+	}
+	return dir, err
+}
+
+// UndoReport tells what an undo did.
+type UndoReport struct {
+	Operation *Operation `json:"operation"`
+	// Restored are the files moved back.
+	Restored []*Entry `json:"restored,omitempty"`
+	// Conflicts are the files not moved back because their path is taken,
+	// they stay in the trash.
+	Conflicts []*Entry `json:"conflicts,omitempty"`
+}
+
+func (ur *UndoReport) String() string {
+	var bytes int64
+	for _, e := range ur.Restored {
+		bytes += e.Size
+	}
+	s := fmt.Sprintf("restored %d files with %d bytes of %s", len(ur.Restored), bytes, ur.Operation.ID)
+	if len(ur.Conflicts) > 0 {
+		s += fmt.Sprintf(", %d files stay in the trash because their path is taken", len(ur.Conflicts))
+	}
+	return s
+}
+
+// Undo moves the files of the operation with the given ID back to where
+// they were. Files whose path is taken stay in the trash, a later undo moves
+// them back once it is free.
+func (t *Trash) Undo(id string) (*UndoReport, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	dir, err := t.opDir(id)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := readOperation(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ur := &UndoReport{Operation: op}
+	var left []*Entry
+	for i, e := range entries {
+		_, err = os.Lstat(e.Path)
+		if err == nil {
+			ur.Conflicts = append(ur.Conflicts, e)
+			left = append(left, e)
+			continue
+		}
+		if os.IsNotExist(err) {
+			err = move(trashedPath(dir, e), e.Path)
+		}
+		if err != nil {
+			left = append(left, entries[i:]...)
+			break
+		}
+		ur.Restored = append(ur.Restored, e)
+	}
+
+	now := time.Now()
+	op.Undone = &now
+	op.Restored += int64(len(ur.Restored))
+	op.Files, op.Bytes = 0, 0
+	for _, e := range left {
+		op.Files++
+		op.Bytes += e.Size
+	}
+	if op.Finished == nil {
+		// an undo finishes an interrupted operation
+		op.Finished = &now
+	}
+
+	merr := writeManifest(dir, left)
+	if merr == nil {
+		merr = writeOperation(dir, op)
+	}
+	if err == nil {
+		err = merr
+	}
+	if err != nil {
+		return ur, err
+	}
+
+	logger.Infof("undid trash operation %s: %v", id, ur)
+	return ur, nil
+}
+
+// expire removes the operations started more than the keep time ago.
+func (t *Trash) expire() error {
+	if t.keep <= 0 {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ops, err := t.list()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-t.keep)
+	for _, op := range ops {
+		if !op.Started.Before(cutoff) {
+			break
+		}
+		dir := filepath.Join(t.dir, op.ID)
+		entries, err := readManifest(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = t.remove(dir, op.ID, entries)
+		if err != nil {
+			return err
+		}
+		logger.Infof("emptied trash operation %s", op.ID)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package trash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func TestUndo(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-trash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tr := New(filepath.Join(root, "trash"), 0)
+
+	file := filepath.Join(root, "set", "game.zip")
+	dir := filepath.Join(root, "set", "game")
+	writeFile(t, file, "zip")
+	writeFile(t, filepath.Join(dir, "a.bin"), "rom a")
+
+	op, err := tr.Begin("fix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{file, dir} {
+		err = op.Remove(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still there: %v", path, err)
+		}
+	}
+	desc, err := op.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Files != 2 || desc.Bytes != 8 || desc.Finished == nil {
+		t.Errorf("got operation %+v, want 2 files with 8 bytes", desc)
+	}
+
+	// operations removing nothing leave no trash
+	empty, err := tr.Begin("purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = empty.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := tr.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].ID != op.ID() || ops[0].Name != "fix" || ops[0].Files != 2 {
+		t.Fatalf("got operations %+v, want the fix", ops)
+	}
+
+	// the path of the zip is taken again, it stays in the trash
+	writeFile(t, file, "new zip")
+
+	ur, err := tr.Undo(op.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ur.Restored) != 1 || ur.Restored[0].Path != dir || len(ur.Conflicts) != 1 || ur.Conflicts[0].Path != file {
+		t.Errorf("got undo %v, want the game dir restored and the zip in conflict", ur)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.bin")); got != "rom a" {
+		t.Errorf("restored %q", got)
+	}
+
+	err = os.Remove(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ur, err = tr.Undo(op.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ur.Restored) != 1 || len(ur.Conflicts) != 0 || ur.Operation.Restored != 2 || ur.Operation.Files != 0 {
+		t.Errorf("got second undo %v, operation %+v", ur, ur.Operation)
+	}
+	if got := readFile(t, file); got != "zip" {
+		t.Errorf("restored %q", got)
+	}
+
+	for _, id := range []string{"", "..", "../x", "nope"} {
+		if _, err := tr.Undo(id); err == nil {
+			t.Errorf("undid %q", id)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-trash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tr := New(filepath.Join(root, "trash"), time.Hour)
+
+	file := filepath.Join(root, "old.bin")
+	writeFile(t, file, "old")
+
+	op, err := tr.Begin("purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = op.Remove(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := op.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// age the operation
+	desc.Started = desc.Started.Add(-2 * time.Hour)
+	err = writeOperation(op.dir, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := tr.Begin("purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	// the second operation may get the ID of the expired one
+	trashed := filepath.Join(op.dir, filesDir, trashedName(file))
+	if _, err := os.Stat(trashed); !os.IsNotExist(err) {
+		t.Errorf("old operation not expired: %v", err)
+	}
+	ops, err := tr.List()
+	if err != nil || len(ops) != 1 || ops[0].ID != second.ID() || ops[0].Files != 0 {
+		t.Errorf("got operations %+v, %v, want the new one", ops, err)
+	}
+}
+
+func TestArea(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-trash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tr := New(filepath.Join(root, "trash"), time.Hour)
+	depot := filepath.Join(root, "depot")
+	err = tr.AddArea(depot, filepath.Join(depot, ".trash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(depot, "ab", "rom.gz")
+	other := filepath.Join(root, "set", "game.zip")
+	writeFile(t, file, "rom")
+	writeFile(t, other, "zip")
+
+	op, err := tr.Begin("purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{file, other} {
+		err = op.Remove(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc, err := op.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inArea := filepath.Join(depot, ".trash", desc.ID, "ab", "rom.gz")
+	if readFile(t, inArea) != "rom" {
+		t.Errorf("depot file not trashed into the area")
+	}
+	if readFile(t, filepath.Join(op.dir, filesDir, trashedName(other))) != "zip" {
+		t.Errorf("set file not trashed into the trash dir")
+	}
+
+	ur, err := tr.Undo(desc.ID)
+	if err != nil || len(ur.Restored) != 2 {
+		t.Fatalf("got undo %v, %v", ur, err)
+	}
+	if readFile(t, file) != "rom" || readFile(t, other) != "zip" {
+		t.Errorf("files not restored")
+	}
+
+	// expiring removes the directory of the operation in the area too
+	writeFile(t, file, "rom")
+	op, err = tr.Begin("purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = op.Remove(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err = op.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc.Started = desc.Started.Add(-2 * time.Hour)
+	err = writeOperation(op.dir, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(depot, ".trash", desc.ID)); !os.IsNotExist(err) {
+		t.Errorf("area of expired operation left: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCompareNames(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"Disk 2", "Disk 10", -1},
+		{"disk 2", "Disk 10", -1},
+		{"Disk 10", "Disk 9", 1},
+		{"game", "Game", 1},
+		{"Game", "game", -1},
+		{"game", "game", 0},
+		{"a01", "a1", -1},
+		{"a1", "a1b", -1},
+		{"b", "A", 1},
+		{"x99999999999999999999999", "x100000000000000000000000", -1},
+		{"Über", "über", -1},
+	} {
+		if got := CompareNames(tc.a, tc.b); got != tc.want {
+			t.Errorf("CompareNames(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := CompareNames(tc.b, tc.a); got != -tc.want {
+			t.Errorf("CompareNames(%q, %q) = %d, want %d", tc.b, tc.a, got, -tc.want)
+		}
+	}
+}
+
+func TestNormalizeSortsNaturally(t *testing.T) {
+	d := &Dat{}
+	for _, name := range []string{"Game (Disk 10)", "game (disk 1)", "Game (Disk 2)", "Game (Disk 1)"} {
+		d.Games = append(d.Games, &Game{Name: name, Roms: RomSlice{
+			&Rom{Name: "track 10.bin"}, &Rom{Name: "Track 9.bin"},
+		}})
+	}
+	d.Normalize()
+
+	var names []string
+	for _, g := range d.Games {
+		names = append(names, g.Name)
+	}
+	want := "Game (Disk 1)|game (disk 1)|Game (Disk 2)|Game (Disk 10)"
+	if got := strings.Join(names, "|"); got != want {
+		t.Errorf("got games %s, want %s", got, want)
+	}
+
+	if roms := d.Games[0].Roms; roms[0].Name != "Track 9.bin" {
+		t.Errorf("got roms %s, %s", roms[0].Name, roms[1].Name)
+	}
+
+	if !sort.IsSorted(d.Games) {
+		t.Errorf("games not sorted")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"regexp"
+	"strings"
+)
+
+// GameFilter picks the games Filter keeps.
+type GameFilter func(g *Game) bool
+
+// Filter returns a dat with the games and software of d that keep picks. The
+// games are shared with d. Games kept can refer to games dropped through
+// CloneOf and RomOf.
+func (d *Dat) Filter(keep GameFilter) *Dat {
+	nd := *d
+	nd.Games = filterGames(d.Games, keep)
+	nd.Software = filterGames(d.Software, keep)
+	nd.Machines = filterGames(d.Machines, keep)
+	return &nd
+}
+
+func filterGames(games GameSlice, keep GameFilter) GameSlice {
+	if games == nil {
+		return nil
+	}
+
+	kept := make(GameSlice, 0, len(games))
+	for _, g := range games {
+		if keep(g) {
+			kept = append(kept, g)
+		}
+	}
+	return kept
+}
+
+// Not picks the games f doesn't.
+func Not(f GameFilter) GameFilter {
+	return func(g *Game) bool {
+		return !f(g)
+	}
+}
+
+// NameMatches picks the games whose name matches re, for instance
+// regexp.MustCompile(`\(USA\)`) for the US releases in a no-intro dat.
+func NameMatches(re *regexp.Regexp) GameFilter {
+	return func(g *Game) bool {
+		return re.MatchString(g.Name)
+	}
+}
+
+// InRegions picks the games whose name tags one of regions, as in
+// "Game (USA, Europe)", compared without case.
+func InRegions(regions []string) GameFilter {
+	return func(g *Game) bool {
+		return rank(nameTags(g.Name), regions) < len(regions)
+	}
+}
+
+// InCategories picks the games of one of categories, compared without case.
+func InCategories(categories []string) GameFilter {
+	return func(g *Game) bool {
+		for _, c := range categories {
+			if strings.EqualFold(g.Category, c) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// BiosSets picks the BIOS sets of d: games flagged as BIOS and games other
+// games take roms from that are nobody's parent and have no parent themselves.
+func (d *Dat) BiosSets() GameFilter {
+	romOfs := make(map[string]bool)
+	cloneOfs := make(map[string]bool)
+	for _, games := range d.gameLists() {
+		for _, g := range games {
+			if g.RomOf != "" {
+				romOfs[g.RomOf] = true
+			}
+			if g.CloneOf != "" {
+				cloneOfs[g.CloneOf] = true
+			}
+		}
+	}
+
+	return func(g *Game) bool {
+		return bool(g.IsBios) || romOfs[g.Name] && !cloneOfs[g.Name] && g.CloneOf == "" && g.RomOf == ""
+	}
+}
+
+// MergeDats returns a normalized dat with the games of all dats. Games of the
+// same name are merged into one with the roms and disks of all of them; the
+// first one seen gives the description and parent. The header is that of the
+// first dat. The dats are left as they are.
+func MergeDats(dats []*Dat) *Dat {
+	nd := new(Dat)
+	if len(dats) > 0 {
+		nd = dats[0].Header()
+	}
+
+	byName := make(map[string]*Game)
+	for _, d := range dats {
+		for _, games := range d.gameLists() {
+			for _, g := range games {
+				mg, ok := byName[g.Name]
+				if !ok {
+					mg = &Game{
+						Name:        g.Name,
+						Description: g.Description,
+						CloneOf:     g.CloneOf,
+						RomOf:       g.RomOf,
+						SampleOf:    g.SampleOf,
+					}
+					byName[g.Name] = mg
+					nd.Games = append(nd.Games, mg)
+				}
+				mg.merge(g)
+			}
+		}
+	}
+
+	nd.Normalize()
+	return nd
+}
+
+// merge adds the roms and disks of g to mg, which is normalized later.
+func (mg *Game) merge(g *Game) {
+	for _, roms := range []RomSlice{g.Roms, g.Parts, g.Regions} {
+		mg.Roms = append(mg.Roms, roms...)
+	}
+	for _, disks := range []DiskSlice{g.Disks, g.PartDisks} {
+		mg.Disks = append(mg.Disks, disks...)
+	}
+}
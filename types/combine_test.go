@@ -0,0 +1,114 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	dat := setsTestDat()
+
+	noBios := dat.Filter(Not(dat.BiosSets()))
+	if len(noBios.Games) != 2 || noBios.Games[0].Name != "clone" || noBios.Games[1].Name != "parent" {
+		t.Errorf("got games %v without BIOS sets", noBios.Games)
+	}
+	if len(dat.Games) != 3 {
+		t.Errorf("filtering changed the dat")
+	}
+
+	parents := dat.Filter(NameMatches(regexp.MustCompile("^par")))
+	if len(parents.Games) != 1 || parents.Games[0] != dat.Games[2] {
+		t.Errorf("got games %v matching ^par", parents.Games)
+	}
+}
+
+func TestRegionAndCategoryFilters(t *testing.T) {
+	dat := &Dat{
+		Games: GameSlice{
+			&Game{Name: "a (USA, Europe)", Category: "Games"},
+			&Game{Name: "b (Japan)", Category: "Games"},
+			&Game{Name: "c (Europe) (Demo)", Category: "Demos"},
+		},
+	}
+
+	europe := dat.Filter(InRegions([]string{"europe"}))
+	if len(europe.Games) != 2 || europe.Games[0].Name != "a (USA, Europe)" || europe.Games[1].Name != "c (Europe) (Demo)" {
+		t.Errorf("got games %v in Europe", europe.Games)
+	}
+
+	games := dat.Filter(InCategories([]string{"games", "Applications"}))
+	if len(games.Games) != 2 || games.Games[1].Name != "b (Japan)" {
+		t.Errorf("got games %v of category Games", games.Games)
+	}
+}
+
+func TestMergeDats(t *testing.T) {
+	usa := &Dat{
+		Name: "usa",
+		Games: GameSlice{
+			&Game{Name: "b (USA)", Roms: RomSlice{setsTestRom("b.bin", 1)}},
+			&Game{Name: "shared", Description: "from usa", Roms: RomSlice{setsTestRom("s1.bin", 2)}},
+		},
+	}
+	europe := &Dat{
+		Name: "europe",
+		Games: GameSlice{
+			&Game{Name: "a (Europe)", Roms: RomSlice{setsTestRom("a.bin", 3)}},
+		},
+		Software: GameSlice{
+			&Game{Name: "shared", Description: "from europe", Roms: RomSlice{
+				setsTestRom("s1.bin", 2),
+				setsTestRom("s2.bin", 4),
+			}},
+		},
+	}
+
+	merged := MergeDats([]*Dat{usa, europe})
+	if merged.Name != "usa" {
+		t.Errorf("got name %q, want usa", merged.Name)
+	}
+	if len(merged.Games) != 3 || merged.Games[0].Name != "a (Europe)" {
+		t.Fatalf("got games %v", merged.Games)
+	}
+
+	shared := merged.Games[2]
+	if shared.Description != "from usa" {
+		t.Errorf("got description %q, want the first one", shared.Description)
+	}
+	if got := romNames(merged, "shared"); got != "s1.bin s2.bin" {
+		t.Errorf("got roms %q in shared", got)
+	}
+
+	if len(usa.Games[1].Roms) != 1 || len(europe.Software) != 1 {
+		t.Errorf("merging changed the dats")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"fmt"
+)
+
+// Tally counts roms and their bytes.
+type Tally struct {
+	Roms  int   `json:"roms"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (t *Tally) add(r *Rom) {
+	t.Roms++
+	t.Bytes += r.Size
+}
+
+func (t *Tally) addTally(o Tally) {
+	t.Roms += o.Roms
+	t.Bytes += o.Bytes
+}
+
+// GameCompleteness is how much of a game is present. Roms without a dump
+// count neither as present nor as missing.
+type GameCompleteness struct {
+	Name    string `json:"name"`
+	Have    Tally  `json:"have"`
+	Missing Tally  `json:"missing"`
+}
+
+// Total is what there is of the game, present or missing.
+func (gc *GameCompleteness) Total() Tally {
+	t := gc.Have
+	t.addTally(gc.Missing)
+	return t
+}
+
+// Complete reports whether nothing of the game is missing.
+func (gc *GameCompleteness) Complete() bool {
+	return gc.Missing.Roms == 0
+}
+
+// Completeness is how much of a dat is present, game by game.
+type Completeness struct {
+	Name    string              `json:"name"`
+	Games   []*GameCompleteness `json:"games"`
+	Have    Tally               `json:"have"`
+	Missing Tally               `json:"missing"`
+	// CompleteGames counts the games nothing is missing of.
+	CompleteGames int `json:"completegames"`
+}
+
+// Total is what there is of the dat, present or missing.
+func (c *Completeness) Total() Tally {
+	t := c.Have
+	t.addTally(c.Missing)
+	return t
+}
+
+// Complete reports whether nothing of the dat is missing.
+func (c *Completeness) Complete() bool {
+	return c.Missing.Roms == 0
+}
+
+func (c *Completeness) String() string {
+	return fmt.Sprintf("%s: %d of %d games complete, %d of %d roms present, %d missing (%d bytes)",
+		c.Name, c.CompleteGames, len(c.Games), c.Have.Roms, c.Total().Roms, c.Missing.Roms, c.Missing.Bytes)
+}
+
+// GameCompletenessOf counts the roms and disks of g have reports present and
+// those it doesn't.
+func GameCompletenessOf(g *Game, have func(*Rom) bool) *GameCompleteness {
+	gc := &GameCompleteness{Name: g.Name}
+	for _, r := range g.AllRoms() {
+		switch {
+		case r.NoDump():
+		case have(r):
+			gc.Have.add(r)
+		default:
+			gc.Missing.add(r)
+		}
+	}
+	return gc
+}
+
+// CompletenessOf counts the roms and disks of d have reports present and those
+// it doesn't, game by game and in total.
+func CompletenessOf(d *Dat, have func(*Rom) bool) *Completeness {
+	c := &Completeness{Name: d.Name}
+	for _, games := range d.gameLists() {
+		for _, g := range games {
+			gc := GameCompletenessOf(g, have)
+			c.Games = append(c.Games, gc)
+			c.Have.addTally(gc.Have)
+			c.Missing.addTally(gc.Missing)
+			if gc.Complete() {
+				c.CompleteGames++
+			}
+		}
+	}
+	return c
+}
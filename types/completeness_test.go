@@ -0,0 +1,66 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"testing"
+)
+
+func TestCompleteness(t *testing.T) {
+	dat := csvTestDat()
+	have := func(r *Rom) bool { return r.Name == "a.bin" || r.Name == "disk" }
+
+	c := CompletenessOf(dat, have)
+	if len(c.Games) != 2 {
+		t.Fatalf("got %d games", len(c.Games))
+	}
+
+	one, two := c.Games[0], c.Games[1]
+	if !one.Complete() || one.Have != (Tally{1, 4}) || one.Total() != (Tally{1, 4}) {
+		t.Errorf("got %+v for game with a nodump rom", one)
+	}
+	if two.Complete() || two.Have != (Tally{1, 0}) || two.Missing != (Tally{1, 2}) {
+		t.Errorf("got %+v for incomplete game", two)
+	}
+
+	if c.Complete() || c.CompleteGames != 1 || c.Have != (Tally{2, 4}) || c.Missing != (Tally{1, 2}) ||
+		c.Total() != (Tally{3, 6}) {
+		t.Errorf("got %s", c)
+	}
+
+	// the same roms as the have and miss lists
+	haveDat, missDat := HaveMiss(dat, have)
+	if hc := CompletenessOf(haveDat, have); hc.Have != c.Have || !hc.Complete() {
+		t.Errorf("have list counts %s", hc)
+	}
+	if mc := CompletenessOf(missDat, have); mc.Missing != c.Missing || mc.Have.Roms != 0 {
+		t.Errorf("miss list counts %s", mc)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"strconv"
+)
+
+// Separators for CSVWriter.
+const (
+	CSV = ','
+	TSV = '\t'
+)
+
+var csvHeader = []string{"game", "rom", "size", "crc", "md5", "sha1", "status"}
+
+// CSVWriter writes one row per rom and disk of the games given to it, after a
+// header row naming the columns: game, rom, size, crc, md5, sha1 and status.
+// Once Annotate was called, a have column tells whether the rom is present.
+type CSVWriter struct {
+	cw            *csv.Writer
+	have          func(*Rom) bool
+	headerWritten bool
+}
+
+// NewCSVWriter returns a writer separating columns with comma, CSV or TSV
+// usually.
+func NewCSVWriter(w io.Writer, comma rune) *CSVWriter {
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	return &CSVWriter{cw: cw}
+}
+
+// Annotate adds a have column, yes or no as have reports for each rom. It has
+// to be called before the first game is written.
+func (w *CSVWriter) Annotate(have func(*Rom) bool) {
+	w.have = have
+}
+
+func (w *CSVWriter) WriteGame(g *Game) error {
+	if !w.headerWritten {
+		header := csvHeader
+		if w.have != nil {
+			header = append(header[:len(header):len(header)], "have")
+		}
+		if err := w.cw.Write(header); err != nil {
+			return err
+		}
+		w.headerWritten = true
+	}
+
+	for _, r := range g.AllRoms() {
+		status := r.Status
+		if status == "" {
+			status = StatusGood
+		}
+
+		row := []string{
+			g.Name,
+			r.Name,
+			strconv.FormatInt(r.Size, 10),
+			hex.EncodeToString(r.Crc),
+			hex.EncodeToString(r.Md5),
+			hex.EncodeToString(r.Sha1),
+			status,
+		}
+		if w.have != nil {
+			have := "no"
+			if w.have(r) {
+				have = "yes"
+			}
+			row = append(row, have)
+		}
+
+		if err := w.cw.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes out buffered rows.
+func (w *CSVWriter) Flush() error {
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+// ComposeDatCSV writes the roms of d with columns separated by comma.
+func ComposeDatCSV(d *Dat, w io.Writer, comma rune) error {
+	return composeCSV(d, NewCSVWriter(w, comma))
+}
+
+// ComposeAnnotatedCSV writes the roms of d like ComposeDatCSV with a have
+// column added.
+func ComposeAnnotatedCSV(d *Dat, w io.Writer, comma rune, have func(*Rom) bool) error {
+	cw := NewCSVWriter(w, comma)
+	cw.Annotate(have)
+	return composeCSV(d, cw)
+}
+
+func composeCSV(d *Dat, cw *CSVWriter) error {
+	for _, games := range d.gameLists() {
+		for _, g := range games {
+			if err := cw.WriteGame(g); err != nil {
+				return err
+			}
+		}
+	}
+	return cw.Flush()
+}
+
+// HaveMiss splits d into a dat of the roms and disks have reports present and
+// one of those missing, leaving out games with nothing in them. Roms without a
+// dump are in neither, as in Completeness. Disks end up as roms. Write them out with
+// ComposeDatCSV for have and miss lists.
+func HaveMiss(d *Dat, have func(*Rom) bool) (haveDat, missDat *Dat) {
+	var haves, misses GameSlice
+
+	for _, games := range d.gameLists() {
+		for _, g := range games {
+			var hr, mr RomSlice
+			for _, r := range g.AllRoms() {
+				switch {
+				case r.NoDump():
+				case have(r):
+					hr = append(hr, r)
+				default:
+					mr = append(mr, r)
+				}
+			}
+
+			if len(hr) > 0 {
+				hg := g.withRoms(hr)
+				hg.Disks = nil
+				haves = append(haves, hg)
+			}
+			if len(mr) > 0 {
+				mg := g.withRoms(mr)
+				mg.Disks = nil
+				misses = append(misses, mg)
+			}
+		}
+	}
+
+	return d.withGames(haves), d.withGames(misses)
+}
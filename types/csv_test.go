@@ -0,0 +1,101 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func csvTestDat() *Dat {
+	return &Dat{
+		Name: "csv",
+		Games: GameSlice{
+			&Game{Name: "game, one", Roms: RomSlice{
+				&Rom{Name: "a.bin", Size: 4, Crc: []byte{1, 2, 3, 4}, Sha1: []byte{0xab}},
+				&Rom{Name: "b.bin", Size: 8, Status: StatusNoDump},
+			}},
+			&Game{Name: "two", Roms: RomSlice{
+				&Rom{Name: "c.bin", Size: 2, Md5: []byte{0xcd}, Status: StatusBadDump},
+			}, Disks: DiskSlice{
+				&Disk{Name: "disk", Sha1: []byte{0xef}},
+			}},
+		},
+	}
+}
+
+func TestComposeDatCSV(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := ComposeDatCSV(csvTestDat(), buf, CSV); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `game,rom,size,crc,md5,sha1,status
+"game, one",a.bin,4,01020304,,ab,good
+"game, one",b.bin,8,,,,nodump
+two,c.bin,2,,cd,,baddump
+two,disk,0,,,ef,good
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	have := func(r *Rom) bool { return r.Name == "c.bin" }
+	if err := ComposeAnnotatedCSV(csvTestDat(), buf, TSV, have); err != nil {
+		t.Fatal(err)
+	}
+
+	want = "game\trom\tsize\tcrc\tmd5\tsha1\tstatus\thave\n" +
+		"game, one\ta.bin\t4\t01020304\t\tab\tgood\tno\n" +
+		"game, one\tb.bin\t8\t\t\t\tnodump\tno\n" +
+		"two\tc.bin\t2\t\tcd\t\tbaddump\tyes\n" +
+		"two\tdisk\t0\t\t\tef\tgood\tno\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestHaveMiss(t *testing.T) {
+	dat := csvTestDat()
+
+	haveDat, missDat := HaveMiss(dat, func(r *Rom) bool { return r.Name == "c.bin" })
+
+	if len(haveDat.Games) != 1 || romNames(haveDat, "two") != "c.bin" {
+		t.Errorf("got have games %v", haveDat.Games)
+	}
+	if len(missDat.Games) != 2 || romNames(missDat, "game, one") != "a.bin" ||
+		romNames(missDat, "two") != "disk" || len(missDat.Games[1].Disks) != 0 {
+		t.Errorf("got miss games %v", missDat.Games)
+	}
+	if len(dat.Games[1].Disks) != 1 {
+		t.Errorf("splitting changed the dat")
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// dedupRom is what a Dedup knows of a rom, by its key: the dats referencing
+// it, the first of them and whether all are in one tree.
+type dedupRom struct {
+	name      string
+	size      int64
+	dats      int32
+	owner     int32
+	tree      int32
+	manyTrees bool
+}
+
+// Dedup works out how much the dats added to it share their roms. Roms are
+// told apart by SHA1, or by CRC and size for roms without one the complete
+// function of the Dedup doesn't find. It is safe for concurrent use.
+type Dedup struct {
+	complete func(r *Rom) error
+
+	mutex sync.Mutex
+	roms  map[string]*dedupRom
+	dats  []*DatDedup
+	trees []*DatDedup
+	// treeIDs are the indexes of trees by name
+	treeIDs map[string]int32
+}
+
+// DatDedup is how much of a dat, or of a tree of dats, is its own.
+type DatDedup struct {
+	// Name is the name of the dat or of the tree, Path the path of the dat.
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+	// Roms and Bytes count the different roms of the dat and their sizes.
+	Roms  int   `json:"roms"`
+	Bytes int64 `json:"bytes"`
+	// MarginalRoms and MarginalBytes count the roms no other dat, or dat of
+	// another tree, has: what the depot holds for the dat alone.
+	MarginalRoms  int   `json:"marginalRoms"`
+	MarginalBytes int64 `json:"marginalBytes"`
+}
+
+// SharedRom is a rom referenced by several dats.
+type SharedRom struct {
+	// Name is the name of the rom in the first dat seen with it.
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	Dats int    `json:"dats"`
+}
+
+// DedupReport sums up a Dedup.
+type DedupReport struct {
+	// Roms and Bytes count the different roms of all dats, RefBytes the
+	// bytes of the roms of each dat summed up over the dats.
+	Roms     int   `json:"roms"`
+	Bytes    int64 `json:"bytes"`
+	RefBytes int64 `json:"refBytes"`
+	// Dats and Trees are ordered by marginal bytes, most first.
+	Dats  []*DatDedup `json:"dats"`
+	Trees []*DatDedup `json:"trees,omitempty"`
+	// Top are the roms referenced by the most dats.
+	Top []*SharedRom `json:"top"`
+}
+
+// NewDedup returns a Dedup without dats. complete fills in the SHA1 of roms
+// having only a CRC or MD5 if it knows it, like RomDB.CompleteRom, so that
+// they are told apart by SHA1 like the roms of other dats. Roms are taken as
+// they are if it is nil.
+func NewDedup(complete func(r *Rom) error) *Dedup {
+	return &Dedup{
+		complete: complete,
+		roms:     make(map[string]*dedupRom),
+		treeIDs:  make(map[string]int32),
+	}
+}
+
+// dedupKey returns the key telling roms apart, empty for roms without SHA1
+// or CRC.
+func dedupKey(r *Rom) string {
+	switch {
+	case r.Sha1 != nil:
+		return "sha1:" + hex.EncodeToString(r.Sha1)
+	case r.Crc != nil:
+		return fmt.Sprintf("crc:%s-%d", hex.EncodeToString(r.Crc), r.Size)
+	}
+	return ""
+}
+
+// Add adds the roms of d, which is part of the tree of dats named tree.
+func (dd *Dedup) Add(d *Dat, tree string) error {
+	// the roms of d, counted once
+	own := make(map[string]*Rom)
+	for _, g := range d.Games {
+		for _, r := range g.AllRoms() {
+			if r.NoDump() {
+				continue
+			}
+			if r.Sha1 == nil && dd.complete != nil {
+				// completed on a copy, d keeps its roms
+				c := *r
+				err := dd.complete(&c)
+				if err != nil {
+					return err
+				}
+				r = &c
+			}
+			if key := dedupKey(r); key != "" && own[key] == nil {
+				own[key] = r
+			}
+		}
+	}
+
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	id := int32(len(dd.dats))
+	dat := &DatDedup{Name: d.Name, Path: d.Path}
+	dd.dats = append(dd.dats, dat)
+
+	treeID, ok := dd.treeIDs[tree]
+	if !ok {
+		treeID = int32(len(dd.trees))
+		dd.trees = append(dd.trees, &DatDedup{Name: tree})
+		dd.treeIDs[tree] = treeID
+	}
+
+	for key, r := range own {
+		dat.Roms++
+		dat.Bytes += r.Size
+
+		dr := dd.roms[key]
+		if dr == nil {
+			dd.roms[key] = &dedupRom{
+				name:  r.Name,
+				size:  r.Size,
+				dats:  1,
+				owner: id,
+				tree:  treeID,
+			}
+			continue
+		}
+		dr.dats++
+		if dr.tree != treeID {
+			dr.manyTrees = true
+		}
+	}
+	return nil
+}
+
+// Report returns the report of the dats added so far, with the top roms
+// referenced by the most dats.
+func (dd *Dedup) Report(top int) *DedupReport {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	dats := make([]*DatDedup, len(dd.dats))
+	for i, dat := range dd.dats {
+		c := *dat
+		dats[i] = &c
+	}
+	trees := make([]*DatDedup, len(dd.trees))
+	for i, tree := range dd.trees {
+		trees[i] = &DatDedup{Name: tree.Name}
+	}
+
+	report := &DedupReport{
+		Dats:  dats,
+		Trees: trees,
+	}
+
+	var shared []*SharedRom
+	for key, dr := range dd.roms {
+		report.Roms++
+		report.Bytes += dr.size
+		report.RefBytes += dr.size * int64(dr.dats)
+
+		if dr.dats == 1 {
+			dats[dr.owner].MarginalRoms++
+			dats[dr.owner].MarginalBytes += dr.size
+		} else {
+			shared = append(shared, &SharedRom{Name: dr.name, Key: key, Size: dr.size, Dats: int(dr.dats)})
+		}
+
+		tree := trees[dr.tree]
+		tree.Roms++
+		tree.Bytes += dr.size
+		if !dr.manyTrees {
+			tree.MarginalRoms++
+			tree.MarginalBytes += dr.size
+		}
+	}
+
+	sortDatDedups(report.Dats)
+	sortDatDedups(report.Trees)
+
+	sort.Slice(shared, func(i, j int) bool {
+		a, b := shared[i], shared[j]
+		if a.Dats != b.Dats {
+			return a.Dats > b.Dats
+		}
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.Key < b.Key
+	})
+	if len(shared) > top {
+		shared = shared[:top]
+	}
+	report.Top = shared
+	return report
+}
+
+func sortDatDedups(dds []*DatDedup) {
+	sort.Slice(dds, func(i, j int) bool {
+		a, b := dds[i], dds[j]
+		if a.MarginalBytes != b.MarginalBytes {
+			return a.MarginalBytes > b.MarginalBytes
+		}
+		return a.Path+a.Name < b.Path+b.Name
+	})
+}
+
+func (dr *DedupReport) String() string {
+	return fmt.Sprintf("%d dats reference %d different roms, %s, %s counting each dat",
+		len(dr.Dats), dr.Roms, humanize.Bytes(uint64(dr.Bytes)), humanize.Bytes(uint64(dr.RefBytes)))
+}
+
+// WriteText writes dr as text, the trees and dats with how many of their
+// bytes are their own followed by the most shared roms.
+func (dr *DedupReport) WriteText(w io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "%v\n", dr)
+
+	for _, section := range []struct {
+		title string
+		dds   []*DatDedup
+	}{
+		{"trees", dr.Trees},
+		{"dats", dr.Dats},
+	} {
+		fmt.Fprintf(buf, "\n%s by marginal size:\n", section.title)
+		for _, dd := range section.dds {
+			name := dd.Name
+			if dd.Path != "" {
+				name = dd.Path
+			}
+			fmt.Fprintf(buf, "%s\t%d roms, %s\tmarginal %d roms, %s\n", name,
+				dd.Roms, humanize.Bytes(uint64(dd.Bytes)), dd.MarginalRoms, humanize.Bytes(uint64(dd.MarginalBytes)))
+		}
+	}
+
+	fmt.Fprintf(buf, "\nmost shared roms:\n")
+	for _, sr := range dr.Top {
+		fmt.Fprintf(buf, "%s\t%s\t%s\tin %d dats\n", sr.Key, sr.Name, humanize.Bytes(uint64(sr.Size)), sr.Dats)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteJSON writes dr as JSON.
+func (dr *DedupReport) WriteJSON(w io.Writer) error {
+	return newJSONEncoder(w).Encode(dr)
+}
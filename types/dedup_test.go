@@ -0,0 +1,120 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	rom := func(name string, sha1 byte, size int64) *Rom {
+		return &Rom{Name: name, Size: size, Sha1: []byte{sha1}}
+	}
+
+	// the CRC only rom of b is the rom of c with SHA1 3
+	crcOnly := &Rom{Name: "tree", Size: 20, Crc: []byte{9}}
+	dd := NewDedup(func(r *Rom) error {
+		if bytes.Equal(r.Crc, crcOnly.Crc) {
+			r.Sha1 = []byte{3}
+		}
+		return nil
+	})
+	dd.Add(&Dat{Name: "a", Path: "tosec/a.dat", Games: GameSlice{
+		{Name: "g1", Roms: RomSlice{rom("shared", 1, 100), rom("own", 2, 10)}},
+		{Name: "g2", Roms: RomSlice{rom("shared again", 1, 100), {Name: "bad", Size: 5, Status: "nodump"}}},
+	}}, "tosec")
+	dd.Add(&Dat{Name: "b", Path: "tosec/b.dat", Games: GameSlice{
+		{Name: "g", Roms: RomSlice{rom("shared", 1, 100), crcOnly}},
+	}}, "tosec")
+	if crcOnly.Sha1 != nil {
+		t.Errorf("adding dat b completed its rom")
+	}
+	dd.Add(&Dat{Name: "c", Path: "nointro/c.dat", Games: GameSlice{
+		{Name: "g", Roms: RomSlice{rom("shared", 1, 100), rom("tree", 3, 20), rom("big", 4, 1000)}},
+	}}, "nointro")
+
+	report := dd.Report(1)
+
+	if report.Roms != 4 || report.Bytes != 1130 || report.RefBytes != 1350 {
+		t.Errorf("got %d roms, %d bytes, %d referenced, want 4, 1130, 1350",
+			report.Roms, report.Bytes, report.RefBytes)
+	}
+
+	for i, want := range []struct {
+		name          string
+		roms          int
+		bytes         int64
+		marginalBytes int64
+	}{
+		{"c", 3, 1120, 1000},
+		{"a", 2, 110, 10},
+		{"b", 2, 120, 0},
+	} {
+		got := report.Dats[i]
+		if got.Name != want.name || got.Roms != want.roms || got.Bytes != want.bytes ||
+			got.MarginalBytes != want.marginalBytes {
+			t.Errorf("dat %d is %+v, want %+v", i, got, want)
+		}
+	}
+
+	for i, want := range []struct {
+		name          string
+		marginalBytes int64
+	}{
+		{"nointro", 1000},
+		{"tosec", 10},
+	} {
+		got := report.Trees[i]
+		if got.Name != want.name || got.MarginalBytes != want.marginalBytes {
+			t.Errorf("tree %d is %+v, want %+v", i, got, want)
+		}
+	}
+
+	if len(report.Top) != 1 || report.Top[0].Name != "shared" || report.Top[0].Dats != 3 {
+		t.Fatalf("got top roms %+v, want shared in 3 dats", report.Top)
+	}
+
+	buf := new(bytes.Buffer)
+	err := report.WriteJSON(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := new(DedupReport)
+	err = json.Unmarshal(buf.Bytes(), rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.RefBytes != report.RefBytes || len(rr.Dats) != 3 {
+		t.Errorf("got %+v back from JSON, want %+v", rr, report)
+	}
+}
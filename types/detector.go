@@ -0,0 +1,206 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"bytes"
+)
+
+// Detector recognizes roms that carry a copier or emulator header in front of
+// the actual rom data, in the manner of clrmamepro header skipper definitions.
+// Dats like No-Intro's list the hashes of the data without the header.
+type Detector struct {
+	Name    string
+	Author  string
+	Version string
+	Rules   []*DetectorRule
+}
+
+// DetectorRule describes one header format. It applies if all its tests pass,
+// the rom data is then the range from StartOffset to EndOffset with Operation
+// applied to it.
+type DetectorRule struct {
+	StartOffset int64
+	// EndOffset is -1 for the end of the file
+	EndOffset int64
+	Operation string
+	Tests     []*DetectorTest
+}
+
+// Detector rule operations
+const (
+	OpNone         = "none"
+	OpBitSwap      = "bitswap"
+	OpByteSwap     = "byteswap"
+	OpWordSwap     = "wordswap"
+	OpWordByteSwap = "wordbyteswap"
+)
+
+// DetectorTest is a single check of a rule. Data tests compare the bytes at
+// Offset with Value, and, or and xor tests combine them with Mask first. File
+// tests compare the file size with Size using Operator ("equal", "less" or
+// "greater"), a Size of -1 stands for "is a power of two". A test passes if
+// the comparison comes out as Result.
+type DetectorTest struct {
+	Kind     string
+	Offset   int64
+	Value    []byte
+	Mask     []byte
+	Size     int64
+	Operator string
+	Result   bool
+}
+
+// Detector test kinds
+const (
+	TestData = "data"
+	TestOr   = "or"
+	TestAnd  = "and"
+	TestXor  = "xor"
+	TestFile = "file"
+)
+
+// HeaderLen returns the number of bytes from the start of a file the detector
+// needs to look at to match it.
+func (d *Detector) HeaderLen() int {
+	n := 0
+	for _, r := range d.Rules {
+		for _, t := range r.Tests {
+			if l := int(t.Offset) + len(t.Value); l > n {
+				n = l
+			}
+		}
+	}
+	return n
+}
+
+// Match returns the first rule matching a file of the given size starting
+// with header, or nil if none does.
+func (d *Detector) Match(header []byte, size int64) *DetectorRule {
+	for _, r := range d.Rules {
+		if r.Match(header, size) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Match reports whether all tests of the rule pass.
+func (r *DetectorRule) Match(header []byte, size int64) bool {
+	for _, t := range r.Tests {
+		if t.Match(header, size) != t.Result {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether the comparison of the test holds, regardless of the
+// expected Result.
+func (t *DetectorTest) Match(header []byte, size int64) bool {
+	if t.Kind == TestFile {
+		switch {
+		case t.Size == -1:
+			return size > 0 && size&(size-1) == 0
+		case t.Operator == "less":
+			return size < t.Size
+		case t.Operator == "greater":
+			return size > t.Size
+		default:
+			return size == t.Size
+		}
+	}
+
+	end := t.Offset + int64(len(t.Value))
+	if t.Offset < 0 || end > int64(len(header)) {
+		return false
+	}
+	data := header[t.Offset:end]
+
+	if t.Kind == TestData || len(t.Mask) != len(t.Value) {
+		return bytes.Equal(data, t.Value)
+	}
+
+	for i, b := range data {
+		switch t.Kind {
+		case TestOr:
+			b |= t.Mask[i]
+		case TestAnd:
+			b &= t.Mask[i]
+		case TestXor:
+			b ^= t.Mask[i]
+		}
+		if b != t.Value[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply returns the rom data of a file with contents data, i.e. data without
+// the header and with the rule's operation applied. data is left untouched.
+func (r *DetectorRule) Apply(data []byte) []byte {
+	start := r.StartOffset
+	end := r.EndOffset
+	if end < 0 || end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	if start > end {
+		start = end
+	}
+
+	out := make([]byte, end-start)
+	copy(out, data[start:end])
+
+	switch r.Operation {
+	case OpBitSwap:
+		for i, b := range out {
+			var rb byte
+			for k := uint(0); k < 8; k++ {
+				rb |= ((b >> k) & 1) << (7 - k)
+			}
+			out[i] = rb
+		}
+	case OpByteSwap:
+		for i := 0; i+1 < len(out); i += 2 {
+			out[i], out[i+1] = out[i+1], out[i]
+		}
+	case OpWordSwap:
+		for i := 0; i+3 < len(out); i += 4 {
+			out[i], out[i+1], out[i+2], out[i+3] = out[i+3], out[i+2], out[i+1], out[i]
+		}
+	case OpWordByteSwap:
+		for i := 0; i+3 < len(out); i += 4 {
+			out[i], out[i+1], out[i+2], out[i+3] = out[i+2], out[i+3], out[i], out[i+1]
+		}
+	}
+	return out
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DatDiff is what changed between an old and a new release of a dat. Roms and
+// disks are compared together, disks as roms.
+type DatDiff struct {
+	// Added are the games only in the new dat.
+	Added GameSlice `json:"added,omitempty"`
+	// Removed are the games only in the old dat.
+	Removed GameSlice `json:"removed,omitempty"`
+	// Changed are the games in both dats whose roms differ.
+	Changed []*GameDiff `json:"changed,omitempty"`
+}
+
+// GameDiff is what changed in a game found in both dats.
+type GameDiff struct {
+	Old     *Game        `json:"-"`
+	New     *Game        `json:"-"`
+	Name    string       `json:"name"`
+	Added   RomSlice     `json:"added,omitempty"`
+	Removed RomSlice     `json:"removed,omitempty"`
+	Changed []*RomChange `json:"changed,omitempty"`
+}
+
+// RomChange is a rom whose name stayed but whose size or hashes changed.
+type RomChange struct {
+	Old *Rom `json:"old"`
+	New *Rom `json:"new"`
+}
+
+// Empty reports whether the dats have the same games and roms.
+func (dd *DatDiff) Empty() bool {
+	return len(dd.Added) == 0 && len(dd.Removed) == 0 && len(dd.Changed) == 0
+}
+
+// DiffDats compares two normalized dats game by game and, within games that
+// are in both, rom by rom.
+func DiffDats(old, nw *Dat) *DatDiff {
+	dd := &DatDiff{}
+
+	oldGames := make(map[string]*Game, len(old.Games))
+	for _, g := range old.Games {
+		oldGames[g.Name] = g
+	}
+
+	for _, ng := range nw.Games {
+		og, ok := oldGames[ng.Name]
+		if !ok {
+			dd.Added = append(dd.Added, ng)
+			continue
+		}
+		delete(oldGames, ng.Name)
+
+		if gd := diffGames(og, ng); gd != nil {
+			dd.Changed = append(dd.Changed, gd)
+		}
+	}
+
+	for _, og := range old.Games {
+		if _, ok := oldGames[og.Name]; ok {
+			dd.Removed = append(dd.Removed, og)
+		}
+	}
+	return dd
+}
+
+func diffGames(og, ng *Game) *GameDiff {
+	oldRoms := make(map[string]RomSlice)
+	for _, r := range og.AllRoms() {
+		oldRoms[r.Name] = append(oldRoms[r.Name], r)
+	}
+
+	gd := &GameDiff{Old: og, New: ng, Name: ng.Name}
+
+	var unmatched RomSlice
+NewRoms:
+	for _, nr := range ng.AllRoms() {
+		olds := oldRoms[nr.Name]
+		for i, or := range olds {
+			if or.Equals(nr) {
+				oldRoms[nr.Name] = append(olds[:i], olds[i+1:]...)
+				continue NewRoms
+			}
+		}
+		unmatched = append(unmatched, nr)
+	}
+
+	// what is left over under the same name changed
+	for _, nr := range unmatched {
+		olds := oldRoms[nr.Name]
+		if len(olds) == 0 {
+			gd.Added = append(gd.Added, nr)
+			continue
+		}
+		gd.Changed = append(gd.Changed, &RomChange{Old: olds[0], New: nr})
+		oldRoms[nr.Name] = olds[1:]
+	}
+
+	for _, or := range og.AllRoms() {
+		for _, r := range oldRoms[or.Name] {
+			if r == or {
+				gd.Removed = append(gd.Removed, or)
+				break
+			}
+		}
+	}
+
+	if len(gd.Added) == 0 && len(gd.Removed) == 0 && len(gd.Changed) == 0 {
+		return nil
+	}
+	return gd
+}
+
+// Dat returns a dat with the header of d and what is in the new dat but not
+// in the old one: the added games and, of the changed games, the added and
+// changed roms (disks included).
+func (dd *DatDiff) Dat(d *Dat) *Dat {
+	nd := d.Header()
+
+	nd.Games = append(nd.Games, dd.Added...)
+	for _, gd := range dd.Changed {
+		roms := append(RomSlice(nil), gd.Added...)
+		for _, rc := range gd.Changed {
+			roms = append(roms, rc.New)
+		}
+		if len(roms) > 0 {
+			g := gd.New.withRoms(roms)
+			g.Disks = nil
+			nd.Games = append(nd.Games, g)
+		}
+	}
+
+	nd.Normalize()
+	return nd
+}
+
+// WriteText writes dd in a line oriented form, + for added, - for removed and
+// ~ for changed games and roms.
+func (dd *DatDiff) WriteText(w io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	for _, g := range dd.Added {
+		fmt.Fprintf(buf, "+ game %s\n", g.Name)
+	}
+	for _, g := range dd.Removed {
+		fmt.Fprintf(buf, "- game %s\n", g.Name)
+	}
+	for _, gd := range dd.Changed {
+		fmt.Fprintf(buf, "~ game %s\n", gd.Name)
+		for _, r := range gd.Added {
+			fmt.Fprintf(buf, "\t+ rom %s (%s)\n", r.Name, romSummary(r))
+		}
+		for _, r := range gd.Removed {
+			fmt.Fprintf(buf, "\t- rom %s (%s)\n", r.Name, romSummary(r))
+		}
+		for _, rc := range gd.Changed {
+			fmt.Fprintf(buf, "\t~ rom %s: %s\n", rc.New.Name, rc.changes())
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteJSON writes dd as a JSON object.
+func (dd *DatDiff) WriteJSON(w io.Writer) error {
+	return newJSONEncoder(w).Encode(dd)
+}
+
+func romSummary(r *Rom) string {
+	parts := []string{fmt.Sprintf("size %d", r.Size)}
+	for _, h := range romHashes(r) {
+		if h.value != nil {
+			parts = append(parts, h.name+" "+hex.EncodeToString(h.value))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+type namedHash struct {
+	name  string
+	value []byte
+}
+
+func romHashes(r *Rom) []namedHash {
+	return []namedHash{
+		{"crc", r.Crc},
+		{"md5", r.Md5},
+		{"sha1", r.Sha1},
+		{"sha256", r.Sha256},
+		{"blake3", r.Blake3},
+	}
+}
+
+// changes lists the size and hashes that differ.
+func (rc *RomChange) changes() string {
+	var parts []string
+	if rc.Old.Size != rc.New.Size {
+		parts = append(parts, fmt.Sprintf("size %d -> %d", rc.Old.Size, rc.New.Size))
+	}
+
+	oh, nh := romHashes(rc.Old), romHashes(rc.New)
+	for i := range oh {
+		if !bytes.Equal(oh[i].value, nh[i].value) {
+			parts = append(parts, fmt.Sprintf("%s %s -> %s", oh[i].name,
+				hex.EncodeToString(oh[i].value), hex.EncodeToString(nh[i].value)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
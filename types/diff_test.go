@@ -0,0 +1,130 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDiffDats(t *testing.T) {
+	old := setsTestDat()
+	nw := setsTestDat()
+
+	// bios dropped, clone gets a fixed main.bin, parent loses common.bin and
+	// gains extra.bin, a new game shows up
+	nw.Games = GameSlice{
+		&Game{Name: "clone", CloneOf: "parent", RomOf: "parent", Roms: RomSlice{
+			setsTestRom("bios.bin", 1),
+			setsTestRom("common.bin", 2),
+			setsTestRom("main.bin", 6),
+			setsTestRom("sound.bin", 5),
+		}},
+		&Game{Name: "newgame", Roms: RomSlice{setsTestRom("new.bin", 7)}},
+		&Game{Name: "parent", RomOf: "bios", Roms: RomSlice{
+			setsTestRom("bios.bin", 1),
+			setsTestRom("extra.bin", 8),
+			setsTestRom("main.bin", 3),
+		}},
+	}
+
+	dd := DiffDats(old, nw)
+	if dd.Empty() {
+		t.Fatalf("expected a diff")
+	}
+
+	if len(dd.Added) != 1 || dd.Added[0].Name != "newgame" {
+		t.Errorf("got added games %v", dd.Added)
+	}
+	if len(dd.Removed) != 1 || dd.Removed[0].Name != "bios" {
+		t.Errorf("got removed games %v", dd.Removed)
+	}
+	if len(dd.Changed) != 2 {
+		t.Fatalf("got %d changed games, want 2", len(dd.Changed))
+	}
+
+	clone := dd.Changed[0]
+	if clone.Name != "clone" || len(clone.Changed) != 1 || len(clone.Added) != 0 || len(clone.Removed) != 0 {
+		t.Errorf("got clone diff %+v", clone)
+	}
+
+	parent := dd.Changed[1]
+	if parent.Name != "parent" || len(parent.Changed) != 0 ||
+		len(parent.Added) != 1 || parent.Added[0].Name != "extra.bin" ||
+		len(parent.Removed) != 1 || parent.Removed[0].Name != "common.bin" {
+		t.Errorf("got parent diff %+v", parent)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := dd.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"+ game newgame\n",
+		"- game bios\n",
+		"~ game clone\n",
+		"\t~ rom main.bin: crc 00000004 -> 00000006\n",
+		"\t+ rom extra.bin (size 1, crc 00000008)\n",
+		"\t- rom common.bin (size 1, crc 00000002)\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("text diff misses %q:\n%s", line, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := dd.WriteJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded DatDiff
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Changed) != 2 || !decoded.Changed[0].Changed[0].New.Equals(clone.Changed[0].New) {
+		t.Errorf("JSON diff did not round trip: %s", buf.String())
+	}
+
+	nd := dd.Dat(nw)
+	if got := romNames(nd, "clone"); got != "main.bin" {
+		t.Errorf("got %q in clone of new entries", got)
+	}
+	if got := romNames(nd, "newgame"); got != "new.bin" {
+		t.Errorf("got %q in newgame of new entries", got)
+	}
+	if got := romNames(nd, "bios"); got != "<missing>" {
+		t.Errorf("got %q in bios of new entries", got)
+	}
+
+	if !DiffDats(old, setsTestDat()).Empty() {
+		t.Errorf("expected no diff between equal dats")
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+)
+
+// Crc32, Md5Sum and Sha1Sum are the hashes of roms. They are plain byte
+// slices, nil when unknown, so they convert to and from []byte freely; the
+// Parse functions and Valid make sure they have the right length before they
+// end up as keys in the index or names in the depot.
+type (
+	Crc32   []byte
+	Md5Sum  []byte
+	Sha1Sum []byte
+)
+
+// parseHash decodes the hex encoded hash s of size bytes. An empty s is a
+// missing hash.
+func parseHash(kind, s string, size int) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", kind, s, err)
+	}
+	if len(bs) != size {
+		return nil, fmt.Errorf("invalid %s %q: %d bytes instead of %d", kind, s, len(bs), size)
+	}
+	return bs, nil
+}
+
+func ParseCrc32(s string) (Crc32, error) {
+	return parseHash("crc", s, crc32.Size)
+}
+
+func ParseMd5Sum(s string) (Md5Sum, error) {
+	return parseHash("md5", s, md5.Size)
+}
+
+func ParseSha1Sum(s string) (Sha1Sum, error) {
+	return parseHash("sha1", s, sha1.Size)
+}
+
+// Valid reports whether h is missing or has the length of a CRC32.
+func (h Crc32) Valid() bool { return h == nil || len(h) == crc32.Size }
+
+// Valid reports whether h is missing or has the length of an MD5.
+func (h Md5Sum) Valid() bool { return h == nil || len(h) == md5.Size }
+
+// Valid reports whether h is missing or has the length of a SHA1.
+func (h Sha1Sum) Valid() bool { return h == nil || len(h) == sha1.Size }
+
+// Hex returns h hex encoded, empty if h is missing.
+func (h Crc32) Hex() string   { return hex.EncodeToString(h) }
+func (h Md5Sum) Hex() string  { return hex.EncodeToString(h) }
+func (h Sha1Sum) Hex() string { return hex.EncodeToString(h) }
+
+func (h Crc32) Equal(o Crc32) bool     { return bytes.Equal(h, o) }
+func (h Md5Sum) Equal(o Md5Sum) bool   { return bytes.Equal(h, o) }
+func (h Sha1Sum) Equal(o Sha1Sum) bool { return bytes.Equal(h, o) }
+
+// ValidHashes reports an error if one of the hashes of r has the wrong length.
+func (r *Rom) ValidHashes() error {
+	switch {
+	case !r.Crc.Valid():
+		return fmt.Errorf("rom %s has a crc of %d bytes", r.Name, len(r.Crc))
+	case !r.Md5.Valid():
+		return fmt.Errorf("rom %s has an md5 of %d bytes", r.Name, len(r.Md5))
+	case !r.Sha1.Valid():
+		return fmt.Errorf("rom %s has a sha1 of %d bytes", r.Name, len(r.Sha1))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseHashes(t *testing.T) {
+	crc, err := ParseCrc32("C1E6AB10")
+	if err != nil || crc.Hex() != "c1e6ab10" || !crc.Valid() {
+		t.Errorf("got crc %s, %v", crc.Hex(), err)
+	}
+
+	for _, s := range []string{"c1e6ab", "c1e6ab1000", "c1e6ab1x"} {
+		if _, err := ParseCrc32(s); err == nil {
+			t.Errorf("crc %q accepted", s)
+		}
+	}
+
+	if md5, err := ParseMd5Sum(""); err != nil || md5 != nil || !md5.Valid() {
+		t.Errorf("got md5 %v, %v for empty string", md5, err)
+	}
+
+	sha1, err := ParseSha1Sum("e87e059c5be45753f7e9f33dff851f16d6751181")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sha1.Equal(Sha1Sum(append([]byte(nil), sha1...))) || sha1.Equal(sha1[1:]) {
+		t.Errorf("sha1 equality is off")
+	}
+
+	if _, err := ParseSha1Sum("e87e059c5be45753f7e9f33dff851f16d67511"); err == nil {
+		t.Errorf("short sha1 accepted")
+	}
+}
+
+func TestRomValidHashes(t *testing.T) {
+	rom := &Rom{Name: "a.bin", Crc: []byte{1, 2, 3, 4}}
+	if err := rom.ValidHashes(); err != nil {
+		t.Errorf("valid rom rejected: %v", err)
+	}
+
+	rom.Sha1 = []byte{1, 2, 3, 4}
+	if err := rom.ValidHashes(); err == nil {
+		t.Errorf("rom with short sha1 accepted")
+	}
+
+	err := json.Unmarshal([]byte(`{"name":"a.bin","size":1,"crc":"0102030405"}`), new(Rom))
+	if err == nil {
+		t.Errorf("JSON rom with long crc accepted")
+	}
+}
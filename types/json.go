@@ -0,0 +1,209 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// romJSON is the JSON form of a Rom, with hashes hex encoded like in dats.
+type romJSON struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Crc    string `json:"crc,omitempty"`
+	Md5    string `json:"md5,omitempty"`
+	Sha1   string `json:"sha1,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+	Blake3 string `json:"blake3,omitempty"`
+	Status string `json:"status,omitempty"`
+	Merge  string `json:"merge,omitempty"`
+	Bios   string `json:"bios,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+func (r *Rom) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&romJSON{
+		Name:   r.Name,
+		Size:   r.Size,
+		Crc:    hex.EncodeToString(r.Crc),
+		Md5:    hex.EncodeToString(r.Md5),
+		Sha1:   hex.EncodeToString(r.Sha1),
+		Sha256: hex.EncodeToString(r.Sha256),
+		Blake3: hex.EncodeToString(r.Blake3),
+		Status: r.Status,
+		Merge:  r.Merge,
+		Bios:   r.Bios,
+		Path:   r.Path,
+	})
+}
+
+func (r *Rom) UnmarshalJSON(data []byte) error {
+	var rj romJSON
+	err := json.Unmarshal(data, &rj)
+	if err != nil {
+		return err
+	}
+
+	hashes := []struct {
+		name string
+		in   string
+		out  *[]byte
+	}{
+		{"crc", rj.Crc, (*[]byte)(&r.Crc)},
+		{"md5", rj.Md5, (*[]byte)(&r.Md5)},
+		{"sha1", rj.Sha1, (*[]byte)(&r.Sha1)},
+		{"sha256", rj.Sha256, &r.Sha256},
+		{"blake3", rj.Blake3, &r.Blake3},
+	}
+	for _, h := range hashes {
+		*h.out, err = decodeJSONHash(rj.Name, h.name, h.in)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.Name = rj.Name
+	r.Size = rj.Size
+	r.Status = rj.Status
+	r.Merge = rj.Merge
+	r.Bios = rj.Bios
+	r.Path = rj.Path
+	return r.ValidHashes()
+}
+
+type diskJSON struct {
+	Name   string `json:"name"`
+	Sha1   string `json:"sha1,omitempty"`
+	Md5    string `json:"md5,omitempty"`
+	Status string `json:"status,omitempty"`
+	Merge  string `json:"merge,omitempty"`
+}
+
+func (dk *Disk) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&diskJSON{
+		Name:   dk.Name,
+		Sha1:   hex.EncodeToString(dk.Sha1),
+		Md5:    hex.EncodeToString(dk.Md5),
+		Status: dk.Status,
+		Merge:  dk.Merge,
+	})
+}
+
+func (dk *Disk) UnmarshalJSON(data []byte) error {
+	var dj diskJSON
+	err := json.Unmarshal(data, &dj)
+	if err != nil {
+		return err
+	}
+
+	sha1, err := decodeJSONHash(dj.Name, "sha1", dj.Sha1)
+	if err != nil {
+		return err
+	}
+	md5, err := decodeJSONHash(dj.Name, "md5", dj.Md5)
+	if err != nil {
+		return err
+	}
+
+	*dk = Disk{
+		Name:   dj.Name,
+		Sha1:   sha1,
+		Md5:    md5,
+		Status: dj.Status,
+		Merge:  dj.Merge,
+	}
+	return nil
+}
+
+func decodeJSONHash(name, kind, h string) ([]byte, error) {
+	if h == "" {
+		return nil, nil
+	}
+	bs, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, fmt.Errorf("%s has invalid %s %q: %v", name, kind, h, err)
+	}
+	return bs, nil
+}
+
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	// names in dats are full of & and <, keep them readable
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+// ComposeDatJSON writes d as a single JSON object.
+func ComposeDatJSON(d *Dat, w io.Writer) error {
+	return newJSONEncoder(w).Encode(d)
+}
+
+// JSONLWriter writes dats as JSON lines, one line for the dat without its
+// games followed by one line per game, so huge dats can be written and read
+// back a game at a time.
+type JSONLWriter struct {
+	enc *json.Encoder
+}
+
+func NewJSONLWriter(w io.Writer) *JSONLWriter {
+	return &JSONLWriter{enc: newJSONEncoder(w)}
+}
+
+// WriteDat writes the line for d itself, leaving out its games.
+func (jw *JSONLWriter) WriteDat(d *Dat) error {
+	return jw.enc.Encode(d.Header())
+}
+
+func (jw *JSONLWriter) WriteGame(g *Game) error {
+	return jw.enc.Encode(g)
+}
+
+// ComposeDatJSONL writes d as JSON lines, see JSONLWriter.
+func ComposeDatJSONL(d *Dat, w io.Writer) error {
+	jw := NewJSONLWriter(w)
+
+	err := jw.WriteDat(d)
+	if err != nil {
+		return err
+	}
+
+	for _, games := range d.gameLists() {
+		for _, g := range games {
+			err = jw.WriteGame(g)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testDat() *Dat {
+	return &Dat{
+		Name:        "Tom & Jerry",
+		Description: "Tom & Jerry <Collection>",
+		Games: GameSlice{
+			&Game{
+				Name:        "area51",
+				Description: "Area 51",
+				Roms: RomSlice{
+					&Rom{
+						Name:   "area51.bin",
+						Size:   4,
+						Crc:    []byte{0x17, 0x5a, 0x3f, 0x26},
+						Sha1:   []byte{0x80, 0x35, 0x3c, 0xb1, 0x68, 0xdc, 0x5d, 0x7c, 0xc1, 0xdc, 0xe5, 0x79, 0x71, 0xf4, 0xea, 0x26, 0x40, 0xa5, 0xa, 0xc4},
+						Status: "baddump",
+					},
+				},
+				Disks: DiskSlice{
+					&Disk{
+						Name: "area51",
+						Sha1: []byte{0x3b, 0x30, 0x3b, 0xc3, 0x7e, 0x20, 0x6a, 0x6d, 0x73, 0x39, 0x35, 0x2c, 0x86, 0x9f, 0x05, 0x0d, 0x04, 0x18, 0x6f, 0x11},
+					},
+				},
+			},
+			&Game{
+				Name:        "blank",
+				Description: "Blank",
+				Roms: RomSlice{
+					&Rom{Name: "nodump.bin", Size: 16, Status: "nodump"},
+				},
+			},
+		},
+	}
+}
+
+func TestDatJSON(t *testing.T) {
+	dat := testDat()
+
+	buf := new(bytes.Buffer)
+	err := ComposeDatJSON(dat, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{`"name":"Tom & Jerry"`, `"crc":"175a3f26"`, `"status":"nodump"`, `"disks":[{"name":"area51","sha1":"3b303bc3`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("JSON lacks %s: %s", want, out)
+		}
+	}
+	if strings.Contains(out, `"md5"`) {
+		t.Errorf("JSON has empty md5: %s", out)
+	}
+
+	parsed := new(Dat)
+	err = json.Unmarshal(buf.Bytes(), parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dat.Equals(parsed) {
+		t.Errorf("dat differs after JSON round trip: %s", out)
+	}
+}
+
+func TestDatJSONL(t *testing.T) {
+	dat := testDat()
+
+	buf := new(bytes.Buffer)
+	err := ComposeDatJSONL(dat, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := new(Dat)
+	scanner := bufio.NewScanner(buf)
+	for first := true; scanner.Scan(); first = false {
+		if first {
+			err = json.Unmarshal(scanner.Bytes(), parsed)
+		} else {
+			g := new(Game)
+			err = json.Unmarshal(scanner.Bytes(), g)
+			parsed.Games = append(parsed.Games, g)
+		}
+		if err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+	}
+
+	if !dat.Equals(parsed) {
+		t.Errorf("dat differs after JSONL round trip")
+	}
+}
+
+func TestRomJSONRejectsBadHashes(t *testing.T) {
+	err := json.Unmarshal([]byte(`{"name":"a.bin","size":1,"sha1":"xyz"}`), new(Rom))
+	if err == nil {
+		t.Errorf("invalid sha1 accepted")
+	}
+}
@@ -33,24 +33,48 @@ package types
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/xml"
+	"fmt"
 	"io"
+	"sync"
 	"text/template"
+
+	"github.com/dustin/go-humanize"
 )
 
-const datTemplate = `
-dat (
+// datTemplate and datXMLTemplate are made of header, game and footer
+// templates so DatWriter can write dats a game at a time.
+const datTemplate = `{{define "header"}}
+clrmamepro (
 	name "{{.Name}}"
-	description "{{.Description}}"
+	description "{{.Description}}"{{with .Category}}
+	category "{{.}}"{{end}}{{with .Version}}
+	version "{{.}}"{{end}}{{with .Date}}
+	date "{{.}}"{{end}}{{with .Author}}
+	author "{{.}}"{{end}}{{with .Email}}
+	email "{{.}}"{{end}}{{with .Homepage}}
+	homepage "{{.}}"{{end}}{{with .URL}}
+	url "{{.}}"{{end}}{{with .Comment}}
+	comment "{{.}}"{{end}}
 	path "{{.Path}}"
 )
-{{with .Games}}{{range .}}
+{{end}}{{define "game"}}
 game (
 	name "{{.Name}}"
-	description "{{.Description}}"
+	description "{{.Description}}"{{with .Category}}
+	category "{{.}}"{{end}}{{with .CloneOf}}
+	cloneof "{{.}}"{{end}}{{with .RomOf}}
+	romof "{{.}}"{{end}}{{with .SampleOf}}
+	sampleof "{{.}}"{{end}}
 	{{with .Roms}}{{range .}}
-	rom ( name "{{.Name}}" size {{.Size}} crc {{hex .Crc}} md5 {{hex .Md5}} sha1 {{hex .Sha1}} ){{end}}{{end}}
-){{end}}{{end}}
-`
+	rom ( name "{{.Name}}"{{with .Merge}} merge "{{.}}"{{end}} size {{.Size}}{{with .Crc}} crc {{hex .}}{{end}}{{with .Md5}} md5 {{hex .}}{{end}}{{with .Sha1}} sha1 {{hex .}}{{end}}{{if .Sha256}} sha256 {{hex .Sha256}}{{end}}{{if .Blake3}} blake3 {{hex .Blake3}}{{end}}{{template "flags" .Status}}{{with .Bios}} bios "{{.}}"{{end}} ){{end}}{{end}}{{with .Disks}}{{range .}}
+	disk ( name "{{.Name}}"{{with .Merge}} merge "{{.}}"{{end}}{{with .Sha1}} sha1 {{hex .}}{{end}}{{with .Md5}} md5 {{hex .}}{{end}}{{template "flags" .Status}} ){{end}}{{end}}{{range .Samples}}
+	sample "{{.Name}}"{{end}}
+){{end}}{{define "footer"}}
+{{end}}{{template "header" .}}{{range .Games}}{{template "game" .}}{{end}}{{template "footer" .}}`
+
+// clrmamepro dats have no flag for good dumps
+const flagsTemplate = `{{define "flags"}}{{if and . (ne . "good")}} flags {{.}}{{end}}{{end}}`
 
 const datShortTemplate = `
 dat (
@@ -64,6 +88,38 @@ game (
 	description "{{.Description}}"
 ){{end}}{{end}}
 `
+// datXMLTemplate follows the Logiqx datafile DTD, which has no place for
+// sha256 and blake3 hashes, the bios of roms or the devices of MAME machines.
+// The DTD requires a version and author, romba signs dats without one.
+const datXMLTemplate = `{{define "header"}}<?xml version="1.0"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+<datafile>
+	<header>
+		<name>{{xml .Name}}</name>
+		<description>{{xml .Description}}</description>{{with .Category}}
+		<category>{{xml .}}</category>{{end}}
+		<version>{{xml .Version}}</version>{{with .Date}}
+		<date>{{xml .}}</date>{{end}}
+		<author>{{with .Author}}{{xml .}}{{else}}romba{{end}}</author>{{with .Email}}
+		<email>{{xml .}}</email>{{end}}{{with .Homepage}}
+		<homepage>{{xml .}}</homepage>{{end}}{{with .URL}}
+		<url>{{xml .}}</url>{{end}}{{with .Comment}}
+		<comment>{{xml .}}</comment>{{end}}
+	</header>
+{{end}}{{define "game"}}	<game name="{{xml .Name}}"{{if .IsBios}} isbios="yes"{{end}}{{with .CloneOf}} cloneof="{{xml .}}"{{end}}{{with .RomOf}} romof="{{xml .}}"{{end}}{{with .SampleOf}} sampleof="{{xml .}}"{{end}}>
+		<description>{{xml .Description}}</description>{{with .Year}}
+		<year>{{xml .}}</year>{{end}}{{with .Manufacturer}}
+		<manufacturer>{{xml .}}</manufacturer>{{end}}{{with .Category}}
+		<category>{{xml .}}</category>{{end}}
+{{range .Releases}}		<release name="{{xml .Name}}" region="{{xml .Region}}"{{with .Language}} language="{{xml .}}"{{end}}{{with .Date}} date="{{xml .}}"{{end}}{{if .Default}} default="yes"{{end}}/>
+{{end}}{{range .BiosSets}}		<biosset name="{{xml .Name}}" description="{{xml .Description}}"{{if .Default}} default="yes"{{end}}/>
+{{end}}{{range .Roms}}		<rom name="{{xml .Name}}" size="{{.Size}}"{{with .Crc}} crc="{{hex .}}"{{end}}{{with .Md5}} md5="{{hex .}}"{{end}}{{with .Sha1}} sha1="{{hex .}}"{{end}}{{with .Merge}} merge="{{xml .}}"{{end}}{{with .Status}} status="{{xml .}}"{{end}}/>
+{{end}}{{range .Disks}}		<disk name="{{xml .Name}}"{{with .Sha1}} sha1="{{hex .}}"{{end}}{{with .Md5}} md5="{{hex .}}"{{end}}{{with .Merge}} merge="{{xml .}}"{{end}}{{with .Status}} status="{{xml .}}"{{end}}/>
+{{end}}{{range .Samples}}		<sample name="{{xml .Name}}"/>
+{{end}}	</game>
+{{end}}{{define "footer"}}</datafile>
+{{end}}{{template "header" .}}{{range .Games}}{{template "game" .}}{{end}}{{template "footer" .}}`
+
 const datsTemplate = `
 {{range .}}
 dat (
@@ -75,32 +131,100 @@ dat (
 `
 
 var ff = template.FuncMap{
-	"hex": hex.EncodeToString,
+	"hex":    hex.EncodeToString,
+	"xml":    xmlEscape,
+	"size":   humanSize,
+	"status": romStatus,
 }
 
-var dt = template.Must(template.New("datout").Funcs(ff).Parse(datTemplate))
-var sdt = template.Must(template.New("datshortout").Funcs(ff).Parse(datShortTemplate))
-var dts = template.Must(template.New("datsout").Funcs(ff).Parse(datsTemplate))
-
-func PrintDat(d *Dat) []byte {
+func xmlEscape(s string) string {
 	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
 
-	err := dt.Execute(buf, d)
+func humanSize(size int64) string {
+	return humanize.Bytes(uint64(size))
+}
+
+// romStatus spells out the good status left empty in roms and disks.
+func romStatus(status string) string {
+	if status == "" {
+		return StatusGood
+	}
+	return status
+}
+
+// Names of the built-in output templates.
+const (
+	TemplateDat      = "dat"
+	TemplateShortDat = "shortdat"
+	TemplateDats     = "dats"
+	TemplateXML      = "xml"
+)
+
+var (
+	templatesMu sync.RWMutex
+	templates   = map[string]*template.Template{
+		TemplateDat:      mustParseTemplate(TemplateDat, datTemplate),
+		TemplateShortDat: mustParseTemplate(TemplateShortDat, datShortTemplate),
+		TemplateDats:     mustParseTemplate(TemplateDats, datsTemplate),
+		TemplateXML:      mustParseTemplate(TemplateXML, datXMLTemplate),
+	}
+)
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(ff).Parse(flagsTemplate)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return t.Parse(text)
+}
 
-	return buf.Bytes()
+func mustParseTemplate(name, text string) *template.Template {
+	return template.Must(parseTemplate(name, text))
 }
 
-func ComposeDat(d *Dat, w io.Writer) error {
-	return dt.Execute(w, d)
+// RegisterTemplate adds an output template under name, replacing the one
+// registered before, built-in ones included. Templates are text/template
+// templates with these functions:
+//
+//	hex     hex encodes a hash
+//	xml     escapes a string for XML
+//	size    a size in bytes for humans, like 4.1 kB
+//	status  the status of a rom or disk, good if it has none
+//
+// and the flags template from the clrmamepro output, which writes the flags
+// of a rom given its status.
+func RegisterTemplate(name, text string) error {
+	t, err := parseTemplate(name, text)
+	if err != nil {
+		return err
+	}
+
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	templates[name] = t
+	return nil
 }
 
-func PrintShortDat(d *Dat) []byte {
+// Render executes the output template name with data, a *Dat for the built-in
+// ones except TemplateDats which takes a []*Dat.
+func Render(name string, w io.Writer, data interface{}) error {
+	templatesMu.RLock()
+	t := templates[name]
+	templatesMu.RUnlock()
+
+	if t == nil {
+		return fmt.Errorf("no output template %s", name)
+	}
+	return t.Execute(w, data)
+}
+
+func render(name string, data interface{}) []byte {
 	buf := new(bytes.Buffer)
 
-	err := sdt.Execute(buf, d)
+	err := Render(name, buf, data)
 	if err != nil {
 		panic(err)
 	}
@@ -108,13 +232,67 @@ func PrintShortDat(d *Dat) []byte {
 	return buf.Bytes()
 }
 
-func PrintRomInDats(dats []*Dat) []byte {
-	buf := new(bytes.Buffer)
+// DatWriter writes a dat a game at a time, so dats too big to hold in memory
+// can be written as they are put together. Its output template has to define
+// header, game and footer templates for the dat, each game and the end, like
+// TemplateDat and TemplateXML do.
+type DatWriter struct {
+	w   io.Writer
+	t   *template.Template
+	dat *Dat
+}
 
-	err := dts.Execute(buf, dats)
-	if err != nil {
-		panic(err)
+// NewDatWriter returns a writer to w using the output template name.
+func NewDatWriter(w io.Writer, name string) (*DatWriter, error) {
+	templatesMu.RLock()
+	t := templates[name]
+	templatesMu.RUnlock()
+
+	if t == nil {
+		return nil, fmt.Errorf("no output template %s", name)
 	}
 
-	return buf.Bytes()
+	for _, part := range []string{"header", "game", "footer"} {
+		if t.Lookup(part) == nil {
+			return nil, fmt.Errorf("output template %s has no %s template", name, part)
+		}
+	}
+	return &DatWriter{w: w, t: t}, nil
+}
+
+// BeginDat writes the header of d. The games of d are left out, write them
+// with WriteGame.
+func (dw *DatWriter) BeginDat(d *Dat) error {
+	dw.dat = d
+	return dw.t.ExecuteTemplate(dw.w, "header", d)
+}
+
+func (dw *DatWriter) WriteGame(g *Game) error {
+	return dw.t.ExecuteTemplate(dw.w, "game", g)
+}
+
+// EndDat ends the dat begun with BeginDat.
+func (dw *DatWriter) EndDat() error {
+	return dw.t.ExecuteTemplate(dw.w, "footer", dw.dat)
+}
+
+func PrintDat(d *Dat) []byte {
+	return render(TemplateDat, d)
+}
+
+func ComposeDat(d *Dat, w io.Writer) error {
+	return Render(TemplateDat, w, d)
+}
+
+// ComposeDatXML writes d as a Logiqx XML datafile.
+func ComposeDatXML(d *Dat, w io.Writer) error {
+	return Render(TemplateXML, w, d)
+}
+
+func PrintShortDat(d *Dat) []byte {
+	return render(TemplateShortDat, d)
+}
+
+func PrintRomInDats(dats []*Dat) []byte {
+	return render(TemplateDats, dats)
 }
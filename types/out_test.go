@@ -0,0 +1,111 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegisterTemplate(t *testing.T) {
+	dat := csvTestDat()
+
+	err := RegisterTemplate("report", `{{range .Games}}{{.Name}}:{{range .Roms}} {{.Name}} {{size .Size}} {{status .Status}}{{with .Crc}} {{hex .}}{{end}}{{template "flags" .Status}};{{end}}
+{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Render("report", buf, dat); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "game, one: a.bin 4 B good 01020304; b.bin 8 B nodump flags nodump;\n" +
+		"two: c.bin 2 B baddump flags baddump;\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	if err := RegisterTemplate("broken", "{{.Name"); err == nil {
+		t.Errorf("broken template registered")
+	}
+	if err := Render("missing", buf, dat); err == nil {
+		t.Errorf("rendered a missing template")
+	}
+}
+
+func TestOverrideTemplate(t *testing.T) {
+	defer RegisterTemplate(TemplateShortDat, datShortTemplate)
+
+	if err := RegisterTemplate(TemplateShortDat, "short {{.Name}}"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(PrintShortDat(csvTestDat())); got != "short csv" {
+		t.Errorf("got %q from overridden template", got)
+	}
+}
+
+func TestDatWriter(t *testing.T) {
+	dat := csvTestDat()
+
+	for _, name := range []string{TemplateDat, TemplateXML} {
+		want := new(bytes.Buffer)
+		if err := Render(name, want, dat); err != nil {
+			t.Fatal(err)
+		}
+
+		got := new(bytes.Buffer)
+		dw, err := NewDatWriter(got, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dw.BeginDat(&Dat{Name: dat.Name, Description: dat.Description}); err != nil {
+			t.Fatal(err)
+		}
+		for _, g := range dat.Games {
+			if err := dw.WriteGame(g); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dw.EndDat(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got.String() != want.String() {
+			t.Errorf("%s: streamed\n%s\nrendered\n%s", name, got.String(), want.String())
+		}
+	}
+
+	if _, err := NewDatWriter(new(bytes.Buffer), TemplateShortDat); err == nil {
+		t.Errorf("streaming with a template without game template")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"path"
+	"sort"
+)
+
+const (
+	// SampleSuffix ends the names of the files of sample sets.
+	SampleSuffix = ".wav"
+	// SamplesDir is the folder sample sets go in, next to the games of a
+	// dat, like MAME's samplepath.
+	SamplesDir = "samples"
+)
+
+// SampleSet returns the name of the sample set holding the samples of g: the
+// one named by SampleOf, or g itself without one.
+func (g *Game) SampleSet() string {
+	if g.SampleOf != "" {
+		return g.SampleOf
+	}
+	return g.Name
+}
+
+// SampleSets returns the sample sets used by the games of d as games named
+// SamplesDir/<set>, with a rom without hashes for the file of each sample.
+// Sets are sorted by name, samples of games sharing a set appear once.
+func (d *Dat) SampleSets() GameSlice {
+	bySet := make(map[string]*Game)
+
+	for _, g := range d.Games {
+		if len(g.Samples) == 0 {
+			continue
+		}
+
+		name := g.SampleSet()
+		sg := bySet[name]
+		if sg == nil {
+			sg = &Game{
+				Name:        path.Join(SamplesDir, name),
+				Description: "samples of " + name,
+			}
+			bySet[name] = sg
+		}
+
+		for _, sm := range g.Samples {
+			file := sm.Name + SampleSuffix
+			if !sg.Roms.hasName(file) {
+				sg.Roms = append(sg.Roms, &Rom{Name: file})
+			}
+		}
+	}
+
+	sets := make(GameSlice, 0, len(bySet))
+	for _, sg := range bySet {
+		sort.Sort(sg.Roms)
+		sets = append(sets, sg)
+	}
+	sort.Sort(sets)
+	return sets
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"testing"
+)
+
+func TestSampleSets(t *testing.T) {
+	dat := &Dat{
+		Name: "mame",
+		Games: GameSlice{
+			{Name: "galaxian", SampleOf: "galaxian", Samples: SampleSlice{{Name: "shot"}, {Name: "death"}}},
+			{Name: "galaxiana", CloneOf: "galaxian", SampleOf: "galaxian", Samples: SampleSlice{{Name: "shot"}, {Name: "hiscore"}}},
+			{Name: "invaders", Samples: SampleSlice{{Name: "ufo"}}},
+			{Name: "pacman"},
+		},
+	}
+
+	sets := dat.SampleSets()
+	if len(sets) != 2 {
+		t.Fatalf("got %d sample sets, want 2", len(sets))
+	}
+
+	for i, want := range []struct {
+		name  string
+		files string
+	}{
+		{"samples/galaxian", "death.wav hiscore.wav shot.wav"},
+		{"samples/invaders", "ufo.wav"},
+	} {
+		if sets[i].Name != want.name {
+			t.Errorf("got sample set %s, want %s", sets[i].Name, want.name)
+		}
+		if got := romNames(&Dat{Games: sets}, want.name); got != want.files {
+			t.Errorf("sample set %s has %s, want %s", want.name, got, want.files)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"strings"
+)
+
+// SelectOptions are the preferences for OneGameOneRom.
+type SelectOptions struct {
+	// Regions in order of preference, for instance USA, Europe, Japan. They
+	// are matched against the tags in parentheses of game names, as in
+	// "Game (USA, Europe) (En,Fr)".
+	Regions []string
+	// Languages in order of preference, for instance En, Fr. Languages only
+	// decide between games of equally preferred regions.
+	Languages []string
+	// KeepUnmatched keeps families without a game in any of Regions,
+	// choosing by the other criteria. They are dropped otherwise.
+	KeepUnmatched bool
+}
+
+// nameTags returns the comma separated entries of the tags in parentheses of
+// name.
+func nameTags(name string) []string {
+	var tags []string
+	for {
+		start := strings.IndexByte(name, '(')
+		if start < 0 {
+			return tags
+		}
+		end := strings.IndexByte(name[start:], ')')
+		if end < 0 {
+			return tags
+		}
+		for _, tag := range strings.Split(name[start+1:start+end], ",") {
+			tags = append(tags, strings.TrimSpace(tag))
+		}
+		name = name[start+end+1:]
+	}
+}
+
+// rank returns the index of the first of prefs found in tags, len(prefs) if
+// none is.
+func rank(tags, prefs []string) int {
+	for i, pref := range prefs {
+		for _, tag := range tags {
+			if strings.EqualFold(tag, pref) {
+				return i
+			}
+		}
+	}
+	return len(prefs)
+}
+
+type selectCandidate struct {
+	game     *Game
+	region   int
+	language int
+	clone    bool
+}
+
+func (c *selectCandidate) better(o *selectCandidate) bool {
+	switch {
+	case c.region != o.region:
+		return c.region < o.region
+	case c.language != o.language:
+		return c.language < o.language
+	case c.clone != o.clone:
+		return !c.clone
+	}
+	return c.game.Name < o.game.Name
+}
+
+// OneGameOneRom returns a dat with one game of each family of d, the parent
+// and its clones, picked by region first, language second, parents before
+// clones and names last. The games are those of the non-merged view, so
+// picked clones have all their roms. Filter d beforehand to leave out betas,
+// prototypes and the like.
+func (d *Dat) OneGameOneRom(opts *SelectOptions) *Dat {
+	nonMerged := d.NonMerged()
+	byName := d.gamesByName()
+
+	var families []string
+	best := make(map[string]*selectCandidate)
+
+	for i, g := range d.Games {
+		family := g.Name
+		if as := ancestors(g, byName, cloneOf); len(as) > 0 {
+			family = as[len(as)-1].Name
+		}
+
+		tags := nameTags(g.Name)
+		c := &selectCandidate{
+			game:     nonMerged.Games[i],
+			region:   rank(tags, opts.Regions),
+			language: rank(tags, opts.Languages),
+			clone:    family != g.Name,
+		}
+
+		b, ok := best[family]
+		if !ok {
+			families = append(families, family)
+		}
+		if !ok || c.better(b) {
+			best[family] = c
+		}
+	}
+
+	games := make(GameSlice, 0, len(families))
+	for _, family := range families {
+		c := best[family]
+		if c.region == len(opts.Regions) && len(opts.Regions) > 0 && !opts.KeepUnmatched {
+			continue
+		}
+		games = append(games, c.game)
+	}
+	return d.withGames(games)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"testing"
+)
+
+func TestOneGameOneRom(t *testing.T) {
+	dat := &Dat{
+		Name: "no-intro",
+		Games: GameSlice{
+			&Game{Name: "Game (Europe) (En,Fr,De)", CloneOf: "Game (Japan)", Roms: RomSlice{setsTestRom("game.bin", 1)}},
+			&Game{Name: "Game (Japan)", Roms: RomSlice{setsTestRom("game.bin", 2), setsTestRom("extra.bin", 9)}},
+			&Game{Name: "Game (USA) (Fr)", CloneOf: "Game (Japan)", Roms: RomSlice{setsTestRom("game.bin", 3)}},
+			&Game{Name: "Game (USA, Europe) (En)", CloneOf: "Game (Japan)", Roms: RomSlice{setsTestRom("game.bin", 4)}},
+			&Game{Name: "Other (Japan)", Roms: RomSlice{setsTestRom("other.bin", 5)}},
+			&Game{Name: "Third (Europe)", Roms: RomSlice{setsTestRom("third.bin", 6)}},
+		},
+	}
+
+	names := func(d *Dat) []string {
+		var ns []string
+		for _, g := range d.Games {
+			ns = append(ns, g.Name)
+		}
+		return ns
+	}
+
+	picked := dat.OneGameOneRom(&SelectOptions{
+		Regions:   []string{"USA", "Europe"},
+		Languages: []string{"En"},
+	})
+	if got := names(picked); len(got) != 2 || got[0] != "Game (USA, Europe) (En)" || got[1] != "Third (Europe)" {
+		t.Fatalf("got %v", got)
+	}
+	if got := romNames(picked, "Game (USA, Europe) (En)"); got != "extra.bin game.bin" {
+		t.Errorf("picked clone has roms %q", got)
+	}
+
+	picked = dat.OneGameOneRom(&SelectOptions{
+		Regions:       []string{"Europe"},
+		KeepUnmatched: true,
+	})
+	if got := names(picked); len(got) != 3 || got[0] != "Game (Europe) (En,Fr,De)" || got[1] != "Other (Japan)" {
+		t.Errorf("got %v", got)
+	}
+
+	picked = dat.OneGameOneRom(&SelectOptions{})
+	if got := names(picked); len(got) != 3 || got[0] != "Game (Japan)" {
+		t.Errorf("got %v without preferences, want parents", got)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// The set views below spread the roms of parents and clones over games the
+// way the usual set types do, for a normalized dat:
+//
+//	non-merged: every game has all its roms, including those of its
+//	            parents it doesn't list itself
+//	split:      games leave out the roms of the game they take roms from
+//	merged:     parents also hold the roms of their clones, which are gone
+//
+// BIOS roms are left to the BIOS game in all of them. Disks stay with their
+// games, except in merged views where parents take those of their clones.
+// The views share roms and disks with d, except for renamed roms in merged
+// views.
+
+// sameRom reports whether a and b have the same contents, going by the best
+// hash both have.
+func sameRom(a, b *Rom) bool {
+	switch {
+	case a.Sha1 != nil && b.Sha1 != nil:
+		return bytes.Equal(a.Sha1, b.Sha1)
+	case a.Crc != nil && b.Crc != nil:
+		return a.Size == b.Size && bytes.Equal(a.Crc, b.Crc)
+	}
+	return a.Name == b.Name && a.Size == b.Size
+}
+
+func (rs RomSlice) has(rom *Rom) bool {
+	for _, r := range rs {
+		if sameRom(r, rom) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ds DiskSlice) has(disk *Disk) bool {
+	for _, d := range ds {
+		if d.Name == disk.Name || (d.Sha1 != nil && bytes.Equal(d.Sha1, disk.Sha1)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs RomSlice) hasName(name string) bool {
+	for _, r := range rs {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dat) gamesByName() map[string]*Game {
+	m := make(map[string]*Game, len(d.Games))
+	for _, g := range d.Games {
+		m[g.Name] = g
+	}
+	return m
+}
+
+// ancestors returns the games reached from g by following next, nearest
+// first, stopping at missing games and cycles.
+func ancestors(g *Game, byName map[string]*Game, next func(*Game) string) []*Game {
+	var as []*Game
+	seen := map[string]bool{g.Name: true}
+
+	for name := next(g); name != "" && !seen[name]; name = next(g) {
+		seen[name] = true
+		g = byName[name]
+		if g == nil {
+			break
+		}
+		as = append(as, g)
+	}
+	return as
+}
+
+func cloneOf(g *Game) string { return g.CloneOf }
+
+func romOf(g *Game) string { return g.RomOf }
+
+// Parent returns the game g is a clone of, following chains of clones, or nil
+// if g isn't a clone of a game in d.
+func (d *Dat) Parent(g *Game) *Game {
+	as := ancestors(g, d.gamesByName(), cloneOf)
+	if len(as) == 0 {
+		return nil
+	}
+	return as[len(as)-1]
+}
+
+func (d *Dat) withGames(games GameSlice) *Dat {
+	nd := *d
+	nd.Games = games
+	nd.Software = nil
+	nd.Machines = nil
+	return &nd
+}
+
+func (g *Game) withRoms(roms RomSlice) *Game {
+	ng := *g
+	ng.Roms = roms
+	ng.Parts = nil
+	ng.PartDisks = nil
+	ng.Regions = nil
+	return &ng
+}
+
+// Split returns the split set view of d.
+func (d *Dat) Split() *Dat {
+	byName := d.gamesByName()
+	games := make(GameSlice, 0, len(d.Games))
+
+	for _, g := range d.Games {
+		var inherited RomSlice
+		for _, a := range ancestors(g, byName, romOf) {
+			inherited = append(inherited, a.Roms...)
+		}
+
+		var roms RomSlice
+		for _, rom := range g.Roms {
+			if !inherited.has(rom) {
+				roms = append(roms, rom)
+			}
+		}
+		games = append(games, g.withRoms(roms))
+	}
+	return d.withGames(games)
+}
+
+// NonMerged returns the non-merged set view of d.
+func (d *Dat) NonMerged() *Dat {
+	byName := d.gamesByName()
+	games := make(GameSlice, 0, len(d.Games))
+
+	for _, g := range d.Games {
+		roms := append(RomSlice(nil), g.Roms...)
+		for _, a := range ancestors(g, byName, cloneOf) {
+			for _, rom := range a.Roms {
+				if !roms.has(rom) && !roms.hasName(rom.Name) {
+					roms = append(roms, rom)
+				}
+			}
+		}
+		sort.Sort(roms)
+		games = append(games, g.withRoms(roms))
+	}
+	return d.withGames(games)
+}
+
+// Merged returns the merged set view of d. Roms of clones whose name is
+// taken in the parent by a different rom are put under the name of the clone,
+// as clone/name.
+func (d *Dat) Merged() *Dat {
+	split := d.Split()
+	byName := split.gamesByName()
+
+	parents := make(map[string]*Game)
+	games := make(GameSlice, 0, len(d.Games))
+
+	for _, g := range split.Games {
+		if as := ancestors(g, byName, cloneOf); len(as) == 0 {
+			pg := g.withRoms(append(RomSlice(nil), g.Roms...))
+			pg.Disks = append(DiskSlice(nil), g.Disks...)
+			parents[g.Name] = pg
+			games = append(games, pg)
+		}
+	}
+
+	for _, g := range split.Games {
+		as := ancestors(g, byName, cloneOf)
+		if len(as) == 0 {
+			continue
+		}
+		pg := parents[as[len(as)-1].Name]
+
+		for _, rom := range g.Roms {
+			if pg.Roms.has(rom) {
+				continue
+			}
+			if pg.Roms.hasName(rom.Name) {
+				renamed := *rom
+				renamed.Name = g.Name + "/" + rom.Name
+				rom = &renamed
+			}
+			pg.Roms = append(pg.Roms, rom)
+		}
+
+		for _, disk := range g.Disks {
+			if !pg.Disks.has(disk) {
+				pg.Disks = append(pg.Disks, disk)
+			}
+		}
+	}
+
+	for _, pg := range games {
+		sort.Sort(pg.Roms)
+		sort.Sort(pg.Disks)
+	}
+	return d.withGames(games)
+}
+
+// SetMode names one of the set views, the empty mode leaves games as the dat
+// has them.
+type SetMode string
+
+const (
+	AsIsSets      SetMode = ""
+	NonMergedSets SetMode = "non-merged"
+	SplitSets     SetMode = "split"
+	MergedSets    SetMode = "merged"
+)
+
+// ParseSetMode returns the set mode named s.
+func ParseSetMode(s string) (SetMode, error) {
+	switch mode := SetMode(s); mode {
+	case AsIsSets, NonMergedSets, SplitSets, MergedSets:
+		return mode, nil
+	}
+	return AsIsSets, fmt.Errorf("unknown set mode %q, want %s, %s or %s", s, NonMergedSets, SplitSets, MergedSets)
+}
+
+// Sets returns the view of d for mode.
+func (d *Dat) Sets(mode SetMode) *Dat {
+	switch mode {
+	case NonMergedSets:
+		return d.NonMerged()
+	case SplitSets:
+		return d.Split()
+	case MergedSets:
+		return d.Merged()
+	}
+	return d
+}
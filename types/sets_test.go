@@ -0,0 +1,143 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func setsTestRom(name string, crc byte) *Rom {
+	return &Rom{Name: name, Size: 1, Crc: []byte{0, 0, 0, crc}}
+}
+
+func setsTestDat() *Dat {
+	return &Dat{
+		Name: "arcade",
+		Games: GameSlice{
+			&Game{Name: "bios", Roms: RomSlice{setsTestRom("bios.bin", 1)}},
+			&Game{Name: "clone", CloneOf: "parent", RomOf: "parent", Roms: RomSlice{
+				setsTestRom("bios.bin", 1),
+				setsTestRom("common.bin", 2),
+				setsTestRom("main.bin", 4),
+				setsTestRom("sound.bin", 5),
+			}},
+			&Game{Name: "parent", RomOf: "bios", Roms: RomSlice{
+				setsTestRom("bios.bin", 1),
+				setsTestRom("common.bin", 2),
+				setsTestRom("main.bin", 3),
+			}},
+		},
+	}
+}
+
+func romNames(d *Dat, game string) string {
+	for _, g := range d.Games {
+		if g.Name == game {
+			var names []string
+			for _, rom := range g.Roms {
+				names = append(names, rom.Name)
+			}
+			sort.Strings(names)
+			return strings.Join(names, " ")
+		}
+	}
+	return "<missing>"
+}
+
+func TestSetViews(t *testing.T) {
+	dat := setsTestDat()
+
+	if p := dat.Parent(dat.Games[1]); p == nil || p.Name != "parent" {
+		t.Errorf("got parent %v for clone", p)
+	}
+	if p := dat.Parent(dat.Games[2]); p != nil {
+		t.Errorf("got parent %s for parent", p.Name)
+	}
+
+	tests := []struct {
+		view string
+		dat  *Dat
+		want map[string]string
+	}{
+		{"split", dat.Split(), map[string]string{
+			"bios":   "bios.bin",
+			"parent": "common.bin main.bin",
+			"clone":  "main.bin sound.bin",
+		}},
+		{"non-merged", dat.NonMerged(), map[string]string{
+			"bios":   "bios.bin",
+			"parent": "bios.bin common.bin main.bin",
+			"clone":  "bios.bin common.bin main.bin sound.bin",
+		}},
+		{"merged", dat.Merged(), map[string]string{
+			"bios":   "bios.bin",
+			"parent": "clone/main.bin common.bin main.bin sound.bin",
+			"clone":  "<missing>",
+		}},
+	}
+
+	for _, test := range tests {
+		for game, want := range test.want {
+			if got := romNames(test.dat, game); got != want {
+				t.Errorf("%s %s: got roms %s, want %s", test.view, game, got, want)
+			}
+		}
+	}
+
+	if got := romNames(dat, "clone"); got != "bios.bin common.bin main.bin sound.bin" {
+		t.Errorf("views changed the dat itself: clone has %s", got)
+	}
+}
+
+func TestSetMode(t *testing.T) {
+	dat := setsTestDat()
+
+	for _, name := range []string{"", "non-merged", "split", "merged"} {
+		mode, err := ParseSetMode(name)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", name, err)
+		}
+		if mode == AsIsSets {
+			if dat.Sets(mode) != dat {
+				t.Errorf("mode %q changed the dat", name)
+			}
+			continue
+		}
+		if got := romNames(dat.Sets(mode), "parent"); got == romNames(dat, "parent") && mode != NonMergedSets {
+			t.Errorf("mode %q left parent with roms %s", name, got)
+		}
+	}
+
+	if _, err := ParseSetMode("fullmerged"); err == nil {
+		t.Errorf("unknown set mode accepted")
+	}
+}
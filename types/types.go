@@ -32,41 +32,233 @@ package types
 
 import (
 	"bytes"
+	"encoding/xml"
 	"sort"
+	"strings"
 )
 
+// Dat is a dat file. The header fields after Description are those of
+// clrmamepro and Logiqx dats, kept so dats written by romba don't lose them.
 type Dat struct {
-	Name        string    `xml:"header>name"`
-	Description string    `xml:"header>description"`
-	Games       GameSlice `xml:"game"`
-	Generation  int64
-	Artificial  bool
-	Path        string
-	Software    GameSlice `xml:"software"`
+	Name        string    `xml:"header>name" json:"name"`
+	Description string    `xml:"header>description" json:"description"`
+	Category    string    `xml:"header>category" json:"category,omitempty"`
+	Version     string    `xml:"header>version" json:"version,omitempty"`
+	Date        string    `xml:"header>date" json:"date,omitempty"`
+	Author      string    `xml:"header>author" json:"author,omitempty"`
+	Email       string    `xml:"header>email" json:"email,omitempty"`
+	Homepage    string    `xml:"header>homepage" json:"homepage,omitempty"`
+	URL         string    `xml:"header>url" json:"url,omitempty"`
+	Comment     string    `xml:"header>comment" json:"comment,omitempty"`
+	Games       GameSlice `xml:"game" json:"games,omitempty"`
+	Generation  int64     `json:"generation,omitempty"`
+	Artificial  bool      `json:"artificial,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Software    GameSlice `xml:"software" json:"software,omitempty"`
+	// Machines are the games of MAME -listxml output.
+	Machines GameSlice `xml:"machine" json:"machines,omitempty"`
+	// DatFlags are the flags set on the dat, kept by the DB apart from the
+	// dat file.
+	DatFlags `xml:"-"`
 }
 
+// DatFlags are what a user set on a dat to guard it against destructive
+// commands, see RomDB.SetDatFlags.
+type DatFlags struct {
+	// Pinned dats keep their roms in the depot, purges leave them even
+	// once the dat is no longer current.
+	Pinned bool `json:"pinned,omitempty"`
+	// Protected dats are pinned and the set folders built from them aren't
+	// changed by fix and rebuild.
+	Protected bool `json:"protected,omitempty"`
+}
+
+// KeepsRoms tells whether the roms of a dat with flags f stay in the depot.
+func (f DatFlags) KeepsRoms() bool {
+	return f.Pinned || f.Protected
+}
+
+func (f DatFlags) String() string {
+	switch {
+	case f.Protected:
+		return "protected"
+	case f.Pinned:
+		return "pinned"
+	}
+	return "none"
+}
+
+// Game is a set of roms. CloneOf names the parent of a clone, RomOf the game
+// it takes roms from (the parent, or the BIOS for parents) and SampleOf the
+// game whose samples it uses.
 type Game struct {
-	Name        string   `xml:"name,attr"`
-	Description string   `xml:"description"`
-	Roms        RomSlice `xml:"rom"`
-	Disks       RomSlice `xml:"disk"`
-	Parts       RomSlice `xml:"part>dataarea>rom"`
-	Regions     RomSlice `xml:"region>rom"`
+	Name         string     `xml:"name,attr" json:"name"`
+	Description  string     `xml:"description" json:"description"`
+	Year         string     `xml:"year" json:"year,omitempty"`
+	Manufacturer string     `xml:"manufacturer" json:"manufacturer,omitempty"`
+	Category     string     `xml:"category" json:"category,omitempty"`
+	CloneOf      string     `xml:"cloneof,attr" json:"cloneof,omitempty"`
+	RomOf        string     `xml:"romof,attr" json:"romof,omitempty"`
+	SampleOf     string     `xml:"sampleof,attr" json:"sampleof,omitempty"`
+	IsBios       YesNo      `xml:"isbios,attr" json:"isbios,omitempty"`
+	IsDevice     YesNo      `xml:"isdevice,attr" json:"isdevice,omitempty"`
+	IsMechanical YesNo      `xml:"ismechanical,attr" json:"ismechanical,omitempty"`
+	Releases     []*Release `xml:"release" json:"releases,omitempty"`
+	BiosSets     []*BiosSet `xml:"biosset" json:"biossets,omitempty"`
+	// DeviceRefs name the devices, themselves games, a MAME machine uses.
+	DeviceRefs []*DeviceRef `xml:"device_ref" json:"devicerefs,omitempty"`
+	Roms       RomSlice     `xml:"rom" json:"roms,omitempty"`
+	Disks      DiskSlice    `xml:"disk" json:"disks,omitempty"`
+	Samples    SampleSlice  `xml:"sample" json:"samples,omitempty"`
+	Parts      RomSlice     `xml:"part>dataarea>rom" json:"parts,omitempty"`
+	PartDisks  DiskSlice    `xml:"part>diskarea>disk" json:"partdisks,omitempty"`
+	Regions    RomSlice     `xml:"region>rom" json:"regions,omitempty"`
+	// Span is where the game is in its dat file, only recorded on request,
+	// see parser.ParseSpans.
+	Span *Span `xml:"-" json:"-"`
 }
 
 type GameSlice []*Game
 
+// Span is the byte range of a dat file from Start up to End.
+type Span struct {
+	Start, End int64
+}
+
+// YesNo is a flag of XML dats, set by the value yes.
+type YesNo bool
+
+func (yn *YesNo) UnmarshalXMLAttr(attr xml.Attr) error {
+	*yn = YesNo(attr.Value == "yes")
+	return nil
+}
+
+// Release is a release of a game in a region.
+type Release struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Region   string `xml:"region,attr" json:"region"`
+	Language string `xml:"language,attr" json:"language,omitempty"`
+	Date     string `xml:"date,attr" json:"date,omitempty"`
+	Default  YesNo  `xml:"default,attr" json:"default,omitempty"`
+}
+
+// BiosSet is a BIOS option of a game, roms with a Bios name one.
+type BiosSet struct {
+	Name        string `xml:"name,attr" json:"name"`
+	Description string `xml:"description,attr" json:"description"`
+	Default     YesNo  `xml:"default,attr" json:"default,omitempty"`
+}
+
+type DeviceRef struct {
+	Name string `xml:"name,attr" json:"name"`
+}
+
+// Header returns a copy of d without its games, to start dats derived from d.
+func (d *Dat) Header() *Dat {
+	hd := *d
+	hd.Games = nil
+	hd.Software = nil
+	hd.Machines = nil
+	return &hd
+}
+
+// gameLists returns the lists of games of d, those not yet moved into Games
+// by Normalize included.
+func (d *Dat) gameLists() []GameSlice {
+	return []GameSlice{d.Games, d.Software, d.Machines}
+}
+
 type Rom struct {
-	Name string `xml:"name,attr"`
-	Size int64  `xml:"size,attr"`
-	Crc  []byte `xml:"crc,attr"`
-	Md5  []byte `xml:"md5,attr"`
-	Sha1 []byte `xml:"sha1,attr"`
+	Name   string  `xml:"name,attr"`
+	Size   int64   `xml:"size,attr"`
+	Crc    Crc32   `xml:"crc,attr"`
+	Md5    Md5Sum  `xml:"md5,attr"`
+	Sha1   Sha1Sum `xml:"sha1,attr"`
+	Sha256 []byte  `xml:"sha256,attr"`
+	Blake3 []byte  `xml:"blake3,attr"`
+	// Status is the dump status, one of the Status constants. Empty means
+	// good.
+	Status string `xml:"status,attr"`
+	// Merge is the name of the rom in the parent game that this rom of a
+	// clone is the same as.
+	Merge string `xml:"merge,attr"`
+	// Bios is the BIOS option this rom belongs to.
+	Bios string `xml:"bios,attr"`
 	Path string
 }
 
+// Dump status of roms and disks.
+const (
+	StatusGood     = "good"
+	StatusBadDump  = "baddump"
+	StatusNoDump   = "nodump"
+	StatusVerified = "verified"
+)
+
+// NoDump reports whether rom is known to have no dump, so it can't be missing
+// from the depot or a set.
+func (r *Rom) NoDump() bool {
+	return r.Status == StatusNoDump
+}
+
 type RomSlice []*Rom
 
+// Disk is a CHD disk image. The depot stores CHDs under their internal SHA1,
+// which is what Sha1 refers to.
+type Disk struct {
+	Name   string  `xml:"name,attr"`
+	Sha1   Sha1Sum `xml:"sha1,attr"`
+	Md5    Md5Sum  `xml:"md5,attr"`
+	Status string  `xml:"status,attr"`
+	Merge  string  `xml:"merge,attr"`
+
+	rom *Rom
+}
+
+type DiskSlice []*Disk
+
+// Rom returns disk as a rom, for the code indexing and looking up roms in the
+// depot. It is the same rom on every call, so anything filled into it sticks.
+func (dk *Disk) Rom() *Rom {
+	if dk.rom == nil {
+		dk.rom = &Rom{
+			Name:   dk.Name,
+			Md5:    dk.Md5,
+			Sha1:   dk.Sha1,
+			Status: dk.Status,
+			Merge:  dk.Merge,
+		}
+	}
+	return dk.rom
+}
+
+// Sample is a sound of a game, played from the file Name.wav of its sample
+// set. Dats list samples by name only, their hashes come from dats of sample
+// sets.
+type Sample struct {
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type SampleSlice []*Sample
+
+// AllRoms returns the roms of g followed by its disks as roms.
+func (g *Game) AllRoms() RomSlice {
+	if len(g.Disks) == 0 {
+		return g.Roms
+	}
+
+	roms := make(RomSlice, 0, len(g.Roms)+len(g.Disks))
+	roms = append(roms, g.Roms...)
+	for _, dk := range g.Disks {
+		roms = append(roms, dk.Rom())
+	}
+	return roms
+}
+
+func (ad *Disk) Equals(bd *Disk) bool {
+	return ad.Name == bd.Name && ad.Sha1.Equal(bd.Sha1) && ad.Md5.Equal(bd.Md5)
+}
+
 func (ar *Rom) Equals(br *Rom) bool {
 	if ar.Name != br.Name {
 		return false
@@ -76,27 +268,68 @@ func (ar *Rom) Equals(br *Rom) bool {
 		return false
 	}
 
-	if !bytes.Equal(ar.Crc, br.Crc) {
+	if !ar.Crc.Equal(br.Crc) {
 		return false
 	}
 
-	if !bytes.Equal(ar.Md5, br.Md5) {
+	if !ar.Md5.Equal(br.Md5) {
 		return false
 	}
 
-	if !bytes.Equal(ar.Sha1, br.Sha1) {
+	if !ar.Sha1.Equal(br.Sha1) {
+		return false
+	}
+
+	if !bytes.Equal(ar.Sha256, br.Sha256) {
+		return false
+	}
+
+	if !bytes.Equal(ar.Blake3, br.Blake3) {
 		return false
 	}
 	return true
 }
 
-func (s GameSlice) Len() int           { return len(s) }
-func (s GameSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-func (s GameSlice) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s GameSlice) Len() int      { return len(s) }
+func (s GameSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s GameSlice) Less(i, j int) bool {
+	if s[i].Name != s[j].Name {
+		return NameLess(s[i].Name, s[j].Name)
+	}
+	return s[i].Description < s[j].Description
+}
 
-func (s RomSlice) Len() int           { return len(s) }
-func (s RomSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-func (s RomSlice) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s RomSlice) Len() int      { return len(s) }
+func (s RomSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s RomSlice) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	if a.Name != b.Name {
+		return NameLess(a.Name, b.Name)
+	}
+	if a.Size != b.Size {
+		return a.Size < b.Size
+	}
+	if c := bytes.Compare(a.Sha1, b.Sha1); c != 0 {
+		return c < 0
+	}
+	if c := bytes.Compare(a.Crc, b.Crc); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(a.Md5, b.Md5) < 0
+}
+
+func (s SampleSlice) Len() int           { return len(s) }
+func (s SampleSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s SampleSlice) Less(i, j int) bool { return NameLess(s[i].Name, s[j].Name) }
+
+func (s DiskSlice) Len() int      { return len(s) }
+func (s DiskSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s DiskSlice) Less(i, j int) bool {
+	if s[i].Name != s[j].Name {
+		return NameLess(s[i].Name, s[j].Name)
+	}
+	return bytes.Compare(s[i].Sha1, s[j].Sha1) < 0
+}
 
 // assumes slices are sorted
 func (as GameSlice) Equals(bs GameSlice) bool {
@@ -112,6 +345,34 @@ func (as GameSlice) Equals(bs GameSlice) bool {
 	return true
 }
 
+// assumes slices are sorted
+func (as DiskSlice) Equals(bs DiskSlice) bool {
+	if len(as) != len(bs) {
+		return false
+	}
+
+	for i, ad := range as {
+		if !bs[i].Equals(ad) {
+			return false
+		}
+	}
+	return true
+}
+
+// assumes slices are sorted
+func (as SampleSlice) Equals(bs SampleSlice) bool {
+	if len(as) != len(bs) {
+		return false
+	}
+
+	for i, a := range as {
+		if bs[i].Name != a.Name {
+			return false
+		}
+	}
+	return true
+}
+
 // assumes slices are sorted
 func (as RomSlice) Equals(bs RomSlice) bool {
 	if len(as) != len(bs) {
@@ -135,9 +396,21 @@ func (ag *Game) Equals(bg *Game) bool {
 		return false
 	}
 
+	if ag.CloneOf != bg.CloneOf || ag.RomOf != bg.RomOf || ag.SampleOf != bg.SampleOf {
+		return false
+	}
+
 	if !ag.Roms.Equals(bg.Roms) {
 		return false
 	}
+
+	if !ag.Disks.Equals(bg.Disks) {
+		return false
+	}
+
+	if !ag.Samples.Equals(bg.Samples) {
+		return false
+	}
 	return true
 }
 
@@ -156,26 +429,145 @@ func (ad *Dat) Equals(bd *Dat) bool {
 	return true
 }
 
+// Normalize puts d into the canonical form the rest of romba expects: games
+// from software lists and machines, roms from parts and regions and disks from parts are
+// moved into the main lists, games, roms and disks are sorted by name (see
+// CompareNames) and contents, and identical roms and disks of a game are
+// dropped. Hashes are held as bytes, so their case in the source doesn't
+// matter.
 func (d *Dat) Normalize() {
 	if d.Software != nil {
 		d.Games = append(d.Games, d.Software...)
 		d.Software = nil
 	}
-	sort.Sort(d.Games)
+	if d.Machines != nil {
+		d.Games = append(d.Games, d.Machines...)
+		d.Machines = nil
+	}
+	sort.Stable(d.Games)
 
 	for _, g := range d.Games {
-		if g.Disks != nil {
-			g.Roms = append(g.Roms, g.Disks...)
-			g.Disks = nil
+		g.Normalize()
+	}
+}
+
+// Normalize puts g into the canonical form of games of normalized dats, see
+// Dat.Normalize.
+func (g *Game) Normalize() {
+	if g.PartDisks != nil {
+		g.Disks = append(g.Disks, g.PartDisks...)
+		g.PartDisks = nil
+	}
+	if g.Parts != nil {
+		g.Roms = append(g.Roms, g.Parts...)
+		g.Parts = nil
+	}
+	if g.Regions != nil {
+		g.Roms = append(g.Roms, g.Regions...)
+		g.Regions = nil
+	}
+	sort.Stable(g.Roms)
+	sort.Stable(g.Disks)
+	sort.Stable(g.Samples)
+	g.Roms = g.Roms.dedup()
+	g.Disks = g.Disks.dedup()
+	g.Samples = g.Samples.dedup()
+}
+
+// dedup drops roms identical to one before them with the same name, it
+// assumes s is sorted.
+func (s RomSlice) dedup() RomSlice {
+	if len(s) < 2 {
+		return s
+	}
+
+	kept := s[:1]
+Roms:
+	for _, r := range s[1:] {
+		for i := len(kept) - 1; i >= 0 && kept[i].Name == r.Name; i-- {
+			if kept[i].Equals(r) {
+				continue Roms
+			}
 		}
-		if g.Parts != nil {
-			g.Roms = append(g.Roms, g.Parts...)
-			g.Parts = nil
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+// dedup drops disks identical to the one before them, it assumes s is sorted.
+func (s DiskSlice) dedup() DiskSlice {
+	if len(s) < 2 {
+		return s
+	}
+
+	kept := s[:1]
+	for _, dk := range s[1:] {
+		if !kept[len(kept)-1].Equals(dk) {
+			kept = append(kept, dk)
 		}
-		if g.Regions != nil {
-			g.Roms = append(g.Roms, g.Regions...)
-			g.Regions = nil
+	}
+	return kept
+}
+
+// dedup drops samples named like the one before them, it assumes s is sorted.
+func (s SampleSlice) dedup() SampleSlice {
+	if len(s) < 2 {
+		return s
+	}
+
+	kept := s[:1]
+	for _, sm := range s[1:] {
+		if kept[len(kept)-1].Name != sm.Name {
+			kept = append(kept, sm)
 		}
-		sort.Sort(g.Roms)
 	}
+	return kept
+}
+
+// NameRule rewrites a game, rom or disk name when canonicalizing a dat.
+type NameRule func(name string) string
+
+// Name rules for Canonicalize.
+var (
+	// TrimSpace removes leading and trailing white space.
+	TrimSpace NameRule = strings.TrimSpace
+	// CollapseSpace replaces runs of white space with a single space.
+	CollapseSpace NameRule = func(name string) string {
+		return strings.Join(strings.Fields(name), " ")
+	}
+	// ForwardSlashes replaces backslashes used as path separators by slashes.
+	ForwardSlashes NameRule = func(name string) string {
+		return strings.Replace(name, "\\", "/", -1)
+	}
+)
+
+// Canonicalize applies rules in order to the names of the games, roms and
+// disks of d and normalizes it, so dats that differ only in the form of their
+// names compare, hash and diff the same.
+func (d *Dat) Canonicalize(rules ...NameRule) {
+	rename := func(name string) string {
+		for _, rule := range rules {
+			name = rule(name)
+		}
+		return name
+	}
+
+	for _, games := range d.gameLists() {
+		for _, g := range games {
+			g.Name = rename(g.Name)
+			for _, roms := range []RomSlice{g.Roms, g.Parts, g.Regions} {
+				for _, r := range roms {
+					r.Name = rename(r.Name)
+				}
+			}
+			for _, disks := range []DiskSlice{g.Disks, g.PartDisks} {
+				for _, dk := range disks {
+					dk.Name = rename(dk.Name)
+					dk.rom = nil
+				}
+			}
+		}
+	}
+
+	d.Normalize()
 }
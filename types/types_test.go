@@ -0,0 +1,76 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	newDat := func(names ...string) *Dat {
+		d := &Dat{Name: "test"}
+		for _, name := range names {
+			g := &Game{Name: " game  " + name}
+			g.Roms = RomSlice{
+				&Rom{Name: `dir\b.bin`, Size: 2, Crc: []byte{0, 0, 0, 2}},
+				&Rom{Name: "a.bin", Size: 1, Crc: []byte{0, 0, 0, 1}},
+				&Rom{Name: "a.bin ", Size: 1, Crc: []byte{0, 0, 0, name[0] - '0'}},
+			}
+			d.Games = append(d.Games, g)
+		}
+		return d
+	}
+
+	d := newDat("2", "1")
+	d.Canonicalize(TrimSpace, CollapseSpace, ForwardSlashes)
+
+	if d.Games[0].Name != "game 1" || d.Games[1].Name != "game 2" {
+		t.Fatalf("games not renamed and sorted: %s", PrintDat(d))
+	}
+
+	// game 1 has a.bin twice with the same contents
+	roms := d.Games[0].Roms
+	if len(roms) != 2 || roms[0].Name != "a.bin" || roms[1].Name != "dir/b.bin" {
+		t.Errorf("roms not renamed, sorted and deduplicated: %s", PrintDat(d))
+	}
+
+	// game 2 has a.bin twice with different contents
+	roms = d.Games[1].Roms
+	if len(roms) != 3 || roms[0].Crc[3] != 1 || roms[1].Crc[3] != 2 {
+		t.Errorf("roms with the same name not sorted by contents: %s", PrintDat(d))
+	}
+
+	other := newDat("1", "2")
+	other.Canonicalize(TrimSpace, CollapseSpace, ForwardSlashes)
+	if !bytes.Equal(PrintDat(d), PrintDat(other)) {
+		t.Errorf("canonical forms differ:\n%s\n%s", PrintDat(d), PrintDat(other))
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package worker
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limits restrict the resources of the workers of a job, see WithLimits.
+type Limits struct {
+	// Nice is added to the niceness of the threads of the workers, on the
+	// systems supporting it.
+	Nice int
+	// BytesPerSecond caps the rate at which the workers read the bytes of
+	// their files, no cap if 0.
+	BytesPerSecond int64
+}
+
+// limitedTracker is the ProgressTracker of work run within limits.
+type limitedTracker struct {
+	ProgressTracker
+	limits   Limits
+	throttle *throttle
+}
+
+// WithLimits returns pt for work run within l. Work renices the workers of
+// masters whose ProgressTracker it is by l.Nice, and the workers reading their
+// files through ThrottleReader or ThrottleWait with it share l.BytesPerSecond.
+func WithLimits(pt ProgressTracker, l Limits) ProgressTracker {
+	if l == (Limits{}) {
+		return pt
+	}
+	return &limitedTracker{
+		ProgressTracker: pt,
+		limits:          l,
+		throttle:        newThrottle(l.BytesPerSecond),
+	}
+}
+
+// LimitsOf returns the limits pt was given by WithLimits, none if it wasn't.
+func LimitsOf(pt ProgressTracker) Limits {
+	if lt, ok := pt.(*limitedTracker); ok {
+		return lt.limits
+	}
+	return Limits{}
+}
+
+func throttleOf(pt ProgressTracker) *throttle {
+	if lt, ok := pt.(*limitedTracker); ok {
+		return lt.throttle
+	}
+	return nil
+}
+
+// ThrottleReader returns r with its reads held back to the BytesPerSecond of
+// the limits of pt, shared by all the reads throttled with pt. r itself is
+// returned if there is no such limit.
+func ThrottleReader(pt ProgressTracker, r io.Reader) io.Reader {
+	t := throttleOf(pt)
+	if t == nil {
+		return r
+	}
+	return &throttledReader{r: r, t: t}
+}
+
+// ThrottleWait sleeps until n more bytes read are due at the BytesPerSecond of
+// the limits of pt, for readers ThrottleReader can't wrap.
+func ThrottleWait(pt ProgressTracker, n int) {
+	throttleOf(pt).wait(int64(n))
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.t.wait(int64(n))
+	return n, err
+}
+
+// throttle holds readers back to a rate of bytes shared by all of them.
+type throttle struct {
+	lock  sync.Mutex
+	rate  int64
+	start time.Time
+	total int64
+}
+
+func newThrottle(rate int64) *throttle {
+	if rate <= 0 {
+		return nil
+	}
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait sleeps until n more bytes are due.
+func (t *throttle) wait(n int64) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	t.total += n
+	due := t.start.Add(time.Duration(float64(t.total) / float64(t.rate) * float64(time.Second)))
+	t.lock.Unlock()
+
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
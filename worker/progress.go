@@ -38,6 +38,9 @@ type ProgressTracker interface {
 	SetTotalBytes(value int64)
 	SetTotalFiles(value int32)
 	AddBytesFromFile(value int64)
+	// AddSkipped records the file at path as skipped for reason, with the
+	// error it failed with if any.
+	AddSkipped(path, reason string, err error)
 	Finished()
 	Reset()
 	GetProgress() *Progress
@@ -48,7 +51,11 @@ type Progress struct {
 	TotalFiles int32
 	BytesSoFar int64
 	FilesSoFar int32
-	m          *sync.Mutex
+	// Skipped counts the files skipped by reason, SkippedFiles lists up to
+	// MaxSkippedFiles of them.
+	Skipped      map[string]int64 `json:",omitempty"`
+	SkippedFiles []SkippedFile    `json:",omitempty"`
+	m            *sync.Mutex
 }
 
 func NewProgressTracker() ProgressTracker {
@@ -73,6 +80,20 @@ func (pt *Progress) AddBytesFromFile(value int64) {
 	pt.FilesSoFar++
 }
 
+func (pt *Progress) AddSkipped(path, reason string, err error) {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+
+	if pt.Skipped == nil {
+		pt.Skipped = make(map[string]int64)
+	}
+	pt.Skipped[reason]++
+
+	if len(pt.SkippedFiles) < MaxSkippedFiles {
+		pt.SkippedFiles = append(pt.SkippedFiles, newSkippedFile(path, reason, err))
+	}
+}
+
 func (pt *Progress) Finished() {
 	pt.BytesSoFar = pt.TotalBytes
 	pt.FilesSoFar = pt.TotalFiles
@@ -83,6 +104,11 @@ func (pt *Progress) Reset() {
 	pt.TotalFiles = 0
 	pt.BytesSoFar = 0
 	pt.FilesSoFar = 0
+
+	pt.m.Lock()
+	pt.Skipped = nil
+	pt.SkippedFiles = nil
+	pt.m.Unlock()
 }
 
 func (pt *Progress) GetProgress() *Progress {
@@ -94,5 +120,12 @@ func (pt *Progress) GetProgress() *Progress {
 	p.TotalFiles = pt.TotalFiles
 	p.BytesSoFar = pt.BytesSoFar
 	p.FilesSoFar = pt.FilesSoFar
+	if len(pt.Skipped) > 0 {
+		p.Skipped = make(map[string]int64, len(pt.Skipped))
+		for reason, n := range pt.Skipped {
+			p.Skipped[reason] = n
+		}
+		p.SkippedFiles = append([]SkippedFile(nil), pt.SkippedFiles...)
+	}
 	return p
 }
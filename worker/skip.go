@@ -0,0 +1,160 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Reasons files are skipped for by Work, besides those given to Skip.
+const (
+	// SkipRejected files weren't accepted by the master.
+	SkipRejected = "rejected"
+	// SkipUnreadable files or directories failed to be read while walking
+	// the paths.
+	SkipUnreadable = "unreadable"
+	// SkipFailed files failed to be processed.
+	SkipFailed = "failed"
+)
+
+// MaxSkippedFiles is how many skipped files a Progress lists.
+const MaxSkippedFiles = 1000
+
+// SkipError is returned by Process for files left out on purpose.
+type SkipError struct {
+	Reason string
+}
+
+func (e *SkipError) Error() string {
+	return "skipped: " + e.Reason
+}
+
+// Skip returns the error Process returns for a file it leaves out on
+// purpose, counted as skipped for reason instead of as failed.
+func Skip(reason string) error {
+	return &SkipError{Reason: reason}
+}
+
+// SkippedFile is a file Work skipped.
+type SkippedFile struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newSkippedFile(path, reason string, err error) SkippedFile {
+	sf := SkippedFile{Path: path, Reason: reason}
+	if err != nil {
+		sf.Error = err.Error()
+	}
+	return sf
+}
+
+func (sf SkippedFile) String() string {
+	if sf.Error != "" {
+		return fmt.Sprintf("%s\t%s: %s", sf.Path, sf.Reason, sf.Error)
+	}
+	return fmt.Sprintf("%s\t%s", sf.Path, sf.Reason)
+}
+
+// skipCounter counts the files skipped by one Work.
+type skipCounter struct {
+	lock   sync.Mutex
+	counts map[string]int64
+	files  []SkippedFile
+	pt     ProgressTracker
+}
+
+func newSkipCounter(pt ProgressTracker) *skipCounter {
+	return &skipCounter{
+		counts: make(map[string]int64),
+		pt:     pt,
+	}
+}
+
+func (sc *skipCounter) add(path, reason string, err error) {
+	sc.lock.Lock()
+	sc.counts[reason]++
+	if len(sc.files) < MaxSkippedFiles {
+		sc.files = append(sc.files, newSkippedFile(path, reason, err))
+	}
+	sc.lock.Unlock()
+
+	sc.pt.AddSkipped(path, reason, err)
+}
+
+// SkipSummary returns the number of files skipped by reason as text, empty
+// if none were.
+func SkipSummary(counts map[string]int64) string {
+	var total int64
+	reasons := make([]string, 0, len(counts))
+	for reason, n := range counts {
+		total += n
+		reasons = append(reasons, reason)
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.Strings(reasons)
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "skipped %d files (", total)
+	for i, reason := range reasons {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(buf, "%s: %d", reason, counts[reason])
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
+
+// snapshot returns a copy of the counts and of the files listed.
+func (sc *skipCounter) snapshot() (map[string]int64, []SkippedFile) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	counts := make(map[string]int64, len(sc.counts))
+	for reason, n := range sc.counts {
+		counts[reason] = n
+	}
+	return counts, append([]SkippedFile(nil), sc.files...)
+}
+
+func (sc *skipCounter) summary() string {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	return SkipSummary(sc.counts)
+}
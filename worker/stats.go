@@ -0,0 +1,82 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package worker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are counters over all the workers run since the process started.
+type Stats struct {
+	// Workers is the number of workers currently running, Busy how many
+	// of them are processing a file right now.
+	Workers int64
+	Busy    int64
+	// Processed and Failed count the files handed to workers.
+	Processed int64
+	Failed    int64
+	// BusyTime is the total time workers spent processing files.
+	BusyTime time.Duration
+}
+
+var stats struct {
+	workers   int64
+	busy      int64
+	processed int64
+	failed    int64
+	busyNanos int64
+}
+
+// CurrentStats returns the worker counters as of now.
+func CurrentStats() Stats {
+	return Stats{
+		Workers:   atomic.LoadInt64(&stats.workers),
+		Busy:      atomic.LoadInt64(&stats.busy),
+		Processed: atomic.LoadInt64(&stats.processed),
+		Failed:    atomic.LoadInt64(&stats.failed),
+		BusyTime:  time.Duration(atomic.LoadInt64(&stats.busyNanos)),
+	}
+}
+
+func processCounted(w Worker, path string, size int64) error {
+	atomic.AddInt64(&stats.busy, 1)
+	start := time.Now()
+
+	err := w.Process(path, size)
+
+	atomic.AddInt64(&stats.busyNanos, int64(time.Since(start)))
+	atomic.AddInt64(&stats.busy, -1)
+	atomic.AddInt64(&stats.processed, 1)
+	if _, skipped := err.(*SkipError); err != nil && !skipped {
+		atomic.AddInt64(&stats.failed, 1)
+	}
+	return err
+}
@@ -35,17 +35,22 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/logging"
 )
 
+var logger = logging.For("worker")
+
 type countVisitor struct {
 	numBytes       int64
 	numFiles       int
 	commonRootPath string
 	master         Master
+	skips          *skipCounter
 }
 
 func commonRoot(pa, pb string) string {
@@ -101,10 +106,18 @@ func commonRoot(pa, pb string) string {
 }
 
 func (cv *countVisitor) visit(path string, f os.FileInfo, err error) error {
+	if err != nil {
+		logger.Warningf("skipping %s: %v", path, err)
+		cv.skips.add(path, SkipUnreadable, err)
+	}
 	if f == nil || f.Name() == ".DS_Store" {
 		return nil
 	}
-	if !f.IsDir() && cv.master.Accept(path) {
+	if !f.IsDir() && !cv.master.Accept(path) {
+		cv.skips.add(path, SkipRejected, nil)
+		return nil
+	}
+	if !f.IsDir() {
 		cv.numFiles += 1
 		cv.numBytes += f.Size()
 		if cv.commonRootPath == "" {
@@ -135,6 +148,8 @@ func (sv *scanVisitor) visit(path string, f os.FileInfo, err error) error {
 }
 
 type Worker interface {
+	// Process processes the file at path. Files left out on purpose are
+	// reported by returning the error of Skip.
 	Process(path string, size int64) error
 	Close() error
 }
@@ -146,7 +161,35 @@ type Master interface {
 	ProgressTracker() ProgressTracker
 	FinishUp() error
 	Start() error
-	Scanned(numFiles int, numBytes int64, commonRootPath string)
+	// Scanned is called once the amount of work is known, before any of it
+	// is done. Returning an error aborts the work.
+	Scanned(numFiles int, numBytes int64, commonRootPath string) error
+}
+
+// Walker is implemented by masters whose paths aren't all local directories,
+// to walk them instead of filepath.Walk. Work passes them their paths as
+// given, without making them absolute.
+type Walker interface {
+	Walk(root string, walkFn filepath.WalkFunc) error
+}
+
+// Result is what Work did.
+type Result struct {
+	// Message sums up the work, as logged at its end.
+	Message string
+	// Files and Bytes are the amount of work found by the initial scan.
+	Files int
+	Bytes int64
+	// Elapsed is how long the work took.
+	Elapsed time.Duration
+	// Skipped counts the files skipped by reason, see SkipError, and
+	// SkippedFiles lists up to MaxSkippedFiles of them.
+	Skipped      map[string]int64
+	SkippedFiles []SkippedFile
+}
+
+func (r *Result) String() string {
+	return r.Message
 }
 
 type workUnit struct {
@@ -157,18 +200,34 @@ type workUnit struct {
 type slave struct {
 	closeC chan error
 	pt     ProgressTracker
+	skips  *skipCounter
 	worker Worker
+	// nice is added to the niceness of the worker, see Limits
+	nice int
 }
 
 func runSlave(w *slave, inwork <-chan *workUnit, workerNum int, workname string) {
-	glog.Infof("starting worker %d for %s", workerNum, workname)
+	logger.Infof("starting worker %d for %s", workerNum, workname)
+	atomic.AddInt64(&stats.workers, 1)
+	defer atomic.AddInt64(&stats.workers, -1)
+
+	if w.nice != 0 {
+		err := reniceThread(w.nice)
+		if err != nil {
+			logger.Warningf("failed to renice worker %d by %d: %v", workerNum, w.nice, err)
+		}
+	}
+
 	var perr error
 	for wu := range inwork {
 		path := wu.path
 
-		err := w.worker.Process(path, wu.size)
-		if err != nil {
-			glog.Errorf("failed to process %s: %v", path, err)
+		err := processCounted(w.worker, path, wu.size)
+		if se, ok := err.(*SkipError); ok {
+			w.skips.add(path, se.Reason, nil)
+		} else if err != nil {
+			logger.Errorf("failed to process %s: %v", path, err)
+			w.skips.add(path, SkipFailed, err)
 			if perr == nil {
 				perr = err
 			}
@@ -179,51 +238,77 @@ func runSlave(w *slave, inwork <-chan *workUnit, workerNum int, workname string)
 
 	err := w.worker.Close()
 	if err != nil {
-		glog.Errorf("failed to close worker: %v", err)
+		logger.Errorf("failed to close worker: %v", err)
 	}
 
 	w.closeC <- perr
-	glog.Infof("exiting worker %d for %s", workerNum, workname)
+	logger.Infof("exiting worker %d for %s", workerNum, workname)
 }
 
-func Work(workname string, paths []string, master Master) (string, error) {
+// Work runs the workers of master on the files below paths it accepts. It
+// returns the Result of the work even if it fails, with what was done until
+// then.
+func Work(workname string, paths []string, master Master) (*Result, error) {
 	pt := master.ProgressTracker()
 
-	glog.Infof("starting %s\n", workname)
+	logger.Infof("starting %s\n", workname)
 	startTime := time.Now()
 
+	res := new(Result)
+	skips := newSkipCounter(pt)
+	defer func() {
+		res.Elapsed = time.Since(startTime)
+		res.Skipped, res.SkippedFiles = skips.snapshot()
+	}()
+
 	err := master.Start()
 	if err != nil {
-		glog.Errorf("failed to start master: %v\n", err)
-		return "", err
+		logger.Errorf("failed to start master: %v\n", err)
+		return res, err
 	}
 
 	cv := new(countVisitor)
 	cv.master = master
+	cv.skips = skips
+
+	walk := filepath.Walk
+	walker, ownPaths := master.(Walker)
+	if ownPaths {
+		walk = walker.Walk
+	}
 
 	for k, name := range paths {
-		if !filepath.IsAbs(name) {
+		if !ownPaths && !filepath.IsAbs(name) {
 			absname, err := filepath.Abs(name)
 			if err != nil {
-				return "", err
+				return res, err
 			}
 			paths[k] = absname
 		}
 	}
 
 	for _, name := range paths {
-		glog.Infof("initial scan of %s to determine amount of work\n", name)
+		logger.Infof("initial scan of %s to determine amount of work\n", name)
 
-		err := filepath.Walk(name, cv.visit)
+		err := walk(name, cv.visit)
 		if err != nil {
-			glog.Errorf("failed to count in dir %s: %v\n", name, err)
-			return "", err
+			logger.Errorf("failed to count in dir %s: %v\n", name, err)
+			return res, err
 		}
 	}
 
-	glog.Infof("found %d files and %s to do. starting work...\n", cv.numFiles, humanize.Bytes(uint64(cv.numBytes)))
+	logger.Infof("found %d files and %s to do. starting work...\n", cv.numFiles, humanize.Bytes(uint64(cv.numBytes)))
+	res.Files = cv.numFiles
+	res.Bytes = cv.numBytes
 
-	master.Scanned(cv.numFiles, cv.numBytes, cv.commonRootPath)
+	err = master.Scanned(cv.numFiles, cv.numBytes, cv.commonRootPath)
+	if err != nil {
+		logger.Errorf("aborting %s: %v\n", workname, err)
+		if ferr := master.FinishUp(); ferr != nil {
+			logger.Errorf("failed to finish up master: %v\n", ferr)
+		}
+		return res, err
+	}
 
 	pt.SetTotalBytes(cv.numBytes)
 	pt.SetTotalFiles(int32(cv.numFiles))
@@ -237,32 +322,36 @@ func Work(workname string, paths []string, master Master) (string, error) {
 
 	closeC := make(chan error, master.NumWorkers())
 
+	limits := LimitsOf(pt)
+
 	for i := 0; i < master.NumWorkers(); i++ {
 		worker := &slave{
 			pt:     pt,
+			skips:  skips,
 			worker: master.NewWorker(i),
 			closeC: closeC,
+			nice:   limits.Nice,
 		}
 
 		go runSlave(worker, inwork, i, workname)
 	}
 
 	for _, name := range paths {
-		err := filepath.Walk(name, sv.visit)
+		err := walk(name, sv.visit)
 		if err != nil {
-			glog.Errorf("failed to scan dir %s: %v\n", name, err)
+			logger.Errorf("failed to scan dir %s: %v\n", name, err)
 
 			close(inwork)
 			pt.Finished()
 
-			glog.Infof("Flushing workers and closing work. Hang in there...\n")
+			logger.Infof("Flushing workers and closing work. Hang in there...\n")
 			for i := 0; i < master.NumWorkers(); i++ {
 				perr := <-closeC
 				if perr != nil {
-					glog.Errorf("master found worker error %v", perr)
+					logger.Errorf("master found worker error %v", perr)
 				}
 			}
-			return "", err
+			return res, err
 		}
 	}
 
@@ -272,7 +361,7 @@ func Work(workname string, paths []string, master Master) (string, error) {
 	for i := 0; i < master.NumWorkers(); i++ {
 		err := <-closeC
 		if err != nil {
-			glog.Errorf("master found worker error %v", err)
+			logger.Errorf("master found worker error %v", err)
 			if perr == nil {
 				perr = err
 			}
@@ -283,25 +372,29 @@ func Work(workname string, paths []string, master Master) (string, error) {
 
 	err = master.FinishUp()
 	if err != nil {
-		glog.Errorf("failed to finish up master: %v\n", err)
-		return "", err
+		logger.Errorf("failed to finish up master: %v\n", err)
+		return res, err
 	}
 
 	if perr != nil {
-		glog.Infof("Failed due to worker errors.\n")
+		logger.Infof("Failed due to worker errors.\n")
 
 		var endMsg bytes.Buffer
 
-		endMsg.WriteString(fmt.Sprintf("error processing %s: \n", workname, perr))
+		endMsg.WriteString(fmt.Sprintf("error processing %s: %v\n", workname, perr))
+		if sm := skips.summary(); sm != "" {
+			endMsg.WriteString(sm + "\n")
+		}
 
 		endS := endMsg.String()
 
-		glog.Info(endS)
+		logger.Info(endS)
 
-		return endS, perr
+		res.Message = endS
+		return res, perr
 	}
 
-	glog.Infof("Done.\n")
+	logger.Infof("Done.\n")
 
 	elapsed := time.Since(startTime)
 
@@ -315,12 +408,16 @@ func Work(workname string, paths []string, master Master) (string, error) {
 	ts := uint64(float64(cv.numBytes) / float64(elapsed.Seconds()))
 
 	endMsg.WriteString(fmt.Sprintf("throughput: %s/s \n", humanize.Bytes(ts)))
+	if sm := skips.summary(); sm != "" {
+		endMsg.WriteString(sm + "\n")
+	}
 
 	endS := endMsg.String()
 
-	glog.Info(endS)
+	logger.Info(endS)
 
-	return endS, nil
+	res.Message = endS
+	return res, nil
 }
 
 func formatDuration(d time.Duration) string {
@@ -31,7 +31,14 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package worker
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func executeTestCommonRoot(pa, pb, expected string, t *testing.T) {
@@ -54,3 +61,116 @@ func TestCommonRoot(t *testing.T) {
 	executeTestCommonRoot("/a", "/", "/", t)
 	executeTestCommonRoot("/", "", "", t)
 }
+
+func TestThrottle(t *testing.T) {
+	if newThrottle(0) != nil {
+		t.Errorf("got a throttle without a rate")
+	}
+
+	th := newThrottle(1000)
+	start := time.Now()
+	th.wait(100)
+	th.wait(100)
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("200 bytes at 1000 bytes per second took %v", elapsed)
+	}
+}
+
+func TestWithLimits(t *testing.T) {
+	pt := NewProgressTracker()
+	if WithLimits(pt, Limits{}) != pt || LimitsOf(pt) != (Limits{}) {
+		t.Errorf("got limits without any")
+	}
+
+	r := strings.NewReader("0123456789")
+	if ThrottleReader(pt, r) != io.Reader(r) {
+		t.Errorf("throttled a reader without a rate")
+	}
+
+	l := Limits{Nice: 5, BytesPerSecond: 100}
+	lpt := WithLimits(pt, l)
+	if got := LimitsOf(lpt); got != l {
+		t.Errorf("got limits %+v, want %+v", got, l)
+	}
+
+	// the reads are charged as they happen, shared by all the readers
+	start := time.Now()
+	buf := make([]byte, 5)
+	for _, tr := range []io.Reader{ThrottleReader(lpt, r), ThrottleReader(lpt, r)} {
+		_, err := io.ReadFull(tr, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("10 bytes at 100 bytes per second took %v", elapsed)
+	}
+}
+
+type skipTestMaster struct {
+	pt ProgressTracker
+}
+
+func (m *skipTestMaster) Accept(path string) bool          { return filepath.Ext(path) == ".dat" }
+func (m *skipTestMaster) NewWorker(workerIndex int) Worker { return m }
+func (m *skipTestMaster) NumWorkers() int                  { return 2 }
+func (m *skipTestMaster) ProgressTracker() ProgressTracker { return m.pt }
+func (m *skipTestMaster) FinishUp() error                  { return nil }
+func (m *skipTestMaster) Start() error                     { return nil }
+func (m *skipTestMaster) Close() error                     { return nil }
+
+func (m *skipTestMaster) Scanned(numFiles int, numBytes int64, commonRootPath string) error {
+	return nil
+}
+
+func (m *skipTestMaster) Process(path string, size int64) error {
+	switch filepath.Base(path) {
+	case "old.dat":
+		return Skip("too old")
+	case "bad.dat":
+		return fmt.Errorf("bad dat")
+	}
+	return nil
+}
+
+func TestWorkSkips(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba-worker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, name := range []string{"good.dat", "old.dat", "bad.dat", "readme.txt", "notes.txt"} {
+		err = ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pt := NewProgressTracker()
+	res, err := Work("skip test", []string{root, filepath.Join(root, "missing")}, &skipTestMaster{pt: pt})
+	if err == nil || err.Error() != "bad dat" {
+		t.Errorf("got error %v, want bad dat", err)
+	}
+
+	want := "skipped 5 files (failed: 1, rejected: 2, too old: 1, unreadable: 1)"
+	if !strings.Contains(res.Message, want) {
+		t.Errorf("got message %q, want it to contain %q", res.Message, want)
+	}
+	if res.Files != 3 || res.Skipped[SkipRejected] != 2 || res.Skipped["too old"] != 1 || len(res.SkippedFiles) != 5 {
+		t.Errorf("got result %+v", res)
+	}
+
+	p := pt.GetProgress()
+	if p.Skipped[SkipRejected] != 2 || p.Skipped["too old"] != 1 || p.Skipped[SkipFailed] != 1 {
+		t.Errorf("got skipped %v", p.Skipped)
+	}
+	if len(p.SkippedFiles) != 5 {
+		t.Fatalf("got skipped files %v, want 5", p.SkippedFiles)
+	}
+	for _, sf := range p.SkippedFiles {
+		if sf.Reason == SkipFailed && (filepath.Base(sf.Path) != "bad.dat" || sf.Error != "bad dat") {
+			t.Errorf("got failed file %v, want bad.dat", sf)
+		}
+	}
+}